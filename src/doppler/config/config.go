@@ -11,23 +11,49 @@ import (
 
 const HeartbeatInterval = 10 * time.Second
 
+// DefaultSyslogDrainSyncIntervalSeconds is the syslog drain sync interval of
+// configs that do not set one.
+const DefaultSyslogDrainSyncIntervalSeconds = 60
+
 type Config struct {
 	cfcomponent.Config
-	EtcdUrls                      []string
-	EtcdMaxConcurrentRequests     int
-	Index                         uint
-	DropsondeIncomingMessagesPort uint32
-	OutgoingPort                  uint32
-	LogFilePath                   string
-	MaxRetainedLogMessages        uint32
-	WSMessageBufferSize           uint
-	SharedSecret                  string
-	SkipCertVerify                bool
-	BlackListIps                  []iprange.IPRange
-	JobName                       string
-	Zone                          string
-	ContainerMetricTTLSeconds     int
-	SinkInactivityTimeoutSeconds  int
+	EtcdUrls                             []string
+	EtcdMaxConcurrentRequests            int
+	Index                                uint
+	DropsondeIncomingMessagesPort        uint32
+	DropsondeTCPIncomingMessagesPort     uint32
+	DropsondeTLSIncomingMessagesPort     uint32
+	DropsondeTLSCertFile                 string
+	DropsondeTLSKeyFile                  string
+	DropsondeTLSCAFile                   string
+	DropsondeWSIncomingMessagesPort      uint32
+	DropsondeWSTLS                       bool
+	OutgoingPort                         uint32
+	LogFilePath                          string
+	MaxRetainedLogMessages               uint32
+	WSMessageBufferSize                  uint
+	SharedSecret                         string
+	SkipCertVerify                       bool
+	BlackListIps                         []iprange.IPRange
+	JobName                              string
+	Zone                                 string
+	ContainerMetricTTLSeconds            int
+	SinkInactivityTimeoutSeconds         int
+	SinkErrorNotificationIntervalSeconds int
+	MessageRouterWorkers                 int
+	SinkDropMetricsIntervalSeconds       int
+	MaxSinkDropMetricSeries              int
+	SyslogKeepAliveSeconds               int
+	SyslogWriteTimeoutSeconds            int
+	SyslogResolveIntervalSeconds         int
+	SyslogDrainSyncIntervalSeconds       int
+	SinkBufferMemoryBudgetMegabytes      int
+	SinkBufferMinSize                    uint
+	SinkBufferMaxSize                    uint
+	SinkBufferSampleIntervalSeconds      int
+	SyslogUdpMaxDatagramSize             int
+	HealthPort                           uint32
+	HealthIntervalSeconds                int
 }
 
 func (c *Config) Validate(logger *gosteno.Logger) (err error) {
@@ -35,6 +61,34 @@ func (c *Config) Validate(logger *gosteno.Logger) (err error) {
 		return errors.New("Need max number of log messages to retain per application")
 	}
 
+	if c.SyslogDrainSyncIntervalSeconds == 0 {
+		c.SyslogDrainSyncIntervalSeconds = DefaultSyslogDrainSyncIntervalSeconds
+	}
+	if c.SyslogDrainSyncIntervalSeconds < 0 {
+		return errors.New("Need a positive syslog drain sync interval")
+	}
+
+	if c.SinkBufferMemoryBudgetMegabytes > 0 {
+		if c.SinkBufferMinSize < 2 || c.SinkBufferMaxSize < c.SinkBufferMinSize {
+			return errors.New("Need a sink buffer min size of at least 2 and a max size no smaller than the min size when adaptive sink buffers are enabled")
+		}
+		if c.SinkBufferSampleIntervalSeconds <= 0 {
+			return errors.New("Need a positive sink buffer sample interval when adaptive sink buffers are enabled")
+		}
+	}
+
+	if c.HealthPort != 0 && c.HealthIntervalSeconds <= 0 {
+		return errors.New("Need a positive health interval when the health endpoint is enabled")
+	}
+
+	if c.DropsondeTLSIncomingMessagesPort != 0 && (c.DropsondeTLSCertFile == "" || c.DropsondeTLSKeyFile == "" || c.DropsondeTLSCAFile == "") {
+		return errors.New("Need a certificate, key and CA file when the dropsonde TLS listener is enabled")
+	}
+
+	if c.DropsondeWSIncomingMessagesPort != 0 && c.DropsondeWSTLS && (c.DropsondeTLSCertFile == "" || c.DropsondeTLSKeyFile == "" || c.DropsondeTLSCAFile == "") {
+		return errors.New("Need a certificate, key and CA file when the dropsonde websocket listener requires TLS")
+	}
+
 	if c.BlackListIps != nil {
 		err = iprange.ValidateIpAddresses(c.BlackListIps)
 		if err != nil {
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
 	"doppler/config"
+	"doppler/drainwatcher"
+	"doppler/health"
 	"doppler/sinkserver"
 	"doppler/sinkserver/blacklist"
 	"doppler/sinkserver/sinkmanager"
 	"doppler/sinkserver/websocketserver"
+	"doppler/tcplistener"
+	"doppler/truncatingbuffer"
+	"doppler/udplistener"
+	"doppler/unbatcher"
+	"doppler/websocketlistener"
 	"fmt"
 	"sync"
 	"time"
@@ -14,31 +22,37 @@ import (
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/dropsonde/signature"
 	"github.com/cloudfoundry/gosteno"
-	"github.com/cloudfoundry/loggregatorlib/agentlistener"
 	"github.com/cloudfoundry/loggregatorlib/appservice"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
-	"github.com/cloudfoundry/loggregatorlib/store"
-	"github.com/cloudfoundry/loggregatorlib/store/cache"
 	"github.com/cloudfoundry/storeadapter"
 )
 
 type Doppler struct {
 	*gosteno.Logger
-	appStoreWatcher *store.AppServiceStoreWatcher
+	appStoreWatcher *drainwatcher.DrainWatcher
 
 	errChan           chan error
-	dropsondeListener agentlistener.AgentListener
+	dropsondeListener *udplistener.UDPListener
+	sequenceTracker   *udplistener.SequenceTracker
 	sinkManager       *sinkmanager.SinkManager
 	messageRouter     *sinkserver.MessageRouter
 	websocketServer   *websocketserver.WebsocketServer
+	healthServer      *health.Server
+	bufferSupervisor  *truncatingbuffer.SizeSupervisor
+	tcpListener       *tcplistener.TCPListener
+	tlsListener       *tcplistener.TCPListener
+	websocketListener *websocketlistener.WebsocketListener
 
 	dropsondeUnmarshaller      dropsonde_unmarshaller.DropsondeUnmarshaller
 	dropsondeBytesChan         <-chan []byte
+	streamBytesChans           []<-chan []byte
 	dropsondeVerifiedBytesChan chan []byte
+	unbatchedBytesChan         chan []byte
 	envelopeChan               chan *events.Envelope
 	wrappedEnvelopeChan        chan *events.Envelope
 	signatureVerifier          signature.SignatureVerifier
+	unbatcher                  *unbatcher.Unbatcher
 
 	storeAdapter storeadapter.StoreAdapter
 
@@ -51,10 +65,42 @@ func New(host string, config *config.Config, logger *gosteno.Logger, storeAdapte
 	cfcomponent.Logger = logger
 	keepAliveInterval := 30 * time.Second
 
-	appStoreCache := cache.NewAppServiceCache()
-	appStoreWatcher, newAppServiceChan, deletedAppServiceChan := store.NewAppServiceStoreWatcher(storeAdapter, appStoreCache)
+	syslogDrainSyncInterval := time.Duration(config.SyslogDrainSyncIntervalSeconds) * time.Second
+	appStoreWatcher, newAppServiceChan, deletedAppServiceChan := drainwatcher.New(storeAdapter, syslogDrainSyncInterval, logger)
 
-	dropsondeListener, dropsondeBytesChan := agentlistener.NewAgentListener(fmt.Sprintf("%s:%d", host, config.DropsondeIncomingMessagesPort), logger, "dropsondeListener")
+	sequenceTracker := udplistener.NewSequenceTracker(logger)
+	dropsondeListener, dropsondeBytesChan := udplistener.New(fmt.Sprintf("%s:%d", host, config.DropsondeIncomingMessagesPort), sequenceTracker, logger, "dropsondeListener")
+
+	var streamBytesChans []<-chan []byte
+	var tcpListener, tlsListener *tcplistener.TCPListener
+	if config.DropsondeTCPIncomingMessagesPort != 0 {
+		var tcpBytesChan <-chan []byte
+		tcpListener, tcpBytesChan = tcplistener.New(fmt.Sprintf("%s:%d", host, config.DropsondeTCPIncomingMessagesPort), nil, logger, "dropsondeTCPListener")
+		streamBytesChans = append(streamBytesChans, tcpBytesChan)
+	}
+	if config.DropsondeTLSIncomingMessagesPort != 0 {
+		tlsConfig, err := tcplistener.NewServerTLSConfig(config.DropsondeTLSCertFile, config.DropsondeTLSKeyFile, config.DropsondeTLSCAFile)
+		if err != nil {
+			logger.Fatalf("Startup: Error loading the dropsonde TLS listener certificates: %s", err)
+		}
+		var tlsBytesChan <-chan []byte
+		tlsListener, tlsBytesChan = tcplistener.New(fmt.Sprintf("%s:%d", host, config.DropsondeTLSIncomingMessagesPort), tlsConfig, logger, "dropsondeTLSListener")
+		streamBytesChans = append(streamBytesChans, tlsBytesChan)
+	}
+	var websocketListener *websocketlistener.WebsocketListener
+	if config.DropsondeWSIncomingMessagesPort != 0 {
+		var tlsConfig *tls.Config
+		if config.DropsondeWSTLS {
+			var err error
+			tlsConfig, err = tcplistener.NewServerTLSConfig(config.DropsondeTLSCertFile, config.DropsondeTLSKeyFile, config.DropsondeTLSCAFile)
+			if err != nil {
+				logger.Fatalf("Startup: Error loading the dropsonde websocket listener certificates: %s", err)
+			}
+		}
+		var websocketBytesChan <-chan []byte
+		websocketListener, websocketBytesChan = websocketlistener.New(fmt.Sprintf("%s:%d", host, config.DropsondeWSIncomingMessagesPort), tlsConfig, logger, "dropsondeWebsocketListener")
+		streamBytesChans = append(streamBytesChans, websocketBytesChan)
+	}
 
 	signatureVerifier := signature.NewSignatureVerifier(logger, config.SharedSecret)
 	dropsondeUnmarshaller := dropsonde_unmarshaller.NewDropsondeUnmarshaller(logger)
@@ -62,24 +108,67 @@ func New(host string, config *config.Config, logger *gosteno.Logger, storeAdapte
 	blacklist := blacklist.New(config.BlackListIps)
 	metricTTL := time.Duration(config.ContainerMetricTTLSeconds) * time.Second
 	sinkTimeout := time.Duration(config.SinkInactivityTimeoutSeconds) * time.Second
-	sinkManager := sinkmanager.New(config.MaxRetainedLogMessages, config.SkipCertVerify, blacklist, logger, dropsondeOrigin, sinkTimeout, metricTTL)
+	errorNotificationInterval := time.Duration(config.SinkErrorNotificationIntervalSeconds) * time.Second
+	dropMetricsInterval := time.Duration(config.SinkDropMetricsIntervalSeconds) * time.Second
+	sinkManager := sinkmanager.New(config.MaxRetainedLogMessages, config.SkipCertVerify, blacklist, logger, dropsondeOrigin, sinkTimeout, metricTTL, errorNotificationInterval, dropMetricsInterval, config.MaxSinkDropMetricSeries)
+	sinkManager.SetSyslogDrainOptions(sinkmanager.SyslogDrainOptions{
+		KeepAlive:          time.Duration(config.SyslogKeepAliveSeconds) * time.Second,
+		WriteTimeout:       time.Duration(config.SyslogWriteTimeoutSeconds) * time.Second,
+		ResolveInterval:    time.Duration(config.SyslogResolveIntervalSeconds) * time.Second,
+		UdpMaxDatagramSize: config.SyslogUdpMaxDatagramSize,
+	})
+
+	var bufferSupervisor *truncatingbuffer.SizeSupervisor
+	if config.SinkBufferMemoryBudgetMegabytes > 0 {
+		memoryBudget := uint64(config.SinkBufferMemoryBudgetMegabytes) * 1024 * 1024
+		sampleInterval := time.Duration(config.SinkBufferSampleIntervalSeconds) * time.Second
+		bufferSupervisor = truncatingbuffer.NewSizeSupervisor(memoryBudget, config.SinkBufferMinSize, config.SinkBufferMaxSize, sampleInterval, logger)
+		sinkManager.SetBufferSizer(bufferSupervisor)
+	}
+
+	sinkManagerRouter := sinkserver.NewMessageRouter(sinkManager, config.MessageRouterWorkers, logger)
+
+	var healthServer *health.Server
+	if config.HealthPort != 0 {
+		healthInterval := time.Duration(config.HealthIntervalSeconds) * time.Second
+		healthServer = health.NewServer(fmt.Sprintf("127.0.0.1:%d", config.HealthPort), healthInterval, sinkManagerRouter, sinkManager, logger)
+		healthServer.SetListener("udp", dropsondeListener)
+		if tcpListener != nil {
+			healthServer.SetListener("tcp", tcpListener)
+		}
+		if tlsListener != nil {
+			healthServer.SetListener("tls", tlsListener)
+		}
+		if websocketListener != nil {
+			healthServer.SetListener("websocket", websocketListener)
+		}
+	}
 
 	return &Doppler{
 		Logger:                     logger,
 		dropsondeListener:          dropsondeListener,
+		sequenceTracker:            sequenceTracker,
 		sinkManager:                sinkManager,
-		messageRouter:              sinkserver.NewMessageRouter(sinkManager, logger),
+		messageRouter:              sinkManagerRouter,
+		healthServer:               healthServer,
+		bufferSupervisor:           bufferSupervisor,
+		tcpListener:                tcpListener,
+		tlsListener:                tlsListener,
+		websocketListener:          websocketListener,
 		websocketServer:            websocketserver.New(fmt.Sprintf("%s:%d", host, config.OutgoingPort), sinkManager, keepAliveInterval, config.WSMessageBufferSize, dropsondeOrigin, logger),
 		newAppServiceChan:          newAppServiceChan,
 		deletedAppServiceChan:      deletedAppServiceChan,
 		appStoreWatcher:            appStoreWatcher,
 		storeAdapter:               storeAdapter,
 		dropsondeBytesChan:         dropsondeBytesChan,
+		streamBytesChans:           streamBytesChans,
 		dropsondeUnmarshaller:      dropsondeUnmarshaller,
 		envelopeChan:               make(chan *events.Envelope),
 		wrappedEnvelopeChan:        make(chan *events.Envelope),
 		signatureVerifier:          signatureVerifier,
 		dropsondeVerifiedBytesChan: make(chan []byte),
+		unbatcher:                  unbatcher.New(logger),
+		unbatchedBytesChan:         make(chan []byte),
 	}
 }
 
@@ -88,7 +177,7 @@ func (doppler *Doppler) Start() {
 	doppler.errChan = make(chan error)
 	doppler.Unlock()
 
-	doppler.Add(7)
+	doppler.Add(8)
 
 	go func() {
 		defer doppler.Done()
@@ -103,13 +192,20 @@ func (doppler *Doppler) Start() {
 	go func() {
 		defer doppler.Done()
 		defer close(doppler.envelopeChan)
-		doppler.dropsondeUnmarshaller.Run(doppler.dropsondeVerifiedBytesChan, doppler.envelopeChan)
+		doppler.dropsondeUnmarshaller.Run(doppler.unbatchedBytesChan, doppler.envelopeChan)
+	}()
+
+	go func() {
+		defer doppler.Done()
+		defer close(doppler.unbatchedBytesChan)
+		doppler.unbatcher.Run(doppler.dropsondeVerifiedBytesChan, doppler.unbatchedBytesChan)
 	}()
 
 	go func() {
 		defer doppler.Done()
 		defer close(doppler.dropsondeVerifiedBytesChan)
-		doppler.signatureVerifier.Run(doppler.dropsondeBytesChan, doppler.dropsondeVerifiedBytesChan)
+		dropsondeBytesChan := mergeChannels(append([]<-chan []byte{doppler.dropsondeBytesChan}, doppler.streamBytesChans...)...)
+		doppler.signatureVerifier.Run(dropsondeBytesChan, doppler.dropsondeVerifiedBytesChan)
 	}()
 
 	go func() {
@@ -127,6 +223,40 @@ func (doppler *Doppler) Start() {
 		doppler.websocketServer.Start()
 	}()
 
+	for _, streamListener := range []*tcplistener.TCPListener{doppler.tcpListener, doppler.tlsListener} {
+		if streamListener != nil {
+			doppler.Add(1)
+			go func(streamListener *tcplistener.TCPListener) {
+				defer doppler.Done()
+				streamListener.Start()
+			}(streamListener)
+		}
+	}
+
+	if doppler.websocketListener != nil {
+		doppler.Add(1)
+		go func() {
+			defer doppler.Done()
+			doppler.websocketListener.Start()
+		}()
+	}
+
+	if doppler.healthServer != nil {
+		doppler.Add(1)
+		go func() {
+			defer doppler.Done()
+			doppler.healthServer.Start()
+		}()
+	}
+
+	if doppler.bufferSupervisor != nil {
+		doppler.Add(1)
+		go func() {
+			defer doppler.Done()
+			doppler.bufferSupervisor.Run()
+		}()
+	}
+
 	for err := range doppler.errChan {
 		doppler.Errorf("Got error %s", err)
 	}
@@ -135,10 +265,26 @@ func (doppler *Doppler) Start() {
 func (l *Doppler) Stop() {
 	l.Lock()
 	defer l.Unlock()
+	l.appStoreWatcher.Stop()
 	l.dropsondeListener.Stop()
+	if l.tcpListener != nil {
+		l.tcpListener.Stop()
+	}
+	if l.tlsListener != nil {
+		l.tlsListener.Stop()
+	}
+	if l.websocketListener != nil {
+		l.websocketListener.Stop()
+	}
 	l.sinkManager.Stop()
 	l.messageRouter.Stop()
 	l.websocketServer.Stop()
+	if l.healthServer != nil {
+		l.healthServer.Stop()
+	}
+	if l.bufferSupervisor != nil {
+		l.bufferSupervisor.Stop()
+	}
 	l.storeAdapter.Disconnect()
 
 	l.Wait()
@@ -146,11 +292,52 @@ func (l *Doppler) Stop() {
 }
 
 func (l *Doppler) Emitters() []instrumentation.Instrumentable {
-	return []instrumentation.Instrumentable{
+	emitters := []instrumentation.Instrumentable{
 		l.dropsondeListener,
+		l.sequenceTracker,
 		l.messageRouter,
 		l.sinkManager,
 		l.dropsondeUnmarshaller,
 		l.signatureVerifier,
+		l.unbatcher,
+	}
+	if l.bufferSupervisor != nil {
+		emitters = append(emitters, l.bufferSupervisor)
+	}
+	if l.tcpListener != nil {
+		emitters = append(emitters, l.tcpListener)
+	}
+	if l.tlsListener != nil {
+		emitters = append(emitters, l.tlsListener)
 	}
+	if l.websocketListener != nil {
+		emitters = append(emitters, l.websocketListener)
+	}
+	return emitters
+}
+
+// mergeChannels passes the messages read from all inputs on to one channel,
+// which is closed once all inputs are closed.
+func mergeChannels(inputs ...<-chan []byte) <-chan []byte {
+	if len(inputs) == 1 {
+		return inputs[0]
+	}
+
+	output := make(chan []byte)
+	var wg sync.WaitGroup
+	wg.Add(len(inputs))
+	for _, input := range inputs {
+		go func(input <-chan []byte) {
+			defer wg.Done()
+			for message := range input {
+				output <- message
+			}
+		}(input)
+	}
+
+	go func() {
+		wg.Wait()
+		close(output)
+	}()
+	return output
 }
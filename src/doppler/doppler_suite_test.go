@@ -36,17 +36,18 @@ var _ = BeforeSuite(func() {
 		EtcdUrls:                  []string{etcdUrl},
 		EtcdMaxConcurrentRequests: 10,
 
-		Index: 0,
-		DropsondeIncomingMessagesPort: 3457,
-		OutgoingPort:                  8083,
-		LogFilePath:                   "",
-		MaxRetainedLogMessages:        100,
-		WSMessageBufferSize:           100,
-		SharedSecret:                  "secret",
-		SkipCertVerify:                true,
-		BlackListIps:                  []iprange.IPRange{},
-		ContainerMetricTTLSeconds:     120,
-		SinkInactivityTimeoutSeconds:  2,
+		Index:                          0,
+		DropsondeIncomingMessagesPort:  3457,
+		OutgoingPort:                   8083,
+		LogFilePath:                    "",
+		MaxRetainedLogMessages:         100,
+		WSMessageBufferSize:            100,
+		SharedSecret:                   "secret",
+		SkipCertVerify:                 true,
+		BlackListIps:                   []iprange.IPRange{},
+		ContainerMetricTTLSeconds:      120,
+		SinkInactivityTimeoutSeconds:   2,
+		SyslogDrainSyncIntervalSeconds: 60,
 	}
 	cfcomponent.Logger = loggertesthelper.Logger()
 })
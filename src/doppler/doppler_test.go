@@ -2,6 +2,7 @@ package main_test
 
 import (
 	doppler "doppler"
+	"doppler/unbatcher"
 
 	"net"
 	"time"
@@ -70,6 +71,15 @@ var _ = Describe("Doppler Server", func() {
 			instrumentationtesthelpers.EventuallyExpectMetric(emitter, "missingSignatureErrors", 1)
 		})
 
+		It("emits metrics for the unbatcher", func() {
+			emitter := getEmitter("unbatcher")
+
+			connection, _ := net.Dial("udp", "127.0.0.1:3457")
+			connection.Write(createSignedBatchOfHeartbeatEnvelopes(2))
+
+			instrumentationtesthelpers.EventuallyExpectMetric(emitter, "envelopesUnpacked", 2)
+		})
+
 		It("emits metrics for the message router", func() {
 			emitter := getEmitter("httpServer")
 
@@ -118,3 +128,19 @@ func createSignedMessageFromHeartbeatEnvelope() []byte {
 	message, _ := proto.Marshal(envelope)
 	return signature.SignMessage(message, []byte("secret"))
 }
+
+func createSignedBatchOfHeartbeatEnvelopes(count int) []byte {
+	envelope := &events.Envelope{
+		Origin:    proto.String("fake-origin-3"),
+		EventType: events.Envelope_Heartbeat.Enum(),
+		Heartbeat: factories.NewHeartbeat(1, 2, 3),
+	}
+	message, _ := proto.Marshal(envelope)
+
+	batch := []byte{unbatcher.BatchMarker}
+	for i := 0; i < count; i++ {
+		batch = append(batch, byte(len(message)))
+		batch = append(batch, message...)
+	}
+	return signature.SignMessage(batch, []byte("secret"))
+}
@@ -0,0 +1,242 @@
+package drainwatcher
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/storeadapter"
+)
+
+const ServicesKey = "/loggregator/services"
+
+// WatchRetryInterval is how long the watcher waits before watching the store
+// again after the watch failed. Bindings are still picked up by the full
+// syncs in the meantime.
+var WatchRetryInterval = time.Second
+
+// DrainWatcher keeps doppler's syslog drain bindings in line with the store.
+// Bindings written by the syslog drain binder are applied as soon as the
+// store reports them, and a full sync every syncInterval corrects anything a
+// watch missed. Every binding is reported once on the add channel when it
+// appears and once on the remove channel when it disappears, however often
+// the store repeats it.
+type DrainWatcher struct {
+	adapter      storeadapter.StoreAdapter
+	syncInterval time.Duration
+	logger       *gosteno.Logger
+
+	bindings                  map[string]map[string]appservice.AppService // keys are app id and AppService.Id()
+	outAddChan, outRemoveChan chan appservice.AppService
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func New(adapter storeadapter.StoreAdapter, syncInterval time.Duration, logger *gosteno.Logger) (*DrainWatcher, <-chan appservice.AppService, <-chan appservice.AppService) {
+	outAddChan := make(chan appservice.AppService)
+	outRemoveChan := make(chan appservice.AppService)
+
+	return &DrainWatcher{
+		adapter:       adapter,
+		syncInterval:  syncInterval,
+		logger:        logger,
+		bindings:      make(map[string]map[string]appservice.AppService),
+		outAddChan:    outAddChan,
+		outRemoveChan: outRemoveChan,
+		stopChan:      make(chan struct{}),
+	}, outAddChan, outRemoveChan
+}
+
+// Run watches the bindings and syncs all of them, then applies watch events
+// and periodic syncs until Stop is called. It closes the add and remove
+// channels when it returns.
+func (w *DrainWatcher) Run() {
+	defer close(w.outAddChan)
+	defer close(w.outRemoveChan)
+
+	events, stopWatch, errs := w.adapter.Watch(ServicesKey)
+	var retryWatch <-chan time.Time
+	defer func() {
+		if stopWatch != nil {
+			close(stopWatch)
+		}
+	}()
+	// watching first, bindings written during the sync are not missed
+	w.sync()
+
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.apply(event)
+		case err, ok := <-errs:
+			if ok {
+				w.logger.Warnf("DrainWatcher: Watching %s failed, falling back to a full sync. Err: %v", ServicesKey, err)
+			}
+			close(stopWatch)
+			events, stopWatch, errs = nil, nil, nil
+			retryWatch = time.After(WatchRetryInterval)
+			w.sync()
+		case <-retryWatch:
+			retryWatch = nil
+			events, stopWatch, errs = w.adapter.Watch(ServicesKey)
+			// bindings changed while not watching are only seen by a sync
+			w.sync()
+		case <-ticker.C:
+			w.sync()
+		}
+	}
+}
+
+func (w *DrainWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stopChan) })
+}
+
+func (w *DrainWatcher) apply(event storeadapter.WatchEvent) {
+	switch event.Type {
+	case storeadapter.CreateEvent, storeadapter.UpdateEvent:
+		if event.Node == nil {
+			return
+		}
+		if event.Node.Dir {
+			for _, appService := range appServicesIn(*event.Node) {
+				w.add(appService)
+			}
+			return
+		}
+		if appService, ok := appServiceFor(*event.Node); ok {
+			w.add(appService)
+		}
+	case storeadapter.DeleteEvent, storeadapter.ExpireEvent:
+		node := event.PrevNode
+		if node == nil {
+			node = event.Node
+		}
+		if node == nil {
+			return
+		}
+		w.removeKey(node.Key)
+	}
+}
+
+// sync adds the bindings found in the store that are not known yet and
+// removes the known ones that are no longer in the store.
+func (w *DrainWatcher) sync() {
+	node, err := w.adapter.ListRecursively(ServicesKey)
+	if err == storeadapter.ErrorKeyNotFound {
+		node, err = storeadapter.StoreNode{}, nil
+	}
+	if err != nil {
+		w.logger.Warnf("DrainWatcher: Error listing %s, keeping the current bindings. Err: %v", ServicesKey, err)
+		return
+	}
+
+	current := make(map[string]map[string]bool)
+	for _, appService := range appServicesIn(node) {
+		if current[appService.AppId] == nil {
+			current[appService.AppId] = make(map[string]bool)
+		}
+		current[appService.AppId][appService.Id()] = true
+		w.add(appService)
+	}
+
+	for appId, appServices := range w.bindings {
+		for id, appService := range appServices {
+			if !current[appId][id] {
+				w.remove(appService)
+			}
+		}
+	}
+}
+
+func (w *DrainWatcher) add(appService appservice.AppService) {
+	if _, ok := w.bindings[appService.AppId][appService.Id()]; ok {
+		return
+	}
+
+	if w.bindings[appService.AppId] == nil {
+		w.bindings[appService.AppId] = make(map[string]appservice.AppService)
+	}
+	w.bindings[appService.AppId][appService.Id()] = appService
+	select {
+	case w.outAddChan <- appService:
+	case <-w.stopChan:
+	}
+}
+
+func (w *DrainWatcher) remove(appService appservice.AppService) {
+	delete(w.bindings[appService.AppId], appService.Id())
+	if len(w.bindings[appService.AppId]) == 0 {
+		delete(w.bindings, appService.AppId)
+	}
+	select {
+	case w.outRemoveChan <- appService:
+	case <-w.stopChan:
+	}
+}
+
+// removeKey removes the binding stored at key, or all bindings below key if
+// it is a directory.
+func (w *DrainWatcher) removeKey(key string) {
+	components := keyComponents(key)
+	switch len(components) {
+	case 0:
+		for _, appServices := range w.bindings {
+			for _, appService := range appServices {
+				w.remove(appService)
+			}
+		}
+	case 1:
+		for _, appService := range w.bindings[components[0]] {
+			w.remove(appService)
+		}
+	case 2:
+		if appService, ok := w.bindings[components[0]][components[1]]; ok {
+			w.remove(appService)
+		}
+	}
+}
+
+// keyComponents returns the parts of key below ServicesKey: the app id and,
+// for a binding, the hash of its drain URL.
+func keyComponents(key string) []string {
+	relative := strings.Trim(strings.TrimPrefix(key, ServicesKey), "/")
+	if relative == "" {
+		return nil
+	}
+	return strings.Split(relative, "/")
+}
+
+func appServiceFor(node storeadapter.StoreNode) (appservice.AppService, bool) {
+	components := keyComponents(node.Key)
+	if len(components) != 2 {
+		return appservice.AppService{}, false
+	}
+	return appservice.AppService{AppId: components[0], Url: string(node.Value)}, true
+}
+
+func appServicesIn(node storeadapter.StoreNode) []appservice.AppService {
+	if !node.Dir {
+		if appService, ok := appServiceFor(node); ok {
+			return []appservice.AppService{appService}
+		}
+		return nil
+	}
+
+	var appServices []appservice.AppService
+	for _, child := range node.ChildNodes {
+		appServices = append(appServices, appServicesIn(child)...)
+	}
+	return appServices
+}
@@ -0,0 +1,261 @@
+package drainwatcher_test
+
+import (
+	"crypto/sha1"
+	"doppler/drainwatcher"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/cloudfoundry/storeadapter"
+	"github.com/cloudfoundry/storeadapter/fakestoreadapter"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DrainWatcher", func() {
+	var (
+		store                 *fakeStore
+		watcher               *drainwatcher.DrainWatcher
+		addChan, removeChan   <-chan appservice.AppService
+		syncInterval          time.Duration
+		runDone               chan struct{}
+		originalRetryInterval time.Duration
+	)
+
+	startWatcher := func() {
+		watcher, addChan, removeChan = drainwatcher.New(store, syncInterval, loggertesthelper.Logger())
+		runDone = make(chan struct{})
+		go func() {
+			watcher.Run()
+			close(runDone)
+		}()
+	}
+
+	BeforeEach(func() {
+		store = newFakeStore()
+		syncInterval = time.Hour
+
+		originalRetryInterval = drainwatcher.WatchRetryInterval
+		drainwatcher.WatchRetryInterval = 50 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		watcher.Stop()
+		Eventually(runDone).Should(BeClosed())
+		drainwatcher.WatchRetryInterval = originalRetryInterval
+	})
+
+	It("adds the bindings in the store on start", func() {
+		store.SetMulti([]storeadapter.StoreNode{drainNode("app-1", "syslog://drain-a"), drainNode("app-2", "syslog://drain-b")})
+		startWatcher()
+
+		var added []appservice.AppService
+		for i := 0; i < 2; i++ {
+			var appService appservice.AppService
+			Eventually(addChan).Should(Receive(&appService))
+			added = append(added, appService)
+		}
+		Expect(added).To(ConsistOf(
+			appservice.AppService{AppId: "app-1", Url: "syslog://drain-a"},
+			appservice.AppService{AppId: "app-2", Url: "syslog://drain-b"},
+		))
+	})
+
+	It("watches the bindings before syncing them, so that none written meanwhile is missed", func() {
+		startWatcher()
+
+		Eventually(store.Calls).Should(HaveLen(2))
+		Expect(store.Calls()).To(Equal([]string{"watch", "list"}))
+	})
+
+	Context("when watching", func() {
+		BeforeEach(func() {
+			startWatcher()
+			Eventually(store.WatchCount).Should(Equal(1))
+		})
+
+		It("adds a binding as soon as it is created", func() {
+			node := drainNode("app-1", "syslog://drain-a")
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.CreateEvent, Node: &node})
+
+			Eventually(addChan, 50*time.Millisecond).Should(Receive(Equal(appservice.AppService{AppId: "app-1", Url: "syslog://drain-a"})))
+			Expect(store.ListCount()).To(Equal(1))
+		})
+
+		It("adds a binding only once however often it is written", func() {
+			node := drainNode("app-1", "syslog://drain-a")
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.CreateEvent, Node: &node})
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.UpdateEvent, Node: &node})
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.UpdateEvent, Node: &node})
+
+			Eventually(addChan).Should(Receive())
+			Consistently(addChan).ShouldNot(Receive())
+		})
+
+		It("removes a binding as soon as it is deleted", func() {
+			node := drainNode("app-1", "syslog://drain-a")
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.CreateEvent, Node: &node})
+			Eventually(addChan).Should(Receive())
+
+			deleted := storeadapter.StoreNode{Key: node.Key}
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.DeleteEvent, Node: &deleted, PrevNode: &node})
+
+			Eventually(removeChan, 50*time.Millisecond).Should(Receive(Equal(appservice.AppService{AppId: "app-1", Url: "syslog://drain-a"})))
+		})
+
+		It("removes all bindings of an app when its directory expires", func() {
+			nodeA := drainNode("app-1", "syslog://drain-a")
+			nodeB := drainNode("app-1", "syslog://drain-b")
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.CreateEvent, Node: &nodeA})
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.CreateEvent, Node: &nodeB})
+			Eventually(addChan).Should(Receive())
+			Eventually(addChan).Should(Receive())
+
+			appDir := storeadapter.StoreNode{Key: drainwatcher.ServicesKey + "/app-1", Dir: true}
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.ExpireEvent, Node: &appDir})
+
+			var removed []appservice.AppService
+			for i := 0; i < 2; i++ {
+				var appService appservice.AppService
+				Eventually(removeChan).Should(Receive(&appService))
+				removed = append(removed, appService)
+			}
+			Expect(removed).To(ConsistOf(
+				appservice.AppService{AppId: "app-1", Url: "syslog://drain-a"},
+				appservice.AppService{AppId: "app-1", Url: "syslog://drain-b"},
+			))
+		})
+
+		It("ignores the removal of unknown bindings", func() {
+			node := drainNode("app-1", "syslog://drain-a")
+			store.Send(storeadapter.WatchEvent{Type: storeadapter.DeleteEvent, Node: &node, PrevNode: &node})
+
+			Consistently(removeChan).ShouldNot(Receive())
+		})
+
+		Context("when the watch fails", func() {
+			It("falls back to a full sync and watches again", func() {
+				store.SetMulti([]storeadapter.StoreNode{drainNode("app-1", "syslog://drain-a")})
+				store.FailWatch(errors.New("watch failed"))
+
+				Eventually(addChan).Should(Receive(Equal(appservice.AppService{AppId: "app-1", Url: "syslog://drain-a"})))
+				Eventually(store.WatchCount).Should(Equal(2))
+
+				node := drainNode("app-2", "syslog://drain-b")
+				store.Send(storeadapter.WatchEvent{Type: storeadapter.CreateEvent, Node: &node})
+				Eventually(addChan, 50*time.Millisecond).Should(Receive(Equal(appservice.AppService{AppId: "app-2", Url: "syslog://drain-b"})))
+			})
+		})
+	})
+
+	Context("with a sync interval", func() {
+		BeforeEach(func() {
+			syncInterval = 50 * time.Millisecond
+		})
+
+		It("catches up on changes the watch missed", func() {
+			store.SetMulti([]storeadapter.StoreNode{drainNode("app-1", "syslog://drain-a")})
+			startWatcher()
+			Eventually(addChan).Should(Receive())
+
+			store.SetMulti([]storeadapter.StoreNode{drainNode("app-2", "syslog://drain-b")})
+			store.Delete(drainNode("app-1", "syslog://drain-a").Key)
+
+			Eventually(addChan).Should(Receive(Equal(appservice.AppService{AppId: "app-2", Url: "syslog://drain-b"})))
+			Eventually(removeChan).Should(Receive(Equal(appservice.AppService{AppId: "app-1", Url: "syslog://drain-a"})))
+			Consistently(addChan).ShouldNot(Receive())
+		})
+	})
+
+	It("closes its channels when stopped", func() {
+		startWatcher()
+		watcher.Stop()
+
+		Eventually(addChan).Should(BeClosed())
+		Eventually(removeChan).Should(BeClosed())
+	})
+})
+
+func drainNode(appId string, drainUrl string) storeadapter.StoreNode {
+	return storeadapter.StoreNode{
+		Key:   fmt.Sprintf("%s/%s/%x", drainwatcher.ServicesKey, appId, sha1.Sum([]byte(drainUrl))),
+		Value: []byte(drainUrl),
+	}
+}
+
+// fakeStore hands out watches whose events and errors are controlled by the
+// test, instead of the ones of the embedded fake.
+type fakeStore struct {
+	*fakestoreadapter.FakeStoreAdapter
+
+	lock        sync.Mutex
+	watchEvents chan storeadapter.WatchEvent
+	watchErrors chan error
+	watchCount  int
+	listCount   int
+	calls       []string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{FakeStoreAdapter: fakestoreadapter.New()}
+}
+
+func (s *fakeStore) Watch(key string) (<-chan storeadapter.WatchEvent, chan<- bool, <-chan error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.watchCount++
+	s.calls = append(s.calls, "watch")
+	s.watchEvents = make(chan storeadapter.WatchEvent, 10)
+	s.watchErrors = make(chan error, 1)
+	return s.watchEvents, make(chan bool, 1), s.watchErrors
+}
+
+func (s *fakeStore) ListRecursively(key string) (storeadapter.StoreNode, error) {
+	s.lock.Lock()
+	s.listCount++
+	s.calls = append(s.calls, "list")
+	s.lock.Unlock()
+
+	return s.FakeStoreAdapter.ListRecursively(key)
+}
+
+func (s *fakeStore) Send(event storeadapter.WatchEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.watchEvents <- event
+}
+
+func (s *fakeStore) FailWatch(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.watchErrors <- err
+}
+
+func (s *fakeStore) WatchCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.watchCount
+}
+
+func (s *fakeStore) ListCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.listCount
+}
+
+func (s *fakeStore) Calls() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.calls...)
+}
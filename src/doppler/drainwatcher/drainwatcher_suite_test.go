@@ -0,0 +1,13 @@
+package drainwatcher_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDrainwatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Drainwatcher Suite")
+}
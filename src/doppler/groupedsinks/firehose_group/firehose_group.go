@@ -15,6 +15,7 @@ type FirehoseGroup interface {
 	RemoveAllSinks()
 	IsEmpty() bool
 	BroadcastMessage(msg *events.Envelope)
+	Sinks() []sinks.Sink
 }
 
 type firehoseGroup struct {
@@ -94,6 +95,17 @@ func (group *firehoseGroup) BroadcastMessage(msg *events.Envelope) {
 	group.lastUsedSinkIndex += 1
 }
 
+func (group *firehoseGroup) Sinks() []sinks.Sink {
+	group.RLock()
+	defer group.RUnlock()
+
+	results := make([]sinks.Sink, 0, len(group.sinkWrappers))
+	for _, sinkWrapper := range group.sinkWrappers {
+		results = append(results, sinkWrapper.Sink)
+	}
+	return results
+}
+
 func (group *firehoseGroup) length() int {
 	group.RLock()
 	defer group.RUnlock()
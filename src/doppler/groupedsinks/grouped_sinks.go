@@ -100,12 +100,34 @@ func (group *GroupedSinks) BroadcastError(appId string, errorMsg *events.Envelop
 	group.BroadcastMessageToFirehoses(errorMsg)
 }
 
+func (group *GroupedSinks) BroadcastToFirehoses(msg *events.Envelope) {
+	group.RLock()
+	defer group.RUnlock()
+
+	group.BroadcastMessageToFirehoses(msg)
+}
+
 func (group *GroupedSinks) BroadcastMessageToFirehoses(msg *events.Envelope) {
 	for _, fgroup := range group.firehoses {
 		fgroup.BroadcastMessage(msg)
 	}
 }
 
+// BufferedMessageCount returns the number of messages waiting in the input
+// channels of all app sinks.
+func (group *GroupedSinks) BufferedMessageCount() int {
+	group.RLock()
+	defer group.RUnlock()
+
+	count := 0
+	for _, appSinks := range group.apps {
+		for _, wrapper := range appSinks {
+			count += len(wrapper.InputChan)
+		}
+	}
+	return count
+}
+
 func (group *GroupedSinks) CountFor(appId string) int {
 	group.RLock()
 	defer group.RUnlock()
@@ -133,8 +155,8 @@ func (group *GroupedSinks) DrainsFor(appId string) []sinks.Sink {
 
 	results := []sinks.Sink{}
 	for _, wrapper := range group.apps[appId] {
-		_, isSyslogSink := wrapper.Sink.(*syslog.SyslogSink)
-		if isSyslogSink {
+		switch wrapper.Sink.(type) {
+		case *syslog.SyslogSink, *syslog.UdpSyslogSink:
 			results = append(results, wrapper.Sink)
 		}
 	}
@@ -245,6 +267,32 @@ func (group *GroupedSinks) DeleteAll() {
 	}
 }
 
+// GetOriginFilterMetrics returns the counts of matched and filtered
+// envelopes of all websocket sinks, app and firehose, that filter by origin.
+func (group *GroupedSinks) GetOriginFilterMetrics() []sinks.Metric {
+	group.RLock()
+	defer group.RUnlock()
+
+	var metrics []sinks.Metric
+	addMetrics := func(sink sinks.Sink) {
+		if websocketSink, ok := sink.(*websocket.WebsocketSink); ok {
+			metrics = append(metrics, websocketSink.OriginFilterMetrics()...)
+		}
+	}
+
+	for _, appSinks := range group.apps {
+		for _, wrapper := range appSinks {
+			addMetrics(wrapper.Sink)
+		}
+	}
+	for _, fgroup := range group.firehoses {
+		for _, sink := range fgroup.Sinks() {
+			addMetrics(sink)
+		}
+	}
+	return metrics
+}
+
 func (group *GroupedSinks) GetAllInstrumentationMetrics() []sinks.Metric {
 	group.RLock()
 	defer group.RUnlock()
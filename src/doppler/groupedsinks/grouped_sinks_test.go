@@ -36,7 +36,7 @@ var _ = Describe("GroupedSink", func() {
 
 				groupedSinks.CloseAndDeleteFirehose(firehoseSink)
 
-				appSink := syslog.NewSyslogSink("123", "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+				appSink := syslog.NewSyslogSink("123", "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 				appSinkInputChan := make(chan *events.Envelope)
 				groupedSinks.RegisterAppSink(appSinkInputChan, appSink)
 
@@ -49,12 +49,12 @@ var _ = Describe("GroupedSink", func() {
 
 		It("sends message to all registered sinks that match the appId", func(done Done) {
 			appId := "123"
-			appSink := syslog.NewSyslogSink("123", "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink := syslog.NewSyslogSink("123", "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			otherInputChan := make(chan *events.Envelope)
 			groupedSinks.RegisterAppSink(otherInputChan, appSink)
 
 			appId = "789"
-			appSink = syslog.NewSyslogSink(appId, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink = syslog.NewSyslogSink(appId, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, appSink)
 
@@ -125,7 +125,7 @@ var _ = Describe("GroupedSink", func() {
 		})
 
 		It("counts how many messages it drops if input chan is full", func(done Done) {
-			appSink := syslog.NewSyslogSink("123", "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink := syslog.NewSyslogSink("123", "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			appSinkInputChan := make(chan *events.Envelope, 1)
 			groupedSinks.RegisterAppSink(appSinkInputChan, appSink)
 			go appSink.Run(appSinkInputChan)
@@ -178,7 +178,7 @@ var _ = Describe("GroupedSink", func() {
 			appId := "789"
 
 			sink1 := dump.NewDumpSink(appId, 10, loggertesthelper.Logger(), time.Second, make(chan int64))
-			sink2 := syslog.NewSyslogSink(appId, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := syslog.NewSyslogSink(appId, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 			groupedSinks.RegisterAppSink(inputChan, sink2)
@@ -193,21 +193,21 @@ var _ = Describe("GroupedSink", func() {
 	Describe("Register", func() {
 		It("returns false for empty app ids", func() {
 			appId := ""
-			appSink := syslog.NewSyslogSink(appId, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink := syslog.NewSyslogSink(appId, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			result := groupedSinks.RegisterAppSink(inputChan, appSink)
 			Expect(result).To(BeFalse())
 		})
 
 		It("returns false for empty identifiers", func() {
 			appId := "appId"
-			appSink := syslog.NewSyslogSink(appId, "", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink := syslog.NewSyslogSink(appId, "", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			result := groupedSinks.RegisterAppSink(inputChan, appSink)
 			Expect(result).To(BeFalse())
 		})
 
 		It("returns false when registering a duplicate", func() {
 			appId := "789"
-			appSink := syslog.NewSyslogSink(appId, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink := syslog.NewSyslogSink(appId, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			groupedSinks.RegisterAppSink(inputChan, appSink)
 			result := groupedSinks.RegisterAppSink(inputChan, appSink)
 			Expect(result).To(BeFalse())
@@ -217,14 +217,14 @@ var _ = Describe("GroupedSink", func() {
 	Describe("RegisterFirehose", func() {
 		It("returns false for empty subscription ids", func() {
 			subscriptionId := ""
-			firehoseSink := syslog.NewSyslogSink(subscriptionId, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			firehoseSink := syslog.NewSyslogSink(subscriptionId, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			result := groupedSinks.RegisterFirehoseSink(inputChan, firehoseSink)
 			Expect(result).To(BeFalse())
 		})
 
 		It("returns true if a subscription id is present", func() {
 			subscriptionId := "firehose-subscription-a"
-			firehoseSink := syslog.NewSyslogSink(subscriptionId, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			firehoseSink := syslog.NewSyslogSink(subscriptionId, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			result := groupedSinks.RegisterFirehoseSink(inputChan, firehoseSink)
 			Expect(result).To(BeTrue())
 		})
@@ -234,8 +234,8 @@ var _ = Describe("GroupedSink", func() {
 		It("only deletes a specific sink", func() {
 			target := "789"
 
-			sink1 := syslog.NewSyslogSink(target, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
-			sink2 := syslog.NewSyslogSink(target, "url2", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(target, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := syslog.NewSyslogSink(target, "url2", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 			groupedSinks.RegisterAppSink(inputChan, sink2)
@@ -248,7 +248,7 @@ var _ = Describe("GroupedSink", func() {
 		It("handle deletes for non-existing appIds", func() {
 			target := "789"
 
-			sink1 := syslog.NewSyslogSink(target, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(target, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			ok := groupedSinks.CloseAndDelete(sink1)
 			Expect(ok).To(BeFalse())
@@ -259,8 +259,8 @@ var _ = Describe("GroupedSink", func() {
 		It("handle deletes for existing appIds but unregistered drain URLs", func() {
 			target := "789"
 
-			sink1 := syslog.NewSyslogSink(target, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
-			sink2 := syslog.NewSyslogSink(target, "url2", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(target, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := syslog.NewSyslogSink(target, "url2", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 
@@ -273,7 +273,7 @@ var _ = Describe("GroupedSink", func() {
 		It("closes the inputChan", func() {
 			target := "789"
 
-			sink := syslog.NewSyslogSink(target, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink := syslog.NewSyslogSink(target, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			groupedSinks.RegisterAppSink(inputChan, sink)
 			groupedSinks.CloseAndDelete(sink)
 			Expect(inputChan).To(BeClosed())
@@ -349,7 +349,7 @@ var _ = Describe("GroupedSink", func() {
 			target := "789"
 
 			sink1 := dump.NewDumpSink(target, 10, loggertesthelper.Logger(), time.Second, make(chan int64))
-			sink2 := syslog.NewSyslogSink(target, "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := syslog.NewSyslogSink(target, "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 			groupedSinks.RegisterAppSink(inputChan, sink2)
@@ -364,8 +364,8 @@ var _ = Describe("GroupedSink", func() {
 		It("returns only sinks that match the appid and drain URL", func() {
 			target := "789"
 
-			sink1 := syslog.NewSyslogSink(target, "other sink", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
-			sink2 := syslog.NewSyslogSink(target, "sink we are searching for", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(target, "other sink", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := syslog.NewSyslogSink(target, "sink we are searching for", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 			groupedSinks.RegisterAppSink(inputChan, sink2)
@@ -377,7 +377,7 @@ var _ = Describe("GroupedSink", func() {
 		It("returns nil if no drains are registered", func() {
 			target := "789"
 
-			sink := syslog.NewSyslogSink(target, "url2", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink := syslog.NewSyslogSink(target, "url2", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			groupedSinks.RegisterAppSink(inputChan, sink)
 
 			Expect(groupedSinks.DrainFor(target, "url1")).To(BeNil())
@@ -392,8 +392,8 @@ var _ = Describe("GroupedSink", func() {
 		It("returns only dumps", func() {
 			appId := "789"
 
-			sink1 := syslog.NewSyslogSink(appId, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
-			sink2 := syslog.NewSyslogSink(appId, "url2", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(appId, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := syslog.NewSyslogSink(appId, "url2", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			sink3 := dump.NewDumpSink(appId, 5, loggertesthelper.Logger(), time.Second, make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
@@ -419,7 +419,7 @@ var _ = Describe("GroupedSink", func() {
 		It("returns nil if no dumps are registered", func() {
 			target := "789"
 
-			sink1 := syslog.NewSyslogSink(target, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(target, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 
@@ -478,9 +478,9 @@ var _ = Describe("GroupedSink", func() {
 			fakeWriter1 := fakeMessageWriter{RemoteAddress: "1"}
 			fakeWriter2 := fakeMessageWriter{RemoteAddress: "2"}
 
-			sink1 := syslog.NewSyslogSink(appId, "url1", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
-			sink2 := websocket.NewWebsocketSink(appId, loggertesthelper.Logger(), &fakeWriter1, 100, "origin", make(chan int64))
-			sink3 := websocket.NewWebsocketSink(appId, loggertesthelper.Logger(), &fakeWriter2, 100, "origin", make(chan int64))
+			sink1 := syslog.NewSyslogSink(appId, "url1", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			sink2 := websocket.NewWebsocketSink(appId, loggertesthelper.Logger(), &fakeWriter1, 100, websocket.DropsondeEncoding, "origin", make(chan int64), make(chan int64))
+			sink3 := websocket.NewWebsocketSink(appId, loggertesthelper.Logger(), &fakeWriter2, 100, websocket.DropsondeEncoding, "origin", make(chan int64), make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 			groupedSinks.RegisterAppSink(inputChan, sink2)
@@ -495,8 +495,8 @@ var _ = Describe("GroupedSink", func() {
 
 			fakeWriter := fakeMessageWriter{RemoteAddress: "1"}
 
-			sink1 := websocket.NewWebsocketSink(appId, loggertesthelper.Logger(), &fakeWriter, 100, "origin", make(chan int64))
-			sink2 := websocket.NewWebsocketSink(otherAppId, loggertesthelper.Logger(), &fakeWriter, 100, "origin", make(chan int64))
+			sink1 := websocket.NewWebsocketSink(appId, loggertesthelper.Logger(), &fakeWriter, 100, websocket.DropsondeEncoding, "origin", make(chan int64), make(chan int64))
+			sink2 := websocket.NewWebsocketSink(otherAppId, loggertesthelper.Logger(), &fakeWriter, 100, websocket.DropsondeEncoding, "origin", make(chan int64), make(chan int64))
 
 			groupedSinks.RegisterAppSink(inputChan, sink1)
 			groupedSinks.RegisterAppSink(inputChan, sink2)
@@ -511,7 +511,7 @@ var _ = Describe("GroupedSink", func() {
 
 	Describe("GetInstrumentationMetrics", func() {
 		It("does not get metrics from sinks with no dropped logs", func() {
-			appSink := syslog.NewSyslogSink("789", "url", loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
+			appSink := syslog.NewSyslogSink("789", "url", syslog.DrainTypeLogs, loggertesthelper.Logger(), DummySyslogWriter{}, dummyErrorHandler, "dropsonde-origin", make(chan int64))
 			groupedSinks.RegisterAppSink(inputChan, appSink)
 			metrics := groupedSinks.GetAllInstrumentationMetrics()
 			Expect(len(metrics)).To(Equal(0))
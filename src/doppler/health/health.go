@@ -0,0 +1,125 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"healthendpoint"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// Report is the JSON document served by the health endpoint. Counts "in the
+// last interval" are the difference between the two most recent samples of
+// the underlying instrumentation metrics.
+type Report struct {
+	UptimeSeconds     float64           `json:"uptimeSeconds"`
+	IntervalSeconds   float64           `json:"intervalSeconds"`
+	ReceivedEnvelopes map[string]uint64 `json:"receivedEnvelopes"`
+	RoutedEnvelopes   uint64            `json:"routedEnvelopes"`
+	Sinks             map[string]int64  `json:"sinks"`
+	BufferedMessages  int64             `json:"bufferedMessages"`
+	DroppedMessages   int64             `json:"droppedMessages"`
+}
+
+type sample struct {
+	received map[string]uint64 // by protocol
+	routed   uint64
+	dropped  int64
+}
+
+var sinkMetrics = map[string]string{
+	"dump":       "numberOfDumpSinks",
+	"syslog":     "numberOfSyslogSinks",
+	"syslog-udp": "numberOfLossyUdpSyslogSinks",
+	"websocket":  "numberOfWebsocketSinks",
+	"firehose":   "numberOfFirehoseSinks",
+}
+
+// Server serves a Report on a localhost HTTP endpoint. The numbers are read
+// from the instrumentation of the listeners, the message router and the sink
+// manager, so they match the emitted metrics. Sampling happens once per interval;
+// requests only copy the last report.
+type Server struct {
+	interval    time.Duration
+	router      instrumentation.Instrumentable
+	sinkManager instrumentation.Instrumentable
+	listeners   map[string]instrumentation.Instrumentable // by protocol
+	startTime   time.Time
+
+	*healthendpoint.Server
+
+	lock   sync.RWMutex
+	report Report
+	last   sample
+}
+
+func NewServer(address string, interval time.Duration, router, sinkManager instrumentation.Instrumentable, logger *gosteno.Logger) *Server {
+	s := &Server{
+		interval:    interval,
+		router:      router,
+		sinkManager: sinkManager,
+		listeners:   make(map[string]instrumentation.Instrumentable),
+		startTime:   time.Now(),
+	}
+	s.Server = healthendpoint.NewServer(address, interval, s.sample, s, logger)
+	return s
+}
+
+// SetListener makes the report count the envelopes received by listener
+// under protocol, such as "udp" or "tls", from its receivedMessageCount. It
+// must be called before Start.
+func (s *Server) SetListener(protocol string, listener instrumentation.Instrumentable) {
+	s.listeners[protocol] = listener
+}
+
+func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.lock.RLock()
+	report := s.report
+	s.lock.RUnlock()
+
+	report.UptimeSeconds = time.Since(s.startTime).Seconds()
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(report)
+}
+
+func (s *Server) sample() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.last = s.sampleMetrics(&s.report)
+}
+
+// sampleMetrics fills in the report from the current metrics and returns the
+// counters to compare the next sample against. It must be called with the
+// lock held.
+func (s *Server) sampleMetrics(report *Report) sample {
+	routerMetrics := healthendpoint.MetricsByName(s.router.Emit())
+	sinkManagerMetrics := healthendpoint.MetricsByName(s.sinkManager.Emit())
+
+	current := sample{
+		received: make(map[string]uint64, len(s.listeners)),
+		routed:   uint64(routerMetrics["routedMessages"]),
+		dropped:  sinkManagerMetrics["totalDroppedMessages"],
+	}
+
+	report.IntervalSeconds = s.interval.Seconds()
+	report.ReceivedEnvelopes = make(map[string]uint64, len(s.listeners))
+	for protocol, listener := range s.listeners {
+		current.received[protocol] = uint64(healthendpoint.MetricsByName(listener.Emit())["receivedMessageCount"])
+		report.ReceivedEnvelopes[protocol] = current.received[protocol] - s.last.received[protocol]
+	}
+	report.RoutedEnvelopes = current.routed - s.last.routed
+	report.DroppedMessages = current.dropped - s.last.dropped
+	report.BufferedMessages = sinkManagerMetrics["totalBufferedMessages"]
+
+	report.Sinks = make(map[string]int64, len(sinkMetrics))
+	for sinkType, metricName := range sinkMetrics {
+		report.Sinks[sinkType] = sinkManagerMetrics[metricName]
+	}
+
+	return current
+}
@@ -0,0 +1,162 @@
+package health_test
+
+import (
+	"doppler/health"
+	"doppler/sinkserver"
+	"doppler/sinkserver/blacklist"
+	"doppler/sinkserver/sinkmanager"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health Server", func() {
+	const address = "127.0.0.1:9093"
+
+	var (
+		sinkManager     *sinkmanager.SinkManager
+		messageRouter   *sinkserver.MessageRouter
+		healthServer    *health.Server
+		udpListener     *fakeListener
+		tlsListener     *fakeListener
+		incomingChan    chan *events.Envelope
+		sinkManagerDone chan struct{}
+		serverDone      chan struct{}
+	)
+
+	getReport := func() health.Report {
+		var report health.Report
+		response, err := http.Get("http://" + address)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+
+		Expect(response.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(json.NewDecoder(response.Body).Decode(&report)).To(Succeed())
+		return report
+	}
+
+	sendLogMessages := func(count int) {
+		for i := 0; i < count; i++ {
+			envelope, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "message", "app-id", "App"), "origin")
+			incomingChan <- envelope
+		}
+	}
+
+	BeforeEach(func() {
+		logger := loggertesthelper.Logger()
+		sinkManager = sinkmanager.New(10, false, blacklist.New(nil), logger, "dropsonde-origin", time.Minute, time.Minute, time.Minute, 0, 0)
+		messageRouter = sinkserver.NewMessageRouter(sinkManager, 2, logger)
+		incomingChan = make(chan *events.Envelope)
+
+		sinkManagerDone = make(chan struct{})
+		go func() {
+			defer close(sinkManagerDone)
+			sinkManager.Start(make(chan appservice.AppService), make(chan appservice.AppService))
+		}()
+		go messageRouter.Start(incomingChan)
+
+		udpListener = &fakeListener{}
+		tlsListener = &fakeListener{}
+		healthServer = health.NewServer(address, 100*time.Millisecond, messageRouter, sinkManager, logger)
+		healthServer.SetListener("udp", udpListener)
+		healthServer.SetListener("tls", tlsListener)
+		serverDone = make(chan struct{})
+		go func() {
+			defer close(serverDone)
+			healthServer.Start()
+		}()
+
+		Eventually(func() error {
+			_, err := http.Get("http://" + address)
+			return err
+		}).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		healthServer.Stop()
+		Eventually(serverDone).Should(BeClosed())
+		messageRouter.Stop()
+		sinkManager.Stop()
+		<-sinkManagerDone
+	})
+
+	It("reports uptime and the sampling interval", func() {
+		report := getReport()
+		Expect(report.UptimeSeconds).To(BeNumerically(">", 0))
+		Expect(report.IntervalSeconds).To(Equal(0.1))
+
+		time.Sleep(10 * time.Millisecond)
+		Expect(getReport().UptimeSeconds).To(BeNumerically(">", report.UptimeSeconds))
+	})
+
+	It("reports no traffic and no sinks before anything was received", func() {
+		report := getReport()
+		Expect(report.ReceivedEnvelopes).To(Equal(map[string]uint64{"udp": 0, "tls": 0}))
+		Expect(report.RoutedEnvelopes).To(BeZero())
+		Expect(report.DroppedMessages).To(BeZero())
+		Expect(report.BufferedMessages).To(BeZero())
+		Expect(report.Sinks).To(Equal(map[string]int64{"dump": 0, "syslog": 0, "syslog-udp": 0, "websocket": 0, "firehose": 0}))
+	})
+
+	It("reports the envelopes received per protocol in the last interval", func() {
+		udpListener.receive(25)
+		tlsListener.receive(5)
+
+		Eventually(func() map[string]uint64 { return getReport().ReceivedEnvelopes }).Should(Equal(map[string]uint64{"udp": 25, "tls": 5}))
+		Eventually(func() map[string]uint64 { return getReport().ReceivedEnvelopes }).Should(Equal(map[string]uint64{"udp": 0, "tls": 0}))
+	})
+
+	It("reports the envelopes routed in the last interval", func() {
+		sendLogMessages(25)
+
+		Eventually(func() uint64 { return getReport().RoutedEnvelopes }).Should(Equal(uint64(25)))
+		Eventually(func() uint64 { return getReport().RoutedEnvelopes }).Should(BeZero())
+	})
+
+	It("reports the sinks created for incoming traffic", func() {
+		sendLogMessages(1)
+
+		Eventually(func() int64 { return getReport().Sinks["dump"] }).Should(Equal(int64(1)))
+	})
+
+	It("reports the same numbers as the emitted metrics", func() {
+		sendLogMessages(10)
+
+		Eventually(func() uint64 { return getReport().RoutedEnvelopes }).Should(Equal(uint64(10)))
+		for _, metric := range messageRouter.Emit().Metrics {
+			if metric.Name == "routedMessages" {
+				Expect(metric.Value).To(Equal(uint64(10)))
+			}
+		}
+	})
+})
+
+// fakeListener stands in for a dropsonde listener, reporting the messages
+// the test says it received.
+type fakeListener struct {
+	receivedMessageCount uint64
+}
+
+func (l *fakeListener) receive(count uint64) {
+	atomic.AddUint64(&l.receivedMessageCount, count)
+}
+
+func (l *fakeListener) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: "fakeListener",
+		Metrics: []instrumentation.Metric{
+			{Name: "receivedMessageCount", Value: atomic.LoadUint64(&l.receivedMessageCount)},
+		},
+	}
+}
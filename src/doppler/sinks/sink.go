@@ -16,8 +16,15 @@ type Sink interface {
 	UpdateDroppedMessageCount(int64)
 }
 
-func RunTruncatingBuffer(inputChan <-chan *events.Envelope, bufferSize uint, logger *gosteno.Logger, dropsondeOrigin string) *truncatingbuffer.TruncatingBuffer {
-	b := truncatingbuffer.NewTruncatingBuffer(inputChan, bufferSize, logger, dropsondeOrigin)
+// BufferSized is implemented by sinks that buffer their messages in a
+// truncating buffer whose size can be decided by someone else. It has to be
+// set before the sink runs.
+type BufferSized interface {
+	SetBufferSizer(truncatingbuffer.BufferSizer)
+}
+
+func RunTruncatingBuffer(inputChan <-chan *events.Envelope, sizer truncatingbuffer.BufferSizer, logger *gosteno.Logger, dropsondeOrigin string) *truncatingbuffer.TruncatingBuffer {
+	b := truncatingbuffer.NewSizedTruncatingBuffer(inputChan, sizer, logger, dropsondeOrigin)
 	go b.Run()
 	return b
 }
@@ -0,0 +1,55 @@
+package syslog
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/dropsonde/events"
+)
+
+type DrainType int
+
+const (
+	DrainTypeLogs DrainType = iota
+	DrainTypeMetrics
+	DrainTypeAll
+)
+
+const DrainTypeParam = "drain-type"
+
+// ParseDrainType interprets the value of a drain URL's drain-type query
+// parameter. An empty value selects logs. Unrecognized values also select
+// logs, but return an error describing the value that was ignored.
+func ParseDrainType(value string) (DrainType, error) {
+	switch value {
+	case "", "logs":
+		return DrainTypeLogs, nil
+	case "metrics":
+		return DrainTypeMetrics, nil
+	case "all":
+		return DrainTypeAll, nil
+	default:
+		return DrainTypeLogs, fmt.Errorf("unknown drain-type %q, must be logs, metrics or all", value)
+	}
+}
+
+func (d DrainType) String() string {
+	switch d {
+	case DrainTypeMetrics:
+		return "metrics"
+	case DrainTypeAll:
+		return "all"
+	default:
+		return "logs"
+	}
+}
+
+func (d DrainType) Accepts(envelope *events.Envelope) bool {
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage:
+		return d == DrainTypeLogs || d == DrainTypeAll
+	case events.Envelope_ContainerMetric, events.Envelope_ValueMetric, events.Envelope_CounterEvent:
+		return d == DrainTypeMetrics || d == DrainTypeAll
+	default:
+		return false
+	}
+}
@@ -0,0 +1,69 @@
+package syslog_test
+
+import (
+	"doppler/sinks/syslog"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DrainType", func() {
+	Describe("ParseDrainType", func() {
+		It("parses the known drain types", func() {
+			Expect(syslog.ParseDrainType("logs")).To(Equal(syslog.DrainTypeLogs))
+			Expect(syslog.ParseDrainType("metrics")).To(Equal(syslog.DrainTypeMetrics))
+			Expect(syslog.ParseDrainType("all")).To(Equal(syslog.DrainTypeAll))
+		})
+
+		It("defaults to logs when no drain type is given", func() {
+			Expect(syslog.ParseDrainType("")).To(Equal(syslog.DrainTypeLogs))
+		})
+
+		It("falls back to logs and returns an error for an unknown drain type", func() {
+			drainType, err := syslog.ParseDrainType("bogus")
+			Expect(err).To(MatchError(ContainSubstring(`unknown drain-type "bogus"`)))
+			Expect(drainType).To(Equal(syslog.DrainTypeLogs))
+		})
+	})
+
+	Describe("Accepts", func() {
+		var logMessage, containerMetric, valueMetric, counterEvent, heartbeat *events.Envelope
+
+		BeforeEach(func() {
+			logMessage, _ = emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "log", "appId", "App"), "origin")
+			containerMetric, _ = emitter.Wrap(factories.NewContainerMetric("appId", 0, 1, 2, 3), "origin")
+			valueMetric, _ = emitter.Wrap(&events.ValueMetric{Name: proto.String("metric"), Value: proto.Float64(1), Unit: proto.String("ms")}, "origin")
+			counterEvent, _ = emitter.Wrap(&events.CounterEvent{Name: proto.String("counter"), Delta: proto.Uint64(1), Total: proto.Uint64(2)}, "origin")
+			heartbeat, _ = emitter.Wrap(factories.NewHeartbeat(1, 2, 3), "origin")
+		})
+
+		It("accepts only log messages for logs drains", func() {
+			Expect(syslog.DrainTypeLogs.Accepts(logMessage)).To(BeTrue())
+			Expect(syslog.DrainTypeLogs.Accepts(containerMetric)).To(BeFalse())
+			Expect(syslog.DrainTypeLogs.Accepts(valueMetric)).To(BeFalse())
+			Expect(syslog.DrainTypeLogs.Accepts(counterEvent)).To(BeFalse())
+			Expect(syslog.DrainTypeLogs.Accepts(heartbeat)).To(BeFalse())
+		})
+
+		It("accepts only metrics for metrics drains", func() {
+			Expect(syslog.DrainTypeMetrics.Accepts(logMessage)).To(BeFalse())
+			Expect(syslog.DrainTypeMetrics.Accepts(containerMetric)).To(BeTrue())
+			Expect(syslog.DrainTypeMetrics.Accepts(valueMetric)).To(BeTrue())
+			Expect(syslog.DrainTypeMetrics.Accepts(counterEvent)).To(BeTrue())
+			Expect(syslog.DrainTypeMetrics.Accepts(heartbeat)).To(BeFalse())
+		})
+
+		It("accepts logs and metrics for all drains", func() {
+			Expect(syslog.DrainTypeAll.Accepts(logMessage)).To(BeTrue())
+			Expect(syslog.DrainTypeAll.Accepts(containerMetric)).To(BeTrue())
+			Expect(syslog.DrainTypeAll.Accepts(valueMetric)).To(BeTrue())
+			Expect(syslog.DrainTypeAll.Accepts(counterEvent)).To(BeTrue())
+			Expect(syslog.DrainTypeAll.Accepts(heartbeat)).To(BeFalse())
+		})
+	})
+})
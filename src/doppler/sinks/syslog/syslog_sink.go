@@ -4,6 +4,7 @@ import (
 	"doppler/sinks"
 	"doppler/sinks/retrystrategy"
 	"doppler/sinks/syslogwriter"
+	"doppler/truncatingbuffer"
 	"fmt"
 	"sync"
 	"time"
@@ -12,6 +13,10 @@ import (
 	"github.com/cloudfoundry/gosteno"
 )
 
+const metricPriorityValue = 14
+
+const defaultBufferSize = 100
+
 const (
 	dial_error_debug_string = "Syslog Sink %s: Error when dialing out. Backing off for %v. Err: %v"
 	dialing_debug_string    = "Syslog Sink %s: Not connected. Trying to connect."
@@ -22,6 +27,7 @@ type SyslogSink struct {
 	*gosteno.Logger
 	appId             string
 	drainUrl          string
+	drainType         DrainType
 	sentMessageCount  *uint64
 	sentByteCount     *uint64
 	listenerChannel   chan *events.Envelope
@@ -29,24 +35,31 @@ type SyslogSink struct {
 	handleSendError   func(errorMessage, appId, drainUrl string)
 	disconnectChannel chan struct{}
 	dropsondeOrigin   string
+	bufferSizer       truncatingbuffer.BufferSizer
 	disconnectOnce    sync.Once
 	sinks.DropCounter
 }
 
-func NewSyslogSink(appId string, drainUrl string, givenLogger *gosteno.Logger, syslogWriter syslogwriter.Writer, errorHandler func(string, string, string), dropsondeOrigin string, metricUpdateChan chan<- int64) sinks.Sink {
+func NewSyslogSink(appId string, drainUrl string, drainType DrainType, givenLogger *gosteno.Logger, syslogWriter syslogwriter.Writer, errorHandler func(string, string, string), dropsondeOrigin string, metricUpdateChan chan<- int64) sinks.Sink {
 	givenLogger.Debugf("Syslog Sink %s: Created for appId [%s]", drainUrl, appId)
 	return &SyslogSink{
 		appId:             appId,
 		drainUrl:          drainUrl,
+		drainType:         drainType,
 		Logger:            givenLogger,
 		syslogWriter:      syslogWriter,
 		handleSendError:   errorHandler,
 		disconnectChannel: make(chan struct{}),
 		dropsondeOrigin:   dropsondeOrigin,
+		bufferSizer:       truncatingbuffer.FixedSize(defaultBufferSize),
 		DropCounter:       sinks.NewDropCounter(appId, drainUrl, metricUpdateChan),
 	}
 }
 
+func (s *SyslogSink) SetBufferSizer(sizer truncatingbuffer.BufferSizer) {
+	s.bufferSizer = sizer
+}
+
 func (s *SyslogSink) Run(inputChan <-chan *events.Envelope) {
 	s.Infof("Syslog Sink %s: Running.", s.drainUrl)
 	defer s.Errorf("Syslog Sink %s: Stopped.", s.drainUrl)
@@ -65,7 +78,7 @@ func (s *SyslogSink) Run(inputChan <-chan *events.Envelope) {
 					return
 				}
 
-				if v.GetEventType() != events.Envelope_LogMessage {
+				if !s.drainType.Accepts(v) {
 					continue
 				}
 
@@ -76,7 +89,7 @@ func (s *SyslogSink) Run(inputChan <-chan *events.Envelope) {
 		}
 	}()
 
-	buffer := sinks.RunTruncatingBuffer(filteredChan, 100, s.Logger, s.dropsondeOrigin)
+	buffer := sinks.RunTruncatingBuffer(filteredChan, s.bufferSizer, s.Logger, s.dropsondeOrigin)
 	timer := time.NewTimer(backoffStrategy(numberOfTries))
 	connected := false
 	defer timer.Stop()
@@ -150,9 +163,12 @@ func (s *SyslogSink) ShouldReceiveErrors() bool {
 }
 
 func (s *SyslogSink) sendMessage(messageEnvelope *events.Envelope) bool {
-	logMessage := messageEnvelope.GetLogMessage()
-
-	_, err := s.syslogWriter.Write(messagePriorityValue(logMessage), logMessage.GetMessage(), logMessage.GetSourceType(), logMessage.GetSourceInstance(), *logMessage.Timestamp)
+	var err error
+	if logMessage := messageEnvelope.GetLogMessage(); logMessage != nil {
+		_, err = s.syslogWriter.Write(messagePriorityValue(logMessage), logMessage.GetMessage(), logMessage.GetSourceType(), logMessage.GetSourceInstance(), *logMessage.Timestamp)
+	} else {
+		_, err = s.syslogWriter.Write(metricPriorityValue, formatMetric(messageEnvelope), messageEnvelope.GetOrigin(), metricSourceInstance(messageEnvelope), messageEnvelope.GetTimestamp())
+	}
 
 	if err != nil {
 		s.Debugf("Syslog Sink %s: Error when trying to send data to sink. Backing off. Err: %v\n", s.drainUrl, err)
@@ -163,6 +179,29 @@ func (s *SyslogSink) sendMessage(messageEnvelope *events.Envelope) bool {
 	}
 }
 
+func formatMetric(envelope *events.Envelope) []byte {
+	switch envelope.GetEventType() {
+	case events.Envelope_ContainerMetric:
+		metric := envelope.GetContainerMetric()
+		return []byte(fmt.Sprintf("cpuPercentage=%g memoryBytes=%d diskBytes=%d", metric.GetCpuPercentage(), metric.GetMemoryBytes(), metric.GetDiskBytes()))
+	case events.Envelope_ValueMetric:
+		metric := envelope.GetValueMetric()
+		return []byte(fmt.Sprintf("%s=%g %s", metric.GetName(), metric.GetValue(), metric.GetUnit()))
+	case events.Envelope_CounterEvent:
+		counter := envelope.GetCounterEvent()
+		return []byte(fmt.Sprintf("%s delta=%d total=%d", counter.GetName(), counter.GetDelta(), counter.GetTotal()))
+	default:
+		return []byte{}
+	}
+}
+
+func metricSourceInstance(envelope *events.Envelope) string {
+	if metric := envelope.GetContainerMetric(); metric != nil {
+		return fmt.Sprintf("%d", metric.GetInstanceIndex())
+	}
+	return ""
+}
+
 func messagePriorityValue(msg *events.LogMessage) int {
 	switch msg.GetMessageType() {
 	case events.LogMessage_OUT:
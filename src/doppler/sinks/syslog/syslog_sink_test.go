@@ -3,8 +3,14 @@ package syslog_test
 import (
 	"doppler/sinks"
 	"doppler/sinks/syslog"
+	"doppler/sinks/syslogwriter"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -62,7 +68,7 @@ var _ = Describe("SyslogSink", func() {
 		}
 
 		updateMetricChan = make(chan int64, 1)
-		syslogSink = syslog.NewSyslogSink("appId", "syslog://using-fake", loggertesthelper.Logger(), sysLogger, errorHandler, "dropsonde-origin", updateMetricChan).(*syslog.SyslogSink)
+		syslogSink = syslog.NewSyslogSink("appId", "syslog://using-fake", syslog.DrainTypeLogs, loggertesthelper.Logger(), sysLogger, errorHandler, "dropsonde-origin", updateMetricChan).(*syslog.SyslogSink)
 	})
 
 	AfterEach(func() {
@@ -243,6 +249,61 @@ var _ = Describe("SyslogSink", func() {
 		})
 	})
 
+	Describe("drain types", func() {
+		var mixedStream []*events.Envelope
+
+		BeforeEach(func() {
+			logMessage := factories.NewLogMessage(events.LogMessage_OUT, "test message", "appId", "App")
+			logMessage.SourceInstance = proto.String("2")
+			logEnvelope, _ := emitter.Wrap(logMessage, "origin")
+			containerMetric, _ := emitter.Wrap(factories.NewContainerMetric("appId", 2, 73, 1024, 2048), "origin")
+			valueMetric, _ := emitter.Wrap(&events.ValueMetric{Name: proto.String("latency"), Value: proto.Float64(1.5), Unit: proto.String("ms")}, "origin")
+			counterEvent, _ := emitter.Wrap(&events.CounterEvent{Name: proto.String("requests"), Delta: proto.Uint64(3), Total: proto.Uint64(10)}, "origin")
+			heartbeat, _ := emitter.Wrap(factories.NewHeartbeat(1, 2, 3), "origin")
+
+			mixedStream = []*events.Envelope{logEnvelope, containerMetric, heartbeat, valueMetric, counterEvent}
+		})
+
+		runSink := func(drainType syslog.DrainType) []string {
+			syslogSink = syslog.NewSyslogSink("appId", "syslog://using-fake", drainType, loggertesthelper.Logger(), sysLogger, errorHandler, "dropsonde-origin", updateMetricChan).(*syslog.SyslogSink)
+			go func() {
+				syslogSink.Run(inputChan)
+				closeSysLoggerDoneChan()
+			}()
+
+			for _, envelope := range mixedStream {
+				inputChan <- envelope
+			}
+			close(inputChan)
+
+			Eventually(sysLoggerDoneChan).Should(BeClosed())
+			return sysLogger.ReceivedMessages()
+		}
+
+		It("delivers only log messages to logs drains", func() {
+			Expect(runSink(syslog.DrainTypeLogs)).To(ConsistOf(
+				MatchRegexp(`^<14>1 test message ts: \d+ src: App srcId: 2$`),
+			))
+		})
+
+		It("delivers only metrics to metrics drains", func() {
+			Expect(runSink(syslog.DrainTypeMetrics)).To(ConsistOf(
+				MatchRegexp(`^<14>1 cpuPercentage=73 memoryBytes=1024 diskBytes=2048 ts: \d+ src: origin srcId: 2$`),
+				MatchRegexp(`^<14>1 latency=1.5 ms ts: \d+ src: origin srcId: $`),
+				MatchRegexp(`^<14>1 requests delta=3 total=10 ts: \d+ src: origin srcId: $`),
+			))
+		})
+
+		It("delivers logs and metrics to all drains", func() {
+			Expect(runSink(syslog.DrainTypeAll)).To(ConsistOf(
+				MatchRegexp(`^<14>1 test message `),
+				MatchRegexp(`^<14>1 cpuPercentage=73 `),
+				MatchRegexp(`^<14>1 latency=1.5 ms `),
+				MatchRegexp(`^<14>1 requests delta=3 total=10 `),
+			))
+		})
+	})
+
 	Describe("Disconnect", func() {
 		It("is idempotent", func() {
 			syslogSink.Disconnect()
@@ -250,6 +311,91 @@ var _ = Describe("SyslogSink", func() {
 		})
 	})
 
+	Describe("with a drain that stops reading", func() {
+		var (
+			listener      net.Listener
+			readingConn   chan struct{}
+			blackholeConn net.Conn
+			stopFeeding   chan struct{}
+		)
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			readingConn = make(chan struct{})
+			stopFeeding = make(chan struct{})
+
+			// The first connection is accepted and never read from; later
+			// connections are read normally.
+			acceptedConns := make(chan net.Conn, 1)
+			go func() {
+				first := true
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					if first {
+						first = false
+						acceptedConns <- conn
+						continue
+					}
+
+					go func() {
+						buffer := make([]byte, 1024)
+						_, err := conn.Read(buffer)
+						if err == nil {
+							close(readingConn)
+						}
+						io.Copy(ioutil.Discard, conn)
+					}()
+				}
+			}()
+
+			drainUrl := "syslog://" + listener.Addr().String()
+			outputUrl, _ := url.Parse(drainUrl)
+			writer, err := syslogwriter.NewSyslogWriter(outputUrl, "appId", time.Second, 100*time.Millisecond, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			go func() {
+				for range updateMetricChan {
+				}
+			}()
+
+			syslogSink = syslog.NewSyslogSink("appId", drainUrl, syslog.DrainTypeLogs, loggertesthelper.Logger(), writer, errorHandler, "dropsonde-origin", updateMetricChan).(*syslog.SyslogSink)
+			go syslogSink.Run(inputChan)
+
+			largeMessage := strings.Repeat("a", 64*1024)
+			feedChan := inputChan
+			go func() {
+				for {
+					logMessage := factories.NewLogMessage(events.LogMessage_OUT, largeMessage, "appId", "App")
+					envelope, _ := emitter.Wrap(logMessage, "origin")
+					select {
+					case feedChan <- envelope:
+					case <-stopFeeding:
+						return
+					}
+				}
+			}()
+
+			Eventually(acceptedConns).Should(Receive(&blackholeConn))
+		})
+
+		AfterEach(func() {
+			close(stopFeeding)
+			syslogSink.Disconnect()
+			listener.Close()
+			blackholeConn.Close()
+		})
+
+		It("reconnects once a write misses its deadline", func() {
+			Eventually(readingConn, 5).Should(BeClosed())
+		})
+	})
+
 	Describe("GetInstrumentationMetric", func() {
 		It("emits an emptry metrics if no dropped messages", func() {
 			metrics := syslogSink.GetInstrumentationMetric()
@@ -0,0 +1,241 @@
+package syslog
+
+import (
+	"bytes"
+	"doppler/sinks"
+	"doppler/sinks/syslogwriter"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+)
+
+const (
+	// UdpScheme is the drain URL scheme of lossy RFC 3164 syslog drains.
+	UdpScheme = "syslog-udp"
+
+	// LossyUdpMessagesLostMetricName is reported instead of the usual
+	// numberOfMessagesLost, since UDP drains lose messages by design.
+	LossyUdpMessagesLostMetricName = "numberOfLossyUdpSyslogMessagesLost"
+
+	DefaultUdpMaxDatagramSize = 1024
+
+	udpSendQueueSize     = 32
+	udpDropFlushInterval = time.Second
+	truncationIndicator  = "...[truncated]"
+	rfc3164              = "Jan _2 15:04:05"
+)
+
+// UdpSyslogSink sends RFC 3164 formatted messages to a syslog drain over
+// UDP. Sends are fire-and-forget: there is no retry and messages that do not
+// fit into the small send queue are dropped. Drops are counted locally and
+// passed on to the metric update channel in batches, so that a drain dropping
+// every message does not block on the channel once per message.
+type UdpSyslogSink struct {
+	*gosteno.Logger
+	appId           string
+	drainUrl        string
+	host            string
+	drainType       DrainType
+	maxDatagramSize int
+	resolveInterval time.Duration
+	handleSendError func(errorMessage, appId, drainUrl string)
+
+	droppedMessageCount int64
+	flushedMessageCount int64
+	dropFlushInterval   time.Duration
+	metricUpdateChan    chan<- int64
+}
+
+// NewUdpSyslogSink returns a sink sending to host, which is re-resolved every
+// resolveInterval, or only while unresolved if resolveInterval is zero.
+// Messages longer than maxDatagramSize are truncated.
+func NewUdpSyslogSink(appId string, drainUrl string, host string, drainType DrainType, givenLogger *gosteno.Logger, maxDatagramSize int, resolveInterval time.Duration, errorHandler func(string, string, string), metricUpdateChan chan<- int64) sinks.Sink {
+	givenLogger.Debugf("UDP Syslog Sink %s: Created for appId [%s]", drainUrl, appId)
+
+	if maxDatagramSize <= 0 {
+		maxDatagramSize = DefaultUdpMaxDatagramSize
+	}
+
+	return &UdpSyslogSink{
+		Logger:            givenLogger,
+		appId:             appId,
+		drainUrl:          drainUrl,
+		host:              host,
+		drainType:         drainType,
+		maxDatagramSize:   maxDatagramSize,
+		resolveInterval:   resolveInterval,
+		handleSendError:   errorHandler,
+		dropFlushInterval: udpDropFlushInterval,
+		metricUpdateChan:  metricUpdateChan,
+	}
+}
+
+// SetDropFlushInterval sets how often drops are passed on to the metric
+// update channel. It must be called before Run.
+func (s *UdpSyslogSink) SetDropFlushInterval(interval time.Duration) {
+	s.dropFlushInterval = interval
+}
+
+func (s *UdpSyslogSink) Run(inputChan <-chan *events.Envelope) {
+	s.Infof("UDP Syslog Sink %s: Running.", s.drainUrl)
+	defer s.Infof("UDP Syslog Sink %s: Stopped.", s.drainUrl)
+
+	sendQueue := make(chan *events.Envelope, udpSendQueueSize)
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		s.send(sendQueue)
+	}()
+
+	stopFlushing := make(chan struct{})
+	flushDone := make(chan struct{})
+	go func() {
+		defer close(flushDone)
+		s.flushDropsPeriodically(stopFlushing)
+	}()
+
+	for envelope := range inputChan {
+		if !s.drainType.Accepts(envelope) {
+			continue
+		}
+
+		select {
+		case sendQueue <- envelope:
+		default:
+			s.UpdateDroppedMessageCount(1)
+		}
+	}
+
+	close(sendQueue)
+	<-sendDone
+	close(stopFlushing)
+	<-flushDone
+	s.flushDrops()
+}
+
+func (s *UdpSyslogSink) flushDropsPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.dropFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.flushDrops()
+		}
+	}
+}
+
+// flushDrops sends the drops counted since the last flush to the metric
+// update channel. It is only called from one goroutine at a time.
+func (s *UdpSyslogSink) flushDrops() {
+	dropped := atomic.LoadInt64(&s.droppedMessageCount)
+	if delta := dropped - s.flushedMessageCount; delta > 0 {
+		s.metricUpdateChan <- delta
+		s.flushedMessageCount = dropped
+	}
+}
+
+func (s *UdpSyslogSink) send(sendQueue <-chan *events.Envelope) {
+	var conn *net.UDPConn
+	var resolvedAddr string
+	var lastResolve time.Time
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for envelope := range sendQueue {
+		if conn == nil || (s.resolveInterval > 0 && time.Since(lastResolve) >= s.resolveInterval) {
+			lastResolve = time.Now()
+			addr, err := net.ResolveUDPAddr("udp", s.host)
+			if err != nil {
+				s.handleSendError(fmt.Sprintf("UDP Syslog Sink %s: Error resolving drain. Err: %v", s.drainUrl, err), s.appId, s.drainUrl)
+			} else if conn == nil || addr.String() != resolvedAddr {
+				newConn, err := net.DialUDP("udp", nil, addr)
+				if err != nil {
+					s.handleSendError(fmt.Sprintf("UDP Syslog Sink %s: Error dialing drain. Err: %v", s.drainUrl, err), s.appId, s.drainUrl)
+				} else {
+					if conn != nil {
+						conn.Close()
+					}
+					s.Debugf("UDP Syslog Sink %s: Sending to %s", s.drainUrl, addr)
+					conn = newConn
+					resolvedAddr = addr.String()
+				}
+			}
+		}
+
+		if conn == nil {
+			s.UpdateDroppedMessageCount(1)
+			continue
+		}
+
+		_, err := conn.Write(s.formatMessage(envelope))
+		if err != nil {
+			s.Debugf("UDP Syslog Sink %s: Error when sending data. Err: %v", s.drainUrl, err)
+			s.UpdateDroppedMessageCount(1)
+		}
+	}
+}
+
+func (s *UdpSyslogSink) formatMessage(envelope *events.Envelope) []byte {
+	var message []byte
+	if logMessage := envelope.GetLogMessage(); logMessage != nil {
+		message = createRfc3164Message(messagePriorityValue(logMessage), s.appId, logMessage.GetSourceType(), logMessage.GetSourceInstance(), logMessage.GetMessage(), logMessage.GetTimestamp())
+	} else {
+		message = createRfc3164Message(metricPriorityValue, s.appId, envelope.GetOrigin(), metricSourceInstance(envelope), formatMetric(envelope), envelope.GetTimestamp())
+	}
+
+	return truncate(message, s.maxDatagramSize)
+}
+
+// createRfc3164Message formats a message as
+// "<PRI>Mmm dd hh:mm:ss loggregator appId[source/instance]: message".
+func createRfc3164Message(priority int, appId string, source string, sourceId string, message []byte, timestamp int64) []byte {
+	message = bytes.TrimRight(bytes.Replace(message, []byte("\000"), nil, -1), "\n")
+	timeString := time.Unix(0, timestamp).UTC().Format(rfc3164)
+
+	return []byte(fmt.Sprintf("<%d>%s %s %s%s: %s", priority, timeString, "loggregator", appId, syslogwriter.FormatProcId(source, sourceId), message))
+}
+
+// truncate cuts message down to maxSize bytes, ending it with a marker so the
+// receiver can tell it was truncated.
+func truncate(message []byte, maxSize int) []byte {
+	if len(message) <= maxSize {
+		return message
+	}
+	if maxSize <= len(truncationIndicator) {
+		return message[:maxSize]
+	}
+
+	return append(message[:maxSize-len(truncationIndicator)], truncationIndicator...)
+}
+
+func (s *UdpSyslogSink) Identifier() string {
+	return s.drainUrl
+}
+
+func (s *UdpSyslogSink) StreamId() string {
+	return s.appId
+}
+
+func (s *UdpSyslogSink) ShouldReceiveErrors() bool {
+	return false
+}
+
+func (s *UdpSyslogSink) GetInstrumentationMetric() sinks.Metric {
+	count := atomic.LoadInt64(&s.droppedMessageCount)
+	return sinks.Metric{Name: LossyUdpMessagesLostMetricName, Tags: map[string]interface{}{"appId": s.appId, "drainUrl": s.drainUrl}, Value: count}
+}
+
+func (s *UdpSyslogSink) UpdateDroppedMessageCount(messageCount int64) {
+	atomic.AddInt64(&s.droppedMessageCount, messageCount)
+}
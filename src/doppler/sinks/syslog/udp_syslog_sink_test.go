@@ -0,0 +1,164 @@
+package syslog_test
+
+import (
+	"doppler/sinks/syslog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UdpSyslogSink", func() {
+	var (
+		drain            *net.UDPConn
+		inputChan        chan *events.Envelope
+		updateMetricChan chan int64
+		errors           chan string
+	)
+
+	newSink := func(host string, drainType syslog.DrainType, maxDatagramSize int) *syslog.UdpSyslogSink {
+		errorHandler := func(errorMsg string, appId string, drainUrl string) {
+			select {
+			case errors <- errorMsg:
+			default:
+			}
+		}
+		return syslog.NewUdpSyslogSink("appId", "syslog-udp://"+host, host, drainType, loggertesthelper.Logger(), maxDatagramSize, 0, errorHandler, updateMetricChan).(*syslog.UdpSyslogSink)
+	}
+
+	readDatagram := func() string {
+		buffer := make([]byte, 65535)
+		n, err := drain.Read(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buffer[:n])
+	}
+
+	logEnvelope := func(message string) *events.Envelope {
+		envelope, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, message, "appId", "App"), "origin")
+		envelope.GetLogMessage().SourceInstance = proto.String("2")
+		return envelope
+	}
+
+	BeforeEach(func() {
+		var err error
+		drain, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).NotTo(HaveOccurred())
+
+		inputChan = make(chan *events.Envelope)
+		updateMetricChan = make(chan int64, 100)
+		errors = make(chan string, 10)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+		drain.Close()
+	})
+
+	It("sends log messages in RFC 3164 format", func() {
+		sink := newSink(drain.LocalAddr().String(), syslog.DrainTypeLogs, 1024)
+		go sink.Run(inputChan)
+
+		inputChan <- logEnvelope("just a test\n")
+
+		Expect(readDatagram()).To(MatchRegexp(`^<14>[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2} loggregator appId\[App/2\]: just a test$`))
+	})
+
+	It("sends metrics to drains accepting them", func() {
+		sink := newSink(drain.LocalAddr().String(), syslog.DrainTypeAll, 1024)
+		go sink.Run(inputChan)
+
+		envelope, _ := emitter.Wrap(factories.NewValueMetric("cpu", 1.5, "percent"), "origin")
+		inputChan <- envelope
+
+		Expect(readDatagram()).To(MatchRegexp(`^<14>.* loggregator appId\[origin/-\]: cpu=1.5 percent$`))
+	})
+
+	It("tags messages with the source type and instance", func() {
+		sink := newSink(drain.LocalAddr().String(), syslog.DrainTypeLogs, 1024)
+		go sink.Run(inputChan)
+
+		envelope, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "staging", "appId", "STG"), "origin")
+		envelope.GetLogMessage().SourceInstance = proto.String("1")
+		inputChan <- envelope
+		Expect(readDatagram()).To(HaveSuffix(" loggregator appId[STG/1]: staging"))
+
+		envelope, _ = emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "routed", "appId", "RTR"), "origin")
+		inputChan <- envelope
+		Expect(readDatagram()).To(HaveSuffix(" loggregator appId[RTR/-]: routed"))
+	})
+
+	It("truncates messages longer than the max datagram size", func() {
+		sink := newSink(drain.LocalAddr().String(), syslog.DrainTypeLogs, 64)
+		go sink.Run(inputChan)
+
+		inputChan <- logEnvelope(strings.Repeat("a", 100))
+
+		datagram := readDatagram()
+		Expect(datagram).To(HaveLen(64))
+		Expect(datagram).To(HaveSuffix("aaa...[truncated]"))
+	})
+
+	It("does not truncate messages that fit", func() {
+		sink := newSink(drain.LocalAddr().String(), syslog.DrainTypeLogs, 1024)
+		go sink.Run(inputChan)
+
+		inputChan <- logEnvelope(strings.Repeat("a", 100))
+
+		Expect(readDatagram()).To(HaveSuffix(": " + strings.Repeat("a", 100)))
+	})
+
+	Context("when the drain cannot be resolved", func() {
+		It("reports an error and counts the messages as lost under the lossy metric", func() {
+			sink := newSink("127.0.0.1:not-a-port", syslog.DrainTypeLogs, 1024)
+			go sink.Run(inputChan)
+
+			for i := 0; i < 3; i++ {
+				inputChan <- logEnvelope("message")
+			}
+
+			Eventually(errors).Should(Receive(ContainSubstring("Error resolving drain")))
+			Eventually(func() int64 { return sink.GetInstrumentationMetric().Value }).Should(Equal(int64(3)))
+			Expect(sink.GetInstrumentationMetric().Name).To(Equal("numberOfLossyUdpSyslogMessagesLost"))
+
+			var flushed int64
+			Eventually(func() int64 {
+				select {
+				case delta := <-updateMetricChan:
+					flushed += delta
+				default:
+				}
+				return flushed
+			}, 3).Should(Equal(int64(3)))
+		})
+
+		It("passes the drops on to the metric update channel in batches", func() {
+			sink := newSink("127.0.0.1:not-a-port", syslog.DrainTypeLogs, 1024)
+			sink.SetDropFlushInterval(time.Hour)
+			sinkDone := make(chan struct{})
+			input := make(chan *events.Envelope)
+			go func() {
+				defer close(sinkDone)
+				sink.Run(input)
+			}()
+
+			for i := 0; i < 5; i++ {
+				input <- logEnvelope("message")
+			}
+			Eventually(func() int64 { return sink.GetInstrumentationMetric().Value }).Should(Equal(int64(5)))
+			Consistently(updateMetricChan).ShouldNot(Receive())
+
+			close(input)
+			<-sinkDone
+			Expect(updateMetricChan).To(Receive(Equal(int64(5))))
+			Expect(updateMetricChan).NotTo(Receive())
+		})
+	})
+})
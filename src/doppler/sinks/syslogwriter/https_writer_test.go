@@ -39,12 +39,12 @@ var _ = Describe("HttpsWriter", func() {
 
 			parsedTime, err := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 			byteCount, err := w.Write(standardErrorPriority, []byte("Message"), "just a test", "TEST", parsedTime.UnixNano())
-			Expect(byteCount).To(Equal(76))
+			Expect(byteCount).To(Equal(81))
 			Expect(err).ToNot(HaveOccurred())
 
 			Eventually(func() string {
 				return string(<-requestChan)
-			}).Should(ContainSubstring("loggregator appId [just a test] - - Message"))
+			}).Should(ContainSubstring("loggregator appId [just a test/TEST] - - Message"))
 		})
 
 		It("returns an error when unable to HTTP POST the log message", func() {
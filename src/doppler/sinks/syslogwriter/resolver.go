@@ -0,0 +1,95 @@
+package syslogwriter
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Resolver looks up the addresses of a drain hostname. It has the signature
+// of net.LookupHost, which is the default.
+type Resolver func(host string) ([]string, error)
+
+// drainResolver resolves a drain's host on every connect and, for healthy
+// connections, again every interval, so drains follow DNS based failover.
+type drainResolver struct {
+	host     string
+	port     string
+	interval time.Duration
+	resolve  Resolver
+
+	lastResolved time.Time
+}
+
+func newDrainResolver(hostPort string, interval time.Duration) *drainResolver {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// dialing will fail with a descriptive error
+		host = hostPort
+	}
+
+	return &drainResolver{
+		host:     host,
+		port:     port,
+		interval: interval,
+		resolve:  net.LookupHost,
+	}
+}
+
+func (r *drainResolver) addresses() ([]string, error) {
+	r.lastResolved = time.Now()
+
+	ips, err := r.resolve(r.host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses found for " + r.host)
+	}
+
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		addresses[i] = net.JoinHostPort(ip, r.port)
+	}
+	return addresses, nil
+}
+
+// dial resolves the host and dials its addresses in order until one
+// succeeds. A resolution failure is returned like a dial failure.
+func (r *drainResolver) dial(dialAddress func(address string) (net.Conn, error)) (net.Conn, error) {
+	addresses, err := r.addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, address := range addresses {
+		var conn net.Conn
+		conn, err = dialAddress(address)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// moved reports whether conn's address is no longer among the host's
+// addresses. The host is only re-resolved once the interval has passed, and a
+// failed resolution keeps the connection.
+func (r *drainResolver) moved(conn net.Conn) bool {
+	if r.interval <= 0 || time.Since(r.lastResolved) < r.interval {
+		return false
+	}
+
+	addresses, err := r.addresses()
+	if err != nil {
+		return false
+	}
+
+	current := conn.RemoteAddr().String()
+	for _, address := range addresses {
+		if address == current {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package syslogwriter_test
+
+import (
+	"bufio"
+	"doppler/sinks/syslogwriter"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type drainListener struct {
+	net.Listener
+	lines chan string
+}
+
+func newDrainListener(address string) *drainListener {
+	listener, err := net.Listen("tcp", address)
+	Expect(err).NotTo(HaveOccurred())
+
+	l := &drainListener{Listener: listener, lines: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					l.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+var _ = Describe("Drain host resolution", func() {
+	var (
+		primary, standby *drainListener
+		outputUrl        *url.URL
+
+		lock      sync.Mutex
+		addresses []string
+		lookupErr error
+		lookups   []string
+	)
+
+	resolver := func(host string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		lookups = append(lookups, host)
+		return addresses, lookupErr
+	}
+
+	resolveTo := func(ips []string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		addresses = ips
+		lookupErr = err
+	}
+
+	lookupCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return len(lookups)
+	}
+
+	newWriter := func(resolveInterval time.Duration) syslogwriter.Writer {
+		writer, err := syslogwriter.NewSyslogWriter(outputUrl, "appId", 0, 0, resolveInterval)
+		Expect(err).NotTo(HaveOccurred())
+		writer.SetResolver(resolver)
+		return writer
+	}
+
+	write := func(writer syslogwriter.Writer, message string) error {
+		_, err := writer.Write(14, []byte(message), "App", "0", time.Now().UnixNano())
+		return err
+	}
+
+	BeforeEach(func() {
+		primary = newDrainListener("127.0.0.1:0")
+		port := primary.Addr().(*net.TCPAddr).Port
+		standby = newDrainListener("127.0.0.2:" + strconv.Itoa(port))
+
+		outputUrl, _ = url.Parse("syslog://drain.example.com:" + strconv.Itoa(port))
+
+		lookups = nil
+		resolveTo([]string{"127.0.0.1"}, nil)
+	})
+
+	AfterEach(func() {
+		primary.Close()
+		standby.Close()
+	})
+
+	It("resolves the drain host on connect", func() {
+		writer := newWriter(0)
+		Expect(writer.Connect()).To(Succeed())
+		defer writer.Close()
+
+		Expect(lookups).To(Equal([]string{"drain.example.com"}))
+		Expect(write(writer, "hello")).To(Succeed())
+		Eventually(primary.lines).Should(Receive(ContainSubstring("hello")))
+	})
+
+	It("re-resolves the drain host on every reconnect", func() {
+		writer := newWriter(0)
+		Expect(writer.Connect()).To(Succeed())
+		defer writer.Close()
+
+		resolveTo([]string{"127.0.0.2"}, nil)
+		Expect(writer.Connect()).To(Succeed())
+
+		Expect(write(writer, "after failover")).To(Succeed())
+		Eventually(standby.lines).Should(Receive(ContainSubstring("after failover")))
+	})
+
+	It("dials the next resolved address if the first one fails", func() {
+		primary.Close()
+		resolveTo([]string{"127.0.0.1", "127.0.0.2"}, nil)
+
+		writer := newWriter(0)
+		Expect(writer.Connect()).To(Succeed())
+		defer writer.Close()
+
+		Expect(write(writer, "hello")).To(Succeed())
+		Eventually(standby.lines).Should(Receive(ContainSubstring("hello")))
+	})
+
+	It("fails to connect when the drain host cannot be resolved", func() {
+		resolveTo(nil, errors.New("no such host"))
+
+		writer := newWriter(0)
+		Expect(writer.Connect()).To(MatchError("no such host"))
+	})
+
+	Context("with a resolve interval", func() {
+		const resolveInterval = 100 * time.Millisecond
+
+		var writer syslogwriter.Writer
+
+		BeforeEach(func() {
+			writer = newWriter(resolveInterval)
+			Expect(writer.Connect()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			writer.Close()
+		})
+
+		It("moves a healthy connection once the host no longer resolves to its address", func() {
+			Expect(write(writer, "before")).To(Succeed())
+			Eventually(primary.lines).Should(Receive(ContainSubstring("before")))
+
+			resolveTo([]string{"127.0.0.2"}, nil)
+			time.Sleep(resolveInterval)
+
+			Expect(write(writer, "after")).To(Succeed())
+			Eventually(standby.lines).Should(Receive(ContainSubstring("after")))
+		})
+
+		It("keeps the connection while the host still resolves to its address", func() {
+			resolveTo([]string{"127.0.0.2", "127.0.0.1"}, nil)
+			time.Sleep(resolveInterval)
+
+			Expect(write(writer, "still here")).To(Succeed())
+			Eventually(primary.lines).Should(Receive(ContainSubstring("still here")))
+			Expect(lookupCount()).To(Equal(2))
+		})
+
+		It("keeps the connection when re-resolving fails", func() {
+			resolveTo(nil, errors.New("no such host"))
+			time.Sleep(resolveInterval)
+
+			Expect(write(writer, "still here")).To(Succeed())
+			Eventually(primary.lines).Should(Receive(ContainSubstring("still here")))
+		})
+
+		It("does not re-resolve before the interval has passed", func() {
+			Expect(write(writer, "one")).To(Succeed())
+			Expect(write(writer, "two")).To(Succeed())
+
+			Expect(lookupCount()).To(Equal(1))
+		})
+	})
+})
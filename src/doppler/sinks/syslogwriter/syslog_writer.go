@@ -16,19 +16,24 @@ import (
 
 type syslogWriter struct {
 	appId string
-	host  string
 
 	mu   sync.Mutex // guards conn
 	conn net.Conn
+
+	keepAlive    time.Duration
+	writeTimeout time.Duration
+	resolver     *drainResolver
 }
 
-func NewSyslogWriter(outputUrl *url.URL, appId string) (w *syslogWriter, err error) {
+func NewSyslogWriter(outputUrl *url.URL, appId string, keepAlive, writeTimeout, resolveInterval time.Duration) (w *syslogWriter, err error) {
 	if outputUrl.Scheme != "syslog" {
 		return nil, errors.New(fmt.Sprintf("Invalid scheme %s, syslogWriter only supports syslog", outputUrl.Scheme))
 	}
 	return &syslogWriter{
-		appId: appId,
-		host:  outputUrl.Host,
+		appId:        appId,
+		keepAlive:    keepAlive,
+		writeTimeout: writeTimeout,
+		resolver:     newDrainResolver(outputUrl.Host, resolveInterval),
 	}, nil
 }
 
@@ -36,12 +41,28 @@ func (w *syslogWriter) Connect() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	return w.connect()
+}
+
+// SetResolver replaces the lookup used to resolve the drain host.
+func (w *syslogWriter) SetResolver(resolve Resolver) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.resolver.resolve = resolve
+}
+
+// connect must be called with mu held.
+func (w *syslogWriter) connect() error {
 	if w.conn != nil {
 		// ignore err from close, it makes sense to continue anyway
 		w.conn.Close()
 		w.conn = nil
 	}
-	c, err := net.DialTimeout("tcp", w.host, 500*time.Millisecond)
+	dialer := &net.Dialer{Timeout: 500 * time.Millisecond, KeepAlive: w.keepAlive}
+	c, err := w.resolver.dial(func(address string) (net.Conn, error) {
+		return dialer.Dial("tcp", address)
+	})
 	if err == nil {
 		w.conn = c
 	}
@@ -55,8 +76,16 @@ func (w *syslogWriter) Write(p int, b []byte, source string, sourceId string, ti
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.conn != nil && w.resolver.moved(w.conn) {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
 	if w.conn != nil {
-		byteCount, err = w.conn.Write(finalMsg)
+		byteCount, err = writeWithDeadline(w.conn, finalMsg, w.writeTimeout)
+		if err != nil {
+			w.conn = nil
+		}
 	} else {
 		return 0, errors.New("Connection to syslog sink lost")
 	}
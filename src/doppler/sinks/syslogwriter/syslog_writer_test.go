@@ -21,7 +21,7 @@ var _ = Describe("SyslogWriter", func() {
 	BeforeEach(func(done Done) {
 		outputURL, _ := url.Parse("syslog://127.0.0.1:9999")
 		syslogServerSession = startSyslogServer("127.0.0.1:9999")
-		sysLogWriter, _ = syslogwriter.NewSyslogWriter(outputURL, "appId")
+		sysLogWriter, _ = syslogwriter.NewSyslogWriter(outputURL, "appId", 0, 0, 0)
 
 		Eventually(func() error {
 			err := sysLogWriter.Connect()
@@ -44,6 +44,15 @@ var _ = Describe("SyslogWriter", func() {
 			close(done)
 		}, 10)
 
+		It("puts the source type and instance into the PROCID", func(done Done) {
+			sysLogWriter.Write(standardOutPriority, []byte("staging"), "STG", "1", time.Now().UnixNano())
+			sysLogWriter.Write(standardOutPriority, []byte("routed"), "RTR", "", time.Now().UnixNano())
+
+			Eventually(syslogServerSession, 5).Should(gbytes.Say(`loggregator appId \[STG/1\] - - staging\n`))
+			Eventually(syslogServerSession, 5).Should(gbytes.Say(`loggregator appId \[RTR/-\] - - routed\n`))
+			close(done)
+		}, 10)
+
 		It("strips null termination char from message", func(done Done) {
 			sysLogWriter.Write(standardOutPriority, []byte(string(0)+" hi"), "appId", "", time.Now().UnixNano())
 
@@ -71,13 +80,13 @@ var _ = Describe("SyslogWriter", func() {
 
 	It("returns an error for syslog-tls scheme", func() {
 		outputURL, _ := url.Parse("syslog-tls://localhost")
-		_, err := syslogwriter.NewSyslogWriter(outputURL, "appId")
+		_, err := syslogwriter.NewSyslogWriter(outputURL, "appId", 0, 0, 0)
 		Expect(err).To(HaveOccurred())
 	})
 
 	It("returns an error for https scheme", func() {
 		outputURL, _ := url.Parse("https://localhost")
-		_, err := syslogwriter.NewSyslogWriter(outputURL, "appId")
+		_, err := syslogwriter.NewSyslogWriter(outputURL, "appId", 0, 0, 0)
 		Expect(err).To(HaveOccurred())
 	})
 
@@ -17,23 +17,31 @@ import (
 
 type tlsWriter struct {
 	appId string
-	host  string
 
 	mu   sync.Mutex // guards conn
 	conn net.Conn
 
+	keepAlive    time.Duration
+	writeTimeout time.Duration
+	resolver     *drainResolver
+
 	tlsConfig *tls.Config
 }
 
-func NewTlsWriter(outputUrl *url.URL, appId string, skipCertVerify bool) (w *tlsWriter, err error) {
+func NewTlsWriter(outputUrl *url.URL, appId string, skipCertVerify bool, keepAlive, writeTimeout, resolveInterval time.Duration) (w *tlsWriter, err error) {
 	if outputUrl.Scheme != "syslog-tls" {
 		return nil, errors.New(fmt.Sprintf("Invalid scheme %s, tlsWriter only supports syslog-tls", outputUrl.Scheme))
 	}
-	tlsConfig := &tls.Config{InsecureSkipVerify: skipCertVerify}
+	resolver := newDrainResolver(outputUrl.Host, resolveInterval)
+	// the drain is dialed by IP address, so verify the certificate against
+	// the host name from the URL
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipCertVerify, ServerName: resolver.host}
 	return &tlsWriter{
-		appId:     appId,
-		host:      outputUrl.Host,
-		tlsConfig: tlsConfig,
+		appId:        appId,
+		tlsConfig:    tlsConfig,
+		keepAlive:    keepAlive,
+		writeTimeout: writeTimeout,
+		resolver:     resolver,
 	}, nil
 }
 
@@ -41,6 +49,19 @@ func (w *tlsWriter) Connect() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	return w.connect()
+}
+
+// SetResolver replaces the lookup used to resolve the drain host.
+func (w *tlsWriter) SetResolver(resolve Resolver) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.resolver.resolve = resolve
+}
+
+// connect must be called with mu held.
+func (w *tlsWriter) connect() error {
 	if w.conn != nil {
 		// ignore err from close, it makes sense to continue anyway
 		w.conn.Close()
@@ -48,7 +69,10 @@ func (w *tlsWriter) Connect() error {
 	}
 	dialer := new(net.Dialer)
 	dialer.Timeout = 500 * time.Millisecond
-	c, err := tls.DialWithDialer(dialer, "tcp", w.host, w.tlsConfig)
+	dialer.KeepAlive = w.keepAlive
+	c, err := w.resolver.dial(func(address string) (net.Conn, error) {
+		return tls.DialWithDialer(dialer, "tcp", address, w.tlsConfig)
+	})
 	if err == nil {
 		w.conn = c
 	}
@@ -62,8 +86,16 @@ func (w *tlsWriter) Write(p int, b []byte, source string, sourceId string, times
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.conn != nil && w.resolver.moved(w.conn) {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
 	if w.conn != nil {
-		byteCount, err = w.conn.Write(finalMsg)
+		byteCount, err = writeWithDeadline(w.conn, finalMsg, w.writeTimeout)
+		if err != nil {
+			w.conn = nil
+		}
 	} else {
 		return 0, errors.New("Connection to syslog-tls sink lost")
 	}
@@ -21,7 +21,7 @@ var _ = Describe("TLSWriter", func() {
 		BeforeEach(func(done Done) {
 			syslogServerSession = startEncryptedTCPServer("127.0.0.1:9998")
 			outputURL, _ := url.Parse("syslog-tls://127.0.0.1:9998")
-			syslogWriter, _ = syslogwriter.NewTlsWriter(outputURL, "appId", true)
+			syslogWriter, _ = syslogwriter.NewTlsWriter(outputURL, "appId", true, 0, 0, 0)
 			close(done)
 		}, 5)
 
@@ -68,7 +68,7 @@ var _ = Describe("TLSWriter", func() {
 		syslogServerSession = startEncryptedTCPServer("127.0.0.1:9998")
 		outputURL, _ := url.Parse("syslog-tls://localhost:9998")
 
-		syslogWriter, _ = syslogwriter.NewTlsWriter(outputURL, "appId", false)
+		syslogWriter, _ = syslogwriter.NewTlsWriter(outputURL, "appId", false, 0, 0, 0)
 		err := syslogWriter.Connect()
 		Expect(err).To(HaveOccurred())
 
@@ -79,13 +79,13 @@ var _ = Describe("TLSWriter", func() {
 
 	It("returns an error for syslog scheme", func() {
 		outputURL, _ := url.Parse("syslog://localhost")
-		_, err := syslogwriter.NewTlsWriter(outputURL, "appId", false)
+		_, err := syslogwriter.NewTlsWriter(outputURL, "appId", false, 0, 0, 0)
 		Expect(err).To(HaveOccurred())
 	})
 
 	It("returns an error for https scheme", func() {
 		outputURL, _ := url.Parse("https://localhost")
-		_, err := syslogwriter.NewTlsWriter(outputURL, "appId", false)
+		_, err := syslogwriter.NewTlsWriter(outputURL, "appId", false, 0, 0, 0)
 		Expect(err).To(HaveOccurred())
 	})
 })
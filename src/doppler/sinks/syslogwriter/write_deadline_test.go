@@ -0,0 +1,96 @@
+package syslogwriter_test
+
+import (
+	"bytes"
+	"doppler/sinks/syslogwriter"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write deadlines", func() {
+	var (
+		listener    net.Listener
+		connsLock   sync.Mutex
+		conns       []net.Conn
+		largeOutput []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		conns = nil
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				// never read from the connection, so the writer's buffers fill up
+				connsLock.Lock()
+				conns = append(conns, conn)
+				connsLock.Unlock()
+			}
+		}()
+
+		largeOutput = bytes.Repeat([]byte("a"), 64*1024)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		connsLock.Lock()
+		defer connsLock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	writeUntilError := func(writer syslogwriter.Writer) error {
+		for {
+			_, err := writer.Write(14, largeOutput, "App", "0", time.Now().UnixNano())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	It("fails a write to a server that stops reading within the write timeout", func() {
+		outputUrl, _ := url.Parse("syslog://" + listener.Addr().String())
+		writer, err := syslogwriter.NewWriter(outputUrl, "appId", false, time.Second, 100*time.Millisecond, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Connect()).To(Succeed())
+		defer writer.Close()
+
+		errChan := make(chan error, 1)
+		go func() { errChan <- writeUntilError(writer) }()
+
+		var writeErr error
+		Eventually(errChan, 5).Should(Receive(&writeErr))
+		netErr, ok := writeErr.(net.Error)
+		Expect(ok).To(BeTrue())
+		Expect(netErr.Timeout()).To(BeTrue())
+	})
+
+	It("drops the connection after a missed deadline until it reconnects", func() {
+		outputUrl, _ := url.Parse("syslog://" + listener.Addr().String())
+		writer, err := syslogwriter.NewWriter(outputUrl, "appId", false, time.Second, 100*time.Millisecond, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Connect()).To(Succeed())
+		defer writer.Close()
+
+		writeUntilError(writer)
+
+		_, err = writer.Write(14, []byte("message"), "App", "0", time.Now().UnixNano())
+		Expect(err).To(MatchError("Connection to syslog sink lost"))
+
+		Expect(writer.Connect()).To(Succeed())
+		_, err = writer.Write(14, []byte("message"), "App", "0", time.Now().UnixNano())
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
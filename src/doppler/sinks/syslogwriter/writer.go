@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 	"time"
@@ -23,19 +24,42 @@ type Writer interface {
 	Close() error
 }
 
-func NewWriter(outputUrl *url.URL, appId string, skipCertVerify bool) (Writer, error) {
+// NewWriter returns a writer for the drain's scheme. For the TCP based
+// syslog and syslog-tls schemes, keepAlive sets the TCP keepalive period of
+// the connection and writeTimeout bounds every write; a write that misses
+// its deadline fails and closes the connection. A zero writeTimeout never
+// times out. The drain host is resolved on every connect and, if
+// resolveInterval is non-zero, re-resolved at that interval while connected;
+// the writer reconnects once the host no longer resolves to the address it is
+// connected to.
+func NewWriter(outputUrl *url.URL, appId string, skipCertVerify bool, keepAlive, writeTimeout, resolveInterval time.Duration) (Writer, error) {
 	switch outputUrl.Scheme {
 	case "https":
 		return NewHttpsWriter(outputUrl, appId, skipCertVerify)
 	case "syslog":
-		return NewSyslogWriter(outputUrl, appId)
+		return NewSyslogWriter(outputUrl, appId, keepAlive, writeTimeout, resolveInterval)
 	case "syslog-tls":
-		return NewTlsWriter(outputUrl, appId, skipCertVerify)
+		return NewTlsWriter(outputUrl, appId, skipCertVerify, keepAlive, writeTimeout, resolveInterval)
 	default:
 		return nil, errors.New(fmt.Sprintf("Invalid scheme type %s, must be https, syslog-tls or syslog", outputUrl.Scheme))
 	}
 }
 
+// writeWithDeadline writes b to conn, failing if the write does not complete
+// within timeout. Since a failed write may have sent part of a frame, the
+// connection is closed on error so it is never reused.
+func writeWithDeadline(conn net.Conn, b []byte, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	byteCount, err := conn.Write(b)
+	if err != nil {
+		conn.Close()
+	}
+	return byteCount, err
+}
+
 func clean(in []byte) []byte {
 	return bytes.Replace(in, badBytes, emptyBytes, -1)
 }
@@ -51,13 +75,16 @@ func createMessage(p int, appId string, source string, sourceId string, msg []by
 	timeString := time.Unix(0, timestamp).Format(rfc5424)
 	timeString = strings.Replace(timeString, "Z", "+00:00", 1)
 
-	var formattedSource string
-	if source == "App" {
-		formattedSource = fmt.Sprintf("[%s/%s]", source, sourceId)
-	} else {
-		formattedSource = fmt.Sprintf("[%s]", source)
-	}
-
 	// syslog format https://tools.ietf.org/html/rfc5424#section-6
-	return fmt.Sprintf("<%d>1 %s %s %s %s - - %s%s", p, timeString, "loggregator", appId, formattedSource, msg, nl)
+	return fmt.Sprintf("<%d>1 %s %s %s %s - - %s%s", p, timeString, "loggregator", appId, FormatProcId(source, sourceId), msg, nl)
+}
+
+// FormatProcId identifies the emitter of a message as "[source/instance]",
+// e.g. "[App/3]" or "[RTR/0]", so collectors can tell the instances of a
+// scaled app apart. A missing instance is written as "-".
+func FormatProcId(source string, sourceId string) string {
+	if sourceId == "" {
+		sourceId = "-"
+	}
+	return fmt.Sprintf("[%s/%s]", source, sourceId)
 }
@@ -14,7 +14,7 @@ var _ = Describe("Writer", func() {
 
 	It("returns an syslogWriter for syslog scheme", func() {
 		outputUrl, _ := url.Parse("syslog://localhost:9999")
-		w, err := syslogwriter.NewWriter(outputUrl, "appId", false)
+		w, err := syslogwriter.NewWriter(outputUrl, "appId", false, 0, 0, 0)
 		Expect(err).ToNot(HaveOccurred())
 		writerType := reflect.TypeOf(w).String()
 		Expect(writerType).To(Equal("*syslogwriter.syslogWriter"))
@@ -22,7 +22,7 @@ var _ = Describe("Writer", func() {
 
 	It("returns an tlsWriter for syslog-tls scheme", func() {
 		outputUrl, _ := url.Parse("syslog-tls://localhost:9999")
-		w, err := syslogwriter.NewWriter(outputUrl, "appId", false)
+		w, err := syslogwriter.NewWriter(outputUrl, "appId", false, 0, 0, 0)
 		Expect(err).ToNot(HaveOccurred())
 		writerType := reflect.TypeOf(w).String()
 		Expect(writerType).To(Equal("*syslogwriter.tlsWriter"))
@@ -30,7 +30,7 @@ var _ = Describe("Writer", func() {
 
 	It("returns an httpsWriter for https scheme", func() {
 		outputUrl, _ := url.Parse("https://localhost:9999")
-		w, err := syslogwriter.NewWriter(outputUrl, "appId", false)
+		w, err := syslogwriter.NewWriter(outputUrl, "appId", false, 0, 0, 0)
 		Expect(err).ToNot(HaveOccurred())
 		writerType := reflect.TypeOf(w).String()
 		Expect(writerType).To(Equal("*syslogwriter.httpsWriter"))
@@ -38,8 +38,23 @@ var _ = Describe("Writer", func() {
 
 	It("returns an error for invalid scheme", func() {
 		outputUrl, _ := url.Parse("notValid://localhost:9999")
-		w, err := syslogwriter.NewWriter(outputUrl, "appId", false)
+		w, err := syslogwriter.NewWriter(outputUrl, "appId", false, 0, 0, 0)
 		Expect(err).To(HaveOccurred())
 		Expect(w).To(BeNil())
 	})
+
+	Describe("FormatProcId", func() {
+		It("includes the source type and instance index", func() {
+			Expect(syslogwriter.FormatProcId("App", "0")).To(Equal("[App/0]"))
+			Expect(syslogwriter.FormatProcId("App", "3")).To(Equal("[App/3]"))
+			Expect(syslogwriter.FormatProcId("STG", "1")).To(Equal("[STG/1]"))
+			Expect(syslogwriter.FormatProcId("RTR", "2")).To(Equal("[RTR/2]"))
+			Expect(syslogwriter.FormatProcId("APP/PROC/WEB", "3")).To(Equal("[APP/PROC/WEB/3]"))
+		})
+
+		It("uses - when the instance is missing", func() {
+			Expect(syslogwriter.FormatProcId("App", "")).To(Equal("[App/-]"))
+			Expect(syslogwriter.FormatProcId("LGR", "")).To(Equal("[LGR/-]"))
+		})
+	})
 })
@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/gogo/protobuf/proto"
+)
+
+// Encoding is the wire format a websocket sink writes. Sinks for new
+// endpoints write dropsonde envelopes; sinks for the legacy endpoints write
+// logmessage.LogMessage protobufs and skip everything that is not a log.
+type Encoding int
+
+const (
+	DropsondeEncoding Encoding = iota
+	LegacyEncoding
+)
+
+const FormatParam = "format"
+
+var ErrNotLogMessage = errors.New("envelope does not contain a LogMessage")
+
+// ParseEncoding maps the value of the format query parameter to an
+// Encoding. An empty value selects the dropsonde encoding.
+func ParseEncoding(format string) (Encoding, error) {
+	switch format {
+	case "", "dropsonde":
+		return DropsondeEncoding, nil
+	case "legacy":
+		return LegacyEncoding, nil
+	default:
+		return DropsondeEncoding, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case LegacyEncoding:
+		return "legacy"
+	default:
+		return "dropsonde"
+	}
+}
+
+// Encode marshals the envelope in this encoding. The legacy encoding returns
+// ErrNotLogMessage for envelopes that have no legacy representation.
+func (e Encoding) Encode(envelope *events.Envelope) ([]byte, error) {
+	if e != LegacyEncoding {
+		return proto.Marshal(envelope)
+	}
+
+	legacyMessage, err := ToLegacyLogMessage(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(legacyMessage)
+}
+
+// ToLegacyLogMessage converts the LogMessage in a dropsonde envelope to the
+// legacy logmessage format. The source type becomes the source name and the
+// source instance becomes the source id.
+func ToLegacyLogMessage(envelope *events.Envelope) (*logmessage.LogMessage, error) {
+	if envelope.GetEventType() != events.Envelope_LogMessage || envelope.GetLogMessage() == nil {
+		return nil, ErrNotLogMessage
+	}
+
+	logMessage := envelope.GetLogMessage()
+	return &logmessage.LogMessage{
+		Message:     logMessage.GetMessage(),
+		MessageType: logmessage.LogMessage_MessageType(logMessage.GetMessageType()).Enum(),
+		Timestamp:   proto.Int64(logMessage.GetTimestamp()),
+		AppId:       proto.String(logMessage.GetAppId()),
+		SourceId:    proto.String(logMessage.GetSourceInstance()),
+		SourceName:  proto.String(logMessage.GetSourceType()),
+	}, nil
+}
@@ -0,0 +1,107 @@
+package websocket_test
+
+import (
+	"doppler/sinks/websocket"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encoding", func() {
+	var envelope *events.Envelope
+
+	BeforeEach(func() {
+		envelope = &events.Envelope{
+			Origin:    proto.String("origin"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:        []byte("hello world"),
+				MessageType:    events.LogMessage_ERR.Enum(),
+				Timestamp:      proto.Int64(1234567890123456789),
+				AppId:          proto.String("app-id"),
+				SourceType:     proto.String("App"),
+				SourceInstance: proto.String("3"),
+			},
+		}
+	})
+
+	Describe("ParseEncoding", func() {
+		It("defaults to the dropsonde encoding", func() {
+			Expect(websocket.ParseEncoding("")).To(Equal(websocket.DropsondeEncoding))
+		})
+
+		It("parses known formats", func() {
+			Expect(websocket.ParseEncoding("dropsonde")).To(Equal(websocket.DropsondeEncoding))
+			Expect(websocket.ParseEncoding("legacy")).To(Equal(websocket.LegacyEncoding))
+		})
+
+		It("returns an error for unknown formats", func() {
+			_, err := websocket.ParseEncoding("xml")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ToLegacyLogMessage", func() {
+		It("maps the fields of the log message", func() {
+			legacyMessage, err := websocket.ToLegacyLogMessage(envelope)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(legacyMessage.GetMessage()).To(Equal([]byte("hello world")))
+			Expect(legacyMessage.GetMessageType()).To(Equal(logmessage.LogMessage_ERR))
+			Expect(legacyMessage.GetTimestamp()).To(Equal(int64(1234567890123456789)))
+			Expect(legacyMessage.GetAppId()).To(Equal("app-id"))
+			Expect(legacyMessage.GetSourceName()).To(Equal("App"))
+			Expect(legacyMessage.GetSourceId()).To(Equal("3"))
+		})
+
+		It("returns an error for envelopes without a log message", func() {
+			metric, _ := emitter.Wrap(factories.NewContainerMetric("app-id", 3, 1, 2, 3), "origin")
+			_, err := websocket.ToLegacyLogMessage(metric)
+			Expect(err).To(Equal(websocket.ErrNotLogMessage))
+		})
+	})
+
+	Describe("Encode", func() {
+		It("round-trips dropsonde envelopes", func() {
+			bytes, err := websocket.DropsondeEncoding.Encode(envelope)
+			Expect(err).NotTo(HaveOccurred())
+
+			var receivedEnvelope events.Envelope
+			Expect(proto.Unmarshal(bytes, &receivedEnvelope)).To(Succeed())
+			Expect(&receivedEnvelope).To(Equal(envelope))
+		})
+
+		It("round-trips legacy log messages back to the original log message", func() {
+			bytes, err := websocket.LegacyEncoding.Encode(envelope)
+			Expect(err).NotTo(HaveOccurred())
+
+			var legacyMessage logmessage.LogMessage
+			Expect(proto.Unmarshal(bytes, &legacyMessage)).To(Succeed())
+
+			roundTripped := &events.LogMessage{
+				Message:        legacyMessage.Message,
+				MessageType:    (*events.LogMessage_MessageType)(legacyMessage.MessageType),
+				Timestamp:      legacyMessage.Timestamp,
+				AppId:          legacyMessage.AppId,
+				SourceType:     legacyMessage.SourceName,
+				SourceInstance: legacyMessage.SourceId,
+			}
+			Expect(roundTripped).To(Equal(envelope.GetLogMessage()))
+		})
+
+		It("refuses to encode non-log envelopes in the legacy encoding", func() {
+			metric, _ := emitter.Wrap(factories.NewContainerMetric("app-id", 3, 1, 2, 3), "origin")
+			_, err := websocket.LegacyEncoding.Encode(metric)
+			Expect(err).To(Equal(websocket.ErrNotLogMessage))
+
+			_, err = websocket.DropsondeEncoding.Encode(metric)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/dropsonde/events"
+)
+
+const OriginParam = "origin"
+
+// MaxOrigins is the most origins a single subscription may filter for.
+const MaxOrigins = 10
+
+// OriginFilter passes only envelopes whose origin is exactly one of the
+// filter's origins, and counts how many envelopes it matched and filtered
+// out. A nil OriginFilter passes every envelope.
+type OriginFilter struct {
+	origins  map[string]bool
+	matched  uint64
+	filtered uint64
+}
+
+// ParseOriginFilter builds a filter from the values of the origin query
+// parameter. It returns nil when there are none, and an error for empty
+// values or more than MaxOrigins values.
+func ParseOriginFilter(values []string) (*OriginFilter, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) > MaxOrigins {
+		return nil, fmt.Errorf("at most %d origins can be given, got %d", MaxOrigins, len(values))
+	}
+
+	origins := make(map[string]bool, len(values))
+	for _, origin := range values {
+		if origin == "" {
+			return nil, errors.New("empty origin")
+		}
+		origins[origin] = true
+	}
+	return &OriginFilter{origins: origins}, nil
+}
+
+func (f *OriginFilter) Accepts(envelope *events.Envelope) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.origins[envelope.GetOrigin()] {
+		atomic.AddUint64(&f.matched, 1)
+		return true
+	}
+	atomic.AddUint64(&f.filtered, 1)
+	return false
+}
+
+func (f *OriginFilter) Matched() uint64 {
+	return atomic.LoadUint64(&f.matched)
+}
+
+func (f *OriginFilter) Filtered() uint64 {
+	return atomic.LoadUint64(&f.filtered)
+}
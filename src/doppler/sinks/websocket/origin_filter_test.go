@@ -0,0 +1,59 @@
+package websocket_test
+
+import (
+	"doppler/sinks/websocket"
+	"strconv"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OriginFilter", func() {
+	envelopeFrom := func(origin string) *events.Envelope {
+		return &events.Envelope{Origin: proto.String(origin), EventType: events.Envelope_LogMessage.Enum()}
+	}
+
+	Describe("ParseOriginFilter", func() {
+		It("returns no filter without origins", func() {
+			filter, err := websocket.ParseOriginFilter(nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filter).To(BeNil())
+			Expect(filter.Accepts(envelopeFrom("anything"))).To(BeTrue())
+		})
+
+		It("accepts up to MaxOrigins origins", func() {
+			origins := []string{}
+			for i := 0; i < websocket.MaxOrigins; i++ {
+				origins = append(origins, "origin-"+strconv.Itoa(i))
+			}
+
+			_, err := websocket.ParseOriginFilter(origins)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = websocket.ParseOriginFilter(append(origins, "one-too-many"))
+			Expect(err).To(MatchError("at most 10 origins can be given, got 11"))
+		})
+
+		It("rejects empty origins", func() {
+			_, err := websocket.ParseOriginFilter([]string{"gorouter", ""})
+			Expect(err).To(MatchError("empty origin"))
+		})
+	})
+
+	Describe("Accepts", func() {
+		It("matches origins exactly and counts matched and filtered envelopes", func() {
+			filter, _ := websocket.ParseOriginFilter([]string{"gorouter"})
+
+			Expect(filter.Accepts(envelopeFrom("gorouter"))).To(BeTrue())
+			Expect(filter.Accepts(envelopeFrom("GoRouter"))).To(BeFalse())
+			Expect(filter.Accepts(envelopeFrom("gorouter-z1"))).To(BeFalse())
+			Expect(filter.Accepts(envelopeFrom(""))).To(BeFalse())
+
+			Expect(filter.Matched()).To(BeEquivalentTo(1))
+			Expect(filter.Filtered()).To(BeEquivalentTo(3))
+		})
+	})
+})
@@ -2,11 +2,11 @@ package websocket
 
 import (
 	"doppler/sinks"
+	"doppler/truncatingbuffer"
 	"net"
 
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/gosteno"
-	"github.com/gogo/protobuf/proto"
 	gorilla "github.com/gorilla/websocket"
 )
 
@@ -18,25 +18,30 @@ type remoteMessageWriter interface {
 }
 
 type WebsocketSink struct {
-	logger              *gosteno.Logger
-	streamId            string
-	ws                  remoteMessageWriter
-	clientAddress       net.Addr
-	wsMessageBufferSize uint
-	dropsondeOrigin     string
+	logger            *gosteno.Logger
+	streamId          string
+	ws                remoteMessageWriter
+	clientAddress     net.Addr
+	bufferSizer       truncatingbuffer.BufferSizer
+	encoding          Encoding
+	dropsondeOrigin   string
+	skippedUpdateChan chan<- int64
+	originFilter      *OriginFilter
 
 	sinks.DropCounter
 }
 
-func NewWebsocketSink(streamId string, givenLogger *gosteno.Logger, ws remoteMessageWriter, wsMessageBufferSize uint, dropsondeOrigin string, metricUpdateChan chan<- int64) *WebsocketSink {
+func NewWebsocketSink(streamId string, givenLogger *gosteno.Logger, ws remoteMessageWriter, wsMessageBufferSize uint, encoding Encoding, dropsondeOrigin string, metricUpdateChan, skippedUpdateChan chan<- int64) *WebsocketSink {
 	return &WebsocketSink{
-		logger:              givenLogger,
-		streamId:            streamId,
-		ws:                  ws,
-		clientAddress:       ws.RemoteAddr(),
-		wsMessageBufferSize: wsMessageBufferSize,
-		dropsondeOrigin:     dropsondeOrigin,
-		DropCounter:         sinks.NewDropCounter(streamId, ws.RemoteAddr().String(), metricUpdateChan),
+		logger:            givenLogger,
+		streamId:          streamId,
+		ws:                ws,
+		clientAddress:     ws.RemoteAddr(),
+		bufferSizer:       truncatingbuffer.FixedSize(wsMessageBufferSize),
+		encoding:          encoding,
+		dropsondeOrigin:   dropsondeOrigin,
+		skippedUpdateChan: skippedUpdateChan,
+		DropCounter:       sinks.NewDropCounter(streamId, ws.RemoteAddr().String(), metricUpdateChan),
 	}
 }
 
@@ -48,14 +53,46 @@ func (sink *WebsocketSink) StreamId() string {
 	return sink.streamId
 }
 
+func (sink *WebsocketSink) Encoding() Encoding {
+	return sink.encoding
+}
+
 func (sink *WebsocketSink) ShouldReceiveErrors() bool {
 	return true
 }
 
+func (sink *WebsocketSink) SetBufferSizer(sizer truncatingbuffer.BufferSizer) {
+	sink.bufferSizer = sizer
+}
+
+// SetOriginFilter makes the sink send only envelopes accepted by filter. It
+// has to be set before the sink runs.
+func (sink *WebsocketSink) SetOriginFilter(filter *OriginFilter) {
+	sink.originFilter = filter
+}
+
+// OriginFilterMetrics returns how many envelopes the sink's origin filter
+// matched and filtered out, or nothing if the sink has no filter.
+func (sink *WebsocketSink) OriginFilterMetrics() []sinks.Metric {
+	if sink.originFilter == nil {
+		return nil
+	}
+
+	tags := map[string]interface{}{"streamId": sink.streamId, "clientAddress": sink.clientAddress.String()}
+	return []sinks.Metric{
+		{Name: "numberOfOriginMatchedEnvelopes", Value: int64(sink.originFilter.Matched()), Tags: tags},
+		{Name: "numberOfOriginFilteredEnvelopes", Value: int64(sink.originFilter.Filtered()), Tags: tags},
+	}
+}
+
 func (sink *WebsocketSink) Run(inputChan <-chan *events.Envelope) {
 	sink.logger.Debugf("Websocket Sink %s: Running for streamId [%s]", sink.clientAddress, sink.streamId)
 
-	buffer := sinks.RunTruncatingBuffer(inputChan, sink.wsMessageBufferSize, sink.logger, sink.dropsondeOrigin)
+	if sink.originFilter != nil {
+		inputChan = filterOrigins(inputChan, sink.originFilter)
+	}
+
+	buffer := sinks.RunTruncatingBuffer(inputChan, sink.bufferSizer, sink.logger, sink.dropsondeOrigin)
 	for {
 		sink.logger.Debugf("Websocket Sink %s: Waiting for activity", sink.clientAddress)
 		messageEnvelope, ok := <-buffer.GetOutputChannel()
@@ -71,7 +108,13 @@ func (sink *WebsocketSink) Run(inputChan <-chan *events.Envelope) {
 			return
 		}
 
-		messageBytes, err := proto.Marshal(messageEnvelope)
+		messageBytes, err := sink.encoding.Encode(messageEnvelope)
+
+		if err == ErrNotLogMessage {
+			sink.logger.Debugf("Websocket Sink %s: Skipping %s envelope, %s encoding only sends log messages", sink.clientAddress, messageEnvelope.GetEventType().String(), sink.encoding)
+			sink.skippedUpdateChan <- 1
+			continue
+		}
 
 		if err != nil {
 			sink.logger.Errorf("Websocket Sink %s: Error marshalling %s envelope from origin %s: %s", sink.clientAddress, messageEnvelope.GetEventType().String(), messageEnvelope.GetOrigin(), err.Error())
@@ -88,3 +131,16 @@ func (sink *WebsocketSink) Run(inputChan <-chan *events.Envelope) {
 		sink.logger.Debugf("Websocket Sink %s: Successfully sent data", sink.clientAddress)
 	}
 }
+
+func filterOrigins(inputChan <-chan *events.Envelope, filter *OriginFilter) <-chan *events.Envelope {
+	filteredChan := make(chan *events.Envelope)
+	go func() {
+		defer close(filteredChan)
+		for envelope := range inputChan {
+			if filter.Accepts(envelope) {
+				filteredChan <- envelope
+			}
+		}
+	}()
+	return filteredChan
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
 	"github.com/gogo/protobuf/proto"
 
 	. "github.com/onsi/ginkgo"
@@ -57,13 +58,15 @@ var _ = Describe("WebsocketSink", func() {
 		websocketSink    *websocket.WebsocketSink
 		fakeWebsocket    *fakeMessageWriter
 		updateMetricChan chan int64
+		skipMetricChan   chan int64
 	)
 
 	BeforeEach(func() {
 		logger = loggertesthelper.Logger()
 		fakeWebsocket = &fakeMessageWriter{}
 		updateMetricChan = make(chan int64, 1)
-		websocketSink = websocket.NewWebsocketSink("appId", logger, fakeWebsocket, 10, "dropsonde-origin", updateMetricChan)
+		skipMetricChan = make(chan int64, 10)
+		websocketSink = websocket.NewWebsocketSink("appId", logger, fakeWebsocket, 10, websocket.DropsondeEncoding, "dropsonde-origin", updateMetricChan, skipMetricChan)
 	})
 
 	Describe("Identifier", func() {
@@ -78,6 +81,12 @@ var _ = Describe("WebsocketSink", func() {
 		})
 	})
 
+	Describe("Encoding", func() {
+		It("returns the encoding the sink was created with", func() {
+			Expect(websocketSink.Encoding()).To(Equal(websocket.DropsondeEncoding))
+		})
+	})
+
 	Describe("ShouldReceiveErrors", func() {
 		It("returns true", func() {
 			Expect(websocketSink.ShouldReceiveErrors()).To(BeTrue())
@@ -108,6 +117,98 @@ var _ = Describe("WebsocketSink", func() {
 			Eventually(fakeWebsocket.ReadMessages).Should(HaveLen(2))
 			Expect(fakeWebsocket.ReadMessages()[1]).To(Equal(messageTwoBytes))
 		})
+
+		Context("with the legacy encoding", func() {
+			BeforeEach(func() {
+				websocketSink = websocket.NewWebsocketSink("appId", logger, fakeWebsocket, 10, websocket.LegacyEncoding, "dropsonde-origin", updateMetricChan, skipMetricChan)
+			})
+
+			It("forwards log messages as legacy log messages", func() {
+				go websocketSink.Run(inputChan)
+
+				message, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_ERR, "hello world", "appId", "App"), "origin")
+				inputChan <- message
+				Eventually(fakeWebsocket.ReadMessages).Should(HaveLen(1))
+
+				var legacyMessage logmessage.LogMessage
+				Expect(proto.Unmarshal(fakeWebsocket.ReadMessages()[0], &legacyMessage)).To(Succeed())
+				Expect(legacyMessage.GetMessage()).To(BeEquivalentTo("hello world"))
+				Expect(legacyMessage.GetMessageType()).To(Equal(logmessage.LogMessage_ERR))
+				Expect(legacyMessage.GetAppId()).To(Equal("appId"))
+				Expect(legacyMessage.GetSourceName()).To(Equal("App"))
+			})
+
+			It("skips envelopes that are not log messages and counts them", func() {
+				go websocketSink.Run(inputChan)
+
+				metric, _ := emitter.Wrap(factories.NewContainerMetric("appId", 0, 1, 2, 3), "origin")
+				message, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "hello world", "appId", "App"), "origin")
+				inputChan <- metric
+				inputChan <- message
+
+				Eventually(fakeWebsocket.ReadMessages).Should(HaveLen(1))
+				Consistently(fakeWebsocket.ReadMessages).Should(HaveLen(1))
+				Expect(skipMetricChan).To(Receive(Equal(int64(1))))
+				Expect(skipMetricChan).NotTo(Receive())
+			})
+		})
+	})
+
+	Describe("origin filtering", func() {
+		var inputChan chan *events.Envelope
+
+		originsOf := func(messages [][]byte) []string {
+			origins := []string{}
+			for _, message := range messages {
+				var envelope events.Envelope
+				proto.Unmarshal(message, &envelope)
+				origins = append(origins, envelope.GetOrigin())
+			}
+			return origins
+		}
+
+		BeforeEach(func() {
+			inputChan = make(chan *events.Envelope, 10)
+			filter, err := websocket.ParseOriginFilter([]string{"gorouter", "uaa"})
+			Expect(err).NotTo(HaveOccurred())
+			websocketSink.SetOriginFilter(filter)
+		})
+
+		It("only sends envelopes from the given origins", func() {
+			go websocketSink.Run(inputChan)
+
+			for _, origin := range []string{"gorouter", "dea", "uaa", "gorouter-2", "gorouter"} {
+				envelope, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "hello", "appId", "App"), origin)
+				inputChan <- envelope
+			}
+
+			Eventually(func() []string { return originsOf(fakeWebsocket.ReadMessages()) }).Should(Equal([]string{"gorouter", "uaa", "gorouter"}))
+			Consistently(fakeWebsocket.ReadMessages).Should(HaveLen(3))
+			close(inputChan)
+		})
+
+		It("reports how many envelopes it matched and filtered out", func() {
+			go websocketSink.Run(inputChan)
+
+			for _, origin := range []string{"gorouter", "dea", "uaa"} {
+				envelope, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "hello", "appId", "App"), origin)
+				inputChan <- envelope
+			}
+			Eventually(fakeWebsocket.ReadMessages).Should(HaveLen(2))
+
+			tags := map[string]interface{}{"streamId": "appId", "clientAddress": "client-address"}
+			Eventually(websocketSink.OriginFilterMetrics).Should(ConsistOf(
+				sinks.Metric{Name: "numberOfOriginMatchedEnvelopes", Value: 2, Tags: tags},
+				sinks.Metric{Name: "numberOfOriginFilteredEnvelopes", Value: 1, Tags: tags},
+			))
+			close(inputChan)
+		})
+
+		It("reports no metrics without a filter", func() {
+			websocketSink.SetOriginFilter(nil)
+
+			Expect(websocketSink.OriginFilterMetrics()).To(BeEmpty())
+		})
 	})
 
 	Describe("GetInstrumentationMetric", func() {
@@ -0,0 +1,106 @@
+package errorthrottle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const aggregateErrorMsg = "Connection to drain %s failed %d times in the last %v: %s"
+
+type NotifyFunc func(errorMsg, appId, drainUrl string)
+
+type drainKey struct {
+	appId    string
+	drainUrl string
+}
+
+type drainErrors struct {
+	count     int
+	lastError string
+	timer     *time.Timer
+}
+
+// ErrorThrottle limits the error notifications for each (app, drain) pair to
+// at most one per interval. The first error of an interval is passed through
+// as is; any further errors during that interval are collapsed into a single
+// aggregate notification sent when the interval ends.
+type ErrorThrottle struct {
+	interval time.Duration
+	notify   NotifyFunc
+	drains   map[drainKey]*drainErrors
+	stopped  bool
+	sync.Mutex
+}
+
+func New(interval time.Duration, notify NotifyFunc) *ErrorThrottle {
+	return &ErrorThrottle{
+		interval: interval,
+		notify:   notify,
+		drains:   make(map[drainKey]*drainErrors),
+	}
+}
+
+func (t *ErrorThrottle) HandleError(errorMsg, appId, drainUrl string) {
+	if t.interval <= 0 {
+		t.notify(errorMsg, appId, drainUrl)
+		return
+	}
+
+	key := drainKey{appId: appId, drainUrl: drainUrl}
+
+	t.Lock()
+	if t.stopped {
+		t.Unlock()
+		return
+	}
+
+	if errs, ok := t.drains[key]; ok {
+		errs.count++
+		errs.lastError = errorMsg
+		t.Unlock()
+		return
+	}
+
+	t.startInterval(key)
+	t.Unlock()
+
+	t.notify(errorMsg, appId, drainUrl)
+}
+
+func (t *ErrorThrottle) Stop() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.stopped = true
+	for key, errs := range t.drains {
+		errs.timer.Stop()
+		delete(t.drains, key)
+	}
+}
+
+func (t *ErrorThrottle) startInterval(key drainKey) {
+	t.drains[key] = &drainErrors{
+		timer: time.AfterFunc(t.interval, func() { t.flush(key) }),
+	}
+}
+
+func (t *ErrorThrottle) flush(key drainKey) {
+	t.Lock()
+	errs, ok := t.drains[key]
+	if !ok || t.stopped {
+		t.Unlock()
+		return
+	}
+
+	if errs.count == 0 {
+		delete(t.drains, key)
+		t.Unlock()
+		return
+	}
+
+	t.startInterval(key)
+	t.Unlock()
+
+	t.notify(fmt.Sprintf(aggregateErrorMsg, key.drainUrl, errs.count, t.interval, errs.lastError), key.appId, key.drainUrl)
+}
@@ -0,0 +1,122 @@
+package errorthrottle_test
+
+import (
+	"doppler/sinkserver/errorthrottle"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ErrorThrottle", func() {
+	var (
+		notifier *fakeNotifier
+		throttle *errorthrottle.ErrorThrottle
+	)
+
+	BeforeEach(func() {
+		notifier = &fakeNotifier{}
+		throttle = errorthrottle.New(100*time.Millisecond, notifier.Notify)
+	})
+
+	AfterEach(func() {
+		throttle.Stop()
+	})
+
+	It("passes the first error through immediately", func() {
+		throttle.HandleError("dial failed", "app-id", "syslog://drain")
+
+		Expect(notifier.Notices()).To(ConsistOf(notice{"dial failed", "app-id", "syslog://drain"}))
+	})
+
+	It("collapses a rapidly failing drain into one aggregate notice per interval", func() {
+		for i := 0; i < 195; i++ {
+			throttle.HandleError(fmt.Sprintf("dial failed %d", i), "app-id", "syslog://drain")
+		}
+
+		Expect(notifier.Notices()).To(HaveLen(1))
+		Eventually(notifier.Notices).Should(HaveLen(2))
+		Consistently(notifier.Notices, 200*time.Millisecond).Should(HaveLen(2))
+
+		aggregate := notifier.Notices()[1]
+		Expect(aggregate.appId).To(Equal("app-id"))
+		Expect(aggregate.drainUrl).To(Equal("syslog://drain"))
+		Expect(aggregate.errorMsg).To(Equal("Connection to drain syslog://drain failed 194 times in the last 100ms: dial failed 194"))
+	})
+
+	It("resets the aggregate count every interval", func() {
+		throttle.HandleError("first", "app-id", "syslog://drain")
+		throttle.HandleError("second", "app-id", "syslog://drain")
+		throttle.HandleError("third", "app-id", "syslog://drain")
+		Eventually(notifier.Notices).Should(HaveLen(2))
+
+		throttle.HandleError("fourth", "app-id", "syslog://drain")
+		Expect(notifier.Notices()).To(HaveLen(2))
+		Eventually(notifier.Notices).Should(HaveLen(3))
+
+		Expect(notifier.Notices()[1].errorMsg).To(ContainSubstring("failed 2 times"))
+		Expect(notifier.Notices()[2].errorMsg).To(Equal("Connection to drain syslog://drain failed 1 times in the last 100ms: fourth"))
+	})
+
+	It("passes an error through immediately once a drain has been quiet for an interval", func() {
+		throttle.HandleError("first", "app-id", "syslog://drain")
+		time.Sleep(250 * time.Millisecond)
+
+		throttle.HandleError("second", "app-id", "syslog://drain")
+		Expect(notifier.Notices()).To(Equal([]notice{
+			{"first", "app-id", "syslog://drain"},
+			{"second", "app-id", "syslog://drain"},
+		}))
+	})
+
+	It("throttles each app and drain pair independently", func() {
+		throttle.HandleError("error", "app-id", "syslog://drain-1")
+		throttle.HandleError("error", "app-id", "syslog://drain-2")
+		throttle.HandleError("error", "other-app-id", "syslog://drain-1")
+
+		Expect(notifier.Notices()).To(HaveLen(3))
+	})
+
+	It("does not send notices after it has been stopped", func() {
+		throttle.HandleError("first", "app-id", "syslog://drain")
+		throttle.HandleError("second", "app-id", "syslog://drain")
+		throttle.Stop()
+
+		Consistently(notifier.Notices, 200*time.Millisecond).Should(HaveLen(1))
+	})
+
+	Context("with a zero interval", func() {
+		It("passes every error through", func() {
+			throttle = errorthrottle.New(0, notifier.Notify)
+
+			for i := 0; i < 10; i++ {
+				throttle.HandleError("error", "app-id", "syslog://drain")
+			}
+
+			Expect(notifier.Notices()).To(HaveLen(10))
+		})
+	})
+})
+
+type notice struct {
+	errorMsg, appId, drainUrl string
+}
+
+type fakeNotifier struct {
+	notices []notice
+	sync.Mutex
+}
+
+func (f *fakeNotifier) Notify(errorMsg, appId, drainUrl string) {
+	f.Lock()
+	defer f.Unlock()
+	f.notices = append(f.notices, notice{errorMsg, appId, drainUrl})
+}
+
+func (f *fakeNotifier) Notices() []notice {
+	f.Lock()
+	defer f.Unlock()
+	return append([]notice{}, f.notices...)
+}
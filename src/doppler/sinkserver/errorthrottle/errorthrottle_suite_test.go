@@ -0,0 +1,13 @@
+package errorthrottle_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestErrorthrottle(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Errorthrottle Suite")
+}
@@ -2,6 +2,8 @@ package sinkserver
 
 import (
 	"doppler/sinkserver/metrics"
+	"hash/fnv"
+	"strconv"
 	"sync"
 	"sync/atomic"
 
@@ -11,8 +13,15 @@ import (
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 )
 
+const workerBufferSize = 100
+
+// MessageRouter hands envelopes to the sink manager from a fixed pool of
+// workers. Envelopes are sharded by app id and source instance, so all
+// envelopes from one app instance are sent by the same worker, in the order
+// they were received. There is no ordering guarantee across instances.
 type MessageRouter struct {
 	sinkManager sinkManager
+	workerCount int
 	metrics     *metrics.MessageRouterMetrics
 	logger      *gosteno.Logger
 	done        chan struct{}
@@ -23,9 +32,14 @@ type sinkManager interface {
 	SendTo(string, *events.Envelope)
 }
 
-func NewMessageRouter(sinkManager sinkManager, logger *gosteno.Logger) *MessageRouter {
+func NewMessageRouter(sinkManager sinkManager, workerCount int, logger *gosteno.Logger) *MessageRouter {
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
 	return &MessageRouter{
 		sinkManager: sinkManager,
+		workerCount: workerCount,
 		metrics:     &metrics.MessageRouterMetrics{},
 		logger:      logger,
 		done:        make(chan struct{}),
@@ -34,6 +48,27 @@ func NewMessageRouter(sinkManager sinkManager, logger *gosteno.Logger) *MessageR
 
 func (r *MessageRouter) Start(incomingLogChan <-chan *events.Envelope) {
 	r.logger.Debug("MessageRouter:Starting")
+
+	workerChans := make([]chan *events.Envelope, r.workerCount)
+	var wg sync.WaitGroup
+	wg.Add(r.workerCount)
+	for i := range workerChans {
+		workerChans[i] = make(chan *events.Envelope, workerBufferSize)
+		go func(workerChan <-chan *events.Envelope) {
+			defer wg.Done()
+			for envelope := range workerChan {
+				r.send(envelope)
+			}
+		}(workerChans[i])
+	}
+
+	defer func() {
+		for _, workerChan := range workerChans {
+			close(workerChan)
+		}
+		wg.Wait()
+	}()
+
 	for {
 		select {
 		case <-r.done:
@@ -47,7 +82,13 @@ func (r *MessageRouter) Start(incomingLogChan <-chan *events.Envelope) {
 				return
 			}
 			r.logger.Debugf("MessageRouter:outgoingLogChan: Received %s message from %s at %d.", envelope.GetEventType().String(), envelope.GetOrigin(), envelope.Timestamp)
-			r.send(envelope)
+
+			select {
+			case workerChans[r.shard(envelope)] <- envelope:
+			case <-r.done:
+				r.logger.Debug("MessageRouter:MessageReceived:Done")
+				return
+			}
 		}
 	}
 }
@@ -60,10 +101,34 @@ func (r *MessageRouter) Emit() instrumentation.Context {
 	return r.metrics.Emit()
 }
 
+func (r *MessageRouter) shard(envelope *events.Envelope) int {
+	if r.workerCount == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(envelope_extensions.GetAppId(envelope)))
+	hash.Write([]byte{'/'})
+	hash.Write([]byte(sourceInstance(envelope)))
+	return int(hash.Sum32() % uint32(r.workerCount))
+}
+
+func sourceInstance(envelope *events.Envelope) string {
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage:
+		return envelope.GetLogMessage().GetSourceInstance()
+	case events.Envelope_ContainerMetric:
+		return strconv.Itoa(int(envelope.GetContainerMetric().GetInstanceIndex()))
+	default:
+		return ""
+	}
+}
+
 func (r *MessageRouter) send(envelope *events.Envelope) {
 	appId := envelope_extensions.GetAppId(envelope)
 
 	r.logger.Debugf("MessageRouter:outgoingLogChan: Searching for sinks with appId [%s].", appId)
 	r.sinkManager.SendTo(appId, envelope)
+	atomic.AddUint64(&r.metrics.RoutedMessages, 1)
 	r.logger.Debugf("MessageRouter:outgoingLogChan: Done sending message.")
 }
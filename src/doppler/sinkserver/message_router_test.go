@@ -2,12 +2,17 @@ package sinkserver_test
 
 import (
 	"doppler/sinkserver"
+	"fmt"
+	"math/rand"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/cloudfoundry/dropsonde/emitter"
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -17,9 +22,14 @@ type fakeSinkManager struct {
 	sync.RWMutex
 	receivedMessages []*events.Envelope
 	receivedDrains   [][]string
+	jitter           bool
 }
 
 func (f *fakeSinkManager) SendTo(appId string, receivedMessage *events.Envelope) {
+	if f.jitter {
+		time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+	}
+
 	f.Lock()
 	defer f.Unlock()
 	f.receivedMessages = append(f.receivedMessages, receivedMessage)
@@ -50,7 +60,7 @@ var _ = Describe("Message Router", func() {
 
 	BeforeEach(func() {
 		fakeManager = &fakeSinkManager{receivedMessages: make([]*events.Envelope, 0), receivedDrains: make([][]string, 0)}
-		messageRouter = sinkserver.NewMessageRouter(fakeManager, loggertesthelper.Logger())
+		messageRouter = sinkserver.NewMessageRouter(fakeManager, 8, loggertesthelper.Logger())
 	})
 
 	Describe("Start", func() {
@@ -71,6 +81,65 @@ var _ = Describe("Message Router", func() {
 				Eventually(fakeManager.received).Should(HaveLen(1))
 				Expect(fakeManager.received()[0].GetLogMessage()).To(Equal(message.GetLogMessage()))
 			})
+
+			It("sends container metrics to the sink manager", func() {
+				message, _ := emitter.Wrap(factories.NewContainerMetric("app", 3, 1.0, 2, 3), "origin")
+				incomingLogChan <- message
+				Eventually(fakeManager.received).Should(HaveLen(1))
+				Expect(fakeManager.received()[0].GetContainerMetric()).To(Equal(message.GetContainerMetric()))
+			})
+		})
+
+		Context("with interleaved messages from many app instances", func() {
+			const (
+				appCount            = 3
+				instanceCount       = 5
+				messagesPerInstance = 200
+			)
+
+			var incomingLogChan chan *events.Envelope
+
+			BeforeEach(func() {
+				fakeManager.jitter = true
+				incomingLogChan = make(chan *events.Envelope)
+				go messageRouter.Start(incomingLogChan)
+			})
+
+			AfterEach(func() {
+				messageRouter.Stop()
+			})
+
+			It("preserves the order of messages from each app instance", func() {
+				for seq := 0; seq < messagesPerInstance; seq++ {
+					for app := 0; app < appCount; app++ {
+						for instance := 0; instance < instanceCount; instance++ {
+							logMessage := factories.NewLogMessage(events.LogMessage_OUT, strconv.Itoa(seq), fmt.Sprintf("app-%d", app), "App")
+							logMessage.SourceInstance = proto.String(strconv.Itoa(instance))
+							message, _ := emitter.Wrap(logMessage, "origin")
+							incomingLogChan <- message
+						}
+					}
+				}
+
+				Eventually(fakeManager.received, 5).Should(HaveLen(appCount * instanceCount * messagesPerInstance))
+
+				lastSeen := make(map[string]int)
+				for _, envelope := range fakeManager.received() {
+					logMessage := envelope.GetLogMessage()
+					key := logMessage.GetAppId() + "/" + logMessage.GetSourceInstance()
+					seq, err := strconv.Atoi(string(logMessage.GetMessage()))
+					Expect(err).NotTo(HaveOccurred())
+
+					last, seen := lastSeen[key]
+					if seen {
+						Expect(seq).To(Equal(last+1), "message out of order for "+key)
+					} else {
+						Expect(seq).To(Equal(0))
+					}
+					lastSeen[key] = seq
+				}
+				Expect(lastSeen).To(HaveLen(appCount * instanceCount))
+			})
 		})
 	})
 
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"sync/atomic"
+
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 )
 
@@ -9,6 +11,7 @@ type MessageRouterMetrics struct {
 	UnmarshalErrorsInParseEnvelopes uint
 	DroppedInParseEnvelopes         uint
 	ReceivedMessages                uint64
+	RoutedMessages                  uint64
 }
 
 func (messageRouterMetrics *MessageRouterMetrics) Emit() instrumentation.Context {
@@ -16,7 +19,8 @@ func (messageRouterMetrics *MessageRouterMetrics) Emit() instrumentation.Context
 		instrumentation.Metric{Name: "numberOfMessagesUnmarshalledInParseEnvelopes", Value: messageRouterMetrics.UnmarshalledInParseEnvelopes},
 		instrumentation.Metric{Name: "numberOfMessagesUnmarshalErrorsInParseEnvelopes", Value: messageRouterMetrics.UnmarshalErrorsInParseEnvelopes},
 		instrumentation.Metric{Name: "numberOfMessagesDroppedInParseEnvelopes", Value: messageRouterMetrics.DroppedInParseEnvelopes},
-		instrumentation.Metric{Name: "receivedMessages", Value: messageRouterMetrics.ReceivedMessages},
+		instrumentation.Metric{Name: "receivedMessages", Value: atomic.LoadUint64(&messageRouterMetrics.ReceivedMessages)},
+		instrumentation.Metric{Name: "routedMessages", Value: atomic.LoadUint64(&messageRouterMetrics.RoutedMessages)},
 	}
 
 	return instrumentation.Context{
@@ -18,6 +18,7 @@ var _ = Describe("MessageRouterMetrics", func() {
 			instrumentation.Metric{Name: "numberOfMessagesUnmarshalErrorsInParseEnvelopes", Value: 0},
 			instrumentation.Metric{Name: "numberOfMessagesDroppedInParseEnvelopes", Value: 0},
 			instrumentation.Metric{Name: "receivedMessages", Value: 0},
+			instrumentation.Metric{Name: "routedMessages", Value: 0},
 		},
 	}
 
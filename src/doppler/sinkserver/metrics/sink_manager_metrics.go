@@ -14,20 +14,25 @@ type SinkManagerMetrics struct {
 	dumpSinks              int
 	websocketSinks         int
 	syslogSinks            int
+	udpSyslogSinks         int
 	firehoseSinks          int
 	syslogDrainErrorCounts map[string](map[string]int) // appId -> (url -> count)
 	appDrainMetrics        []sinks.Metric
 	totalDroppedMessages   int64
+	totalSkippedMessages   int64
+	bufferedMessages       int
 
 	sinkDropUpdateChannel <-chan int64
+	sinkSkipUpdateChannel <-chan int64
 
 	lock sync.RWMutex
 }
 
-func NewSinkManagerMetrics(sinkDropUpdateChannel <-chan int64) *SinkManagerMetrics {
+func NewSinkManagerMetrics(sinkDropUpdateChannel, sinkSkipUpdateChannel <-chan int64) *SinkManagerMetrics {
 	m := SinkManagerMetrics{
 		syslogDrainErrorCounts: make(map[string](map[string]int)),
 		sinkDropUpdateChannel:  sinkDropUpdateChannel,
+		sinkSkipUpdateChannel:  sinkSkipUpdateChannel,
 	}
 
 	go func() {
@@ -38,6 +43,14 @@ func NewSinkManagerMetrics(sinkDropUpdateChannel <-chan int64) *SinkManagerMetri
 		}
 	}()
 
+	go func() {
+		for delta := range m.sinkSkipUpdateChannel {
+			m.lock.Lock()
+			m.totalSkippedMessages += delta
+			m.lock.Unlock()
+		}
+	}()
+
 	return &m
 }
 
@@ -50,6 +63,8 @@ func (sinkManagerMetrics *SinkManagerMetrics) Inc(sink sinks.Sink) {
 		sinkManagerMetrics.dumpSinks++
 	case *syslog.SyslogSink:
 		sinkManagerMetrics.syslogSinks++
+	case *syslog.UdpSyslogSink:
+		sinkManagerMetrics.udpSyslogSinks++
 	case *websocket.WebsocketSink:
 		sinkManagerMetrics.websocketSinks++
 	}
@@ -64,6 +79,8 @@ func (sinkManagerMetrics *SinkManagerMetrics) Dec(sink sinks.Sink) {
 		sinkManagerMetrics.dumpSinks--
 	case *syslog.SyslogSink:
 		sinkManagerMetrics.syslogSinks--
+	case *syslog.UdpSyslogSink:
+		sinkManagerMetrics.udpSyslogSinks--
 	case *websocket.WebsocketSink:
 		sinkManagerMetrics.websocketSinks--
 	}
@@ -101,6 +118,12 @@ func (sinkManagerMetrics *SinkManagerMetrics) AddAppDrainMetrics(metrics []sinks
 	sinkManagerMetrics.appDrainMetrics = metrics
 }
 
+func (sinkManagerMetrics *SinkManagerMetrics) SetBufferedMessages(count int) {
+	sinkManagerMetrics.lock.Lock()
+	defer sinkManagerMetrics.lock.Unlock()
+	sinkManagerMetrics.bufferedMessages = count
+}
+
 func (sinkManagerMetrics *SinkManagerMetrics) Emit() instrumentation.Context {
 	sinkManagerMetrics.lock.RLock()
 	defer sinkManagerMetrics.lock.RUnlock()
@@ -110,6 +133,7 @@ func (sinkManagerMetrics *SinkManagerMetrics) Emit() instrumentation.Context {
 		instrumentation.Metric{Name: "numberOfSyslogSinks", Value: sinkManagerMetrics.syslogSinks},
 		instrumentation.Metric{Name: "numberOfWebsocketSinks", Value: sinkManagerMetrics.websocketSinks},
 		instrumentation.Metric{Name: "numberOfFirehoseSinks", Value: sinkManagerMetrics.firehoseSinks},
+		instrumentation.Metric{Name: "numberOfLossyUdpSyslogSinks", Value: sinkManagerMetrics.udpSyslogSinks},
 	}
 
 	for appId, errorsByUrl := range sinkManagerMetrics.syslogDrainErrorCounts {
@@ -119,6 +143,8 @@ func (sinkManagerMetrics *SinkManagerMetrics) Emit() instrumentation.Context {
 	}
 
 	data = append(data, instrumentation.Metric{Name: "totalDroppedMessages", Value: sinkManagerMetrics.totalDroppedMessages})
+	data = append(data, instrumentation.Metric{Name: "totalLegacyEncodingSkippedMessages", Value: sinkManagerMetrics.totalSkippedMessages})
+	data = append(data, instrumentation.Metric{Name: "totalBufferedMessages", Value: sinkManagerMetrics.bufferedMessages})
 
 	for _, metric := range sinkManagerMetrics.appDrainMetrics {
 		data = append(data, instrumentation.Metric{
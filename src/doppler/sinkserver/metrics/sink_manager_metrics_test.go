@@ -18,10 +18,12 @@ var _ = Describe("SinkManagerMetrics", func() {
 	var sinkManagerMetrics *metrics.SinkManagerMetrics
 	var sink sinks.Sink
 	var dropUpdateChan chan int64
+	var skipUpdateChan chan int64
 
 	BeforeEach(func() {
 		dropUpdateChan = make(chan int64)
-		sinkManagerMetrics = metrics.NewSinkManagerMetrics(dropUpdateChan)
+		skipUpdateChan = make(chan int64)
+		sinkManagerMetrics = metrics.NewSinkManagerMetrics(dropUpdateChan, skipUpdateChan)
 	})
 
 	It("emits metrics for dump sinks", func() {
@@ -99,6 +101,21 @@ var _ = Describe("SinkManagerMetrics", func() {
 
 	})
 
+	It("emits metrics for lossy UDP syslog sinks", func() {
+		Expect(sinkManagerMetrics.Emit().Metrics[4].Name).To(Equal("numberOfLossyUdpSyslogSinks"))
+		Expect(sinkManagerMetrics.Emit().Metrics[4].Value).To(Equal(0))
+
+		sink := &syslog.UdpSyslogSink{}
+		sinkManagerMetrics.Inc(sink)
+
+		Expect(sinkManagerMetrics.Emit().Metrics[1].Value).To(Equal(0))
+		Expect(sinkManagerMetrics.Emit().Metrics[4].Value).To(Equal(1))
+
+		sinkManagerMetrics.Dec(sink)
+
+		Expect(sinkManagerMetrics.Emit().Metrics[4].Value).To(Equal(0))
+	})
+
 	It("emits error counts for syslog sinks by app ID and drain URL", func() {
 		sinkManagerMetrics.ReportSyslogError("app-id-1", "url-1")
 
@@ -107,7 +124,7 @@ var _ = Describe("SinkManagerMetrics", func() {
 
 		sinkManagerMetrics.ReportSyslogError("app-id-2", "url-3")
 
-		drainErrorMetrics := sinkManagerMetrics.Emit().Metrics[4:7]
+		drainErrorMetrics := sinkManagerMetrics.Emit().Metrics[5:8]
 		Expect(drainErrorMetrics).To(ConsistOf(
 			instrumentation.Metric{Name: "numberOfSyslogDrainErrors", Value: 1, Tags: map[string]interface{}{"appId": "app-id-1", "drainUrl": "url-1"}},
 			instrumentation.Metric{Name: "numberOfSyslogDrainErrors", Value: 2, Tags: map[string]interface{}{"appId": "app-id-1", "drainUrl": "url-2"}},
@@ -132,7 +149,7 @@ var _ = Describe("SinkManagerMetrics", func() {
 
 		totalDroppedMessageCountMetric := instrumentation.Metric{Name: "totalDroppedMessages", Value: int64(50)}
 
-		Eventually(func() instrumentation.Metric { return sinkManagerMetrics.Emit().Metrics[4] }).Should(Equal(totalDroppedMessageCountMetric))
+		Eventually(func() instrumentation.Metric { return sinkManagerMetrics.Emit().Metrics[5] }).Should(Equal(totalDroppedMessageCountMetric))
 	})
 
 	It("retains total dropped message count independently of current app drain metrics list", func() {
@@ -145,12 +162,27 @@ var _ = Describe("SinkManagerMetrics", func() {
 		var allMetrics []instrumentation.Metric
 		Eventually(func() int64 {
 			allMetrics = sinkManagerMetrics.Emit().Metrics
-			totalMetric := allMetrics[4]
+			totalMetric := allMetrics[5]
 
 			return totalMetric.Value.(int64)
 		}).Should(Equal(int64(50)))
 
-		appMetric := allMetrics[5]
+		appMetric := allMetrics[8]
 		Expect(appMetric.Value).To(Equal(int64(378)))
 	})
+
+	It("emits the number of buffered messages", func() {
+		sinkManagerMetrics.SetBufferedMessages(12)
+
+		Expect(sinkManagerMetrics.Emit().Metrics[7]).To(Equal(instrumentation.Metric{Name: "totalBufferedMessages", Value: 12}))
+	})
+
+	It("emits the total number of messages skipped by legacy encoded sinks", func() {
+		skipUpdateChan <- 3
+		skipUpdateChan <- 4
+
+		totalSkippedMessageCountMetric := instrumentation.Metric{Name: "totalLegacyEncodingSkippedMessages", Value: int64(7)}
+
+		Eventually(func() instrumentation.Metric { return sinkManagerMetrics.Emit().Metrics[6] }).Should(Equal(totalSkippedMessageCountMetric))
+	})
 })
@@ -0,0 +1,123 @@
+package sinkmanager
+
+import (
+	"doppler/sinks/syslog"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const droppedMessagesMetricName = "numberOfMessagesLost"
+
+var unsafeMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+type sinkDrops struct {
+	key, name, appId, drain string
+	delta, total            uint64
+}
+
+func (sinkManager *SinkManager) reportSinkDropMetrics() {
+	ticker := time.NewTicker(sinkManager.dropMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sinkManager.doneChannel:
+			return
+		case <-ticker.C:
+			sinkManager.emitSinkDropMetrics()
+		}
+	}
+}
+
+// emitSinkDropMetrics sends a CounterEvent to the firehose for every sink
+// that dropped messages since the last report. Events are named after the
+// drop metric of the sink, which keeps lossy UDP drains apart from the rest.
+// At most maxDropMetricSeries events are sent, picking the sinks with the
+// most drops; the drops of the other sinks are carried over to the next
+// report.
+func (sinkManager *SinkManager) emitSinkDropMetrics() {
+	var drops []sinkDrops
+	seen := make(map[string]bool)
+
+	for _, metric := range sinkManager.sinks.GetAllInstrumentationMetrics() {
+		if metric.Name != droppedMessagesMetricName && metric.Name != syslog.LossyUdpMessagesLostMetricName {
+			continue
+		}
+
+		appId, _ := metric.Tags["appId"].(string)
+		drain, _ := metric.Tags["drainUrl"].(string)
+		key := appId + "\x00" + drain
+		total := uint64(metric.Value)
+		seen[key] = true
+
+		lastReported := sinkManager.reportedDrops[key]
+		if total < lastReported {
+			// The sink was replaced and its count started over.
+			lastReported = 0
+		}
+		if total == lastReported {
+			continue
+		}
+
+		drops = append(drops, sinkDrops{key: key, name: metric.Name, appId: appId, drain: drain, delta: total - lastReported, total: total})
+	}
+
+	for key := range sinkManager.reportedDrops {
+		if !seen[key] {
+			delete(sinkManager.reportedDrops, key)
+		}
+	}
+
+	sort.Sort(byDelta(drops))
+
+	if sinkManager.maxDropMetricSeries > 0 && len(drops) > sinkManager.maxDropMetricSeries {
+		sinkManager.logger.Debugf("SinkManager: %d sinks dropped messages, only reporting the %d with the most drops", len(drops), sinkManager.maxDropMetricSeries)
+		drops = drops[:sinkManager.maxDropMetricSeries]
+	}
+
+	for _, d := range drops {
+		sinkManager.reportedDrops[d.key] = d.total
+		sinkManager.sinks.BroadcastToFirehoses(sinkManager.dropMetricEnvelope(d))
+	}
+}
+
+func (sinkManager *SinkManager) dropMetricEnvelope(d sinkDrops) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(sinkManager.dropsondeOrigin),
+		EventType: events.Envelope_CounterEvent.Enum(),
+		Timestamp: proto.Int64(time.Now().UnixNano()),
+		CounterEvent: &events.CounterEvent{
+			Name:  proto.String(fmt.Sprintf("%s.%s.%s", d.name, d.appId, sanitizeDrain(d.drain))),
+			Delta: proto.Uint64(d.delta),
+			Total: proto.Uint64(d.total),
+		},
+	}
+}
+
+// sanitizeDrain strips credentials and query parameters from drain URLs and
+// replaces everything but letters, digits, dashes and underscores, so the
+// drain can be used as part of a metric name.
+func sanitizeDrain(drain string) string {
+	if drainUrl, err := url.Parse(drain); err == nil && drainUrl.Host != "" {
+		drain = drainUrl.Scheme + "_" + drainUrl.Host + drainUrl.Path
+	}
+
+	return unsafeMetricNameChars.ReplaceAllString(drain, "_")
+}
+
+type byDelta []sinkDrops
+
+func (d byDelta) Len() int      { return len(d) }
+func (d byDelta) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byDelta) Less(i, j int) bool {
+	if d[i].delta != d[j].delta {
+		return d[i].delta > d[j].delta
+	}
+	return d[i].key < d[j].key
+}
@@ -8,8 +8,11 @@ import (
 	"doppler/sinks/syslog"
 	"doppler/sinks/syslogwriter"
 	"doppler/sinkserver/blacklist"
+	"doppler/sinkserver/errorthrottle"
 	"doppler/sinkserver/metrics"
+	"doppler/truncatingbuffer"
 	"fmt"
+	"net/url"
 	"sync"
 	"time"
 
@@ -22,46 +25,77 @@ import (
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 )
 
+// SyslogDrainOptions configures the connections to syslog drains. The
+// options are passed on as they are to syslogwriter.NewWriter and
+// syslog.NewUdpSyslogSink, which document what their zero values mean.
+type SyslogDrainOptions struct {
+	KeepAlive          time.Duration
+	WriteTimeout       time.Duration
+	ResolveInterval    time.Duration
+	UdpMaxDatagramSize int
+}
+
 type SinkManager struct {
 	dropsondeOrigin string
 
 	sinkDropUpdateChannel chan int64
+	sinkSkipUpdateChannel chan int64
 	metrics               *metrics.SinkManagerMetrics
 	recentLogCount        uint32
 
 	doneChannel            chan struct{}
 	errorChannel           chan *events.Envelope
+	errorThrottle          *errorthrottle.ErrorThrottle
 	urlBlacklistManager    *blacklist.URLBlacklistManager
 	sinks                  *groupedsinks.GroupedSinks
 	skipCertVerify         bool
 	sinkTimeout, metricTTL time.Duration
 	logger                 *gosteno.Logger
 
+	dropMetricsInterval time.Duration
+	maxDropMetricSeries int
+
+	bufferSizer truncatingbuffer.BufferSizer
+
+	syslogDrainOptions SyslogDrainOptions
+	reportedDrops      map[string]uint64 // key is appId and drain; only used by the drop metrics reporter
+
 	stopOnce sync.Once
 }
 
-func New(maxRetainedLogMessages uint32, skipCertVerify bool, blackListManager *blacklist.URLBlacklistManager, logger *gosteno.Logger, dropsondeOrigin string, sinkTimeout, metricTTL time.Duration) *SinkManager {
+func New(maxRetainedLogMessages uint32, skipCertVerify bool, blackListManager *blacklist.URLBlacklistManager, logger *gosteno.Logger, dropsondeOrigin string, sinkTimeout, metricTTL, errorNotificationInterval, dropMetricsInterval time.Duration, maxDropMetricSeries int) *SinkManager {
 	sinkDropUpdateChannel := make(chan int64)
+	sinkSkipUpdateChannel := make(chan int64)
 
-	return &SinkManager{
+	sinkManager := &SinkManager{
 		doneChannel:           make(chan struct{}),
 		errorChannel:          make(chan *events.Envelope, 100),
 		urlBlacklistManager:   blackListManager,
 		sinks:                 groupedsinks.NewGroupedSinks(logger),
 		skipCertVerify:        skipCertVerify,
 		recentLogCount:        maxRetainedLogMessages,
-		metrics:               metrics.NewSinkManagerMetrics(sinkDropUpdateChannel),
+		metrics:               metrics.NewSinkManagerMetrics(sinkDropUpdateChannel, sinkSkipUpdateChannel),
 		sinkDropUpdateChannel: sinkDropUpdateChannel,
+		sinkSkipUpdateChannel: sinkSkipUpdateChannel,
 		logger:                logger,
 		dropsondeOrigin:       dropsondeOrigin,
 		sinkTimeout:           sinkTimeout,
 		metricTTL:             metricTTL,
+		dropMetricsInterval:   dropMetricsInterval,
+		maxDropMetricSeries:   maxDropMetricSeries,
+		reportedDrops:         make(map[string]uint64),
 	}
+	sinkManager.errorThrottle = errorthrottle.New(errorNotificationInterval, sinkManager.sendErrorToApp)
+
+	return sinkManager
 }
 
 func (sinkManager *SinkManager) Start(newAppServiceChan, deletedAppServiceChan <-chan appservice.AppService) {
 	go sinkManager.listenForNewAppServices(newAppServiceChan)
 	go sinkManager.listenForDeletedAppServices(deletedAppServiceChan)
+	if sinkManager.dropMetricsInterval > 0 {
+		go sinkManager.reportSinkDropMetrics()
+	}
 
 	sinkManager.listenForErrorMessages()
 }
@@ -69,6 +103,7 @@ func (sinkManager *SinkManager) Start(newAppServiceChan, deletedAppServiceChan <
 func (sinkManager *SinkManager) Stop() {
 	sinkManager.stopOnce.Do(func() {
 		close(sinkManager.doneChannel)
+		sinkManager.errorThrottle.Stop()
 		sinkManager.sinks.DeleteAll()
 	})
 }
@@ -79,7 +114,27 @@ func (sinkManager *SinkManager) SendTo(appId string, receivedMessage *events.Env
 	sinkManager.sinks.Broadcast(appId, receivedMessage)
 }
 
+// SetBufferSizer makes every sink and firehose sink registered from now on
+// size its buffer with sizer instead of its own fixed size.
+func (sinkManager *SinkManager) SetBufferSizer(sizer truncatingbuffer.BufferSizer) {
+	sinkManager.bufferSizer = sizer
+}
+
+// SetSyslogDrainOptions sets the options of the syslog drains registered from
+// now on. It must be called before Start.
+func (sinkManager *SinkManager) SetSyslogDrainOptions(options SyslogDrainOptions) {
+	sinkManager.syslogDrainOptions = options
+}
+
+func (sinkManager *SinkManager) sizeBuffer(sink sinks.Sink) {
+	if sized, ok := sink.(sinks.BufferSized); ok && sinkManager.bufferSizer != nil {
+		sized.SetBufferSizer(sinkManager.bufferSizer)
+	}
+}
+
 func (sinkManager *SinkManager) RegisterSink(sink sinks.Sink) bool {
+	sinkManager.sizeBuffer(sink)
+
 	inputChan := make(chan *events.Envelope, 128)
 	ok := sinkManager.sinks.RegisterAppSink(inputChan, sink)
 	if !ok {
@@ -114,6 +169,8 @@ func (sinkManager *SinkManager) UnregisterSink(sink sinks.Sink) {
 }
 
 func (sinkManager *SinkManager) RegisterFirehoseSink(sink sinks.Sink) bool {
+	sinkManager.sizeBuffer(sink)
+
 	inputChan := make(chan *events.Envelope, 1)
 	ok := sinkManager.sinks.RegisterFirehoseSink(inputChan, sink)
 	if !ok {
@@ -164,6 +221,10 @@ func (sinkManager *SinkManager) SendSyslogErrorToLoggregator(errorMsg string, ap
 
 	sinkManager.logger.Warnf(errorMsg)
 
+	sinkManager.errorThrottle.HandleError(errorMsg, appId, sinkUrl)
+}
+
+func (sinkManager *SinkManager) sendErrorToApp(errorMsg string, appId string, sinkUrl string) {
 	logMessage := factories.NewLogMessage(events.LogMessage_ERR, errorMsg, appId, "LGR")
 
 	envelope, err := emitter.Wrap(logMessage, sinkManager.dropsondeOrigin)
@@ -177,7 +238,8 @@ func (sinkManager *SinkManager) SendSyslogErrorToLoggregator(errorMsg string, ap
 }
 
 func (sinkManager *SinkManager) Emit() instrumentation.Context {
-	sinkManager.metrics.AddAppDrainMetrics(sinkManager.sinks.GetAllInstrumentationMetrics())
+	sinkManager.metrics.AddAppDrainMetrics(append(sinkManager.sinks.GetAllInstrumentationMetrics(), sinkManager.sinks.GetOriginFilterMetrics()...))
+	sinkManager.metrics.SetBufferedMessages(sinkManager.sinks.BufferedMessageCount())
 	return sinkManager.metrics.Emit()
 }
 
@@ -185,6 +247,10 @@ func (sinkManager *SinkManager) SinkDropUpdateChannel() chan<- int64 {
 	return sinkManager.sinkDropUpdateChannel
 }
 
+func (sinkManager *SinkManager) SinkSkipUpdateChannel() chan<- int64 {
+	return sinkManager.sinkSkipUpdateChannel
+}
+
 func (sinkManager *SinkManager) listenForNewAppServices(newAppServiceChan <-chan appservice.AppService) {
 	for appService := range newAppServiceChan {
 		sinkManager.registerNewSyslogSink(appService.AppId, appService.Url)
@@ -218,13 +284,38 @@ func (sinkManager *SinkManager) listenForErrorMessages() {
 }
 
 func (sinkManager *SinkManager) registerNewSyslogSink(appId string, syslogSinkUrl string) {
+	if sinkManager.sinks.DrainFor(appId, syslogSinkUrl) != nil {
+		return
+	}
+
 	parsedSyslogDrainUrl, err := sinkManager.urlBlacklistManager.CheckUrl(syslogSinkUrl)
 	if err != nil {
 		sinkManager.SendSyslogErrorToLoggregator(invalidSyslogUrlErrorMsg(appId, syslogSinkUrl, err), appId, syslogSinkUrl)
 		return
 	}
 
-	syslogWriter, err := syslogwriter.NewWriter(parsedSyslogDrainUrl, appId, sinkManager.skipCertVerify)
+	drainType, err := syslog.ParseDrainType(parsedSyslogDrainUrl.Query().Get(syslog.DrainTypeParam))
+	if err != nil {
+		sinkManager.sendErrorToApp(invalidDrainTypeErrorMsg(appId, syslogSinkUrl, err), appId, syslogSinkUrl)
+	}
+	removeDrainTypeParam(parsedSyslogDrainUrl)
+
+	if parsedSyslogDrainUrl.Scheme == syslog.UdpScheme {
+		sinkManager.RegisterSink(syslog.NewUdpSyslogSink(
+			appId,
+			syslogSinkUrl,
+			parsedSyslogDrainUrl.Host,
+			drainType,
+			sinkManager.logger,
+			sinkManager.syslogDrainOptions.UdpMaxDatagramSize,
+			sinkManager.syslogDrainOptions.ResolveInterval,
+			sinkManager.SendSyslogErrorToLoggregator,
+			sinkManager.sinkDropUpdateChannel,
+		))
+		return
+	}
+
+	syslogWriter, err := syslogwriter.NewWriter(parsedSyslogDrainUrl, appId, sinkManager.skipCertVerify, sinkManager.syslogDrainOptions.KeepAlive, sinkManager.syslogDrainOptions.WriteTimeout, sinkManager.syslogDrainOptions.ResolveInterval)
 	if err != nil {
 		sinkManager.SendSyslogErrorToLoggregator(invalidSyslogUrlErrorMsg(appId, syslogSinkUrl, err), appId, syslogSinkUrl)
 		return
@@ -233,6 +324,7 @@ func (sinkManager *SinkManager) registerNewSyslogSink(appId string, syslogSinkUr
 	syslogSink := syslog.NewSyslogSink(
 		appId,
 		syslogSinkUrl,
+		drainType,
 		sinkManager.logger,
 		syslogWriter,
 		sinkManager.SendSyslogErrorToLoggregator,
@@ -248,6 +340,19 @@ func invalidSyslogUrlErrorMsg(appId string, syslogSinkUrl string, err error) str
 	return fmt.Sprintf("SinkManager: Invalid syslog drain URL (%s) for application %s. Err: %v", syslogSinkUrl, appId, err)
 }
 
+func invalidDrainTypeErrorMsg(appId string, syslogSinkUrl string, err error) string {
+	return fmt.Sprintf("SinkManager: Invalid drain-type on syslog drain URL (%s) for application %s, sending logs only. Err: %v", syslogSinkUrl, appId, err)
+}
+
+func removeDrainTypeParam(drainUrl *url.URL) {
+	query := drainUrl.Query()
+	if _, ok := query[syslog.DrainTypeParam]; !ok {
+		return
+	}
+	query.Del(syslog.DrainTypeParam)
+	drainUrl.RawQuery = query.Encode()
+}
+
 func (sinkManager *SinkManager) ensureRecentLogsSinkFor(appId string) {
 	if sinkManager.sinks.DumpFor(appId) != nil {
 		return
@@ -8,6 +8,8 @@ import (
 	"doppler/sinks/syslogwriter"
 	"doppler/sinkserver/blacklist"
 	"doppler/sinkserver/sinkmanager"
+	"doppler/truncatingbuffer"
+	"fmt"
 	"net/url"
 	"sync"
 	"time"
@@ -31,7 +33,7 @@ var _ = Describe("SinkManager", func() {
 	var newAppServiceChan, deletedAppServiceChan chan appservice.AppService
 
 	BeforeEach(func() {
-		sinkManager = sinkmanager.New(1, true, blackListManager, loggertesthelper.Logger(), "dropsonde-origin", 1*time.Second, 1*time.Second)
+		sinkManager = sinkmanager.New(1, true, blackListManager, loggertesthelper.Logger(), "dropsonde-origin", 1*time.Second, 1*time.Second, 500*time.Millisecond, 0, 0)
 
 		newAppServiceChan = make(chan appservice.AppService)
 		deletedAppServiceChan = make(chan appservice.AppService)
@@ -195,6 +197,26 @@ var _ = Describe("SinkManager", func() {
 					Eventually(numSyslogSinks).Should(Equal(initialNumSinks + 1))
 				})
 
+				It("creates a new lossy UDP syslog sink from the newAppServicesChan", func() {
+					numUdpSyslogSinks := func() int {
+						return metricValue(sinkManager, "numberOfLossyUdpSyslogSinks")
+					}
+					initialNumSyslogSinks := numSyslogSinks()
+					newAppServiceChan <- appservice.AppService{AppId: "aptastic", Url: "syslog-udp://127.0.1.1:885"}
+
+					Eventually(numUdpSyslogSinks).Should(Equal(1))
+					Expect(numSyslogSinks()).To(Equal(initialNumSyslogSinks))
+				})
+
+				It("creates only one syslog sink when the same drain is added twice", func() {
+					initialNumSinks := numSyslogSinks()
+					newAppServiceChan <- appservice.AppService{AppId: "aptastic", Url: "syslog://127.0.1.1:885"}
+					newAppServiceChan <- appservice.AppService{AppId: "aptastic", Url: "syslog://127.0.1.1:885"}
+
+					Eventually(numSyslogSinks).Should(Equal(initialNumSinks + 1))
+					Consistently(numSyslogSinks).Should(Equal(initialNumSinks + 1))
+				})
+
 				Context("with an invalid drain Url", func() {
 					var errorSink *channelSink
 
@@ -220,6 +242,34 @@ var _ = Describe("SinkManager", func() {
 						Expect(string(errorMsg.GetLogMessage().GetMessage())).To(MatchRegexp("Invalid syslog drain URL"))
 					})
 				})
+
+				Context("with a drain-type on the drain Url", func() {
+					var errorSink *channelSink
+
+					BeforeEach(func() {
+						errorSink = &channelSink{appId: "aptastic",
+							identifier: "myAppChan1",
+							done:       make(chan struct{}),
+						}
+						sinkManager.RegisterSink(errorSink)
+					})
+
+					It("creates the syslog sink for a known drain-type", func() {
+						initialNumSinks := numSyslogSinks()
+						newAppServiceChan <- appservice.AppService{AppId: "aptastic", Url: "syslog://127.0.1.1:887?drain-type=metrics"}
+
+						Eventually(numSyslogSinks).Should(Equal(initialNumSinks + 1))
+						Consistently(receivedMessages(errorSink)).ShouldNot(ContainElement(ContainSubstring("Invalid drain-type")))
+					})
+
+					It("creates the syslog sink and warns the app for an unknown drain-type", func() {
+						initialNumSinks := numSyslogSinks()
+						newAppServiceChan <- appservice.AppService{AppId: "aptastic", Url: "syslog://127.0.1.1:887?drain-type=bogus"}
+
+						Eventually(numSyslogSinks).Should(Equal(initialNumSinks + 1))
+						Eventually(receivedMessages(errorSink)).Should(ContainElement(MatchRegexp(`Invalid drain-type .* sending logs only`)))
+					})
+				})
 			})
 
 			Context("when a delete update is received", func() {
@@ -243,6 +293,35 @@ var _ = Describe("SinkManager", func() {
 		})
 	})
 
+	Describe("SetBufferSizer", func() {
+		It("hands the sizer to sinks registered afterwards", func() {
+			sizer := truncatingbuffer.FixedSize(42)
+			sinkManager.SetBufferSizer(sizer)
+
+			sink := &sizedChannelSink{channelSink: channelSink{appId: "myApp", identifier: "myAppChan1", done: make(chan struct{})}}
+			sinkManager.RegisterSink(sink)
+
+			Expect(sink.BufferSizer()).To(Equal(sizer))
+		})
+
+		It("hands the sizer to firehose sinks registered afterwards", func() {
+			sizer := truncatingbuffer.FixedSize(42)
+			sinkManager.SetBufferSizer(sizer)
+
+			sink := &sizedChannelSink{channelSink: channelSink{appId: "firehose-a", done: make(chan struct{})}}
+			sinkManager.RegisterFirehoseSink(sink)
+
+			Expect(sink.BufferSizer()).To(Equal(sizer))
+		})
+
+		It("leaves the sizer of sinks alone when none is set", func() {
+			sink := &sizedChannelSink{channelSink: channelSink{appId: "myApp", identifier: "myAppChan1", done: make(chan struct{})}}
+			sinkManager.RegisterSink(sink)
+
+			Expect(sink.BufferSizer()).To(BeNil())
+		})
+	})
+
 	Describe("Stop", func() {
 
 		It("stops", func() {
@@ -300,8 +379,8 @@ var _ = Describe("SinkManager", func() {
 			BeforeEach(func() {
 				url, err := url.Parse("syslog://localhost:9998")
 				Expect(err).To(BeNil())
-				writer, _ := syslogwriter.NewSyslogWriter(url, "appId")
-				syslogSink = syslog.NewSyslogSink("appId", "localhost:9999", loggertesthelper.Logger(), writer, func(string, string, string) {}, "dropsonde-origin", make(chan int64))
+				writer, _ := syslogwriter.NewSyslogWriter(url, "appId", 0, 0, 0)
+				syslogSink = syslog.NewSyslogSink("appId", "localhost:9999", syslog.DrainTypeLogs, loggertesthelper.Logger(), writer, func(string, string, string) {}, "dropsonde-origin", make(chan int64))
 
 				sinkManager.RegisterSink(syslogSink)
 			})
@@ -425,12 +504,45 @@ var _ = Describe("SinkManager", func() {
 			sinkManager.RegisterSink(sink)
 			sinkManager.SendSyslogErrorToLoggregator("error msg", "myApp", "drainUrl")
 
-			syslogFailureMetrics := sinkManager.Emit().Metrics[4:5]
+			syslogFailureMetrics := sinkManager.Emit().Metrics[5:6]
 			Expect(syslogFailureMetrics).To(ConsistOf(
 				instrumentation.Metric{Name: "numberOfSyslogDrainErrors", Value: 1, Tags: map[string]interface{}{"appId": "myApp", "drainUrl": "drainUrl"}},
 			))
 
 		})
+
+		Context("with a rapidly failing drain", func() {
+			var sink *channelSink
+
+			BeforeEach(func() {
+				sink = &channelSink{
+					appId:      "myApp",
+					identifier: "myAppChan1",
+					done:       make(chan struct{}),
+				}
+				sinkManager.RegisterSink(sink)
+
+				for i := 1; i <= 50; i++ {
+					sinkManager.SendSyslogErrorToLoggregator(fmt.Sprintf("error msg %d", i), "myApp", "drainUrl")
+				}
+			})
+
+			It("throttles the error messages sent to the app", func() {
+				Eventually(sink.Received).Should(HaveLen(1))
+				Expect(string(sink.Received()[0].GetLogMessage().GetMessage())).To(Equal("error msg 1"))
+
+				Eventually(sink.Received, 2).Should(HaveLen(2))
+				Consistently(sink.Received, 1).Should(HaveLen(2))
+
+				errorMsg := sink.Received()[1]
+				Expect(errorMsg.GetLogMessage().GetSourceType()).To(Equal("LGR"))
+				Expect(string(errorMsg.GetLogMessage().GetMessage())).To(Equal("Connection to drain drainUrl failed 49 times in the last 500ms: error msg 50"))
+			})
+
+			It("still counts every failure", func() {
+				Expect(metricValue(sinkManager, "numberOfSyslogDrainErrors")).To(Equal(50))
+			})
+		})
 	})
 
 	Describe("Emit", func() {
@@ -513,6 +625,33 @@ func (c *channelSink) GetInstrumentationMetric() sinks.Metric {
 }
 func (c *channelSink) UpdateDroppedMessageCount(mc int64) {}
 
+type sizedChannelSink struct {
+	channelSink
+	sizer truncatingbuffer.BufferSizer
+}
+
+func (c *sizedChannelSink) SetBufferSizer(sizer truncatingbuffer.BufferSizer) {
+	c.Lock()
+	defer c.Unlock()
+	c.sizer = sizer
+}
+
+func (c *sizedChannelSink) BufferSizer() truncatingbuffer.BufferSizer {
+	c.RLock()
+	defer c.RUnlock()
+	return c.sizer
+}
+
+func receivedMessages(sink *channelSink) func() []string {
+	return func() []string {
+		messages := []string{}
+		for _, envelope := range sink.Received() {
+			messages = append(messages, string(envelope.GetLogMessage().GetMessage()))
+		}
+		return messages
+	}
+}
+
 func metricValue(manager *sinkmanager.SinkManager, metricName string) int {
 	ms := manager.Emit().Metrics
 
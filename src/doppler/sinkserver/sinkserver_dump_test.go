@@ -48,7 +48,7 @@ var _ = Describe("Dumping", func() {
 
 		emptyBlacklist := blacklist.New(nil)
 		sinkManager = sinkmanager.New(1024, false, emptyBlacklist, logger, "dropsonde-origin",
-			2*time.Second, 1*time.Second)
+			2*time.Second, 1*time.Second, 1*time.Second, 0, 0)
 
 		services.Add(1)
 		goRoutineSpawned.Add(1)
@@ -58,7 +58,7 @@ var _ = Describe("Dumping", func() {
 			sinkManager.Start(newAppServiceChan, deletedAppServiceChan)
 		}()
 
-		TestMessageRouter = sinkserver.NewMessageRouter(sinkManager, logger)
+		TestMessageRouter = sinkserver.NewMessageRouter(sinkManager, 4, logger)
 
 		services.Add(1)
 		goRoutineSpawned.Add(1)
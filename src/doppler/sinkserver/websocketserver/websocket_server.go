@@ -16,10 +16,14 @@ import (
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/loggregatorlib/server"
-	"github.com/gogo/protobuf/proto"
 	gorilla "github.com/gorilla/websocket"
 )
 
+// ResponseTimeout bounds how long the recentlogs and containermetrics
+// endpoints spend writing their envelopes and the close frame that ends the
+// response.
+var ResponseTimeout = 5 * time.Second
+
 type WebsocketServer struct {
 	apiEndpoint       string
 	sinkManager       *sinkmanager.SinkManager
@@ -75,10 +79,27 @@ func (w *WebsocketServer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 
 	endpointName := strings.Split(request.URL.Path, "/")[1]
 
-	if endpointName == "firehose" {
-		handler, err = w.firehoseHandler(writer, request)
-	} else {
-		handler, err = w.appHandler(writer, request)
+	encoding, err := websocket.ParseEncoding(request.URL.Query().Get(websocket.FormatParam))
+	if err != nil {
+		http.Error(writer, "invalid format: "+err.Error(), 400)
+		w.logger.Errorf("WebsocketServer.ServeHTTP: Invalid format (returning 400): %s", err.Error())
+		return
+	}
+
+	originFilter, err := websocket.ParseOriginFilter(request.URL.Query()[websocket.OriginParam])
+	if err != nil {
+		http.Error(writer, "invalid origin: "+err.Error(), 400)
+		w.logger.Errorf("WebsocketServer.ServeHTTP: Invalid origin (returning 400): %s", err.Error())
+		return
+	}
+
+	switch endpointName {
+	case "firehose":
+		handler, err = w.firehoseHandler(writer, request, encoding, originFilter)
+	case "tail", "dump":
+		handler, err = w.legacyHandler(writer, request, endpointName)
+	default:
+		handler, err = w.appHandler(writer, request, encoding, originFilter)
 	}
 
 	if err != nil {
@@ -94,23 +115,55 @@ func (w *WebsocketServer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 	}
 
 	defer ws.Close()
-	defer ws.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""), time.Time{})
+	defer func() {
+		ws.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""), time.Now().Add(ResponseTimeout))
+	}()
 
 	handler(ws)
 }
 
-func (w *WebsocketServer) firehoseHandler(writer http.ResponseWriter, request *http.Request) (wsHandler, error) {
+func (w *WebsocketServer) firehoseHandler(writer http.ResponseWriter, request *http.Request, encoding websocket.Encoding, originFilter *websocket.OriginFilter) (wsHandler, error) {
 	firehoseSubscriptionId := strings.Split(request.URL.Path, "/")[2]
 
 	f := func(ws *gorilla.Conn) {
-		w.streamFirehose(firehoseSubscriptionId, ws)
+		w.streamFirehose(firehoseSubscriptionId, encoding, originFilter, ws)
 	}
 	return f, nil
 
 }
 
-func (w *WebsocketServer) appHandler(writer http.ResponseWriter, request *http.Request) (wsHandler, error) {
-	var handler func(string, *gorilla.Conn)
+// legacyHandler serves the /tail/?app=APP_ID and /dump/?app=APP_ID endpoints
+// used by old clients. They always write the legacy logmessage encoding.
+func (w *WebsocketServer) legacyHandler(writer http.ResponseWriter, request *http.Request, endpoint string) (wsHandler, error) {
+	var handler func(string, websocket.Encoding, *gorilla.Conn)
+
+	appId := request.URL.Query().Get("app")
+	if appId == "" {
+		writer.Header().Set("WWW-Authenticate", "Basic")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "App ID missing. Make request to /%s/?app=APP_ID", endpoint)
+
+		w.logInvalidApp(request.RemoteAddr)
+		return nil, errors.New("Validation error (returning 400): No AppId")
+	}
+
+	switch endpoint {
+	case "tail":
+		handler = func(appId string, encoding websocket.Encoding, ws *gorilla.Conn) {
+			w.streamLogs(appId, encoding, nil, ws)
+		}
+	case "dump":
+		handler = w.recentLogs
+	}
+
+	f := func(ws *gorilla.Conn) {
+		handler(appId, websocket.LegacyEncoding, ws)
+	}
+	return f, nil
+}
+
+func (w *WebsocketServer) appHandler(writer http.ResponseWriter, request *http.Request, encoding websocket.Encoding, originFilter *websocket.OriginFilter) (wsHandler, error) {
+	var handler func(string, websocket.Encoding, *gorilla.Conn)
 
 	validPaths := regexp.MustCompile("^/apps/(.*)/(recentlogs|stream|containermetrics)$")
 	matches := validPaths.FindStringSubmatch(request.URL.Path)
@@ -134,7 +187,9 @@ func (w *WebsocketServer) appHandler(writer http.ResponseWriter, request *http.R
 
 	switch endpoint {
 	case "stream":
-		handler = w.streamLogs
+		handler = func(appId string, encoding websocket.Encoding, ws *gorilla.Conn) {
+			w.streamLogs(appId, encoding, originFilter, ws)
+		}
 	case "recentlogs":
 		handler = w.recentLogs
 	case "containermetrics":
@@ -145,30 +200,33 @@ func (w *WebsocketServer) appHandler(writer http.ResponseWriter, request *http.R
 	}
 
 	f := func(ws *gorilla.Conn) {
-		handler(appId, ws)
+		handler(appId, encoding, ws)
 	}
 	return f, nil
 }
 
-func (w *WebsocketServer) streamLogs(appId string, websocketConnection *gorilla.Conn) {
-	w.logger.Debugf("WebsocketServer: Requesting a wss sink for app %s", appId)
-	w.streamWebsocket(appId, websocketConnection, w.sinkManager.RegisterSink, w.sinkManager.UnregisterSink)
+func (w *WebsocketServer) streamLogs(appId string, encoding websocket.Encoding, originFilter *websocket.OriginFilter, websocketConnection *gorilla.Conn) {
+	w.logger.Debugf("WebsocketServer: Requesting a wss sink for app %s with %s encoding", appId, encoding)
+	w.streamWebsocket(appId, encoding, originFilter, websocketConnection, w.sinkManager.RegisterSink, w.sinkManager.UnregisterSink)
 }
 
-func (w *WebsocketServer) streamFirehose(subscriptionId string, websocketConnection *gorilla.Conn) {
-	w.logger.Debugf("WebsocketServer: Requesting firehose wss sink")
-	w.streamWebsocket(subscriptionId, websocketConnection, w.sinkManager.RegisterFirehoseSink, w.sinkManager.UnregisterFirehoseSink)
+func (w *WebsocketServer) streamFirehose(subscriptionId string, encoding websocket.Encoding, originFilter *websocket.OriginFilter, websocketConnection *gorilla.Conn) {
+	w.logger.Debugf("WebsocketServer: Requesting firehose wss sink with %s encoding", encoding)
+	w.streamWebsocket(subscriptionId, encoding, originFilter, websocketConnection, w.sinkManager.RegisterFirehoseSink, w.sinkManager.UnregisterFirehoseSink)
 }
 
-func (w *WebsocketServer) streamWebsocket(appId string, websocketConnection *gorilla.Conn, register func(sinks.Sink) bool, unregister func(sinks.Sink)) {
+func (w *WebsocketServer) streamWebsocket(appId string, encoding websocket.Encoding, originFilter *websocket.OriginFilter, websocketConnection *gorilla.Conn, register func(sinks.Sink) bool, unregister func(sinks.Sink)) {
 	websocketSink := websocket.NewWebsocketSink(
 		appId,
 		w.logger,
 		websocketConnection,
 		w.bufferSize,
+		encoding,
 		w.dropsondeOrigin,
 		w.sinkManager.SinkDropUpdateChannel(),
+		w.sinkManager.SinkSkipUpdateChannel(),
 	)
+	websocketSink.SetOriginFilter(originFilter)
 
 	register(websocketSink)
 	defer unregister(websocketSink)
@@ -177,14 +235,19 @@ func (w *WebsocketServer) streamWebsocket(appId string, websocketConnection *gor
 	server.NewKeepAlive(websocketConnection, w.keepAliveInterval).Run()
 }
 
-func (w *WebsocketServer) recentLogs(appId string, websocketConnection *gorilla.Conn) {
+func (w *WebsocketServer) recentLogs(appId string, encoding websocket.Encoding, websocketConnection *gorilla.Conn) {
 	logMessages := w.sinkManager.RecentLogsFor(appId)
-	sendMessagesToWebsocket(logMessages, websocketConnection, w.logger)
+	websocketConnection.SetWriteDeadline(time.Now().Add(ResponseTimeout))
+	sendMessagesToWebsocket(logMessages, encoding, websocketConnection, w.logger)
 }
 
-func (w *WebsocketServer) latestContainerMetrics(appId string, websocketConnection *gorilla.Conn) {
+// latestContainerMetrics writes the app's stored container metrics, one
+// envelope per frame. An app without metrics gets no frames; the connection
+// is then closed normally like any other response.
+func (w *WebsocketServer) latestContainerMetrics(appId string, encoding websocket.Encoding, websocketConnection *gorilla.Conn) {
 	metrics := w.sinkManager.LatestContainerMetrics(appId)
-	sendMessagesToWebsocket(metrics, websocketConnection, w.logger)
+	websocketConnection.SetWriteDeadline(time.Now().Add(ResponseTimeout))
+	sendMessagesToWebsocket(metrics, encoding, websocketConnection, w.logger)
 }
 
 func (w *WebsocketServer) logInvalidApp(address string) {
@@ -192,19 +255,24 @@ func (w *WebsocketServer) logInvalidApp(address string) {
 	w.logger.Warn(message)
 }
 
-func sendMessagesToWebsocket(envelopes []*events.Envelope, websocketConnection *gorilla.Conn, logger *gosteno.Logger) {
+func sendMessagesToWebsocket(envelopes []*events.Envelope, encoding websocket.Encoding, websocketConnection *gorilla.Conn, logger *gosteno.Logger) {
 	for _, messageEnvelope := range envelopes {
-		envelopeBytes, err := proto.Marshal(messageEnvelope)
+		envelopeBytes, err := encoding.Encode(messageEnvelope)
+
+		if err == websocket.ErrNotLogMessage {
+			continue
+		}
 
 		if err != nil {
 			logger.Errorf("Websocket Server %s: Error marshalling %s envelope from origin %s: %s", websocketConnection.RemoteAddr(), messageEnvelope.GetEventType().String(), messageEnvelope.GetOrigin(), err.Error())
+			continue
 		}
 
 		err = websocketConnection.WriteMessage(gorilla.BinaryMessage, envelopeBytes)
 		if err != nil {
 			logger.Debugf("Websocket Server %s: Error when trying to send data to sink %s. Requesting close. Err: %v", websocketConnection.RemoteAddr(), err)
-		} else {
-			logger.Debugf("Websocket Server %s: Successfully sent data", websocketConnection.RemoteAddr())
+			return
 		}
+		logger.Debugf("Websocket Server %s: Successfully sent data", websocketConnection.RemoteAddr())
 	}
 }
@@ -1,6 +1,7 @@
 package websocketserver_test
 
 import (
+	sinkwebsocket "doppler/sinks/websocket"
 	"doppler/sinkserver/blacklist"
 	"doppler/sinkserver/sinkmanager"
 	"doppler/sinkserver/websocketserver"
@@ -12,17 +13,20 @@ import (
 	"github.com/cloudfoundry/dropsonde/factories"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/websocket"
 
 	"github.com/cloudfoundry/dropsonde/emitter"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
 )
 
 var _ = Describe("WebsocketServer", func() {
 
 	var server *websocketserver.WebsocketServer
-	var sinkManager = sinkmanager.New(1024, false, blacklist.New(nil), loggertesthelper.Logger(), "dropsonde-origin", 1*time.Second, 1*time.Second)
+	var sinkManager = sinkmanager.New(1024, false, blacklist.New(nil), loggertesthelper.Logger(), "dropsonde-origin", 1*time.Second, 1*time.Second, 1*time.Second, 0, 0)
 	var appId = "my-app"
 	var wsReceivedChan chan []byte
 	var connectionDropped <-chan struct{}
@@ -55,6 +59,16 @@ var _ = Describe("WebsocketServer", func() {
 			_, connectionDropped = AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/apps/my-app/junk", apiEndpoint))
 			Expect(connectionDropped).To(BeClosed())
 		})
+
+		It("fails with an unknown format", func() {
+			_, connectionDropped = AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/apps/%s/stream?format=junk", apiEndpoint, appId))
+			Expect(connectionDropped).To(BeClosed())
+		})
+
+		It("fails without an app query parameter on the legacy endpoints", func() {
+			_, connectionDropped = AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/tail/", apiEndpoint))
+			Expect(connectionDropped).To(BeClosed())
+		})
 	})
 
 	It("dumps buffer data to the websocket client with /recentlogs", func(done Done) {
@@ -82,6 +96,88 @@ var _ = Describe("WebsocketServer", func() {
 		close(done)
 	})
 
+	Describe("/containermetrics", func() {
+		// requestContainerMetrics reads the whole response for the app and
+		// returns its container metrics and the error that ended it.
+		requestContainerMetrics := func(appId string) ([]*events.ContainerMetric, error) {
+			ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/apps/%s/containermetrics", apiEndpoint, appId), http.Header{})
+			Expect(err).NotTo(HaveOccurred())
+			defer ws.Close()
+
+			var metrics []*events.ContainerMetric
+			for {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					return metrics, err
+				}
+				envelope, err := parseEnvelope(data)
+				Expect(err).NotTo(HaveOccurred())
+				metrics = append(metrics, envelope.GetContainerMetric())
+			}
+		}
+
+		sendContainerMetric := func(appId string, instanceIndex int32, cpuPercentage float64) {
+			envelope, _ := emitter.Wrap(factories.NewContainerMetric(appId, instanceIndex, cpuPercentage, 1234, 123412341234), "origin")
+			sinkManager.SendTo(appId, envelope)
+		}
+
+		It("sends the latest metric of every instance and closes normally", func() {
+			sendContainerMetric("metrics-app", 0, 1)
+			sendContainerMetric("metrics-app", 1, 2)
+
+			var metrics []*events.ContainerMetric
+			var err error
+			Eventually(func() []*events.ContainerMetric {
+				metrics, err = requestContainerMetrics("metrics-app")
+				return metrics
+			}).Should(HaveLen(2))
+
+			Expect(err).To(BeAssignableToTypeOf(&websocket.CloseError{}))
+			Expect(err.(*websocket.CloseError).Code).To(Equal(websocket.CloseNormalClosure))
+			Expect([]float64{metrics[0].GetCpuPercentage(), metrics[1].GetCpuPercentage()}).To(ConsistOf(1.0, 2.0))
+		})
+
+		It("closes normally without sending anything for an app without metrics", func() {
+			metrics, err := requestContainerMetrics("app-without-metrics")
+
+			Expect(metrics).To(BeEmpty())
+			Expect(err).To(BeAssignableToTypeOf(&websocket.CloseError{}))
+			Expect(err.(*websocket.CloseError).Code).To(Equal(websocket.CloseNormalClosure))
+		})
+
+		It("sends complete responses while the metrics are updated", func() {
+			sendContainerMetric("busy-app", 0, 0)
+
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for i := 1; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+						sendContainerMetric("busy-app", int32(i%3), float64(i))
+					}
+				}
+			}()
+			defer func() {
+				close(stop)
+				<-stopped
+			}()
+
+			for i := 0; i < 10; i++ {
+				metrics, err := requestContainerMetrics("busy-app")
+				Expect(err).To(BeAssignableToTypeOf(&websocket.CloseError{}))
+				Expect(err.(*websocket.CloseError).Code).To(Equal(websocket.CloseNormalClosure))
+				Expect(len(metrics)).To(BeNumerically("<=", 3))
+				for _, metric := range metrics {
+					Expect(metric.GetApplicationId()).To(Equal("busy-app"))
+				}
+			}
+		})
+	})
+
 	It("sends data to the websocket client with /stream", func(done Done) {
 		stopKeepAlive, _ := AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/apps/%s/stream", apiEndpoint, appId))
 		lm, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "my message", appId, "App"), "origin")
@@ -150,6 +246,112 @@ var _ = Describe("WebsocketServer", func() {
 		close(done)
 	})
 
+	Describe("origin filtering", func() {
+		// sendUntilReceived sends envelopes with each of origins in turn until the
+		// origins received by the client satisfy matcher, and returns them.
+		sendUntilReceived := func(receivedChan chan []byte, origins []string, matcher types.GomegaMatcher) []string {
+			var received []string
+			sent := 0
+			Eventually(func() []string {
+				origin := origins[sent%len(origins)]
+				lm, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "from "+origin, appId, "App"), origin)
+				sinkManager.SendTo(appId, lm)
+				sent++
+
+				for len(receivedChan) > 0 {
+					envelope, err := receiveEnvelope(receivedChan)
+					Expect(err).NotTo(HaveOccurred())
+					received = append(received, envelope.GetOrigin())
+				}
+				return received
+			}).Should(matcher)
+			return received
+		}
+
+		It("only sends envelopes with a requested origin to the firehose client", func() {
+			receivedChan := make(chan []byte, 1000)
+			stopKeepAlive, _ := AddWSSink(receivedChan, fmt.Sprintf("ws://%s/firehose/fire-subscription-o?origin=router&origin=cell", apiEndpoint))
+			defer close(stopKeepAlive)
+
+			received := sendUntilReceived(receivedChan, []string{"other", "router", "cell"}, And(ContainElement("router"), ContainElement("cell")))
+			Expect(received).NotTo(ContainElement("other"))
+		})
+
+		It("only sends envelopes with a requested origin to the stream client", func() {
+			receivedChan := make(chan []byte, 1000)
+			stopKeepAlive, _ := AddWSSink(receivedChan, fmt.Sprintf("ws://%s/apps/%s/stream?origin=cell", apiEndpoint, appId))
+			defer close(stopKeepAlive)
+
+			received := sendUntilReceived(receivedChan, []string{"router", "cell"}, ContainElement("cell"))
+			Expect(received).NotTo(ContainElement("router"))
+		})
+
+		It("fails with more origins than allowed", func() {
+			query := "origin=a"
+			for i := 0; i < sinkwebsocket.MaxOrigins; i++ {
+				query += fmt.Sprintf("&origin=%d", i)
+			}
+			_, connectionDropped = AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/firehose/fire-subscription-o?%s", apiEndpoint, query))
+			Expect(connectionDropped).To(BeClosed())
+		})
+
+		It("fails with an empty origin", func() {
+			_, connectionDropped = AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/apps/%s/stream?origin=", apiEndpoint, appId))
+			Expect(connectionDropped).To(BeClosed())
+		})
+	})
+
+	Describe("legacy encoding", func() {
+		It("sends legacy log messages to the websocket client with /tail/", func(done Done) {
+			stopKeepAlive, _ := AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/tail/?app=%s", apiEndpoint, appId))
+			lm, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "my message", appId, "App"), "origin")
+			sinkManager.SendTo(appId, lm)
+
+			legacyMessage, err := receiveLegacyMessage(wsReceivedChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(legacyMessage.GetMessage()).To(Equal(lm.GetLogMessage().GetMessage()))
+			Expect(legacyMessage.GetAppId()).To(Equal(appId))
+			close(stopKeepAlive)
+			close(done)
+		})
+
+		It("dumps legacy log messages to the websocket client with /dump/", func(done Done) {
+			lm, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "my legacy message", appId, "App"), "origin")
+			sinkManager.SendTo(appId, lm)
+
+			AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/dump/?app=%s", apiEndpoint, appId))
+
+			var legacyMessage *logmessage.LogMessage
+			var err error
+			for string(legacyMessage.GetMessage()) != "my legacy message" {
+				legacyMessage, err = receiveLegacyMessage(wsReceivedChan)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			close(done)
+		})
+
+		It("sends legacy log messages to clients requesting the legacy format", func(done Done) {
+			stopKeepAlive, _ := AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/apps/%s/stream?format=legacy", apiEndpoint, appId))
+			lm, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, "my message", appId, "App"), "origin")
+			sinkManager.SendTo(appId, lm)
+
+			legacyMessage, err := receiveLegacyMessage(wsReceivedChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(legacyMessage.GetMessage()).To(Equal(lm.GetLogMessage().GetMessage()))
+			close(stopKeepAlive)
+			close(done)
+		})
+
+		It("does not send container metrics to legacy clients", func() {
+			stopKeepAlive, _ := AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/tail/?app=%s", apiEndpoint, appId))
+			cm, _ := emitter.Wrap(factories.NewContainerMetric(appId, 0, 42.42, 1234, 123412341234), "origin")
+			sinkManager.SendTo(appId, cm)
+
+			Consistently(wsReceivedChan).ShouldNot(Receive())
+			close(stopKeepAlive)
+		})
+	})
+
 	It("closes the client when the keep-alive stops", func() {
 		stopKeepAlive, connectionDropped := AddWSSink(wsReceivedChan, fmt.Sprintf("ws://%s/apps/%s/stream", apiEndpoint, appId))
 		Expect(stopKeepAlive).ToNot(Receive())
@@ -162,3 +364,10 @@ func receiveEnvelope(dataChan <-chan []byte) (*events.Envelope, error) {
 	receivedData := <-dataChan
 	return parseEnvelope(receivedData)
 }
+
+func receiveLegacyMessage(dataChan <-chan []byte) (*logmessage.LogMessage, error) {
+	receivedData := <-dataChan
+	var legacyMessage logmessage.LogMessage
+	err := proto.Unmarshal(receivedData, &legacyMessage)
+	return &legacyMessage, err
+}
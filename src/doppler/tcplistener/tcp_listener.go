@@ -0,0 +1,276 @@
+package tcplistener
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// MaxFrameSize is the largest message accepted in a frame, the same as the
+// largest message read from a datagram. Compressed messages may be no larger
+// once decompressed.
+const MaxFrameSize = 65535
+
+// FrameCompressed is set in the first byte of the length header of a frame
+// whose message metron gzip compressed.
+const FrameCompressed = 0x80
+
+// AcceptsCompressedFrames is written to every connection once it is accepted,
+// telling metron that it may send compressed frames on it.
+const AcceptsCompressedFrames = 0x01
+
+// TCPListener receives messages from metrons over persistent TCP or, given a
+// TLS config, TLS connections. Every message is sent as a frame of its length
+// as a 4 byte big endian unsigned integer followed by the message. Metrons
+// may compress the message of a frame once the listener has written
+// AcceptsCompressedFrames to the connection, marking the frame with
+// FrameCompressed, so that metrons that compress and those that do not can
+// both send to the listener.
+type TCPListener struct {
+	address     string
+	tlsConfig   *tls.Config
+	contextName string
+	logger      *gosteno.Logger
+	dataChannel chan []byte
+
+	lock        sync.Mutex
+	listener    net.Listener
+	connections map[net.Conn]struct{}
+	stopped     bool
+	readers     sync.WaitGroup
+
+	receivedMessageCount  uint64
+	receivedByteCount     uint64
+	invalidFrameCount     uint64
+	compressedFrameCount  uint64
+	decompressedByteCount uint64
+}
+
+func New(address string, tlsConfig *tls.Config, logger *gosteno.Logger, contextName string) (*TCPListener, <-chan []byte) {
+	dataChannel := make(chan []byte, 1024)
+	return &TCPListener{
+		address:     address,
+		tlsConfig:   tlsConfig,
+		contextName: contextName,
+		logger:      logger,
+		dataChannel: dataChannel,
+		connections: make(map[net.Conn]struct{}),
+	}, dataChannel
+}
+
+// NewServerTLSConfig returns a TLS config that presents the given certificate
+// and requires clients to present a certificate signed by the CA.
+func NewServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Start accepts connections until Stop is called. The data channel is closed
+// once all connections are closed.
+func (l *TCPListener) Start() {
+	defer close(l.dataChannel)
+
+	listener, err := l.listen()
+	if err != nil {
+		l.logger.Fatalf("Failed to listen on %s. %s", l.address, err)
+		return
+	}
+	l.logger.Infof("Listening on %s", l.address)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+
+		if !l.addConnection(conn) {
+			conn.Close()
+			break
+		}
+		go l.readFrames(conn)
+	}
+
+	l.readers.Wait()
+}
+
+func (l *TCPListener) listen() (net.Listener, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return nil, errors.New("listener stopped")
+	}
+
+	var listener net.Listener
+	var err error
+	if l.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", l.address, l.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", l.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.listener = listener
+	return listener, nil
+}
+
+func (l *TCPListener) addConnection(conn net.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return false
+	}
+	l.connections[conn] = struct{}{}
+	l.readers.Add(1)
+	return true
+}
+
+func (l *TCPListener) removeConnection(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.connections, conn)
+	conn.Close()
+}
+
+func (l *TCPListener) readFrames(conn net.Conn) {
+	defer l.readers.Done()
+	defer l.removeConnection(conn)
+
+	if _, err := conn.Write([]byte{AcceptsCompressedFrames}); err != nil {
+		l.logger.Debugf("TCPListener: Error writing to %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	var header [4]byte
+	var decompressor *gzip.Reader
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err != io.EOF {
+				l.logger.Debugf("TCPListener: Error reading from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		compressed := header[0]&FrameCompressed != 0
+		header[0] &^= FrameCompressed
+		length := binary.BigEndian.Uint32(header[:])
+		if length > MaxFrameSize {
+			atomic.AddUint64(&l.invalidFrameCount, 1)
+			l.logger.Warnf("TCPListener: Closing the connection from %s after a frame of %d bytes, more than %d", conn.RemoteAddr(), length, MaxFrameSize)
+			return
+		}
+
+		message := make([]byte, length)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			l.logger.Debugf("TCPListener: Error reading from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+
+		atomic.AddUint64(&l.receivedMessageCount, 1)
+		atomic.AddUint64(&l.receivedByteCount, uint64(length))
+
+		if compressed {
+			var err error
+			decompressor, message, err = decompress(decompressor, message)
+			if err != nil {
+				atomic.AddUint64(&l.invalidFrameCount, 1)
+				l.logger.Warnf("TCPListener: Closing the connection from %s after a compressed frame that could not be read: %s", conn.RemoteAddr(), err)
+				return
+			}
+			atomic.AddUint64(&l.compressedFrameCount, 1)
+			atomic.AddUint64(&l.decompressedByteCount, uint64(len(message)))
+		}
+		l.dataChannel <- message
+	}
+}
+
+// decompress returns the gzip compressed message decompressed, along with
+// the reader to reuse for the next message.
+func decompress(decompressor *gzip.Reader, compressed []byte) (*gzip.Reader, []byte, error) {
+	var err error
+	if decompressor == nil {
+		decompressor, err = gzip.NewReader(bytes.NewReader(compressed))
+	} else {
+		err = decompressor.Reset(bytes.NewReader(compressed))
+	}
+	if err != nil {
+		return decompressor, nil, err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(decompressor, MaxFrameSize+1))
+	if err != nil {
+		return decompressor, nil, err
+	}
+	if len(message) > MaxFrameSize {
+		return decompressor, nil, fmt.Errorf("decompressed to more than %d bytes", MaxFrameSize)
+	}
+	return decompressor, message, nil
+}
+
+// Stop closes the listener and all connections.
+func (l *TCPListener) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stopped = true
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	for conn := range l.connections {
+		conn.Close()
+	}
+}
+
+func (l *TCPListener) Emit() instrumentation.Context {
+	l.lock.Lock()
+	currentConnections := len(l.connections)
+	l.lock.Unlock()
+
+	return instrumentation.Context{
+		Name: l.contextName,
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "receivedMessageCount", Value: atomic.LoadUint64(&l.receivedMessageCount)},
+			instrumentation.Metric{Name: "receivedByteCount", Value: atomic.LoadUint64(&l.receivedByteCount)},
+			instrumentation.Metric{Name: "invalidFrameCount", Value: atomic.LoadUint64(&l.invalidFrameCount)},
+			instrumentation.Metric{Name: "compressedFrameCount", Value: atomic.LoadUint64(&l.compressedFrameCount)},
+			instrumentation.Metric{Name: "decompressedByteCount", Value: atomic.LoadUint64(&l.decompressedByteCount)},
+			instrumentation.Metric{Name: "currentConnections", Value: currentConnections},
+		},
+	}
+}
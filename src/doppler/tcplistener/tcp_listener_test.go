@@ -0,0 +1,265 @@
+package tcplistener_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"doppler/tcplistener"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const address = "127.0.0.1:52101"
+
+func frame(message []byte) []byte {
+	framed := make([]byte, 4, 4+len(message))
+	binary.BigEndian.PutUint32(framed, uint32(len(message)))
+	return append(framed, message...)
+}
+
+func compressedFrame(message []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(message)
+	writer.Close()
+
+	framed := frame(compressed.Bytes())
+	framed[0] |= tcplistener.FrameCompressed
+	return framed
+}
+
+func expectAccepted(conn net.Conn) {
+	accepted := make([]byte, 1)
+	_, err := conn.Read(accepted)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(accepted[0]).To(BeEquivalentTo(tcplistener.AcceptsCompressedFrames))
+}
+
+func clientTLSConfig(certFile, keyFile string) *tls.Config {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	Expect(err).NotTo(HaveOccurred())
+	caCert, err := ioutil.ReadFile("fixtures/ca.crt")
+	Expect(err).NotTo(HaveOccurred())
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caCert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      rootCAs,
+		ServerName:   "doppler",
+	}
+}
+
+func metricValue(listener *tcplistener.TCPListener, name string) interface{} {
+	for _, metric := range listener.Emit().Metrics {
+		if metric.Name == name {
+			return metric.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("TCPListener", func() {
+	var (
+		listener     *tcplistener.TCPListener
+		dataChannel  <-chan []byte
+		listenerDone chan struct{}
+	)
+
+	start := func(tlsConfig *tls.Config) {
+		listener, dataChannel = tcplistener.New(address, tlsConfig, loggertesthelper.Logger(), "tcpListener")
+		listenerDone = make(chan struct{})
+		go func() {
+			listener.Start()
+			close(listenerDone)
+		}()
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).ShouldNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		listener.Stop()
+		Eventually(listenerDone).Should(BeClosed())
+	})
+
+	Context("without TLS", func() {
+		BeforeEach(func() {
+			start(nil)
+		})
+
+		It("receives the framed messages", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			conn.Write(append(frame([]byte("first")), frame([]byte("second"))...))
+
+			Eventually(dataChannel).Should(Receive(Equal([]byte("first"))))
+			Eventually(dataChannel).Should(Receive(Equal([]byte("second"))))
+			Eventually(func() interface{} { return metricValue(listener, "receivedMessageCount") }).Should(BeEquivalentTo(2))
+			Expect(metricValue(listener, "receivedByteCount")).To(BeEquivalentTo(11))
+		})
+
+		It("receives a frame split across writes", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			framed := frame([]byte("split message"))
+			conn.Write(framed[:2])
+			Consistently(dataChannel).ShouldNot(Receive())
+			conn.Write(framed[2:])
+
+			Eventually(dataChannel).Should(Receive(Equal([]byte("split message"))))
+		})
+
+		It("closes connections that send a frame larger than the max frame size", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			var header [4]byte
+			binary.BigEndian.PutUint32(header[:], tcplistener.MaxFrameSize+1)
+			conn.Write(header[:])
+
+			expectAccepted(conn)
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+			Expect(metricValue(listener, "invalidFrameCount")).To(BeEquivalentTo(1))
+		})
+
+		It("tells clients that it accepts compressed frames", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			expectAccepted(conn)
+		})
+
+		It("decompresses compressed frames between uncompressed ones", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			message := bytes.Repeat([]byte("compressible "), 100)
+			frames := [][]byte{
+				frame([]byte("plain")),
+				compressedFrame(message),
+				compressedFrame([]byte("again")),
+				frame([]byte("plain again")),
+			}
+			wireBytes := 0
+			for _, framed := range frames {
+				conn.Write(framed)
+				wireBytes += len(framed) - 4
+			}
+
+			Eventually(dataChannel).Should(Receive(Equal([]byte("plain"))))
+			Eventually(dataChannel).Should(Receive(Equal(message)))
+			Eventually(dataChannel).Should(Receive(Equal([]byte("again"))))
+			Eventually(dataChannel).Should(Receive(Equal([]byte("plain again"))))
+			Eventually(func() interface{} { return metricValue(listener, "receivedMessageCount") }).Should(BeEquivalentTo(4))
+			Expect(metricValue(listener, "compressedFrameCount")).To(BeEquivalentTo(2))
+			Expect(metricValue(listener, "decompressedByteCount")).To(BeEquivalentTo(len(message) + 5))
+			Expect(metricValue(listener, "receivedByteCount")).To(BeEquivalentTo(wireBytes))
+		})
+
+		It("closes connections that send a frame that cannot be decompressed", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			framed := frame([]byte("not gzip"))
+			framed[0] |= tcplistener.FrameCompressed
+			conn.Write(framed)
+
+			expectAccepted(conn)
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+			Expect(metricValue(listener, "invalidFrameCount")).To(BeEquivalentTo(1))
+			Consistently(dataChannel).ShouldNot(Receive())
+		})
+
+		It("closes connections that send a frame larger than the max frame size once decompressed", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			conn.Write(compressedFrame(make([]byte, tcplistener.MaxFrameSize+1)))
+
+			expectAccepted(conn)
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+			Expect(metricValue(listener, "invalidFrameCount")).To(BeEquivalentTo(1))
+			Consistently(dataChannel).ShouldNot(Receive())
+		})
+
+		It("closes connections and the data channel when stopped", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Eventually(func() interface{} { return metricValue(listener, "currentConnections") }).Should(Equal(1))
+			expectAccepted(conn)
+
+			listener.Stop()
+
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+			Eventually(dataChannel).Should(BeClosed())
+		})
+	})
+
+	Context("with TLS", func() {
+		BeforeEach(func() {
+			tlsConfig, err := tcplistener.NewServerTLSConfig("fixtures/server.crt", "fixtures/server.key", "fixtures/ca.crt")
+			Expect(err).NotTo(HaveOccurred())
+			start(tlsConfig)
+		})
+
+		It("receives the framed messages from clients with a trusted certificate", func() {
+			conn, err := tls.Dial("tcp", address, clientTLSConfig("fixtures/client.crt", "fixtures/client.key"))
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			conn.Write(frame([]byte("secure message")))
+
+			Eventually(dataChannel).Should(Receive(Equal([]byte("secure message"))))
+		})
+
+		It("rejects clients with an untrusted certificate", func() {
+			conn, err := tls.Dial("tcp", address, clientTLSConfig("fixtures/untrusted-client.crt", "fixtures/untrusted-client.key"))
+			if err == nil {
+				defer conn.Close()
+				conn.Write(frame([]byte("untrusted message")))
+			}
+
+			Consistently(dataChannel).ShouldNot(Receive())
+		})
+	})
+})
+
+var _ = Describe("NewServerTLSConfig", func() {
+	It("requires a client certificate signed by the CA", func() {
+		tlsConfig, err := tcplistener.NewServerTLSConfig("fixtures/server.crt", "fixtures/server.key", "fixtures/ca.crt")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tlsConfig.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+		Expect(tlsConfig.Certificates).To(HaveLen(1))
+	})
+
+	It("returns an error for a missing CA file", func() {
+		_, err := tcplistener.NewServerTLSConfig("fixtures/server.crt", "fixtures/server.key", "fixtures/missing.crt")
+		Expect(err).To(HaveOccurred())
+	})
+})
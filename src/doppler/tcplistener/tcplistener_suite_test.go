@@ -0,0 +1,13 @@
+package tcplistener_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTcplistener(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tcplistener Suite")
+}
@@ -0,0 +1,147 @@
+package truncatingbuffer
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+const (
+	// Above this share of the memory budget buffers shrink, below
+	// growThreshold they grow.
+	shrinkThreshold = 0.9
+	growThreshold   = 0.6
+)
+
+// SizeSupervisor is a BufferSizer that adapts the size of truncating buffers
+// to memory pressure. Every sample interval it compares the heap in use with
+// the memory budget and halves the buffer size when the heap is close to the
+// budget or doubles it when there is plenty of room, always staying between
+// the minimum and maximum size.
+//
+// New buffers are created with the current size, existing buffers pick it up
+// when they next truncate.
+type SizeSupervisor struct {
+	memoryBudget     uint64
+	minSize, maxSize uint
+	sampleInterval   time.Duration
+	logger           *gosteno.Logger
+	readHeap         func() uint64
+
+	lock        sync.RWMutex
+	size        uint
+	heapBytes   uint64
+	growCount   uint64
+	shrinkCount uint64
+	stopChan    chan struct{}
+	stopOnce    sync.Once
+}
+
+func NewSizeSupervisor(memoryBudget uint64, minSize, maxSize uint, sampleInterval time.Duration, logger *gosteno.Logger) *SizeSupervisor {
+	return &SizeSupervisor{
+		memoryBudget:   memoryBudget,
+		minSize:        minSize,
+		maxSize:        maxSize,
+		sampleInterval: sampleInterval,
+		logger:         logger,
+		readHeap:       readHeapInUse,
+		size:           maxSize,
+		stopChan:       make(chan struct{}),
+	}
+}
+
+// SetHeapReader replaces the function used to measure the heap in use, which
+// reads runtime.MemStats by default.
+func (s *SizeSupervisor) SetHeapReader(readHeap func() uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readHeap = readHeap
+}
+
+func (s *SizeSupervisor) BufferSize() uint {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.size
+}
+
+func (s *SizeSupervisor) Run() {
+	ticker := time.NewTicker(s.sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			s.Sample()
+		}
+	}
+}
+
+func (s *SizeSupervisor) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+}
+
+// Sample measures the heap once and resizes the buffers if needed.
+func (s *SizeSupervisor) Sample() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.heapBytes = s.readHeap()
+	usage := float64(s.heapBytes) / float64(s.memoryBudget)
+
+	newSize := s.size
+	switch {
+	case usage > shrinkThreshold:
+		newSize = s.size / 2
+		if newSize < s.minSize {
+			newSize = s.minSize
+		}
+	case usage < growThreshold:
+		newSize = s.size * 2
+		if newSize > s.maxSize {
+			newSize = s.maxSize
+		}
+	}
+
+	if newSize == s.size {
+		return
+	}
+
+	decision := "growing"
+	if newSize < s.size {
+		decision = "shrinking"
+		s.shrinkCount++
+	} else {
+		s.growCount++
+	}
+	s.logger.Infof("SizeSupervisor: Heap at %d of %d budgeted bytes, %s sink buffers from %d to %d messages", s.heapBytes, s.memoryBudget, decision, s.size, newSize)
+	s.size = newSize
+}
+
+func (s *SizeSupervisor) Emit() instrumentation.Context {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return instrumentation.Context{
+		Name: "sinkBufferSizeSupervisor",
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "bufferSize", Value: s.size},
+			instrumentation.Metric{Name: "heapBytes", Value: s.heapBytes},
+			instrumentation.Metric{Name: "memoryBudgetBytes", Value: s.memoryBudget},
+			instrumentation.Metric{Name: "bufferGrowths", Value: s.growCount},
+			instrumentation.Metric{Name: "bufferShrinks", Value: s.shrinkCount},
+		},
+	}
+}
+
+func readHeapInUse() uint64 {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return memStats.HeapInuse
+}
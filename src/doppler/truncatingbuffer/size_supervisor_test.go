@@ -0,0 +1,151 @@
+package truncatingbuffer_test
+
+import (
+	"doppler/truncatingbuffer"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/emitter"
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SizeSupervisor", func() {
+	const memoryBudget = 1000
+
+	var (
+		supervisor *truncatingbuffer.SizeSupervisor
+		heapBytes  uint64
+	)
+
+	sampleAt := func(heap uint64) {
+		heapBytes = heap
+		supervisor.Sample()
+	}
+
+	metric := func(name string) interface{} {
+		for _, m := range supervisor.Emit().Metrics {
+			if m.Name == name {
+				return m.Value
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+		supervisor = truncatingbuffer.NewSizeSupervisor(memoryBudget, 10, 80, time.Hour, loggertesthelper.Logger())
+		supervisor.SetHeapReader(func() uint64 { return heapBytes })
+	})
+
+	It("starts with the max size", func() {
+		Expect(supervisor.BufferSize()).To(BeEquivalentTo(80))
+	})
+
+	It("halves the size down to the min size when the heap is close to the budget", func() {
+		sampleAt(950)
+		Expect(supervisor.BufferSize()).To(BeEquivalentTo(40))
+
+		sampleAt(950)
+		sampleAt(950)
+		sampleAt(950)
+		Expect(supervisor.BufferSize()).To(BeEquivalentTo(10))
+	})
+
+	It("doubles the size up to the max size when the heap is well below the budget", func() {
+		sampleAt(950)
+		sampleAt(950)
+		sampleAt(950)
+
+		sampleAt(100)
+		Expect(supervisor.BufferSize()).To(BeEquivalentTo(20))
+
+		sampleAt(100)
+		sampleAt(100)
+		sampleAt(100)
+		Expect(supervisor.BufferSize()).To(BeEquivalentTo(80))
+	})
+
+	It("keeps the size while the heap is between the thresholds", func() {
+		sampleAt(950)
+		sampleAt(750)
+
+		Expect(supervisor.BufferSize()).To(BeEquivalentTo(40))
+	})
+
+	It("logs every resize", func() {
+		sampleAt(950)
+		sampleAt(750)
+		sampleAt(100)
+
+		logs := loggertesthelper.TestLoggerSink.LogContents()
+		Expect(logs).To(ContainSubstring("Heap at 950 of 1000 budgeted bytes, shrinking sink buffers from 80 to 40 messages"))
+		Expect(logs).To(ContainSubstring("Heap at 100 of 1000 budgeted bytes, growing sink buffers from 40 to 80 messages"))
+		Expect(logs).NotTo(ContainSubstring("Heap at 750"))
+	})
+
+	It("emits its decisions as metrics", func() {
+		sampleAt(950)
+		sampleAt(950)
+		sampleAt(100)
+
+		Expect(supervisor.Emit().Name).To(Equal("sinkBufferSizeSupervisor"))
+		Expect(metric("bufferSize")).To(BeEquivalentTo(40))
+		Expect(metric("heapBytes")).To(BeEquivalentTo(100))
+		Expect(metric("memoryBudgetBytes")).To(BeEquivalentTo(memoryBudget))
+		Expect(metric("bufferShrinks")).To(BeEquivalentTo(2))
+		Expect(metric("bufferGrowths")).To(BeEquivalentTo(1))
+	})
+
+	It("does not count samples that leave the size alone", func() {
+		sampleAt(100)
+
+		Expect(metric("bufferGrowths")).To(BeEquivalentTo(0))
+		Expect(metric("bufferShrinks")).To(BeEquivalentTo(0))
+		Expect(supervisor.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "bufferSize", Value: uint(80)}))
+	})
+
+	Describe("sizing truncating buffers", func() {
+		var inMessageChan chan *events.Envelope
+
+		send := func(message string) {
+			envelope, _ := emitter.Wrap(factories.NewLogMessage(events.LogMessage_OUT, message, "appId", "App"), "origin")
+			inMessageChan <- envelope
+		}
+
+		BeforeEach(func() {
+			inMessageChan = make(chan *events.Envelope)
+			supervisor = truncatingbuffer.NewSizeSupervisor(memoryBudget, 2, 4, time.Hour, loggertesthelper.Logger())
+			supervisor.SetHeapReader(func() uint64 { return heapBytes })
+		})
+
+		AfterEach(func() {
+			close(inMessageChan)
+		})
+
+		It("creates new buffers with the current size", func() {
+			sampleAt(950)
+
+			buffer := truncatingbuffer.NewSizedTruncatingBuffer(inMessageChan, supervisor, loggertesthelper.Logger(), "dropsonde-origin")
+			Expect(cap(buffer.GetOutputChannel())).To(Equal(2))
+		})
+
+		It("resizes existing buffers only when they truncate", func() {
+			buffer := truncatingbuffer.NewSizedTruncatingBuffer(inMessageChan, supervisor, loggertesthelper.Logger(), "dropsonde-origin")
+			go buffer.Run()
+
+			sampleAt(950)
+			for i := 0; i < 4; i++ {
+				send("message")
+			}
+			Expect(cap(buffer.GetOutputChannel())).To(Equal(4))
+
+			send("one too many")
+			Eventually(func() int { return cap(buffer.GetOutputChannel()) }).Should(Equal(2))
+		})
+	})
+})
@@ -12,9 +12,24 @@ import (
 	"github.com/gogo/protobuf/proto"
 )
 
+// BufferSizer decides the capacity of a truncating buffer. It is asked when
+// the buffer is created and again every time the buffer truncates, so a
+// buffer only changes its size when its content is dropped anyway.
+type BufferSizer interface {
+	BufferSize() uint
+}
+
+// FixedSize is a BufferSizer that never changes the buffer size.
+type FixedSize uint
+
+func (s FixedSize) BufferSize() uint {
+	return uint(s)
+}
+
 type TruncatingBuffer struct {
 	inputChannel        <-chan *events.Envelope
 	outputChannel       chan *events.Envelope
+	sizer               BufferSizer
 	logger              *gosteno.Logger
 	lock                *sync.RWMutex
 	dropsondeOrigin     string
@@ -22,10 +37,15 @@ type TruncatingBuffer struct {
 }
 
 func NewTruncatingBuffer(inputChannel <-chan *events.Envelope, bufferSize uint, logger *gosteno.Logger, dropsondeOrigin string) *TruncatingBuffer {
-	outputChannel := make(chan *events.Envelope, bufferSize)
+	return NewSizedTruncatingBuffer(inputChannel, FixedSize(bufferSize), logger, dropsondeOrigin)
+}
+
+func NewSizedTruncatingBuffer(inputChannel <-chan *events.Envelope, sizer BufferSizer, logger *gosteno.Logger, dropsondeOrigin string) *TruncatingBuffer {
+	outputChannel := make(chan *events.Envelope, sizer.BufferSize())
 	return &TruncatingBuffer{
 		inputChannel:        inputChannel,
 		outputChannel:       outputChannel,
+		sizer:               sizer,
 		logger:              logger,
 		lock:                &sync.RWMutex{},
 		dropsondeOrigin:     dropsondeOrigin,
@@ -52,7 +72,7 @@ func (r *TruncatingBuffer) Run() {
 		default:
 			messageCount := len(r.outputChannel)
 			r.droppedMessageCount += int64(messageCount)
-			r.outputChannel = make(chan *events.Envelope, cap(r.outputChannel))
+			r.outputChannel = make(chan *events.Envelope, r.sizer.BufferSize())
 			appId := envelope_extensions.GetAppId(msg)
 			lm := generateLogMessage(fmt.Sprintf("Log message output too high. We've dropped %d messages", messageCount), appId)
 
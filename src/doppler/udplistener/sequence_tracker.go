@@ -0,0 +1,126 @@
+package udplistener
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// ReorderWindow is how many sequence numbers below the highest one received
+// from a peer may still arrive without being counted as missing. A number is
+// counted as missing once ReorderWindow higher numbers have arrived.
+const ReorderWindow = 64
+
+// ResetJump is how far a sequence number must fall below the highest one
+// received from a peer to be taken as the peer starting over, e.g. after
+// metron was restarted. The numbers missing at that point are not counted.
+// Numbers that fall less far but arrive after the reorder window are dropped
+// from the count, as they were already counted as missing.
+const ResetJump = 1024
+
+// SequenceTracker counts the sequence numbers missing from the datagrams of
+// every peer, which metron numbers per doppler when it is configured to.
+type SequenceTracker struct {
+	logger *gosteno.Logger
+
+	lock  sync.Mutex
+	peers map[string]*peerSequence
+}
+
+type peerSequence struct {
+	highest uint64
+	// received has bit i set if highest-i has arrived. Numbers before the
+	// first one received are taken to have arrived.
+	received uint64
+	missing  uint64
+	resets   uint64
+}
+
+func NewSequenceTracker(logger *gosteno.Logger) *SequenceTracker {
+	return &SequenceTracker{
+		logger: logger,
+		peers:  make(map[string]*peerSequence),
+	}
+}
+
+// Track records the arrival of number from peer.
+func (t *SequenceTracker) Track(peer string, number uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sequence, ok := t.peers[peer]
+	if !ok {
+		t.peers[peer] = &peerSequence{highest: number, received: ^uint64(0)}
+		return
+	}
+
+	if number > sequence.highest {
+		sequence.advance(number)
+		return
+	}
+
+	behind := sequence.highest - number
+	switch {
+	case behind >= ResetJump:
+		t.logger.Infof("SequenceTracker: Sequence of %s started over at %d after %d", peer, number, sequence.highest)
+		sequence.highest = number
+		sequence.received = ^uint64(0)
+		sequence.resets++
+	case behind < ReorderWindow:
+		sequence.received |= 1 << behind
+	}
+}
+
+// advance moves the window up to number, counting the numbers that leave it
+// without having arrived.
+func (s *peerSequence) advance(number uint64) {
+	shift := number - s.highest
+	if shift >= ReorderWindow {
+		s.missing += uint64(ReorderWindow-countArrived(s.received)) + shift - ReorderWindow
+		s.received = 1
+	} else {
+		leaving := s.received >> (ReorderWindow - shift)
+		s.missing += shift - uint64(countArrived(leaving))
+		s.received = s.received<<shift | 1
+	}
+	s.highest = number
+}
+
+func countArrived(received uint64) int {
+	count := 0
+	for ; received != 0; received &= received - 1 {
+		count++
+	}
+	return count
+}
+
+// Missing returns how many sequence numbers of peer have not arrived.
+func (t *SequenceTracker) Missing(peer string) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if sequence, ok := t.peers[peer]; ok {
+		return sequence.missing
+	}
+	return 0
+}
+
+// Emit reports the missing sequence numbers and the sequence resets of every
+// peer, tagged with the peer's address.
+func (t *SequenceTracker) Emit() instrumentation.Context {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var metrics []instrumentation.Metric
+	for peer, sequence := range t.peers {
+		tags := map[string]interface{}{"peer": peer}
+		metrics = append(metrics, instrumentation.Metric{Name: "missingSequenceNumbers", Value: sequence.missing, Tags: tags})
+		metrics = append(metrics, instrumentation.Metric{Name: "sequenceResets", Value: sequence.resets, Tags: tags})
+	}
+
+	return instrumentation.Context{
+		Name:    "udp",
+		Metrics: metrics,
+	}
+}
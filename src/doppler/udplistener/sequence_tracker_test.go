@@ -0,0 +1,127 @@
+package udplistener_test
+
+import (
+	"doppler/udplistener"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SequenceTracker", func() {
+	var tracker *udplistener.SequenceTracker
+
+	track := func(peer string, numbers ...uint64) {
+		for _, number := range numbers {
+			tracker.Track(peer, number)
+		}
+	}
+
+	// pushOut moves the reorder window past number.
+	pushOut := func(peer string, number uint64) {
+		for i := uint64(1); i <= udplistener.ReorderWindow; i++ {
+			tracker.Track(peer, number+i)
+		}
+	}
+
+	BeforeEach(func() {
+		tracker = udplistener.NewSequenceTracker(loggertesthelper.Logger())
+	})
+
+	It("counts nothing for consecutive numbers", func() {
+		for i := uint64(1); i <= 1000; i++ {
+			tracker.Track("10.0.0.1", i)
+		}
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeZero())
+	})
+
+	It("does not count the numbers before the first one received", func() {
+		track("10.0.0.1", 500, 501)
+		pushOut("10.0.0.1", 501)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeZero())
+	})
+
+	It("counts a gap once it leaves the reorder window", func() {
+		track("10.0.0.1", 1, 2, 5)
+		Expect(tracker.Missing("10.0.0.1")).To(BeZero())
+
+		pushOut("10.0.0.1", 5)
+		Expect(tracker.Missing("10.0.0.1")).To(BeEquivalentTo(2))
+	})
+
+	It("counts a gap larger than the reorder window", func() {
+		track("10.0.0.1", 1, 1001)
+		pushOut("10.0.0.1", 1001)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeEquivalentTo(999))
+	})
+
+	It("does not count numbers arriving out of order within the reorder window", func() {
+		track("10.0.0.1", 1, 3, 2, 6, 5, 4)
+		track("10.0.0.1", 7, 70, 8)
+		for i := uint64(9); i < 70; i++ {
+			tracker.Track("10.0.0.1", i)
+		}
+		pushOut("10.0.0.1", 70)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeZero())
+	})
+
+	It("counts numbers arriving after the reorder window as missing", func() {
+		track("10.0.0.1", 1, 3)
+		pushOut("10.0.0.1", 3)
+		track("10.0.0.1", 2)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeEquivalentTo(1))
+	})
+
+	It("does not count duplicates", func() {
+		track("10.0.0.1", 1, 2, 2, 3, 1)
+		pushOut("10.0.0.1", 3)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeZero())
+	})
+
+	It("starts over without counting loss after a large backwards jump", func() {
+		for i := uint64(1); i <= 5000; i++ {
+			tracker.Track("10.0.0.1", i)
+		}
+		track("10.0.0.1", 1, 2, 3, 10)
+		pushOut("10.0.0.1", 10)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeEquivalentTo(6))
+	})
+
+	It("tracks every peer on its own", func() {
+		track("10.0.0.1", 1, 2, 3)
+		track("10.0.0.2", 1, 3)
+		pushOut("10.0.0.1", 3)
+		pushOut("10.0.0.2", 3)
+
+		Expect(tracker.Missing("10.0.0.1")).To(BeZero())
+		Expect(tracker.Missing("10.0.0.2")).To(BeEquivalentTo(1))
+	})
+
+	It("emits the missing numbers and resets per peer", func() {
+		track("10.0.0.1", 5000, 2)
+		track("10.0.0.2", 1, 3)
+		pushOut("10.0.0.2", 3)
+
+		context := tracker.Emit()
+		Expect(context.Name).To(Equal("udp"))
+
+		values := map[string]interface{}{}
+		for _, metric := range context.Metrics {
+			values[metric.Name+" "+metric.Tags["peer"].(string)] = metric.Value
+		}
+		Expect(values).To(Equal(map[string]interface{}{
+			"missingSequenceNumbers 10.0.0.1": uint64(0),
+			"sequenceResets 10.0.0.1":         uint64(1),
+			"missingSequenceNumbers 10.0.0.2": uint64(1),
+			"sequenceResets 10.0.0.2":         uint64(0),
+		}))
+	})
+})
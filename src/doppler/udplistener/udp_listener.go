@@ -0,0 +1,132 @@
+package udplistener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// SequenceMarker starts the sequence header metron puts in front of a signed
+// datagram when it numbers its datagrams to doppler.
+var SequenceMarker = []byte{0xff, 'S', 'E', 'Q'}
+
+// SequenceHeaderLength is the length of the sequence header: the
+// SequenceMarker followed by the sequence number as a big endian uint64.
+const SequenceHeaderLength = 12
+
+// UDPListener receives datagrams from metrons. It strips the sequence header
+// from numbered datagrams and has the tracker count the numbers missing per
+// metron. Datagrams without a header are passed on unchanged.
+type UDPListener struct {
+	address     string
+	contextName string
+	tracker     *SequenceTracker
+	logger      *gosteno.Logger
+	dataChannel chan []byte
+
+	lock       sync.Mutex
+	connection net.PacketConn
+	stopped    bool
+
+	receivedMessageCount  uint64
+	receivedByteCount     uint64
+	sequencedMessageCount uint64
+}
+
+func New(address string, tracker *SequenceTracker, logger *gosteno.Logger, contextName string) (*UDPListener, <-chan []byte) {
+	dataChannel := make(chan []byte, 1024)
+	return &UDPListener{
+		address:     address,
+		contextName: contextName,
+		tracker:     tracker,
+		logger:      logger,
+		dataChannel: dataChannel,
+	}, dataChannel
+}
+
+// Start reads datagrams until Stop is called, then closes the data channel.
+func (l *UDPListener) Start() {
+	defer close(l.dataChannel)
+
+	connection, err := l.listen()
+	if err != nil {
+		l.logger.Fatalf("Failed to listen on %s. %s", l.address, err)
+		return
+	}
+	l.logger.Infof("Listening on %s", l.address)
+
+	readBuffer := make([]byte, 65535)
+	for {
+		readCount, sender, err := connection.ReadFrom(readBuffer)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&l.receivedMessageCount, 1)
+		atomic.AddUint64(&l.receivedByteCount, uint64(readCount))
+
+		datagram := readBuffer[:readCount]
+		if len(datagram) >= SequenceHeaderLength && bytes.HasPrefix(datagram, SequenceMarker) {
+			atomic.AddUint64(&l.sequencedMessageCount, 1)
+			l.tracker.Track(peerHost(sender), binary.BigEndian.Uint64(datagram[len(SequenceMarker):SequenceHeaderLength]))
+			datagram = datagram[SequenceHeaderLength:]
+		}
+
+		message := make([]byte, len(datagram))
+		copy(message, datagram)
+		l.dataChannel <- message
+	}
+}
+
+// peerHost returns the host of sender, so that a metron restarting with
+// another source port keeps its sequence.
+func peerHost(sender net.Addr) string {
+	host, _, err := net.SplitHostPort(sender.String())
+	if err != nil {
+		return sender.String()
+	}
+	return host
+}
+
+func (l *UDPListener) listen() (net.PacketConn, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return nil, errors.New("listener stopped")
+	}
+
+	connection, err := net.ListenPacket("udp", l.address)
+	if err != nil {
+		return nil, err
+	}
+	l.connection = connection
+	return connection, nil
+}
+
+// Stop closes the connection.
+func (l *UDPListener) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stopped = true
+	if l.connection != nil {
+		l.connection.Close()
+	}
+}
+
+func (l *UDPListener) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: l.contextName,
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "receivedMessageCount", Value: atomic.LoadUint64(&l.receivedMessageCount)},
+			instrumentation.Metric{Name: "receivedByteCount", Value: atomic.LoadUint64(&l.receivedByteCount)},
+			instrumentation.Metric{Name: "sequencedMessageCount", Value: atomic.LoadUint64(&l.sequencedMessageCount)},
+		},
+	}
+}
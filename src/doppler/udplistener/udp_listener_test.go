@@ -0,0 +1,98 @@
+package udplistener_test
+
+import (
+	"doppler/udplistener"
+	"encoding/binary"
+	"net"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const listenerAddress = "127.0.0.1:52130"
+
+func numbered(number uint64, message string) []byte {
+	datagram := make([]byte, udplistener.SequenceHeaderLength, udplistener.SequenceHeaderLength+len(message))
+	copy(datagram, udplistener.SequenceMarker)
+	binary.BigEndian.PutUint64(datagram[len(udplistener.SequenceMarker):], number)
+	return append(datagram, message...)
+}
+
+func listenerMetric(listener *udplistener.UDPListener, name string) interface{} {
+	for _, metric := range listener.Emit().Metrics {
+		if metric.Name == name {
+			return metric.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("UDPListener", func() {
+	var (
+		tracker    *udplistener.SequenceTracker
+		listener   *udplistener.UDPListener
+		dataChan   <-chan []byte
+		connection net.Conn
+	)
+
+	BeforeEach(func() {
+		logger := loggertesthelper.Logger()
+		tracker = udplistener.NewSequenceTracker(logger)
+		listener, dataChan = udplistener.New(listenerAddress, tracker, logger, "dropsondeListener")
+		go listener.Start()
+
+		var err error
+		connection, err = net.Dial("udp", listenerAddress)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		listener.Stop()
+		Eventually(dataChan).Should(BeClosed())
+	})
+
+	// send writes the datagram until the listener receives it, as it may not
+	// be listening yet.
+	send := func(datagram []byte) []byte {
+		var received []byte
+		Eventually(func() bool {
+			connection.Write(datagram)
+			select {
+			case received = <-dataChan:
+				return true
+			default:
+				return false
+			}
+		}).Should(BeTrue())
+		return received
+	}
+
+	It("passes datagrams without a sequence header on unchanged", func() {
+		Expect(send([]byte("message"))).To(Equal([]byte("message")))
+		Expect(tracker.Emit().Metrics).To(BeEmpty())
+		Expect(listenerMetric(listener, "sequencedMessageCount")).To(BeEquivalentTo(0))
+	})
+
+	It("strips the sequence header and tracks the numbers of the sender", func() {
+		Expect(send(numbered(1, "first"))).To(Equal([]byte("first")))
+		connection.Write(numbered(3, "third"))
+		Eventually(dataChan).Should(Receive(Equal([]byte("third"))))
+		for i := uint64(4); i <= 3+udplistener.ReorderWindow; i++ {
+			connection.Write(numbered(i, "message"))
+			Eventually(dataChan).Should(Receive())
+		}
+
+		Expect(tracker.Missing("127.0.0.1")).To(BeEquivalentTo(1))
+		Expect(listenerMetric(listener, "sequencedMessageCount")).To(BeNumerically(">=", 2+udplistener.ReorderWindow))
+	})
+
+	It("counts the datagrams and bytes it receives", func() {
+		send([]byte("message"))
+
+		Expect(listenerMetric(listener, "receivedMessageCount")).To(BeNumerically(">=", 1))
+		Expect(listenerMetric(listener, "receivedByteCount")).To(BeNumerically(">=", len("message")))
+	})
+})
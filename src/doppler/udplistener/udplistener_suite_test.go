@@ -0,0 +1,13 @@
+package udplistener_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestUdplistener(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Udplistener Suite")
+}
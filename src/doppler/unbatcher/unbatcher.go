@@ -0,0 +1,83 @@
+package unbatcher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// BatchMarker starts every batch of envelopes sent by metron. A marshalled
+// envelope never starts with it.
+const BatchMarker byte = 0x00
+
+// Unbatcher splits the batches metron sends into their envelopes. A batch is
+// the BatchMarker followed by every envelope prefixed with its length as an
+// unsigned varint. Messages that are not batches are passed on unchanged.
+type Unbatcher struct {
+	logger *gosteno.Logger
+
+	batchesReceived   uint64
+	envelopesUnpacked uint64
+	malformedBatches  uint64
+}
+
+func New(logger *gosteno.Logger) *Unbatcher {
+	return &Unbatcher{
+		logger: logger,
+	}
+}
+
+// Run splits the messages read from inputChan until it is closed.
+func (u *Unbatcher) Run(inputChan <-chan []byte, outputChan chan<- []byte) {
+	for message := range inputChan {
+		if len(message) == 0 || message[0] != BatchMarker {
+			outputChan <- message
+			continue
+		}
+
+		atomic.AddUint64(&u.batchesReceived, 1)
+		envelopes, err := split(message[1:])
+		if err != nil {
+			atomic.AddUint64(&u.malformedBatches, 1)
+			u.logger.Warnf("Unbatcher: Dropping the rest of a malformed batch: %s", err)
+		}
+
+		for _, envelope := range envelopes {
+			atomic.AddUint64(&u.envelopesUnpacked, 1)
+			outputChan <- envelope
+		}
+	}
+}
+
+func split(batch []byte) ([][]byte, error) {
+	var envelopes [][]byte
+	for len(batch) > 0 {
+		length, n := binary.Uvarint(batch)
+		if n <= 0 {
+			return envelopes, errors.New("invalid envelope length")
+		}
+		batch = batch[n:]
+
+		if length > uint64(len(batch)) {
+			return envelopes, fmt.Errorf("envelope length %d exceeds the %d remaining bytes", length, len(batch))
+		}
+		envelopes = append(envelopes, batch[:length])
+		batch = batch[length:]
+	}
+	return envelopes, nil
+}
+
+func (u *Unbatcher) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: "unbatcher",
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "batchesReceived", Value: atomic.LoadUint64(&u.batchesReceived)},
+			instrumentation.Metric{Name: "envelopesUnpacked", Value: atomic.LoadUint64(&u.envelopesUnpacked)},
+			instrumentation.Metric{Name: "malformedBatches", Value: atomic.LoadUint64(&u.malformedBatches)},
+		},
+	}
+}
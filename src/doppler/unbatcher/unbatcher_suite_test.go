@@ -0,0 +1,13 @@
+package unbatcher_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestUnbatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Unbatcher Suite")
+}
@@ -0,0 +1,68 @@
+package unbatcher_test
+
+import (
+	"doppler/unbatcher"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unbatcher", func() {
+	var (
+		inputChan  chan []byte
+		outputChan chan []byte
+		u          *unbatcher.Unbatcher
+	)
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		inputChan = make(chan []byte, 10)
+		outputChan = make(chan []byte, 10)
+		u = unbatcher.New(loggertesthelper.Logger())
+		go u.Run(inputChan, outputChan)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	It("passes single envelopes on unchanged", func() {
+		inputChan <- []byte{0x0a, 0x01, 0x02}
+
+		Eventually(outputChan).Should(Receive(Equal([]byte{0x0a, 0x01, 0x02})))
+	})
+
+	It("splits batches into their envelopes", func() {
+		inputChan <- []byte{unbatcher.BatchMarker, 0x02, 0x0a, 0x01, 0x03, 0x0a, 0x02, 0x03}
+
+		Eventually(outputChan).Should(Receive(Equal([]byte{0x0a, 0x01})))
+		Eventually(outputChan).Should(Receive(Equal([]byte{0x0a, 0x02, 0x03})))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("passes on the envelopes before the malformed part of a batch", func() {
+		inputChan <- []byte{unbatcher.BatchMarker, 0x02, 0x0a, 0x01, 0x05, 0x0a}
+
+		Eventually(outputChan).Should(Receive(Equal([]byte{0x0a, 0x01})))
+		Consistently(outputChan).ShouldNot(Receive())
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Dropping the rest of a malformed batch"))
+	})
+
+	It("emits the batches received, envelopes unpacked and malformed batches", func() {
+		inputChan <- []byte{unbatcher.BatchMarker, 0x01, 0x0a, 0x01, 0x0a}
+		inputChan <- []byte{unbatcher.BatchMarker, 0x05}
+		Eventually(outputChan).Should(Receive())
+		Eventually(outputChan).Should(Receive())
+
+		Eventually(func() uint64 { return u.Emit().Metrics[2].Value.(uint64) }).Should(BeEquivalentTo(1))
+		metrics := u.Emit().Metrics
+		Expect(metrics[0].Name).To(Equal("batchesReceived"))
+		Expect(metrics[0].Value).To(BeEquivalentTo(2))
+		Expect(metrics[1].Name).To(Equal("envelopesUnpacked"))
+		Expect(metrics[1].Value).To(BeEquivalentTo(2))
+		Expect(metrics[2].Name).To(Equal("malformedBatches"))
+	})
+})
@@ -0,0 +1,192 @@
+package websocketlistener
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/gorilla/websocket"
+)
+
+// MaxMessageSize is the largest message accepted over a websocket, the same
+// as the largest message read from a datagram or a frame.
+const MaxMessageSize = 65535
+
+// Path is the path metrons open their websockets on.
+const Path = "/ingest"
+
+// WebsocketListener receives messages from metrons over persistent
+// websockets, for networks that only let HTTP through between metron and
+// doppler. Every binary message is a message, as it would be sent in a
+// datagram. Given a TLS config, the websockets are served over TLS.
+type WebsocketListener struct {
+	address     string
+	tlsConfig   *tls.Config
+	contextName string
+	logger      *gosteno.Logger
+	dataChannel chan []byte
+	upgrader    websocket.Upgrader
+
+	lock        sync.Mutex
+	listener    net.Listener
+	connections map[*websocket.Conn]struct{}
+	stopped     bool
+	readers     sync.WaitGroup
+
+	receivedMessageCount uint64
+	receivedByteCount    uint64
+	invalidMessageCount  uint64
+}
+
+func New(address string, tlsConfig *tls.Config, logger *gosteno.Logger, contextName string) (*WebsocketListener, <-chan []byte) {
+	dataChannel := make(chan []byte, 1024)
+	return &WebsocketListener{
+		address:     address,
+		tlsConfig:   tlsConfig,
+		contextName: contextName,
+		logger:      logger,
+		dataChannel: dataChannel,
+		connections: make(map[*websocket.Conn]struct{}),
+	}, dataChannel
+}
+
+// Start accepts websockets until Stop is called. The data channel is closed
+// once all websockets are closed.
+func (l *WebsocketListener) Start() {
+	defer close(l.dataChannel)
+
+	listener, err := l.listen()
+	if err != nil {
+		l.logger.Fatalf("Failed to listen on %s. %s", l.address, err)
+		return
+	}
+	l.logger.Infof("Listening for websockets on %s", l.address)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(Path, l.serveWebsocket)
+	(&http.Server{Handler: mux}).Serve(listener)
+
+	l.readers.Wait()
+}
+
+func (l *WebsocketListener) listen() (net.Listener, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return nil, errors.New("listener stopped")
+	}
+
+	var listener net.Listener
+	var err error
+	if l.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", l.address, l.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", l.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.listener = listener
+	return listener, nil
+}
+
+func (l *WebsocketListener) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.logger.Debugf("WebsocketListener: Error upgrading the connection from %s: %s", r.RemoteAddr, err)
+		return
+	}
+
+	if !l.addConnection(conn) {
+		conn.Close()
+		return
+	}
+	l.readMessages(conn)
+}
+
+func (l *WebsocketListener) addConnection(conn *websocket.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return false
+	}
+	l.connections[conn] = struct{}{}
+	l.readers.Add(1)
+	return true
+}
+
+func (l *WebsocketListener) removeConnection(conn *websocket.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.connections, conn)
+	conn.Close()
+}
+
+func (l *WebsocketListener) readMessages(conn *websocket.Conn) {
+	defer l.readers.Done()
+	defer l.removeConnection(conn)
+
+	conn.SetReadLimit(MaxMessageSize)
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			atomic.AddUint64(&l.invalidMessageCount, 1)
+			l.logger.Warnf("WebsocketListener: Closing the websocket from %s after a message of more than %d bytes", conn.RemoteAddr(), MaxMessageSize)
+			return
+		}
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				l.logger.Debugf("WebsocketListener: Error reading from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			atomic.AddUint64(&l.invalidMessageCount, 1)
+			l.logger.Warnf("WebsocketListener: Closing the websocket from %s after a message that is not binary", conn.RemoteAddr())
+			return
+		}
+
+		atomic.AddUint64(&l.receivedMessageCount, 1)
+		atomic.AddUint64(&l.receivedByteCount, uint64(len(message)))
+		l.dataChannel <- message
+	}
+}
+
+// Stop closes the listener and all websockets.
+func (l *WebsocketListener) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stopped = true
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	for conn := range l.connections {
+		conn.Close()
+	}
+}
+
+func (l *WebsocketListener) Emit() instrumentation.Context {
+	l.lock.Lock()
+	currentConnections := len(l.connections)
+	l.lock.Unlock()
+
+	return instrumentation.Context{
+		Name: l.contextName,
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "receivedMessageCount", Value: atomic.LoadUint64(&l.receivedMessageCount)},
+			instrumentation.Metric{Name: "receivedByteCount", Value: atomic.LoadUint64(&l.receivedByteCount)},
+			instrumentation.Metric{Name: "invalidMessageCount", Value: atomic.LoadUint64(&l.invalidMessageCount)},
+			instrumentation.Metric{Name: "currentConnections", Value: currentConnections},
+		},
+	}
+}
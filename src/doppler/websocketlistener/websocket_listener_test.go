@@ -0,0 +1,167 @@
+package websocketlistener_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"doppler/tcplistener"
+	"doppler/websocketlistener"
+	"io/ioutil"
+	"net"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const address = "127.0.0.1:52102"
+
+func clientTLSConfig() *tls.Config {
+	certificate, err := tls.LoadX509KeyPair("../tcplistener/fixtures/client.crt", "../tcplistener/fixtures/client.key")
+	Expect(err).NotTo(HaveOccurred())
+	caCert, err := ioutil.ReadFile("../tcplistener/fixtures/ca.crt")
+	Expect(err).NotTo(HaveOccurred())
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caCert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      rootCAs,
+		ServerName:   "doppler",
+	}
+}
+
+func metricValue(listener *websocketlistener.WebsocketListener, name string) interface{} {
+	for _, metric := range listener.Emit().Metrics {
+		if metric.Name == name {
+			return metric.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("WebsocketListener", func() {
+	var (
+		listener     *websocketlistener.WebsocketListener
+		dataChannel  <-chan []byte
+		listenerDone chan struct{}
+	)
+
+	start := func(tlsConfig *tls.Config) {
+		listener, dataChannel = websocketlistener.New(address, tlsConfig, loggertesthelper.Logger(), "websocketListener")
+		listenerDone = make(chan struct{})
+		go func() {
+			listener.Start()
+			close(listenerDone)
+		}()
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).ShouldNot(HaveOccurred())
+	}
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+websocketlistener.Path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		return conn
+	}
+
+	AfterEach(func() {
+		listener.Stop()
+		Eventually(listenerDone).Should(BeClosed())
+	})
+
+	Context("without TLS", func() {
+		BeforeEach(func() {
+			start(nil)
+		})
+
+		It("receives every binary message as a message", func() {
+			conn := dial()
+			defer conn.Close()
+
+			conn.WriteMessage(websocket.BinaryMessage, []byte("first"))
+			conn.WriteMessage(websocket.BinaryMessage, []byte("second"))
+
+			Eventually(dataChannel).Should(Receive(Equal([]byte("first"))))
+			Eventually(dataChannel).Should(Receive(Equal([]byte("second"))))
+			Eventually(func() interface{} { return metricValue(listener, "receivedMessageCount") }).Should(BeEquivalentTo(2))
+			Expect(metricValue(listener, "receivedByteCount")).To(BeEquivalentTo(11))
+		})
+
+		It("closes websockets that send a text message", func() {
+			conn := dial()
+			defer conn.Close()
+
+			conn.WriteMessage(websocket.TextMessage, []byte("text"))
+
+			_, _, err := conn.ReadMessage()
+			Expect(err).To(HaveOccurred())
+			Expect(metricValue(listener, "invalidMessageCount")).To(BeEquivalentTo(1))
+			Consistently(dataChannel).ShouldNot(Receive())
+		})
+
+		It("closes websockets that send a message larger than the max message size", func() {
+			conn := dial()
+			defer conn.Close()
+
+			conn.WriteMessage(websocket.BinaryMessage, make([]byte, websocketlistener.MaxMessageSize+1))
+
+			_, _, err := conn.ReadMessage()
+			Expect(err).To(HaveOccurred())
+			Eventually(func() interface{} { return metricValue(listener, "invalidMessageCount") }).Should(BeEquivalentTo(1))
+			Consistently(dataChannel).ShouldNot(Receive())
+		})
+
+		It("does not accept websockets on other paths", func() {
+			_, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/other", nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("closes websockets and the data channel when stopped", func() {
+			conn := dial()
+			defer conn.Close()
+			Eventually(func() interface{} { return metricValue(listener, "currentConnections") }).Should(Equal(1))
+
+			listener.Stop()
+
+			_, _, err := conn.ReadMessage()
+			Expect(err).To(HaveOccurred())
+			Eventually(dataChannel).Should(BeClosed())
+		})
+	})
+
+	Context("with TLS", func() {
+		BeforeEach(func() {
+			tlsConfig, err := tcplistener.NewServerTLSConfig("../tcplistener/fixtures/server.crt", "../tcplistener/fixtures/server.key", "../tcplistener/fixtures/ca.crt")
+			Expect(err).NotTo(HaveOccurred())
+			start(tlsConfig)
+		})
+
+		It("receives the messages from clients with a trusted certificate", func() {
+			dialer := &websocket.Dialer{TLSClientConfig: clientTLSConfig()}
+			conn, _, err := dialer.Dial("wss://"+address+websocketlistener.Path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			conn.WriteMessage(websocket.BinaryMessage, []byte("secure message"))
+
+			Eventually(dataChannel).Should(Receive(Equal([]byte("secure message"))))
+		})
+
+		It("rejects clients without a certificate", func() {
+			dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: clientTLSConfig().RootCAs, ServerName: "doppler"}}
+			conn, _, err := dialer.Dial("wss://"+address+websocketlistener.Path, nil)
+			if err == nil {
+				defer conn.Close()
+				conn.WriteMessage(websocket.BinaryMessage, []byte("untrusted message"))
+			}
+
+			Consistently(dataChannel).ShouldNot(Receive())
+		})
+	})
+})
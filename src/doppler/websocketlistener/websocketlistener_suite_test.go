@@ -0,0 +1,13 @@
+package websocketlistener_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestWebsocketlistener(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Websocketlistener Suite")
+}
@@ -0,0 +1,103 @@
+package healthendpoint
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// Server runs a component's health endpoint: it listens on a localhost
+// address, calls sample once on Start and then once per interval, and serves
+// requests with handler. The component keeps its own report; sample and
+// handler must do their own locking.
+type Server struct {
+	address  string
+	interval time.Duration
+	sample   func()
+	handler  http.Handler
+	logger   *gosteno.Logger
+
+	lock     sync.Mutex
+	listener net.Listener
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewServer(address string, interval time.Duration, sample func(), handler http.Handler, logger *gosteno.Logger) *Server {
+	return &Server{
+		address:  address,
+		interval: interval,
+		sample:   sample,
+		handler:  handler,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		s.logger.Errorf("Health: Failed to listen on %s: %s", s.address, err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+
+	s.sample()
+	go s.sampleEveryInterval()
+
+	s.logger.Infof("Health: Listening on %s", s.address)
+	err = http.Serve(listener, s.handler)
+	s.logger.Debugf("Health: Serve ended with %v", err)
+}
+
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
+func (s *Server) sampleEveryInterval() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+// MetricsByName returns the integer metrics of context by name, so that
+// counters of any integer type can be compared between samples.
+func MetricsByName(context instrumentation.Context) map[string]int64 {
+	values := make(map[string]int64)
+	for _, metric := range context.Metrics {
+		switch value := metric.Value.(type) {
+		case int:
+			values[metric.Name] = int64(value)
+		case int64:
+			values[metric.Name] = value
+		case uint:
+			values[metric.Name] = int64(value)
+		case uint64:
+			values[metric.Name] = int64(value)
+		}
+	}
+	return values
+}
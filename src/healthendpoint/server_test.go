@@ -0,0 +1,91 @@
+package healthendpoint_test
+
+import (
+	"healthendpoint"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	const address = "127.0.0.1:9095"
+
+	var (
+		samples    int64
+		server     *healthendpoint.Server
+		serverDone chan struct{}
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt64(&samples, 0)
+		sample := func() { atomic.AddInt64(&samples, 1) }
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte("healthy"))
+		})
+
+		server = healthendpoint.NewServer(address, 50*time.Millisecond, sample, handler, loggertesthelper.Logger())
+		serverDone = make(chan struct{})
+		go func() {
+			server.Start()
+			close(serverDone)
+		}()
+		Eventually(func() error {
+			_, err := http.Get("http://" + address)
+			return err
+		}).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		Eventually(serverDone).Should(BeClosed())
+	})
+
+	It("serves requests with the handler", func() {
+		response, err := http.Get("http://" + address)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("healthy"))
+	})
+
+	It("samples on start and once per interval", func() {
+		Expect(atomic.LoadInt64(&samples)).To(BeNumerically(">=", 1))
+		Eventually(func() int64 { return atomic.LoadInt64(&samples) }).Should(BeNumerically(">=", 3))
+	})
+
+	It("stops sampling once stopped", func() {
+		server.Stop()
+		Eventually(serverDone).Should(BeClosed())
+
+		stopped := atomic.LoadInt64(&samples)
+		Consistently(func() int64 { return atomic.LoadInt64(&samples) }).Should(BeNumerically("<=", stopped+1))
+	})
+})
+
+var _ = Describe("MetricsByName", func() {
+	It("returns the integer metrics as int64 by name", func() {
+		context := instrumentation.Context{Metrics: []instrumentation.Metric{
+			{Name: "int", Value: 1},
+			{Name: "int64", Value: int64(2)},
+			{Name: "uint", Value: uint(3)},
+			{Name: "uint64", Value: uint64(4)},
+			{Name: "string", Value: "five"},
+		}}
+
+		Expect(healthendpoint.MetricsByName(context)).To(Equal(map[string]int64{
+			"int":    1,
+			"int64":  2,
+			"uint":   3,
+			"uint64": 4,
+		}))
+	})
+})
@@ -0,0 +1,79 @@
+package integration_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+	"time"
+
+	"github.com/cloudfoundry/storeadapter"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dropsonde message forwarding from the unix socket", func() {
+	var testDoppler net.PacketConn
+
+	BeforeEach(func() {
+		testDoppler, _ = net.ListenPacket("udp", "localhost:3457")
+
+		node := storeadapter.StoreNode{
+			Key:   "/healthstatus/doppler/z1/0",
+			Value: []byte("localhost"),
+		}
+
+		adapter := etcdRunner.Adapter()
+		adapter.Create(node)
+		adapter.Disconnect()
+	})
+
+	AfterEach(func() {
+		testDoppler.Close()
+	})
+
+	It("forwards hmac signed messages written to the unix socket", func(done Done) {
+		defer close(done)
+
+		expectedMessage, _ := proto.Marshal(addDefaultTags(basicHeartbeatEvent()))
+
+		mac := hmac.New(sha256.New, []byte("shared_secret"))
+		mac.Write(expectedMessage)
+		signature := mac.Sum(nil)
+
+		var metronInput net.Conn
+		Eventually(func() error {
+			var err error
+			metronInput, err = net.Dial("unixgram", "/tmp/metron-integration-dropsonde.sock")
+			return err
+		}).ShouldNot(HaveOccurred())
+		defer metronInput.Close()
+
+		stopTheWorld := make(chan struct{})
+		defer close(stopTheWorld)
+
+		go func() {
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+
+			for {
+				metronInput.Write(basicHeartbeatMessage())
+
+				select {
+				case <-stopTheWorld:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+
+		readBuffer := make([]byte, 65535)
+		readCount, _, err := testDoppler.ReadFrom(readBuffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readCount).To(BeNumerically(">", len(signature)))
+
+		Expect(readBuffer[:len(signature)]).To(Equal(signature))
+		Expect(readBuffer[len(signature):readCount]).To(Equal(expectedMessage))
+	})
+})
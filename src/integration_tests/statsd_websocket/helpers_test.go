@@ -0,0 +1,53 @@
+package statsd_websocket_test
+
+import (
+	"doppler/sinks/websocket"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// dopplerWebsocketServer stands in for doppler's websocket endpoint. Every
+// client that connects is served by a doppler WebsocketSink, in the dropsonde
+// encoding, that streams the envelopes read from the channel the server was
+// created with until that channel is closed. It is meant for a single client,
+// as clients compete for the envelopes.
+type dopplerWebsocketServer struct {
+	*httptest.Server
+	envelopes <-chan *events.Envelope
+}
+
+func newDopplerWebsocketServer(envelopes <-chan *events.Envelope) *dopplerWebsocketServer {
+	server := &dopplerWebsocketServer{envelopes: envelopes}
+	server.Server = httptest.NewServer(server)
+	return server
+}
+
+// URL returns the websocket URL of the server.
+func (s *dopplerWebsocketServer) URL() string {
+	return "ws://" + s.Listener.Addr().String()
+}
+
+func (s *dopplerWebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := gorilla.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		http.Error(w, "Not a websocket handshake", http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+
+	// Reading processes the close frame sent by the client.
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sink := websocket.NewWebsocketSink(websocket.FIREHOSE_APP_ID, loggertesthelper.Logger(), ws, 100, websocket.DropsondeEncoding, "doppler", make(chan int64, 100), make(chan int64, 100))
+	sink.Run(s.envelopes)
+}
@@ -0,0 +1,13 @@
+package statsd_websocket_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestStatsdWebsocket(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Statsd to Websocket Integration Suite")
+}
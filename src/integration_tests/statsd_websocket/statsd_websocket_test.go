@@ -0,0 +1,127 @@
+package statsd_websocket_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"time"
+	"trafficcontroller/listener"
+	"trafficcontroller/marshaller"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Statsd to websocket", func() {
+	const statsdAddress = "localhost:51182"
+
+	var (
+		statsdListener   statsdlistener.StatsdListener
+		statsdDone       chan struct{}
+		dopplerServer    *dopplerWebsocketServer
+		outputChan       chan []byte
+		stopChan         chan struct{}
+		websocketDone    chan struct{}
+		statsdConnection net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := statsdConnection.Write([]byte(statsdmsg))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	receiveEnvelope := func() *events.Envelope {
+		var message []byte
+		Eventually(outputChan).Should(Receive(&message))
+
+		envelope := &events.Envelope{}
+		Expect(proto.Unmarshal(message, envelope)).To(Succeed())
+		return envelope
+	}
+
+	receiveValueMetric := func(origin string, name string, value float64, unit string) {
+		envelope := receiveEnvelope()
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(envelope.GetOrigin()).To(Equal(origin))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal(name))
+		Expect(envelope.GetValueMetric().GetValue()).To(BeNumerically("==", value))
+		Expect(envelope.GetValueMetric().GetUnit()).To(Equal(unit))
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		envelopeChan := make(chan *events.Envelope)
+		statsdListener = statsdlistener.NewStatsdListener(statsdAddress, loggertesthelper.Logger(), "statsdAgentListener")
+		statsdDone = make(chan struct{})
+		go func() {
+			statsdListener.Run(envelopeChan)
+			close(statsdDone)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		dopplerServer = newDopplerWebsocketServer(envelopeChan)
+
+		outputChan = make(chan []byte, 10)
+		stopChan = make(chan struct{})
+		websocketDone = make(chan struct{})
+		connected := make(chan struct{})
+		converter := func(message []byte) ([]byte, error) { return message, nil }
+		websocketListener := listener.NewWebsocket(marshaller.DropsondeLogMessage, converter, 0, loggertesthelper.Logger())
+		websocketListener.OnConnect = func(time.Duration, net.Addr) { close(connected) }
+		go func() {
+			defer GinkgoRecover()
+			err := websocketListener.Start(dopplerServer.URL(), "firehose", outputChan, stopChan)
+			Expect(err).NotTo(HaveOccurred())
+			close(websocketDone)
+		}()
+		Eventually(connected).Should(BeClosed())
+
+		var err error
+		statsdConnection, err = net.Dial("udp", statsdAddress)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		statsdConnection.Close()
+		close(stopChan)
+		Eventually(websocketDone).Should(BeClosed())
+		statsdListener.CloseOutput()
+		Eventually(statsdDone).Should(BeClosed())
+		dopplerServer.Close()
+	})
+
+	It("delivers a statsd gauge as a ValueMetric envelope", func() {
+		send("fake-origin.test.gauge:42|g")
+
+		receiveValueMetric("fake-origin", "test.gauge", 42, "gauge")
+	})
+
+	It("delivers accumulated statsd counters", func() {
+		send("fake-origin.test.counter:3|c")
+		receiveValueMetric("fake-origin", "test.counter", 3, "counter")
+
+		send("fake-origin.test.counter:4|c")
+		receiveValueMetric("fake-origin", "test.counter", 7, "counter")
+	})
+
+	It("delivers every line of a packet in order", func() {
+		send("fake-origin.test.timing:12|ms\nfake-origin.test.gauge:5|g\nother-origin.test.gauge:+2|g")
+
+		receiveValueMetric("fake-origin", "test.timing", 12, "ms")
+		receiveValueMetric("fake-origin", "test.gauge", 5, "gauge")
+		receiveValueMetric("other-origin", "test.gauge", 2, "gauge")
+	})
+
+	It("stamps envelopes with the time the line was received", func() {
+		before := time.Now().UnixNano()
+		send("fake-origin.test.gauge:1|g")
+
+		envelope := receiveEnvelope()
+		Expect(envelope.GetTimestamp()).To(BeNumerically(">=", before))
+		Expect(envelope.GetTimestamp()).To(BeNumerically("<=", time.Now().UnixNano()))
+	})
+})
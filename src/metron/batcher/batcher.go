@@ -0,0 +1,150 @@
+package batcher
+
+import (
+	"encoding/binary"
+	"metron/bufferpool"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/signature"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// BatchMarker starts every batch. A marshalled envelope never starts with
+// it, as it would be a protobuf tag for the invalid field number 0, so
+// doppler can tell batches from single envelopes.
+const BatchMarker byte = 0x00
+
+// MaxDatagramSize is the largest UDP payload that can be sent over IPv4.
+const MaxDatagramSize = 65507
+
+// Batcher combines marshalled envelopes into batches that each fit into a
+// single signed datagram to doppler. A batch is the BatchMarker followed by
+// every envelope prefixed with its length as an unsigned varint. A batch is
+// sent once the next envelope would not fit into it, or once the flush
+// interval has passed since its first envelope was added. A batch of a
+// single envelope is sent as the plain envelope.
+type Batcher struct {
+	payloadBudget int
+	flushInterval time.Duration
+	pool          *bufferpool.Pool
+	logger        *gosteno.Logger
+
+	pending          []byte
+	pendingEnvelopes [][]byte
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+
+	envelopesReceived uint64
+	datagramsSent     uint64
+}
+
+// NewBatcher returns a batcher for datagrams of up to maxDatagramBytes,
+// including the signature added later on. With a maxDatagramBytes too small
+// to hold a signature and a batch, every envelope is sent on its own.
+func NewBatcher(maxDatagramBytes int, flushInterval time.Duration, logger *gosteno.Logger) *Batcher {
+	return &Batcher{
+		payloadBudget: maxDatagramBytes - signature.SIGNATURE_LENGTH,
+		flushInterval: flushInterval,
+		logger:        logger,
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// SetBufferPool makes the batcher write batches into buffers from pool and
+// return the buffers of the envelopes it batched to pool. The buffer of an
+// envelope sent on its own is handed on. It must be called before Run.
+func (b *Batcher) SetBufferPool(pool *bufferpool.Pool) {
+	b.pool = pool
+}
+
+// Run batches the envelopes read from inputChan until inputChan is closed or
+// Stop is called. The pending batch is sent before Run returns.
+func (b *Batcher) Run(inputChan <-chan []byte, outputChan chan<- []byte) {
+	var flushTimer <-chan time.Time
+	for {
+		select {
+		case envelope, ok := <-inputChan:
+			if !ok {
+				b.flush(outputChan)
+				return
+			}
+			atomic.AddUint64(&b.envelopesReceived, 1)
+
+			if len(b.pendingEnvelopes) > 0 && len(b.pending)+framedSize(envelope) > b.payloadBudget {
+				b.flush(outputChan)
+				flushTimer = nil
+			}
+			b.add(envelope)
+
+			if len(b.pending) >= b.payloadBudget {
+				b.flush(outputChan)
+				flushTimer = nil
+			} else if flushTimer == nil {
+				flushTimer = time.After(b.flushInterval)
+			}
+		case <-flushTimer:
+			flushTimer = nil
+			b.flush(outputChan)
+		case <-b.stopChan:
+			b.flush(outputChan)
+			return
+		}
+	}
+}
+
+// Stop makes Run send the pending batch and return.
+func (b *Batcher) Stop() {
+	b.stopOnce.Do(func() { close(b.stopChan) })
+}
+
+func framedSize(envelope []byte) int {
+	var lengthBuffer [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(lengthBuffer[:], uint64(len(envelope))) + len(envelope)
+}
+
+func (b *Batcher) add(envelope []byte) {
+	if len(b.pendingEnvelopes) == 0 {
+		b.pending = append(b.pending[:0], BatchMarker)
+	}
+
+	var lengthBuffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lengthBuffer[:], uint64(len(envelope)))
+	b.pending = append(b.pending, lengthBuffer[:n]...)
+	b.pending = append(b.pending, envelope...)
+	b.pendingEnvelopes = append(b.pendingEnvelopes, envelope)
+}
+
+func (b *Batcher) flush(outputChan chan<- []byte) {
+	switch len(b.pendingEnvelopes) {
+	case 0:
+		return
+	case 1:
+		outputChan <- b.pendingEnvelopes[0]
+	default:
+		batch := append(b.pool.Get(), b.pending...)
+		for i, envelope := range b.pendingEnvelopes {
+			b.pool.Put(envelope)
+			b.pendingEnvelopes[i] = nil
+		}
+		outputChan <- batch
+		b.logger.Debugf("Batcher: Sent %d envelopes in %d bytes", len(b.pendingEnvelopes), len(batch))
+	}
+
+	atomic.AddUint64(&b.datagramsSent, 1)
+	b.pendingEnvelopes[0] = nil
+	b.pendingEnvelopes = b.pendingEnvelopes[:0]
+}
+
+func (b *Batcher) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: "batcher",
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "envelopesReceived", Value: atomic.LoadUint64(&b.envelopesReceived)},
+			instrumentation.Metric{Name: "datagramsSent", Value: atomic.LoadUint64(&b.datagramsSent)},
+		},
+	}
+}
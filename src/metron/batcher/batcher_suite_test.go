@@ -0,0 +1,13 @@
+package batcher_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestBatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Batcher Suite")
+}
@@ -0,0 +1,212 @@
+package batcher_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"metron/batcher"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/signature"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// unbatch splits a datagram payload the way doppler does.
+func unbatch(payload []byte) [][]byte {
+	if len(payload) == 0 || payload[0] != batcher.BatchMarker {
+		return [][]byte{payload}
+	}
+
+	var envelopes [][]byte
+	reader := bytes.NewReader(payload[1:])
+	for reader.Len() > 0 {
+		length, err := binary.ReadUvarint(reader)
+		Expect(err).NotTo(HaveOccurred())
+		envelope := make([]byte, length)
+		_, err = reader.Read(envelope)
+		Expect(err).NotTo(HaveOccurred())
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes
+}
+
+func envelopeOfSize(size int) []byte {
+	envelope := bytes.Repeat([]byte{'e'}, size)
+	envelope[0] = 0x0a
+	return envelope
+}
+
+var _ = Describe("Batcher", func() {
+	var (
+		inputChan   chan []byte
+		outputChan  chan []byte
+		runComplete chan struct{}
+		b           *batcher.Batcher
+	)
+
+	start := func(maxDatagramBytes int, flushInterval time.Duration) {
+		b = batcher.NewBatcher(maxDatagramBytes, flushInterval, loggertesthelper.Logger())
+		go func() {
+			b.Run(inputChan, outputChan)
+			close(runComplete)
+		}()
+	}
+
+	BeforeEach(func() {
+		inputChan = make(chan []byte, 100)
+		outputChan = make(chan []byte, 100)
+		runComplete = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		b.Stop()
+		Eventually(runComplete).Should(BeClosed())
+	})
+
+	It("sends the envelopes received within the flush interval in one batch", func() {
+		start(1350, 50*time.Millisecond)
+		envelopes := [][]byte{envelopeOfSize(100), envelopeOfSize(200), envelopeOfSize(300)}
+		for _, envelope := range envelopes {
+			inputChan <- envelope
+		}
+
+		var datagram []byte
+		Eventually(outputChan).Should(Receive(&datagram))
+		Expect(datagram[0]).To(Equal(batcher.BatchMarker))
+		Expect(unbatch(datagram)).To(Equal(envelopes))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("sends a batch once the next envelope does not fit into the datagram", func() {
+		start(1350, time.Hour)
+		for i := 0; i < 5; i++ {
+			inputChan <- envelopeOfSize(400)
+		}
+
+		var datagram []byte
+		Eventually(outputChan).Should(Receive(&datagram))
+		Expect(unbatch(datagram)).To(HaveLen(3))
+		Expect(len(datagram) + signature.SIGNATURE_LENGTH).To(BeNumerically("<=", 1350))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("sends a single envelope without batch framing", func() {
+		start(1350, 10*time.Millisecond)
+		envelope := envelopeOfSize(100)
+		inputChan <- envelope
+
+		Eventually(outputChan).Should(Receive(Equal(envelope)))
+	})
+
+	It("sends envelopes larger than the datagram on their own", func() {
+		start(1350, time.Hour)
+		small, large := envelopeOfSize(100), envelopeOfSize(2000)
+		inputChan <- small
+		inputChan <- large
+
+		Eventually(outputChan).Should(Receive(Equal(small)))
+		Eventually(outputChan).Should(Receive(Equal(large)))
+	})
+
+	It("sends every envelope on its own when batching is disabled", func() {
+		start(0, time.Hour)
+		first, second := envelopeOfSize(10), envelopeOfSize(20)
+		inputChan <- first
+		inputChan <- second
+
+		Eventually(outputChan).Should(Receive(Equal(first)))
+		Eventually(outputChan).Should(Receive(Equal(second)))
+	})
+
+	It("sends the pending batch when stopped", func() {
+		start(1350, time.Hour)
+		envelopes := [][]byte{envelopeOfSize(10), envelopeOfSize(20)}
+		for _, envelope := range envelopes {
+			inputChan <- envelope
+		}
+		Eventually(inputChan).Should(BeEmpty())
+		Consistently(outputChan).ShouldNot(Receive())
+
+		b.Stop()
+
+		var datagram []byte
+		Eventually(outputChan).Should(Receive(&datagram))
+		Expect(unbatch(datagram)).To(Equal(envelopes))
+		Eventually(runComplete).Should(BeClosed())
+	})
+
+	It("sends the pending batch when the input is closed", func() {
+		start(1350, time.Hour)
+		envelopes := [][]byte{envelopeOfSize(10), envelopeOfSize(20)}
+		for _, envelope := range envelopes {
+			inputChan <- envelope
+		}
+		close(inputChan)
+
+		var datagram []byte
+		Eventually(outputChan).Should(Receive(&datagram))
+		Expect(unbatch(datagram)).To(Equal(envelopes))
+		Eventually(runComplete).Should(BeClosed())
+	})
+
+	It("emits the envelopes received and datagrams sent", func() {
+		start(1350, 10*time.Millisecond)
+		for i := 0; i < 4; i++ {
+			inputChan <- envelopeOfSize(100)
+		}
+		Eventually(outputChan).Should(Receive())
+
+		metrics := b.Emit().Metrics
+		Expect(metrics[0].Name).To(Equal("envelopesReceived"))
+		Expect(metrics[0].Value).To(BeEquivalentTo(4))
+		Expect(metrics[1].Name).To(Equal("datagramsSent"))
+		Expect(metrics[1].Value).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Batching", func() {
+	Measure("datagrams per second at a constant envelope rate", func(bench Benchmarker) {
+		// 10 envelopes of 150 bytes every millisecond, for a quarter second
+		datagramsPerSecond := func(maxDatagramBytes int) float64 {
+			input, output := make(chan []byte, 10), make(chan []byte, 100)
+			rateBatcher := batcher.NewBatcher(maxDatagramBytes, 10*time.Millisecond, loggertesthelper.Logger())
+			go func() {
+				rateBatcher.Run(input, output)
+				close(output)
+			}()
+
+			datagrams := 0
+			counted := make(chan struct{})
+			go func() {
+				for range output {
+					datagrams++
+				}
+				close(counted)
+			}()
+
+			ticker := time.NewTicker(time.Millisecond)
+			start := time.Now()
+			for i := 0; i < 250; i++ {
+				<-ticker.C
+				for j := 0; j < 10; j++ {
+					input <- envelopeOfSize(150)
+				}
+			}
+			ticker.Stop()
+			close(input)
+
+			<-counted
+			elapsed := time.Since(start)
+			return float64(datagrams) / elapsed.Seconds()
+		}
+
+		unbatched := datagramsPerSecond(0)
+		batched := datagramsPerSecond(1350)
+		bench.RecordValue("unbatched datagrams per second", unbatched)
+		bench.RecordValue("batched datagrams per second", batched)
+
+		Expect(batched).To(BeNumerically("<", unbatched/5))
+	}, 3)
+})
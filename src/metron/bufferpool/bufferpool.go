@@ -0,0 +1,49 @@
+package bufferpool
+
+import (
+	"sync"
+)
+
+// InitialCapacity is the capacity of the buffers the pool allocates. It
+// holds a signed, batched datagram of the default batch size.
+const InitialCapacity = 2048
+
+// MaxCapacity is the capacity beyond which returned buffers are left to the
+// garbage collector, so that a few large envelopes do not keep large buffers
+// alive. It holds the largest UDP datagram.
+const MaxCapacity = 65536
+
+// Pool recycles the byte slices that carry marshalled envelopes from the
+// marshaller through the batcher and the signer to the forwarder. A buffer
+// belongs to whoever holds it until it is handed on over a channel, and the
+// last holder returns it with Put once nothing refers to it anymore, which for
+// the forwarder is once the write to doppler has returned.
+//
+// A nil Pool allocates a new buffer on every Get and ignores Put, so that the
+// stages work on their own as well.
+type Pool struct {
+	pool sync.Pool
+}
+
+func New() *Pool {
+	return &Pool{}
+}
+
+// Get returns an empty buffer.
+func (p *Pool) Get() []byte {
+	if p != nil {
+		if buffer, ok := p.pool.Get().(*[]byte); ok {
+			return (*buffer)[:0]
+		}
+	}
+	return make([]byte, 0, InitialCapacity)
+}
+
+// Put returns a buffer to the pool. The caller must not use it afterwards.
+func (p *Pool) Put(buffer []byte) {
+	if p == nil || cap(buffer) > MaxCapacity {
+		return
+	}
+	buffer = buffer[:0]
+	p.pool.Put(&buffer)
+}
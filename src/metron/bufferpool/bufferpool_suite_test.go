@@ -0,0 +1,13 @@
+package bufferpool_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "BufferPool Suite")
+}
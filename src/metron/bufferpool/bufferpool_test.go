@@ -0,0 +1,51 @@
+package bufferpool_test
+
+import (
+	"bytes"
+	"metron/bufferpool"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pool", func() {
+	It("returns empty buffers that hold a default batch", func() {
+		pool := bufferpool.New()
+
+		buffer := pool.Get()
+		Expect(buffer).To(BeEmpty())
+		Expect(cap(buffer)).To(BeNumerically(">=", bufferpool.InitialCapacity))
+
+		pool.Put(append(buffer, "message"...))
+		Expect(pool.Get()).To(BeEmpty())
+	})
+
+	It("allocates buffers without a pool", func() {
+		var pool *bufferpool.Pool
+
+		buffer := pool.Get()
+		Expect(buffer).To(BeEmpty())
+		Expect(cap(buffer)).To(Equal(bufferpool.InitialCapacity))
+		pool.Put(buffer)
+	})
+
+	It("hands out every buffer to one holder at a time", func() {
+		pool := bufferpool.New()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(fill byte) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					buffer := append(pool.Get(), bytes.Repeat([]byte{fill}, 100+j)...)
+					Expect(bytes.Count(buffer, []byte{fill})).To(Equal(len(buffer)))
+					pool.Put(buffer)
+				}
+			}(byte(i))
+		}
+		wg.Wait()
+	})
+})
@@ -0,0 +1,151 @@
+package bufferpool_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"metron/batcher"
+	"metron/bufferpool"
+	"metron/dopplerforwarder"
+	"metron/marshaller"
+	"metron/signer"
+	"net"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/signature"
+	"github.com/cloudfoundry/loggregatorlib/clientpool"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	pipelineUDPPort = 52121
+	pipelineTCPPort = 52122
+)
+
+type fakeAddressList struct{}
+
+func (fakeAddressList) Run(time.Duration)      {}
+func (fakeAddressList) Stop()                  {}
+func (fakeAddressList) GetAddresses() []string { return []string{"127.0.0.1"} }
+
+// readFrames sends the payloads of the frames read from the connections
+// accepted by listener to payloads.
+func readFrames(listener net.Listener, payloads chan<- []byte) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var header [4]byte
+			for {
+				if _, err := io.ReadFull(conn, header[:]); err != nil {
+					return
+				}
+				payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					return
+				}
+				payloads <- payload
+			}
+		}()
+	}
+}
+
+// verify checks the signature of a signed datagram and returns the envelopes
+// batched in it.
+func verify(signed []byte) [][]byte {
+	Expect(len(signed)).To(BeNumerically(">", signature.SIGNATURE_LENGTH))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(signed[signature.SIGNATURE_LENGTH:])
+	Expect(hmac.Equal(mac.Sum(nil), signed[:signature.SIGNATURE_LENGTH])).To(BeTrue(), "signature mismatch")
+
+	payload := signed[signature.SIGNATURE_LENGTH:]
+	if payload[0] != batcher.BatchMarker {
+		return [][]byte{payload}
+	}
+	var envelopes [][]byte
+	for rest := payload[1:]; len(rest) > 0; {
+		length, n := binary.Uvarint(rest)
+		envelopes = append(envelopes, rest[n:n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	return envelopes
+}
+
+var _ = Describe("Pooled buffers in metron's forwarding path", func() {
+	It("are not reused before the forwarder has written them", func() {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", pipelineTCPPort))
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		payloads := make(chan []byte, 1000)
+		go readFrames(listener, payloads)
+
+		logger := loggertesthelper.Logger()
+		pool := bufferpool.New()
+
+		envelopeChan := make(chan *events.Envelope)
+		marshalledChan, batchedChan, signedChan := make(chan []byte), make(chan []byte), make(chan []byte)
+
+		messageBatcher := batcher.NewBatcher(1350, time.Millisecond, logger)
+		messageBatcher.SetBufferPool(pool)
+		udpPool := clientpool.NewLoggregatorClientPool(logger, pipelineUDPPort, fakeAddressList{})
+		forwarder := dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP, dopplerforwarder.UDP}, udpPool, fakeAddressList{}, pipelineTCPPort, 0, nil, logger)
+		forwarder.SetBufferPool(pool)
+		defer forwarder.Stop()
+
+		go func() {
+			marshaller.New(pool, logger).Run(envelopeChan, marshalledChan)
+			close(marshalledChan)
+		}()
+		go func() {
+			messageBatcher.Run(marshalledChan, batchedChan)
+			close(batchedChan)
+		}()
+		go signer.New("secret", pool).Run(batchedChan, signedChan)
+		forwarderDone := make(chan struct{})
+		go func() {
+			forwarder.Run(signedChan)
+			close(forwarderDone)
+		}()
+
+		const count = 2000
+		go func() {
+			for i := 0; i < count; i++ {
+				envelopeChan <- &events.Envelope{
+					Origin:    proto.String("origin"),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metric-%d", i)),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("count"),
+					},
+				}
+			}
+			close(envelopeChan)
+		}()
+		Eventually(forwarderDone, 5).Should(BeClosed())
+
+		received := make(map[string]float64)
+		for len(received) < count {
+			var signed []byte
+			Eventually(payloads).Should(Receive(&signed))
+			for _, marshalled := range verify(signed) {
+				var envelope events.Envelope
+				Expect(proto.Unmarshal(marshalled, &envelope)).To(Succeed())
+				received[envelope.GetValueMetric().GetName()] = envelope.GetValueMetric().GetValue()
+			}
+		}
+		for i := 0; i < count; i++ {
+			Expect(received).To(HaveKeyWithValue(fmt.Sprintf("metric-%d", i), float64(i)))
+		}
+	})
+})
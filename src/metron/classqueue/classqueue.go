@@ -0,0 +1,207 @@
+package classqueue
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// Class is the class of an envelope the queue keeps a queue for.
+type Class int
+
+const (
+	// Logs are LogMessages and Errors.
+	Logs Class = iota
+	// Metrics are the envelopes of every other type.
+	Metrics
+)
+
+var classNames = [...]string{"logs", "metrics"}
+
+func (c Class) String() string {
+	return classNames[c]
+}
+
+// ParseClass parses the name of a class, logs or metrics.
+func ParseClass(name string) (Class, error) {
+	for class, className := range classNames {
+		if name == className {
+			return Class(class), nil
+		}
+	}
+	return Logs, fmt.Errorf("Unknown envelope class '%s', must be logs or metrics", name)
+}
+
+// ClassOf returns the class of envelope.
+func ClassOf(envelope *events.Envelope) Class {
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage, events.Envelope_Error:
+		return Logs
+	default:
+		return Metrics
+	}
+}
+
+// Policy decides which class the queue passes on next while both have
+// envelopes waiting.
+type Policy int
+
+const (
+	// Weighted passes on the envelopes of the classes in proportion to their
+	// weights.
+	Weighted Policy = iota
+	// StrictPriority passes on the envelopes of the priority class first,
+	// and those of the other class only while none of the priority class
+	// are waiting.
+	StrictPriority
+)
+
+func ParsePolicy(policy string) (Policy, error) {
+	switch policy {
+	case "weighted":
+		return Weighted, nil
+	case "strict":
+		return StrictPriority, nil
+	default:
+		return Weighted, fmt.Errorf("Unknown envelope class policy '%s', must be weighted or strict", policy)
+	}
+}
+
+// ClassQueue queues the envelopes on their way to doppler by class, so that
+// while doppler cannot take them as fast as they come in, the bandwidth is
+// shared between logs and metrics by a policy rather than by who came first.
+// Each class is queued up to maxLength envelopes; beyond that its oldest
+// envelopes are dropped and counted. While downstream keeps up, envelopes are
+// passed on as they come in.
+type ClassQueue struct {
+	policy    Policy
+	weights   [2]uint64
+	priority  Class
+	maxLength int
+	logger    *gosteno.Logger
+
+	queues [2][]*events.Envelope
+	served [2]uint64
+
+	depth   [2]int64
+	sent    [2]uint64
+	dropped [2]uint64
+}
+
+// New returns a queue of up to maxLength envelopes per class that shares the
+// bandwidth by policy, with equal weights and logs as the priority class.
+func New(policy Policy, maxLength int, logger *gosteno.Logger) *ClassQueue {
+	return &ClassQueue{
+		policy:    policy,
+		weights:   [2]uint64{1, 1},
+		priority:  Logs,
+		maxLength: maxLength,
+		logger:    logger,
+	}
+}
+
+// SetWeights sets the relative weights of the classes for the Weighted
+// policy. Both must be positive. It must be called before Run.
+func (q *ClassQueue) SetWeights(logs int, metrics int) {
+	q.weights = [2]uint64{uint64(logs), uint64(metrics)}
+}
+
+// SetPriority sets the class the StrictPriority policy passes on first. It
+// must be called before Run.
+func (q *ClassQueue) SetPriority(class Class) {
+	q.priority = class
+}
+
+// Run passes on the envelopes read from inputChan until it is closed and the
+// queued envelopes are passed on.
+func (q *ClassQueue) Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope) {
+	for {
+		class, ok := q.next()
+		if !ok {
+			if inputChan == nil {
+				return
+			}
+			envelope, ok := <-inputChan
+			if !ok {
+				return
+			}
+			q.push(envelope)
+			continue
+		}
+
+		select {
+		case outputChan <- q.queues[class][0]:
+			q.pop(class)
+		case envelope, ok := <-inputChan:
+			if !ok {
+				inputChan = nil
+				continue
+			}
+			q.push(envelope)
+		}
+	}
+}
+
+// next returns the class whose oldest envelope is to be passed on next, or
+// false if both queues are empty.
+func (q *ClassQueue) next() (Class, bool) {
+	logs, metrics := len(q.queues[Logs]) > 0, len(q.queues[Metrics]) > 0
+	switch {
+	case !logs && !metrics:
+		return Logs, false
+	case !metrics:
+		q.served = [2]uint64{}
+		return Logs, true
+	case !logs:
+		q.served = [2]uint64{}
+		return Metrics, true
+	case q.policy == StrictPriority:
+		return q.priority, true
+	}
+
+	// the class that got the smaller share of its weight since both queues
+	// had envelopes waiting
+	if q.served[Logs]*q.weights[Metrics] <= q.served[Metrics]*q.weights[Logs] {
+		return Logs, true
+	}
+	return Metrics, true
+}
+
+func (q *ClassQueue) push(envelope *events.Envelope) {
+	class := ClassOf(envelope)
+	if len(q.queues[class]) >= q.maxLength {
+		q.queues[class][0] = nil
+		q.queues[class] = q.queues[class][1:]
+		atomic.AddUint64(&q.dropped[class], 1)
+		atomic.AddInt64(&q.depth[class], -1)
+		q.logger.Debugf("ClassQueue: Dropped the oldest queued %s envelope, the queue is full", class)
+	}
+	q.queues[class] = append(q.queues[class], envelope)
+	atomic.AddInt64(&q.depth[class], 1)
+}
+
+func (q *ClassQueue) pop(class Class) {
+	q.queues[class][0] = nil
+	q.queues[class] = q.queues[class][1:]
+	q.served[class]++
+	atomic.AddUint64(&q.sent[class], 1)
+	atomic.AddInt64(&q.depth[class], -1)
+}
+
+func (q *ClassQueue) Emit() instrumentation.Context {
+	var metrics []instrumentation.Metric
+	for _, class := range []Class{Logs, Metrics} {
+		metrics = append(metrics,
+			instrumentation.Metric{Name: class.String() + "Depth", Value: atomic.LoadInt64(&q.depth[class])},
+			instrumentation.Metric{Name: class.String() + "Sent", Value: atomic.LoadUint64(&q.sent[class])},
+			instrumentation.Metric{Name: class.String() + "Dropped", Value: atomic.LoadUint64(&q.dropped[class])},
+		)
+	}
+	return instrumentation.Context{
+		Name:    "classQueue",
+		Metrics: metrics,
+	}
+}
@@ -0,0 +1,13 @@
+package classqueue_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestClassQueue(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ClassQueue Suite")
+}
@@ -0,0 +1,211 @@
+package classqueue_test
+
+import (
+	"metron/classqueue"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func envelope(eventType events.Envelope_EventType, index int) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("origin"),
+		EventType: eventType.Enum(),
+		Timestamp: proto.Int64(int64(index)),
+	}
+}
+
+func metricValue(queue *classqueue.ClassQueue, name string) interface{} {
+	for _, metric := range queue.Emit().Metrics {
+		if metric.Name == name {
+			return metric.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("ClassQueue", func() {
+	var (
+		queue      *classqueue.ClassQueue
+		inputChan  chan *events.Envelope
+		outputChan chan *events.Envelope
+		done       chan struct{}
+		stopChan   chan struct{}
+		saturated  chan struct{}
+		closed     bool
+	)
+
+	run := func(policy classqueue.Policy, maxLength int, configure func()) {
+		queue = classqueue.New(policy, maxLength, loggertesthelper.Logger())
+		configure()
+		inputChan = make(chan *events.Envelope)
+		outputChan = make(chan *events.Envelope)
+		done = make(chan struct{})
+		stopChan = make(chan struct{})
+		saturated = nil
+		closed = false
+		go func() {
+			queue.Run(inputChan, outputChan)
+			close(done)
+		}()
+	}
+
+	// saturate keeps sending logs and metrics in turns until stopped.
+	saturate := func() {
+		saturated = make(chan struct{})
+		go func() {
+			defer close(saturated)
+			for i := 0; ; i++ {
+				eventType := events.Envelope_LogMessage
+				if i%2 == 1 {
+					eventType = events.Envelope_ValueMetric
+				}
+				select {
+				case inputChan <- envelope(eventType, i):
+				case <-stopChan:
+					return
+				}
+			}
+		}()
+	}
+
+	// slowDoppler takes count envelopes, one every millisecond, and returns
+	// how many of them were logs.
+	slowDoppler := func(count int) int {
+		logs := 0
+		for i := 0; i < count; i++ {
+			time.Sleep(time.Millisecond)
+			var e *events.Envelope
+			Eventually(outputChan).Should(Receive(&e))
+			if classqueue.ClassOf(e) == classqueue.Logs {
+				logs++
+			}
+		}
+		return logs
+	}
+
+	// drain takes the envelopes left until Run returns.
+	drain := func() {
+		for {
+			select {
+			case <-outputChan:
+			case <-done:
+				return
+			}
+		}
+	}
+
+	AfterEach(func() {
+		close(stopChan)
+		if saturated != nil {
+			<-saturated
+		}
+		if !closed {
+			close(inputChan)
+		}
+		drain()
+	})
+
+	It("gives the bandwidth to logs under strict priority for logs", func() {
+		run(classqueue.StrictPriority, 100, func() { queue.SetPriority(classqueue.Logs) })
+		saturate()
+
+		slowDoppler(20)
+		Expect(slowDoppler(100)).To(Equal(100))
+		Expect(metricValue(queue, "metricsDropped")).To(BeNumerically(">", 0))
+	})
+
+	It("gives the bandwidth to metrics under strict priority for metrics", func() {
+		run(classqueue.StrictPriority, 100, func() { queue.SetPriority(classqueue.Metrics) })
+		saturate()
+
+		slowDoppler(20)
+		Expect(slowDoppler(100)).To(Equal(0))
+		Expect(metricValue(queue, "logsDropped")).To(BeNumerically(">", 0))
+	})
+
+	It("shares the bandwidth by the weights of the classes", func() {
+		run(classqueue.Weighted, 100, func() { queue.SetWeights(3, 1) })
+		saturate()
+
+		slowDoppler(20)
+		Expect(slowDoppler(100)).To(BeNumerically("~", 75, 2))
+	})
+
+	It("passes the envelopes on in the order they came in while downstream keeps up", func() {
+		run(classqueue.Weighted, 100, func() {})
+
+		for i := 0; i < 10; i++ {
+			eventType := events.Envelope_LogMessage
+			if i%3 == 0 {
+				eventType = events.Envelope_CounterEvent
+			}
+			inputChan <- envelope(eventType, i)
+			var e *events.Envelope
+			Eventually(outputChan).Should(Receive(&e))
+			Expect(e.GetTimestamp()).To(BeEquivalentTo(i))
+		}
+	})
+
+	It("drops the oldest envelopes of a full class and counts them", func() {
+		run(classqueue.Weighted, 10, func() {})
+
+		for i := 0; i < 30; i++ {
+			inputChan <- envelope(events.Envelope_Error, i)
+		}
+		inputChan <- envelope(events.Envelope_ValueMetric, 30)
+		Eventually(func() interface{} { return metricValue(queue, "metricsDepth") }).Should(BeEquivalentTo(1))
+		Expect(metricValue(queue, "logsDepth")).To(BeEquivalentTo(10))
+		Expect(metricValue(queue, "logsDropped")).To(BeEquivalentTo(20))
+		Expect(metricValue(queue, "metricsDropped")).To(BeEquivalentTo(0))
+
+		var e *events.Envelope
+		Eventually(outputChan).Should(Receive(&e))
+		Expect(e.GetTimestamp()).To(BeEquivalentTo(20))
+	})
+
+	It("passes on the queued envelopes once the input is closed", func() {
+		run(classqueue.Weighted, 10, func() {})
+
+		for i := 0; i < 5; i++ {
+			inputChan <- envelope(events.Envelope_LogMessage, i)
+		}
+		close(inputChan)
+		closed = true
+
+		for i := 0; i < 5; i++ {
+			Eventually(outputChan).Should(Receive())
+		}
+		Eventually(done).Should(BeClosed())
+		Expect(metricValue(queue, "logsSent")).To(BeEquivalentTo(5))
+	})
+})
+
+var _ = Describe("ParsePolicy", func() {
+	It("parses the policies", func() {
+		Expect(classqueue.ParsePolicy("weighted")).To(Equal(classqueue.Weighted))
+		Expect(classqueue.ParsePolicy("strict")).To(Equal(classqueue.StrictPriority))
+	})
+
+	It("returns an error for an unknown policy", func() {
+		_, err := classqueue.ParsePolicy("fifo")
+		Expect(err).To(MatchError("Unknown envelope class policy 'fifo', must be weighted or strict"))
+	})
+})
+
+var _ = Describe("ParseClass", func() {
+	It("parses the classes", func() {
+		Expect(classqueue.ParseClass("logs")).To(Equal(classqueue.Logs))
+		Expect(classqueue.ParseClass("metrics")).To(Equal(classqueue.Metrics))
+	})
+
+	It("returns an error for an unknown class", func() {
+		_, err := classqueue.ParseClass("events")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,128 @@
+package coalescer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// Clock waits for time to pass. A Coalescer uses the wall clock unless
+// SetClock replaces it.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// key identifies the ValueMetrics that replace each other: those of the same
+// origin, name and unit, tagged with the same deployment, job, index and IP.
+type key struct {
+	origin     string
+	name       string
+	unit       string
+	deployment string
+	job        string
+	index      string
+	ip         string
+}
+
+func keyOf(envelope *events.Envelope) key {
+	return key{
+		origin:     envelope.GetOrigin(),
+		name:       envelope.GetValueMetric().GetName(),
+		unit:       envelope.GetValueMetric().GetUnit(),
+		deployment: envelope.GetDeployment(),
+		job:        envelope.GetJob(),
+		index:      envelope.GetIndex(),
+		ip:         envelope.GetIp(),
+	}
+}
+
+// Coalescer holds back the ValueMetrics for a window and then passes on only
+// the newest one of every key, for emitters that send the same gauge many
+// times per second when only its latest value matters downstream. The window
+// starts with the first ValueMetric held back. Envelopes of every other type
+// are passed on as they come in.
+type Coalescer struct {
+	window time.Duration
+	clock  Clock
+	logger *gosteno.Logger
+
+	coalesced uint64
+}
+
+// New returns a coalescer holding ValueMetrics back for window.
+func New(window time.Duration, logger *gosteno.Logger) *Coalescer {
+	return &Coalescer{
+		window: window,
+		clock:  wallClock{},
+		logger: logger,
+	}
+}
+
+// SetClock replaces the clock the coalescer waits on for the window to
+// close. It must be called before Run.
+func (c *Coalescer) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// Run passes on the envelopes read from inputChan until it is closed. The
+// ValueMetrics held back then are passed on before Run returns. They are
+// passed on in the order their keys were first seen in the window.
+func (c *Coalescer) Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope) {
+	var pending []*events.Envelope
+	positions := make(map[key]int)
+	var windowClosed <-chan time.Time
+	for {
+		select {
+		case envelope, ok := <-inputChan:
+			if !ok {
+				for _, envelope := range pending {
+					outputChan <- envelope
+				}
+				return
+			}
+			if envelope.GetEventType() != events.Envelope_ValueMetric {
+				outputChan <- envelope
+				continue
+			}
+
+			k := keyOf(envelope)
+			if position, ok := positions[k]; ok {
+				pending[position] = envelope
+				atomic.AddUint64(&c.coalesced, 1)
+				continue
+			}
+			if len(pending) == 0 {
+				windowClosed = c.clock.After(c.window)
+			}
+			positions[k] = len(pending)
+			pending = append(pending, envelope)
+		case <-windowClosed:
+			c.logger.Debugf("Coalescer: Passing on %d ValueMetrics at the end of the window", len(pending))
+			for i, envelope := range pending {
+				outputChan <- envelope
+				pending[i] = nil
+			}
+			pending = pending[:0]
+			positions = make(map[key]int)
+			windowClosed = nil
+		}
+	}
+}
+
+func (c *Coalescer) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: "coalescer",
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "coalescedValueMetrics", Value: atomic.LoadUint64(&c.coalesced)},
+		},
+	}
+}
@@ -0,0 +1,13 @@
+package coalescer_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCoalescer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Coalescer Suite")
+}
@@ -0,0 +1,166 @@
+package coalescer_test
+
+import (
+	"metron/coalescer"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// windowClock closes the windows the coalescer waits on when told to.
+type windowClock struct {
+	lock  sync.Mutex
+	waits []chan time.Time
+}
+
+func (c *windowClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	wait := make(chan time.Time, 1)
+	c.waits = append(c.waits, wait)
+	return wait
+}
+
+func (c *windowClock) Waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.waits)
+}
+
+func (c *windowClock) CloseWindow() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.waits[0] <- time.Now()
+	c.waits = c.waits[1:]
+}
+
+var _ = Describe("Coalescer", func() {
+	var (
+		clock      *windowClock
+		c          *coalescer.Coalescer
+		inputChan  chan *events.Envelope
+		outputChan chan *events.Envelope
+		done       chan struct{}
+	)
+
+	valueMetric := func(job string, name string, value float64) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("origin"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Job:       proto.String(job),
+			Index:     proto.String("0"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(value),
+				Unit:  proto.String("unit"),
+			},
+		}
+	}
+
+	closeWindow := func() {
+		Eventually(clock.Waiting).Should(Equal(1))
+		clock.CloseWindow()
+	}
+
+	BeforeEach(func() {
+		clock = &windowClock{}
+		c = coalescer.New(time.Second, loggertesthelper.Logger())
+		c.SetClock(clock)
+
+		inputChan = make(chan *events.Envelope)
+		outputChan = make(chan *events.Envelope, 10)
+		done = make(chan struct{})
+		go func() {
+			c.Run(inputChan, outputChan)
+			close(done)
+		}()
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("passes on only the newest value of a ValueMetric once the window closes", func() {
+		inputChan <- valueMetric("job", "metric", 1)
+		inputChan <- valueMetric("job", "metric", 2)
+		inputChan <- valueMetric("job", "metric", 3)
+		Consistently(outputChan).ShouldNot(Receive())
+
+		closeWindow()
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("job", "metric", 3))))
+		Consistently(outputChan).ShouldNot(Receive())
+		Expect(c.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "coalescedValueMetrics", Value: uint64(2)}))
+	})
+
+	It("passes on the newest value of every window", func() {
+		inputChan <- valueMetric("job", "metric", 1)
+		inputChan <- valueMetric("job", "metric", 2)
+		closeWindow()
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("job", "metric", 2))))
+
+		inputChan <- valueMetric("job", "metric", 3)
+		inputChan <- valueMetric("job", "metric", 4)
+		closeWindow()
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("job", "metric", 4))))
+	})
+
+	It("keeps the ValueMetrics of different names and tags apart", func() {
+		inputChan <- valueMetric("job", "metric", 1)
+		inputChan <- valueMetric("job", "other-metric", 2)
+		inputChan <- valueMetric("other-job", "metric", 3)
+		inputChan <- valueMetric("job", "metric", 4)
+		inputChan <- valueMetric("other-job", "metric", 5)
+		closeWindow()
+
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("job", "metric", 4))))
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("job", "other-metric", 2))))
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("other-job", "metric", 5))))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("keeps ValueMetrics of different units apart", func() {
+		inputChan <- valueMetric("job", "metric", 1)
+		other := valueMetric("job", "metric", 2)
+		other.ValueMetric.Unit = proto.String("other-unit")
+		inputChan <- other
+		closeWindow()
+
+		Eventually(outputChan).Should(Receive(Equal(valueMetric("job", "metric", 1))))
+		Eventually(outputChan).Should(Receive(Equal(other)))
+	})
+
+	It("passes on the envelopes of other types right away", func() {
+		counterEvent := &events.Envelope{
+			Origin:       proto.String("origin"),
+			EventType:    events.Envelope_CounterEvent.Enum(),
+			CounterEvent: &events.CounterEvent{Name: proto.String("counter"), Delta: proto.Uint64(1)},
+		}
+		inputChan <- valueMetric("job", "metric", 1)
+		inputChan <- counterEvent
+
+		Eventually(outputChan).Should(Receive(Equal(counterEvent)))
+		Expect(clock.Waiting()).To(Equal(1))
+	})
+
+	It("passes on the ValueMetrics held back when the input is closed", func() {
+		inputChan <- valueMetric("job", "metric", 1)
+		inputChan <- valueMetric("job", "metric", 2)
+		close(inputChan)
+		Eventually(done).Should(BeClosed())
+		inputChan = make(chan *events.Envelope)
+
+		Expect(outputChan).To(Receive(Equal(valueMetric("job", "metric", 2))))
+		Expect(outputChan).NotTo(Receive())
+	})
+})
@@ -0,0 +1,58 @@
+package dopplerforwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// FrameCompressed is set in the first byte of the length header of a frame
+// whose message is gzip compressed. Messages are at most 65535 bytes long, so
+// the byte is zero for uncompressed frames.
+const FrameCompressed = 0x80
+
+// AcceptsCompressedFrames is the byte dopplers that decompress frames write
+// once a stream connection is accepted. Metron only compresses the frames on
+// connections it has read the byte from, so it keeps sending uncompressed
+// frames to dopplers that do not know about compression.
+const AcceptsCompressedFrames = 0x01
+
+// frameCompression holds the compression settings shared by the clients of a
+// stream client pool.
+type frameCompression struct {
+	minBytes int
+	// report is called with the lengths of every message compressed before
+	// and after compression.
+	report func(messageBytes int, compressedBytes int)
+}
+
+// frameCompressor gzips messages into a buffer it reuses. It is not safe for
+// concurrent use.
+type frameCompressor struct {
+	buffer bytes.Buffer
+	writer *gzip.Writer
+}
+
+// compress returns message compressed, or nil if compressing did not make it
+// smaller. The result is only valid until the next call.
+func (c *frameCompressor) compress(message []byte) []byte {
+	c.buffer.Reset()
+	if c.writer == nil {
+		// gzip is in the standard library, so doppler can read the frames
+		// without a new dependency, and at its fastest level it still
+		// shrinks log text several times.
+		c.writer, _ = gzip.NewWriterLevel(&c.buffer, gzip.BestSpeed)
+	} else {
+		c.writer.Reset(&c.buffer)
+	}
+
+	if _, err := c.writer.Write(message); err != nil {
+		return nil
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil
+	}
+	if c.buffer.Len() >= len(message) {
+		return nil
+	}
+	return c.buffer.Bytes()
+}
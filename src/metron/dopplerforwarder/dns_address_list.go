@@ -0,0 +1,161 @@
+package dopplerforwarder
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+// DNSResolver looks up the records a DNSAddressList reads its dopplers from.
+// The lookups of the net package are used unless SetResolver replaces them.
+type DNSResolver interface {
+	LookupHost(host string) ([]string, error)
+	LookupSRV(service, proto, name string) (string, []*net.SRV, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+func (netResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	return net.LookupSRV(service, proto, name)
+}
+
+// DNSAddressList keeps the addresses of the dopplers behind a DNS name, for
+// deployments that do not run etcd. The name is resolved to its A and AAAA
+// records or, with SRV records, to the targets of its SRV records. The ports
+// of the SRV records are not used, as every doppler listens on the same
+// configured ports for each transport.
+//
+// The name is resolved again every resolve interval. Clients pick up the
+// dopplers added and stop sending to the ones removed from their next send
+// on. While the name cannot be resolved, or resolves to no dopplers, the list
+// keeps the addresses it resolved last.
+type DNSAddressList struct {
+	name            string
+	srv             bool
+	resolveInterval time.Duration
+	resolver        DNSResolver
+	logger          *gosteno.Logger
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+
+	lock      sync.RWMutex
+	addresses []string
+}
+
+// NewDNSAddressList returns a list of the dopplers behind name, read from its
+// SRV records if srv is set, that is resolved every resolveInterval.
+func NewDNSAddressList(name string, srv bool, resolveInterval time.Duration, logger *gosteno.Logger) *DNSAddressList {
+	return &DNSAddressList{
+		name:            name,
+		srv:             srv,
+		resolveInterval: resolveInterval,
+		resolver:        netResolver{},
+		logger:          logger,
+		stopChan:        make(chan struct{}),
+	}
+}
+
+// SetResolver replaces the resolver the name is looked up with. It must be
+// called before Run.
+func (list *DNSAddressList) SetResolver(resolver DNSResolver) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.resolver = resolver
+}
+
+// Run resolves the name right away and then every resolve interval until
+// Stop is called. The update interval the other lists are run with is not
+// used, as DNS answers change on their own schedule.
+func (list *DNSAddressList) Run(updateInterval time.Duration) {
+	list.resolve()
+
+	ticker := time.NewTicker(list.resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			list.resolve()
+		case <-list.stopChan:
+			return
+		}
+	}
+}
+
+func (list *DNSAddressList) Stop() {
+	list.stopOnce.Do(func() { close(list.stopChan) })
+}
+
+func (list *DNSAddressList) GetAddresses() []string {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	return list.addresses
+}
+
+func (list *DNSAddressList) resolve() {
+	list.lock.RLock()
+	resolver := list.resolver
+	list.lock.RUnlock()
+
+	addresses, err := list.lookup(resolver)
+	if err != nil {
+		list.logger.Warnf("DNSAddressList: Error resolving %s, keeping the current dopplers: %s", list.name, err)
+		return
+	}
+	if len(addresses) == 0 {
+		list.logger.Warnf("DNSAddressList: %s resolved to no dopplers, keeping the current dopplers", list.name)
+		return
+	}
+	sort.Strings(addresses)
+
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if list.stopped() || reflect.DeepEqual(addresses, list.addresses) {
+		return
+	}
+	list.logger.Infof("DNSAddressList: %s resolved to the dopplers %s", list.name, strings.Join(addresses, ", "))
+	list.addresses = addresses
+}
+
+func (list *DNSAddressList) stopped() bool {
+	select {
+	case <-list.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (list *DNSAddressList) lookup(resolver DNSResolver) ([]string, error) {
+	if !list.srv {
+		return resolver.LookupHost(list.name)
+	}
+
+	_, records, err := resolver.LookupSRV("", "", list.name)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(records))
+	addresses := make([]string, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		addresses = append(addresses, target)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,150 @@
+package dopplerforwarder_test
+
+import (
+	"errors"
+	"metron/dopplerforwarder"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const dnsTestPort = 52120
+
+// fakeResolver answers with the hosts and SRV records it was last given.
+type fakeResolver struct {
+	sync.Mutex
+	hosts     []string
+	srv       []*net.SRV
+	err       error
+	lookedUp  []string
+	srvLookup int
+}
+
+func (r *fakeResolver) answer(hosts []string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.hosts = hosts
+	r.err = err
+}
+
+func (r *fakeResolver) LookupHost(host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.lookedUp = append(r.lookedUp, host)
+	return append([]string(nil), r.hosts...), r.err
+}
+
+func (r *fakeResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.lookedUp = append(r.lookedUp, name)
+	r.srvLookup++
+	return name, r.srv, r.err
+}
+
+var _ = Describe("DNSAddressList", func() {
+	var (
+		resolver *fakeResolver
+		list     *dopplerforwarder.DNSAddressList
+	)
+
+	BeforeEach(func() {
+		resolver = &fakeResolver{hosts: []string{"10.0.0.2", "10.0.0.1"}}
+	})
+
+	AfterEach(func() {
+		list.Stop()
+	})
+
+	start := func(srv bool) {
+		list = dopplerforwarder.NewDNSAddressList("dopplers.example.com", srv, 10*time.Millisecond, loggertesthelper.Logger())
+		list.SetResolver(resolver)
+		go list.Run(time.Hour)
+	}
+
+	It("resolves the name to its addresses right away", func() {
+		start(false)
+
+		Eventually(list.GetAddresses).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		resolver.Lock()
+		defer resolver.Unlock()
+		Expect(resolver.lookedUp[0]).To(Equal("dopplers.example.com"))
+	})
+
+	It("follows the changes to the answers on every resolve interval", func() {
+		start(false)
+		Eventually(list.GetAddresses).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+
+		resolver.answer([]string{"10.0.0.2", "10.0.0.3", "fd00::1"}, nil)
+		Eventually(list.GetAddresses).Should(Equal([]string{"10.0.0.2", "10.0.0.3", "fd00::1"}))
+
+		resolver.answer([]string{"10.0.0.3"}, nil)
+		Eventually(list.GetAddresses).Should(Equal([]string{"10.0.0.3"}))
+	})
+
+	It("keeps the addresses while the name cannot be resolved or has no addresses", func() {
+		start(false)
+		Eventually(list.GetAddresses).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+
+		resolver.answer(nil, errors.New("no such host"))
+		Consistently(list.GetAddresses, 100*time.Millisecond).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+
+		resolver.answer(nil, nil)
+		Consistently(list.GetAddresses, 100*time.Millisecond).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+	})
+
+	It("reads the targets of the SRV records without duplicates", func() {
+		resolver.srv = []*net.SRV{
+			{Target: "doppler-1.example.com.", Port: 3457},
+			{Target: "doppler-0.example.com.", Port: 3457},
+			{Target: "doppler-1.example.com.", Port: 3458},
+		}
+		start(true)
+
+		Eventually(list.GetAddresses).Should(Equal([]string{"doppler-0.example.com", "doppler-1.example.com"}))
+		resolver.Lock()
+		defer resolver.Unlock()
+		Expect(resolver.srvLookup).To(BeNumerically(">", 0))
+	})
+
+	It("stops resolving once stopped", func() {
+		start(false)
+		Eventually(list.GetAddresses).ShouldNot(BeEmpty())
+		list.Stop()
+
+		resolver.answer([]string{"10.0.0.9"}, nil)
+		Consistently(list.GetAddresses, 100*time.Millisecond).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+	})
+
+	It("moves the forwarder's stream traffic to the dopplers in the answers", func() {
+		first := newFakeDopplerOn("127.0.0.1", dnsTestPort, nil)
+		defer first.stop()
+		second := newFakeDopplerOn("127.0.0.2", dnsTestPort, nil)
+		defer second.stop()
+
+		resolver.answer([]string{"127.0.0.1"}, nil)
+		start(false)
+		Eventually(list.GetAddresses).Should(Equal([]string{"127.0.0.1"}))
+
+		forwarder := dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, list, dnsTestPort, 0, nil, loggertesthelper.Logger())
+		defer forwarder.Stop()
+		messageChan := make(chan []byte)
+		defer close(messageChan)
+		go forwarder.Run(messageChan)
+
+		messageChan <- []byte("to the first")
+		Eventually(first.messages).Should(Receive(Equal("to the first")))
+
+		resolver.answer([]string{"127.0.0.2"}, nil)
+		Eventually(list.GetAddresses).Should(Equal([]string{"127.0.0.2"}))
+
+		messageChan <- []byte("to the second")
+		Eventually(second.messages).Should(Receive(Equal("to the second")))
+		Consistently(first.messages).ShouldNot(Receive())
+	})
+})
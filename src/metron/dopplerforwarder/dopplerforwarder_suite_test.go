@@ -0,0 +1,13 @@
+package dopplerforwarder_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDopplerforwarder(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dopplerforwarder Suite")
+}
@@ -0,0 +1,260 @@
+package dopplerforwarder
+
+import (
+	"metron/metrics"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/servicediscovery"
+)
+
+// EjectionSampleSize is how many of the latest sends to a doppler its error
+// rate is taken over. A doppler is not ejected before that many sends to it
+// have been reported. It is read when an EjectingAddressList is created.
+var EjectionSampleSize = 20
+
+// EjectingAddressList hands out the addresses of another list, except for the
+// dopplers it ejected as the sends to them kept failing, such as a doppler
+// that accepts connections but fails every write while it is still
+// registered.
+//
+// A doppler is ejected once more than maxErrorRate of the latest
+// EjectionSampleSize sends reported with ReportSend failed. After ejectFor
+// it is handed out again as a probe until the next send to it is reported: a
+// successful send restores it, a failed one ejects it for another ejectFor.
+// The last doppler handed out is never ejected. Ejections and restorations
+// are logged and counted.
+type EjectingAddressList struct {
+	list         servicediscovery.ServerAddressList
+	maxErrorRate float64
+	ejectFor     time.Duration
+	sampleSize   int
+	logger       *gosteno.Logger
+
+	metricsRegistry *metrics.Registry
+	group           string
+	clock           Clock
+
+	lock     sync.Mutex
+	outcomes map[string]*sendOutcomes // by address
+	ejected  map[string]*ejection     // by address
+}
+
+type ejection struct {
+	at      time.Time
+	until   time.Time
+	probing bool
+}
+
+func NewEjectingAddressList(list servicediscovery.ServerAddressList, maxErrorRate float64, ejectFor time.Duration, logger *gosteno.Logger) *EjectingAddressList {
+	return &EjectingAddressList{
+		list:         list,
+		maxErrorRate: maxErrorRate,
+		ejectFor:     ejectFor,
+		sampleSize:   EjectionSampleSize,
+		logger:       logger,
+		clock:        wallClock{},
+		outcomes:     make(map[string]*sendOutcomes),
+		ejected:      make(map[string]*ejection),
+	}
+}
+
+// SetMetricsRegistry makes the list count its ejections and restorations in
+// registry. It must be called before the list is used.
+func (list *EjectingAddressList) SetMetricsRegistry(registry *metrics.Registry) {
+	list.metricsRegistry = registry
+}
+
+// SetGroup names the group of dopplers the list holds, when metron sends
+// every message to several groups. The ejections and restorations are then
+// counted under the group's name. It must be called before the list is used.
+func (list *EjectingAddressList) SetGroup(group string) {
+	list.group = group
+}
+
+// SetClock replaces the clock the ejections are timed with. It must be called
+// before the list is used.
+func (list *EjectingAddressList) SetClock(clock Clock) {
+	list.clock = clock
+}
+
+func (list *EjectingAddressList) Run(updateInterval time.Duration) {
+	list.list.Run(updateInterval)
+}
+
+func (list *EjectingAddressList) Stop() {
+	list.list.Stop()
+}
+
+// GetAddresses returns the addresses of the other list without the dopplers
+// that are ejected. Should every doppler left be ejected, as the others
+// dropped out of the other list, they are all handed out.
+func (list *EjectingAddressList) GetAddresses() []string {
+	addresses := list.list.GetAddresses()
+
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.forget(addresses)
+	if len(list.ejected) == 0 {
+		return addresses
+	}
+
+	now := list.clock.Now()
+	handedOut := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if ejection, ok := list.ejected[address]; ok && !ejection.probing {
+			if now.Before(ejection.until) {
+				continue
+			}
+			ejection.probing = true
+			list.logger.Debugf("EjectingAddressList: Probing doppler %s", address)
+		}
+		handedOut = append(handedOut, address)
+	}
+	if len(handedOut) == 0 {
+		return addresses
+	}
+	return handedOut
+}
+
+// ReportSend records whether a send to the doppler at address failed and
+// passes it on to the other list, if it takes it into account.
+func (list *EjectingAddressList) ReportSend(address string, err error) {
+	if sends, ok := list.list.(sendReporter); ok {
+		sends.ReportSend(address, err)
+	}
+	addresses := list.list.GetAddresses()
+
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	now := list.clock.Now()
+	if ejection, ok := list.ejected[address]; ok {
+		// sends that were under way when the doppler was ejected do not
+		// count as probes
+		if !ejection.probing {
+			return
+		}
+		if err == nil {
+			list.restore(address, ejection, now)
+			return
+		}
+		list.logger.Debugf("EjectingAddressList: Probe of doppler %s failed: %s", address, err)
+		ejection.until = now.Add(list.ejectFor)
+		ejection.probing = false
+		return
+	}
+
+	outcomes, ok := list.outcomes[address]
+	if !ok {
+		outcomes = newSendOutcomes(list.sampleSize)
+		list.outcomes[address] = outcomes
+	}
+	outcomes.add(err != nil)
+
+	errorRate, ok := outcomes.errorRate()
+	if !ok || errorRate <= list.maxErrorRate || !list.othersHandedOut(address, addresses) {
+		return
+	}
+	list.ejected[address] = &ejection{at: now, until: now.Add(list.ejectFor)}
+	list.logger.Warnf("EjectingAddressList: Ejecting doppler %s for %s, %.0f%% of the last %d sends to it failed", address, list.ejectFor, errorRate*100, list.sampleSize)
+	list.metricsRegistry.Increment(metrics.InGroup(metrics.DopplerEjections, list.group))
+}
+
+// CrossZone reports whether the other list hands out the addresses of
+// dopplers outside metron's zone, if it tells.
+func (list *EjectingAddressList) CrossZone() bool {
+	if zones, ok := list.list.(zoneReporter); ok {
+		return zones.CrossZone()
+	}
+	return false
+}
+
+// Loads returns the loads of the dopplers of the other list, if it knows
+// them.
+func (list *EjectingAddressList) Loads() map[string]int {
+	if loads, ok := list.list.(loadReporter); ok {
+		return loads.Loads()
+	}
+	return nil
+}
+
+// restore must be called with the lock held. The doppler starts over with no
+// sends recorded.
+func (list *EjectingAddressList) restore(address string, ejection *ejection, now time.Time) {
+	delete(list.ejected, address)
+	delete(list.outcomes, address)
+	list.logger.Infof("EjectingAddressList: Restoring doppler %s, ejected for %s", address, now.Sub(ejection.at))
+	list.metricsRegistry.Increment(metrics.InGroup(metrics.DopplerRestorations, list.group))
+}
+
+// othersHandedOut must be called with the lock held. It reports whether a
+// doppler in addresses other than address is not ejected.
+func (list *EjectingAddressList) othersHandedOut(address string, addresses []string) bool {
+	for _, other := range addresses {
+		if _, ejected := list.ejected[other]; other != address && !ejected {
+			return true
+		}
+	}
+	return false
+}
+
+// forget must be called with the lock held. It drops the sends and ejections
+// of the dopplers that are no longer in addresses.
+func (list *EjectingAddressList) forget(addresses []string) {
+	if len(list.ejected) == 0 && len(list.outcomes) <= len(addresses) {
+		return
+	}
+
+	listed := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		listed[address] = true
+	}
+	for address := range list.ejected {
+		if !listed[address] {
+			delete(list.ejected, address)
+		}
+	}
+	for address := range list.outcomes {
+		if !listed[address] {
+			delete(list.outcomes, address)
+		}
+	}
+}
+
+// sendOutcomes keeps whether each of the latest sends to a doppler failed.
+type sendOutcomes struct {
+	failed   []bool
+	next     int
+	full     bool
+	failures int
+}
+
+func newSendOutcomes(size int) *sendOutcomes {
+	return &sendOutcomes{failed: make([]bool, size)}
+}
+
+func (o *sendOutcomes) add(failed bool) {
+	if o.failed[o.next] {
+		o.failures--
+	}
+	o.failed[o.next] = failed
+	if failed {
+		o.failures++
+	}
+	o.next = (o.next + 1) % len(o.failed)
+	if o.next == 0 {
+		o.full = true
+	}
+}
+
+// errorRate returns the share of the latest sends that failed, once as many
+// sends as are kept have been added.
+func (o *sendOutcomes) errorRate() (float64, bool) {
+	if !o.full {
+		return 0, false
+	}
+	return float64(o.failures) / float64(len(o.failed)), true
+}
@@ -0,0 +1,163 @@
+package dopplerforwarder_test
+
+import (
+	"errors"
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EjectingAddressList", func() {
+	const ejectFor = 30 * time.Second
+
+	var (
+		addressList *reportingAddressList
+		registry    *metrics.Registry
+		clock       *fakeClock
+		list        *dopplerforwarder.EjectingAddressList
+	)
+
+	errWrite := errors.New("write failed")
+
+	// report reports sends to address, every failEvery-th of which failed.
+	report := func(address string, sends int, failEvery int) {
+		for i := 1; i <= sends; i++ {
+			var err error
+			if failEvery > 0 && i%failEvery == 0 {
+				err = errWrite
+			}
+			list.ReportSend(address, err)
+		}
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		addressList = &reportingAddressList{
+			fakeAddressList: fakeAddressList{addresses: []string{"10.0.0.1", "10.0.0.2"}},
+			reports:         make(chan sendReport, 1000),
+		}
+		registry = metrics.NewRegistry()
+		clock = &fakeClock{now: time.Unix(1000, 0)}
+		list = dopplerforwarder.NewEjectingAddressList(addressList, 0.5, ejectFor, loggertesthelper.Logger())
+		list.SetMetricsRegistry(registry)
+		list.SetClock(clock)
+	})
+
+	It("passes the sends on to the other list", func() {
+		list.ReportSend("10.0.0.1", errWrite)
+
+		Expect(addressList.reports).To(Receive(Equal(sendReport{address: "10.0.0.1", failed: true})))
+	})
+
+	It("keeps handing out a doppler whose error rate stays at the threshold", func() {
+		report("10.0.0.1", 100, 2)
+
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		Expect(registry.Counter(metrics.DopplerEjections)).To(BeZero())
+	})
+
+	It("does not eject a doppler before enough sends to it were reported", func() {
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize-1, 1)
+
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+	})
+
+	It("ejects a doppler once its error rate exceeds the threshold", func() {
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize, 1)
+
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+		Expect(registry.Counter(metrics.DopplerEjections)).To(BeEquivalentTo(1))
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Ejecting doppler 10.0.0.1 for 30s, 100% of the last 20 sends to it failed"))
+	})
+
+	It("takes the error rate over the latest sends only", func() {
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize, 0)
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize/2, 1)
+		Expect(list.GetAddresses()).To(HaveLen(2))
+
+		list.ReportSend("10.0.0.1", errWrite)
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+	})
+
+	It("never ejects its last doppler", func() {
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize, 1)
+		report("10.0.0.2", dopplerforwarder.EjectionSampleSize, 1)
+
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+		Expect(registry.Counter(metrics.DopplerEjections)).To(BeEquivalentTo(1))
+	})
+
+	It("hands out every doppler once the ones not ejected dropped out of the other list", func() {
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize, 1)
+		addressList.addresses = []string{"10.0.0.1"}
+
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1"}))
+	})
+
+	Context("when a doppler is ejected", func() {
+		BeforeEach(func() {
+			report("10.0.0.1", dopplerforwarder.EjectionSampleSize, 1)
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+		})
+
+		It("ignores the sends that were under way when it was ejected", func() {
+			list.ReportSend("10.0.0.1", nil)
+
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+			Expect(registry.Counter(metrics.DopplerRestorations)).To(BeZero())
+		})
+
+		It("hands it out again as a probe once the ejection has passed", func() {
+			clock.advance(ejectFor - time.Second)
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+
+			clock.advance(time.Second)
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		})
+
+		It("restores it fully once a probe succeeds", func() {
+			clock.advance(ejectFor)
+			list.GetAddresses()
+			list.ReportSend("10.0.0.1", nil)
+
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+			Expect(registry.Counter(metrics.DopplerRestorations)).To(BeEquivalentTo(1))
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Restoring doppler 10.0.0.1, ejected for 30s"))
+
+			report("10.0.0.1", dopplerforwarder.EjectionSampleSize-1, 1)
+			Expect(list.GetAddresses()).To(HaveLen(2))
+		})
+
+		It("ejects it again once a probe fails", func() {
+			clock.advance(ejectFor)
+			list.GetAddresses()
+			list.ReportSend("10.0.0.1", errWrite)
+
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+			clock.advance(ejectFor)
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+			Expect(registry.Counter(metrics.DopplerRestorations)).To(BeZero())
+		})
+
+		It("forgets it once it drops out of the other list", func() {
+			addressList.addresses = []string{"10.0.0.2"}
+			list.GetAddresses()
+			addressList.addresses = []string{"10.0.0.1", "10.0.0.2"}
+
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		})
+	})
+
+	It("counts the ejections of a group of dopplers under its name", func() {
+		list.SetGroup("archive")
+		report("10.0.0.1", dopplerforwarder.EjectionSampleSize, 1)
+
+		Expect(registry.Counter(metrics.InGroup(metrics.DopplerEjections, "archive"))).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,111 @@
+package dopplerforwarder
+
+import (
+	"metron/bufferpool"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// FanOut sends every message to each of several groups of dopplers, one
+// forwarder per group. Every forwarder reads from its own queue of
+// queueLength messages, so a group that cannot be reached or keeps up only
+// slowly does not hold up the others: once its queue is full, the messages
+// for that group are dropped and counted.
+type FanOut struct {
+	forwarders  []*Forwarder
+	queueLength int
+	pool        *bufferpool.Pool
+	logger      *gosteno.Logger
+
+	droppedMessages []uint64
+}
+
+// NewFanOut returns a FanOut sending to the groups of the given forwarders.
+// The forwarders must not be run by anything else.
+func NewFanOut(forwarders []*Forwarder, queueLength int, logger *gosteno.Logger) *FanOut {
+	return &FanOut{
+		forwarders:      forwarders,
+		queueLength:     queueLength,
+		logger:          logger,
+		droppedMessages: make([]uint64, len(forwarders)),
+	}
+}
+
+// SetBufferPool makes the fan out copy every message into a buffer from pool
+// for every group but the first, and return the buffers of the messages it
+// drops. The forwarders must use the same pool. It must be called before Run.
+func (f *FanOut) SetBufferPool(pool *bufferpool.Pool) {
+	f.pool = pool
+}
+
+// Run forwards the messages read from messageChan until it is closed, and
+// returns once every forwarder is done.
+func (f *FanOut) Run(messageChan <-chan []byte) {
+	queues := make([]chan []byte, len(f.forwarders))
+	var wg sync.WaitGroup
+	for i, forwarder := range f.forwarders {
+		queues[i] = make(chan []byte, f.queueLength)
+		wg.Add(1)
+		go func(forwarder *Forwarder, queue <-chan []byte) {
+			defer wg.Done()
+			forwarder.Run(queue)
+		}(forwarder, queues[i])
+	}
+
+	for message := range messageChan {
+		// Copy the message before handing it on, as the first forwarder
+		// returns it to the pool once it has been sent.
+		messages := make([][]byte, len(queues))
+		messages[0] = message
+		for i := 1; i < len(queues); i++ {
+			messages[i] = append(f.pool.Get(), message...)
+		}
+
+		for i, queue := range queues {
+			select {
+			case queue <- messages[i]:
+			default:
+				if atomic.AddUint64(&f.droppedMessages[i], 1) == 1 {
+					f.logger.Warnf("DopplerFanOut: Queue of %s is full, dropping messages", f.groupName(i))
+				}
+				f.pool.Put(messages[i])
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// Stop closes the stream connections of every forwarder.
+func (f *FanOut) Stop() {
+	for _, forwarder := range f.forwarders {
+		forwarder.Stop()
+	}
+}
+
+func (f *FanOut) groupName(i int) string {
+	if f.forwarders[i].group == "" {
+		return "default"
+	}
+	return f.forwarders[i].group
+}
+
+// Emit reports the messages dropped per group. The forwarders report their
+// own metrics.
+func (f *FanOut) Emit() instrumentation.Context {
+	var metrics []instrumentation.Metric
+	for i := range f.forwarders {
+		metrics = append(metrics, instrumentation.Metric{Name: f.groupName(i) + "DroppedMessages", Value: atomic.LoadUint64(&f.droppedMessages[i])})
+	}
+
+	return instrumentation.Context{
+		Name:    "dopplerFanOut",
+		Metrics: metrics,
+	}
+}
@@ -0,0 +1,127 @@
+package dopplerforwarder_test
+
+import (
+	"fmt"
+	"metron/bufferpool"
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	oldClusterPort = 52114
+	newClusterPort = 52115
+)
+
+var _ = Describe("FanOut", func() {
+	var (
+		registry    *metrics.Registry
+		pool        *bufferpool.Pool
+		messageChan chan []byte
+		fanOut      *dopplerforwarder.FanOut
+		fanOutDone  chan struct{}
+		oldCluster  *fakeDoppler
+		newCluster  *fakeDoppler
+	)
+
+	newGroupForwarder := func(group string, port int) *dopplerforwarder.Forwarder {
+		addressList := &fakeAddressList{addresses: []string{"127.0.0.1"}}
+		forwarder := dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, addressList, port, 0, nil, loggertesthelper.Logger())
+		forwarder.SetGroup(group)
+		forwarder.SetBufferPool(pool)
+		forwarder.SetMetricsRegistry(registry)
+		return forwarder
+	}
+
+	sendMessages := func(count int) {
+		for i := 0; i < count; i++ {
+			message := append(pool.Get(), fmt.Sprintf("message %d", i)...)
+			messageChan <- message
+		}
+	}
+
+	BeforeEach(func() {
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+		registry = metrics.NewRegistry()
+		pool = bufferpool.New()
+		messageChan = make(chan []byte)
+		fanOutDone = make(chan struct{})
+
+		oldCluster = newFakeDoppler(oldClusterPort, nil)
+
+		forwarders := []*dopplerforwarder.Forwarder{
+			newGroupForwarder("", oldClusterPort),
+			newGroupForwarder("new", newClusterPort),
+		}
+		fanOut = dopplerforwarder.NewFanOut(forwarders, 100, loggertesthelper.Logger())
+		fanOut.SetBufferPool(pool)
+		go func() {
+			fanOut.Run(messageChan)
+			close(fanOutDone)
+		}()
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(fanOutDone).Should(BeClosed())
+		fanOut.Stop()
+		oldCluster.stop()
+		if newCluster != nil {
+			newCluster.stop()
+			newCluster = nil
+		}
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+	})
+
+	Context("when both groups accept the messages", func() {
+		BeforeEach(func() {
+			newCluster = newFakeDoppler(newClusterPort, nil)
+		})
+
+		It("sends every message to both groups", func() {
+			sendMessages(10)
+
+			for i := 0; i < 10; i++ {
+				Eventually(oldCluster.messages).Should(Receive(Equal(fmt.Sprintf("message %d", i))))
+				Eventually(newCluster.messages).Should(Receive(Equal(fmt.Sprintf("message %d", i))))
+			}
+			Eventually(func() uint64 { return registry.Counter("dopplerForwarder.tcpSentMessages") }).Should(BeEquivalentTo(10))
+			Eventually(func() uint64 { return registry.Counter("dopplerForwarder.new.tcpSentMessages") }).Should(BeEquivalentTo(10))
+		})
+	})
+
+	Context("when one group cannot be reached", func() {
+		It("keeps sending to the other group and counts the errors of the failing one", func() {
+			sendMessages(10)
+
+			for i := 0; i < 10; i++ {
+				Eventually(oldCluster.messages).Should(Receive(Equal(fmt.Sprintf("message %d", i))))
+			}
+			Eventually(func() uint64 { return registry.Counter("dopplerForwarder.new.sendErrors") }).Should(BeEquivalentTo(10))
+			Expect(registry.Counter("dopplerForwarder.new.tcpSentMessages")).To(BeZero())
+			Expect(registry.Counter("dopplerForwarder.tcpSentMessages")).To(BeEquivalentTo(10))
+			Expect(registry.Counter("dopplerForwarder.sendErrors")).To(BeZero())
+		})
+
+		It("starts sending to it once it can be reached", func() {
+			sendMessages(1)
+			Eventually(oldCluster.messages).Should(Receive(Equal("message 0")))
+
+			newCluster = newFakeDoppler(newClusterPort, nil)
+			Eventually(func() bool {
+				sendMessages(1)
+				select {
+				case <-newCluster.messages:
+					return true
+				case <-time.After(20 * time.Millisecond):
+					return false
+				}
+			}).Should(BeTrue())
+		})
+	})
+})
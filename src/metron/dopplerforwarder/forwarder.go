@@ -0,0 +1,735 @@
+package dopplerforwarder
+
+import (
+	"crypto/tls"
+	"metron/bufferpool"
+	"metron/metrics"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/servicediscovery"
+)
+
+// RetryInterval is how often the forwarder tries to send the messages in its
+// retry buffer while they cannot be sent.
+var RetryInterval = 100 * time.Millisecond
+
+// zoneReporter is implemented by address lists, such as ZoneAddressList, that
+// know whether their dopplers are in metron's zone.
+type zoneReporter interface {
+	CrossZone() bool
+}
+
+// Forwarder sends messages to a random doppler over the first of its
+// transports that works. Over the stream transports, a message that cannot be
+// sent to one doppler is retried on another one that is not waiting to be
+// reconnected to, up to the number of send retries. A message that cannot be
+// sent over a transport falls back to the next one. A message that cannot be
+// sent at all is dropped, unless the forwarder has a retry buffer. With origin
+// ordering, messages do not overtake the buffered messages of the same
+// origins.
+type Forwarder struct {
+	transports  []Transport
+	udpPool     UDPClientPool
+	streamPools map[Transport]*streamClientPool
+	addressList servicediscovery.ServerAddressList
+	tlsConfig   *tls.Config
+	zones       zoneReporter
+	loads       loadReporter
+	sends       sendReporter
+	retryBuffer *retryBuffer
+	ordering    *originOrdering
+	shutdown    time.Duration
+	sequencer   *udpSequencer
+	pool        *bufferpool.Pool
+	registry    *metrics.Registry
+	group       string
+	logger      *gosteno.Logger
+
+	sentMessages          [4]uint64
+	fallbacks             [4]uint64
+	droppedMessages       uint64
+	sameZoneSentMessages  uint64
+	crossZoneSentMessages uint64
+	retriedMessages       uint64
+	sendRetries           uint64
+	heldBackMessages      uint64
+	abandonedEnvelopes    uint64
+	egressBytes           uint64
+	compressionBytesIn    uint64
+	compressionBytesOut   uint64
+	compressing           bool
+
+	udpErrorsLock sync.Mutex
+	udpErrors     map[string]uint64 // key is the class of the error
+	udpErrnos     map[string]uint64 // key is the errno of the unknown errors
+
+	unreachableSince int64 // unix nanoseconds, zero while dopplers are reachable
+	lastTransport    atomic.Value
+}
+
+// New returns a forwarder using the transports in the given order. The
+// stream transports connect to the dopplers in addressList on tcpPort and
+// tlsPort, and the websocket transport on the port set with
+// SetWebsocketPort. The UDP transport uses udpPool. If addressList reports whether
+// its dopplers are in metron's zone, sends are also counted by zone. If it
+// reports the loads of its dopplers, the stream transports send to less
+// loaded dopplers more often; udpPool always picks dopplers uniformly. If it
+// takes the outcome of sends into account, the outcome of every send over a
+// stream transport is reported to it, and over UDP whether the datagram was
+// written or refused, unless udpPool's clients cannot tell, as those of the
+// loggregatorlib client pool.
+func New(transports []Transport, udpPool UDPClientPool, addressList servicediscovery.ServerAddressList, tcpPort, tlsPort int, tlsConfig *tls.Config, logger *gosteno.Logger) *Forwarder {
+	streamPools := make(map[Transport]*streamClientPool)
+	for _, transport := range transports {
+		switch transport {
+		case TCP:
+			streamPools[TCP] = newStreamClientPool(tcpPort, nil, logger)
+		case TLS:
+			streamPools[TLS] = newStreamClientPool(tlsPort, tlsConfig, logger)
+		case Websocket:
+			streamPools[Websocket] = newStreamClientPool(0, nil, logger)
+			streamPools[Websocket].websocket = true
+		}
+	}
+
+	zones, _ := addressList.(zoneReporter)
+	loads, _ := addressList.(loadReporter)
+	sends, _ := addressList.(sendReporter)
+
+	forwarder := &Forwarder{
+		transports:  transports,
+		udpPool:     udpPool,
+		streamPools: streamPools,
+		addressList: addressList,
+		tlsConfig:   tlsConfig,
+		zones:       zones,
+		loads:       loads,
+		sends:       sends,
+		logger:      logger,
+		udpErrors:   make(map[string]uint64),
+		udpErrnos:   make(map[string]uint64),
+	}
+	for _, pool := range streamPools {
+		pool.written = forwarder.countEgress
+	}
+	forwarder.SetSendRetries(DefaultSendRetries, DefaultSendRetryDelay)
+	return forwarder
+}
+
+// SetWebsocketPort makes the websocket transport connect to the dopplers on
+// port, over TLS with the forwarder's TLS config if secure. The other stream
+// transports are unaffected. It must be called before Run.
+func (f *Forwarder) SetWebsocketPort(port int, secure bool) {
+	pool, ok := f.streamPools[Websocket]
+	if !ok {
+		return
+	}
+	pool.port = port
+	pool.tlsConfig = nil
+	if secure {
+		pool.tlsConfig = f.tlsConfig
+	}
+}
+
+// SetSendRetries makes the forwarder retry a message it could not send over a
+// stream transport up to maxRetries times, on a different doppler where
+// there is one, waiting around delay before each retry with some jitter.
+// Only once the retries are used up does the message fall back to the next
+// transport, the retry buffer or get dropped. A message is retried before the
+// next one is sent, so retries do not reorder messages. Sends over UDP are
+// never retried on another doppler; only a datagram that could not be written
+// as the socket buffers were full is written again, after UDPNoBufferBackoff.
+// It must be called before Run.
+func (f *Forwarder) SetSendRetries(maxRetries int, delay time.Duration) {
+	for _, pool := range f.streamPools {
+		pool.retries = &sendRetryPolicy{maxRetries: maxRetries, delay: delay, report: f.countSendRetry}
+	}
+}
+
+// SetRetryBuffer makes the forwarder queue the messages it cannot send to any
+// doppler, up to maxMessages messages and maxBytes bytes, dropping the oldest
+// ones beyond that. The queued messages are sent in order once a doppler can
+// be reached again, alongside the messages that keep coming in. It must be
+// called before Run.
+func (f *Forwarder) SetRetryBuffer(maxMessages int, maxBytes int) {
+	f.retryBuffer = newRetryBuffer(maxMessages, maxBytes, f.pool)
+	if f.ordering != nil {
+		f.retryBuffer.dropped = f.ordering.release
+	}
+}
+
+// SetShutdownTimeout makes Run, once messageChan is closed, keep retrying the
+// messages left in the retry buffer for up to timeout before it returns, so
+// that they are not lost when metron shuts down while doppler cannot be
+// reached. The envelopes of the messages still left after that are abandoned
+// and counted, see AbandonedEnvelopes. With a zero timeout, the default, they
+// are abandoned right away. It must be called before Run.
+func (f *Forwarder) SetShutdownTimeout(timeout time.Duration) {
+	f.shutdown = timeout
+}
+
+// SetOriginOrdering makes the forwarder keep the messages of every origin in
+// order while messages wait in its retry buffer. A message holding an
+// envelope of an origin that has a message waiting is queued behind it in
+// the retry buffer rather than sent, until the waiting message is sent or
+// dropped from the full retry buffer. Messages of other origins keep being
+// sent right away.
+//
+// The cost is that a single failed batch holds back every origin it
+// contains, even if later sends would have succeeded, and the messages held
+// back take up room in the retry buffer. Messages that are not signed
+// envelopes or batches of them have no origin and are never held back. It
+// has no effect without a retry buffer and must be called before Run.
+func (f *Forwarder) SetOriginOrdering(enabled bool) {
+	f.ordering = nil
+	if enabled {
+		f.ordering = newOriginOrdering()
+	}
+	if f.retryBuffer != nil {
+		f.retryBuffer.dropped = nil
+		if f.ordering != nil {
+			f.retryBuffer.dropped = f.ordering.release
+		}
+	}
+}
+
+// SetUDPSequenceNumbers makes the forwarder put a sequence header in front
+// of every datagram it sends over UDP, numbering the datagrams to every
+// doppler on their own. Dopplers that do not strip the header drop the
+// datagrams, as their signature no longer matches. It must be called before
+// Run.
+func (f *Forwarder) SetUDPSequenceNumbers(enabled bool) {
+	f.sequencer = nil
+	if enabled {
+		f.sequencer = newUDPSequencer()
+	}
+}
+
+// SetFrameCompression makes the forwarder gzip the messages of at least
+// minBytes it sends over the stream transports, to the dopplers that accept
+// compressed frames. Smaller messages, and messages compression does not
+// make smaller, are sent as they are, as are the first messages on a new
+// connection until doppler has told that it accepts compressed frames. It must
+// be called before Run.
+func (f *Forwarder) SetFrameCompression(minBytes int) {
+	f.compressing = true
+	for _, pool := range f.streamPools {
+		pool.compression = &frameCompression{minBytes: minBytes, report: f.countCompressed}
+	}
+}
+
+// SetBufferPool makes the forwarder return every message to pool once it has
+// been written to doppler or dropped, so the message must not be used by
+// anything else after it is handed to the forwarder. It must be called before
+// Run.
+func (f *Forwarder) SetBufferPool(pool *bufferpool.Pool) {
+	f.pool = pool
+	if f.retryBuffer != nil {
+		f.retryBuffer.pool = pool
+	}
+}
+
+// SetMetricsRegistry makes the forwarder count the messages it sends per
+// transport and its failed sends in registry, and keep the depth of its retry
+// buffer there. It must be called before Run.
+func (f *Forwarder) SetMetricsRegistry(registry *metrics.Registry) {
+	f.registry = registry
+}
+
+// SetGroup names the group of dopplers the forwarder sends to, when metron
+// sends every message to several groups. The forwarder's metrics are then
+// kept and emitted under the group's name. It must be called before Run.
+func (f *Forwarder) SetGroup(group string) {
+	f.group = group
+}
+
+// Run forwards the messages read from messageChan until it is closed. With a
+// retry buffer, it then sends the messages left in it before returning, see
+// SetShutdownTimeout.
+func (f *Forwarder) Run(messageChan <-chan []byte) {
+	if f.retryBuffer == nil {
+		for message := range messageChan {
+			f.send(message)
+		}
+		return
+	}
+
+	stopChan := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f.retry(stopChan)
+	}()
+
+	for message := range messageChan {
+		f.send(message)
+	}
+
+	close(stopChan)
+	wg.Wait()
+	f.flushRetryBuffer()
+}
+
+// Send sends message over the first of the transports that works, without
+// buffering it for retry, and reports whether it was sent. It is meant for the
+// last messages metron sends once Run has returned.
+func (f *Forwarder) Send(message []byte) bool {
+	for _, transport := range f.transports {
+		if err := f.sendWith(transport, message); err == nil {
+			f.countSent(transport)
+			f.pool.Put(message)
+			return true
+		}
+		f.registry.Increment(f.metricName(metrics.DopplerSendErrors))
+	}
+
+	atomic.AddUint64(&f.droppedMessages, 1)
+	f.pool.Put(message)
+	return false
+}
+
+// AbandonedEnvelopes returns the number of envelopes left in the retry buffer
+// that Run could not send within the shutdown timeout.
+func (f *Forwarder) AbandonedEnvelopes() uint64 {
+	return atomic.LoadUint64(&f.abandonedEnvelopes)
+}
+
+// Stop closes the stream connections.
+func (f *Forwarder) Stop() {
+	for _, pool := range f.streamPools {
+		pool.stop()
+	}
+}
+
+func (f *Forwarder) send(message []byte) {
+	if f.retryBuffer != nil && f.ordering != nil && f.ordering.blocks(message) {
+		atomic.AddUint64(&f.heldBackMessages, 1)
+		f.buffer(message)
+		return
+	}
+
+	for i, transport := range f.transports {
+		err := f.sendWith(transport, message)
+		if err == nil {
+			f.countSent(transport)
+			f.pool.Put(message)
+			return
+		}
+
+		f.registry.Increment(f.metricName(metrics.DopplerSendErrors))
+		if tooLarge, ok := err.(datagramTooLargeError); ok {
+			f.dropTooLarge(message, tooLarge)
+			return
+		}
+		if i == len(f.transports)-1 {
+			f.markUnreachable()
+			if f.retryBuffer != nil {
+				f.logger.Debugf("DopplerForwarder: Buffering message for retry: %v", err)
+				f.buffer(message)
+				return
+			}
+			atomic.AddUint64(&f.droppedMessages, 1)
+			f.logger.Errorf("can't forward message: %v", err)
+			f.pool.Put(message)
+			return
+		}
+		atomic.AddUint64(&f.fallbacks[transport], 1)
+		f.logger.Debugf("DopplerForwarder: Falling back from %s to %s: %v", transport, f.transports[i+1], err)
+	}
+}
+
+func (f *Forwarder) buffer(message []byte) {
+	if f.ordering != nil {
+		f.ordering.hold(message)
+	}
+	f.countDropped(f.retryBuffer.push(message))
+	f.reportRetryBufferDepth()
+}
+
+// retry sends the buffered messages, oldest first, every RetryInterval until
+// one of them fails again or stopChan is closed.
+func (f *Forwarder) retry(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+
+		retried := 0
+		for {
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+
+			message := f.retryBuffer.pop()
+			if message == nil {
+				break
+			}
+			if !f.retrySend(message) {
+				f.countDropped(f.retryBuffer.pushFront(message))
+				break
+			}
+			retried++
+		}
+		f.reportRetryBufferDepth()
+
+		if retried > 0 {
+			f.logger.Infof("DopplerForwarder: Sent %d buffered messages", retried)
+		}
+	}
+}
+
+// flushRetryBuffer sends the messages left in the retry buffer, oldest first,
+// trying again every RetryInterval until the shutdown timeout has passed, and
+// abandons the messages it could not send.
+func (f *Forwarder) flushRetryBuffer() {
+	deadline := time.Now().Add(f.shutdown)
+	for {
+		message := f.retryBuffer.pop()
+		if message == nil {
+			break
+		}
+		if f.retrySend(message) {
+			continue
+		}
+
+		f.countDropped(f.retryBuffer.pushFront(message))
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			break
+		}
+		if wait > RetryInterval {
+			wait = RetryInterval
+		}
+		time.Sleep(wait)
+	}
+
+	abandoned := 0
+	for message := f.retryBuffer.pop(); message != nil; message = f.retryBuffer.pop() {
+		abandoned += len(messageEnvelopes(message))
+		if f.ordering != nil {
+			f.ordering.release(message)
+		}
+		f.pool.Put(message)
+	}
+	f.reportRetryBufferDepth()
+
+	if abandoned > 0 {
+		atomic.AddUint64(&f.abandonedEnvelopes, uint64(abandoned))
+		f.registry.Add(f.metricName(metrics.DopplerAbandonedEnvelopes), uint64(abandoned))
+		f.logger.Warnf("DopplerForwarder: Abandoned %d envelopes that could not be sent to doppler before shutting down", abandoned)
+	}
+}
+
+// retrySend does not count fallbacks, as the message was counted when it was
+// first sent.
+func (f *Forwarder) retrySend(message []byte) bool {
+	for _, transport := range f.transports {
+		if err := f.sendWith(transport, message); err == nil {
+			f.countSent(transport)
+			atomic.AddUint64(&f.retriedMessages, 1)
+			if f.ordering != nil {
+				f.ordering.release(message)
+			}
+			f.pool.Put(message)
+			return true
+		} else if tooLarge, ok := err.(datagramTooLargeError); ok {
+			f.registry.Increment(f.metricName(metrics.DopplerSendErrors))
+			if f.ordering != nil {
+				f.ordering.release(message)
+			}
+			f.dropTooLarge(message, tooLarge)
+			return true
+		}
+		f.registry.Increment(f.metricName(metrics.DopplerSendErrors))
+	}
+	return false
+}
+
+func (f *Forwarder) reportRetryBufferDepth() {
+	f.registry.SetGauge(f.metricName(metrics.DopplerRetryBufferedMessages), float64(f.retryBuffer.len()))
+}
+
+func (f *Forwarder) metricName(name string) string {
+	return metrics.InGroup(name, f.group)
+}
+
+func (f *Forwarder) countSent(transport Transport) {
+	atomic.AddUint64(&f.sentMessages[transport], 1)
+	f.registry.Increment(f.metricName(sentMessagesMetrics[transport]))
+	f.countZone()
+
+	if atomic.LoadInt64(&f.unreachableSince) != 0 {
+		atomic.StoreInt64(&f.unreachableSince, 0)
+	}
+	if last, ok := f.lastTransport.Load().(Transport); !ok || last != transport {
+		f.lastTransport.Store(transport)
+	}
+}
+
+// countEgress counts the bytes written to the doppler at host, after batching
+// and compression and including the frame headers and every retry. Bytes
+// written to an unknown doppler, with an empty host, only count towards the
+// total.
+func (f *Forwarder) countEgress(host string, bytes int) {
+	atomic.AddUint64(&f.egressBytes, uint64(bytes))
+	name := f.metricName(metrics.DopplerEgressBytes)
+	f.registry.Add(name, uint64(bytes))
+	if host != "" {
+		f.registry.Add(metrics.ForDestination(name, host), uint64(bytes))
+	}
+}
+
+func (f *Forwarder) markUnreachable() {
+	atomic.CompareAndSwapInt64(&f.unreachableSince, 0, time.Now().UnixNano())
+}
+
+// UnreachableSince returns when the forwarder started failing to send
+// messages to any doppler over any of its transports, or the zero time if the
+// last message was sent or none has been sent yet.
+func (f *Forwarder) UnreachableSince() time.Time {
+	since := atomic.LoadInt64(&f.unreachableSince)
+	if since == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, since)
+}
+
+// LastTransport returns the name of the transport the last message was sent
+// over, or an empty string if none has been sent yet.
+func (f *Forwarder) LastTransport() string {
+	transport, ok := f.lastTransport.Load().(Transport)
+	if !ok {
+		return ""
+	}
+	return transport.String()
+}
+
+func (f *Forwarder) countCompressed(messageBytes int, compressedBytes int) {
+	bytesIn := atomic.AddUint64(&f.compressionBytesIn, uint64(messageBytes))
+	bytesOut := atomic.AddUint64(&f.compressionBytesOut, uint64(compressedBytes))
+	f.registry.Add(f.metricName(metrics.DopplerCompressionBytesIn), uint64(messageBytes))
+	f.registry.Add(f.metricName(metrics.DopplerCompressionBytesOut), uint64(compressedBytes))
+	f.registry.SetGauge(f.metricName(metrics.DopplerCompressionRatio), float64(bytesIn)/float64(bytesOut))
+}
+
+func (f *Forwarder) countSendRetry() {
+	atomic.AddUint64(&f.sendRetries, 1)
+	f.registry.Increment(f.metricName(metrics.DopplerSendRetries))
+}
+
+func (f *Forwarder) countDropped(dropped int) {
+	if dropped == 0 {
+		return
+	}
+	atomic.AddUint64(&f.droppedMessages, uint64(dropped))
+	f.logger.Debugf("DopplerForwarder: Retry buffer full, dropped %d messages", dropped)
+}
+
+func (f *Forwarder) countZone() {
+	if f.zones == nil {
+		return
+	}
+	if f.zones.CrossZone() {
+		atomic.AddUint64(&f.crossZoneSentMessages, 1)
+	} else {
+		atomic.AddUint64(&f.sameZoneSentMessages, 1)
+	}
+}
+
+func (f *Forwarder) sendWith(transport Transport, message []byte) error {
+	if transport == UDP {
+		client, err := f.udpPool.RandomClient()
+		if err != nil {
+			return err
+		}
+		datagram := message
+		if f.sequencer != nil {
+			datagram = f.sequencer.stamp(f.pool.Get(), client, message, f.udpPool)
+			defer f.pool.Put(datagram)
+		}
+		if writer, ok := client.(udpWriter); ok {
+			return f.writeUDP(writer, datagram)
+		}
+		// the loggregatorlib client pool tells neither which doppler it
+		// picked nor whether the datagram was written
+		client.Send(datagram)
+		f.countEgress("", len(datagram))
+		return nil
+	}
+
+	var loads map[string]int
+	if f.loads != nil {
+		loads = f.loads.Loads()
+	}
+	var report func(host string, err error)
+	if f.sends != nil {
+		report = f.sends.ReportSend
+	}
+	return f.streamPools[transport].send(f.addressList.GetAddresses(), loads, message, report)
+}
+
+// writeUDP writes datagram with client and counts the errors by class. A
+// datagram that could not be written as the socket buffers were full is
+// written again after a short backoff. A datagram too large for the path to
+// doppler is never written again, see datagramTooLargeError. A doppler that
+// refused an earlier datagram is reported as failing right away.
+func (f *Forwarder) writeUDP(client udpWriter, datagram []byte) error {
+	for attempt := 0; ; attempt++ {
+		err := client.write(datagram)
+		if err == nil {
+			f.countEgress(client.host(), len(datagram))
+			if f.sends != nil {
+				f.sends.ReportSend(client.host(), nil)
+			}
+			return nil
+		}
+
+		class, errno := udpErrorClass(err)
+		first := f.countUDPError(class, errno)
+		switch class {
+		case udpMessageTooLong:
+			return datagramTooLargeError{err: err, first: first}
+		case udpConnectionRefused:
+			if f.sends != nil {
+				f.sends.ReportSend(client.host(), err)
+			}
+		case udpNoBufferSpace:
+			if attempt < UDPNoBufferRetries {
+				time.Sleep(UDPNoBufferBackoff)
+				continue
+			}
+		}
+		return err
+	}
+}
+
+// datagramTooLargeError is the error writing a datagram larger than the path
+// to doppler allows. The message is dropped rather than falling back or being
+// retried, as it would never fit. first is set for the first datagram too
+// large to send.
+type datagramTooLargeError struct {
+	err   error
+	first bool
+}
+
+func (e datagramTooLargeError) Error() string {
+	return e.err.Error()
+}
+
+// countUDPError returns whether this is the first error of its class.
+func (f *Forwarder) countUDPError(class string, errno syscall.Errno) bool {
+	f.registry.Increment(f.metricName(metrics.DopplerUDPSendErrors + "." + class))
+
+	f.udpErrorsLock.Lock()
+	defer f.udpErrorsLock.Unlock()
+
+	f.udpErrors[class]++
+	if class == udpUnknownError {
+		name := "none"
+		if errno != 0 {
+			name = errno.Error()
+		}
+		f.udpErrnos[name]++
+	}
+	return f.udpErrors[class] == 1
+}
+
+// dropTooLarge only warns about the first message too large to send, as the
+// messages of a misconfigured batch size would flood the log.
+func (f *Forwarder) dropTooLarge(message []byte, err datagramTooLargeError) {
+	atomic.AddUint64(&f.droppedMessages, 1)
+
+	if err.first {
+		f.logger.Warnf("DopplerForwarder: Dropping a message of %d bytes too large to send over UDP: %v", len(message), err)
+	} else {
+		f.logger.Debugf("DopplerForwarder: Dropping a message of %d bytes too large to send over UDP: %v", len(message), err)
+	}
+	f.pool.Put(message)
+}
+
+// udpErrorMetrics returns the counts of the errors writing datagrams, by
+// class, and of the unknown errors by errno.
+func (f *Forwarder) udpErrorMetrics() []instrumentation.Metric {
+	f.udpErrorsLock.Lock()
+	defer f.udpErrorsLock.Unlock()
+
+	metrics := []instrumentation.Metric{
+		{Name: "udpMessageTooLongErrors", Value: f.udpErrors[udpMessageTooLong]},
+		{Name: "udpConnectionRefusedErrors", Value: f.udpErrors[udpConnectionRefused]},
+		{Name: "udpNoBufferSpaceErrors", Value: f.udpErrors[udpNoBufferSpace]},
+	}
+	errnos := make([]string, 0, len(f.udpErrnos))
+	for errno := range f.udpErrnos {
+		errnos = append(errnos, errno)
+	}
+	sort.Strings(errnos)
+	for _, errno := range errnos {
+		metrics = append(metrics, instrumentation.Metric{
+			Name:  "udpUnknownErrors",
+			Value: f.udpErrnos[errno],
+			Tags:  map[string]interface{}{"errno": errno},
+		})
+	}
+	return metrics
+}
+
+func (f *Forwarder) Emit() instrumentation.Context {
+	var metrics []instrumentation.Metric
+	for i, transport := range f.transports {
+		metrics = append(metrics, instrumentation.Metric{Name: transport.String() + "SentMessages", Value: atomic.LoadUint64(&f.sentMessages[transport])})
+		if i < len(f.transports)-1 {
+			metrics = append(metrics, instrumentation.Metric{Name: transport.String() + "Fallbacks", Value: atomic.LoadUint64(&f.fallbacks[transport])})
+		}
+		if pool, ok := f.streamPools[transport]; ok {
+			metrics = append(metrics, instrumentation.Metric{Name: transport.String() + "UnavailableDopplers", Value: pool.unavailableCount()})
+		}
+	}
+	metrics = append(metrics, instrumentation.Metric{Name: "droppedMessages", Value: atomic.LoadUint64(&f.droppedMessages)})
+	metrics = append(metrics, instrumentation.Metric{Name: "egressBytes", Value: atomic.LoadUint64(&f.egressBytes)})
+	for _, transport := range f.transports {
+		if transport == UDP {
+			metrics = append(metrics, f.udpErrorMetrics()...)
+		}
+	}
+	if len(f.streamPools) > 0 {
+		metrics = append(metrics, instrumentation.Metric{Name: "sendRetries", Value: atomic.LoadUint64(&f.sendRetries)})
+	}
+	if f.zones != nil {
+		metrics = append(metrics, instrumentation.Metric{Name: "sameZoneSentMessages", Value: atomic.LoadUint64(&f.sameZoneSentMessages)})
+		metrics = append(metrics, instrumentation.Metric{Name: "crossZoneSentMessages", Value: atomic.LoadUint64(&f.crossZoneSentMessages)})
+	}
+	if f.retryBuffer != nil {
+		metrics = append(metrics, instrumentation.Metric{Name: "retryBufferedMessages", Value: f.retryBuffer.len()})
+		metrics = append(metrics, instrumentation.Metric{Name: "retriedMessages", Value: atomic.LoadUint64(&f.retriedMessages)})
+		metrics = append(metrics, instrumentation.Metric{Name: "abandonedEnvelopes", Value: atomic.LoadUint64(&f.abandonedEnvelopes)})
+		if f.ordering != nil {
+			metrics = append(metrics, instrumentation.Metric{Name: "heldBackMessages", Value: atomic.LoadUint64(&f.heldBackMessages)})
+		}
+	}
+	if f.compressing {
+		metrics = append(metrics, instrumentation.Metric{Name: "compressionBytesIn", Value: atomic.LoadUint64(&f.compressionBytesIn)})
+		metrics = append(metrics, instrumentation.Metric{Name: "compressionBytesOut", Value: atomic.LoadUint64(&f.compressionBytesOut)})
+	}
+
+	name := "dopplerForwarder"
+	if f.group != "" {
+		name += "." + f.group
+	}
+	return instrumentation.Context{
+		Name:    name,
+		Metrics: metrics,
+	}
+}
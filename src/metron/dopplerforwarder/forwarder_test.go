@@ -0,0 +1,758 @@
+package dopplerforwarder_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/clientpool"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/cloudfoundry/loggregatorlib/servicediscovery"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	udpPort = 52111
+	tcpPort = 52112
+	tlsPort = 52113
+)
+
+type fakeAddressList struct {
+	addresses []string
+}
+
+func (list *fakeAddressList) Run(time.Duration) {}
+func (list *fakeAddressList) Stop()             {}
+func (list *fakeAddressList) GetAddresses() []string {
+	return list.addresses
+}
+
+type fakeZoneAddressList struct {
+	fakeAddressList
+
+	sync.Mutex
+	crossZone bool
+}
+
+func (list *fakeZoneAddressList) CrossZone() bool {
+	list.Lock()
+	defer list.Unlock()
+	return list.crossZone
+}
+
+func (list *fakeZoneAddressList) setCrossZone(crossZone bool) {
+	list.Lock()
+	defer list.Unlock()
+	list.crossZone = crossZone
+}
+
+type sendReport struct {
+	address string
+	failed  bool
+}
+
+type reportingAddressList struct {
+	fakeAddressList
+	reports chan sendReport
+}
+
+func (list *reportingAddressList) ReportSend(address string, err error) {
+	list.reports <- sendReport{address: address, failed: err != nil}
+}
+
+// fakeDoppler reads frames from the connections it accepts. Unless it accepts
+// compressed frames, it knows nothing about compression, like older dopplers.
+type fakeDoppler struct {
+	listener           net.Listener
+	messages           chan string
+	acceptsCompression bool
+
+	sync.Mutex
+	accepted    int
+	compressed  int
+	connections []net.Conn
+}
+
+func newFakeDoppler(port int, tlsConfig *tls.Config) *fakeDoppler {
+	return newFakeDopplerOn("127.0.0.1", port, tlsConfig)
+}
+
+func newFakeDopplerOn(host string, port int, tlsConfig *tls.Config) *fakeDoppler {
+	address := fmt.Sprintf("%s:%d", host, port)
+	var listener net.Listener
+	var err error
+	if tlsConfig != nil {
+		listener, err = tls.Listen("tcp", address, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	Expect(err).NotTo(HaveOccurred())
+
+	doppler := &fakeDoppler{listener: listener, messages: make(chan string, 100)}
+	go doppler.accept()
+	return doppler
+}
+
+func newCompressingFakeDoppler(port int) *fakeDoppler {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	Expect(err).NotTo(HaveOccurred())
+
+	doppler := &fakeDoppler{listener: listener, messages: make(chan string, 100), acceptsCompression: true}
+	go doppler.accept()
+	return doppler
+}
+
+func (d *fakeDoppler) accept() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.Lock()
+		d.accepted++
+		d.connections = append(d.connections, conn)
+		d.Unlock()
+
+		go func() {
+			if d.acceptsCompression {
+				conn.Write([]byte{dopplerforwarder.AcceptsCompressedFrames})
+			}
+
+			var header [4]byte
+			for {
+				if _, err := io.ReadFull(conn, header[:]); err != nil {
+					return
+				}
+				compressed := d.acceptsCompression && header[0]&dopplerforwarder.FrameCompressed != 0
+				if compressed {
+					header[0] &^= dopplerforwarder.FrameCompressed
+				}
+				message := make([]byte, binary.BigEndian.Uint32(header[:]))
+				if _, err := io.ReadFull(conn, message); err != nil {
+					return
+				}
+				if compressed {
+					reader, err := gzip.NewReader(bytes.NewReader(message))
+					if err != nil {
+						return
+					}
+					if message, err = ioutil.ReadAll(reader); err != nil {
+						return
+					}
+					d.Lock()
+					d.compressed++
+					d.Unlock()
+				}
+				d.messages <- string(message)
+			}
+		}()
+	}
+}
+
+func (d *fakeDoppler) acceptedCount() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.accepted
+}
+
+func (d *fakeDoppler) compressedCount() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.compressed
+}
+
+func (d *fakeDoppler) closeConnections() {
+	d.Lock()
+	defer d.Unlock()
+	for _, conn := range d.connections {
+		conn.Close()
+	}
+	d.connections = nil
+}
+
+func (d *fakeDoppler) stop() {
+	d.listener.Close()
+	d.closeConnections()
+}
+
+func serverTLSConfig(certFile, keyFile string) *tls.Config {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	Expect(err).NotTo(HaveOccurred())
+	caCert, err := ioutil.ReadFile("fixtures/ca.crt")
+	Expect(err).NotTo(HaveOccurred())
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caCert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+}
+
+func metricValue(forwarder *dopplerforwarder.Forwarder, name string) interface{} {
+	for _, metric := range forwarder.Emit().Metrics {
+		if metric.Name == name {
+			return metric.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Forwarder", func() {
+	var (
+		addressList   *fakeAddressList
+		udpListener   net.PacketConn
+		udpMessages   chan string
+		messageChan   chan []byte
+		forwarder     *dopplerforwarder.Forwarder
+		forwarderDone chan struct{}
+		registry      *metrics.Registry
+
+		retryBufferMaxMessages int
+		retryBufferMaxBytes    int
+		compressionMinBytes    int
+	)
+
+	startWith := func(list servicediscovery.ServerAddressList, transports ...dopplerforwarder.Transport) {
+		tlsConfig, err := dopplerforwarder.NewClientTLSConfig("fixtures/client.crt", "fixtures/client.key", "fixtures/ca.crt", "doppler")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := loggertesthelper.Logger()
+		udpPool := clientpool.NewLoggregatorClientPool(logger, udpPort, list)
+		forwarder = dopplerforwarder.New(transports, udpPool, list, tcpPort, tlsPort, tlsConfig, logger)
+		forwarder.SetMetricsRegistry(registry)
+		if retryBufferMaxMessages > 0 {
+			forwarder.SetRetryBuffer(retryBufferMaxMessages, retryBufferMaxBytes)
+		}
+		if compressionMinBytes > 0 {
+			forwarder.SetFrameCompression(compressionMinBytes)
+		}
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	}
+
+	start := func(transports ...dopplerforwarder.Transport) {
+		startWith(addressList, transports...)
+	}
+
+	BeforeEach(func() {
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+
+		addressList = &fakeAddressList{addresses: []string{"127.0.0.1"}}
+		retryBufferMaxMessages = 0
+		compressionMinBytes = 0
+		messageChan = make(chan []byte)
+		registry = metrics.NewRegistry()
+		forwarderDone = make(chan struct{})
+
+		var err error
+		udpListener, err = net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+		Expect(err).NotTo(HaveOccurred())
+		udpMessages = make(chan string, 100)
+		go func() {
+			buffer := make([]byte, 65535)
+			for {
+				n, _, err := udpListener.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				udpMessages <- string(buffer[:n])
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+		forwarder.Stop()
+		udpListener.Close()
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+		dopplerforwarder.RetryInterval = 100 * time.Millisecond
+	})
+
+	Context("when doppler accepts TLS connections", func() {
+		var doppler *fakeDoppler
+
+		BeforeEach(func() {
+			doppler = newFakeDoppler(tlsPort, serverTLSConfig("fixtures/server.crt", "fixtures/server.key"))
+			start(dopplerforwarder.TLS, dopplerforwarder.UDP)
+		})
+
+		AfterEach(func() {
+			doppler.stop()
+		})
+
+		It("sends the messages over one TLS connection", func() {
+			messageChan <- []byte("first")
+			messageChan <- []byte("second")
+
+			Eventually(doppler.messages).Should(Receive(Equal("first")))
+			Eventually(doppler.messages).Should(Receive(Equal("second")))
+			Expect(doppler.acceptedCount()).To(Equal(1))
+			Consistently(udpMessages).ShouldNot(Receive())
+
+			Eventually(func() interface{} { return metricValue(forwarder, "tlsSentMessages") }).Should(BeEquivalentTo(2))
+			Expect(metricValue(forwarder, "tlsFallbacks")).To(BeEquivalentTo(0))
+		})
+
+		It("reconnects after doppler closes the connection mid-stream, losing at most the in-flight frame", func() {
+			sent := 50
+			go func() {
+				for i := 0; i < sent; i++ {
+					messageChan <- []byte(fmt.Sprintf("message %d", i))
+					if i == 20 {
+						doppler.closeConnections()
+					}
+					time.Sleep(2 * time.Millisecond)
+				}
+			}()
+
+			received := make(map[string]bool)
+			receivedOverTLS := 0
+			Eventually(func() int {
+				for {
+					select {
+					case message := <-doppler.messages:
+						received[message] = true
+						receivedOverTLS++
+					case message := <-udpMessages:
+						received[message] = true
+					default:
+						return len(received)
+					}
+				}
+			}).Should(BeNumerically(">=", sent-1))
+
+			Expect(doppler.acceptedCount()).To(Equal(2))
+			Expect(receivedOverTLS).To(BeNumerically(">", 21))
+			Expect(received).To(HaveKey(fmt.Sprintf("message %d", sent-1)))
+		})
+
+		It("closes the connection when stopped", func() {
+			messageChan <- []byte("first")
+			Eventually(doppler.messages).Should(Receive())
+
+			forwarder.Stop()
+
+			messageChan <- []byte("second")
+			Eventually(udpMessages).Should(Receive(Equal("second")))
+		})
+	})
+
+	Context("when the TLS handshake fails", func() {
+		var doppler *fakeDoppler
+
+		BeforeEach(func() {
+			doppler = newFakeDoppler(tlsPort, serverTLSConfig("fixtures/untrusted-server.crt", "fixtures/untrusted-server.key"))
+		})
+
+		AfterEach(func() {
+			doppler.stop()
+		})
+
+		It("falls back to UDP and counts the fallback", func() {
+			start(dopplerforwarder.TLS, dopplerforwarder.UDP)
+			messageChan <- []byte("message")
+
+			Eventually(udpMessages).Should(Receive(Equal("message")))
+			Consistently(doppler.messages).ShouldNot(Receive())
+
+			Eventually(func() interface{} { return metricValue(forwarder, "tlsFallbacks") }).Should(BeEquivalentTo(1))
+			Expect(metricValue(forwarder, "udpSentMessages")).To(BeEquivalentTo(1))
+			Expect(metricValue(forwarder, "tlsSentMessages")).To(BeEquivalentTo(0))
+		})
+
+		It("does not reconnect before the backoff has passed", func() {
+			dopplerforwarder.MinReconnectBackoff = time.Hour
+			start(dopplerforwarder.TLS, dopplerforwarder.UDP)
+
+			for i := 0; i < 3; i++ {
+				messageChan <- []byte("message")
+				Eventually(udpMessages).Should(Receive())
+			}
+
+			Expect(doppler.acceptedCount()).To(Equal(1))
+			Expect(metricValue(forwarder, "tlsFallbacks")).To(BeEquivalentTo(3))
+		})
+	})
+
+	Context("when doppler accepts TCP connections", func() {
+		var doppler *fakeDoppler
+
+		BeforeEach(func() {
+			doppler = newFakeDoppler(tcpPort, nil)
+		})
+
+		AfterEach(func() {
+			doppler.stop()
+		})
+
+		It("falls back from TLS to TCP", func() {
+			start(dopplerforwarder.TLS, dopplerforwarder.TCP, dopplerforwarder.UDP)
+			messageChan <- []byte("message")
+
+			Eventually(doppler.messages).Should(Receive(Equal("message")))
+			Consistently(udpMessages).ShouldNot(Receive())
+			Eventually(func() interface{} { return metricValue(forwarder, "tlsFallbacks") }).Should(BeEquivalentTo(1))
+			Expect(metricValue(forwarder, "tcpSentMessages")).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("with frame compression", func() {
+		var (
+			doppler  *fakeDoppler
+			large    string
+			received []string
+		)
+
+		// sendUntilCompressed sends large until doppler receives it compressed,
+		// as the client only learns that doppler accepts compressed frames
+		// after connecting.
+		sendUntilCompressed := func() {
+			Eventually(func() int {
+				messageChan <- []byte(large)
+				var message string
+				Eventually(doppler.messages).Should(Receive(&message))
+				received = append(received, message)
+				return doppler.compressedCount()
+			}).Should(Equal(1))
+		}
+
+		BeforeEach(func() {
+			compressionMinBytes = 100
+			large = string(bytes.Repeat([]byte("compressible "), 20))
+			received = nil
+		})
+
+		AfterEach(func() {
+			doppler.stop()
+		})
+
+		Context("when doppler accepts compressed frames", func() {
+			BeforeEach(func() {
+				doppler = newCompressingFakeDoppler(tcpPort)
+				start(dopplerforwarder.TCP)
+			})
+
+			It("compresses the messages of at least the minimum size", func() {
+				sendUntilCompressed()
+				for _, message := range received {
+					Expect(message).To(Equal(large))
+				}
+
+				messageChan <- []byte("small")
+				Eventually(doppler.messages).Should(Receive(Equal("small")))
+				messageChan <- []byte(large)
+				Eventually(doppler.messages).Should(Receive(Equal(large)))
+				Expect(doppler.compressedCount()).To(Equal(2))
+			})
+
+			It("sends the messages compression does not make smaller as they are", func() {
+				sendUntilCompressed()
+
+				incompressible := make([]byte, 200)
+				for i := range incompressible {
+					incompressible[i] = byte(i * 101 % 251)
+				}
+				messageChan <- incompressible
+				Eventually(doppler.messages).Should(Receive(Equal(string(incompressible))))
+				Expect(doppler.compressedCount()).To(Equal(1))
+			})
+
+			It("counts the bytes before and after compression", func() {
+				sendUntilCompressed()
+
+				bytesIn := registry.Counter(metrics.DopplerCompressionBytesIn)
+				bytesOut := registry.Counter(metrics.DopplerCompressionBytesOut)
+				Expect(bytesIn).To(BeEquivalentTo(len(large)))
+				Expect(bytesOut).To(BeNumerically("<", bytesIn))
+				Expect(registry.Gauge(metrics.DopplerCompressionRatio)).To(Equal(float64(bytesIn) / float64(bytesOut)))
+				Expect(metricValue(forwarder, "compressionBytesIn")).To(Equal(bytesIn))
+				Expect(metricValue(forwarder, "compressionBytesOut")).To(Equal(bytesOut))
+			})
+		})
+
+		Context("when doppler does not accept compressed frames", func() {
+			BeforeEach(func() {
+				doppler = newFakeDoppler(tcpPort, nil)
+				start(dopplerforwarder.TCP)
+			})
+
+			It("sends the messages uncompressed", func() {
+				for i := 0; i < 10; i++ {
+					messageChan <- []byte(large)
+					Eventually(doppler.messages).Should(Receive(Equal(large)))
+					time.Sleep(10 * time.Millisecond)
+				}
+				Expect(registry.Counter(metrics.DopplerCompressionBytesIn)).To(BeZero())
+			})
+		})
+	})
+
+	Context("with a retry buffer", func() {
+		var doppler *fakeDoppler
+
+		send := func(first, last int) {
+			for i := first; i <= last; i++ {
+				messageChan <- []byte(fmt.Sprintf("message-%d", i))
+			}
+		}
+
+		BeforeEach(func() {
+			dopplerforwarder.RetryInterval = 10 * time.Millisecond
+			retryBufferMaxMessages = 5
+			retryBufferMaxBytes = 1000
+			doppler = nil
+		})
+
+		AfterEach(func() {
+			if doppler != nil {
+				doppler.stop()
+			}
+		})
+
+		It("sends the messages buffered while doppler was down in order once it is back", func() {
+			start(dopplerforwarder.TCP)
+			send(0, 2)
+			Eventually(func() interface{} { return metricValue(forwarder, "retryBufferedMessages") }).Should(BeEquivalentTo(3))
+
+			doppler = newFakeDoppler(tcpPort, nil)
+			for i := 0; i <= 2; i++ {
+				Eventually(doppler.messages, 2*time.Second).Should(Receive(Equal(fmt.Sprintf("message-%d", i))))
+			}
+
+			Expect(metricValue(forwarder, "retriedMessages")).To(BeEquivalentTo(3))
+			Expect(metricValue(forwarder, "tcpSentMessages")).To(BeEquivalentTo(3))
+			Expect(metricValue(forwarder, "retryBufferedMessages")).To(BeEquivalentTo(0))
+			Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(0))
+		})
+
+		It("sends new messages right away once doppler is back", func() {
+			start(dopplerforwarder.TCP)
+			send(0, 0)
+			Eventually(func() interface{} { return metricValue(forwarder, "retryBufferedMessages") }).Should(BeEquivalentTo(1))
+
+			doppler = newFakeDoppler(tcpPort, nil)
+			Eventually(doppler.messages, 2*time.Second).Should(Receive(Equal("message-0")))
+
+			send(1, 1)
+			Eventually(doppler.messages).Should(Receive(Equal("message-1")))
+			Expect(metricValue(forwarder, "retriedMessages")).To(BeEquivalentTo(1))
+		})
+
+		It("drops the oldest messages beyond the message limit", func() {
+			start(dopplerforwarder.TCP)
+			send(0, 7)
+			Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeEquivalentTo(3))
+			Expect(metricValue(forwarder, "retryBufferedMessages")).To(BeEquivalentTo(5))
+
+			doppler = newFakeDoppler(tcpPort, nil)
+			for i := 3; i <= 7; i++ {
+				Eventually(doppler.messages, 2*time.Second).Should(Receive(Equal(fmt.Sprintf("message-%d", i))))
+			}
+			Consistently(doppler.messages).ShouldNot(Receive())
+			Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(3))
+		})
+
+		It("drops the oldest messages beyond the byte limit", func() {
+			retryBufferMaxBytes = 2 * len("message-0")
+			start(dopplerforwarder.TCP)
+			send(0, 3)
+			Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeEquivalentTo(2))
+			Expect(metricValue(forwarder, "retryBufferedMessages")).To(BeEquivalentTo(2))
+
+			doppler = newFakeDoppler(tcpPort, nil)
+			Eventually(doppler.messages, 2*time.Second).Should(Receive(Equal("message-2")))
+			Eventually(doppler.messages).Should(Receive(Equal("message-3")))
+		})
+	})
+
+	Context("tracking whether dopplers are reachable", func() {
+		var doppler *fakeDoppler
+
+		BeforeEach(func() {
+			doppler = nil
+		})
+
+		AfterEach(func() {
+			if doppler != nil {
+				doppler.stop()
+			}
+		})
+
+		It("reports dopplers as reachable before anything was sent", func() {
+			start(dopplerforwarder.TCP)
+
+			Expect(forwarder.UnreachableSince()).To(BeZero())
+			Expect(forwarder.LastTransport()).To(BeEmpty())
+		})
+
+		It("reports since when no doppler could be reached until one can again", func() {
+			start(dopplerforwarder.TCP)
+			sendStart := time.Now()
+			messageChan <- []byte("message")
+
+			Eventually(forwarder.UnreachableSince).ShouldNot(BeZero())
+			unreachableSince := forwarder.UnreachableSince()
+			Expect(unreachableSince).To(BeTemporally(">=", sendStart))
+
+			messageChan <- []byte("message")
+			Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeEquivalentTo(2))
+			Expect(forwarder.UnreachableSince()).To(Equal(unreachableSince))
+
+			doppler = newFakeDoppler(tcpPort, nil)
+			Eventually(func() time.Time {
+				messageChan <- []byte("message")
+				return forwarder.UnreachableSince()
+			}, 2*time.Second).Should(BeZero())
+			Expect(forwarder.LastTransport()).To(Equal("tcp"))
+		})
+
+		It("reports the transport the last message was sent over", func() {
+			start(dopplerforwarder.TCP, dopplerforwarder.UDP)
+			messageChan <- []byte("message")
+
+			Eventually(udpMessages).Should(Receive(Equal("message")))
+			Eventually(forwarder.LastTransport).Should(Equal("udp"))
+			Expect(forwarder.UnreachableSince()).To(BeZero())
+		})
+	})
+
+	Context("counting in a metrics registry", func() {
+		It("counts the messages sent per transport and the failed sends", func() {
+			start(dopplerforwarder.TCP, dopplerforwarder.UDP)
+			messageChan <- []byte("first")
+			messageChan <- []byte("second")
+
+			Eventually(udpMessages).Should(Receive(Equal("first")))
+			Eventually(udpMessages).Should(Receive(Equal("second")))
+			Eventually(func() uint64 { return registry.Counter(metrics.DopplerUDPSentMessages) }).Should(BeEquivalentTo(2))
+			Expect(registry.Counter(metrics.DopplerTCPSentMessages)).To(BeEquivalentTo(0))
+			Expect(registry.Counter(metrics.DopplerSendErrors)).To(BeEquivalentTo(2))
+		})
+
+		It("counts the bytes written to each doppler and in total", func() {
+			doppler := newFakeDoppler(tcpPort, nil)
+			defer doppler.stop()
+			start(dopplerforwarder.TCP)
+
+			message := bytes.Repeat([]byte("x"), 100)
+			for i := 0; i < 10; i++ {
+				messageChan <- message
+				Eventually(doppler.messages).Should(Receive())
+			}
+
+			total := registry.Counter(metrics.DopplerEgressBytes)
+			Expect(total).To(BeNumerically(">=", 10*len(message)))
+			Expect(total).To(BeNumerically("<=", 10*(len(message)+4)))
+			Expect(registry.Counter(metrics.ForDestination(metrics.DopplerEgressBytes, "127.0.0.1"))).To(Equal(total))
+			Expect(metricValue(forwarder, "egressBytes")).To(Equal(total))
+		})
+
+		It("counts the bytes sent over UDP in the total only", func() {
+			start(dopplerforwarder.UDP)
+
+			message := bytes.Repeat([]byte("x"), 100)
+			for i := 0; i < 10; i++ {
+				messageChan <- message
+				Eventually(udpMessages).Should(Receive())
+			}
+
+			Eventually(func() uint64 { return registry.Counter(metrics.DopplerEgressBytes) }).Should(BeEquivalentTo(10 * len(message)))
+			Expect(registry.Counter(metrics.ForDestination(metrics.DopplerEgressBytes, "127.0.0.1"))).To(BeZero())
+		})
+
+		It("keeps the depth of the retry buffer", func() {
+			dopplerforwarder.RetryInterval = 10 * time.Millisecond
+			retryBufferMaxMessages = 5
+			retryBufferMaxBytes = 1000
+			start(dopplerforwarder.TCP)
+			messageChan <- []byte("first")
+			messageChan <- []byte("second")
+			Eventually(func() float64 { return registry.Gauge(metrics.DopplerRetryBufferedMessages) }).Should(Equal(2.0))
+
+			doppler := newFakeDoppler(tcpPort, nil)
+			defer doppler.stop()
+			Eventually(doppler.messages, 2*time.Second).Should(Receive(Equal("first")))
+			Eventually(doppler.messages).Should(Receive(Equal("second")))
+			Eventually(func() float64 { return registry.Gauge(metrics.DopplerRetryBufferedMessages) }).Should(Equal(0.0))
+			Expect(registry.Counter(metrics.DopplerTCPSentMessages)).To(BeEquivalentTo(2))
+		})
+	})
+
+	It("sends the messages over UDP by default", func() {
+		start(dopplerforwarder.UDP)
+		messageChan <- []byte("message")
+
+		Eventually(udpMessages).Should(Receive(Equal("message")))
+		Eventually(func() interface{} { return metricValue(forwarder, "udpSentMessages") }).Should(BeEquivalentTo(1))
+	})
+
+	It("does not report zone metrics when the address list does not know its zone", func() {
+		start(dopplerforwarder.UDP)
+
+		Expect(metricValue(forwarder, "sameZoneSentMessages")).To(BeNil())
+		Expect(metricValue(forwarder, "crossZoneSentMessages")).To(BeNil())
+	})
+
+	It("counts same-zone and cross-zone sends when the address list knows its zone", func() {
+		zoneList := &fakeZoneAddressList{fakeAddressList: *addressList}
+		startWith(zoneList, dopplerforwarder.UDP)
+
+		messageChan <- []byte("message")
+		Eventually(func() interface{} { return metricValue(forwarder, "sameZoneSentMessages") }).Should(BeEquivalentTo(1))
+
+		zoneList.setCrossZone(true)
+		messageChan <- []byte("message")
+		messageChan <- []byte("message")
+		Eventually(func() interface{} { return metricValue(forwarder, "crossZoneSentMessages") }).Should(BeEquivalentTo(2))
+		Expect(metricValue(forwarder, "sameZoneSentMessages")).To(BeEquivalentTo(1))
+	})
+
+	It("reports the outcome of the sends over stream transports to the address list", func() {
+		reportingList := &reportingAddressList{fakeAddressList: *addressList, reports: make(chan sendReport, 10)}
+		startWith(reportingList, dopplerforwarder.TCP, dopplerforwarder.UDP)
+
+		messageChan <- []byte("unreachable")
+		Eventually(reportingList.reports).Should(Receive(Equal(sendReport{address: "127.0.0.1", failed: true})))
+		Eventually(udpMessages).Should(Receive(Equal("unreachable")))
+		Consistently(reportingList.reports).ShouldNot(Receive())
+
+		doppler := newFakeDoppler(tcpPort, nil)
+		defer doppler.stop()
+		Eventually(func() bool {
+			messageChan <- []byte("reachable")
+			select {
+			case report := <-reportingList.reports:
+				return !report.failed
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}, 2*time.Second).Should(BeTrue())
+	})
+
+	It("drops the messages when there are no dopplers", func() {
+		addressList.addresses = nil
+		start(dopplerforwarder.TLS, dopplerforwarder.UDP)
+		messageChan <- []byte("message")
+
+		Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeEquivalentTo(1))
+		Expect(metricValue(forwarder, "tlsFallbacks")).To(BeEquivalentTo(1))
+		Consistently(udpMessages).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,82 @@
+package dopplerforwarder
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// MinLoadWeight is the weight of a doppler reporting a load of 100, so that
+// a fully loaded doppler still gets a twentieth of the messages an idle one
+// gets rather than none.
+const MinLoadWeight = 5
+
+// loadReporter is implemented by address lists, such as ZoneAddressList, that
+// know the load of their dopplers.
+type loadReporter interface {
+	Loads() map[string]int
+}
+
+// parseRegistration splits the value a doppler registers under into its
+// address and, if present, its load hint: "10.0.1.1 load=42" is a doppler at
+// 10.0.1.1 with a load of 42 out of 100. Hints out of range are clamped.
+func parseRegistration(value string) (address string, load int, hasLoad bool) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", 0, false
+	}
+
+	address = fields[0]
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "load=") {
+			continue
+		}
+		load, err := strconv.Atoi(strings.TrimPrefix(field, "load="))
+		if err != nil {
+			return address, 0, false
+		}
+		if load < 0 {
+			load = 0
+		}
+		if load > 100 {
+			load = 100
+		}
+		return address, load, true
+	}
+	return address, 0, false
+}
+
+// loadWeight is inversely proportional to load, but at least MinLoadWeight.
+func loadWeight(load int) int {
+	weight := 100 - load
+	if weight < MinLoadWeight {
+		weight = MinLoadWeight
+	}
+	return weight
+}
+
+// pickAddress returns a random address, weighted by the dopplers' loads if
+// loads holds the load of every address and uniformly otherwise.
+func pickAddress(addresses []string, loads map[string]int) string {
+	if loads == nil {
+		return addresses[rand.Intn(len(addresses))]
+	}
+
+	total := 0
+	for _, address := range addresses {
+		load, ok := loads[address]
+		if !ok {
+			return addresses[rand.Intn(len(addresses))]
+		}
+		total += loadWeight(load)
+	}
+
+	n := rand.Intn(total)
+	for _, address := range addresses {
+		n -= loadWeight(loads[address])
+		if n < 0 {
+			return address
+		}
+	}
+	return addresses[len(addresses)-1]
+}
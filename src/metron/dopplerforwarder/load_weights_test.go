@@ -0,0 +1,138 @@
+package dopplerforwarder_test
+
+import (
+	"math/rand"
+	"metron/dopplerforwarder"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const loadTestPort = 52116
+
+type fakeLoadAddressList struct {
+	fakeAddressList
+	loads map[string]int
+}
+
+func (list *fakeLoadAddressList) Loads() map[string]int {
+	return list.loads
+}
+
+var _ = Describe("Weighted doppler selection", func() {
+	const sent = 3000
+
+	var (
+		dopplers    map[string]*fakeDoppler
+		addressList *fakeLoadAddressList
+	)
+
+	// sendAndCount sends messages over TCP and returns how many each doppler
+	// received.
+	sendAndCount := func() map[string]int {
+		forwarder := dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, addressList, loadTestPort, 0, nil, loggertesthelper.Logger())
+		defer forwarder.Stop()
+
+		var lock sync.Mutex
+		received := make(map[string]int)
+		total := 0
+		stopCounting := make(chan struct{})
+		defer close(stopCounting)
+		for address, doppler := range dopplers {
+			go func(address string, doppler *fakeDoppler) {
+				for {
+					select {
+					case <-doppler.messages:
+						lock.Lock()
+						received[address]++
+						total++
+						lock.Unlock()
+					case <-stopCounting:
+						return
+					}
+				}
+			}(address, doppler)
+		}
+
+		messageChan := make(chan []byte)
+		done := make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(done)
+		}()
+		for i := 0; i < sent; i++ {
+			messageChan <- []byte("message")
+		}
+		close(messageChan)
+		Eventually(done).Should(BeClosed())
+
+		Eventually(func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return total
+		}, 5*time.Second).Should(Equal(sent))
+
+		lock.Lock()
+		defer lock.Unlock()
+		counts := make(map[string]int)
+		for address, count := range received {
+			counts[address] = count
+		}
+		return counts
+	}
+
+	BeforeEach(func() {
+		rand.Seed(1)
+		dopplers = make(map[string]*fakeDoppler)
+		for _, host := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+			dopplers[host] = newFakeDopplerOn(host, loadTestPort, nil)
+		}
+		addressList = &fakeLoadAddressList{fakeAddressList: fakeAddressList{addresses: []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}}}
+	})
+
+	AfterEach(func() {
+		for _, doppler := range dopplers {
+			doppler.stop()
+		}
+	})
+
+	It("sends to the dopplers inversely to their load", func() {
+		addressList.loads = map[string]int{"127.0.0.1": 0, "127.0.0.2": 50, "127.0.0.3": 75}
+
+		// weights 100, 50 and 25
+		counts := sendAndCount()
+		Expect(counts["127.0.0.1"]).To(BeNumerically("~", sent*4/7, sent/20))
+		Expect(counts["127.0.0.2"]).To(BeNumerically("~", sent*2/7, sent/20))
+		Expect(counts["127.0.0.3"]).To(BeNumerically("~", sent*1/7, sent/20))
+	})
+
+	It("does not starve a fully loaded doppler", func() {
+		addressList.loads = map[string]int{"127.0.0.1": 0, "127.0.0.2": 0, "127.0.0.3": 100}
+
+		// weights 100, 100 and MinLoadWeight
+		counts := sendAndCount()
+		share := float64(dopplerforwarder.MinLoadWeight) / float64(200+dopplerforwarder.MinLoadWeight)
+		Expect(counts["127.0.0.3"]).To(BeNumerically(">", 0))
+		Expect(counts["127.0.0.3"]).To(BeNumerically("~", int(share*sent), sent/50))
+	})
+
+	It("sends to the dopplers uniformly without loads", func() {
+		counts := sendAndCount()
+		for _, address := range addressList.addresses {
+			Expect(counts[address]).To(BeNumerically("~", sent/3, sent/20))
+		}
+	})
+
+	It("sends to the dopplers uniformly while a load is missing", func() {
+		addressList.loads = map[string]int{"127.0.0.1": 0, "127.0.0.2": 90}
+
+		counts := sendAndCount()
+		for _, address := range addressList.addresses {
+			Expect(counts[address]).To(BeNumerically("~", sent/3, sent/20))
+		}
+	})
+})
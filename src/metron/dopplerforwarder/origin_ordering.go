@@ -0,0 +1,143 @@
+package dopplerforwarder
+
+import (
+	"encoding/binary"
+	"metron/batcher"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/signature"
+)
+
+// originOrdering counts the messages waiting in the retry buffer per origin
+// of the envelopes they hold, so that newer messages with any of those
+// origins can be queued behind them rather than overtake them.
+type originOrdering struct {
+	lock    sync.Mutex
+	pending map[string]int
+}
+
+func newOriginOrdering() *originOrdering {
+	return &originOrdering{pending: make(map[string]int)}
+}
+
+// blocks reports whether message holds an envelope of an origin that has a
+// message waiting in the retry buffer. The message is not parsed while
+// nothing is waiting.
+func (o *originOrdering) blocks(message []byte) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if len(o.pending) == 0 {
+		return false
+	}
+	for _, origin := range messageOrigins(message) {
+		if o.pending[origin] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hold counts message as waiting in the retry buffer.
+func (o *originOrdering) hold(message []byte) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, origin := range messageOrigins(message) {
+		o.pending[origin]++
+	}
+}
+
+// release counts message as no longer waiting, once it was sent or dropped.
+func (o *originOrdering) release(message []byte) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, origin := range messageOrigins(message) {
+		o.pending[origin]--
+		if o.pending[origin] <= 0 {
+			delete(o.pending, origin)
+		}
+	}
+}
+
+// messageOrigins returns the origins of the envelopes in a signed message,
+// each once. A message that cannot be parsed has no origins.
+func messageOrigins(message []byte) []string {
+	var origins []string
+	seen := make(map[string]bool)
+	for _, envelope := range messageEnvelopes(message) {
+		origin, ok := envelopeOrigin(envelope)
+		if ok && !seen[origin] {
+			seen[origin] = true
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// messageEnvelopes returns the marshalled envelopes in a signed message,
+// which is either a single envelope or a batch of them. The envelopes of a
+// batch are returned up to the first one that cannot be parsed.
+func messageEnvelopes(message []byte) [][]byte {
+	if len(message) <= signature.SIGNATURE_LENGTH {
+		return nil
+	}
+	payload := message[signature.SIGNATURE_LENGTH:]
+	if payload[0] != batcher.BatchMarker {
+		return [][]byte{payload}
+	}
+
+	var envelopes [][]byte
+	for rest := payload[1:]; len(rest) > 0; {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length {
+			break
+		}
+		envelopes = append(envelopes, rest[n:n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	return envelopes
+}
+
+// envelopeOrigin reads the origin, field 1, out of a marshalled envelope
+// without unmarshalling the rest of it.
+func envelopeOrigin(envelope []byte) (string, bool) {
+	for len(envelope) > 0 {
+		key, n := binary.Uvarint(envelope)
+		if n <= 0 {
+			return "", false
+		}
+		envelope = envelope[n:]
+
+		var size uint64
+		switch key & 0x7 {
+		case 0:
+			_, n = binary.Uvarint(envelope)
+			if n <= 0 {
+				return "", false
+			}
+			size = uint64(n)
+		case 1:
+			size = 8
+		case 2:
+			length, n := binary.Uvarint(envelope)
+			if n <= 0 || uint64(len(envelope)-n) < length {
+				return "", false
+			}
+			if key>>3 == 1 {
+				return string(envelope[n : n+int(length)]), true
+			}
+			size = uint64(n) + length
+		case 5:
+			size = 4
+		default:
+			return "", false
+		}
+		if uint64(len(envelope)) < size {
+			return "", false
+		}
+		envelope = envelope[size:]
+	}
+	return "", false
+}
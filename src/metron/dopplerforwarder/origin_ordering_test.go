@@ -0,0 +1,188 @@
+package dopplerforwarder_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"metron/batcher"
+	"metron/dopplerforwarder"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/signature"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const orderingTestPort = 52122
+
+// sequencedEnvelope returns a marshalled envelope of origin numbered with
+// sequence.
+func sequencedEnvelope(origin string, sequence int) []byte {
+	envelope, err := proto.Marshal(&events.Envelope{
+		Origin:    proto.String(origin),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String("sequence"),
+			Value: proto.Float64(float64(sequence)),
+			Unit:  proto.String("count"),
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return envelope
+}
+
+// signed puts a blank signature in front of payload, as the signer does.
+func signed(payload []byte) []byte {
+	return append(make([]byte, signature.SIGNATURE_LENGTH), payload...)
+}
+
+// signedBatch batches envelopes as the batcher does and signs the batch.
+func signedBatch(envelopes ...[]byte) []byte {
+	batch := []byte{batcher.BatchMarker}
+	for _, envelope := range envelopes {
+		var length [binary.MaxVarintLen64]byte
+		batch = append(batch, length[:binary.PutUvarint(length[:], uint64(len(envelope)))]...)
+		batch = append(batch, envelope...)
+	}
+	return signed(batch)
+}
+
+// sequenced returns the origins and sequence numbers of the envelopes in a
+// message received by a fake doppler, as "origin-sequence".
+func sequenced(message string) []string {
+	payload := []byte(message)[signature.SIGNATURE_LENGTH:]
+	var envelopes [][]byte
+	if payload[0] != batcher.BatchMarker {
+		envelopes = append(envelopes, payload)
+	} else {
+		for rest := payload[1:]; len(rest) > 0; {
+			length, n := binary.Uvarint(rest)
+			envelopes = append(envelopes, rest[n:n+int(length)])
+			rest = rest[n+int(length):]
+		}
+	}
+
+	var sequences []string
+	for _, marshalled := range envelopes {
+		envelope := &events.Envelope{}
+		Expect(proto.Unmarshal(marshalled, envelope)).To(Succeed())
+		sequences = append(sequences, fmt.Sprintf("%s-%g", envelope.GetOrigin(), envelope.GetValueMetric().GetValue()))
+	}
+	return sequences
+}
+
+var _ = Describe("Origin ordering", func() {
+	var (
+		doppler       *fakeDoppler
+		forwarder     *dopplerforwarder.Forwarder
+		messageChan   chan []byte
+		forwarderDone chan struct{}
+	)
+
+	receive := func() []string {
+		var message string
+		Eventually(doppler.messages).Should(Receive(&message))
+		return sequenced(message)
+	}
+
+	// start forwards with a retry buffer of maxMessages messages while no
+	// doppler is listening yet.
+	start := func(maxMessages int) {
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, &fakeAddressList{addresses: []string{"127.0.0.1"}}, orderingTestPort, 0, nil, loggertesthelper.Logger())
+		forwarder.SetRetryBuffer(maxMessages, 100000)
+		forwarder.SetOriginOrdering(true)
+		forwarder.SetSendRetries(0, 0)
+		messageChan = make(chan []byte)
+		forwarderDone = make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	}
+
+	// failed counts the messages buffered or dropped.
+	failed := func() int {
+		return metricValue(forwarder, "retryBufferedMessages").(int) + int(metricValue(forwarder, "droppedMessages").(uint64))
+	}
+
+	// fail sends message while doppler is down and waits for it to be
+	// buffered.
+	fail := func(message []byte) {
+		before := failed()
+		messageChan <- message
+		Eventually(failed).Should(Equal(before + 1))
+	}
+
+	// startDoppler starts the doppler and waits for the reconnect backoff of
+	// the failed sends to pass.
+	startDoppler := func() {
+		doppler = newFakeDopplerOn("127.0.0.1", orderingTestPort, nil)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	BeforeEach(func() {
+		dopplerforwarder.RetryInterval = 300 * time.Millisecond
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+		forwarder.Stop()
+		if doppler != nil {
+			doppler.stop()
+			doppler = nil
+		}
+		dopplerforwarder.RetryInterval = 100 * time.Millisecond
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+	})
+
+	It("queues the messages of an origin behind its retried message while other origins keep flowing", func() {
+		start(100)
+		fail(signed(sequencedEnvelope("ordered", 1)))
+		startDoppler()
+
+		messageChan <- signed(sequencedEnvelope("ordered", 2))
+		messageChan <- signed(sequencedEnvelope("other", 1))
+		Expect(receive()).To(Equal([]string{"other-1"}))
+		Expect(metricValue(forwarder, "heldBackMessages")).To(BeEquivalentTo(1))
+
+		Expect(receive()).To(Equal([]string{"ordered-1"}))
+		Expect(receive()).To(Equal([]string{"ordered-2"}))
+
+		messageChan <- signed(sequencedEnvelope("ordered", 3))
+		Expect(receive()).To(Equal([]string{"ordered-3"}))
+		Expect(metricValue(forwarder, "heldBackMessages")).To(BeEquivalentTo(1))
+	})
+
+	It("holds back batches holding any origin that has a message waiting", func() {
+		start(100)
+		fail(signedBatch(sequencedEnvelope("ordered", 1), sequencedEnvelope("ordered", 2)))
+		startDoppler()
+
+		messageChan <- signedBatch(sequencedEnvelope("other", 1), sequencedEnvelope("ordered", 3))
+		messageChan <- signedBatch(sequencedEnvelope("other", 2), sequencedEnvelope("ordered", 4))
+		messageChan <- signedBatch(sequencedEnvelope("unrelated", 1), sequencedEnvelope("unrelated", 2))
+		Expect(receive()).To(Equal([]string{"unrelated-1", "unrelated-2"}))
+		Expect(metricValue(forwarder, "heldBackMessages")).To(BeEquivalentTo(2))
+
+		Expect(receive()).To(Equal([]string{"ordered-1", "ordered-2"}))
+		Expect(receive()).To(Equal([]string{"other-1", "ordered-3"}))
+		Expect(receive()).To(Equal([]string{"other-2", "ordered-4"}))
+	})
+
+	It("stops holding back an origin once its waiting message is dropped", func() {
+		start(1)
+		fail(signed(sequencedEnvelope("dropped", 1)))
+		fail(signed(sequencedEnvelope("other", 1)))
+		Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(1))
+		startDoppler()
+
+		messageChan <- signed(sequencedEnvelope("dropped", 2))
+		Expect(receive()).To(Equal([]string{"dropped-2"}))
+		Expect(metricValue(forwarder, "heldBackMessages")).To(BeEquivalentTo(0))
+	})
+})
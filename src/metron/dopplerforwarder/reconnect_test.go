@@ -0,0 +1,152 @@
+package dopplerforwarder_test
+
+import (
+	"fmt"
+	"metron/dopplerforwarder"
+	"runtime"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const reconnectTestPort = 52119
+
+var _ = Describe("Reconnecting to dopplers", func() {
+	var (
+		hosts         []string
+		dopplers      map[string]*fakeDoppler
+		forwarder     *dopplerforwarder.Forwarder
+		messageChan   chan []byte
+		forwarderDone chan struct{}
+		received      map[string]bool
+		receivedBy    map[string]int
+	)
+
+	// collect drains the messages the dopplers received so far and returns how
+	// many different messages were received in total.
+	collect := func() int {
+		for host, doppler := range dopplers {
+			for drained := false; !drained; {
+				select {
+				case message := <-doppler.messages:
+					received[message] = true
+					receivedBy[host]++
+				default:
+					drained = true
+				}
+			}
+		}
+		return len(received)
+	}
+
+	send := func(first, last int, between func(i int)) {
+		for i := first; i <= last; i++ {
+			messageChan <- []byte(fmt.Sprintf("message-%d", i))
+			if between != nil {
+				between(i)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+
+	start := func(hostList ...string) {
+		hosts = hostList
+		dopplers = make(map[string]*fakeDoppler)
+		received = make(map[string]bool)
+		receivedBy = make(map[string]int)
+		for _, host := range hosts {
+			dopplers[host] = newFakeDopplerOn(host, reconnectTestPort, nil)
+		}
+
+		addressList := &fakeAddressList{addresses: hosts}
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, addressList, reconnectTestPort, 0, nil, loggertesthelper.Logger())
+		forwarder.SetRetryBuffer(1000, 100000)
+		messageChan = make(chan []byte)
+		forwarderDone = make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	}
+
+	BeforeEach(func() {
+		dopplerforwarder.RetryInterval = 10 * time.Millisecond
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+		forwarder.Stop()
+		for _, doppler := range dopplers {
+			doppler.stop()
+		}
+		dopplerforwarder.RetryInterval = 100 * time.Millisecond
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+	})
+
+	It("sends to the other dopplers while one is down, losing at most the in-flight frame", func() {
+		dopplerforwarder.MinReconnectBackoff = time.Second
+		start("127.0.0.1", "127.0.0.2")
+
+		send(0, 99, func(i int) {
+			if i == 30 {
+				dopplers["127.0.0.1"].stop()
+			}
+		})
+		Eventually(collect).Should(BeNumerically(">=", 99))
+		Expect(metricValue(forwarder, "tcpUnavailableDopplers")).To(BeEquivalentTo(1))
+
+		receivedByFirst := receivedBy["127.0.0.1"]
+		dopplers["127.0.0.1"] = newFakeDopplerOn("127.0.0.1", reconnectTestPort, nil)
+		Eventually(func() int {
+			send(100, 100, nil)
+			collect()
+			return receivedBy["127.0.0.1"]
+		}, 3*time.Second).Should(BeNumerically(">", receivedByFirst))
+		Expect(metricValue(forwarder, "tcpUnavailableDopplers")).To(BeEquivalentTo(0))
+	})
+
+	It("sends the messages that could not be sent to any doppler once one is back", func() {
+		start("127.0.0.1")
+
+		send(0, 9, nil)
+		Eventually(collect).Should(Equal(10))
+
+		dopplers["127.0.0.1"].stop()
+		send(10, 19, nil)
+		Eventually(func() interface{} { return metricValue(forwarder, "retryBufferedMessages") }).Should(BeNumerically(">=", 9))
+
+		dopplers["127.0.0.1"] = newFakeDopplerOn("127.0.0.1", reconnectTestPort, nil)
+		Eventually(collect, 2*time.Second).Should(BeNumerically(">=", 19))
+		Expect(received).To(HaveKey("message-19"))
+		Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(0))
+	})
+
+	It("does not leak goroutines when dopplers restart", func() {
+		start("127.0.0.1", "127.0.0.2")
+		send(0, 19, nil)
+		Eventually(collect).Should(Equal(20))
+		goroutines := runtime.NumGoroutine()
+
+		for restart := 0; restart < 3; restart++ {
+			for _, host := range hosts {
+				dopplers[host].stop()
+			}
+			send(restart*10+20, restart*10+29, nil)
+			for _, host := range hosts {
+				dopplers[host] = newFakeDopplerOn(host, reconnectTestPort, nil)
+			}
+			last := fmt.Sprintf("message-%d", restart*10+29)
+			Eventually(func() bool {
+				collect()
+				return received[last]
+			}, 2*time.Second).Should(BeTrue())
+		}
+
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", goroutines))
+	})
+})
@@ -0,0 +1,150 @@
+package dopplerforwarder
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/servicediscovery"
+)
+
+var (
+	errNoDopplersFound    = errors.New("no dopplers found")
+	errAddressListStopped = errors.New("address list stopped")
+)
+
+// ReloadableAddressList hands out the addresses of another list, which can be
+// replaced while metron runs, e.g. when its config is reloaded. Clients that
+// ask for the addresses on every send switch over to the dopplers of the new
+// list from their next send on.
+type ReloadableAddressList struct {
+	lock           sync.RWMutex
+	current        servicediscovery.ServerAddressList
+	updateInterval time.Duration
+	running        bool
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func NewReloadableAddressList(list servicediscovery.ServerAddressList) *ReloadableAddressList {
+	return &ReloadableAddressList{
+		current:  list,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Run runs the current list, and every list replacing it, with
+// updateInterval until Stop is called.
+func (list *ReloadableAddressList) Run(updateInterval time.Duration) {
+	list.lock.Lock()
+	select {
+	case <-list.stopChan:
+		list.lock.Unlock()
+		return
+	default:
+	}
+	list.updateInterval = updateInterval
+	list.running = true
+	go list.current.Run(updateInterval)
+	list.lock.Unlock()
+
+	<-list.stopChan
+}
+
+// Stop stops the current list.
+func (list *ReloadableAddressList) Stop() {
+	list.stopOnce.Do(func() {
+		list.lock.Lock()
+		defer list.lock.Unlock()
+
+		close(list.stopChan)
+		list.current.Stop()
+	})
+}
+
+// Replace makes the list hand out the addresses of next instead of the
+// current list, which is stopped. While running, next is started and the
+// addresses of the current list are handed out until next has found
+// dopplers. If it finds none within timeout, next is stopped and Replace
+// returns an error, keeping the current list.
+func (list *ReloadableAddressList) Replace(next servicediscovery.ServerAddressList, timeout time.Duration) error {
+	list.lock.RLock()
+	running, updateInterval := list.running, list.updateInterval
+	list.lock.RUnlock()
+
+	if running {
+		go next.Run(updateInterval)
+		if !waitForAddresses(next, timeout) {
+			next.Stop()
+			return errNoDopplersFound
+		}
+	}
+
+	list.lock.Lock()
+	select {
+	case <-list.stopChan:
+		list.lock.Unlock()
+		next.Stop()
+		return errAddressListStopped
+	default:
+	}
+	previous := list.current
+	list.current = next
+	list.lock.Unlock()
+
+	previous.Stop()
+	return nil
+}
+
+func waitForAddresses(list servicediscovery.ServerAddressList, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for len(list.GetAddresses()) == 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (list *ReloadableAddressList) GetAddresses() []string {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.current.GetAddresses()
+}
+
+// CrossZone reports whether the current list hands out the addresses of
+// dopplers outside metron's zone, if it tells.
+func (list *ReloadableAddressList) CrossZone() bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	if zones, ok := list.current.(zoneReporter); ok {
+		return zones.CrossZone()
+	}
+	return false
+}
+
+// ReportSend passes the outcome of a send on to the current list, if it
+// takes it into account.
+func (list *ReloadableAddressList) ReportSend(address string, err error) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	if sends, ok := list.current.(sendReporter); ok {
+		sends.ReportSend(address, err)
+	}
+}
+
+// Loads returns the loads of the dopplers of the current list, if it knows
+// them.
+func (list *ReloadableAddressList) Loads() map[string]int {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	if loads, ok := list.current.(loadReporter); ok {
+		return loads.Loads()
+	}
+	return nil
+}
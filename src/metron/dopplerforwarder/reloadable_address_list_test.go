@@ -0,0 +1,169 @@
+package dopplerforwarder_test
+
+import (
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const reloadTestPort = 52117
+
+// runningAddressList finds its addresses only once it runs, like a list
+// reading them from etcd.
+type runningAddressList struct {
+	addresses []string
+
+	sync.Mutex
+	running bool
+	stopped bool
+}
+
+func (list *runningAddressList) Run(time.Duration) {
+	list.Lock()
+	defer list.Unlock()
+	list.running = true
+}
+
+func (list *runningAddressList) Stop() {
+	list.Lock()
+	defer list.Unlock()
+	list.stopped = true
+}
+
+func (list *runningAddressList) GetAddresses() []string {
+	list.Lock()
+	defer list.Unlock()
+	if !list.running {
+		return nil
+	}
+	return list.addresses
+}
+
+func (list *runningAddressList) Stopped() bool {
+	list.Lock()
+	defer list.Unlock()
+	return list.stopped
+}
+
+var _ = Describe("ReloadableAddressList", func() {
+	var (
+		current *runningAddressList
+		list    *dopplerforwarder.ReloadableAddressList
+	)
+
+	BeforeEach(func() {
+		current = &runningAddressList{addresses: []string{"10.0.0.1"}}
+		list = dopplerforwarder.NewReloadableAddressList(current)
+	})
+
+	AfterEach(func() {
+		list.Stop()
+	})
+
+	It("replaces the list right away while not running", func() {
+		Expect(list.Replace(&fakeAddressList{addresses: []string{"10.0.0.2"}}, 0)).To(Succeed())
+
+		Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+		Expect(current.Stopped()).To(BeTrue())
+	})
+
+	Context("while running", func() {
+		BeforeEach(func() {
+			go list.Run(time.Second)
+			Eventually(list.GetAddresses).Should(Equal([]string{"10.0.0.1"}))
+		})
+
+		It("runs the new list and hands out its addresses once it has found dopplers", func() {
+			next := &runningAddressList{addresses: []string{"10.0.0.2"}}
+			Expect(list.Replace(next, time.Second)).To(Succeed())
+
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.2"}))
+			Expect(current.Stopped()).To(BeTrue())
+			Expect(next.Stopped()).To(BeFalse())
+		})
+
+		It("keeps the current list when the new one finds no dopplers", func() {
+			next := &runningAddressList{}
+			Expect(list.Replace(next, 50*time.Millisecond)).To(MatchError("no dopplers found"))
+
+			Expect(list.GetAddresses()).To(Equal([]string{"10.0.0.1"}))
+			Expect(current.Stopped()).To(BeFalse())
+			Expect(next.Stopped()).To(BeTrue())
+		})
+
+		It("stops the current list when stopped", func() {
+			list.Stop()
+
+			Expect(current.Stopped()).To(BeTrue())
+			Expect(list.Replace(&runningAddressList{addresses: []string{"10.0.0.2"}}, time.Second)).To(MatchError("address list stopped"))
+		})
+	})
+
+	It("reports the zones and loads of the current list", func() {
+		Expect(list.CrossZone()).To(BeFalse())
+		Expect(list.Loads()).To(BeNil())
+
+		zoneList := &fakeZoneAddressList{fakeAddressList: fakeAddressList{addresses: []string{"10.0.0.2"}}}
+		zoneList.setCrossZone(true)
+		Expect(list.Replace(zoneList, 0)).To(Succeed())
+		Expect(list.CrossZone()).To(BeTrue())
+
+		Expect(list.Replace(&fakeLoadAddressList{loads: map[string]int{"10.0.0.3": 10}}, 0)).To(Succeed())
+		Expect(list.Loads()).To(Equal(map[string]int{"10.0.0.3": 10}))
+	})
+
+	Context("behind a forwarder", func() {
+		var (
+			oldDoppler  *fakeDoppler
+			newDoppler  *fakeDoppler
+			registry    *metrics.Registry
+			forwarder   *dopplerforwarder.Forwarder
+			messageChan chan []byte
+			done        chan struct{}
+		)
+
+		BeforeEach(func() {
+			oldDoppler = newFakeDopplerOn("127.0.0.1", reloadTestPort, nil)
+			newDoppler = newFakeDopplerOn("127.0.0.2", reloadTestPort, nil)
+			list = dopplerforwarder.NewReloadableAddressList(dopplerforwarder.NewStaticAddressList([]string{"127.0.0.1"}))
+			go list.Run(time.Second)
+
+			registry = metrics.NewRegistry()
+			forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, list, reloadTestPort, 0, nil, loggertesthelper.Logger())
+			forwarder.SetMetricsRegistry(registry)
+			messageChan = make(chan []byte)
+			done = make(chan struct{})
+			go func() {
+				forwarder.Run(messageChan)
+				close(done)
+			}()
+		})
+
+		AfterEach(func() {
+			close(messageChan)
+			Eventually(done).Should(BeClosed())
+			forwarder.Stop()
+			oldDoppler.stop()
+			newDoppler.stop()
+		})
+
+		It("keeps forwarding while switching to the new dopplers", func() {
+			messageChan <- []byte("before")
+			Eventually(oldDoppler.messages).Should(Receive(Equal("before")))
+
+			Expect(list.Replace(dopplerforwarder.NewStaticAddressList([]string{"127.0.0.2"}), time.Second)).To(Succeed())
+
+			messageChan <- []byte("after")
+			Eventually(newDoppler.messages).Should(Receive(Equal("after")))
+			Consistently(oldDoppler.messages).ShouldNot(Receive())
+			Expect(registry.Counter("dopplerForwarder.sendErrors")).To(BeZero())
+			Expect(registry.Counter("dopplerForwarder.tcpSentMessages")).To(BeEquivalentTo(2))
+		})
+	})
+})
@@ -0,0 +1,102 @@
+package dopplerforwarder
+
+import (
+	"metron/bufferpool"
+	"sync"
+)
+
+// retryBuffer queues the messages that could not be sent to any doppler, up
+// to maxMessages messages and maxBytes bytes. Once either limit would be
+// exceeded the oldest messages are dropped and returned to the buffer pool,
+// after being passed to dropped if it is set.
+type retryBuffer struct {
+	maxMessages int
+	maxBytes    int
+	pool        *bufferpool.Pool
+	dropped     func(message []byte)
+
+	lock     sync.Mutex
+	messages [][]byte
+	bytes    int
+}
+
+func newRetryBuffer(maxMessages int, maxBytes int, pool *bufferpool.Pool) *retryBuffer {
+	return &retryBuffer{
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+		pool:        pool,
+	}
+}
+
+// push queues message behind every other message and returns how many
+// messages were dropped to make room for it, including message itself if it
+// is larger than maxBytes.
+func (b *retryBuffer) push(message []byte) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(message) > b.maxBytes {
+		b.drop(message)
+		return 1
+	}
+
+	dropped := 0
+	for len(b.messages) >= b.maxMessages || b.bytes+len(message) > b.maxBytes {
+		b.bytes -= len(b.messages[0])
+		b.drop(b.messages[0])
+		b.messages[0] = nil
+		b.messages = b.messages[1:]
+		dropped++
+	}
+
+	b.messages = append(b.messages, message)
+	b.bytes += len(message)
+	return dropped
+}
+
+// pushFront puts back a message taken with pop that could not be sent. It is
+// dropped, as the oldest message, if the buffer has filled up in the meantime.
+func (b *retryBuffer) pushFront(message []byte) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.messages) >= b.maxMessages || b.bytes+len(message) > b.maxBytes {
+		b.drop(message)
+		return 1
+	}
+
+	b.messages = append([][]byte{message}, b.messages...)
+	b.bytes += len(message)
+	return 0
+}
+
+// pop takes the oldest message out of the buffer, or returns nil if it is
+// empty.
+func (b *retryBuffer) pop() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.messages) == 0 {
+		return nil
+	}
+
+	message := b.messages[0]
+	b.messages[0] = nil
+	b.messages = b.messages[1:]
+	b.bytes -= len(message)
+	return message
+}
+
+func (b *retryBuffer) drop(message []byte) {
+	if b.dropped != nil {
+		b.dropped(message)
+	}
+	b.pool.Put(message)
+}
+
+func (b *retryBuffer) len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.messages)
+}
@@ -0,0 +1,34 @@
+package dopplerforwarder
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultSendRetries and DefaultSendRetryDelay are the send retry policy
+	// of a new forwarder, see SetSendRetries.
+	DefaultSendRetries    = 2
+	DefaultSendRetryDelay = 10 * time.Millisecond
+)
+
+// sendRetryPolicy bounds how often a stream client pool retries a message
+// that could not be sent, and how long it waits before each retry.
+type sendRetryPolicy struct {
+	maxRetries int
+	delay      time.Duration
+	report     func()
+}
+
+// wait sleeps before a retry for between half and one and a half times the
+// delay, so that the metrons that lost the same doppler do not all retry
+// at once.
+func (p *sendRetryPolicy) wait() {
+	if p.report != nil {
+		p.report()
+	}
+	if p.delay <= 0 {
+		return
+	}
+	time.Sleep(p.delay/2 + time.Duration(rand.Int63n(int64(p.delay))))
+}
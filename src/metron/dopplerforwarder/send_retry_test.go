@@ -0,0 +1,92 @@
+package dopplerforwarder_test
+
+import (
+	"fmt"
+	"metron/dopplerforwarder"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const sendRetryTestPort = 52121
+
+var _ = Describe("Send retries", func() {
+	var (
+		healthy       *fakeDoppler
+		forwarder     *dopplerforwarder.Forwarder
+		messageChan   chan []byte
+		forwarderDone chan struct{}
+	)
+
+	// start forwards to the dopplers on hosts, of which only 127.0.0.2 is
+	// listening, so sends to the others fail to connect.
+	start := func(maxRetries int, delay time.Duration, hosts ...string) {
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, &fakeAddressList{addresses: hosts}, sendRetryTestPort, 0, nil, loggertesthelper.Logger())
+		forwarder.SetSendRetries(maxRetries, delay)
+		messageChan = make(chan []byte)
+		forwarderDone = make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	}
+
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			messageChan <- []byte(fmt.Sprintf("message-%d", i))
+		}
+	}
+
+	BeforeEach(func() {
+		dopplerforwarder.MinReconnectBackoff = time.Nanosecond
+		healthy = newFakeDopplerOn("127.0.0.2", sendRetryTestPort, nil)
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+		forwarder.Stop()
+		healthy.stop()
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+	})
+
+	It("retries the messages the failing doppler did not take on the healthy one", func() {
+		start(1, time.Millisecond, "127.0.0.1", "127.0.0.2")
+
+		send(50)
+		for i := 0; i < 50; i++ {
+			Eventually(healthy.messages).Should(Receive(Equal(fmt.Sprintf("message-%d", i))))
+		}
+		Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(0))
+		Expect(metricValue(forwarder, "sendRetries")).To(BeNumerically(">", 0))
+	})
+
+	It("drops the messages that fail once the retries are used up", func() {
+		start(0, time.Millisecond, "127.0.0.1", "127.0.0.2")
+
+		send(50)
+		Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeNumerically(">", 0))
+		Expect(metricValue(forwarder, "sendRetries")).To(BeEquivalentTo(0))
+	})
+
+	It("gives up after the retries when no doppler takes the message", func() {
+		start(2, time.Millisecond, "127.0.0.1", "127.0.0.3", "127.0.0.4")
+
+		send(10)
+		Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeEquivalentTo(10))
+		Expect(metricValue(forwarder, "sendRetries")).To(BeEquivalentTo(20))
+	})
+
+	It("waits around the delay before every retry", func() {
+		start(2, 100*time.Millisecond, "127.0.0.1", "127.0.0.3", "127.0.0.4")
+
+		sent := time.Now()
+		send(2)
+		Eventually(func() interface{} { return metricValue(forwarder, "droppedMessages") }).Should(BeEquivalentTo(1))
+		Expect(time.Since(sent)).To(BeNumerically(">=", 100*time.Millisecond))
+		Expect(time.Since(sent)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+})
@@ -0,0 +1,65 @@
+package dopplerforwarder
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/cloudfoundry/loggregatorlib/clientpool"
+)
+
+// SequenceMarker starts the sequence header metron puts in front of a signed
+// datagram when it numbers its datagrams to doppler. A signature may start
+// with the marker by chance, so doppler must only be sent numbered datagrams
+// once it strips the header.
+var SequenceMarker = [4]byte{0xff, 'S', 'E', 'Q'}
+
+// SequenceHeaderLength is the length of the sequence header: the
+// SequenceMarker followed by the sequence number as a big endian uint64.
+const SequenceHeaderLength = 12
+
+// udpSequencer numbers the datagrams sent to every doppler, starting at 1
+// for each, so that doppler can count the datagrams lost on the way.
+type udpSequencer struct {
+	lock    sync.Mutex
+	numbers map[clientpool.LoggregatorClient]uint64
+}
+
+func newUDPSequencer() *udpSequencer {
+	return &udpSequencer{
+		numbers: make(map[clientpool.LoggregatorClient]uint64),
+	}
+}
+
+// stamp writes the sequence header for the next datagram to client, followed
+// by message, into buffer. The numbers of clients no longer in the pool are
+// forgotten whenever a new client shows up, as the pool only replaces its
+// clients when its dopplers change.
+func (s *udpSequencer) stamp(buffer []byte, client clientpool.LoggregatorClient, message []byte, pool UDPClientPool) []byte {
+	s.lock.Lock()
+	number, known := s.numbers[client]
+	if !known {
+		s.forgetStaleClients(pool.ListClients())
+	}
+	number++
+	s.numbers[client] = number
+	s.lock.Unlock()
+
+	var header [SequenceHeaderLength]byte
+	copy(header[:], SequenceMarker[:])
+	binary.BigEndian.PutUint64(header[len(SequenceMarker):], number)
+
+	buffer = append(buffer, header[:]...)
+	return append(buffer, message...)
+}
+
+func (s *udpSequencer) forgetStaleClients(clients []clientpool.LoggregatorClient) {
+	current := make(map[clientpool.LoggregatorClient]bool, len(clients))
+	for _, client := range clients {
+		current[client] = true
+	}
+	for client := range s.numbers {
+		if !current[client] {
+			delete(s.numbers, client)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package dopplerforwarder_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"metron/dopplerforwarder"
+	"net"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/clientpool"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const sequenceUDPPort = 52118
+
+type sequencedDatagram struct {
+	number  uint64
+	message string
+}
+
+func listenForSequencedDatagrams(host string) (net.PacketConn, <-chan sequencedDatagram) {
+	connection, err := net.ListenPacket("udp", net.JoinHostPort(host, "52118"))
+	Expect(err).NotTo(HaveOccurred())
+
+	datagrams := make(chan sequencedDatagram, 100)
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, _, err := connection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if n < dopplerforwarder.SequenceHeaderLength || !bytes.Equal(buffer[:4], dopplerforwarder.SequenceMarker[:]) {
+				continue
+			}
+			datagrams <- sequencedDatagram{
+				number:  binary.BigEndian.Uint64(buffer[4:dopplerforwarder.SequenceHeaderLength]),
+				message: string(buffer[dopplerforwarder.SequenceHeaderLength:n]),
+			}
+		}
+	}()
+	return connection, datagrams
+}
+
+var _ = Describe("UDP sequence numbers", func() {
+	var (
+		addressList *fakeAddressList
+		messageChan chan []byte
+		forwarder   *dopplerforwarder.Forwarder
+	)
+
+	start := func() {
+		logger := loggertesthelper.Logger()
+		udpPool := clientpool.NewLoggregatorClientPool(logger, sequenceUDPPort, addressList)
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.UDP}, udpPool, addressList, tcpPort, tlsPort, nil, logger)
+		forwarder.SetUDPSequenceNumbers(true)
+		go forwarder.Run(messageChan)
+	}
+
+	BeforeEach(func() {
+		addressList = &fakeAddressList{addresses: []string{"127.0.0.1"}}
+		messageChan = make(chan []byte)
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+	})
+
+	It("puts a sequence header in front of every datagram", func() {
+		connection, datagrams := listenForSequencedDatagrams("127.0.0.1")
+		defer connection.Close()
+		start()
+
+		messageChan <- []byte("first")
+		messageChan <- []byte("second")
+
+		Eventually(datagrams).Should(Receive(Equal(sequencedDatagram{number: 1, message: "first"})))
+		Eventually(datagrams).Should(Receive(Equal(sequencedDatagram{number: 2, message: "second"})))
+	})
+
+	It("numbers the datagrams to every doppler on their own", func() {
+		firstConnection, firstDatagrams := listenForSequencedDatagrams("127.0.0.1")
+		defer firstConnection.Close()
+		secondConnection, secondDatagrams := listenForSequencedDatagrams("127.0.0.2")
+		defer secondConnection.Close()
+		addressList.addresses = []string{"127.0.0.1", "127.0.0.2"}
+		start()
+
+		for i := 0; i < 100; i++ {
+			messageChan <- []byte("message")
+		}
+
+		expectConsecutive := func(datagrams <-chan sequencedDatagram) int {
+			var received int
+			for {
+				select {
+				case datagram := <-datagrams:
+					received++
+					Expect(datagram.number).To(BeEquivalentTo(received))
+				default:
+					return received
+				}
+			}
+		}
+		Eventually(func() int {
+			return len(firstDatagrams) + len(secondDatagrams)
+		}).Should(Equal(100))
+		Expect(expectConsecutive(firstDatagrams)).To(BeNumerically(">", 0))
+		Expect(expectConsecutive(secondDatagrams)).To(BeNumerically(">", 0))
+	})
+
+	It("leaves the datagrams alone by default", func() {
+		connection, err := net.ListenPacket("udp", "127.0.0.1:52118")
+		Expect(err).NotTo(HaveOccurred())
+		defer connection.Close()
+
+		logger := loggertesthelper.Logger()
+		udpPool := clientpool.NewLoggregatorClientPool(logger, sequenceUDPPort, addressList)
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.UDP}, udpPool, addressList, tcpPort, tlsPort, nil, logger)
+		go forwarder.Run(messageChan)
+		messageChan <- []byte("message")
+
+		buffer := make([]byte, 100)
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := connection.ReadFrom(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buffer[:n])).To(Equal("message"))
+	})
+})
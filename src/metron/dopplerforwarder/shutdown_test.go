@@ -0,0 +1,131 @@
+package dopplerforwarder_test
+
+import (
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const shutdownTestPort = 52123
+
+var _ = Describe("Shutting down", func() {
+	var (
+		doppler       *fakeDoppler
+		forwarder     *dopplerforwarder.Forwarder
+		registry      *metrics.Registry
+		messageChan   chan []byte
+		forwarderDone chan struct{}
+	)
+
+	receive := func() []string {
+		var message string
+		Eventually(doppler.messages, 2*time.Second).Should(Receive(&message))
+		return sequenced(message)
+	}
+
+	// start forwards with a retry buffer and the shutdown timeout while no
+	// doppler is listening yet.
+	start := func(shutdownTimeout time.Duration) {
+		registry = metrics.NewRegistry()
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.TCP}, nil, &fakeAddressList{addresses: []string{"127.0.0.1"}}, shutdownTestPort, 0, nil, loggertesthelper.Logger())
+		forwarder.SetMetricsRegistry(registry)
+		forwarder.SetRetryBuffer(100, 100000)
+		forwarder.SetShutdownTimeout(shutdownTimeout)
+		forwarder.SetSendRetries(0, 0)
+		messageChan = make(chan []byte)
+		forwarderDone = make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	}
+
+	// fail sends message while doppler is down and waits for it to be
+	// buffered.
+	fail := func(message []byte) {
+		before := metricValue(forwarder, "retryBufferedMessages").(int)
+		messageChan <- message
+		Eventually(func() interface{} { return metricValue(forwarder, "retryBufferedMessages") }).Should(Equal(before + 1))
+	}
+
+	BeforeEach(func() {
+		dopplerforwarder.RetryInterval = 20 * time.Millisecond
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+		doppler = nil
+	})
+
+	AfterEach(func() {
+		Eventually(forwarderDone, 2*time.Second).Should(BeClosed())
+		forwarder.Stop()
+		if doppler != nil {
+			doppler.stop()
+		}
+		dopplerforwarder.RetryInterval = 100 * time.Millisecond
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+	})
+
+	It("sends the messages left in the retry buffer to a doppler that is back before the shutdown timeout", func() {
+		start(2 * time.Second)
+		fail(signed(sequencedEnvelope("origin", 1)))
+		fail(signedBatch(sequencedEnvelope("origin", 2), sequencedEnvelope("origin", 3)))
+		close(messageChan)
+		Consistently(forwarderDone).ShouldNot(BeClosed())
+
+		doppler = newFakeDopplerOn("127.0.0.1", shutdownTestPort, nil)
+		Expect(receive()).To(Equal([]string{"origin-1"}))
+		Expect(receive()).To(Equal([]string{"origin-2", "origin-3"}))
+		Eventually(forwarderDone).Should(BeClosed())
+		Expect(forwarder.AbandonedEnvelopes()).To(BeZero())
+		Expect(metricValue(forwarder, "retryBufferedMessages")).To(BeEquivalentTo(0))
+	})
+
+	It("abandons and counts the envelopes left once the shutdown timeout has passed", func() {
+		start(200 * time.Millisecond)
+		fail(signed(sequencedEnvelope("origin", 1)))
+		fail(signedBatch(sequencedEnvelope("origin", 2), sequencedEnvelope("origin", 3)))
+
+		closedAt := time.Now()
+		close(messageChan)
+		Eventually(forwarderDone, time.Second).Should(BeClosed())
+		Expect(time.Since(closedAt)).To(BeNumerically(">=", 200*time.Millisecond))
+
+		Expect(forwarder.AbandonedEnvelopes()).To(BeEquivalentTo(3))
+		Expect(metricValue(forwarder, "abandonedEnvelopes")).To(BeEquivalentTo(3))
+		Expect(registry.Counter(metrics.DopplerAbandonedEnvelopes)).To(BeEquivalentTo(3))
+		Expect(metricValue(forwarder, "retryBufferedMessages")).To(BeEquivalentTo(0))
+	})
+
+	It("abandons the messages left right away without a shutdown timeout", func() {
+		start(0)
+		fail(signed(sequencedEnvelope("origin", 1)))
+
+		close(messageChan)
+		Eventually(forwarderDone, 100*time.Millisecond).Should(BeClosed())
+		Expect(forwarder.AbandonedEnvelopes()).To(BeEquivalentTo(1))
+	})
+
+	It("sends a last message once Run has returned", func() {
+		start(0)
+		doppler = newFakeDopplerOn("127.0.0.1", shutdownTestPort, nil)
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+
+		Expect(forwarder.Send(signed(sequencedEnvelope("origin", 1)))).To(BeTrue())
+		Expect(receive()).To(Equal([]string{"origin-1"}))
+		Expect(metricValue(forwarder, "tcpSentMessages")).To(BeEquivalentTo(1))
+	})
+
+	It("reports a last message it could not send", func() {
+		start(0)
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+
+		Expect(forwarder.Send(signed(sequencedEnvelope("origin", 1)))).To(BeFalse())
+		Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,23 @@
+package dopplerforwarder
+
+import (
+	"time"
+)
+
+// StaticAddressList hands out a fixed list of doppler addresses, for groups
+// of dopplers that do not register in etcd.
+type StaticAddressList struct {
+	addresses []string
+}
+
+func NewStaticAddressList(addresses []string) *StaticAddressList {
+	return &StaticAddressList{addresses: addresses}
+}
+
+func (list *StaticAddressList) Run(updateInterval time.Duration) {}
+
+func (list *StaticAddressList) Stop() {}
+
+func (list *StaticAddressList) GetAddresses() []string {
+	return list.addresses
+}
@@ -0,0 +1,433 @@
+package dopplerforwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/clientpool"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// MinReconnectBackoff is how long a stream client waits before
+	// reconnecting after its first failure. The wait doubles with every
+	// further failure, up to MaxReconnectBackoff.
+	MinReconnectBackoff = 100 * time.Millisecond
+	MaxReconnectBackoff = 30 * time.Second
+
+	DialTimeout  = time.Second
+	WriteTimeout = time.Second
+)
+
+var (
+	errReconnectPending = errors.New("waiting to reconnect")
+	errClientStopped    = errors.New("client stopped")
+)
+
+// streamClient sends frames to one doppler over a persistent connection, or
+// binary messages over a persistent websocket. The connection is
+// re-established on the next send after it fails, but not before the backoff
+// has passed. Sends fail right away while waiting.
+type streamClient struct {
+	address     string
+	tlsConfig   *tls.Config
+	websocket   bool
+	compression *frameCompression
+	written     func(host string, bytes int)
+	logger      *gosteno.Logger
+
+	lock               sync.Mutex
+	conn               net.Conn
+	wsConn             *websocket.Conn
+	connectedAt        time.Time
+	acceptsCompression bool
+	backoff            time.Duration
+	retryAt            time.Time
+	stopped            bool
+	frameBuffer        []byte
+	compressor         frameCompressor
+}
+
+// newStreamClient returns a client that compresses the frames it sends to
+// dopplers that accept compressed frames, unless compression is nil.
+func newStreamClient(address string, tlsConfig *tls.Config, compression *frameCompression, logger *gosteno.Logger) *streamClient {
+	return &streamClient{
+		address:     address,
+		tlsConfig:   tlsConfig,
+		compression: compression,
+		logger:      logger,
+	}
+}
+
+// host returns the address of the doppler without the port, as given by the
+// address list.
+func (c *streamClient) host() string {
+	host, _, err := net.SplitHostPort(c.address)
+	if err != nil {
+		return c.address
+	}
+	return host
+}
+
+func (c *streamClient) Send(message []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	if c.wsConn != nil {
+		c.wsConn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	} else {
+		c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	}
+	if err := c.writeFrame(message); err != nil {
+		c.logger.Warnf("DopplerForwarder: Error writing to %s, reconnecting: %s", c.address, err)
+		c.disconnect()
+		return err
+	}
+	return nil
+}
+
+// writeFrame must be called with the lock held. Over TCP the length header
+// and the message are written with a single vectored write, so the message is
+// not copied. A TLS connection would send them as two records, so the frame
+// is assembled in the client's frame buffer instead. Over a websocket the
+// message is written as a binary message without a header. Either way the
+// message is no longer referenced once writeFrame returns. Messages of at
+// least the minimum size are compressed if the doppler accepts compressed
+// frames. The bytes written, also those of a write that failed part way, are
+// passed to written if it is set.
+func (c *streamClient) writeFrame(message []byte) error {
+	messageBytes := len(message)
+	var flags byte
+	if c.compression != nil && c.acceptsCompression && messageBytes >= c.compression.minBytes {
+		if compressed := c.compressor.compress(message); compressed != nil {
+			message = compressed
+			flags = FrameCompressed
+		}
+	}
+
+	var written int
+	var err error
+	if c.wsConn != nil {
+		err = c.wsConn.WriteMessage(websocket.BinaryMessage, message)
+		if err == nil {
+			written = len(message)
+		}
+	} else if _, ok := c.conn.(*net.TCPConn); ok {
+		header := frameHeader(len(message), flags)
+		buffers := net.Buffers{header[:], message}
+		var n int64
+		n, err = buffers.WriteTo(c.conn)
+		written = int(n)
+	} else {
+		c.frameBuffer = appendFrame(c.frameBuffer[:0], message, flags)
+		written, err = c.conn.Write(c.frameBuffer)
+	}
+	if c.written != nil && written > 0 {
+		c.written(c.host(), written)
+	}
+
+	if err == nil && flags == FrameCompressed {
+		c.compression.report(messageBytes, len(message))
+	}
+	return err
+}
+
+// connect must be called with the lock held.
+func (c *streamClient) connect() error {
+	if c.stopped {
+		return errClientStopped
+	}
+	if time.Now().Before(c.retryAt) {
+		return errReconnectPending
+	}
+
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	var conn net.Conn
+	var wsConn *websocket.Conn
+	var err error
+	switch {
+	case c.websocket:
+		wsConn, err = c.dialWebsocket(dialer)
+		if err == nil {
+			conn = wsConn.UnderlyingConn()
+		}
+	case c.tlsConfig != nil:
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, c.tlsConfig)
+	default:
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		c.logger.Warnf("DopplerForwarder: Error connecting to %s: %s", c.address, err)
+		c.fail()
+		return err
+	}
+
+	c.conn = conn
+	c.wsConn = wsConn
+	c.connectedAt = time.Now()
+	c.acceptsCompression = false
+	if wsConn != nil {
+		go c.watchWebsocket(wsConn)
+	} else {
+		go c.watch(conn)
+	}
+	return nil
+}
+
+// dialWebsocket connects to the websocket endpoint of doppler, over TLS if
+// the client has a TLS config.
+func (c *streamClient) dialWebsocket(dialer *net.Dialer) (*websocket.Conn, error) {
+	scheme := "ws"
+	if c.tlsConfig != nil {
+		scheme = "wss"
+	}
+	wsDialer := &websocket.Dialer{
+		NetDial:          dialer.Dial,
+		TLSClientConfig:  c.tlsConfig,
+		HandshakeTimeout: DialTimeout,
+	}
+	conn, _, err := wsDialer.Dial(scheme+"://"+c.address+WebsocketPath, nil)
+	return conn, err
+}
+
+// watch notices when doppler closes the connection. Doppler only ever writes
+// AcceptsCompressedFrames to it right after accepting it, if at all, so
+// reading any further only returns once the connection is closed.
+func (c *streamClient) watch(conn net.Conn) {
+	var first [1]byte
+	if n, _ := conn.Read(first[:]); n == 1 && first[0] == AcceptsCompressedFrames {
+		c.lock.Lock()
+		if c.conn == conn {
+			c.acceptsCompression = true
+		}
+		c.lock.Unlock()
+	}
+
+	io.Copy(ioutil.Discard, conn)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == conn {
+		c.logger.Warnf("DopplerForwarder: Connection to %s closed, reconnecting", c.address)
+		c.disconnect()
+	}
+}
+
+// watchWebsocket notices when doppler closes the websocket. Doppler never
+// sends messages on it, so reading only returns once it is closed, answering
+// the pings of doppler meanwhile.
+func (c *streamClient) watchWebsocket(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.wsConn == conn {
+		c.logger.Warnf("DopplerForwarder: Websocket to %s closed, reconnecting", c.address)
+		c.disconnect()
+	}
+}
+
+// disconnect must be called with the lock held. A connection that was up for
+// at least MaxReconnectBackoff resets the backoff.
+func (c *streamClient) disconnect() {
+	c.conn.Close()
+	c.conn = nil
+	c.wsConn = nil
+	if time.Since(c.connectedAt) >= MaxReconnectBackoff {
+		c.backoff = 0
+	}
+	c.fail()
+}
+
+// fail must be called with the lock held.
+func (c *streamClient) fail() {
+	c.backoff *= 2
+	if c.backoff < MinReconnectBackoff {
+		c.backoff = MinReconnectBackoff
+	}
+	if c.backoff > MaxReconnectBackoff {
+		c.backoff = MaxReconnectBackoff
+	}
+	c.retryAt = time.Now().Add(c.backoff)
+}
+
+// available tells whether the client is connected or may try to connect,
+// rather than waiting for its backoff to pass.
+func (c *streamClient) available() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return !c.stopped && (c.conn != nil || !time.Now().Before(c.retryAt))
+}
+
+func (c *streamClient) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stopped = true
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.wsConn = nil
+	}
+}
+
+// streamClientPool keeps a stream client for every doppler.
+type streamClientPool struct {
+	port        int
+	tlsConfig   *tls.Config
+	websocket   bool
+	compression *frameCompression
+	retries     *sendRetryPolicy
+	written     func(host string, bytes int)
+	logger      *gosteno.Logger
+
+	lock    sync.Mutex
+	clients map[string]*streamClient
+	stopped bool
+}
+
+func newStreamClientPool(port int, tlsConfig *tls.Config, logger *gosteno.Logger) *streamClientPool {
+	return &streamClientPool{
+		port:      port,
+		tlsConfig: tlsConfig,
+		retries:   &sendRetryPolicy{maxRetries: DefaultSendRetries, delay: DefaultSendRetryDelay},
+		logger:    logger,
+		clients:   make(map[string]*streamClient),
+	}
+}
+
+// send sends message to a random available doppler out of addresses, after
+// stopping the clients of dopplers that are gone. With the loads of the
+// dopplers, less loaded dopplers are picked more often. A doppler is
+// unavailable while its client waits to reconnect, so traffic goes to the
+// others meanwhile. If sending fails, the message is retried as often as the
+// retry policy allows, after its delay, on another available doppler where
+// there is one, so a message written to a connection that broke is not lost
+// while others are up. report, if not nil, is called with the outcome of
+// every attempt.
+func (p *streamClientPool) send(addresses []string, loads map[string]int, message []byte, report func(host string, err error)) error {
+	failed := make(map[string]bool)
+	var err error
+	for attempt := 0; ; attempt++ {
+		client, address, pickErr := p.availableClient(addresses, loads, failed)
+		if pickErr == errReconnectPending && len(failed) > 0 {
+			client, address, pickErr = p.availableClient(addresses, loads, nil)
+		}
+		if pickErr != nil {
+			if err != nil {
+				return err
+			}
+			return pickErr
+		}
+		if attempt > 0 {
+			p.retries.wait()
+		}
+
+		err = client.Send(message)
+		if report != nil {
+			report(client.host(), err)
+		}
+		if err == nil {
+			return nil
+		}
+		failed[address] = true
+		if attempt >= p.retries.maxRetries {
+			return err
+		}
+	}
+}
+
+// availableClient returns the client of a random doppler out of addresses
+// that is neither in failed nor waiting to reconnect.
+func (p *streamClientPool) availableClient(addresses []string, loads map[string]int, failed map[string]bool) (*streamClient, string, error) {
+	if len(addresses) == 0 {
+		return nil, "", clientpool.ErrorEmptyClientPool
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return nil, "", errClientStopped
+	}
+
+	current := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		current[address] = true
+	}
+	for address, client := range p.clients {
+		if !current[address] {
+			client.Stop()
+			delete(p.clients, address)
+		}
+	}
+
+	available := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if failed[address] {
+			continue
+		}
+		if client, ok := p.clients[address]; ok && !client.available() {
+			continue
+		}
+		available = append(available, address)
+	}
+	if len(available) == 0 {
+		return nil, "", errReconnectPending
+	}
+
+	address := pickAddress(available, loads)
+	client, ok := p.clients[address]
+	if !ok {
+		client = newStreamClient(net.JoinHostPort(address, strconv.Itoa(p.port)), p.tlsConfig, p.compression, p.logger)
+		client.websocket = p.websocket
+		client.written = p.written
+		p.clients[address] = client
+	}
+	return client, address, nil
+}
+
+// unavailableCount returns how many of the dopplers the pool has clients for
+// are waiting to be reconnected to.
+func (p *streamClientPool) unavailableCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	count := 0
+	for _, client := range p.clients {
+		if !client.available() {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *streamClientPool) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stopped = true
+	for _, client := range p.clients {
+		client.Stop()
+	}
+}
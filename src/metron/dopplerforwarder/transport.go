@@ -0,0 +1,125 @@
+package dopplerforwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"metron/metrics"
+)
+
+// Transport is a way of sending messages to doppler.
+type Transport int
+
+const (
+	// UDP sends every message as a datagram.
+	UDP Transport = iota
+	// TCP sends messages as frames over a persistent TCP connection.
+	TCP
+	// TLS sends messages as frames over a persistent mutual TLS connection.
+	TLS
+	// Websocket sends every message as a binary message over a persistent
+	// websocket, for networks that only let HTTP through.
+	Websocket
+)
+
+// WebsocketPath is the path of the endpoint dopplers accept the websockets
+// of the Websocket transport on.
+const WebsocketPath = "/ingest"
+
+func (t Transport) String() string {
+	switch t {
+	case TCP:
+		return "tcp"
+	case TLS:
+		return "tls"
+	case Websocket:
+		return "websocket"
+	default:
+		return "udp"
+	}
+}
+
+// sentMessagesMetrics holds the names of the metrics counting the messages
+// sent over each transport.
+var sentMessagesMetrics = [...]string{
+	UDP:       metrics.DopplerUDPSentMessages,
+	TCP:       metrics.DopplerTCPSentMessages,
+	TLS:       metrics.DopplerTLSSentMessages,
+	Websocket: metrics.DopplerWebsocketSentMessages,
+}
+
+// ParseTransports parses transports given in order of preference. UDP is
+// always the last resort, so it is added to the end if it is not given.
+func ParseTransports(names []string) ([]Transport, error) {
+	var transports []Transport
+	given := make(map[Transport]bool)
+	for _, name := range names {
+		var transport Transport
+		switch name {
+		case "udp":
+			transport = UDP
+		case "tcp":
+			transport = TCP
+		case "tls":
+			transport = TLS
+		case "websocket":
+			transport = Websocket
+		default:
+			return nil, fmt.Errorf("Unknown doppler transport '%s', must be websocket, tls, tcp or udp", name)
+		}
+
+		if given[transport] {
+			return nil, fmt.Errorf("Doppler transport '%s' is given more than once", name)
+		}
+		given[transport] = true
+		transports = append(transports, transport)
+	}
+
+	if !given[UDP] {
+		transports = append(transports, UDP)
+	}
+	return transports, nil
+}
+
+// NewClientTLSConfig returns a TLS config that presents the given certificate
+// and only trusts dopplers with a certificate signed by the CA. If serverName
+// is empty, the certificate is verified against the doppler's address.
+func NewClientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      rootCAs,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// appendFrame appends the message to dst, prefixed with its frame header.
+func appendFrame(dst []byte, message []byte, flags byte) []byte {
+	header := frameHeader(len(message), flags)
+	return append(append(dst, header[:]...), message...)
+}
+
+// frameHeader returns the length of a message as a 4 byte big endian unsigned
+// integer, with flags such as FrameCompressed set in its first byte.
+func frameHeader(length int, flags byte) [4]byte {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(length))
+	header[0] |= flags
+	return header
+}
@@ -0,0 +1,46 @@
+package dopplerforwarder_test
+
+import (
+	"metron/dopplerforwarder"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseTransports", func() {
+	It("parses the transports in order of preference", func() {
+		Expect(dopplerforwarder.ParseTransports([]string{"tls", "tcp", "udp"})).To(Equal([]dopplerforwarder.Transport{dopplerforwarder.TLS, dopplerforwarder.TCP, dopplerforwarder.UDP}))
+		Expect(dopplerforwarder.ParseTransports([]string{"tcp", "udp", "tls"})).To(Equal([]dopplerforwarder.Transport{dopplerforwarder.TCP, dopplerforwarder.UDP, dopplerforwarder.TLS}))
+		Expect(dopplerforwarder.ParseTransports([]string{"websocket", "udp"})).To(Equal([]dopplerforwarder.Transport{dopplerforwarder.Websocket, dopplerforwarder.UDP}))
+	})
+
+	It("adds UDP as the last resort", func() {
+		Expect(dopplerforwarder.ParseTransports([]string{"tls"})).To(Equal([]dopplerforwarder.Transport{dopplerforwarder.TLS, dopplerforwarder.UDP}))
+		Expect(dopplerforwarder.ParseTransports(nil)).To(Equal([]dopplerforwarder.Transport{dopplerforwarder.UDP}))
+	})
+
+	It("returns an error for an unknown transport", func() {
+		_, err := dopplerforwarder.ParseTransports([]string{"tls", "http"})
+		Expect(err).To(MatchError("Unknown doppler transport 'http', must be websocket, tls, tcp or udp"))
+	})
+
+	It("returns an error for a transport given twice", func() {
+		_, err := dopplerforwarder.ParseTransports([]string{"tcp", "tcp"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("NewClientTLSConfig", func() {
+	It("trusts the CA and presents the certificate", func() {
+		tlsConfig, err := dopplerforwarder.NewClientTLSConfig("fixtures/client.crt", "fixtures/client.key", "fixtures/ca.crt", "doppler")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tlsConfig.Certificates).To(HaveLen(1))
+		Expect(tlsConfig.RootCAs).NotTo(BeNil())
+		Expect(tlsConfig.ServerName).To(Equal("doppler"))
+	})
+
+	It("returns an error for a CA file without certificates", func() {
+		_, err := dopplerforwarder.NewClientTLSConfig("fixtures/client.crt", "fixtures/client.key", "fixtures/client.key", "")
+		Expect(err).To(HaveOccurred())
+	})
+})
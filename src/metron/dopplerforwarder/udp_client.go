@@ -0,0 +1,229 @@
+package dopplerforwarder
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/clientpool"
+	"github.com/cloudfoundry/loggregatorlib/servicediscovery"
+)
+
+var (
+	// UDPNoBufferRetries is how often a datagram that could not be written
+	// because the socket buffers were full is written again, waiting
+	// UDPNoBufferBackoff before each attempt.
+	UDPNoBufferRetries = 3
+	UDPNoBufferBackoff = time.Millisecond
+)
+
+// UDPClientPool picks the client of a doppler to send a datagram to. The
+// loggregatorlib client pool is one; its clients do not tell whether a
+// datagram could be written. The clients of UDPPool do.
+type UDPClientPool interface {
+	RandomClient() (clientpool.LoggregatorClient, error)
+	ListClients() []clientpool.LoggregatorClient
+}
+
+// udpWriter is implemented by the UDP clients that tell whether a datagram
+// could be written.
+type udpWriter interface {
+	write(datagram []byte) error
+	host() string
+}
+
+// The classes of the errors writing a datagram, see udpErrorClass.
+const (
+	udpMessageTooLong    = "messageTooLong"
+	udpConnectionRefused = "connectionRefused"
+	udpNoBufferSpace     = "noBufferSpace"
+	udpUnknownError      = "unknown"
+)
+
+// udpErrorClass returns the class of an error writing a datagram, and the
+// errno it comes from if any.
+func udpErrorClass(err error) (string, syscall.Errno) {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if syscallErr, ok := err.(*os.SyscallError); ok {
+		err = syscallErr.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return udpUnknownError, 0
+	}
+
+	switch errno {
+	case syscall.EMSGSIZE:
+		return udpMessageTooLong, errno
+	case syscall.ECONNREFUSED:
+		return udpConnectionRefused, errno
+	case syscall.ENOBUFS:
+		return udpNoBufferSpace, errno
+	}
+	return udpUnknownError, errno
+}
+
+// udpClient writes datagrams to one doppler over a connected UDP socket.
+// Linux reports on such a socket that an earlier datagram was refused, as
+// nothing listens on the doppler's port; the client is then unavailable
+// until a backoff has passed, like a stream client waiting to reconnect.
+type udpClient struct {
+	address string
+	conn    net.Conn
+
+	lock    sync.Mutex
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// Send writes datagram, ignoring errors, as the loggregatorlib clients do.
+func (c *udpClient) Send(datagram []byte) {
+	c.write(datagram)
+}
+
+func (c *udpClient) write(datagram []byte) error {
+	_, err := c.conn.Write(datagram)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		c.backoff = 0
+		return nil
+	}
+	if class, _ := udpErrorClass(err); class == udpConnectionRefused {
+		c.backoff *= 2
+		if c.backoff < MinReconnectBackoff {
+			c.backoff = MinReconnectBackoff
+		}
+		if c.backoff > MaxReconnectBackoff {
+			c.backoff = MaxReconnectBackoff
+		}
+		c.retryAt = time.Now().Add(c.backoff)
+	}
+	return err
+}
+
+// host returns the address of the doppler without the port.
+func (c *udpClient) host() string {
+	host, _, err := net.SplitHostPort(c.address)
+	if err != nil {
+		return c.address
+	}
+	return host
+}
+
+func (c *udpClient) available() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return !time.Now().Before(c.retryAt)
+}
+
+func (c *udpClient) Stop() {
+	c.conn.Close()
+}
+
+// UDPPool keeps a UDP client for every doppler in an address list, like the
+// loggregatorlib client pool, but its clients tell the forwarder why a
+// datagram could not be written, and a doppler that refused a datagram is
+// not picked until its backoff has passed.
+type UDPPool struct {
+	port        int
+	addressList servicediscovery.ServerAddressList
+	dial        func(network, address string) (net.Conn, error)
+	logger      *gosteno.Logger
+
+	lock    sync.Mutex
+	clients map[string]*udpClient
+}
+
+// NewUDPPool returns a pool sending to the dopplers in addressList on port.
+func NewUDPPool(port int, addressList servicediscovery.ServerAddressList, logger *gosteno.Logger) *UDPPool {
+	return &UDPPool{
+		port:        port,
+		addressList: addressList,
+		dial:        net.Dial,
+		logger:      logger,
+		clients:     make(map[string]*udpClient),
+	}
+}
+
+// SetDial replaces the function the pool connects its UDP sockets with. It
+// must be called before the pool is used.
+func (p *UDPPool) SetDial(dial func(network, address string) (net.Conn, error)) {
+	p.dial = dial
+}
+
+// RandomClient returns the client of a random doppler that is not waiting
+// for its backoff to pass.
+func (p *UDPPool) RandomClient() (clientpool.LoggregatorClient, error) {
+	clients := p.syncedClients()
+	if len(clients) == 0 {
+		return nil, clientpool.ErrorEmptyClientPool
+	}
+
+	available := make([]*udpClient, 0, len(clients))
+	for _, client := range clients {
+		if client.available() {
+			available = append(available, client)
+		}
+	}
+	if len(available) == 0 {
+		return nil, errReconnectPending
+	}
+	return available[rand.Intn(len(available))], nil
+}
+
+func (p *UDPPool) ListClients() []clientpool.LoggregatorClient {
+	clients := p.syncedClients()
+	list := make([]clientpool.LoggregatorClient, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, client)
+	}
+	return list
+}
+
+// syncedClients returns the clients of the dopplers in the address list,
+// after connecting to new dopplers and stopping the clients of dopplers that
+// are gone.
+func (p *UDPPool) syncedClients() []*udpClient {
+	addresses := p.addressList.GetAddresses()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	clients := make(map[string]*udpClient, len(addresses))
+	list := make([]*udpClient, 0, len(addresses))
+	for _, address := range addresses {
+		if _, ok := clients[address]; ok {
+			continue
+		}
+		client, ok := p.clients[address]
+		if ok {
+			delete(p.clients, address)
+		} else {
+			udpAddress := net.JoinHostPort(address, strconv.Itoa(p.port))
+			conn, err := p.dial("udp", udpAddress)
+			if err != nil {
+				p.logger.Debugf("DopplerForwarder: Error connecting to %s: %s", udpAddress, err)
+				continue
+			}
+			client = &udpClient{address: udpAddress, conn: conn}
+		}
+		clients[address] = client
+		list = append(list, client)
+	}
+	for _, client := range p.clients {
+		client.Stop()
+	}
+	p.clients = clients
+	return list
+}
@@ -0,0 +1,256 @@
+package dopplerforwarder_test
+
+import (
+	"errors"
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const refusedUDPPort = 52124
+
+// stubConn fails the writes it has errors queued for, with the error a UDP
+// socket returns, and records the datagrams it writes otherwise.
+type stubConn struct {
+	net.Conn
+	address string
+
+	lock    sync.Mutex
+	errors  []error
+	written []string
+}
+
+func (c *stubConn) failWith(errs ...error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.errors = append(c.errors, errs...)
+}
+
+func (c *stubConn) Write(datagram []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.errors) > 0 {
+		err := c.errors[0]
+		c.errors = c.errors[1:]
+		return 0, err
+	}
+	c.written = append(c.written, string(datagram))
+	return len(datagram), nil
+}
+
+func (c *stubConn) Written() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]string(nil), c.written...)
+}
+
+func (c *stubConn) Close() error {
+	return nil
+}
+
+func writeError(errno syscall.Errno) error {
+	return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", errno)}
+}
+
+func taggedMetricValue(forwarder *dopplerforwarder.Forwarder, name string, tag string, value string) interface{} {
+	for _, metric := range forwarder.Emit().Metrics {
+		if metric.Name == name && metric.Tags[tag] == value {
+			return metric.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("UDP send errors", func() {
+	var (
+		addressList   *reportingAddressList
+		conns         map[string]*stubConn
+		registry      *metrics.Registry
+		forwarder     *dopplerforwarder.Forwarder
+		messageChan   chan []byte
+		forwarderDone chan struct{}
+	)
+
+	start := func(configure func(forwarder *dopplerforwarder.Forwarder)) {
+		logger := loggertesthelper.Logger()
+		udpPool := dopplerforwarder.NewUDPPool(udpPort, addressList, logger)
+		udpPool.SetDial(func(network, address string) (net.Conn, error) {
+			return conns[address], nil
+		})
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.UDP}, udpPool, addressList, tcpPort, tlsPort, nil, logger)
+		forwarder.SetMetricsRegistry(registry)
+		if configure != nil {
+			configure(forwarder)
+		}
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	}
+
+	// send sends message and waits for the forwarder to have written or
+	// dropped it.
+	send := func(message string) {
+		handled := func() uint64 {
+			return registry.Counter(metrics.DopplerUDPSentMessages) + registry.Counter(metrics.DopplerSendErrors)
+		}
+		before := handled()
+		messageChan <- []byte(message)
+		Eventually(handled).Should(BeNumerically(">", before))
+	}
+
+	conn := func(host string) *stubConn {
+		return conns[net.JoinHostPort(host, strconv.Itoa(udpPort))]
+	}
+
+	BeforeEach(func() {
+		addressList = &reportingAddressList{
+			fakeAddressList: fakeAddressList{addresses: []string{"127.0.0.1"}},
+			reports:         make(chan sendReport, 100),
+		}
+		conns = make(map[string]*stubConn)
+		for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+			conns[net.JoinHostPort(host, strconv.Itoa(udpPort))] = &stubConn{address: host}
+		}
+		registry = metrics.NewRegistry()
+		messageChan = make(chan []byte)
+		forwarderDone = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+		forwarder.Stop()
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+		dopplerforwarder.RetryInterval = 100 * time.Millisecond
+	})
+
+	It("drops a datagram too large to send without retrying it", func() {
+		conn := conn("127.0.0.1")
+		conn.failWith(writeError(syscall.EMSGSIZE))
+		dopplerforwarder.RetryInterval = 10 * time.Millisecond
+		start(func(forwarder *dopplerforwarder.Forwarder) {
+			forwarder.SetRetryBuffer(10, 100000)
+		})
+
+		send("too large")
+		send("next")
+
+		Expect(conn.Written()).To(Equal([]string{"next"}))
+		Consistently(conn.Written).Should(Equal([]string{"next"}))
+		Expect(metricValue(forwarder, "udpMessageTooLongErrors")).To(BeEquivalentTo(1))
+		Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(1))
+		Expect(metricValue(forwarder, "retryBufferedMessages")).To(BeEquivalentTo(0))
+		Expect(registry.Counter(metrics.DopplerUDPSendErrors + ".messageTooLong")).To(BeEquivalentTo(1))
+	})
+
+	It("stops sending to a doppler that refused a datagram until its backoff has passed", func() {
+		dopplerforwarder.MinReconnectBackoff = time.Hour
+		addressList.addresses = []string{"127.0.0.1", "127.0.0.2"}
+		refusing := conn("127.0.0.1")
+		refusing.failWith(writeError(syscall.ECONNREFUSED))
+		start(nil)
+
+		for metricValue(forwarder, "udpConnectionRefusedErrors") == uint64(0) {
+			send("message")
+		}
+		Expect(registry.Counter(metrics.DopplerUDPSendErrors + ".connectionRefused")).To(BeEquivalentTo(1))
+		Eventually(addressList.reports).Should(Receive(Equal(sendReport{address: "127.0.0.1", failed: true})))
+
+		refused, other := len(refusing.Written()), len(conn("127.0.0.2").Written())
+		for i := 0; i < 20; i++ {
+			send("message")
+		}
+		Expect(refusing.Written()).To(HaveLen(refused))
+		Expect(conn("127.0.0.2").Written()).To(HaveLen(other + 20))
+	})
+
+	It("writes a datagram again while the socket buffers are full", func() {
+		conn := conn("127.0.0.1")
+		conn.failWith(writeError(syscall.ENOBUFS), writeError(syscall.ENOBUFS))
+		start(nil)
+
+		send("message")
+
+		Expect(conn.Written()).To(Equal([]string{"message"}))
+		Expect(metricValue(forwarder, "udpNoBufferSpaceErrors")).To(BeEquivalentTo(2))
+		Expect(metricValue(forwarder, "udpSentMessages")).To(BeEquivalentTo(1))
+	})
+
+	It("gives up on a datagram once the socket buffers stay full", func() {
+		conn := conn("127.0.0.1")
+		for i := 0; i <= dopplerforwarder.UDPNoBufferRetries; i++ {
+			conn.failWith(writeError(syscall.ENOBUFS))
+		}
+		start(nil)
+
+		send("message")
+
+		Expect(conn.Written()).To(BeEmpty())
+		Expect(metricValue(forwarder, "udpNoBufferSpaceErrors")).To(BeEquivalentTo(dopplerforwarder.UDPNoBufferRetries + 1))
+		Expect(metricValue(forwarder, "droppedMessages")).To(BeEquivalentTo(1))
+	})
+
+	It("counts the unknown errors by errno", func() {
+		conn := conn("127.0.0.1")
+		conn.failWith(writeError(syscall.EPERM), writeError(syscall.EPERM), errors.New("not a socket error"))
+		start(nil)
+
+		send("first")
+		send("second")
+		send("third")
+
+		Expect(taggedMetricValue(forwarder, "udpUnknownErrors", "errno", syscall.EPERM.Error())).To(BeEquivalentTo(2))
+		Expect(taggedMetricValue(forwarder, "udpUnknownErrors", "errno", "none")).To(BeEquivalentTo(1))
+		Expect(registry.Counter(metrics.DopplerUDPSendErrors + ".unknown")).To(BeEquivalentTo(3))
+	})
+
+	It("counts the bytes written to each doppler", func() {
+		start(nil)
+
+		send("message")
+
+		Expect(registry.Counter(metrics.ForDestination(metrics.DopplerEgressBytes, "127.0.0.1"))).To(BeEquivalentTo(len("message")))
+		Expect(addressList.reports).To(Receive(Equal(sendReport{address: "127.0.0.1", failed: false})))
+	})
+})
+
+var _ = Describe("UDPPool", func() {
+	It("sees a doppler refuse datagrams when nothing listens on its port", func() {
+		addressList := &fakeAddressList{addresses: []string{"127.0.0.1"}}
+		logger := loggertesthelper.Logger()
+		udpPool := dopplerforwarder.NewUDPPool(refusedUDPPort, addressList, logger)
+		forwarder := dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.UDP}, udpPool, addressList, tcpPort, tlsPort, nil, logger)
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+		defer func() { dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond }()
+
+		messageChan := make(chan []byte)
+		forwarderDone := make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+		defer func() {
+			close(messageChan)
+			Eventually(forwarderDone).Should(BeClosed())
+		}()
+
+		Eventually(func() interface{} {
+			messageChan <- []byte("message")
+			return metricValue(forwarder, "udpConnectionRefusedErrors")
+		}).Should(BeNumerically(">", 0))
+	})
+})
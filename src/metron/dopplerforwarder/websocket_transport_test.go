@@ -0,0 +1,146 @@
+package dopplerforwarder_test
+
+import (
+	"fmt"
+	"metron/dopplerforwarder"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const websocketPort = 52125
+
+// fakeWebsocketDoppler accepts dropsonde messages over websockets, the way
+// doppler's websocket listener does.
+type fakeWebsocketDoppler struct {
+	listener net.Listener
+	messages chan string
+
+	sync.Mutex
+	conns    []*websocket.Conn
+	accepted int
+}
+
+func newFakeWebsocketDoppler(port int) *fakeWebsocketDoppler {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	Expect(err).NotTo(HaveOccurred())
+
+	doppler := &fakeWebsocketDoppler{
+		listener: listener,
+		messages: make(chan string, 100),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(dopplerforwarder.WebsocketPath, doppler.serve)
+	go http.Serve(listener, mux)
+	return doppler
+}
+
+func (doppler *fakeWebsocketDoppler) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	doppler.Lock()
+	doppler.conns = append(doppler.conns, conn)
+	doppler.accepted++
+	doppler.Unlock()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			doppler.messages <- string(message)
+		}
+	}
+}
+
+func (doppler *fakeWebsocketDoppler) acceptedCount() int {
+	doppler.Lock()
+	defer doppler.Unlock()
+	return doppler.accepted
+}
+
+func (doppler *fakeWebsocketDoppler) closeConnections() {
+	doppler.Lock()
+	defer doppler.Unlock()
+	for _, conn := range doppler.conns {
+		conn.Close()
+	}
+	doppler.conns = nil
+}
+
+func (doppler *fakeWebsocketDoppler) stop() {
+	doppler.listener.Close()
+	doppler.closeConnections()
+}
+
+var _ = Describe("Websocket transport", func() {
+	var (
+		doppler       *fakeWebsocketDoppler
+		forwarder     *dopplerforwarder.Forwarder
+		messageChan   chan []byte
+		forwarderDone chan struct{}
+	)
+
+	BeforeEach(func() {
+		dopplerforwarder.MinReconnectBackoff = 10 * time.Millisecond
+
+		doppler = newFakeWebsocketDoppler(websocketPort)
+		addressList := &fakeAddressList{addresses: []string{"127.0.0.1"}}
+		forwarder = dopplerforwarder.New([]dopplerforwarder.Transport{dopplerforwarder.Websocket}, nil, addressList, 0, 0, nil, loggertesthelper.Logger())
+		forwarder.SetWebsocketPort(websocketPort, false)
+
+		messageChan = make(chan []byte)
+		forwarderDone = make(chan struct{})
+		go func() {
+			forwarder.Run(messageChan)
+			close(forwarderDone)
+		}()
+	})
+
+	AfterEach(func() {
+		close(messageChan)
+		Eventually(forwarderDone).Should(BeClosed())
+		forwarder.Stop()
+		doppler.stop()
+		dopplerforwarder.MinReconnectBackoff = 100 * time.Millisecond
+	})
+
+	It("sends each message as a binary message over one websocket", func() {
+		messageChan <- []byte("first")
+		messageChan <- []byte("second")
+
+		Eventually(doppler.messages).Should(Receive(Equal("first")))
+		Eventually(doppler.messages).Should(Receive(Equal("second")))
+		Expect(doppler.acceptedCount()).To(Equal(1))
+
+		Eventually(func() interface{} { return metricValue(forwarder, "websocketSentMessages") }).Should(BeEquivalentTo(2))
+	})
+
+	It("reconnects after doppler closes the websocket", func() {
+		messageChan <- []byte("first")
+		Eventually(doppler.messages).Should(Receive(Equal("first")))
+
+		doppler.closeConnections()
+
+		Eventually(func() bool {
+			messageChan <- []byte("second")
+			select {
+			case message := <-doppler.messages:
+				return message == "second"
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}).Should(BeTrue())
+		Expect(doppler.acceptedCount()).To(Equal(2))
+	})
+})
@@ -0,0 +1,377 @@
+package dopplerforwarder
+
+import (
+	"math/rand"
+	"metron/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/storeadapter"
+)
+
+// DefaultMaxRegistryBackoff is the longest a ZoneAddressList waits between
+// two attempts to reach the registry, unless set otherwise with SetMaxBackoff.
+const DefaultMaxRegistryBackoff = 30 * time.Second
+
+// ZoneAddressList keeps the addresses of the dopplers registered under
+// storeKey/<zone>/<job>/<index>. It hands out the dopplers in its own zone
+// and falls back to the dopplers in every other zone only while none are
+// registered in its own zone, as dopplers drop out of the registry once they
+// stop reporting healthy.
+//
+// While the registry cannot be reached, the list keeps the addresses it read
+// last and reports them as stale. It retries with an exponential backoff,
+// reconnecting before every attempt, and reads the whole registry again as
+// soon as it is back.
+//
+// Dopplers may add a hint of their load to the value they register, such as
+// "10.0.1.1 load=42". The list reports the loads while they are known for all
+// of its dopplers and the registry can be reached.
+//
+// With SetZoneFailover, the list also falls back to the other zones while the
+// sends to the dopplers in its own zone keep failing, see SetZoneFailover.
+type ZoneAddressList struct {
+	storeAdapter storeadapter.StoreAdapter
+	storeKey     string
+	zone         string
+	logger       *gosteno.Logger
+
+	maxBackoff      time.Duration
+	metricsRegistry *metrics.Registry
+	clock           Clock
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+
+	lock       sync.RWMutex
+	sameZone   []string
+	otherZones []string
+	failover   *zoneFailover
+	addresses  []string
+	loads      map[string]int
+	crossZone  bool
+	stale      bool
+	lastRead   time.Time
+}
+
+func NewZoneAddressList(storeAdapter storeadapter.StoreAdapter, storeKey string, zone string, logger *gosteno.Logger) *ZoneAddressList {
+	return &ZoneAddressList{
+		storeAdapter: storeAdapter,
+		storeKey:     strings.TrimRight(storeKey, "/"),
+		zone:         zone,
+		logger:       logger,
+		maxBackoff:   DefaultMaxRegistryBackoff,
+		clock:        wallClock{},
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// SetZoneFailover makes the list fall back to the dopplers in other zones
+// once the sends to every doppler in its own zone have kept failing for
+// failAfter, and return to its own zone once the sends to one of them have
+// stopped failing for failBackAfter, with the health of a doppler taken from
+// the sends reported with ReportSend. As the dopplers in its own zone are not
+// sent to while falling back, their send errors count for ZoneErrorWindow
+// only. Either way, a doppler registering in its own zone again is returned
+// to only after failBackAfter. The fallbacks and returns are logged and
+// counted. It must be called before Run.
+func (list *ZoneAddressList) SetZoneFailover(failAfter time.Duration, failBackAfter time.Duration) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.failover = newZoneFailover(failAfter, failBackAfter)
+}
+
+// SetClock replaces the clock the zone failover is timed with. It must be
+// called before Run.
+func (list *ZoneAddressList) SetClock(clock Clock) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.clock = clock
+}
+
+// ReportSend records whether a send to the doppler at address failed, for
+// the zone failover. Without a zone failover it does nothing.
+func (list *ZoneAddressList) ReportSend(address string, err error) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if list.failover == nil {
+		return
+	}
+	list.failover.reportSend(address, err, list.clock.Now())
+	list.selectZone()
+}
+
+// SetMaxBackoff sets the longest the list waits between two attempts to
+// reach the registry. It must be called before Run.
+func (list *ZoneAddressList) SetMaxBackoff(maxBackoff time.Duration) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.maxBackoff = maxBackoff
+}
+
+// SetMetricsRegistry makes the list keep the number of seconds its addresses
+// have been stale in registry. It must be called before Run.
+func (list *ZoneAddressList) SetMetricsRegistry(registry *metrics.Registry) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.metricsRegistry = registry
+}
+
+// Run reads the registry every updateInterval until Stop is called. After a
+// failed read it waits twice as long as after the previous one, up to the
+// maximum backoff and with some jitter, so that metrons do not all retry at
+// once.
+func (list *ZoneAddressList) Run(updateInterval time.Duration) {
+	list.lock.Lock()
+	list.lastRead = time.Now()
+	maxBackoff := list.maxBackoff
+	list.lock.Unlock()
+
+	var backoff time.Duration
+	timer := time.NewTimer(updateInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-list.stopChan:
+			return
+		}
+
+		if list.read(backoff > 0) {
+			backoff = 0
+			timer.Reset(updateInterval)
+			continue
+		}
+
+		backoff *= 2
+		if backoff < updateInterval {
+			backoff = updateInterval
+		}
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		timer.Reset(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+	}
+}
+
+func (list *ZoneAddressList) Stop() {
+	list.stopOnce.Do(func() { close(list.stopChan) })
+}
+
+func (list *ZoneAddressList) GetAddresses() []string {
+	if list.hasFailover() {
+		list.lock.Lock()
+		defer list.lock.Unlock()
+		list.selectZone()
+		return list.addresses
+	}
+
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.addresses
+}
+
+func (list *ZoneAddressList) hasFailover() bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.failover != nil
+}
+
+// Stale reports whether the registry could not be reached on the last attempt,
+// in which case the addresses are the ones read before.
+func (list *ZoneAddressList) Stale() bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.stale
+}
+
+// Staleness returns how long the registry has not been read successfully
+// while the addresses are stale, and zero otherwise.
+func (list *ZoneAddressList) Staleness() time.Duration {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	if !list.stale {
+		return 0
+	}
+	return time.Since(list.lastRead)
+}
+
+// Loads returns the load hint of every doppler by address, from 0 for an
+// idle doppler to 100 for a fully loaded one. It returns nil if a doppler has
+// not registered a hint or the addresses are stale, as the loads are then
+// unknown or outdated.
+func (list *ZoneAddressList) Loads() map[string]int {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	if list.stale {
+		return nil
+	}
+	for _, address := range list.addresses {
+		if _, ok := list.loads[address]; !ok {
+			return nil
+		}
+	}
+	return list.loads
+}
+
+// CrossZone reports whether the addresses are those of dopplers outside the
+// list's zone.
+func (list *ZoneAddressList) CrossZone() bool {
+	if list.hasFailover() {
+		list.lock.Lock()
+		defer list.lock.Unlock()
+		list.selectZone()
+		return list.crossZone
+	}
+
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.crossZone
+}
+
+// read lists the registry, after reconnecting to it if the previous attempt
+// failed, and reports whether it succeeded.
+func (list *ZoneAddressList) read(reconnect bool) bool {
+	if reconnect {
+		if err := list.storeAdapter.Connect(); err != nil {
+			list.logger.Debugf("ZoneAddressList: Error reconnecting to the registry: %v", err)
+			list.markStale()
+			return false
+		}
+	}
+
+	node, err := list.storeAdapter.ListRecursively(list.storeKey)
+	if err == storeadapter.ErrorKeyNotFound {
+		node = storeadapter.StoreNode{}
+	} else if err != nil {
+		list.logger.Debugf("ZoneAddressList: Error listing %s: %v", list.storeKey, err)
+		list.markStale()
+		return false
+	}
+
+	list.update(node)
+	return true
+}
+
+func (list *ZoneAddressList) markStale() {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if !list.stale {
+		list.logger.Warnf("ZoneAddressList: Cannot reach the registry, keeping the %d dopplers read last", len(list.addresses))
+		list.stale = true
+	}
+	list.metricsRegistry.SetGauge(metrics.DopplerRegistryStalenessSeconds, time.Since(list.lastRead).Seconds())
+}
+
+func (list *ZoneAddressList) update(node storeadapter.StoreNode) {
+
+	addressesByZone, loads := list.addressesByZone(node)
+	sameZone := []string{}
+	otherZones := []string{}
+	for zone, addresses := range addressesByZone {
+		if zone == list.zone {
+			sameZone = append(sameZone, addresses...)
+		} else {
+			otherZones = append(otherZones, addresses...)
+		}
+	}
+
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if list.stale {
+		list.logger.Infof("ZoneAddressList: Reached the registry again after %s", time.Since(list.lastRead))
+		list.stale = false
+	}
+	list.sameZone = sameZone
+	list.otherZones = otherZones
+	list.loads = loads
+	list.lastRead = time.Now()
+	list.metricsRegistry.SetGauge(metrics.DopplerRegistryStalenessSeconds, 0)
+
+	if list.failover != nil {
+		registered := make(map[string]bool, len(sameZone))
+		for _, address := range sameZone {
+			registered[address] = true
+		}
+		list.failover.forget(registered)
+	}
+	list.selectZone()
+}
+
+// selectZone must be called with the lock held. It picks the zone to hand
+// out the dopplers of.
+func (list *ZoneAddressList) selectZone() {
+	crossZone := false
+	switch {
+	case len(list.sameZone) == 0:
+		crossZone = len(list.otherZones) > 0
+		if crossZone && !list.crossZone {
+			list.logger.Warnf("ZoneAddressList: No doppler registered in zone %s, falling back to %d dopplers in other zones", list.zone, len(list.otherZones))
+		}
+		if list.failover != nil {
+			list.failover.reset()
+		}
+	case list.failover == nil:
+		if list.crossZone {
+			list.logger.Infof("ZoneAddressList: Dopplers registered in zone %s again", list.zone)
+		}
+	default:
+		now := list.clock.Now()
+		crossZone = list.failover.crossZone(list.crossZone, list.sameZone, now) && len(list.otherZones) > 0
+		if crossZone != list.crossZone {
+			if crossZone {
+				list.logger.Warnf("ZoneAddressList: Sends to the dopplers in zone %s failing for %s, falling back to %d dopplers in other zones", list.zone, now.Sub(list.failover.unhealthySince), len(list.otherZones))
+			} else {
+				list.logger.Infof("ZoneAddressList: Dopplers in zone %s healthy for %s, returning to them", list.zone, now.Sub(list.failover.healthySince))
+			}
+		}
+	}
+
+	if crossZone != list.crossZone {
+		if crossZone {
+			list.metricsRegistry.Increment(metrics.DopplerZoneFallbacks)
+		} else {
+			list.metricsRegistry.Increment(metrics.DopplerZoneReturns)
+		}
+	}
+	list.crossZone = crossZone
+	list.addresses = list.sameZone
+	if crossZone {
+		list.addresses = list.otherZones
+	}
+}
+
+func (list *ZoneAddressList) addressesByZone(node storeadapter.StoreNode) (map[string][]string, map[string]int) {
+	addresses := make(map[string][]string)
+	loads := make(map[string]int)
+	var walk func(storeadapter.StoreNode)
+	walk = func(node storeadapter.StoreNode) {
+		if len(node.ChildNodes) == 0 {
+			address, load, hasLoad := parseRegistration(string(node.Value))
+			if address == "" {
+				return
+			}
+			zone := strings.SplitN(strings.TrimPrefix(node.Key, list.storeKey+"/"), "/", 2)[0]
+			addresses[zone] = append(addresses[zone], address)
+			if hasLoad {
+				loads[address] = load
+			}
+			return
+		}
+		for _, child := range node.ChildNodes {
+			walk(child)
+		}
+	}
+	walk(node)
+	return addresses, loads
+}
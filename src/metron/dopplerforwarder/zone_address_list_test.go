@@ -0,0 +1,416 @@
+package dopplerforwarder_test
+
+import (
+	"errors"
+	"metron/dopplerforwarder"
+	"metron/metrics"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/cloudfoundry/storeadapter"
+	"github.com/cloudfoundry/storeadapter/fakestoreadapter"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ZoneAddressList", func() {
+	var (
+		store *fakestoreadapter.FakeStoreAdapter
+		list  *dopplerforwarder.ZoneAddressList
+	)
+
+	register := func(key string, address string) {
+		err := store.SetMulti([]storeadapter.StoreNode{{Key: "/healthstatus/doppler/" + key, Value: []byte(address)}})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	deregister := func(key string) {
+		err := store.Delete("/healthstatus/doppler/" + key)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		store = fakestoreadapter.New()
+		register("z1/doppler_z1/0", "10.0.1.1")
+		register("z1/doppler_z1/1", "10.0.1.2")
+		register("z2/doppler_z2/0", "10.0.2.1")
+		register("z3/doppler_z3/0", "10.0.3.1")
+
+		list = dopplerforwarder.NewZoneAddressList(store, "/healthstatus/doppler", "z1", loggertesthelper.Logger())
+		go list.Run(10 * time.Millisecond)
+	})
+
+	AfterEach(func() {
+		list.Stop()
+	})
+
+	It("has no addresses before the registry is read", func() {
+		Expect(list.GetAddresses()).To(BeEmpty())
+	})
+
+	It("returns every doppler in its own zone", func() {
+		Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.1", "10.0.1.2"))
+		Expect(list.CrossZone()).To(BeFalse())
+	})
+
+	It("picks up dopplers registering in its own zone", func() {
+		register("z1/doppler_z1/2", "10.0.1.3")
+
+		Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.1", "10.0.1.2", "10.0.1.3"))
+	})
+
+	Context("when no doppler is left in its own zone", func() {
+		BeforeEach(func() {
+			Eventually(list.GetAddresses).Should(HaveLen(2))
+			deregister("z1")
+		})
+
+		It("falls back to the dopplers in every other zone", func() {
+			Eventually(list.GetAddresses).Should(ConsistOf("10.0.2.1", "10.0.3.1"))
+			Expect(list.CrossZone()).To(BeTrue())
+		})
+
+		It("returns to its own zone once a doppler registers there again", func() {
+			Eventually(list.CrossZone).Should(BeTrue())
+			register("z1/doppler_z1/1", "10.0.1.2")
+
+			Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.2"))
+			Expect(list.CrossZone()).To(BeFalse())
+		})
+	})
+
+	Context("when dopplers register their load", func() {
+		BeforeEach(func() {
+			register("z1/doppler_z1/0", "10.0.1.1 load=20")
+			register("z1/doppler_z1/1", "10.0.1.2 load=80")
+		})
+
+		It("returns the addresses without the hints and the load of every doppler", func() {
+			Eventually(list.Loads).Should(Equal(map[string]int{"10.0.1.1": 20, "10.0.1.2": 80}))
+			Expect(list.GetAddresses()).To(ConsistOf("10.0.1.1", "10.0.1.2"))
+		})
+
+		It("picks up changes to the loads", func() {
+			Eventually(list.Loads).Should(HaveKeyWithValue("10.0.1.1", 20))
+			register("z1/doppler_z1/0", "10.0.1.1 load=95")
+
+			Eventually(list.Loads).Should(HaveKeyWithValue("10.0.1.1", 95))
+		})
+
+		It("clamps the loads to the range from 0 to 100", func() {
+			register("z1/doppler_z1/0", "10.0.1.1 load=140")
+			register("z1/doppler_z1/1", "10.0.1.2 load=-3")
+
+			Eventually(list.Loads).Should(Equal(map[string]int{"10.0.1.1": 100, "10.0.1.2": 0}))
+		})
+
+		It("returns no loads while a doppler has not registered its load", func() {
+			register("z1/doppler_z1/2", "10.0.1.3")
+
+			Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.1", "10.0.1.2", "10.0.1.3"))
+			Expect(list.Loads()).To(BeNil())
+		})
+	})
+
+	It("returns no loads when the dopplers do not register their load", func() {
+		Eventually(list.GetAddresses).Should(HaveLen(2))
+		Expect(list.Loads()).To(BeNil())
+	})
+
+	It("has no addresses when no doppler is registered at all", func() {
+		Eventually(list.GetAddresses).Should(HaveLen(2))
+		deregister("z1")
+		deregister("z2")
+		deregister("z3")
+
+		Eventually(list.GetAddresses).Should(BeEmpty())
+		Expect(list.CrossZone()).To(BeFalse())
+	})
+})
+
+// flakyStore is an etcd that can go away and come back.
+type flakyStore struct {
+	*fakestoreadapter.FakeStoreAdapter
+
+	lock     sync.Mutex
+	down     bool
+	lists    int
+	connects int
+}
+
+func (store *flakyStore) setDown(down bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.down = down
+}
+
+func (store *flakyStore) attempts() (lists int, connects int) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.lists, store.connects
+}
+
+func (store *flakyStore) Connect() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.connects++
+	if store.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (store *flakyStore) ListRecursively(key string) (storeadapter.StoreNode, error) {
+	store.lock.Lock()
+	store.lists++
+	down := store.down
+	store.lock.Unlock()
+
+	if down {
+		return storeadapter.StoreNode{}, storeadapter.ErrorTimeout
+	}
+	return store.FakeStoreAdapter.ListRecursively(key)
+}
+
+var _ = Describe("ZoneAddressList without a registry", func() {
+	var (
+		store    *flakyStore
+		list     *dopplerforwarder.ZoneAddressList
+		registry *metrics.Registry
+	)
+
+	BeforeEach(func() {
+		store = &flakyStore{FakeStoreAdapter: fakestoreadapter.New()}
+		err := store.SetMulti([]storeadapter.StoreNode{{Key: "/healthstatus/doppler/z1/doppler_z1/0", Value: []byte("10.0.1.1")}})
+		Expect(err).NotTo(HaveOccurred())
+		registry = metrics.NewRegistry()
+
+		list = dopplerforwarder.NewZoneAddressList(store, "/healthstatus/doppler", "z1", loggertesthelper.Logger())
+		list.SetMaxBackoff(200 * time.Millisecond)
+		list.SetMetricsRegistry(registry)
+		go list.Run(10 * time.Millisecond)
+
+		Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.1"))
+		store.setDown(true)
+	})
+
+	AfterEach(func() {
+		list.Stop()
+	})
+
+	It("reports no loads while the addresses are stale", func() {
+		err := store.SetMulti([]storeadapter.StoreNode{{Key: "/healthstatus/doppler/z1/doppler_z1/0", Value: []byte("10.0.1.1 load=10")}})
+		Expect(err).NotTo(HaveOccurred())
+		store.setDown(false)
+		Eventually(list.Loads).Should(HaveKeyWithValue("10.0.1.1", 10))
+
+		store.setDown(true)
+
+		Eventually(list.Stale).Should(BeTrue())
+		Expect(list.Loads()).To(BeNil())
+	})
+
+	It("keeps the addresses read last and reports them as stale", func() {
+		Eventually(list.Stale).Should(BeTrue())
+		Expect(list.GetAddresses()).To(ConsistOf("10.0.1.1"))
+
+		Eventually(list.Staleness).Should(BeNumerically(">", 50*time.Millisecond))
+		Eventually(func() float64 { return registry.Gauge(metrics.DopplerRegistryStalenessSeconds) }).Should(BeNumerically(">", 0.05))
+	})
+
+	It("backs off between the attempts to reach the registry", func() {
+		Eventually(list.Stale).Should(BeTrue())
+		lists, _ := store.attempts()
+
+		time.Sleep(500 * time.Millisecond)
+		listsWhileDown, connectsWhileDown := store.attempts()
+		Expect(listsWhileDown - lists).To(BeNumerically("<=", 1))
+		Expect(connectsWhileDown).To(BeNumerically(">=", 2))
+		Expect(connectsWhileDown).To(BeNumerically("<", 25))
+	})
+
+	It("reconnects and reads the whole registry as soon as it is back", func() {
+		Eventually(list.Stale).Should(BeTrue())
+		err := store.SetMulti([]storeadapter.StoreNode{{Key: "/healthstatus/doppler/z1/doppler_z1/1", Value: []byte("10.0.1.2")}})
+		Expect(err).NotTo(HaveOccurred())
+		err = store.Delete("/healthstatus/doppler/z1/doppler_z1/0")
+		Expect(err).NotTo(HaveOccurred())
+
+		store.setDown(false)
+
+		Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.2"))
+		Expect(list.Stale()).To(BeFalse())
+		Expect(list.Staleness()).To(BeZero())
+		Expect(registry.Gauge(metrics.DopplerRegistryStalenessSeconds)).To(BeZero())
+	})
+})
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+var _ = Describe("ZoneAddressList with a zone failover", func() {
+	const (
+		failAfter     = 10 * time.Second
+		failBackAfter = 30 * time.Second
+	)
+
+	var (
+		store    *fakestoreadapter.FakeStoreAdapter
+		list     *dopplerforwarder.ZoneAddressList
+		clock    *fakeClock
+		registry *metrics.Registry
+
+		originalErrorWindow time.Duration
+	)
+
+	register := func(key string, address string) {
+		err := store.SetMulti([]storeadapter.StoreNode{{Key: "/healthstatus/doppler/" + key, Value: []byte(address)}})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	failSameZone := func() {
+		list.ReportSend("10.0.1.1", errors.New("connection refused"))
+		list.ReportSend("10.0.1.2", errors.New("connection refused"))
+	}
+
+	// failSameZoneFor keeps the sends to the dopplers in z1 failing every
+	// second for d.
+	failSameZoneFor := func(d time.Duration) {
+		failSameZone()
+		for elapsed := time.Duration(0); elapsed < d; elapsed += time.Second {
+			clock.advance(time.Second)
+			failSameZone()
+		}
+	}
+
+	BeforeEach(func() {
+		originalErrorWindow = dopplerforwarder.ZoneErrorWindow
+		dopplerforwarder.ZoneErrorWindow = 5 * time.Second
+
+		store = fakestoreadapter.New()
+		register("z1/doppler_z1/0", "10.0.1.1")
+		register("z1/doppler_z1/1", "10.0.1.2")
+		register("z2/doppler_z2/0", "10.0.2.1")
+
+		clock = &fakeClock{now: time.Unix(1000, 0)}
+		registry = metrics.NewRegistry()
+
+		list = dopplerforwarder.NewZoneAddressList(store, "/healthstatus/doppler", "z1", loggertesthelper.Logger())
+		list.SetZoneFailover(failAfter, failBackAfter)
+		list.SetClock(clock)
+		list.SetMetricsRegistry(registry)
+		go list.Run(10 * time.Millisecond)
+
+		Eventually(list.GetAddresses).Should(ConsistOf("10.0.1.1", "10.0.1.2"))
+	})
+
+	AfterEach(func() {
+		list.Stop()
+		dopplerforwarder.ZoneErrorWindow = originalErrorWindow
+	})
+
+	It("stays in its own zone while one of its dopplers is healthy", func() {
+		list.ReportSend("10.0.1.1", errors.New("connection refused"))
+		clock.advance(failAfter)
+		list.ReportSend("10.0.1.1", errors.New("connection refused"))
+
+		Expect(list.GetAddresses()).To(ConsistOf("10.0.1.1", "10.0.1.2"))
+		Expect(list.CrossZone()).To(BeFalse())
+	})
+
+	It("stays in its own zone through failures shorter than the fail over duration", func() {
+		failSameZoneFor(failAfter - time.Second)
+		Expect(list.CrossZone()).To(BeFalse())
+
+		list.ReportSend("10.0.1.2", nil)
+		failSameZoneFor(failAfter - time.Second)
+		Expect(list.CrossZone()).To(BeFalse())
+		Expect(registry.Counter(metrics.DopplerZoneFallbacks)).To(BeZero())
+	})
+
+	It("falls back to the other zones once its dopplers have failed for the fail over duration", func() {
+		failSameZoneFor(failAfter - time.Second)
+		Expect(list.CrossZone()).To(BeFalse())
+
+		clock.advance(time.Second)
+		Expect(list.CrossZone()).To(BeTrue())
+		Expect(list.GetAddresses()).To(ConsistOf("10.0.2.1"))
+		Expect(registry.Counter(metrics.DopplerZoneFallbacks)).To(BeEquivalentTo(1))
+	})
+
+	Context("once it has fallen back", func() {
+		BeforeEach(func() {
+			failSameZoneFor(failAfter - time.Second)
+			clock.advance(time.Second)
+			Expect(list.CrossZone()).To(BeTrue())
+		})
+
+		It("returns once its dopplers have been healthy for the fail back duration", func() {
+			clock.advance(dopplerforwarder.ZoneErrorWindow)
+			Expect(list.CrossZone()).To(BeTrue())
+
+			clock.advance(failBackAfter - time.Second)
+			Expect(list.CrossZone()).To(BeTrue())
+
+			clock.advance(time.Second)
+			Expect(list.CrossZone()).To(BeFalse())
+			Expect(list.GetAddresses()).To(ConsistOf("10.0.1.1", "10.0.1.2"))
+			Expect(registry.Counter(metrics.DopplerZoneReturns)).To(BeEquivalentTo(1))
+		})
+
+		It("starts the fail back duration over when its dopplers fail again", func() {
+			clock.advance(dopplerforwarder.ZoneErrorWindow)
+			Expect(list.CrossZone()).To(BeTrue())
+
+			clock.advance(failBackAfter - time.Second)
+			failSameZone()
+			Expect(list.CrossZone()).To(BeTrue())
+
+			clock.advance(dopplerforwarder.ZoneErrorWindow)
+			Expect(list.CrossZone()).To(BeTrue())
+			clock.advance(failBackAfter - time.Second)
+			Expect(list.CrossZone()).To(BeTrue())
+			clock.advance(time.Second)
+			Expect(list.CrossZone()).To(BeFalse())
+			Expect(registry.Counter(metrics.DopplerZoneReturns)).To(BeEquivalentTo(1))
+		})
+
+		It("does not count sends to the other zones against its own dopplers", func() {
+			list.ReportSend("10.0.2.1", errors.New("connection refused"))
+			clock.advance(dopplerforwarder.ZoneErrorWindow)
+			Expect(list.CrossZone()).To(BeTrue())
+			clock.advance(failBackAfter)
+
+			Expect(list.CrossZone()).To(BeFalse())
+		})
+	})
+
+	It("waits for the fail back duration when a doppler registers in its own zone again", func() {
+		store.Delete("/healthstatus/doppler/z1")
+		Eventually(list.CrossZone).Should(BeTrue())
+		Expect(registry.Counter(metrics.DopplerZoneFallbacks)).To(BeEquivalentTo(1))
+
+		register("z1/doppler_z1/0", "10.0.1.1")
+		Consistently(list.GetAddresses).Should(ConsistOf("10.0.2.1"))
+
+		clock.advance(failBackAfter)
+		Expect(list.GetAddresses()).To(ConsistOf("10.0.1.1"))
+		Expect(registry.Counter(metrics.DopplerZoneReturns)).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,114 @@
+package dopplerforwarder
+
+import (
+	"time"
+)
+
+// ZoneErrorWindow is how long a failed send counts against a doppler. A
+// doppler whose last send failed within the window is unhealthy; once the
+// window has passed, or a send to it succeeds, it is healthy again. It is read
+// when the zone failover is set up.
+var ZoneErrorWindow = 10 * time.Second
+
+// Clock tells the time. A ZoneAddressList uses the wall clock unless SetClock
+// replaces it.
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// sendReporter is implemented by address lists, such as ZoneAddressList, that
+// take the outcome of the sends to their dopplers into account.
+type sendReporter interface {
+	ReportSend(address string, err error)
+}
+
+// zoneFailover decides from the recent send errors to the dopplers in
+// metron's zone when to fall back to the dopplers in other zones and when to
+// return, so that a short outage in the zone does not make metron flap
+// between the zones.
+type zoneFailover struct {
+	failAfter     time.Duration
+	failBackAfter time.Duration
+	errorWindow   time.Duration
+
+	failedAt       map[string]time.Time // by address, while the last send failed
+	unhealthySince time.Time
+	healthySince   time.Time
+}
+
+func newZoneFailover(failAfter time.Duration, failBackAfter time.Duration) *zoneFailover {
+	return &zoneFailover{
+		failAfter:     failAfter,
+		failBackAfter: failBackAfter,
+		errorWindow:   ZoneErrorWindow,
+		failedAt:      make(map[string]time.Time),
+	}
+}
+
+func (f *zoneFailover) reportSend(address string, err error, now time.Time) {
+	if err == nil {
+		delete(f.failedAt, address)
+		return
+	}
+	f.failedAt[address] = now
+}
+
+// forget drops the send errors of the dopplers that are no longer registered.
+func (f *zoneFailover) forget(registered map[string]bool) {
+	for address := range f.failedAt {
+		if !registered[address] {
+			delete(f.failedAt, address)
+		}
+	}
+}
+
+// reset starts over, for when the zone is picked by the registry alone.
+func (f *zoneFailover) reset() {
+	f.unhealthySince = time.Time{}
+	f.healthySince = time.Time{}
+}
+
+// crossZone returns whether to send to the dopplers in other zones from now
+// on. The zone is given up once none of sameZone has been healthy for
+// failAfter, and returned to once one of them has been healthy for
+// failBackAfter.
+func (f *zoneFailover) crossZone(current bool, sameZone []string, now time.Time) bool {
+	healthy := f.healthy(sameZone, now)
+	if !current {
+		f.healthySince = time.Time{}
+		if healthy {
+			f.unhealthySince = time.Time{}
+			return false
+		}
+		if f.unhealthySince.IsZero() {
+			f.unhealthySince = now
+		}
+		return now.Sub(f.unhealthySince) >= f.failAfter
+	}
+
+	f.unhealthySince = time.Time{}
+	if !healthy {
+		f.healthySince = time.Time{}
+		return true
+	}
+	if f.healthySince.IsZero() {
+		f.healthySince = now
+	}
+	return now.Sub(f.healthySince) < f.failBackAfter
+}
+
+func (f *zoneFailover) healthy(addresses []string, now time.Time) bool {
+	for _, address := range addresses {
+		failedAt, failed := f.failedAt[address]
+		if !failed || now.Sub(failedAt) >= f.errorWindow {
+			return true
+		}
+	}
+	return false
+}
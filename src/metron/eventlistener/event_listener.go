@@ -1,9 +1,11 @@
 package eventlistener
 
 import (
+	"metron/metrics"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
@@ -11,6 +13,9 @@ import (
 
 type EventListener interface {
 	instrumentation.Instrumentable
+	SetReceiveBufferSize(size int)
+	SetKernelDropsReader(reader KernelDropsReader, interval time.Duration)
+	SetMetricsRegistry(registry *metrics.Registry)
 	Start()
 	Stop()
 }
@@ -29,6 +34,15 @@ type eventListener struct {
 	receivedByteCount    uint64
 	contextName          string
 
+	receiveBufferSize          int
+	effectiveReceiveBufferSize int
+
+	kernelDropsReader   KernelDropsReader
+	kernelDropsInterval time.Duration
+	kernelDrops         uint64
+
+	registry *metrics.Registry
+
 	sync.RWMutex
 	*gosteno.Logger
 }
@@ -48,8 +62,25 @@ func (eventListener *eventListener) Start() {
 	eventListener.connection = connection
 	eventListener.Unlock()
 
+	if eventListener.receiveBufferSize > 0 {
+		eventListener.setReceiveBuffer(connection)
+	}
+
 	readBuffer := make([]byte, 65535) //buffer with size = max theoretical UDP size
 	defer close(eventListener.dataChannel)
+
+	if eventListener.kernelDropsReader != nil && eventListener.kernelDropsInterval > 0 {
+		stopChan := make(chan struct{})
+		reporterDone := make(chan struct{})
+		go func() {
+			defer close(reporterDone)
+			eventListener.reportKernelDrops(connection.LocalAddr(), stopChan)
+		}()
+		defer func() {
+			close(stopChan)
+			<-reporterDone
+		}()
+	}
 	for {
 		readCount, senderAddr, err := connection.ReadFrom(readBuffer)
 		if err != nil {
@@ -62,24 +93,43 @@ func (eventListener *eventListener) Start() {
 
 		atomic.AddUint64(&eventListener.receivedMessageCount, 1)
 		atomic.AddUint64(&eventListener.receivedByteCount, uint64(readCount))
+		eventListener.registry.Increment(metrics.DropsondeReceivedEnvelopes)
 		eventListener.dataChannel <- readData
 
 		go eventListener.requester.Start(senderAddr, connection)
 	}
 }
 
+// SetMetricsRegistry makes the listener count the envelopes it receives in
+// registry. It must be called before Start.
+func (eventListener *eventListener) SetMetricsRegistry(registry *metrics.Registry) {
+	eventListener.registry = registry
+}
+
 func (eventListener *eventListener) Stop() {
 	eventListener.Lock()
 	defer eventListener.Unlock()
-	eventListener.connection.Close()
+	if eventListener.connection != nil {
+		eventListener.connection.Close()
+	}
 }
 
 func (eventListener *eventListener) metrics() []instrumentation.Metric {
-	return []instrumentation.Metric{
+	metrics := []instrumentation.Metric{
 		instrumentation.Metric{Name: "currentBufferCount", Value: len(eventListener.dataChannel)},
 		instrumentation.Metric{Name: "receivedMessageCount", Value: atomic.LoadUint64(&eventListener.receivedMessageCount)},
 		instrumentation.Metric{Name: "receivedByteCount", Value: atomic.LoadUint64(&eventListener.receivedByteCount)},
 	}
+
+	eventListener.RLock()
+	defer eventListener.RUnlock()
+	if eventListener.receiveBufferSize > 0 {
+		metrics = append(metrics, instrumentation.Metric{Name: "receiveBufferBytes", Value: eventListener.effectiveReceiveBufferSize})
+	}
+	if eventListener.kernelDropsReader != nil && eventListener.kernelDropsInterval > 0 {
+		metrics = append(metrics, instrumentation.Metric{Name: "kernelDrops", Value: atomic.LoadUint64(&eventListener.kernelDrops)})
+	}
+	return metrics
 }
 
 func (eventListener *eventListener) Emit() instrumentation.Context {
@@ -0,0 +1,178 @@
+package eventlistener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"metron/metrics"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	KernelDropsOrigin = metrics.Origin
+	KernelDropsName   = "udp.kernelDrops"
+)
+
+// KernelDropsReader returns how many datagrams the kernel has dropped for the
+// UDP socket bound to localAddr since the socket was opened, such as those
+// that arrived while its receive buffer was full.
+type KernelDropsReader interface {
+	KernelDrops(localAddr net.Addr) (uint64, error)
+}
+
+// SetKernelDropsReader makes the listener read its socket's kernel drops
+// every interval and emit them as a ValueMetric named
+// KernelDropsOrigin.KernelDropsName alongside the datagrams it receives. They
+// are also reported as the kernelDrops metric. It must be called before
+// Start.
+func (eventListener *eventListener) SetKernelDropsReader(reader KernelDropsReader, interval time.Duration) {
+	eventListener.Lock()
+	defer eventListener.Unlock()
+
+	eventListener.kernelDropsReader = reader
+	eventListener.kernelDropsInterval = interval
+}
+
+func (eventListener *eventListener) reportKernelDrops(localAddr net.Addr, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(eventListener.kernelDropsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+
+		drops, err := eventListener.kernelDropsReader.KernelDrops(localAddr)
+		if err != nil {
+			eventListener.Debugf("EventListener: Error reading the kernel drops of %s: %s", localAddr, err)
+			continue
+		}
+		atomic.StoreUint64(&eventListener.kernelDrops, drops)
+
+		message, err := proto.Marshal(kernelDropsEnvelope(drops))
+		if err != nil {
+			eventListener.Errorf("EventListener: Error marshalling the kernel drops: %s", err)
+			continue
+		}
+
+		select {
+		case eventListener.dataChannel <- message:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func kernelDropsEnvelope(drops uint64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(KernelDropsOrigin),
+		Timestamp: proto.Int64(time.Now().UnixNano()),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(KernelDropsName),
+			Value: proto.Float64(float64(drops)),
+			Unit:  proto.String("count"),
+		},
+	}
+}
+
+type procNetUDPReader struct {
+	paths []string
+}
+
+// NewProcNetUDPReader returns a KernelDropsReader that looks the socket up in
+// /proc/net/udp and /proc/net/udp6, which are only available on Linux.
+func NewProcNetUDPReader() KernelDropsReader {
+	return procNetUDPReader{paths: []string{"/proc/net/udp", "/proc/net/udp6"}}
+}
+
+func (reader procNetUDPReader) KernelDrops(localAddr net.Addr) (uint64, error) {
+	udpAddr, ok := localAddr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a UDP address", localAddr)
+	}
+
+	for _, path := range reader.paths {
+		drops, found, err := kernelDropsFromFile(path, udpAddr)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return drops, nil
+		}
+	}
+	return 0, fmt.Errorf("no socket bound to %s found in %s", localAddr, strings.Join(reader.paths, ", "))
+}
+
+// kernelDropsFromFile scans a /proc/net/udp style table, where every socket
+// is a line like
+//
+//	sl  local_address rem_address   st tx_queue:rx_queue ... inode ref pointer drops
+//	12: 0100007F:0D80 00000000:0000 07 00000000:00000000 ... 43081 2 0000000000000000 5
+func kernelDropsFromFile(path string, localAddr *net.UDPAddr) (uint64, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+
+		ip, port, err := parseProcNetAddress(fields[1])
+		if err != nil || port != localAddr.Port || !ip.Equal(localAddr.IP) {
+			continue
+		}
+
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid drops %q in %s", fields[12], path)
+		}
+		return drops, true, nil
+	}
+	return 0, false, scanner.Err()
+}
+
+// parseProcNetAddress parses an address like 0100007F:0D80. The IP address
+// is printed as 32 bit words in host byte order, which is little endian on the
+// platforms metron runs on.
+func parseProcNetAddress(address string) (net.IP, int, error) {
+	parts := strings.Split(address, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %q", address)
+	}
+
+	words, err := hex.DecodeString(parts[0])
+	if err != nil || (len(words) != net.IPv4len && len(words) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid IP address %q", parts[0])
+	}
+	ip := make(net.IP, len(words))
+	for i := 0; i < len(words); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(words[i:]))
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", parts[1])
+	}
+	return ip, int(port), nil
+}
@@ -0,0 +1,143 @@
+package eventlistener_test
+
+import (
+	"errors"
+	"metron/eventlistener"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EventListener kernel drops", func() {
+	var (
+		listener       eventlistener.EventListener
+		dataChannel    <-chan []byte
+		fakePinger     *fakePingSender
+		reader         *fakeKernelDropsReader
+		listenerClosed chan struct{}
+	)
+
+	metricValue := func(name string) interface{} {
+		for _, metric := range listener.Emit().Metrics {
+			if metric.Name == name {
+				return metric.Value
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+		listenerClosed = make(chan struct{})
+		fakePinger = &fakePingSender{pingTargets: make(map[string]chan (struct{}))}
+		reader = &fakeKernelDropsReader{drops: 42}
+		listener, dataChannel = eventlistener.NewEventListener("127.0.0.1:3459", loggertesthelper.Logger(), "eventListener", fakePinger)
+		listener.SetKernelDropsReader(reader, 10*time.Millisecond)
+	})
+
+	JustBeforeEach(func() {
+		go func() {
+			listener.Start()
+			close(listenerClosed)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening on port"))
+	})
+
+	AfterEach(func() {
+		listener.Stop()
+		<-listenerClosed
+	})
+
+	It("emits the kernel drops of its socket as a ValueMetric", func() {
+		var message []byte
+		Eventually(dataChannel).Should(Receive(&message))
+
+		var envelope events.Envelope
+		Expect(proto.Unmarshal(message, &envelope)).To(Succeed())
+		Expect(envelope.GetOrigin()).To(Equal("MetronAgent"))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("udp.kernelDrops"))
+		Expect(envelope.GetValueMetric().GetValue()).To(BeNumerically("==", 42))
+		Expect(envelope.GetValueMetric().GetUnit()).To(Equal("count"))
+
+		Expect(reader.LocalAddr()).To(Equal("127.0.0.1:3459"))
+	})
+
+	It("reports the kernel drops as a metric", func() {
+		Eventually(func() interface{} { return metricValue("kernelDrops") }).Should(Equal(uint64(42)))
+	})
+
+	Context("when the kernel drops cannot be read", func() {
+		BeforeEach(func() {
+			reader.SetError(errors.New("no such socket"))
+		})
+
+		It("emits nothing", func() {
+			Eventually(reader.LocalAddr).ShouldNot(BeEmpty())
+			Consistently(dataChannel).ShouldNot(Receive())
+			Expect(metricValue("kernelDrops")).To(Equal(uint64(0)))
+		})
+	})
+})
+
+var _ = Describe("ProcNetUDPReader", func() {
+	BeforeEach(func() {
+		if _, err := os.Stat("/proc/net/udp"); err != nil {
+			Skip("/proc/net/udp is not available")
+		}
+	})
+
+	It("reads the drops of a socket", func() {
+		connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer connection.Close()
+
+		drops, err := eventlistener.NewProcNetUDPReader().KernelDrops(connection.LocalAddr())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(drops).To(BeZero())
+	})
+
+	It("returns an error for a socket that is not open", func() {
+		connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		localAddr := connection.LocalAddr()
+		connection.Close()
+
+		_, err = eventlistener.NewProcNetUDPReader().KernelDrops(localAddr)
+		Expect(err).To(MatchError(ContainSubstring("no socket bound to " + localAddr.String())))
+	})
+})
+
+type fakeKernelDropsReader struct {
+	sync.Mutex
+	drops     uint64
+	err       error
+	localAddr string
+}
+
+func (reader *fakeKernelDropsReader) KernelDrops(localAddr net.Addr) (uint64, error) {
+	reader.Lock()
+	defer reader.Unlock()
+	reader.localAddr = localAddr.String()
+	return reader.drops, reader.err
+}
+
+func (reader *fakeKernelDropsReader) SetError(err error) {
+	reader.Lock()
+	defer reader.Unlock()
+	reader.err = err
+}
+
+func (reader *fakeKernelDropsReader) LocalAddr() string {
+	reader.Lock()
+	defer reader.Unlock()
+	return reader.localAddr
+}
@@ -0,0 +1,54 @@
+package eventlistener_test
+
+import (
+	"metron/eventlistener"
+	"metron/metrics"
+	"net"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EventListener metrics registry", func() {
+	var (
+		listener       eventlistener.EventListener
+		dataChannel    <-chan []byte
+		registry       *metrics.Registry
+		listenerClosed chan struct{}
+	)
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+		listenerClosed = make(chan struct{})
+		fakePinger := &fakePingSender{pingTargets: make(map[string]chan (struct{}))}
+		listener, dataChannel = eventlistener.NewEventListener("127.0.0.1:3460", loggertesthelper.Logger(), "eventListener", fakePinger)
+		registry = metrics.NewRegistry()
+		listener.SetMetricsRegistry(registry)
+
+		go func() {
+			listener.Start()
+			close(listenerClosed)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening on port"))
+	})
+
+	AfterEach(func() {
+		listener.Stop()
+		<-listenerClosed
+	})
+
+	It("counts every envelope received", func() {
+		connection, err := net.Dial("udp", "127.0.0.1:3460")
+		Expect(err).NotTo(HaveOccurred())
+		defer connection.Close()
+
+		connection.Write([]byte("first"))
+		connection.Write([]byte("second"))
+		Eventually(dataChannel).Should(Receive())
+		Eventually(dataChannel).Should(Receive())
+
+		Expect(registry.Counter(metrics.DropsondeReceivedEnvelopes)).To(BeEquivalentTo(2))
+	})
+})
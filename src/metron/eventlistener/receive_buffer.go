@@ -0,0 +1,42 @@
+package eventlistener
+
+import (
+	"net"
+)
+
+// SetReceiveBufferSize asks the kernel for a socket receive buffer of size
+// bytes once the listener starts, so bursts of datagrams are not dropped
+// before they are read. The kernel may grant a different size, which is
+// logged and reported as the receiveBufferBytes metric. Zero keeps the
+// system default. It must be called before Start.
+func (eventListener *eventListener) SetReceiveBufferSize(size int) {
+	eventListener.Lock()
+	defer eventListener.Unlock()
+
+	eventListener.receiveBufferSize = size
+}
+
+func (eventListener *eventListener) setReceiveBuffer(connection net.PacketConn) {
+	udpConnection, ok := connection.(*net.UDPConn)
+	if !ok {
+		eventListener.Warnf("EventListener: Cannot set the receive buffer of a %T", connection)
+		return
+	}
+
+	err := udpConnection.SetReadBuffer(eventListener.receiveBufferSize)
+	if err != nil {
+		eventListener.Warnf("EventListener: Error setting the receive buffer to %d bytes: %s", eventListener.receiveBufferSize, err)
+		return
+	}
+
+	effectiveSize, err := receiveBufferSize(udpConnection)
+	if err != nil {
+		eventListener.Warnf("EventListener: Set the receive buffer to %d bytes, but could not read back its effective size: %s", eventListener.receiveBufferSize, err)
+		return
+	}
+	eventListener.Infof("EventListener: Set the receive buffer to %d bytes, the effective size is %d bytes", eventListener.receiveBufferSize, effectiveSize)
+
+	eventListener.Lock()
+	eventListener.effectiveReceiveBufferSize = effectiveSize
+	eventListener.Unlock()
+}
@@ -0,0 +1,63 @@
+package eventlistener_test
+
+import (
+	"metron/eventlistener"
+
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EventListener receive buffer", func() {
+	var (
+		listener       eventlistener.EventListener
+		fakePinger     *fakePingSender
+		listenerClosed chan struct{}
+	)
+
+	metricValue := func(name string) interface{} {
+		for _, metric := range listener.Emit().Metrics {
+			if metric.Name == name {
+				return metric.Value
+			}
+		}
+		return nil
+	}
+
+	start := func() {
+		go func() {
+			listener.Start()
+			close(listenerClosed)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening on port"))
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+		listenerClosed = make(chan struct{})
+		fakePinger = &fakePingSender{pingTargets: make(map[string]chan (struct{}))}
+		listener, _ = eventlistener.NewEventListener("127.0.0.1:3458", loggertesthelper.Logger(), "eventListener", fakePinger)
+	})
+
+	AfterEach(func() {
+		listener.Stop()
+		<-listenerClosed
+	})
+
+	It("sets the receive buffer and reports its effective size", func() {
+		listener.SetReceiveBufferSize(65536)
+		start()
+
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Set the receive buffer to 65536 bytes, the effective size is"))
+		Eventually(func() interface{} { return metricValue("receiveBufferBytes") }).Should(BeNumerically(">", 0))
+	})
+
+	It("keeps the system default without a receive buffer size", func() {
+		start()
+
+		Consistently(loggertesthelper.TestLoggerSink.LogContents).ShouldNot(ContainSubstring("receive buffer"))
+		Expect(listener.Emit().Metrics).NotTo(ContainElement(WithTransform(func(metric instrumentation.Metric) string { return metric.Name }, Equal("receiveBufferBytes"))))
+	})
+})
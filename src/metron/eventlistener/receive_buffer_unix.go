@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package eventlistener
+
+import (
+	"net"
+	"syscall"
+)
+
+// receiveBufferSize reads SO_RCVBUF back from the socket. Linux reports twice
+// the size that was set, as it accounts for its bookkeeping overhead.
+func receiveBufferSize(connection *net.UDPConn) (int, error) {
+	rawConnection, err := connection.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockoptErr error
+	err = rawConnection.Control(func(fd uintptr) {
+		size, sockoptErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, sockoptErr
+}
@@ -0,0 +1,10 @@
+package eventlistener
+
+import (
+	"errors"
+	"net"
+)
+
+func receiveBufferSize(connection *net.UDPConn) (int, error) {
+	return 0, errors.New("reading the receive buffer size is not supported on windows")
+}
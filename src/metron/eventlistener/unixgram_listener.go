@@ -0,0 +1,133 @@
+package eventlistener
+
+import (
+	"metron/metrics"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// UnixgramListener receives dropsonde envelopes, one per datagram, from
+// emitters on the same host over a unix datagram socket, sparing them the
+// UDP stack and a port that may collide with another job's. Unlike the UDP
+// listener it does not request heartbeats, as senders on a unix socket
+// usually have no address to answer to.
+type UnixgramListener struct {
+	path        string
+	mode        os.FileMode
+	contextName string
+	dataChannel chan []byte
+	registry    *metrics.Registry
+
+	lock       sync.Mutex
+	connection net.PacketConn
+	stopped    bool
+
+	receivedMessageCount uint64
+	receivedByteCount    uint64
+
+	*gosteno.Logger
+}
+
+// NewUnixgramListener returns a listener on the socket at path, which is
+// created with the permissions in mode.
+func NewUnixgramListener(path string, mode os.FileMode, logger *gosteno.Logger, name string) (*UnixgramListener, <-chan []byte) {
+	dataChannel := make(chan []byte, 1024)
+	return &UnixgramListener{
+		path:        path,
+		mode:        mode,
+		contextName: name,
+		dataChannel: dataChannel,
+		Logger:      logger,
+	}, dataChannel
+}
+
+// SetMetricsRegistry makes the listener count the envelopes it receives in
+// registry. It must be called before Start.
+func (l *UnixgramListener) SetMetricsRegistry(registry *metrics.Registry) {
+	l.registry = registry
+}
+
+// Start reads datagrams until Stop is called, then removes the socket and
+// closes the data channel. A socket left behind by a previous run, e.g.
+// after a crash, is removed first.
+func (l *UnixgramListener) Start() {
+	defer close(l.dataChannel)
+
+	connection, ok := l.listen()
+	if !ok {
+		return
+	}
+	defer os.Remove(l.path)
+	l.Infof("Listening on unix socket %s", l.path)
+
+	readBuffer := make([]byte, 65535)
+	for {
+		readCount, _, err := connection.ReadFrom(readBuffer)
+		if err != nil {
+			l.Debugf("Error while reading. %s", err)
+			return
+		}
+		readData := make([]byte, readCount)
+		copy(readData, readBuffer[:readCount])
+
+		atomic.AddUint64(&l.receivedMessageCount, 1)
+		atomic.AddUint64(&l.receivedByteCount, uint64(readCount))
+		l.registry.Increment(metrics.DropsondeReceivedEnvelopes)
+		l.dataChannel <- readData
+	}
+}
+
+func (l *UnixgramListener) listen() (net.PacketConn, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return nil, false
+	}
+
+	if info, err := os.Lstat(l.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		l.Infof("Removing the stale unix socket %s", l.path)
+		os.Remove(l.path)
+	}
+
+	connection, err := net.ListenPacket("unixgram", l.path)
+	if err != nil {
+		l.Fatalf("Failed to listen on unix socket %s. %s", l.path, err)
+		return nil, false
+	}
+	if err := os.Chmod(l.path, l.mode); err != nil {
+		connection.Close()
+		os.Remove(l.path)
+		l.Fatalf("Failed to set the permissions of unix socket %s. %s", l.path, err)
+		return nil, false
+	}
+
+	l.connection = connection
+	return connection, true
+}
+
+func (l *UnixgramListener) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stopped = true
+	if l.connection != nil {
+		l.connection.Close()
+	}
+}
+
+func (l *UnixgramListener) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: l.contextName,
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "currentBufferCount", Value: len(l.dataChannel)},
+			instrumentation.Metric{Name: "receivedMessageCount", Value: atomic.LoadUint64(&l.receivedMessageCount)},
+			instrumentation.Metric{Name: "receivedByteCount", Value: atomic.LoadUint64(&l.receivedByteCount)},
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package eventlistener_test
+
+import (
+	"io/ioutil"
+	"metron/eventlistener"
+	"metron/metrics"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UnixgramListener", func() {
+	var (
+		socketDir      string
+		socketPath     string
+		listener       *eventlistener.UnixgramListener
+		dataChannel    <-chan []byte
+		registry       *metrics.Registry
+		listenerClosed chan struct{}
+	)
+
+	start := func() {
+		loggertesthelper.TestLoggerSink.Clear()
+		listener, dataChannel = eventlistener.NewUnixgramListener(socketPath, 0620, loggertesthelper.Logger(), "dropsondeUnixgramListener")
+		registry = metrics.NewRegistry()
+		listener.SetMetricsRegistry(registry)
+
+		listenerClosed = make(chan struct{})
+		go func() {
+			listener.Start()
+			close(listenerClosed)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening on unix socket"))
+	}
+
+	stop := func() {
+		listener.Stop()
+		Eventually(listenerClosed).Should(BeClosed())
+	}
+
+	metricValue := func(name string) interface{} {
+		for _, metric := range listener.Emit().Metrics {
+			if metric.Name == name {
+				return metric.Value
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		socketDir, err = ioutil.TempDir("", "unixgram-listener")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(socketDir, "dropsonde.sock")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(socketDir)
+	})
+
+	It("passes every datagram on as it is", func() {
+		start()
+		defer stop()
+
+		connection, err := net.Dial("unixgram", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		defer connection.Close()
+
+		_, err = connection.Write([]byte("first envelope"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = connection.Write([]byte("second envelope"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(dataChannel).Should(Receive(Equal([]byte("first envelope"))))
+		Eventually(dataChannel).Should(Receive(Equal([]byte("second envelope"))))
+		Expect(metricValue("receivedMessageCount")).To(BeEquivalentTo(2))
+		Expect(metricValue("receivedByteCount")).To(BeEquivalentTo(len("first envelope") + len("second envelope")))
+		Expect(registry.Counter(metrics.DropsondeReceivedEnvelopes)).To(BeEquivalentTo(2))
+	})
+
+	It("creates the socket with the given permissions", func() {
+		start()
+		defer stop()
+
+		info, err := os.Stat(socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode() & os.ModeSocket).NotTo(BeZero())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0620)))
+	})
+
+	It("removes the socket and closes the data channel once stopped", func() {
+		start()
+		stop()
+
+		Expect(socketPath).NotTo(BeAnExistingFile())
+		Eventually(dataChannel).Should(BeClosed())
+	})
+
+	It("replaces a stale socket left behind by a previous run", func() {
+		stale, err := net.ListenPacket("unixgram", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		// closing a unixgram socket leaves its file behind, as a crash would
+		stale.Close()
+		Expect(socketPath).To(BeAnExistingFile())
+
+		start()
+		defer stop()
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Removing the stale unix socket"))
+
+		connection, err := net.Dial("unixgram", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		defer connection.Close()
+		connection.Write([]byte("envelope"))
+		Eventually(dataChannel).Should(Receive(Equal([]byte("envelope"))))
+	})
+
+	It("returns right away when stopped before it started", func() {
+		listener, dataChannel = eventlistener.NewUnixgramListener(socketPath, 0620, loggertesthelper.Logger(), "dropsondeUnixgramListener")
+		listener.Stop()
+		listener.Start()
+
+		Expect(dataChannel).To(BeClosed())
+		Expect(socketPath).NotTo(BeAnExistingFile())
+	})
+})
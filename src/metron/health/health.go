@@ -0,0 +1,132 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"healthendpoint"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// Report is the JSON document served by the health endpoint. Counts "in the
+// last interval" are the difference between the two most recent samples of
+// the underlying instrumentation metrics. Sent messages are counted by
+// transport; a message may be a batch of envelopes.
+type Report struct {
+	UptimeSeconds         float64           `json:"uptimeSeconds"`
+	IntervalSeconds       float64           `json:"intervalSeconds"`
+	DopplerReachable      bool              `json:"dopplerReachable"`
+	UnreachableSeconds    float64           `json:"unreachableSeconds"`
+	Transport             string            `json:"transport"`
+	ReceivedEnvelopes     uint64            `json:"receivedEnvelopes"`
+	SentMessages          map[string]uint64 `json:"sentMessages"`
+	RetryBufferedMessages int64             `json:"retryBufferedMessages"`
+}
+
+// Forwarder is the part of the doppler forwarder the health endpoint reports
+// on.
+type Forwarder interface {
+	instrumentation.Instrumentable
+	UnreachableSince() time.Time
+	LastTransport() string
+}
+
+type sample struct {
+	received uint64
+	sent     map[string]uint64
+}
+
+// Server serves a Report on a localhost HTTP endpoint. Traffic is read from
+// the instrumentation of the batcher, which every envelope passes on its way
+// to doppler, and of the forwarder, so it matches the emitted metrics.
+// Sampling happens once per interval; the reachability of dopplers is checked
+// on every request. The status is 503 Service Unavailable once no doppler has
+// been reachable for longer than unreachableThreshold.
+type Server struct {
+	interval             time.Duration
+	unreachableThreshold time.Duration
+	batcher              instrumentation.Instrumentable
+	forwarder            Forwarder
+	startTime            time.Time
+
+	*healthendpoint.Server
+
+	lock   sync.RWMutex
+	report Report
+	last   sample
+}
+
+func NewServer(address string, interval time.Duration, unreachableThreshold time.Duration, batcher instrumentation.Instrumentable, forwarder Forwarder, logger *gosteno.Logger) *Server {
+	s := &Server{
+		interval:             interval,
+		unreachableThreshold: unreachableThreshold,
+		batcher:              batcher,
+		forwarder:            forwarder,
+		startTime:            time.Now(),
+	}
+	s.Server = healthendpoint.NewServer(address, interval, s.sample, s, logger)
+	return s
+}
+
+func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.lock.RLock()
+	report := s.report
+	s.lock.RUnlock()
+
+	report.UptimeSeconds = time.Since(s.startTime).Seconds()
+	report.Transport = s.forwarder.LastTransport()
+
+	status := http.StatusOK
+	unreachableSince := s.forwarder.UnreachableSince()
+	report.DopplerReachable = unreachableSince.IsZero()
+	if !report.DopplerReachable {
+		unreachableFor := time.Since(unreachableSince)
+		report.UnreachableSeconds = unreachableFor.Seconds()
+		if unreachableFor > s.unreachableThreshold {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(report)
+}
+
+func (s *Server) sample() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.last = s.sampleMetrics(&s.report)
+}
+
+// sampleMetrics fills in the report from the current metrics and returns the
+// counters to compare the next sample against. It must be called with the
+// lock held.
+func (s *Server) sampleMetrics(report *Report) sample {
+	batcherMetrics := healthendpoint.MetricsByName(s.batcher.Emit())
+	forwarderMetrics := healthendpoint.MetricsByName(s.forwarder.Emit())
+
+	current := sample{
+		received: uint64(batcherMetrics["envelopesReceived"]),
+		sent:     make(map[string]uint64),
+	}
+	for name, value := range forwarderMetrics {
+		if strings.HasSuffix(name, "SentMessages") && !strings.HasSuffix(name, "ZoneSentMessages") {
+			current.sent[strings.TrimSuffix(name, "SentMessages")] = uint64(value)
+		}
+	}
+
+	report.IntervalSeconds = s.interval.Seconds()
+	report.ReceivedEnvelopes = current.received - s.last.received
+	report.SentMessages = make(map[string]uint64, len(current.sent))
+	for transport, sent := range current.sent {
+		report.SentMessages[transport] = sent - s.last.sent[transport]
+	}
+	report.RetryBufferedMessages = forwarderMetrics["retryBufferedMessages"]
+
+	return current
+}
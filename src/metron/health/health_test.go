@@ -0,0 +1,190 @@
+package health_test
+
+import (
+	"encoding/json"
+	"metron/health"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health Server", func() {
+	const address = "127.0.0.1:9094"
+
+	var (
+		batcher      *fakeInstrumentable
+		forwarder    *fakeForwarder
+		healthServer *health.Server
+		serverDone   chan struct{}
+	)
+
+	get := func() (int, health.Report) {
+		var report health.Report
+		response, err := http.Get("http://" + address)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+
+		Expect(response.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(json.NewDecoder(response.Body).Decode(&report)).To(Succeed())
+		return response.StatusCode, report
+	}
+
+	getReport := func() health.Report {
+		_, report := get()
+		return report
+	}
+
+	getStatus := func() int {
+		status, _ := get()
+		return status
+	}
+
+	BeforeEach(func() {
+		batcher = &fakeInstrumentable{metrics: map[string]interface{}{"envelopesReceived": uint64(0), "datagramsSent": uint64(0)}}
+		forwarder = &fakeForwarder{fakeInstrumentable: fakeInstrumentable{metrics: map[string]interface{}{
+			"tcpSentMessages":       uint64(0),
+			"tcpFallbacks":          uint64(0),
+			"udpSentMessages":       uint64(0),
+			"droppedMessages":       uint64(0),
+			"sameZoneSentMessages":  uint64(0),
+			"crossZoneSentMessages": uint64(0),
+			"retryBufferedMessages": 0,
+		}}}
+
+		healthServer = health.NewServer(address, 100*time.Millisecond, time.Minute, batcher, forwarder, loggertesthelper.Logger())
+		serverDone = make(chan struct{})
+		go func() {
+			defer close(serverDone)
+			healthServer.Start()
+		}()
+
+		Eventually(func() error {
+			_, err := http.Get("http://" + address)
+			return err
+		}).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		healthServer.Stop()
+		Eventually(serverDone).Should(BeClosed())
+	})
+
+	It("reports uptime and the sampling interval", func() {
+		report := getReport()
+		Expect(report.UptimeSeconds).To(BeNumerically(">", 0))
+		Expect(report.IntervalSeconds).To(Equal(0.1))
+	})
+
+	It("is healthy with no traffic before anything was sent", func() {
+		status, report := get()
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(report.DopplerReachable).To(BeTrue())
+		Expect(report.UnreachableSeconds).To(BeZero())
+		Expect(report.Transport).To(BeEmpty())
+		Expect(report.ReceivedEnvelopes).To(BeZero())
+		Expect(report.SentMessages).To(Equal(map[string]uint64{"tcp": 0, "udp": 0}))
+		Expect(report.RetryBufferedMessages).To(BeZero())
+	})
+
+	It("reports the envelopes received and the messages sent in the last interval", func() {
+		batcher.set("envelopesReceived", uint64(25))
+		forwarder.set("tcpSentMessages", uint64(3))
+		forwarder.set("udpSentMessages", uint64(1))
+
+		Eventually(getReport).Should(And(
+			WithTransform(func(r health.Report) uint64 { return r.ReceivedEnvelopes }, Equal(uint64(25))),
+			WithTransform(func(r health.Report) map[string]uint64 { return r.SentMessages }, Equal(map[string]uint64{"tcp": 3, "udp": 1})),
+		))
+
+		Eventually(func() uint64 { return getReport().ReceivedEnvelopes }).Should(BeZero())
+		Expect(getReport().SentMessages).To(Equal(map[string]uint64{"tcp": 0, "udp": 0}))
+	})
+
+	It("reports the retry buffer depth and the transport in use", func() {
+		forwarder.set("retryBufferedMessages", 42)
+		forwarder.setLastTransport("tcp")
+
+		Eventually(func() int64 { return getReport().RetryBufferedMessages }).Should(Equal(int64(42)))
+		Expect(getReport().Transport).To(Equal("tcp"))
+	})
+
+	It("stays healthy while dopplers have been unreachable for less than the threshold", func() {
+		forwarder.setUnreachableSince(time.Now().Add(-30 * time.Second))
+
+		status, report := get()
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(report.DopplerReachable).To(BeFalse())
+		Expect(report.UnreachableSeconds).To(BeNumerically("~", 30, 1))
+	})
+
+	It("becomes unhealthy once dopplers have been unreachable for longer than the threshold", func() {
+		forwarder.setUnreachableSince(time.Now().Add(-61 * time.Second))
+
+		status, report := get()
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+		Expect(report.DopplerReachable).To(BeFalse())
+		Expect(report.UnreachableSeconds).To(BeNumerically(">", 60))
+
+		forwarder.setUnreachableSince(time.Time{})
+		Expect(getStatus()).To(Equal(http.StatusOK))
+		Expect(getReport().DopplerReachable).To(BeTrue())
+	})
+})
+
+type fakeInstrumentable struct {
+	sync.Mutex
+	metrics map[string]interface{}
+}
+
+func (f *fakeInstrumentable) set(name string, value interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	f.metrics[name] = value
+}
+
+func (f *fakeInstrumentable) Emit() instrumentation.Context {
+	f.Lock()
+	defer f.Unlock()
+
+	var metrics []instrumentation.Metric
+	for name, value := range f.metrics {
+		metrics = append(metrics, instrumentation.Metric{Name: name, Value: value})
+	}
+	return instrumentation.Context{Name: "fake", Metrics: metrics}
+}
+
+type fakeForwarder struct {
+	fakeInstrumentable
+	unreachableSince time.Time
+	lastTransport    string
+}
+
+func (f *fakeForwarder) setUnreachableSince(since time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.unreachableSince = since
+}
+
+func (f *fakeForwarder) setLastTransport(transport string) {
+	f.Lock()
+	defer f.Unlock()
+	f.lastTransport = transport
+}
+
+func (f *fakeForwarder) UnreachableSince() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.unreachableSince
+}
+
+func (f *fakeForwarder) LastTransport() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.lastTransport
+}
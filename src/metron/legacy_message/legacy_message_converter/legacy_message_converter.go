@@ -1,8 +1,13 @@
 package legacy_message_converter
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 	"github.com/cloudfoundry/loggregatorlib/logmessage"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gogo/protobuf/proto"
@@ -10,7 +15,13 @@ import (
 
 const LEGACY_DROPSONDE_ORIGIN = "legacy"
 
+var (
+	errNoLogMessage      = errors.New("legacy envelope has no log message")
+	errIncompleteMessage = errors.New("legacy log message is missing its message, message type or timestamp")
+)
+
 type LegacyMessageConverter interface {
+	instrumentation.Instrumentable
 	Run(inputChan <-chan *logmessage.LogEnvelope, outputChan chan<- *events.Envelope)
 }
 
@@ -22,28 +33,66 @@ func NewLegacyMessageConverter(logger *gosteno.Logger) LegacyMessageConverter {
 
 type legacyMessageConverter struct {
 	logger *gosteno.Logger
+
+	convertedMessageCount  uint64
+	conversionFailureCount uint64
 }
 
 func (c *legacyMessageConverter) Run(inputChan <-chan *logmessage.LogEnvelope, outputChan chan<- *events.Envelope) {
 	for legacyEnvelope := range inputChan {
 		c.logger.Debugf("legacyMessageConverter: converting message %v", spew.Sprintf("%v", legacyEnvelope))
 
-		outputChan <- convertMessage(legacyEnvelope)
+		envelope, err := convertMessage(legacyEnvelope)
+		if err != nil {
+			c.logger.Debugf("legacyMessageConverter: conversion error %v for message %v", err, spew.Sprintf("%v", legacyEnvelope))
+			atomic.AddUint64(&c.conversionFailureCount, 1)
+			continue
+		}
+
+		atomic.AddUint64(&c.convertedMessageCount, 1)
+		outputChan <- envelope
 	}
 }
 
-func convertMessage(legacyEnvelope *logmessage.LogEnvelope) *events.Envelope {
+// convertMessage maps a legacy log message field by field onto a dropsonde
+// LogMessage. The source name becomes the source type and the source id the
+// source instance; drain URLs have no dropsonde counterpart and are dropped.
+func convertMessage(legacyEnvelope *logmessage.LogEnvelope) (*events.Envelope, error) {
 	legacyMessage := legacyEnvelope.GetLogMessage()
+	if legacyMessage == nil {
+		return nil, errNoLogMessage
+	}
+	if legacyMessage.Message == nil || legacyMessage.MessageType == nil || legacyMessage.Timestamp == nil {
+		return nil, errIncompleteMessage
+	}
+	if _, ok := events.LogMessage_MessageType_name[int32(legacyMessage.GetMessageType())]; !ok {
+		return nil, fmt.Errorf("unknown legacy message type %d", legacyMessage.GetMessageType())
+	}
+
 	return &events.Envelope{
 		Origin:    proto.String(LEGACY_DROPSONDE_ORIGIN),
 		EventType: events.Envelope_LogMessage.Enum(),
 		LogMessage: &events.LogMessage{
 			Message:        legacyMessage.Message,
-			MessageType:    (*events.LogMessage_MessageType)(legacyMessage.MessageType),
+			MessageType:    events.LogMessage_MessageType(legacyMessage.GetMessageType()).Enum(),
 			Timestamp:      legacyMessage.Timestamp,
 			AppId:          legacyMessage.AppId,
 			SourceType:     legacyMessage.SourceName,
 			SourceInstance: legacyMessage.SourceId,
 		},
+	}, nil
+}
+
+func (c *legacyMessageConverter) metrics() []instrumentation.Metric {
+	return []instrumentation.Metric{
+		instrumentation.Metric{Name: "convertedMessages", Value: atomic.LoadUint64(&c.convertedMessageCount)},
+		instrumentation.Metric{Name: "conversionFailures", Value: atomic.LoadUint64(&c.conversionFailureCount)},
+	}
+}
+
+func (c *legacyMessageConverter) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name:    "legacyMessageConverter",
+		Metrics: c.metrics(),
 	}
 }
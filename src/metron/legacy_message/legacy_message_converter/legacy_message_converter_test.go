@@ -2,6 +2,7 @@ package legacy_message_converter_test
 
 import (
 	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation/testhelpers"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
 	"github.com/cloudfoundry/loggregatorlib/logmessage"
 	"github.com/gogo/protobuf/proto"
@@ -66,5 +67,70 @@ var _ = Describe("LegacyMessageConverter", func() {
 				},
 			})))
 		})
+
+		It("drops envelopes without a log message", func() {
+			inputChan <- &logmessage.LogEnvelope{RoutingKey: proto.String("fake-routing-key")}
+
+			Consistently(outputChan).ShouldNot(Receive())
+			testhelpers.EventuallyExpectMetric(messageConverter, "conversionFailures", 1)
+		})
+
+		It("drops log messages missing a required field", func() {
+			inputChan <- &logmessage.LogEnvelope{
+				LogMessage: &logmessage.LogMessage{
+					Message: []byte{4, 5, 6},
+					AppId:   proto.String("fake-app-id"),
+				},
+			}
+
+			Consistently(outputChan).ShouldNot(Receive())
+			testhelpers.EventuallyExpectMetric(messageConverter, "conversionFailures", 1)
+		})
+
+		It("drops log messages of an unknown type", func() {
+			inputChan <- &logmessage.LogEnvelope{
+				LogMessage: &logmessage.LogMessage{
+					Message:     []byte{4, 5, 6},
+					MessageType: logmessage.LogMessage_MessageType(3).Enum(),
+					Timestamp:   proto.Int64(123),
+				},
+			}
+
+			Consistently(outputChan).ShouldNot(Receive())
+			testhelpers.EventuallyExpectMetric(messageConverter, "conversionFailures", 1)
+		})
+	})
+
+	Context("metrics", func() {
+		BeforeEach(func() {
+			inputChan = make(chan *logmessage.LogEnvelope, 10)
+			outputChan = make(chan *events.Envelope, 10)
+			runComplete = make(chan struct{})
+			messageConverter = legacy_message_converter.NewLegacyMessageConverter(loggertesthelper.Logger())
+
+			go func() {
+				messageConverter.Run(inputChan, outputChan)
+				close(runComplete)
+			}()
+		})
+
+		AfterEach(func() {
+			close(inputChan)
+			Eventually(runComplete).Should(BeClosed())
+		})
+
+		It("emits the correct metrics context", func() {
+			Expect(messageConverter.Emit().Name).To(Equal("legacyMessageConverter"))
+		})
+
+		It("counts converted messages", func() {
+			inputChan <- &logmessage.LogEnvelope{
+				LogMessage: logmessage.GenerateMessage(logmessage.LogMessage_OUT, "message", "fake-app-id", "App"),
+			}
+			inputChan <- &logmessage.LogEnvelope{}
+
+			testhelpers.EventuallyExpectMetric(messageConverter, "convertedMessages", 1)
+			testhelpers.EventuallyExpectMetric(messageConverter, "conversionFailures", 1)
+		})
 	})
 })
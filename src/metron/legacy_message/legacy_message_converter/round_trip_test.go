@@ -0,0 +1,89 @@
+package legacy_message_converter_test
+
+import (
+	"io/ioutil"
+	"metron/legacy_message/legacy_message_converter"
+	"metron/legacy_message/legacy_unmarshaller"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The fixtures are legacy envelopes as emitted to metron's legacy port.
+var _ = Describe("Converting captured legacy payloads", func() {
+	var (
+		unmarshallerInput chan []byte
+		outputChan        chan *events.Envelope
+		runComplete       chan struct{}
+	)
+
+	roundTrip := func(fixture string) *events.Envelope {
+		payload, err := ioutil.ReadFile("fixtures/" + fixture)
+		Expect(err).NotTo(HaveOccurred())
+
+		unmarshallerInput <- payload
+
+		var envelope *events.Envelope
+		Eventually(outputChan).Should(Receive(&envelope))
+
+		marshalled, err := proto.Marshal(envelope)
+		Expect(err).NotTo(HaveOccurred())
+		received := &events.Envelope{}
+		Expect(proto.Unmarshal(marshalled, received)).To(Succeed())
+		return received
+	}
+
+	BeforeEach(func() {
+		unmarshallerInput = make(chan []byte, 10)
+		legacyEnvelopes := make(chan *logmessage.LogEnvelope, 10)
+		outputChan = make(chan *events.Envelope, 10)
+		runComplete = make(chan struct{})
+
+		unmarshaller := legacy_unmarshaller.NewLegacyUnmarshaller(loggertesthelper.Logger())
+		converter := legacy_message_converter.NewLegacyMessageConverter(loggertesthelper.Logger())
+		go func() {
+			unmarshaller.Run(unmarshallerInput, legacyEnvelopes)
+			close(legacyEnvelopes)
+		}()
+		go func() {
+			converter.Run(legacyEnvelopes, outputChan)
+			close(runComplete)
+		}()
+	})
+
+	AfterEach(func() {
+		close(unmarshallerInput)
+		Eventually(runComplete).Should(BeClosed())
+	})
+
+	It("keeps every field of an app log", func() {
+		envelope := roundTrip("app_stdout.bin")
+
+		Expect(envelope.GetOrigin()).To(Equal(legacy_message_converter.LEGACY_DROPSONDE_ORIGIN))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		logMessage := envelope.GetLogMessage()
+		Expect(logMessage.GetMessage()).To(Equal([]byte("Listening on port 8080")))
+		Expect(logMessage.GetMessageType()).To(Equal(events.LogMessage_OUT))
+		Expect(logMessage.GetTimestamp()).To(Equal(int64(1428000000123456789)))
+		Expect(logMessage.GetAppId()).To(Equal("8c2b9a0e-3d2f-4e2b-9f1e-6d6f2c1a7b3e"))
+		Expect(logMessage.GetSourceType()).To(Equal("App"))
+		Expect(logMessage.GetSourceInstance()).To(Equal("2"))
+	})
+
+	It("keeps every field of a staging error without a source id", func() {
+		envelope := roundTrip("staging_stderr.bin")
+
+		logMessage := envelope.GetLogMessage()
+		Expect(logMessage.GetMessage()).To(Equal([]byte("-----> Compiling Ruby/Rack\n       Warning: no Gemfile.lock ☃")))
+		Expect(logMessage.GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(logMessage.GetTimestamp()).To(Equal(int64(1428000042000000000)))
+		Expect(logMessage.GetAppId()).To(Equal("5f0a8b1c-7e4d-4c3a-8b2f-1a9e0d7c6b5a"))
+		Expect(logMessage.GetSourceType()).To(Equal("STG"))
+		Expect(logMessage.SourceInstance).To(BeNil())
+	})
+})
@@ -1,6 +1,8 @@
 package legacy_unmarshaller
 
 import (
+	"metron/metrics"
+
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 	"github.com/cloudfoundry/loggregatorlib/logmessage"
@@ -13,6 +15,7 @@ type LegacyUnmarshaller interface {
 	instrumentation.Instrumentable
 	Run(inputChan <-chan []byte, outputChan chan<- *logmessage.LogEnvelope)
 	UnmarshalMessage([]byte) (*logmessage.LogEnvelope, error)
+	SetMetricsRegistry(registry *metrics.Registry)
 }
 
 func NewLegacyUnmarshaller(logger *gosteno.Logger) LegacyUnmarshaller {
@@ -24,10 +27,18 @@ func NewLegacyUnmarshaller(logger *gosteno.Logger) LegacyUnmarshaller {
 type legacyUnmarshaller struct {
 	logger              *gosteno.Logger
 	unmarshalErrorCount uint64
+	registry            *metrics.Registry
+}
+
+// SetMetricsRegistry makes the unmarshaller count the messages received on
+// the legacy port in registry. It must be called before Run.
+func (u *legacyUnmarshaller) SetMetricsRegistry(registry *metrics.Registry) {
+	u.registry = registry
 }
 
 func (u *legacyUnmarshaller) Run(inputChan <-chan []byte, outputChan chan<- *logmessage.LogEnvelope) {
 	for message := range inputChan {
+		u.registry.Increment(metrics.LegacyReceivedEnvelopes)
 		envelope, err := u.UnmarshalMessage(message)
 		if err != nil {
 			continue
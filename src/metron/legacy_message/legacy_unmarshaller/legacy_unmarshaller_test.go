@@ -8,6 +8,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"metron/legacy_message/legacy_unmarshaller"
+	"metron/metrics"
 )
 
 var _ = Describe("LegacyUnmarshaller", func() {
@@ -91,11 +92,15 @@ var _ = Describe("LegacyUnmarshaller", func() {
 	})
 
 	Context("metrics", func() {
+		var registry *metrics.Registry
+
 		BeforeEach(func() {
 			inputChan = make(chan []byte, 10)
 			outputChan = make(chan *logmessage.LogEnvelope, 10)
 			runComplete = make(chan struct{})
 			unmarshaller = legacy_unmarshaller.NewLegacyUnmarshaller(loggertesthelper.Logger())
+			registry = metrics.NewRegistry()
+			unmarshaller.SetMetricsRegistry(registry)
 
 			go func() {
 				unmarshaller.Run(inputChan, outputChan)
@@ -116,5 +121,21 @@ var _ = Describe("LegacyUnmarshaller", func() {
 			inputChan <- []byte{1, 2, 3}
 			testhelpers.EventuallyExpectMetric(unmarshaller, "unmarshalErrors", 1)
 		})
+
+		It("counts every message received on the legacy port in the metrics registry", func() {
+			message, _ := proto.Marshal(&logmessage.LogEnvelope{
+				RoutingKey: proto.String("fake-routing-key"),
+				Signature:  []byte{1, 2, 3},
+				LogMessage: &logmessage.LogMessage{
+					Message:     []byte{4, 5, 6},
+					MessageType: logmessage.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(123),
+				},
+			})
+			inputChan <- message
+			inputChan <- []byte{1, 2, 3}
+
+			Eventually(func() uint64 { return registry.Counter(metrics.LegacyReceivedEnvelopes) }).Should(BeEquivalentTo(2))
+		})
 	})
 })
@@ -2,16 +2,33 @@ package main
 
 import (
 	"flag"
+	"metron/batcher"
+	"metron/bufferpool"
+	"metron/classqueue"
+	"metron/coalescer"
+	"metron/dopplerforwarder"
 	"metron/eventlistener"
+	"metron/health"
 	"metron/heartbeatrequester"
 	"metron/legacy_message/legacy_message_converter"
 	"metron/legacy_message/legacy_unmarshaller"
+	"metron/marshaller"
 	"metron/message_aggregator"
+	"metron/metrics"
+	"metron/signer"
 	"metron/varz_forwarder"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/cloudfoundry/dropsonde/dropsonde_marshaller"
 	"github.com/cloudfoundry/dropsonde/dropsonde_unmarshaller"
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/dropsonde/signature"
@@ -21,15 +38,18 @@ import (
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent/registrars/collectorregistrar"
-	"github.com/cloudfoundry/loggregatorlib/clientpool"
 	"github.com/cloudfoundry/loggregatorlib/logmessage"
 	"github.com/cloudfoundry/loggregatorlib/servicediscovery"
 	"github.com/cloudfoundry/storeadapter"
 	"github.com/cloudfoundry/storeadapter/etcdstoreadapter"
 	"github.com/cloudfoundry/yagnats"
 	"github.com/cloudfoundry/yagnats/fakeyagnats"
+	"github.com/gogo/protobuf/proto"
+	"metron/ratelimiter"
 	"metron/statsdlistener"
+	"metron/sysloglistener"
 	"metron/tagger"
+	"metron/validator"
 )
 
 var (
@@ -51,31 +71,168 @@ func main() {
 	flag.Parse()
 	config, logger := parseConfig(*debug, *configFilePath, *logFilePath)
 
-	dropsondeClientPool, dropsondeServerDiscovery := initializeClientPool(config, logger, config.LoggregatorDropsondePort)
+	metricsRegistry := metrics.NewRegistry()
+
+	dopplerAddressList, err := newDopplerAddressList(config, metricsRegistry, logger)
+	if err != nil {
+		logger.Fatalf("Startup: %s", err)
+	}
+	dropsondeServerDiscovery := dopplerforwarder.NewReloadableAddressList(dopplerAddressList)
+	dopplers := ejectFailingDopplers(dropsondeServerDiscovery, "", config, metricsRegistry, logger)
+	dropsondeClientPool := dopplerforwarder.NewUDPPool(config.LoggregatorDropsondePort, dopplers, logger)
 
 	// TODO: delete next three lines when "legacy" format goes away
 	legacyMessageListener, legacyMessageChan := agentlistener.NewAgentListener(fmt.Sprintf("localhost:%d", config.LegacyIncomingMessagesPort), logger, "legacyAgentListener")
 	legacyUnmarshaller := legacy_unmarshaller.NewLegacyUnmarshaller(logger)
+	legacyUnmarshaller.SetMetricsRegistry(metricsRegistry)
 	legacyMessageConverter := legacy_message_converter.NewLegacyMessageConverter(logger)
 
 	pinger := heartbeatrequester.NewHeartbeatRequester(pingSenderInterval)
 	dropsondeMessageListener, dropsondeMessageChan := eventlistener.NewEventListener(fmt.Sprintf("localhost:%d", config.DropsondeIncomingMessagesPort), logger, "dropsondeAgentListener", pinger)
+	dropsondeMessageListener.SetReceiveBufferSize(config.DropsondeReceiveBufferBytes)
+	dropsondeMessageListener.SetKernelDropsReader(eventlistener.NewProcNetUDPReader(), time.Duration(config.DropsondeKernelDropsIntervalMilliseconds)*time.Millisecond)
+	dropsondeMessageListener.SetMetricsRegistry(metricsRegistry)
+
+	var dropsondeUnixgramListener *eventlistener.UnixgramListener
+	var dropsondeUnixgramChan <-chan []byte
+	if config.DropsondeUnixSocket != "" {
+		mode, err := unixSocketMode(config.DropsondeUnixSocketMode)
+		if err != nil {
+			logger.Fatalf("Startup: %s", err)
+		}
+		dropsondeUnixgramListener, dropsondeUnixgramChan = eventlistener.NewUnixgramListener(config.DropsondeUnixSocket, mode, logger, "dropsondeUnixgramListener")
+		dropsondeUnixgramListener.SetMetricsRegistry(metricsRegistry)
+	}
+
+	statsdConfig, err := newStatsdListenerConfig(config)
+	if err != nil {
+		logger.Fatalf("Startup: %s", err)
+	}
+	statsdMessageListener := statsdlistener.NewStatsdListener(statsdConfig.Address, logger, "statsdAgentListener")
+	statsdMessageListener.Reconfigure(statsdConfig)
+	statsdMessageListener.SetMetricsRegistry(metricsRegistry)
+	if config.StatsdReadBufferSize < 0 || config.StatsdReadBufferSize > statsdlistener.DefaultReadBufferSize {
+		logger.Fatalf("Startup: StatsdReadBufferSize must be between 0 and %d", statsdlistener.DefaultReadBufferSize)
+	}
+	statsdMessageListener.SetReadBufferSize(config.StatsdReadBufferSize)
+	statsdMessageListener.SetGaugeSnapshotFile(config.StatsdGaugeSnapshotFile)
+	statsdMessageListener.SetReloadGaugeSnapshot(config.StatsdReloadGaugeSnapshot)
+	if config.StatsdCaptureFile != "" {
+		if config.StatsdCaptureMaxFileBytes <= 0 {
+			logger.Fatalf("Startup: StatsdCaptureMaxFileBytes must be positive when capturing statsd packets")
+		}
+		statsdCaptureWriter, err := statsdlistener.NewCaptureWriter(config.StatsdCaptureFile, config.StatsdCaptureMaxFileBytes, config.StatsdCaptureMaxFiles)
+		if err != nil {
+			logger.Fatalf("Startup: Error opening the statsd capture file: %s", err)
+		}
+		statsdMessageListener.SetCaptureWriter(statsdCaptureWriter)
+	}
 
-	statsdMessageListener := statsdlistener.NewStatsdListener(fmt.Sprintf("localhost:%d", config.StatsdIncomingMessagesPort), logger, "statsdAgentListener")
+	var syslogListeners []*sysloglistener.SyslogListener
+	if config.SyslogTCPPort != 0 || config.SyslogUnixSocket != "" {
+		if config.SyslogOrigin == "" {
+			logger.Fatalf("Startup: SyslogOrigin must be given when listening for syslog")
+		}
+		if config.SyslogTCPPort != 0 {
+			syslogListeners = append(syslogListeners, sysloglistener.NewSyslogListener(sysloglistener.TCP, fmt.Sprintf("localhost:%d", config.SyslogTCPPort), config.SyslogOrigin, logger, "syslogTCPListener"))
+		}
+		if config.SyslogUnixSocket != "" {
+			syslogListeners = append(syslogListeners, sysloglistener.NewSyslogListener(sysloglistener.Unixgram, config.SyslogUnixSocket, config.SyslogOrigin, logger, "syslogUnixgramListener"))
+		}
+	}
 
 	unmarshaller := dropsonde_unmarshaller.NewDropsondeUnmarshaller(logger)
 	messageAggregator := message_aggregator.NewMessageAggregator(logger)
+	messageAggregator.SetCounterWindow(time.Duration(config.CounterAggregationWindowMilliseconds) * time.Millisecond)
 	varzForwarder := varz_forwarder.NewVarzForwarder(config.Job, metricTTL, logger)
-	marshaller := dropsonde_marshaller.NewDropsondeMarshaller(logger)
+	bufferPool := bufferpool.New()
+	envelopeMarshaller := marshaller.New(bufferPool, logger)
+	envelopeMarshaller.SetMaxEnvelopeSize(maxEnvelopeBytes(config, logger))
 	messageTagger := tagger.New(config.Deployment, config.Job, config.Index)
+	envelopeValidator := validator.New(logger)
+	envelopeValidator.SetMaxTimestampSkew(time.Duration(config.MaxTimestampSkewSeconds) * time.Second)
+	rateLimiter := newRateLimiter(config, logger)
+	classQueue := newClassQueue(config, logger)
+	valueMetricCoalescer := newCoalescer(config, logger)
+
+	if config.DopplerBatchMaxBytes < 0 || config.DopplerBatchMaxBytes > batcher.MaxDatagramSize {
+		logger.Fatalf("Startup: DopplerBatchMaxBytes must be between 0 and %d", batcher.MaxDatagramSize)
+	}
+	batchMaxBytes := config.DopplerBatchMaxBytes
+	if config.DopplerUDPSequenceNumbers {
+		batchMaxBytes -= dopplerforwarder.SequenceHeaderLength
+	}
+	messageBatcher := batcher.NewBatcher(batchMaxBytes, time.Duration(config.DopplerBatchIntervalMilliseconds)*time.Millisecond, logger)
+	messageBatcher.SetBufferPool(bufferPool)
+
+	dopplerTransports, err := dopplerforwarder.ParseTransports(config.DopplerTransports)
+	if err != nil {
+		logger.Fatalf("Startup: %s", err)
+	}
+	dopplerTLSConfig := loadDopplerTLSConfig(config, dopplerTransports, nil, logger)
+	forwarder := dopplerforwarder.New(dopplerTransports, dropsondeClientPool, dopplers, config.DopplerTCPPort, config.DopplerTLSPort, dopplerTLSConfig, logger)
+	configureForwarder(forwarder, config, bufferPool, metricsRegistry, logger)
+
+	var fanOut *dopplerforwarder.FanOut
+	var destinationForwarders []*dopplerforwarder.Forwarder
+	fanOutAddressLists := map[string]*dopplerforwarder.ReloadableAddressList{}
+	if len(config.DopplerFanOutDestinations) > 0 {
+		groups := map[string]bool{}
+		for _, destination := range config.DopplerFanOutDestinations {
+			if destination.Name == "" || groups[destination.Name] {
+				logger.Fatalf("Startup: Every doppler fan out destination needs a unique name, got '%s'", destination.Name)
+			}
+			groups[destination.Name] = true
+
+			destinationForwarder, addressList, err := newDestinationForwarder(destination, config, dopplerTLSConfig, metricsRegistry, logger)
+			if err != nil {
+				logger.Fatalf("Startup: Doppler fan out destination %s: %s", destination.Name, err)
+			}
+			configureForwarder(destinationForwarder, config, bufferPool, metricsRegistry, logger)
+			destinationForwarders = append(destinationForwarders, destinationForwarder)
+			fanOutAddressLists[destination.Name] = addressList
+		}
+
+		if config.DopplerFanOutQueueLength <= 0 {
+			logger.Fatalf("Startup: DopplerFanOutQueueLength must be positive when fanning out to several dopplers")
+		}
+		fanOut = dopplerforwarder.NewFanOut(append([]*dopplerforwarder.Forwarder{forwarder}, destinationForwarders...), config.DopplerFanOutQueueLength, logger)
+		fanOut.SetBufferPool(bufferPool)
+	}
 
 	instrumentables := []instrumentation.Instrumentable{
 		legacyMessageListener,
+		legacyMessageConverter,
+		&statsdMessageListener,
 		dropsondeMessageListener,
 		unmarshaller,
+		envelopeValidator,
 		varzForwarder,
 		messageAggregator,
-		marshaller,
+		envelopeMarshaller,
+		messageBatcher,
+		forwarder,
+	}
+	if dropsondeUnixgramListener != nil {
+		instrumentables = append(instrumentables, dropsondeUnixgramListener)
+	}
+	if rateLimiter != nil {
+		instrumentables = append(instrumentables, rateLimiter)
+	}
+	if classQueue != nil {
+		instrumentables = append(instrumentables, classQueue)
+	}
+	if valueMetricCoalescer != nil {
+		instrumentables = append(instrumentables, valueMetricCoalescer)
+	}
+	for _, syslogListener := range syslogListeners {
+		instrumentables = append(instrumentables, syslogListener)
+	}
+	if fanOut != nil {
+		for _, destinationForwarder := range destinationForwarders {
+			instrumentables = append(instrumentables, destinationForwarder)
+		}
+		instrumentables = append(instrumentables, fanOut)
 	}
 
 	component := initializeComponent(config, logger, instrumentables)
@@ -83,79 +240,817 @@ func main() {
 	go collectorregistrar.NewCollectorRegistrar(cfcomponent.DefaultYagnatsClientProvider, component, time.Duration(config.CollectorRegistrarIntervalMilliseconds)*time.Millisecond, &config.Config).Run()
 
 	go startMonitoringEndpoints(component, logger)
+
+	if config.HealthPort != 0 {
+		if config.HealthIntervalSeconds <= 0 {
+			logger.Fatalf("Startup: HealthIntervalSeconds must be positive when the health endpoint is enabled")
+		}
+		healthInterval := time.Duration(config.HealthIntervalSeconds) * time.Second
+		unreachableThreshold := time.Duration(config.HealthUnreachableThresholdSeconds) * time.Second
+		healthServer := health.NewServer(fmt.Sprintf("127.0.0.1:%d", config.HealthPort), healthInterval, unreachableThreshold, messageBatcher, forwarder, logger)
+		go healthServer.Start()
+	}
+
 	dropsondeEventChan := make(chan *events.Envelope)
 
+	// dropsondeEventChan is closed once every stage sending to it has
+	// returned, so that the envelopes in flight drain through the pipeline
+	// on shutdown
+	var producers sync.WaitGroup
+	runProducer := func(run func()) {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			run()
+		}()
+	}
+
+	var metricsEmitter *metrics.Emitter
+	if config.MetricsIntervalMilliseconds > 0 {
+		metricsEmitter = metrics.NewEmitter(metricsRegistry, time.Duration(config.MetricsIntervalMilliseconds)*time.Millisecond)
+		runProducer(func() { metricsEmitter.Run(dropsondeEventChan) })
+	}
+
+	var runtimeStats *metrics.RuntimeStats
+	if config.RuntimeStatsIntervalMilliseconds > 0 {
+		runtimeStats = metrics.NewRuntimeStats(time.Duration(config.RuntimeStatsIntervalMilliseconds) * time.Millisecond)
+		runProducer(func() { runtimeStats.Run(dropsondeEventChan) })
+	}
+
 	logEnvelopesChan := make(chan *logmessage.LogEnvelope)
 	go legacyMessageListener.Start()
-	go legacyUnmarshaller.Run(legacyMessageChan, logEnvelopesChan)
-	go legacyMessageConverter.Run(logEnvelopesChan, dropsondeEventChan)
+	go func() {
+		legacyUnmarshaller.Run(legacyMessageChan, logEnvelopesChan)
+		close(logEnvelopesChan)
+	}()
+	runProducer(func() { legacyMessageConverter.Run(logEnvelopesChan, dropsondeEventChan) })
 
 	go dropsondeMessageListener.Start()
-	go unmarshaller.Run(dropsondeMessageChan, dropsondeEventChan)
+	runProducer(func() { unmarshaller.Run(dropsondeMessageChan, dropsondeEventChan) })
+
+	if dropsondeUnixgramListener != nil {
+		// the unix socket is removed before Start closes the channel
+		go dropsondeUnixgramListener.Start()
+		runProducer(func() { unmarshaller.Run(dropsondeUnixgramChan, dropsondeEventChan) })
+	}
+
+	// the statsd listener writes its gauge snapshot before Run returns
+	if config.StatsdBatchSize > 0 {
+		if config.StatsdBatchMaxDelayMilliseconds <= 0 {
+			logger.Fatalf("Startup: StatsdBatchMaxDelayMilliseconds must be positive when batching statsd envelopes")
+		}
+		statsdEnvelopes := make(chan *events.Envelope)
+		statsdBatches := make(chan []*events.Envelope)
+		statsdBatchWriter := statsdlistener.NewBatchWriter(config.StatsdBatchSize, time.Duration(config.StatsdBatchMaxDelayMilliseconds)*time.Millisecond, logger)
+		go func() {
+			statsdMessageListener.Run(statsdEnvelopes)
+			close(statsdEnvelopes)
+		}()
+		go func() {
+			statsdBatchWriter.Run(statsdEnvelopes, statsdBatches)
+			close(statsdBatches)
+		}()
+		runProducer(func() { writeBatches(statsdBatches, dropsondeEventChan) })
+	} else {
+		runProducer(func() { statsdMessageListener.Run(dropsondeEventChan) })
+	}
+
+	for _, syslogListener := range syslogListeners {
+		syslogListener := syslogListener
+		runProducer(func() { syslogListener.Run(dropsondeEventChan) })
+	}
+
+	go func() {
+		producers.Wait()
+		close(dropsondeEventChan)
+	}()
 
-	go statsdMessageListener.Run(dropsondeEventChan)
+	validatedEventChan := make(chan *events.Envelope)
+	go func() {
+		envelopeValidator.Run(dropsondeEventChan, validatedEventChan)
+		close(validatedEventChan)
+	}()
+
+	limitedEventChan := validatedEventChan
+	if rateLimiter != nil {
+		limitedEventChan = make(chan *events.Envelope)
+		go func() {
+			rateLimiter.Run(validatedEventChan, limitedEventChan)
+			close(limitedEventChan)
+		}()
+	}
 
 	aggregatedEventChan := make(chan *events.Envelope)
-	go messageAggregator.Run(dropsondeEventChan, aggregatedEventChan)
+	go func() {
+		messageAggregator.Run(limitedEventChan, aggregatedEventChan)
+		close(aggregatedEventChan)
+	}()
 
 	taggedEventChan := make(chan *events.Envelope)
-	go messageTagger.Run(aggregatedEventChan, taggedEventChan)
+	go func() {
+		messageTagger.Run(aggregatedEventChan, taggedEventChan)
+		close(taggedEventChan)
+	}()
+
+	coalescedEventChan := taggedEventChan
+	if valueMetricCoalescer != nil {
+		coalescedEventChan = make(chan *events.Envelope)
+		go func() {
+			valueMetricCoalescer.Run(taggedEventChan, coalescedEventChan)
+			close(coalescedEventChan)
+		}()
+	}
 
 	forwardedEventChan := make(chan *events.Envelope)
-	go varzForwarder.Run(taggedEventChan, forwardedEventChan)
+	go func() {
+		varzForwarder.Run(coalescedEventChan, forwardedEventChan)
+		close(forwardedEventChan)
+	}()
+
+	queuedEventChan := forwardedEventChan
+	if classQueue != nil {
+		queuedEventChan = make(chan *events.Envelope)
+		go func() {
+			classQueue.Run(forwardedEventChan, queuedEventChan)
+			close(queuedEventChan)
+		}()
+	}
 
 	reMarshalledMessageChan := make(chan []byte)
-	go marshaller.Run(forwardedEventChan, reMarshalledMessageChan)
+	go func() {
+		envelopeMarshaller.Run(queuedEventChan, reMarshalledMessageChan)
+		close(reMarshalledMessageChan)
+	}()
+
+	batchedMessageChan := make(chan []byte)
+	go func() {
+		messageBatcher.Run(reMarshalledMessageChan, batchedMessageChan)
+		close(batchedMessageChan)
+	}()
 
 	signedMessageChan := make(chan ([]byte))
-	go signMessages(config.SharedSecret, reMarshalledMessageChan, signedMessageChan)
+	go signer.New(config.SharedSecret, bufferPool).Run(batchedMessageChan, signedMessageChan)
 
-	go dropsondeServerDiscovery.Run(time.Duration(config.EtcdQueryIntervalMilliseconds) * time.Millisecond)
+	etcdQueryInterval := time.Duration(config.EtcdQueryIntervalMilliseconds) * time.Millisecond
+	go dropsondeServerDiscovery.Run(etcdQueryInterval)
+	for _, addressList := range fanOutAddressLists {
+		go addressList.Run(etcdQueryInterval)
+	}
+
+	dopplerReloader := &dopplerAddressReloader{
+		dopplers:     dropsondeServerDiscovery,
+		destinations: fanOutAddressLists,
+		// a new list from etcd reads the dopplers after the first interval
+		timeout:  2*etcdQueryInterval + time.Second,
+		applied:  config,
+		registry: metricsRegistry,
+		logger:   logger,
+	}
+
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			reloadStatsdListener(&statsdMessageListener, *configFilePath, logger)
+			dopplerReloader.reload(*configFilePath)
+		}
+	}()
+
+	// SIGQUIT is left to the runtime, which exits right away
+	killChan := make(chan os.Signal, 1)
+	signal.Notify(killChan, os.Kill, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-killChan
+		logger.Info("Shutting down, sending the pending envelopes to doppler")
+		if metricsEmitter != nil {
+			metricsEmitter.Stop()
+		}
+		if runtimeStats != nil {
+			runtimeStats.Stop()
+		}
+		legacyMessageListener.Stop()
+		dropsondeMessageListener.Stop()
+		for _, syslogListener := range syslogListeners {
+			syslogListener.Stop()
+		}
+		statsdMessageListener.Stop()
+		if dropsondeUnixgramListener != nil {
+			dropsondeUnixgramListener.Stop()
+		}
+		// once the listeners have returned, the pipeline drains into the
+		// forwarders, which then flush their retry buffers
+	}()
 
-	forwardMessagesToDoppler(dropsondeClientPool, signedMessageChan, logger)
+	forwarders := []*dopplerforwarder.Forwarder{forwarder}
+	if fanOut != nil {
+		forwarders = append(forwarders, destinationForwarders...)
+		fanOut.Run(signedMessageChan)
+	} else {
+		forwarder.Run(signedMessageChan)
+	}
+	sendAbandonedEnvelopes(forwarders, messageTagger, config.SharedSecret, logger)
+	for _, forwarder := range forwarders {
+		forwarder.Stop()
+	}
 }
 
-func signMessages(sharedSecret string, dropsondeMessageChan <-chan ([]byte), signedMessageChan chan<- ([]byte)) {
-	for message := range dropsondeMessageChan {
-		signedMessage := signature.SignMessage(message, []byte(sharedSecret))
-		signedMessageChan <- signedMessage
+// sendAbandonedEnvelopes sends the number of envelopes the forwarders could
+// not send before shutting down to every group of dopplers, as the last
+// message metron sends.
+func sendAbandonedEnvelopes(forwarders []*dopplerforwarder.Forwarder, messageTagger *tagger.Tagger, sharedSecret string, logger *gosteno.Logger) {
+	var abandoned uint64
+	for _, forwarder := range forwarders {
+		abandoned += forwarder.AbandonedEnvelopes()
+	}
+	logger.Infof("Shutdown: Abandoned %d envelopes", abandoned)
+
+	envelopeChan := make(chan *events.Envelope, 1)
+	taggedEnvelopeChan := make(chan *events.Envelope, 1)
+	envelopeChan <- &events.Envelope{
+		Origin:    proto.String(metrics.Origin),
+		Timestamp: proto.Int64(time.Now().UnixNano()),
+		EventType: events.Envelope_ValueMetric.Enum(),
+
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(metrics.DopplerAbandonedEnvelopes),
+			Value: proto.Float64(float64(abandoned)),
+			Unit:  proto.String("count"),
+		},
+	}
+	close(envelopeChan)
+	messageTagger.Run(envelopeChan, taggedEnvelopeChan)
+
+	message, err := proto.Marshal(<-taggedEnvelopeChan)
+	if err != nil {
+		logger.Errorf("Shutdown: Error marshalling the number of abandoned envelopes: %s", err)
+		return
+	}
+	signedMessage := signature.SignMessage(message, []byte(sharedSecret))
+	for _, forwarder := range forwarders {
+		// every forwarder returns the message it was given to the buffer pool
+		if !forwarder.Send(append([]byte(nil), signedMessage...)) {
+			logger.Warn("Shutdown: Unable to send the number of abandoned envelopes to doppler")
+		}
 	}
 }
 
-func startMonitoringEndpoints(component cfcomponent.Component, logger *gosteno.Logger) {
-	if err := component.StartMonitoringEndpoints(); err != nil {
-		component.Logger.Error(err.Error())
+// newClassQueue returns the queue that shares the bandwidth to doppler
+// between logs and metrics, or nil if no policy is configured, in which case
+// the envelopes go to doppler in the order they come in.
+func newClassQueue(config metronConfig, logger *gosteno.Logger) *classqueue.ClassQueue {
+	if config.DopplerClassPolicy == "" {
+		return nil
+	}
+	policy, err := classqueue.ParsePolicy(config.DopplerClassPolicy)
+	if err != nil {
+		logger.Fatalf("Startup: %s", err)
+	}
+	if config.DopplerClassQueueLength <= 0 {
+		logger.Fatalf("Startup: DopplerClassQueueLength must be positive when a doppler class policy is configured")
+	}
+
+	classQueue := classqueue.New(policy, config.DopplerClassQueueLength, logger)
+	switch policy {
+	case classqueue.Weighted:
+		if config.DopplerClassLogWeight <= 0 || config.DopplerClassMetricWeight <= 0 {
+			logger.Fatalf("Startup: DopplerClassLogWeight and DopplerClassMetricWeight must be positive for the weighted doppler class policy")
+		}
+		classQueue.SetWeights(config.DopplerClassLogWeight, config.DopplerClassMetricWeight)
+	case classqueue.StrictPriority:
+		priority, err := classqueue.ParseClass(config.DopplerClassPriority)
+		if err != nil {
+			logger.Fatalf("Startup: DopplerClassPriority: %s", err)
+		}
+		classQueue.SetPriority(priority)
+	}
+	return classQueue
+}
+
+// newCoalescer returns the coalescer of the ValueMetrics metron receives, or
+// nil if no coalescing window is configured.
+func newCoalescer(config metronConfig, logger *gosteno.Logger) *coalescer.Coalescer {
+	if config.ValueMetricCoalescingWindowMilliseconds < 0 {
+		logger.Fatalf("Startup: ValueMetricCoalescingWindowMilliseconds must not be negative, got %d", config.ValueMetricCoalescingWindowMilliseconds)
+	}
+	if config.ValueMetricCoalescingWindowMilliseconds == 0 {
+		return nil
 	}
+	return coalescer.New(time.Duration(config.ValueMetricCoalescingWindowMilliseconds)*time.Millisecond, logger)
 }
 
-func initializeClientPool(config metronConfig, logger *gosteno.Logger, port int) (*clientpool.LoggregatorClientPool, servicediscovery.ServerAddressList) {
-	adapter := storeAdapterProvider(config.EtcdUrls, config.EtcdMaxConcurrentRequests)
-	err := adapter.Connect()
+// newRateLimiter returns the limiter for the envelopes metron receives, or
+// nil if no rate limit is configured.
+func newRateLimiter(config metronConfig, logger *gosteno.Logger) *ratelimiter.RateLimiter {
+	if config.IngestRateLimit < 0 {
+		logger.Fatalf("Startup: IngestRateLimit must not be negative, got %g", config.IngestRateLimit)
+	}
+	if err := ratelimiter.ValidateOriginLimits(config.IngestOriginRateLimits); err != nil {
+		logger.Fatalf("Startup: %s", err)
+	}
+	if config.IngestRateLimit == 0 && len(config.IngestOriginRateLimits) == 0 {
+		return nil
+	}
+
+	rateLimiter := ratelimiter.New(config.IngestRateLimit, logger)
+	rateLimiter.SetOriginLimits(config.IngestOriginRateLimits)
+	rateLimiter.SetLimitLogMessages(config.IngestRateLimitLogMessages)
+	return rateLimiter
+}
+
+// loadDopplerTLSConfig returns the TLS config for sending to doppler if
+// transports include TLS, or websockets over TLS, loading it unless it has
+// been loaded already.
+func loadDopplerTLSConfig(config metronConfig, transports []dopplerforwarder.Transport, loaded *tls.Config, logger *gosteno.Logger) *tls.Config {
+	if loaded != nil {
+		return loaded
+	}
+	for _, transport := range transports {
+		if transport == dopplerforwarder.Websocket && config.DopplerWebsocketPort <= 0 {
+			logger.Fatalf("Startup: DopplerWebsocketPort must be positive when sending to doppler over websockets")
+		}
+		if transport == dopplerforwarder.TLS || transport == dopplerforwarder.Websocket && config.DopplerWebsocketTLS {
+			tlsConfig, err := dopplerforwarder.NewClientTLSConfig(config.DopplerTLSCertFile, config.DopplerTLSKeyFile, config.DopplerTLSCAFile, config.DopplerTLSServerName)
+			if err != nil {
+				logger.Fatalf("Startup: Error loading the doppler TLS certificates: %s", err)
+			}
+			return tlsConfig
+		}
+	}
+	return nil
+}
+
+// configureForwarder applies the settings shared by the forwarders of every
+// group of dopplers.
+func configureForwarder(forwarder *dopplerforwarder.Forwarder, config metronConfig, bufferPool *bufferpool.Pool, metricsRegistry *metrics.Registry, logger *gosteno.Logger) {
+	forwarder.SetBufferPool(bufferPool)
+	forwarder.SetMetricsRegistry(metricsRegistry)
+	forwarder.SetUDPSequenceNumbers(config.DopplerUDPSequenceNumbers)
+	if config.DopplerRetryBufferMaxMessages > 0 {
+		if config.DopplerRetryBufferMaxBytes <= 0 {
+			logger.Fatalf("Startup: DopplerRetryBufferMaxBytes must be positive when the doppler retry buffer is enabled")
+		}
+		forwarder.SetRetryBuffer(config.DopplerRetryBufferMaxMessages, config.DopplerRetryBufferMaxBytes)
+		forwarder.SetOriginOrdering(config.DopplerOriginOrdering)
+	}
+	if config.DopplerShutdownTimeoutMilliseconds < 0 {
+		logger.Fatalf("Startup: DopplerShutdownTimeoutMilliseconds must not be negative")
+	}
+	forwarder.SetShutdownTimeout(time.Duration(config.DopplerShutdownTimeoutMilliseconds) * time.Millisecond)
+	if config.DopplerFrameCompression {
+		if config.DopplerFrameCompressionMinBytes < 0 {
+			logger.Fatalf("Startup: DopplerFrameCompressionMinBytes must not be negative")
+		}
+		forwarder.SetFrameCompression(config.DopplerFrameCompressionMinBytes)
+	}
+	if config.DopplerSendRetries < 0 || config.DopplerSendRetryDelayMilliseconds < 0 {
+		logger.Fatalf("Startup: DopplerSendRetries and DopplerSendRetryDelayMilliseconds must not be negative")
+	}
+	forwarder.SetSendRetries(config.DopplerSendRetries, time.Duration(config.DopplerSendRetryDelayMilliseconds)*time.Millisecond)
+	forwarder.SetWebsocketPort(config.DopplerWebsocketPort, config.DopplerWebsocketTLS)
+}
+
+// maxEnvelopeBytes returns the largest marshalled envelope that still fits
+// into a single signed datagram to doppler, or the smaller configured size.
+func maxEnvelopeBytes(config metronConfig, logger *gosteno.Logger) int {
+	limit := batcher.MaxDatagramSize - signature.SIGNATURE_LENGTH
+	if config.DopplerUDPSequenceNumbers {
+		limit -= dopplerforwarder.SequenceHeaderLength
+	}
+
+	if config.DopplerMaxEnvelopeBytes < 0 || config.DopplerMaxEnvelopeBytes > limit {
+		logger.Fatalf("Startup: DopplerMaxEnvelopeBytes must be between 0 and %d", limit)
+	}
+	if config.DopplerMaxEnvelopeBytes == 0 {
+		return limit
+	}
+	return config.DopplerMaxEnvelopeBytes
+}
+
+// newDestinationForwarder returns the forwarder for a fan out destination,
+// along with the list of its dopplers, which is not running yet.
+func newDestinationForwarder(destination dopplerDestination, config metronConfig, tlsConfig *tls.Config, metricsRegistry *metrics.Registry, logger *gosteno.Logger) (*dopplerforwarder.Forwarder, *dopplerforwarder.ReloadableAddressList, error) {
+	list, err := newAddressList(destination.EtcdKey, destination.Addresses, config, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	addressList := dopplerforwarder.NewReloadableAddressList(list)
+
+	transports, err := dopplerforwarder.ParseTransports(destination.Transports)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig = loadDopplerTLSConfig(config, transports, tlsConfig, logger)
+
+	dopplers := ejectFailingDopplers(addressList, destination.Name, config, metricsRegistry, logger)
+	udpPool := dopplerforwarder.NewUDPPool(config.LoggregatorDropsondePort, dopplers, logger)
+	forwarder := dopplerforwarder.New(transports, udpPool, dopplers, config.DopplerTCPPort, config.DopplerTLSPort, tlsConfig, logger)
+	forwarder.SetGroup(destination.Name)
+	return forwarder, addressList, nil
+}
+
+// ejectFailingDopplers returns list, or, with a DopplerEjectionMaxErrorRate,
+// a list that ejects the dopplers in it whose sends keep failing, counting
+// its ejections under group.
+func ejectFailingDopplers(list servicediscovery.ServerAddressList, group string, config metronConfig, metricsRegistry *metrics.Registry, logger *gosteno.Logger) servicediscovery.ServerAddressList {
+	if config.DopplerEjectionMaxErrorRate == 0 {
+		return list
+	}
+	if config.DopplerEjectionMaxErrorRate < 0 || config.DopplerEjectionMaxErrorRate >= 1 {
+		logger.Fatalf("Startup: DopplerEjectionMaxErrorRate must be at least 0 and below 1, got %g", config.DopplerEjectionMaxErrorRate)
+	}
+	if config.DopplerEjectionMilliseconds <= 0 {
+		logger.Fatalf("Startup: DopplerEjectionMilliseconds must be positive when ejecting failing dopplers")
+	}
+
+	ejectingList := dopplerforwarder.NewEjectingAddressList(list, config.DopplerEjectionMaxErrorRate, time.Duration(config.DopplerEjectionMilliseconds)*time.Millisecond, logger)
+	ejectingList.SetMetricsRegistry(metricsRegistry)
+	ejectingList.SetGroup(group)
+	return ejectingList
+}
+
+// newDopplerAddressList returns the list of metron's own dopplers: the
+// DopplerAddresses if given, those DopplerDNSName resolves to if given, and
+// those registered in etcd otherwise.
+func newDopplerAddressList(config metronConfig, metricsRegistry *metrics.Registry, logger *gosteno.Logger) (servicediscovery.ServerAddressList, error) {
+	if len(config.DopplerAddresses) > 0 {
+		return newAddressList("", config.DopplerAddresses, config, logger)
+	}
+	if config.DopplerDNSName != "" {
+		if config.DopplerDNSResolveIntervalMilliseconds <= 0 {
+			return nil, errors.New("DopplerDNSResolveIntervalMilliseconds must be greater than 0 to resolve DopplerDNSName")
+		}
+		interval := time.Duration(config.DopplerDNSResolveIntervalMilliseconds) * time.Millisecond
+		return dopplerforwarder.NewDNSAddressList(config.DopplerDNSName, config.DopplerDNSSRV, interval, logger), nil
+	}
+
+	list, err := newAddressList("/healthstatus/doppler", nil, config, logger)
 	if err != nil {
-		logger.Errorf("Error connecting to ETCD: %v", err)
+		return nil, err
 	}
+	zoneList := list.(*dopplerforwarder.ZoneAddressList)
+	zoneList.SetMetricsRegistry(metricsRegistry)
+	if config.DopplerZoneFailAfterMilliseconds > 0 || config.DopplerZoneFailBackAfterMilliseconds > 0 {
+		zoneList.SetZoneFailover(time.Duration(config.DopplerZoneFailAfterMilliseconds)*time.Millisecond, time.Duration(config.DopplerZoneFailBackAfterMilliseconds)*time.Millisecond)
+	}
+	return list, nil
+}
 
-	serverAddressDiscovery := servicediscovery.NewServerAddressList(adapter, "/healthstatus/doppler/"+config.Zone, logger)
+// newAddressList returns the list of the dopplers registered in etcd under
+// etcdKey, or of the given addresses. It is not running yet.
+func newAddressList(etcdKey string, addresses []string, config metronConfig, logger *gosteno.Logger) (servicediscovery.ServerAddressList, error) {
+	switch {
+	case etcdKey != "" && len(addresses) > 0:
+		return nil, errors.New("Only one of EtcdKey and Addresses may be given")
+	case etcdKey != "":
+		if len(config.EtcdUrls) == 0 {
+			return nil, errors.New("EtcdUrls must be given to read the dopplers from etcd")
+		}
+		adapter := storeAdapterProvider(config.EtcdUrls, config.EtcdMaxConcurrentRequests)
+		if err := adapter.Connect(); err != nil {
+			logger.Errorf("Error connecting to ETCD: %v", err)
+		}
+		list := dopplerforwarder.NewZoneAddressList(adapter, etcdKey, config.Zone, logger)
+		if config.EtcdMaxBackoffMilliseconds > 0 {
+			list.SetMaxBackoff(time.Duration(config.EtcdMaxBackoffMilliseconds) * time.Millisecond)
+		}
+		return list, nil
+	case len(addresses) > 0:
+		for _, address := range addresses {
+			if address == "" {
+				return nil, errors.New("Doppler addresses must not be empty")
+			}
+		}
+		return dopplerforwarder.NewStaticAddressList(addresses), nil
+	default:
+		return nil, errors.New("Either EtcdKey or Addresses must be given")
+	}
+}
 
-	clientPool := clientpool.NewLoggregatorClientPool(logger, port, serverAddressDiscovery)
-	return clientPool, serverAddressDiscovery
+// dopplerAddressReloader replaces the lists of dopplers when their settings
+// in the config file change, as sent with SIGHUP, so that changes to the
+// etcd URLs, the doppler addresses and the doppler DNS name take effect
+// without dropping the buffered messages. Adding or removing fan out
+// destinations requires a restart.
+type dopplerAddressReloader struct {
+	dopplers     *dopplerforwarder.ReloadableAddressList
+	destinations map[string]*dopplerforwarder.ReloadableAddressList
+	timeout      time.Duration
+	applied      metronConfig
+	registry     *metrics.Registry
+	logger       *gosteno.Logger
+}
+
+func (r *dopplerAddressReloader) reload(configFile string) {
+	config := metronConfig{}
+	if err := cfcomponent.ReadConfigInto(&config, configFile); err != nil {
+		r.logger.Errorf("Reload: Error reading %s, keeping the current dopplers: %s", configFile, err)
+		return
+	}
+
+	etcdChanged := !reflect.DeepEqual(config.EtcdUrls, r.applied.EtcdUrls)
+	var next servicediscovery.ServerAddressList
+	dnsChanged := config.DopplerDNSName != r.applied.DopplerDNSName ||
+		config.DopplerDNSSRV != r.applied.DopplerDNSSRV ||
+		config.DopplerDNSResolveIntervalMilliseconds != r.applied.DopplerDNSResolveIntervalMilliseconds
+	if etcdChanged || dnsChanged || !reflect.DeepEqual(config.DopplerAddresses, r.applied.DopplerAddresses) {
+		list, err := newDopplerAddressList(config, r.registry, r.logger)
+		if err != nil {
+			r.logger.Errorf("Reload: %s, keeping the current dopplers", err)
+			return
+		}
+		next = list
+	}
+
+	applied := map[string]dopplerDestination{}
+	for _, destination := range r.applied.DopplerFanOutDestinations {
+		applied[destination.Name] = destination
+	}
+	type replacement struct {
+		destination dopplerDestination
+		list        servicediscovery.ServerAddressList
+	}
+	var replacements []replacement
+	for _, destination := range config.DopplerFanOutDestinations {
+		current, ok := applied[destination.Name]
+		delete(applied, destination.Name)
+		if !ok {
+			r.logger.Warnf("Reload: Adding the doppler fan out destination %s requires a restart", destination.Name)
+			continue
+		}
+		if !etcdChanged && destination.EtcdKey == current.EtcdKey && reflect.DeepEqual(destination.Addresses, current.Addresses) {
+			continue
+		}
+
+		list, err := newAddressList(destination.EtcdKey, destination.Addresses, config, r.logger)
+		if err != nil {
+			r.logger.Errorf("Reload: Doppler fan out destination %s: %s, keeping the current dopplers", destination.Name, err)
+			return
+		}
+		replacements = append(replacements, replacement{destination, list})
+	}
+	for name := range applied {
+		r.logger.Warnf("Reload: Removing the doppler fan out destination %s requires a restart", name)
+	}
+
+	if next != nil {
+		if err := r.dopplers.Replace(next, r.timeout); err != nil {
+			r.logger.Errorf("Reload: Error replacing the dopplers, keeping the current dopplers: %s", err)
+			return
+		}
+		r.applied.EtcdUrls = config.EtcdUrls
+		r.applied.DopplerAddresses = config.DopplerAddresses
+		r.applied.DopplerDNSName = config.DopplerDNSName
+		r.applied.DopplerDNSSRV = config.DopplerDNSSRV
+		r.applied.DopplerDNSResolveIntervalMilliseconds = config.DopplerDNSResolveIntervalMilliseconds
+		r.logger.Info("Reload: Replaced the dopplers")
+	}
+	for _, replacement := range replacements {
+		name := replacement.destination.Name
+		if err := r.destinations[name].Replace(replacement.list, r.timeout); err != nil {
+			r.logger.Errorf("Reload: Error replacing the dopplers of fan out destination %s, keeping the current dopplers: %s", name, err)
+			continue
+		}
+		for i, destination := range r.applied.DopplerFanOutDestinations {
+			if destination.Name == name {
+				r.applied.DopplerFanOutDestinations[i] = replacement.destination
+			}
+		}
+		r.logger.Infof("Reload: Replaced the dopplers of fan out destination %s", name)
+	}
+}
+
+// unixSocketMode parses the octal permissions of a unix socket, defaulting
+// to 0660.
+func unixSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0660, nil
+	}
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("DropsondeUnixSocketMode must be octal permissions such as 0660, not %q", mode)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// writeBatches writes the envelopes of every batch read from batches to
+// outputChan, until batches is closed.
+func writeBatches(batches <-chan []*events.Envelope, outputChan chan<- *events.Envelope) {
+	for batch := range batches {
+		for _, envelope := range batch {
+			outputChan <- envelope
+		}
+	}
+}
+
+// newStatsdListenerConfig validates the statsd listener's settings in config.
+func newStatsdListenerConfig(config metronConfig) (statsdlistener.StatsdListenerConfig, error) {
+	timestampSource, err := statsdlistener.ParseTimestampSource(config.StatsdTimestampSource)
+	if err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	unknownTypeFallback, err := statsdlistener.ParseUnknownTypeFallback(config.StatsdUnknownTypeFallback)
+	if err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	longLinePolicy, err := statsdlistener.ParseLongLinePolicy(config.StatsdLongLinePolicy)
+	if err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	if err := statsdlistener.ValidateTypeNameTemplate(config.StatsdTypeNameTemplate); err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	if err := statsdlistener.ValidateOriginRules(config.StatsdOriginRules); err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	ingestSamplingMode, err := statsdlistener.ParseIngestSamplingMode(config.StatsdIngestSamplingMode)
+	if err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	if err := statsdlistener.ValidateIngestSampling(config.StatsdIngestSampling); err != nil {
+		return statsdlistener.StatsdListenerConfig{}, err
+	}
+	for _, percentile := range config.StatsdTimerPercentiles {
+		if percentile <= 0 || percentile > 100 {
+			return statsdlistener.StatsdListenerConfig{}, fmt.Errorf("StatsdTimerPercentiles must be greater than 0 and at most 100, got %g", percentile)
+		}
+	}
+
+	return statsdlistener.StatsdListenerConfig{
+		Address:                  fmt.Sprintf("localhost:%d", config.StatsdIncomingMessagesPort),
+		TimestampSource:          timestampSource,
+		CounterRateInterval:      time.Duration(config.StatsdCounterRateIntervalMilliseconds) * time.Millisecond,
+		SampleRateReportInterval: time.Duration(config.StatsdSampleRateReportIntervalMilliseconds) * time.Millisecond,
+		GoroutineReportInterval:  time.Duration(config.StatsdGoroutineReportIntervalMilliseconds) * time.Millisecond,
+		ParseLatencyInterval:     time.Duration(config.StatsdParseLatencyIntervalMilliseconds) * time.Millisecond,
+		GaugeFlushInterval:       time.Duration(config.StatsdGaugeFlushIntervalMilliseconds) * time.Millisecond,
+		GaugeFlushDeltas:         config.StatsdGaugeFlushDeltas,
+		KeyTTL:                   time.Duration(config.StatsdKeyTTLMilliseconds) * time.Millisecond,
+		CounterResetThreshold:    config.StatsdCounterResetThreshold,
+		CounterResetInterval:     time.Duration(config.StatsdCounterResetIntervalMilliseconds) * time.Millisecond,
+		MaxKeys:                  config.StatsdMaxKeys,
+		DefaultOrigin:            config.StatsdDefaultOrigin,
+		OriginRules:              config.StatsdOriginRules,
+		UnknownTypeFallback:      unknownTypeFallback,
+		GaugeDeltaCounters:       config.StatsdGaugeDeltaCounters,
+		RawLineLogMessages:       config.StatsdRawLineLogMessages,
+		MaxLineLength:            config.StatsdMaxLineLength,
+		LongLinePolicy:           longLinePolicy,
+		TimerAggregationInterval: time.Duration(config.StatsdTimerAggregationIntervalMilliseconds) * time.Millisecond,
+		TimerPercentiles:         config.StatsdTimerPercentiles,
+		MaxTimerSamples:          config.StatsdTimerMaxSamples,
+		DropRawTimers:            config.StatsdDropRawTimers,
+		TypeNameTemplate:         config.StatsdTypeNameTemplate,
+		FoldNameCase:             config.StatsdFoldNameCase,
+		FoldOriginCase:           config.StatsdFoldOriginCase,
+		IngestSampling:           config.StatsdIngestSampling,
+		IngestSamplingMode:       ingestSamplingMode,
+	}, nil
+}
+
+// reloadStatsdListener applies the statsd listener's settings from the
+// config file, as sent with SIGHUP. The other settings are only read on
+// startup.
+func reloadStatsdListener(listener *statsdlistener.StatsdListener, configFile string, logger *gosteno.Logger) {
+	config := metronConfig{}
+	if err := cfcomponent.ReadConfigInto(&config, configFile); err != nil {
+		logger.Errorf("Reload: Error reading %s, keeping the current settings: %s", configFile, err)
+		return
+	}
+	statsdConfig, err := newStatsdListenerConfig(config)
+	if err != nil {
+		logger.Errorf("Reload: %s, keeping the current settings", err)
+		return
+	}
+
+	restartRequired := listener.Reconfigure(statsdConfig)
+	if len(restartRequired) > 0 {
+		logger.Warnf("Reload: Reconfigured the statsd listener, changes to %s require a restart", strings.Join(restartRequired, ", "))
+		return
+	}
+	logger.Info("Reload: Reconfigured the statsd listener")
+}
+
+func startMonitoringEndpoints(component cfcomponent.Component, logger *gosteno.Logger) {
+	if err := component.StartMonitoringEndpoints(); err != nil {
+		component.Logger.Error(err.Error())
+	}
+}
+
+// dopplerDestination is a group of dopplers metron sends every message to in
+// addition to its own dopplers. The dopplers are either read from etcd under
+// EtcdKey or given as Addresses.
+type dopplerDestination struct {
+	Name       string
+	EtcdKey    string
+	Addresses  []string
+	Transports []string
 }
 
 type metronConfig struct {
 	cfcomponent.Config
-	Zone                          string
-	Index                         uint
-	Job                           string
-	LegacyIncomingMessagesPort    int
-	DropsondeIncomingMessagesPort int
-	StatsdIncomingMessagesPort    int
-	EtcdUrls                      []string
-	EtcdMaxConcurrentRequests     int
-	EtcdQueryIntervalMilliseconds int
-	LoggregatorLegacyPort         int
-	LoggregatorDropsondePort      int
-	SharedSecret                  string
-	Deployment                    string
+	Zone                                       string
+	Index                                      uint
+	Job                                        string
+	LegacyIncomingMessagesPort                 int
+	DropsondeIncomingMessagesPort              int
+	DropsondeReceiveBufferBytes                int
+	DropsondeKernelDropsIntervalMilliseconds   int
+	DropsondeUnixSocket                        string
+	DropsondeUnixSocketMode                    string
+	StatsdIncomingMessagesPort                 int
+	StatsdTimestampSource                      string
+	StatsdCounterRateIntervalMilliseconds      int
+	StatsdMaxKeys                              int
+	StatsdSampleRateReportIntervalMilliseconds int
+	StatsdGoroutineReportIntervalMilliseconds  int
+	StatsdParseLatencyIntervalMilliseconds     int
+	StatsdGaugeFlushIntervalMilliseconds       int
+	StatsdGaugeFlushDeltas                     bool
+	StatsdKeyTTLMilliseconds                   int
+	StatsdCounterResetThreshold                float64
+	StatsdCounterResetIntervalMilliseconds     int
+	StatsdDefaultOrigin                        string
+	StatsdOriginRules                          []statsdlistener.OriginRule
+	StatsdUnknownTypeFallback                  string
+	StatsdGaugeDeltaCounters                   bool
+	StatsdRawLineLogMessages                   bool
+	StatsdMaxLineLength                        int
+	StatsdLongLinePolicy                       string
+	StatsdTimerAggregationIntervalMilliseconds int
+	StatsdTimerPercentiles                     []float64
+	StatsdTimerMaxSamples                      int
+	StatsdDropRawTimers                        bool
+	StatsdReadBufferSize                       int
+	StatsdTypeNameTemplate                     string
+	StatsdFoldNameCase                         bool
+	StatsdFoldOriginCase                       bool
+	StatsdIngestSampling                       []statsdlistener.IngestSampling
+	StatsdIngestSamplingMode                   string
+	StatsdGaugeSnapshotFile                    string
+	StatsdReloadGaugeSnapshot                  bool
+	StatsdBatchSize                            int
+	StatsdBatchMaxDelayMilliseconds            int
+	SyslogTCPPort                              int
+	SyslogUnixSocket                           string
+	SyslogOrigin                               string
+	StatsdCaptureFile                          string
+	StatsdCaptureMaxFileBytes                  int64
+	StatsdCaptureMaxFiles                      int
+	CounterAggregationWindowMilliseconds       int
+	ValueMetricCoalescingWindowMilliseconds    int
+	MaxTimestampSkewSeconds                    int
+	IngestRateLimit                            float64
+	IngestOriginRateLimits                     []ratelimiter.OriginLimit
+	IngestRateLimitLogMessages                 bool
+	DopplerAddresses                           []string
+	DopplerDNSName                             string
+	DopplerDNSSRV                              bool
+	DopplerDNSResolveIntervalMilliseconds      int
+	EtcdUrls                                   []string
+	EtcdMaxConcurrentRequests                  int
+	EtcdQueryIntervalMilliseconds              int
+	EtcdMaxBackoffMilliseconds                 int
+	LoggregatorLegacyPort                      int
+	LoggregatorDropsondePort                   int
+	DopplerBatchMaxBytes                       int
+	DopplerBatchIntervalMilliseconds           int
+	DopplerMaxEnvelopeBytes                    int
+	DopplerTransports                          []string
+	DopplerUDPSequenceNumbers                  bool
+	DopplerTCPPort                             int
+	DopplerTLSPort                             int
+	DopplerWebsocketPort                       int
+	DopplerWebsocketTLS                        bool
+	DopplerTLSCertFile                         string
+	DopplerTLSKeyFile                          string
+	DopplerTLSCAFile                           string
+	DopplerTLSServerName                       string
+	DopplerRetryBufferMaxMessages              int
+	DopplerRetryBufferMaxBytes                 int
+	DopplerShutdownTimeoutMilliseconds         int
+	DopplerOriginOrdering                      bool
+	DopplerClassPolicy                         string
+	DopplerClassQueueLength                    int
+	DopplerClassLogWeight                      int
+	DopplerClassMetricWeight                   int
+	DopplerClassPriority                       string
+	DopplerFrameCompression                    bool
+	DopplerFrameCompressionMinBytes            int
+	DopplerSendRetries                         int
+	DopplerSendRetryDelayMilliseconds          int
+	DopplerFanOutDestinations                  []dopplerDestination
+	DopplerFanOutQueueLength                   int
+	DopplerZoneFailAfterMilliseconds           int
+	DopplerZoneFailBackAfterMilliseconds       int
+	DopplerEjectionMaxErrorRate                float64
+	DopplerEjectionMilliseconds                int
+	HealthPort                                 int
+	HealthIntervalSeconds                      int
+	HealthUnreachableThresholdSeconds          int
+	MetricsIntervalMilliseconds                int
+	RuntimeStatsIntervalMilliseconds           int
+	SharedSecret                               string
+	Deployment                                 string
 }
 
 type metronHealthMonitor struct{}
@@ -192,14 +1087,3 @@ func parseConfig(debug bool, configFile, logFilePath string) (metronConfig, *gos
 
 	return config, logger
 }
-
-func forwardMessagesToDoppler(clientPool *clientpool.LoggregatorClientPool, messageChan <-chan []byte, logger *gosteno.Logger) {
-	for message := range messageChan {
-		client, err := clientPool.RandomClient()
-		if err != nil {
-			logger.Errorf("can't forward message: %v", err)
-			continue
-		}
-		client.Send(message)
-	}
-}
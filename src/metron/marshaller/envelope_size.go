@@ -0,0 +1,88 @@
+package marshaller
+
+import (
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// TruncatedMarker is appended to the message of a log message that was cut
+// to fit into the maximum envelope size.
+const TruncatedMarker = "TRUNCATED"
+
+// SetMaxEnvelopeSize limits the size of the marshalled envelopes, so that
+// every envelope still fits into a single signed datagram to doppler. The
+// message of a larger log message is cut at a character boundary and
+// TruncatedMarker appended; larger envelopes of other types, and log
+// messages that do not fit even without their message, are dropped and
+// counted. Zero means no limit. It must be called before Run.
+func (m *Marshaller) SetMaxEnvelopeSize(maxBytes int) {
+	m.maxEnvelopeSize = maxBytes
+}
+
+// fit returns marshalled, or a log message cut to fit into the maximum
+// envelope size in its place, or nil if envelope has to be dropped. The
+// buffer of a dropped or replaced envelope is returned to the pool.
+func (m *Marshaller) fit(envelope *events.Envelope, marshalled []byte, buffer *proto.Buffer) []byte {
+	if m.maxEnvelopeSize <= 0 || len(marshalled) <= m.maxEnvelopeSize {
+		return marshalled
+	}
+	m.pool.Put(marshalled)
+
+	if envelope.GetEventType() != events.Envelope_LogMessage {
+		m.dropOversized(envelope, len(marshalled))
+		return nil
+	}
+
+	truncated, ok := truncateLogMessage(envelope, len(marshalled)-m.maxEnvelopeSize)
+	if !ok {
+		m.dropOversized(envelope, len(marshalled))
+		return nil
+	}
+
+	buffer.SetBuf(m.pool.Get())
+	if err := buffer.Marshal(truncated); err != nil || len(buffer.Bytes()) > m.maxEnvelopeSize {
+		m.pool.Put(buffer.Bytes())
+		m.dropOversized(envelope, len(marshalled))
+		return nil
+	}
+
+	if atomic.AddUint64(&m.truncatedLogMessages, 1) == 1 {
+		m.logger.Warnf("Marshaller: Truncating log messages of more than %d bytes, such as one of %d bytes from %s", m.maxEnvelopeSize, len(marshalled), envelope.GetOrigin())
+	}
+	return buffer.Bytes()
+}
+
+func (m *Marshaller) dropOversized(envelope *events.Envelope, size int) {
+	if atomic.AddUint64(&m.droppedOversizedEnvelopes, 1) == 1 {
+		m.logger.Warnf("Marshaller: Dropping envelopes of more than %d bytes, such as a %s of %d bytes from %s", m.maxEnvelopeSize, envelope.GetEventType(), size, envelope.GetOrigin())
+	}
+}
+
+// truncateLogMessage returns a copy of envelope with overflow more bytes cut
+// from the end of its message than the TruncatedMarker takes up. Shortening
+// the message never lengthens the envelope, as its length prefix can only
+// shrink. The cut is moved back to the start of the character it falls into.
+// It reports false if the message is too short to be cut that much.
+func truncateLogMessage(envelope *events.Envelope, overflow int) (*events.Envelope, bool) {
+	message := envelope.GetLogMessage().GetMessage()
+	cut := len(message) - overflow - len(TruncatedMarker)
+	if cut < 0 {
+		return nil, false
+	}
+	for cut > 0 && cut < len(message) && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+
+	truncatedMessage := make([]byte, 0, cut+len(TruncatedMarker))
+	truncatedMessage = append(truncatedMessage, message[:cut]...)
+	truncatedMessage = append(truncatedMessage, TruncatedMarker...)
+
+	logMessage := *envelope.GetLogMessage()
+	logMessage.Message = truncatedMessage
+	truncated := *envelope
+	truncated.LogMessage = &logMessage
+	return &truncated, true
+}
@@ -0,0 +1,160 @@
+package marshaller_test
+
+import (
+	"metron/bufferpool"
+	"metron/marshaller"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Maximum envelope size", func() {
+	const maxEnvelopeSize = 200
+
+	var (
+		envelopeMarshaller *marshaller.Marshaller
+		inputChan          chan *events.Envelope
+		outputChan         chan []byte
+	)
+
+	metricValue := func(name string) interface{} {
+		for _, metric := range envelopeMarshaller.Emit().Metrics {
+			if metric.Name == name {
+				return metric.Value
+			}
+		}
+		return nil
+	}
+
+	receive := func() (*events.Envelope, int) {
+		var marshalled []byte
+		Eventually(outputChan).Should(Receive(&marshalled))
+		var envelope events.Envelope
+		Expect(proto.Unmarshal(marshalled, &envelope)).To(Succeed())
+		return &envelope, len(marshalled)
+	}
+
+	envelopeSize := func(message string) int {
+		marshalled, err := proto.Marshal(logEnvelope(message))
+		Expect(err).NotTo(HaveOccurred())
+		return len(marshalled)
+	}
+
+	// fittingLength returns the length of the longest message that fits into
+	// a log envelope of the maximum size. The length prefixes grow with the
+	// message, so it is searched for rather than computed.
+	fittingLength := func() int {
+		length := 0
+		for envelopeSize(strings.Repeat("a", length+1)) <= maxEnvelopeSize {
+			length++
+		}
+		return length
+	}
+
+	BeforeEach(func() {
+		envelopeMarshaller = marshaller.New(bufferpool.New(), loggertesthelper.Logger())
+		envelopeMarshaller.SetMaxEnvelopeSize(maxEnvelopeSize)
+		inputChan = make(chan *events.Envelope, 10)
+		outputChan = make(chan []byte, 10)
+		go envelopeMarshaller.Run(inputChan, outputChan)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	It("passes on envelopes of the maximum size unchanged", func() {
+		message := strings.Repeat("a", fittingLength())
+		Expect(envelopeSize(message)).To(Equal(maxEnvelopeSize))
+		inputChan <- logEnvelope(message)
+
+		envelope, size := receive()
+		Expect(size).To(Equal(maxEnvelopeSize))
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal(message))
+		Expect(metricValue("truncatedLogMessages")).To(BeEquivalentTo(0))
+	})
+
+	It("truncates the message of a larger log message to fit, marking it as truncated", func() {
+		message := strings.Repeat("a", fittingLength()+1)
+		inputChan <- logEnvelope(message)
+
+		envelope, size := receive()
+		Expect(size).To(BeNumerically("<=", maxEnvelopeSize))
+		truncated := string(envelope.GetLogMessage().GetMessage())
+		Expect(truncated).To(HaveSuffix(marshaller.TruncatedMarker))
+		Expect(strings.TrimSuffix(truncated, marshaller.TruncatedMarker)).To(Equal(message[:len(message)-1-len(marshaller.TruncatedMarker)]))
+		Expect(envelope.GetLogMessage().GetAppId()).To(Equal("app-id"))
+		Expect(metricValue("truncatedLogMessages")).To(BeEquivalentTo(1))
+	})
+
+	It("truncates messages far larger than the maximum", func() {
+		inputChan <- logEnvelope(strings.Repeat("a", 1024*1024))
+
+		envelope, size := receive()
+		Expect(size).To(BeNumerically("<=", maxEnvelopeSize))
+		Expect(size).To(BeNumerically(">", maxEnvelopeSize-4))
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(HaveSuffix(marshaller.TruncatedMarker))
+	})
+
+	It("moves the cut back to the start of a multi-byte character", func() {
+		prefix := strings.Repeat("a", fittingLength()-len(marshaller.TruncatedMarker)-2)
+		// the cut falls after the first byte of the three byte character
+		message := prefix + "a€" + strings.Repeat("b", 10)
+		inputChan <- logEnvelope(message)
+
+		envelope, _ := receive()
+		truncated := envelope.GetLogMessage().GetMessage()
+		Expect(utf8.Valid(truncated)).To(BeTrue())
+		Expect(string(truncated)).To(Equal(prefix + "a" + marshaller.TruncatedMarker))
+	})
+
+	It("keeps a multi-byte character that ends right at the cut", func() {
+		prefix := strings.Repeat("a", fittingLength()-len(marshaller.TruncatedMarker)-3)
+		message := prefix + "€" + strings.Repeat("b", 10)
+		inputChan <- logEnvelope(message)
+
+		envelope, _ := receive()
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal(prefix + "€" + marshaller.TruncatedMarker))
+	})
+
+	It("drops and counts larger envelopes of other types", func() {
+		inputChan <- &events.Envelope{
+			Origin:    proto.String("origin"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(strings.Repeat("n", maxEnvelopeSize)),
+				Value: proto.Float64(1),
+				Unit:  proto.String("unit"),
+			},
+		}
+		inputChan <- logEnvelope("message")
+
+		envelope, _ := receive()
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal("message"))
+		Expect(metricValue("droppedOversizedEnvelopes")).To(BeEquivalentTo(1))
+		Expect(metricValue("truncatedLogMessages")).To(BeEquivalentTo(0))
+	})
+
+	It("drops log messages that do not fit even without their message", func() {
+		envelope := logEnvelope("message")
+		envelope.LogMessage.AppId = proto.String(strings.Repeat("x", maxEnvelopeSize))
+		inputChan <- envelope
+
+		Consistently(outputChan).ShouldNot(Receive())
+		Expect(metricValue("droppedOversizedEnvelopes")).To(BeEquivalentTo(1))
+	})
+
+	It("does not change the envelope it was given", func() {
+		envelope := logEnvelope(strings.Repeat("a", maxEnvelopeSize))
+		inputChan <- envelope
+		receive()
+
+		Expect(envelope.GetLogMessage().GetMessage()).To(HaveLen(maxEnvelopeSize))
+	})
+})
@@ -0,0 +1,61 @@
+package marshaller
+
+import (
+	"metron/bufferpool"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/gogo/protobuf/proto"
+)
+
+// Marshaller marshals envelopes into buffers taken from its buffer pool,
+// instead of allocating a new slice for every envelope as proto.Marshal does.
+// The buffers are handed on with the marshalled envelopes and returned to the
+// pool by the forwarder once they are sent.
+type Marshaller struct {
+	pool            *bufferpool.Pool
+	maxEnvelopeSize int
+	logger          *gosteno.Logger
+
+	marshalErrors             uint64
+	truncatedLogMessages      uint64
+	droppedOversizedEnvelopes uint64
+}
+
+func New(pool *bufferpool.Pool, logger *gosteno.Logger) *Marshaller {
+	return &Marshaller{
+		pool:   pool,
+		logger: logger,
+	}
+}
+
+// Run marshals the envelopes read from inputChan until it is closed.
+// Envelopes that cannot be marshalled are dropped.
+func (m *Marshaller) Run(inputChan <-chan *events.Envelope, outputChan chan<- []byte) {
+	buffer := proto.NewBuffer(nil)
+	for envelope := range inputChan {
+		buffer.SetBuf(m.pool.Get())
+		if err := buffer.Marshal(envelope); err != nil {
+			m.logger.Debugf("Marshaller: Error marshalling envelope: %v", err)
+			atomic.AddUint64(&m.marshalErrors, 1)
+			m.pool.Put(buffer.Bytes())
+			continue
+		}
+		if marshalled := m.fit(envelope, buffer.Bytes(), buffer); marshalled != nil {
+			outputChan <- marshalled
+		}
+	}
+}
+
+func (m *Marshaller) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: "dropsondeMarshaller",
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "marshalErrors", Value: atomic.LoadUint64(&m.marshalErrors)},
+			instrumentation.Metric{Name: "truncatedLogMessages", Value: atomic.LoadUint64(&m.truncatedLogMessages)},
+			instrumentation.Metric{Name: "droppedOversizedEnvelopes", Value: atomic.LoadUint64(&m.droppedOversizedEnvelopes)},
+		},
+	}
+}
@@ -0,0 +1,116 @@
+package marshaller_test
+
+import (
+	"metron/bufferpool"
+	"metron/marshaller"
+	"metron/signer"
+	"testing"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/signature"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func logEnvelope(message string) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("origin"),
+		EventType: events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{
+			Message:     []byte(message),
+			MessageType: events.LogMessage_OUT.Enum(),
+			Timestamp:   proto.Int64(1234),
+			AppId:       proto.String("app-id"),
+		},
+	}
+}
+
+var _ = Describe("Marshaller", func() {
+	var (
+		pool               *bufferpool.Pool
+		envelopeMarshaller *marshaller.Marshaller
+		inputChan          chan *events.Envelope
+		outputChan         chan []byte
+	)
+
+	BeforeEach(func() {
+		pool = bufferpool.New()
+		envelopeMarshaller = marshaller.New(pool, loggertesthelper.Logger())
+		inputChan = make(chan *events.Envelope, 10)
+		outputChan = make(chan []byte, 10)
+		go envelopeMarshaller.Run(inputChan, outputChan)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	It("marshals envelopes the way proto.Marshal does", func() {
+		envelope := logEnvelope("message")
+		expected, err := proto.Marshal(envelope)
+		Expect(err).NotTo(HaveOccurred())
+
+		inputChan <- envelope
+		Eventually(outputChan).Should(Receive(Equal(expected)))
+	})
+
+	It("marshals every envelope into its own buffer", func() {
+		inputChan <- logEnvelope("first")
+		inputChan <- logEnvelope("second")
+
+		var first, second []byte
+		Eventually(outputChan).Should(Receive(&first))
+		Eventually(outputChan).Should(Receive(&second))
+
+		var envelope events.Envelope
+		Expect(proto.Unmarshal(first, &envelope)).To(Succeed())
+		Expect(envelope.GetLogMessage().GetMessage()).To(Equal([]byte("first")))
+		Expect(proto.Unmarshal(second, &envelope)).To(Succeed())
+		Expect(envelope.GetLogMessage().GetMessage()).To(Equal([]byte("second")))
+	})
+
+	It("drops and counts envelopes that cannot be marshalled", func() {
+		inputChan <- &events.Envelope{EventType: events.Envelope_LogMessage.Enum()}
+		inputChan <- logEnvelope("message")
+
+		var marshalled []byte
+		Eventually(outputChan).Should(Receive(&marshalled))
+		var envelope events.Envelope
+		Expect(proto.Unmarshal(marshalled, &envelope)).To(Succeed())
+		Expect(envelope.GetOrigin()).To(Equal("origin"))
+
+		metrics := envelopeMarshaller.Emit().Metrics
+		Expect(metrics[0].Name).To(Equal("marshalErrors"))
+		Expect(metrics[0].Value).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Marshalling", func() {
+	Measure("allocations per marshalled and signed envelope", func(bench Benchmarker) {
+		envelope := logEnvelope("a log line of a typical length, emitted by an app through metron")
+
+		unpooled := testing.AllocsPerRun(1000, func() {
+			message, _ := proto.Marshal(envelope)
+			signature.SignMessage(message, []byte("secret"))
+		})
+
+		pool := bufferpool.New()
+		envelopeChan, marshalledChan, signedChan := make(chan *events.Envelope), make(chan []byte), make(chan []byte)
+		go marshaller.New(pool, loggertesthelper.Logger()).Run(envelopeChan, marshalledChan)
+		go signer.New("secret", pool).Run(marshalledChan, signedChan)
+		defer close(envelopeChan)
+
+		pooled := testing.AllocsPerRun(1000, func() {
+			envelopeChan <- envelope
+			pool.Put(<-signedChan)
+		})
+
+		bench.RecordValue("allocations per envelope with proto.Marshal", unpooled)
+		bench.RecordValue("allocations per envelope with pooled buffers", pooled)
+
+		Expect(pooled).To(BeNumerically("<", unpooled))
+	}, 3)
+})
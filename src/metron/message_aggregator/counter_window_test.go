@@ -0,0 +1,138 @@
+package message_aggregator_test
+
+import (
+	"metron/message_aggregator"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MessageAggregator with a counter window", func() {
+	var (
+		inputChan         chan *events.Envelope
+		outputChan        chan *events.Envelope
+		inputClosed       bool
+		runComplete       chan struct{}
+		messageAggregator message_aggregator.MessageAggregator
+	)
+
+	closeInput := func() {
+		if !inputClosed {
+			close(inputChan)
+			inputClosed = true
+		}
+		Eventually(runComplete).Should(BeClosed())
+	}
+
+	start := func(window time.Duration) {
+		messageAggregator.SetCounterWindow(window)
+		go func() {
+			messageAggregator.Run(inputChan, outputChan)
+			close(runComplete)
+		}()
+	}
+
+	BeforeEach(func() {
+		inputChan = make(chan *events.Envelope, 10)
+		inputClosed = false
+		outputChan = make(chan *events.Envelope, 10)
+		runComplete = make(chan struct{})
+		messageAggregator = message_aggregator.NewMessageAggregator(loggertesthelper.Logger())
+	})
+
+	AfterEach(func() {
+		closeInput()
+	})
+
+	It("sends the CounterEvents of a window as one with the combined delta and the latest total", func() {
+		start(200 * time.Millisecond)
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+
+		var outputMessage *events.Envelope
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter1", 12, 12)
+		Consistently(outputChan).ShouldNot(Receive())
+
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter1", 8, 20)
+	})
+
+	It("sums counters of different names, origins and emitters separately", func() {
+		start(200 * time.Millisecond)
+		otherJob := createCounterMessage("counter1", "fake-origin-1")
+		otherJob.Job = proto.String("other-job")
+
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createCounterMessage("counter2", "fake-origin-1")
+		inputChan <- createCounterMessage("counter1", "fake-origin-2")
+		inputChan <- otherJob
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+
+		var outputMessage *events.Envelope
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		Expect(outputMessage.GetOrigin()).To(Equal("fake-origin-1"))
+		Expect(outputMessage.GetJob()).To(BeEmpty())
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter1", 8, 12)
+
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		Expect(outputMessage.GetOrigin()).To(Equal("fake-origin-1"))
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter2", 4, 4)
+
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		Expect(outputMessage.GetOrigin()).To(Equal("fake-origin-2"))
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter1", 4, 4)
+
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		Expect(outputMessage.GetOrigin()).To(Equal("fake-origin-1"))
+		Expect(outputMessage.GetJob()).To(Equal("other-job"))
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter1", 4, 8)
+	})
+
+	It("passes other events through right away", func() {
+		start(time.Hour)
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createHeartbeatMessage()
+
+		var outputMessage *events.Envelope
+		Eventually(outputChan).Should(Receive(&outputMessage))
+		Expect(outputMessage.GetEventType()).To(Equal(events.Envelope_Heartbeat))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("sends the counters of the current window when the input is closed", func() {
+		start(time.Hour)
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		Consistently(outputChan).ShouldNot(Receive())
+
+		closeInput()
+
+		var outputMessage *events.Envelope
+		Expect(outputChan).To(Receive(&outputMessage))
+		assertCorrectCounterNameDeltaAndTotal(outputMessage, "counter1", 8, 8)
+	})
+
+	It("counts the CounterEvents it sends", func() {
+		start(time.Hour)
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		inputChan <- createCounterMessage("counter1", "fake-origin-1")
+		Eventually(func() []instrumentation.Metric {
+			return messageAggregator.Emit().Metrics
+		}).Should(ContainElement(instrumentation.Metric{Name: "counterEventReceived", Value: uint64(2)}))
+		Expect(messageAggregator.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "counterEventEmitted", Value: uint64(0)}))
+
+		closeInput()
+		Expect(messageAggregator.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "counterEventEmitted", Value: uint64(1)}))
+	})
+})
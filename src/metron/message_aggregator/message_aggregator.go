@@ -13,6 +13,7 @@ var MaxTTL = time.Minute
 
 type MessageAggregator interface {
 	instrumentation.Instrumentable
+	SetCounterWindow(window time.Duration)
 	Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope)
 }
 
@@ -21,6 +22,7 @@ func NewMessageAggregator(logger *gosteno.Logger) MessageAggregator {
 		logger:               logger,
 		startEventsByEventId: make(map[eventId]startEventEntry),
 		counterTotals:        make(map[counterId]uint64),
+		pendingCounters:      make(map[pendingCounterId]*events.Envelope),
 	}
 }
 
@@ -36,6 +38,11 @@ type messageAggregator struct {
 	httpUnmatchedStartReceivedCount uint64
 	httpUnmatchedStopReceivedCount  uint64
 	counterEventReceivedCount       uint64
+	counterEventEmittedCount        uint64
+
+	counterWindow          time.Duration
+	pendingCounters        map[pendingCounterId]*events.Envelope
+	pendingCounterIdsOrder []pendingCounterId
 }
 
 type counterId struct {
@@ -43,6 +50,18 @@ type counterId struct {
 	name   string
 }
 
+// pendingCounterId tells apart the CounterEvents summed within a counter
+// window. Besides origin and name it holds the identity fields the emitter may
+// have set on the envelope, so counters of different emitters are kept apart.
+type pendingCounterId struct {
+	origin     string
+	name       string
+	deployment string
+	job        string
+	index      string
+	ip         string
+}
+
 type eventId struct {
 	requestId string
 	peerType  events.PeerType
@@ -53,27 +72,63 @@ type startEventEntry struct {
 	entryTime  time.Time
 }
 
+// SetCounterWindow makes the aggregator sum up the CounterEvents it receives
+// over each window and send a single CounterEvent per counter and emitter with
+// the combined delta and the latest total once the window is over. Other
+// events are passed on right away. A zero window, the default, sends every
+// CounterEvent as it is received. It must be called before Run.
+func (m *messageAggregator) SetCounterWindow(window time.Duration) {
+	m.counterWindow = window
+}
+
+// Run aggregates the envelopes read from inputChan until inputChan is closed.
+// The CounterEvents of the current window are sent before Run returns.
 func (m *messageAggregator) Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope) {
-	for envelope := range inputChan {
-		// TODO: don't call for every message if throughput becomes a problem
-		m.cleanupOrphanedHttpStart()
-
-		switch envelope.GetEventType() {
-		case events.Envelope_HttpStart:
-			m.handleHttpStart(envelope)
-		case events.Envelope_HttpStop:
-			startStopMessage := m.handleHttpStop(envelope)
-			if startStopMessage != nil {
-				outputChan <- startStopMessage
+	var flushTicks <-chan time.Time
+	if m.counterWindow > 0 {
+		ticker := time.NewTicker(m.counterWindow)
+		defer ticker.Stop()
+		flushTicks = ticker.C
+	}
+
+	for {
+		select {
+		case envelope, ok := <-inputChan:
+			if !ok {
+				m.flushCounters(outputChan)
+				return
 			}
-		case events.Envelope_CounterEvent:
-			counterEventMessage := m.handleCounter(envelope)
-			outputChan <- counterEventMessage
-		default:
-			m.incrementCounter(&m.uncategorizedEventCount)
-			m.logger.Debugf("passing through message %v", spew.Sprintf("%v", envelope))
-			outputChan <- envelope
+			m.handleEnvelope(envelope, outputChan)
+		case <-flushTicks:
+			m.flushCounters(outputChan)
+		}
+	}
+}
+
+func (m *messageAggregator) handleEnvelope(envelope *events.Envelope, outputChan chan<- *events.Envelope) {
+	// TODO: don't call for every message if throughput becomes a problem
+	m.cleanupOrphanedHttpStart()
+
+	switch envelope.GetEventType() {
+	case events.Envelope_HttpStart:
+		m.handleHttpStart(envelope)
+	case events.Envelope_HttpStop:
+		startStopMessage := m.handleHttpStop(envelope)
+		if startStopMessage != nil {
+			outputChan <- startStopMessage
+		}
+	case events.Envelope_CounterEvent:
+		counterEventMessage := m.handleCounter(envelope)
+		if m.counterWindow > 0 {
+			m.holdCounter(counterEventMessage)
+			return
 		}
+		m.incrementCounter(&m.counterEventEmittedCount)
+		outputChan <- counterEventMessage
+	default:
+		m.incrementCounter(&m.uncategorizedEventCount)
+		m.logger.Debugf("passing through message %v", spew.Sprintf("%v", envelope))
+		outputChan <- envelope
 	}
 }
 
@@ -153,6 +208,38 @@ func (m *messageAggregator) handleCounter(envelope *events.Envelope) *events.Env
 	return envelope
 }
 
+// holdCounter adds a CounterEvent, whose Total is already set, to the current
+// window. The envelope held for a counter is the latest one received, carrying
+// the delta summed over the window.
+func (m *messageAggregator) holdCounter(envelope *events.Envelope) {
+	id := pendingCounterId{
+		origin:     envelope.GetOrigin(),
+		name:       envelope.GetCounterEvent().GetName(),
+		deployment: envelope.GetDeployment(),
+		job:        envelope.GetJob(),
+		index:      envelope.GetIndex(),
+		ip:         envelope.GetIp(),
+	}
+
+	pending, ok := m.pendingCounters[id]
+	if !ok {
+		m.pendingCounterIdsOrder = append(m.pendingCounterIdsOrder, id)
+	} else {
+		delta := pending.GetCounterEvent().GetDelta() + envelope.GetCounterEvent().GetDelta()
+		envelope.GetCounterEvent().Delta = &delta
+	}
+	m.pendingCounters[id] = envelope
+}
+
+func (m *messageAggregator) flushCounters(outputChan chan<- *events.Envelope) {
+	for _, id := range m.pendingCounterIdsOrder {
+		m.incrementCounter(&m.counterEventEmittedCount)
+		outputChan <- m.pendingCounters[id]
+		delete(m.pendingCounters, id)
+	}
+	m.pendingCounterIdsOrder = m.pendingCounterIdsOrder[:0]
+}
+
 func (m *messageAggregator) cleanupOrphanedHttpStart() {
 	currentTime := time.Now()
 	for key, eventEntry := range m.startEventsByEventId {
@@ -175,6 +262,7 @@ func (m *messageAggregator) metrics() []instrumentation.Metric {
 		instrumentation.Metric{Name: "httpUnmatchedStartReceived", Value: m.httpUnmatchedStartReceivedCount},
 		instrumentation.Metric{Name: "httpUnmatchedStopReceived", Value: m.httpUnmatchedStopReceivedCount},
 		instrumentation.Metric{Name: "counterEventReceived", Value: m.counterEventReceivedCount},
+		instrumentation.Metric{Name: "counterEventEmitted", Value: m.counterEventEmittedCount},
 	}
 }
 
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// Origin is the origin of the envelopes metron emits about itself.
+const Origin = "MetronAgent"
+
+const gaugeUnit = "count"
+
+// Emitter sends the counters and gauges of a registry every interval, into
+// the same stream as the envelopes metron forwards. Counters are sent as
+// CounterEvents with the increase since the previous emit as their delta,
+// gauges as ValueMetrics.
+type Emitter struct {
+	registry *Registry
+	interval time.Duration
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+
+	emittedTotals map[string]uint64
+}
+
+func NewEmitter(registry *Registry, interval time.Duration) *Emitter {
+	return &Emitter{
+		registry:      registry,
+		interval:      interval,
+		stopChan:      make(chan struct{}),
+		emittedTotals: make(map[string]uint64),
+	}
+}
+
+// Run emits on outputChan every interval until Stop is called.
+func (e *Emitter) Run(outputChan chan<- *events.Envelope) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, envelope := range e.envelopes(time.Now().UnixNano()) {
+				select {
+				case outputChan <- envelope:
+				case <-e.stopChan:
+					return
+				}
+			}
+		case <-e.stopChan:
+			return
+		}
+	}
+}
+
+func (e *Emitter) Stop() {
+	e.stopOnce.Do(func() { close(e.stopChan) })
+}
+
+func (e *Emitter) envelopes(timestamp int64) []*events.Envelope {
+	counters, gauges := e.registry.snapshot()
+
+	envelopes := make([]*events.Envelope, 0, len(counters)+len(gauges))
+	for _, counter := range counters {
+		delta := counter.total - e.emittedTotals[counter.name]
+		e.emittedTotals[counter.name] = counter.total
+
+		envelopes = append(envelopes, &events.Envelope{
+			Origin:    proto.String(Origin),
+			Timestamp: proto.Int64(timestamp),
+			EventType: events.Envelope_CounterEvent.Enum(),
+
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String(counter.name),
+				Delta: proto.Uint64(delta),
+				Total: proto.Uint64(counter.total),
+			},
+		})
+	}
+	for _, gauge := range gauges {
+		envelopes = append(envelopes, &events.Envelope{
+			Origin:    proto.String(Origin),
+			Timestamp: proto.Int64(timestamp),
+			EventType: events.Envelope_ValueMetric.Enum(),
+
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(gauge.name),
+				Value: proto.Float64(gauge.value),
+				Unit:  proto.String(gaugeUnit),
+			},
+		})
+	}
+	return envelopes
+}
@@ -0,0 +1,101 @@
+package metrics_test
+
+import (
+	"metron/metrics"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Emitter", func() {
+	var (
+		registry     *metrics.Registry
+		emitter      *metrics.Emitter
+		envelopeChan chan *events.Envelope
+	)
+
+	// receive collects the next emit, keyed by metric name
+	receive := func() map[string]*events.Envelope {
+		var envelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&envelope))
+
+		emitted := make(map[string]*events.Envelope)
+		for {
+			Expect(envelope.GetOrigin()).To(Equal("MetronAgent"))
+			if envelope.GetEventType() == events.Envelope_CounterEvent {
+				emitted[envelope.GetCounterEvent().GetName()] = envelope
+			} else {
+				emitted[envelope.GetValueMetric().GetName()] = envelope
+			}
+
+			select {
+			case envelope = <-envelopeChan:
+			case <-time.After(20 * time.Millisecond):
+				return emitted
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+		emitter = metrics.NewEmitter(registry, 100*time.Millisecond)
+		envelopeChan = make(chan *events.Envelope, 100)
+		go emitter.Run(envelopeChan)
+	})
+
+	AfterEach(func() {
+		emitter.Stop()
+	})
+
+	It("emits the counters as CounterEvents and the gauges as ValueMetrics after simulated traffic", func() {
+		for i := 0; i < 3; i++ {
+			registry.Increment(metrics.DropsondeReceivedEnvelopes)
+		}
+		registry.Increment(metrics.LegacyReceivedEnvelopes)
+		registry.Add(metrics.StatsdEmittedEnvelopes, 2)
+		registry.Add(metrics.DopplerTLSSentMessages, 4)
+		registry.Increment(metrics.DopplerSendErrors)
+		registry.SetGauge(metrics.DopplerRetryBufferedMessages, 7)
+
+		emitted := receive()
+		Expect(emitted).To(HaveLen(6))
+		for name, total := range map[string]uint64{
+			"dropsondeListener.receivedEnvelopes": 3,
+			"legacyListener.receivedEnvelopes":    1,
+			"statsdListener.emittedEnvelopes":     2,
+			"dopplerForwarder.tlsSentMessages":    4,
+			"dopplerForwarder.sendErrors":         1,
+		} {
+			Expect(emitted).To(HaveKey(name))
+			Expect(emitted[name].GetEventType()).To(Equal(events.Envelope_CounterEvent))
+			Expect(emitted[name].GetCounterEvent().GetDelta()).To(Equal(total))
+			Expect(emitted[name].GetCounterEvent().GetTotal()).To(Equal(total))
+		}
+
+		gauge := emitted["dopplerForwarder.retryBufferedMessages"]
+		Expect(gauge.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(gauge.GetValueMetric().GetValue()).To(Equal(7.0))
+		Expect(gauge.GetValueMetric().GetUnit()).To(Equal("count"))
+	})
+
+	It("emits the increase since the previous emit as the delta", func() {
+		registry.Add(metrics.DopplerUDPSentMessages, 5)
+		emitted := receive()
+		Expect(emitted[metrics.DopplerUDPSentMessages].GetCounterEvent().GetDelta()).To(BeEquivalentTo(5))
+
+		registry.Add(metrics.DopplerUDPSentMessages, 2)
+		emitted = receive()
+		Expect(emitted[metrics.DopplerUDPSentMessages].GetCounterEvent().GetDelta()).To(BeEquivalentTo(2))
+		Expect(emitted[metrics.DopplerUDPSentMessages].GetCounterEvent().GetTotal()).To(BeEquivalentTo(7))
+
+		emitted = receive()
+		Expect(emitted[metrics.DopplerUDPSentMessages].GetCounterEvent().GetDelta()).To(BeEquivalentTo(0))
+	})
+
+	It("emits nothing before anything was counted", func() {
+		Consistently(envelopeChan, 300*time.Millisecond).ShouldNot(Receive())
+	})
+})
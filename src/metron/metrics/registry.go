@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The names of the metrics metron reports about itself. They are emitted
+// with the MetronAgent origin, counters as CounterEvents and gauges as
+// ValueMetrics, and must not change, as dashboards and alerts refer to them.
+const (
+	// DropsondeReceivedEnvelopes counts the datagrams received on the
+	// dropsonde port, each holding one envelope.
+	DropsondeReceivedEnvelopes = "dropsondeListener.receivedEnvelopes"
+	// LegacyReceivedEnvelopes counts the messages received on the legacy
+	// port.
+	LegacyReceivedEnvelopes = "legacyListener.receivedEnvelopes"
+	// StatsdEmittedEnvelopes counts the envelopes the statsd listener
+	// emitted for the lines it received, including its periodic flushes.
+	StatsdEmittedEnvelopes = "statsdListener.emittedEnvelopes"
+
+	// DopplerUDPSentMessages, DopplerTCPSentMessages, DopplerTLSSentMessages
+	// and DopplerWebsocketSentMessages count the messages sent to doppler
+	// over each transport. A message is a single envelope or a batch of
+	// envelopes.
+	DopplerUDPSentMessages       = "dopplerForwarder.udpSentMessages"
+	DopplerTCPSentMessages       = "dopplerForwarder.tcpSentMessages"
+	DopplerTLSSentMessages       = "dopplerForwarder.tlsSentMessages"
+	DopplerWebsocketSentMessages = "dopplerForwarder.websocketSentMessages"
+	// DopplerSendErrors counts the failed attempts to send a message to
+	// doppler over any transport, including those followed by a fallback to
+	// the next transport or a retry.
+	DopplerSendErrors = "dopplerForwarder.sendErrors"
+	// DopplerSendRetries counts the retries of messages that could not be
+	// sent to a doppler over a stream transport.
+	DopplerSendRetries = "dopplerForwarder.sendRetries"
+	// DopplerCompressionBytesIn and DopplerCompressionBytesOut count the
+	// bytes of the messages sent to doppler in compressed frames, before and
+	// after compression. DopplerCompressionRatio is the gauge of the former
+	// over the latter.
+	DopplerCompressionBytesIn  = "dopplerForwarder.compressionBytesIn"
+	DopplerCompressionBytesOut = "dopplerForwarder.compressionBytesOut"
+	DopplerCompressionRatio    = "dopplerForwarder.compressionRatio"
+	// DopplerEgressBytes counts the bytes written to doppler over every
+	// transport, after batching and compression, including the frame headers
+	// of the stream transports and the messages written again on a retry.
+	// The bytes written to each doppler are also counted under the name
+	// ForDestination returns, except over UDP with the loggregatorlib client
+	// pool.
+	DopplerEgressBytes = "dopplerForwarder.egressBytes"
+	// DopplerUDPSendErrors counts the errors writing datagrams to doppler,
+	// under the name followed by the class of the error, such as
+	// dopplerForwarder.udpSendErrors.messageTooLong: messageTooLong,
+	// connectionRefused, noBufferSpace or unknown.
+	DopplerUDPSendErrors = "dopplerForwarder.udpSendErrors"
+	// DopplerRetryBufferedMessages is the gauge of messages waiting in the
+	// forwarder's retry buffer.
+	DopplerRetryBufferedMessages = "dopplerForwarder.retryBufferedMessages"
+	// DopplerAbandonedEnvelopes counts the envelopes left in the forwarder's
+	// retry buffer that could not be sent before metron shut down.
+	DopplerAbandonedEnvelopes = "dopplerForwarder.abandonedEnvelopes"
+	// DopplerRegistryStalenessSeconds is the gauge of seconds since the
+	// doppler addresses were last read from etcd, while it cannot be reached,
+	// and zero otherwise.
+	DopplerRegistryStalenessSeconds = "dopplerRegistry.stalenessSeconds"
+	// DopplerZoneFallbacks counts the times metron fell back to the dopplers
+	// in other zones, and DopplerZoneReturns the times it returned to the
+	// dopplers in its own zone.
+	DopplerZoneFallbacks = "dopplerRegistry.zoneFallbacks"
+	DopplerZoneReturns   = "dopplerRegistry.zoneReturns"
+	// DopplerEjections counts the times a doppler was ejected as the sends
+	// to it kept failing, and DopplerRestorations the times an ejected
+	// doppler was restored.
+	DopplerEjections    = "dopplerRegistry.ejections"
+	DopplerRestorations = "dopplerRegistry.restorations"
+)
+
+// InGroup returns the name of the metric name for the group of dopplers
+// group, such as dopplerForwarder.<group>.udpSentMessages. Without a group
+// name is returned unchanged.
+func InGroup(name string, group string) string {
+	if group == "" {
+		return name
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) < 2 {
+		return group + "." + name
+	}
+	return parts[0] + "." + group + "." + parts[1]
+}
+
+// ForDestination returns the name under which the metric name is counted for
+// the doppler at address alone, such as dopplerForwarder.egressBytes.10.0.0.1.
+// Envelopes carry no tags, so the address is part of the name.
+func ForDestination(name string, address string) string {
+	return name + "." + address
+}
+
+// Registry holds the counters and gauges metron reports about itself. The
+// components of metron update it as they go, and an Emitter turns it into
+// envelopes periodically.
+//
+// A nil Registry ignores all updates, so that the components work on their
+// own as well.
+type Registry struct {
+	lock     sync.Mutex
+	counters map[string]uint64
+	gauges   map[string]float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+// Increment adds one to the counter name.
+func (r *Registry) Increment(name string) {
+	r.Add(name, 1)
+}
+
+// Add adds delta to the counter name.
+func (r *Registry) Add(name string, delta uint64) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.counters[name] += delta
+}
+
+// SetGauge sets the gauge name to value.
+func (r *Registry) SetGauge(name string, value float64) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.gauges[name] = value
+}
+
+// Counter returns the total of the counter name.
+func (r *Registry) Counter(name string) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.counters[name]
+}
+
+// Gauge returns the value of the gauge name.
+func (r *Registry) Gauge(name string) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.gauges[name]
+}
+
+type counterValue struct {
+	name  string
+	total uint64
+}
+
+type gaugeValue struct {
+	name  string
+	value float64
+}
+
+// snapshot returns the counters and gauges sorted by name.
+func (r *Registry) snapshot() ([]counterValue, []gaugeValue) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	counters := make([]counterValue, 0, len(r.counters))
+	for name, total := range r.counters {
+		counters = append(counters, counterValue{name: name, total: total})
+	}
+	sort.Sort(byCounterName(counters))
+
+	gauges := make([]gaugeValue, 0, len(r.gauges))
+	for name, value := range r.gauges {
+		gauges = append(gauges, gaugeValue{name: name, value: value})
+	}
+	sort.Sort(byGaugeName(gauges))
+
+	return counters, gauges
+}
+
+type byCounterName []counterValue
+
+func (c byCounterName) Len() int           { return len(c) }
+func (c byCounterName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byCounterName) Less(i, j int) bool { return c[i].name < c[j].name }
+
+type byGaugeName []gaugeValue
+
+func (g byGaugeName) Len() int           { return len(g) }
+func (g byGaugeName) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g byGaugeName) Less(i, j int) bool { return g[i].name < g[j].name }
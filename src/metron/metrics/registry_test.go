@@ -0,0 +1,35 @@
+package metrics_test
+
+import (
+	"metron/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	It("keeps the totals of counters and the values of gauges", func() {
+		registry := metrics.NewRegistry()
+		registry.Increment(metrics.DropsondeReceivedEnvelopes)
+		registry.Increment(metrics.DropsondeReceivedEnvelopes)
+		registry.Add(metrics.DopplerUDPSentMessages, 5)
+		registry.SetGauge(metrics.DopplerRetryBufferedMessages, 3)
+		registry.SetGauge(metrics.DopplerRetryBufferedMessages, 2)
+
+		Expect(registry.Counter(metrics.DropsondeReceivedEnvelopes)).To(BeEquivalentTo(2))
+		Expect(registry.Counter(metrics.DopplerUDPSentMessages)).To(BeEquivalentTo(5))
+		Expect(registry.Counter(metrics.DopplerSendErrors)).To(BeEquivalentTo(0))
+		Expect(registry.Gauge(metrics.DopplerRetryBufferedMessages)).To(Equal(2.0))
+	})
+
+	It("ignores updates without a registry", func() {
+		var registry *metrics.Registry
+		registry.Increment(metrics.DropsondeReceivedEnvelopes)
+		registry.SetGauge(metrics.DopplerRetryBufferedMessages, 3)
+	})
+
+	It("names the metrics of a group of dopplers after the group", func() {
+		Expect(metrics.InGroup(metrics.DopplerSendErrors, "new")).To(Equal("dopplerForwarder.new.sendErrors"))
+		Expect(metrics.InGroup(metrics.DopplerSendErrors, "")).To(Equal(metrics.DopplerSendErrors))
+	})
+})
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// RuntimeStats sends metron's Go runtime statistics every interval as
+// ValueMetrics, into the same stream as the envelopes metron forwards. It
+// reads the statistics the runtime keeps anyway and never forces a garbage
+// collection.
+type RuntimeStats struct {
+	interval  time.Duration
+	startedAt time.Time
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func NewRuntimeStats(interval time.Duration) *RuntimeStats {
+	return &RuntimeStats{
+		interval:  interval,
+		startedAt: time.Now(),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// Run emits on outputChan every interval until Stop is called.
+func (r *RuntimeStats) Run(outputChan chan<- *events.Envelope) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, envelope := range r.envelopes(time.Now()) {
+				select {
+				case outputChan <- envelope:
+				case <-r.stopChan:
+					return
+				}
+			}
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+func (r *RuntimeStats) Stop() {
+	r.stopOnce.Do(func() { close(r.stopChan) })
+}
+
+func (r *RuntimeStats) envelopes(now time.Time) []*events.Envelope {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	var lastGCPause uint64
+	if memStats.NumGC > 0 {
+		lastGCPause = memStats.PauseNs[(memStats.NumGC+255)%256]
+	}
+
+	stats := []struct {
+		name  string
+		value float64
+		unit  string
+	}{
+		{"numGoRoutines", float64(runtime.NumGoroutine()), "count"},
+		{"uptimeSeconds", now.Sub(r.startedAt).Seconds(), "s"},
+		{"memoryStats.numBytesAllocatedHeap", float64(memStats.HeapAlloc), "bytes"},
+		{"memoryStats.numBytesAllocatedStack", float64(memStats.StackInuse), "bytes"},
+		{"memoryStats.numBytesAllocated", float64(memStats.Alloc), "bytes"},
+		{"memoryStats.numMallocs", float64(memStats.Mallocs), "count"},
+		{"memoryStats.numFrees", float64(memStats.Frees), "count"},
+		{"memoryStats.numGCs", float64(memStats.NumGC), "count"},
+		{"memoryStats.lastGCPauseTimeNS", float64(lastGCPause), "ns"},
+		{"memoryStats.totalGCPauseTimeNS", float64(memStats.PauseTotalNs), "ns"},
+	}
+
+	envelopes := make([]*events.Envelope, 0, len(stats))
+	for _, stat := range stats {
+		envelopes = append(envelopes, &events.Envelope{
+			Origin:    proto.String(Origin),
+			Timestamp: proto.Int64(now.UnixNano()),
+			EventType: events.Envelope_ValueMetric.Enum(),
+
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(stat.name),
+				Value: proto.Float64(stat.value),
+				Unit:  proto.String(stat.unit),
+			},
+		})
+	}
+	return envelopes
+}
@@ -0,0 +1,94 @@
+package metrics_test
+
+import (
+	"metron/metrics"
+	"runtime"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RuntimeStats", func() {
+	var (
+		runtimeStats *metrics.RuntimeStats
+		envelopeChan chan *events.Envelope
+	)
+
+	// receive collects the next emit, keyed by metric name
+	receive := func() map[string]*events.ValueMetric {
+		emitted := make(map[string]*events.ValueMetric)
+		for len(emitted) < 10 {
+			var envelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&envelope))
+			Expect(envelope.GetOrigin()).To(Equal("MetronAgent"))
+			Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+			emitted[envelope.GetValueMetric().GetName()] = envelope.GetValueMetric()
+		}
+		return emitted
+	}
+
+	BeforeEach(func() {
+		runtimeStats = metrics.NewRuntimeStats(50 * time.Millisecond)
+		envelopeChan = make(chan *events.Envelope, 100)
+		go runtimeStats.Run(envelopeChan)
+	})
+
+	AfterEach(func() {
+		runtimeStats.Stop()
+	})
+
+	It("emits the runtime statistics with plausible values", func() {
+		runtime.GC()
+
+		emitted := receive()
+		Expect(emitted).To(HaveLen(10))
+
+		Expect(emitted["numGoRoutines"].GetValue()).To(BeNumerically(">", 1))
+		Expect(emitted["numGoRoutines"].GetUnit()).To(Equal("count"))
+		Expect(emitted["uptimeSeconds"].GetValue()).To(BeNumerically("~", 0.05, 1))
+		Expect(emitted["uptimeSeconds"].GetUnit()).To(Equal("s"))
+
+		for _, name := range []string{"memoryStats.numBytesAllocatedHeap", "memoryStats.numBytesAllocatedStack", "memoryStats.numBytesAllocated"} {
+			Expect(emitted[name].GetValue()).To(BeNumerically(">", 0), name)
+			Expect(emitted[name].GetValue()).To(BeNumerically("<", 1<<30), name)
+			Expect(emitted[name].GetUnit()).To(Equal("bytes"), name)
+		}
+		Expect(emitted["memoryStats.numMallocs"].GetValue()).To(BeNumerically(">=", emitted["memoryStats.numFrees"].GetValue()))
+		Expect(emitted["memoryStats.numGCs"].GetValue()).To(BeNumerically(">=", 1))
+		Expect(emitted["memoryStats.lastGCPauseTimeNS"].GetValue()).To(BeNumerically(">", 0))
+		Expect(emitted["memoryStats.totalGCPauseTimeNS"].GetValue()).To(BeNumerically(">=", emitted["memoryStats.lastGCPauseTimeNS"].GetValue()))
+		Expect(emitted["memoryStats.totalGCPauseTimeNS"].GetUnit()).To(Equal("ns"))
+	})
+
+	It("does not force a garbage collection", func() {
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		emitted := receive()
+		Expect(emitted["memoryStats.numGCs"].GetValue()).To(BeNumerically("~", before.NumGC, 2))
+	})
+
+	It("keeps emitting every interval", func() {
+		first := receive()
+		second := receive()
+
+		Expect(second["uptimeSeconds"].GetValue()).To(BeNumerically(">", first["uptimeSeconds"].GetValue()))
+	})
+
+	It("stops emitting when stopped", func() {
+		receive()
+		runtimeStats.Stop()
+
+		Eventually(func() int {
+			pending := len(envelopeChan)
+			for len(envelopeChan) > 0 {
+				<-envelopeChan
+			}
+			return pending
+		}).Should(BeZero())
+		Consistently(envelopeChan, 200*time.Millisecond).ShouldNot(Receive())
+	})
+})
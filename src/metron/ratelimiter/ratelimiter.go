@@ -0,0 +1,218 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// WarnInterval is how often the limiter at most warns about each origin whose
+// envelopes it drops.
+var WarnInterval = time.Minute
+
+// OriginLimit overrides the default rate for the envelopes of Origin. A zero
+// Rate does not limit the origin.
+type OriginLimit struct {
+	Origin string
+	Rate   float64
+}
+
+// ValidateOriginLimits checks that every limit for SetOriginLimits has an
+// origin and a rate that is not negative.
+func ValidateOriginLimits(limits []OriginLimit) error {
+	for _, limit := range limits {
+		if limit.Origin == "" || limit.Rate < 0 {
+			return fmt.Errorf("Rate limit %+v must have an origin and a rate of at least 0", limit)
+		}
+	}
+	return nil
+}
+
+// Clock tells the time. A RateLimiter uses the wall clock unless SetClock
+// replaces it.
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type originDrops struct {
+	dropped       uint64
+	droppedAtWarn uint64
+	warnedAt      time.Time
+}
+
+// RateLimiter limits the envelopes each origin may send through metron per
+// second with a token bucket per origin, so that a single misbehaving emitter
+// cannot overwhelm the pipeline. A bucket holds up to a second's worth of
+// envelopes, and at least one, so an origin may burst up to its rate.
+// Envelopes over the limit are dropped and counted per origin.
+type RateLimiter struct {
+	lock sync.Mutex
+
+	defaultRate      float64
+	originRates      map[string]float64
+	limitLogMessages bool
+	clock            Clock
+	logger           *gosteno.Logger
+
+	buckets map[string]*bucket
+	drops   map[string]*originDrops
+}
+
+// New returns a limiter that lets defaultRate envelopes per second of every
+// origin through. A zero defaultRate limits only the origins given a rate by
+// SetOriginLimits.
+func New(defaultRate float64, logger *gosteno.Logger) *RateLimiter {
+	return &RateLimiter{
+		defaultRate: defaultRate,
+		originRates: make(map[string]float64),
+		clock:       wallClock{},
+		logger:      logger,
+		buckets:     make(map[string]*bucket),
+		drops:       make(map[string]*originDrops),
+	}
+}
+
+// SetOriginLimits replaces the default rate for the origins of limits.
+func (r *RateLimiter) SetOriginLimits(limits []OriginLimit) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.originRates = make(map[string]float64)
+	for _, limit := range limits {
+		r.originRates[limit.Origin] = limit.Rate
+	}
+}
+
+// SetLimitLogMessages makes the limiter count LogMessages against the rate of
+// their origin as well. By default they are let through, as doppler already
+// limits the logs of apps.
+func (r *RateLimiter) SetLimitLogMessages(limit bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.limitLogMessages = limit
+}
+
+// SetClock replaces the clock the buckets are refilled by. It must be called
+// before Run.
+func (r *RateLimiter) SetClock(clock Clock) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.clock = clock
+}
+
+// Run passes on the envelopes read from inputChan that are within the rate of
+// their origin until inputChan is closed.
+func (r *RateLimiter) Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope) {
+	for envelope := range inputChan {
+		if !r.allow(envelope) {
+			continue
+		}
+		outputChan <- envelope
+	}
+}
+
+func (r *RateLimiter) allow(envelope *events.Envelope) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if envelope.GetEventType() == events.Envelope_LogMessage && !r.limitLogMessages {
+		return true
+	}
+
+	origin := envelope.GetOrigin()
+	rate, ok := r.originRates[origin]
+	if !ok {
+		rate = r.defaultRate
+	}
+	if rate <= 0 {
+		return true
+	}
+
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := r.clock.Now()
+	b, ok := r.buckets[origin]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		r.buckets[origin] = b
+	}
+	b.tokens += rate * now.Sub(b.updated).Seconds()
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	r.drop(origin, rate, now)
+	return false
+}
+
+// drop must be called with the lock held.
+func (r *RateLimiter) drop(origin string, rate float64, now time.Time) {
+	d, ok := r.drops[origin]
+	if !ok {
+		d = &originDrops{}
+		r.drops[origin] = d
+	}
+	d.dropped++
+
+	if !d.warnedAt.IsZero() && now.Sub(d.warnedAt) < WarnInterval {
+		return
+	}
+	r.logger.Warnf("RateLimiter: Dropping envelopes of origin %s over its limit of %g per second, %d dropped since the last warning", origin, rate, d.dropped-d.droppedAtWarn)
+	d.droppedAtWarn = d.dropped
+	d.warnedAt = now
+}
+
+func (r *RateLimiter) metrics() []instrumentation.Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	origins := make([]string, 0, len(r.drops))
+	for origin := range r.drops {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	metrics := make([]instrumentation.Metric, 0, len(origins))
+	for _, origin := range origins {
+		metrics = append(metrics, instrumentation.Metric{
+			Name:  "droppedEnvelopes",
+			Value: r.drops[origin].dropped,
+			Tags:  map[string]interface{}{"origin": origin},
+		})
+	}
+	return metrics
+}
+
+func (r *RateLimiter) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name:    "RateLimiter",
+		Metrics: r.metrics(),
+	}
+}
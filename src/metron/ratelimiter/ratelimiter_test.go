@@ -0,0 +1,210 @@
+package ratelimiter_test
+
+import (
+	"metron/ratelimiter"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var _ = Describe("RateLimiter", func() {
+	var (
+		limiter    *ratelimiter.RateLimiter
+		clock      *fakeClock
+		inputChan  chan *events.Envelope
+		outputChan chan *events.Envelope
+	)
+
+	run := func(defaultRate float64, configure func()) {
+		loggertesthelper.TestLoggerSink.Clear()
+		limiter = ratelimiter.New(defaultRate, loggertesthelper.Logger())
+		clock = &fakeClock{now: time.Unix(1000, 0)}
+		limiter.SetClock(clock)
+		configure()
+
+		inputChan = make(chan *events.Envelope)
+		outputChan = make(chan *events.Envelope, 100)
+		go limiter.Run(inputChan, outputChan)
+	}
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	// passed sends count envelopes of origin and eventType and returns how
+	// many of them were passed on.
+	passed := func(origin string, eventType events.Envelope_EventType, count int) int {
+		for i := 0; i < count; i++ {
+			inputChan <- envelope(origin, eventType)
+		}
+		// an unlimited envelope marks the end of the ones sent
+		inputChan <- envelope("marker", events.Envelope_LogMessage)
+
+		passedOn := 0
+		for {
+			var e *events.Envelope
+			Eventually(outputChan).Should(Receive(&e))
+			if e.GetOrigin() == "marker" {
+				return passedOn
+			}
+			passedOn++
+		}
+	}
+
+	droppedMetrics := func() []instrumentation.Metric {
+		context := limiter.Emit()
+		Expect(context.Name).To(Equal("RateLimiter"))
+		return context.Metrics
+	}
+
+	It("lets an origin burst up to its rate and drops the rest", func() {
+		run(10, func() {})
+
+		Expect(passed("noisy", events.Envelope_ValueMetric, 25)).To(Equal(10))
+	})
+
+	It("refills the bucket of an origin at its rate", func() {
+		run(10, func() {})
+
+		Expect(passed("noisy", events.Envelope_ValueMetric, 25)).To(Equal(10))
+		clock.advance(500 * time.Millisecond)
+		Expect(passed("noisy", events.Envelope_ValueMetric, 25)).To(Equal(5))
+		clock.advance(time.Minute)
+		Expect(passed("noisy", events.Envelope_ValueMetric, 25)).To(Equal(10))
+	})
+
+	It("limits every origin on its own", func() {
+		run(10, func() {})
+
+		Expect(passed("noisy", events.Envelope_ValueMetric, 25)).To(Equal(10))
+		Expect(passed("quiet", events.Envelope_ValueMetric, 5)).To(Equal(5))
+	})
+
+	It("counts the dropped envelopes per origin", func() {
+		run(10, func() {})
+
+		passed("noisy", events.Envelope_ValueMetric, 25)
+		passed("noisier", events.Envelope_CounterEvent, 40)
+		passed("quiet", events.Envelope_ValueMetric, 5)
+
+		Expect(droppedMetrics()).To(Equal([]instrumentation.Metric{
+			{Name: "droppedEnvelopes", Value: uint64(30), Tags: map[string]interface{}{"origin": "noisier"}},
+			{Name: "droppedEnvelopes", Value: uint64(15), Tags: map[string]interface{}{"origin": "noisy"}},
+		}))
+	})
+
+	It("warns about the origins it drops envelopes of at most once per interval", func() {
+		run(10, func() {})
+
+		passed("noisy", events.Envelope_ValueMetric, 25)
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Dropping envelopes of origin noisy over its limit of 10 per second"))
+
+		loggertesthelper.TestLoggerSink.Clear()
+		passed("noisy", events.Envelope_ValueMetric, 25)
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).NotTo(ContainSubstring("noisy"))
+
+		clock.advance(ratelimiter.WarnInterval)
+		passed("noisy", events.Envelope_ValueMetric, 25)
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Dropping envelopes of origin noisy"))
+	})
+
+	Context("with origin limits", func() {
+		It("limits the origins at their own rate", func() {
+			run(10, func() {
+				limiter.SetOriginLimits([]ratelimiter.OriginLimit{{Origin: "busy", Rate: 20}})
+			})
+
+			Expect(passed("busy", events.Envelope_ValueMetric, 25)).To(Equal(20))
+			Expect(passed("other", events.Envelope_ValueMetric, 25)).To(Equal(10))
+		})
+
+		It("does not limit origins with a zero rate", func() {
+			run(10, func() {
+				limiter.SetOriginLimits([]ratelimiter.OriginLimit{{Origin: "trusted", Rate: 0}})
+			})
+
+			Expect(passed("trusted", events.Envelope_ValueMetric, 50)).To(Equal(50))
+		})
+
+		It("limits only the origins given a rate without a default rate", func() {
+			run(0, func() {
+				limiter.SetOriginLimits([]ratelimiter.OriginLimit{{Origin: "noisy", Rate: 10}})
+			})
+
+			Expect(passed("noisy", events.Envelope_ValueMetric, 25)).To(Equal(10))
+			Expect(passed("other", events.Envelope_ValueMetric, 25)).To(Equal(25))
+		})
+
+		It("lets at least one envelope through for rates below one per second", func() {
+			run(0, func() {
+				limiter.SetOriginLimits([]ratelimiter.OriginLimit{{Origin: "slow", Rate: 0.5}})
+			})
+
+			Expect(passed("slow", events.Envelope_ValueMetric, 5)).To(Equal(1))
+			clock.advance(time.Second)
+			Expect(passed("slow", events.Envelope_ValueMetric, 5)).To(Equal(0))
+			clock.advance(time.Second)
+			Expect(passed("slow", events.Envelope_ValueMetric, 5)).To(Equal(1))
+		})
+	})
+
+	Context("with LogMessages", func() {
+		It("does not limit them by default", func() {
+			run(10, func() {})
+
+			Expect(passed("app", events.Envelope_LogMessage, 25)).To(Equal(25))
+			Expect(droppedMetrics()).To(BeEmpty())
+		})
+
+		It("limits them once configured to", func() {
+			run(10, func() { limiter.SetLimitLogMessages(true) })
+
+			Expect(passed("app", events.Envelope_LogMessage, 25)).To(Equal(10))
+		})
+	})
+})
+
+var _ = Describe("ValidateOriginLimits", func() {
+	It("accepts limits with an origin and a rate of at least 0", func() {
+		Expect(ratelimiter.ValidateOriginLimits([]ratelimiter.OriginLimit{{Origin: "a", Rate: 0}, {Origin: "b", Rate: 2.5}})).To(Succeed())
+	})
+
+	It("rejects limits without an origin", func() {
+		Expect(ratelimiter.ValidateOriginLimits([]ratelimiter.OriginLimit{{Rate: 1}})).NotTo(Succeed())
+	})
+
+	It("rejects negative rates", func() {
+		Expect(ratelimiter.ValidateOriginLimits([]ratelimiter.OriginLimit{{Origin: "a", Rate: -1}})).NotTo(Succeed())
+	})
+})
+
+func envelope(origin string, eventType events.Envelope_EventType) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(origin),
+		EventType: eventType.Enum(),
+	}
+}
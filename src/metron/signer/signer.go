@@ -0,0 +1,38 @@
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"metron/bufferpool"
+)
+
+// Signer prefixes messages with their HMAC-SHA256 signature, the way
+// signature.SignMessage does, writing the signed message into a buffer from
+// its pool and returning the unsigned message to the pool.
+type Signer struct {
+	sharedSecret []byte
+	pool         *bufferpool.Pool
+}
+
+func New(sharedSecret string, pool *bufferpool.Pool) *Signer {
+	return &Signer{
+		sharedSecret: []byte(sharedSecret),
+		pool:         pool,
+	}
+}
+
+// Run signs the messages read from inputChan until it is closed, then closes
+// outputChan.
+func (s *Signer) Run(inputChan <-chan []byte, outputChan chan<- []byte) {
+	mac := hmac.New(sha256.New, s.sharedSecret)
+	for message := range inputChan {
+		mac.Reset()
+		mac.Write(message)
+		signedMessage := mac.Sum(s.pool.Get())
+		signedMessage = append(signedMessage, message...)
+		s.pool.Put(message)
+
+		outputChan <- signedMessage
+	}
+	close(outputChan)
+}
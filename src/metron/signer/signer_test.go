@@ -0,0 +1,53 @@
+package signer_test
+
+import (
+	"metron/bufferpool"
+	"metron/signer"
+
+	"github.com/cloudfoundry/dropsonde/signature"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signer", func() {
+	var (
+		inputChan  chan []byte
+		outputChan chan []byte
+	)
+
+	BeforeEach(func() {
+		inputChan = make(chan []byte, 10)
+		outputChan = make(chan []byte, 10)
+		go signer.New("secret", bufferpool.New()).Run(inputChan, outputChan)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	It("signs messages the way dropsonde does", func() {
+		inputChan <- []byte("first message")
+		inputChan <- []byte("second message")
+
+		Eventually(outputChan).Should(Receive(Equal(signature.SignMessage([]byte("first message"), []byte("secret")))))
+		Eventually(outputChan).Should(Receive(Equal(signature.SignMessage([]byte("second message"), []byte("secret")))))
+	})
+
+	It("signs messages doppler can verify", func() {
+		verifiedChan := make(chan []byte, 1)
+		go signature.NewSignatureVerifier(loggertesthelper.Logger(), "secret").Run(outputChan, verifiedChan)
+
+		inputChan <- []byte("message")
+		Eventually(verifiedChan).Should(Receive(Equal([]byte("message"))))
+	})
+
+	It("closes the output channel once the input channel is closed", func() {
+		input, output := make(chan []byte), make(chan []byte)
+		go signer.New("secret", nil).Run(input, output)
+
+		close(input)
+		Eventually(output).Should(BeClosed())
+	})
+})
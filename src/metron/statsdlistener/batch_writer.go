@@ -0,0 +1,69 @@
+package statsdlistener
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+)
+
+// BatchWriter passes the envelopes a listener emits on in batches, so that a
+// consumer writing them out can do so once per batch rather than once per
+// envelope. A batch is flushed once it holds maxSize envelopes or once
+// maxDelay has passed since its first envelope, whichever comes first.
+type BatchWriter struct {
+	maxSize  int
+	maxDelay time.Duration
+	clock    Clock
+	logger   *gosteno.Logger
+}
+
+// NewBatchWriter returns a writer of batches of up to maxSize envelopes that
+// wait at most maxDelay. maxSize must be positive.
+func NewBatchWriter(maxSize int, maxDelay time.Duration, logger *gosteno.Logger) *BatchWriter {
+	return &BatchWriter{
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		clock:    wallClock{},
+		logger:   logger,
+	}
+}
+
+// SetClock replaces the clock the writer waits on for maxDelay. It must be
+// called before Run.
+func (w *BatchWriter) SetClock(clock Clock) {
+	w.clock = clock
+}
+
+// Run batches the envelopes read from inputChan and emits the batches on
+// outputChan until inputChan is closed. The batch pending then is flushed
+// before Run returns.
+func (w *BatchWriter) Run(inputChan <-chan *events.Envelope, outputChan chan<- []*events.Envelope) {
+	var batch []*events.Envelope
+	var deadline <-chan time.Time
+	for {
+		select {
+		case envelope, ok := <-inputChan:
+			if !ok {
+				if len(batch) > 0 {
+					outputChan <- batch
+				}
+				return
+			}
+
+			if len(batch) == 0 {
+				deadline = w.clock.After(w.maxDelay)
+			}
+			batch = append(batch, envelope)
+			if len(batch) < w.maxSize {
+				continue
+			}
+			w.logger.Debugf("BatchWriter: Flushing a full batch of %d envelopes", len(batch))
+		case <-deadline:
+			w.logger.Debugf("BatchWriter: Flushing a batch of %d envelopes after %s", len(batch), w.maxDelay)
+		}
+
+		outputChan <- batch
+		batch, deadline = nil, nil
+	}
+}
@@ -0,0 +1,172 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// steppedClock only advances when told to, firing the waits that are due.
+type steppedClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	pending []steppedWait
+}
+
+type steppedWait struct {
+	due   time.Time
+	fired chan time.Time
+}
+
+func (c *steppedClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *steppedClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fired := make(chan time.Time, 1)
+	c.pending = append(c.pending, steppedWait{due: c.now.Add(d), fired: fired})
+	return fired
+}
+
+func (c *steppedClock) Waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.pending)
+}
+
+func (c *steppedClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	var pending []steppedWait
+	for _, wait := range c.pending {
+		if wait.due.After(c.now) {
+			pending = append(pending, wait)
+			continue
+		}
+		wait.fired <- c.now
+	}
+	c.pending = pending
+}
+
+var _ = Describe("BatchWriter", func() {
+	const maxDelay = time.Second
+
+	var (
+		clock      *steppedClock
+		inputChan  chan *events.Envelope
+		outputChan chan []*events.Envelope
+		done       chan struct{}
+		closed     bool
+	)
+
+	envelope := func(index int) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("origin"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Timestamp: proto.Int64(int64(index)),
+		}
+	}
+
+	timestamps := func(batch []*events.Envelope) []int64 {
+		var timestamps []int64
+		for _, envelope := range batch {
+			timestamps = append(timestamps, envelope.GetTimestamp())
+		}
+		return timestamps
+	}
+
+	BeforeEach(func() {
+		clock = &steppedClock{now: time.Unix(1444990000, 0)}
+		writer := statsdlistener.NewBatchWriter(3, maxDelay, loggertesthelper.Logger())
+		writer.SetClock(clock)
+
+		inputChan = make(chan *events.Envelope)
+		outputChan = make(chan []*events.Envelope, 10)
+		done = make(chan struct{})
+		closed = false
+		go func() {
+			writer.Run(inputChan, outputChan)
+			close(done)
+		}()
+	})
+
+	AfterEach(func() {
+		if !closed {
+			close(inputChan)
+		}
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("flushes a batch once it holds the maximum number of envelopes", func() {
+		for i := 0; i < 7; i++ {
+			inputChan <- envelope(i)
+		}
+
+		var batch []*events.Envelope
+		Eventually(outputChan).Should(Receive(&batch))
+		Expect(timestamps(batch)).To(Equal([]int64{0, 1, 2}))
+		Eventually(outputChan).Should(Receive(&batch))
+		Expect(timestamps(batch)).To(Equal([]int64{3, 4, 5}))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("flushes a batch once the maximum delay has passed since its first envelope", func() {
+		inputChan <- envelope(0)
+		Eventually(clock.Waiting).Should(Equal(1))
+		clock.Advance(maxDelay / 2)
+		inputChan <- envelope(1)
+		Consistently(outputChan).ShouldNot(Receive())
+
+		clock.Advance(maxDelay / 2)
+		var batch []*events.Envelope
+		Eventually(outputChan).Should(Receive(&batch))
+		Expect(timestamps(batch)).To(Equal([]int64{0, 1}))
+
+		inputChan <- envelope(2)
+		Eventually(clock.Waiting).Should(Equal(1))
+		clock.Advance(maxDelay)
+		Eventually(outputChan).Should(Receive(&batch))
+		Expect(timestamps(batch)).To(Equal([]int64{2}))
+	})
+
+	It("does not flush a batch flushed for its size again at its delay", func() {
+		for i := 0; i < 4; i++ {
+			inputChan <- envelope(i)
+		}
+		Eventually(outputChan).Should(Receive())
+		Eventually(clock.Waiting).Should(Equal(2))
+
+		clock.Advance(maxDelay)
+		var batch []*events.Envelope
+		Eventually(outputChan).Should(Receive(&batch))
+		Expect(timestamps(batch)).To(Equal([]int64{3}))
+		Consistently(outputChan).ShouldNot(Receive())
+	})
+
+	It("flushes the pending batch when the input is closed", func() {
+		inputChan <- envelope(0)
+		close(inputChan)
+		closed = true
+		Eventually(done).Should(BeClosed())
+
+		var batch []*events.Envelope
+		Eventually(outputChan).Should(Receive(&batch))
+		Expect(timestamps(batch)).To(Equal([]int64{0}))
+	})
+})
@@ -0,0 +1,281 @@
+package statsdlistener
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+)
+
+// CaptureRecord is a raw statsd packet as it was received.
+type CaptureRecord struct {
+	ReceivedAt time.Time
+	Sender     string
+	Packet     []byte
+}
+
+// A capture is a sequence of records, each made up of
+//
+//	8 bytes  receive time in nanoseconds since the epoch
+//	2 bytes  length of the sender address
+//	n bytes  sender address, e.g. 127.0.0.1:51234
+//	4 bytes  length of the packet
+//	m bytes  packet
+//
+// with all integers big endian.
+const captureHeaderSize = 8 + 2 + 4
+
+func (record CaptureRecord) encode() []byte {
+	encoded := make([]byte, 0, captureHeaderSize+len(record.Sender)+len(record.Packet))
+
+	var buffer [8]byte
+	binary.BigEndian.PutUint64(buffer[:], uint64(record.ReceivedAt.UnixNano()))
+	encoded = append(encoded, buffer[:]...)
+	binary.BigEndian.PutUint16(buffer[:2], uint16(len(record.Sender)))
+	encoded = append(encoded, buffer[:2]...)
+	encoded = append(encoded, record.Sender...)
+	binary.BigEndian.PutUint32(buffer[:4], uint32(len(record.Packet)))
+	encoded = append(encoded, buffer[:4]...)
+	return append(encoded, record.Packet...)
+}
+
+// ReadCaptureRecord reads the next record of a capture. It returns io.EOF
+// at the end of the capture and io.ErrUnexpectedEOF for a truncated record.
+func ReadCaptureRecord(reader io.Reader) (CaptureRecord, error) {
+	var header [8 + 2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return CaptureRecord{}, err
+	}
+	receivedAt := int64(binary.BigEndian.Uint64(header[:8]))
+
+	sender := make([]byte, binary.BigEndian.Uint16(header[8:]))
+	if _, err := io.ReadFull(reader, sender); err != nil {
+		return CaptureRecord{}, unexpectedEOF(err)
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return CaptureRecord{}, unexpectedEOF(err)
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(reader, packet); err != nil {
+		return CaptureRecord{}, unexpectedEOF(err)
+	}
+
+	return CaptureRecord{
+		ReceivedAt: time.Unix(0, receivedAt),
+		Sender:     string(sender),
+		Packet:     packet,
+	}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// CaptureWriter appends records to a capture file. Once the file would grow
+// beyond maxFileBytes it is rotated: it is renamed to path.1, path.1 to
+// path.2 and so on, keeping at most maxFiles rotated files, and a new file is
+// started. A record larger than maxFileBytes is written to a file of its own.
+type CaptureWriter struct {
+	path         string
+	maxFileBytes int64
+	maxFiles     int
+
+	lock     sync.Mutex
+	file     *os.File
+	fileSize int64
+}
+
+func NewCaptureWriter(path string, maxFileBytes int64, maxFiles int) (*CaptureWriter, error) {
+	w := &CaptureWriter{
+		path:         path,
+		maxFileBytes: maxFileBytes,
+		maxFiles:     maxFiles,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *CaptureWriter) Write(record CaptureRecord) error {
+	encoded := record.encode()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return fmt.Errorf("Capture file %s is closed", w.path)
+	}
+
+	if w.fileSize > 0 && w.fileSize+int64(len(encoded)) > w.maxFileBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	written, err := w.file.Write(encoded)
+	w.fileSize += int64(written)
+	return err
+}
+
+func (w *CaptureWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// open must be called with the lock held, or before the writer is shared.
+func (w *CaptureWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.fileSize = info.Size()
+	return nil
+}
+
+// rotate must be called with the lock held.
+func (w *CaptureWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	if w.maxFiles > 0 {
+		for i := w.maxFiles - 1; i > 0; i-- {
+			err := os.Rename(rotatedCapturePath(w.path, i), rotatedCapturePath(w.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(w.path, rotatedCapturePath(w.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func rotatedCapturePath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// SetCaptureWriter makes the listener record every packet it receives, with
+// the time it was received and its sender, so it can be replayed with
+// RunReader.
+func (l *StatsdListener) SetCaptureWriter(writer *CaptureWriter) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.captureWriter = writer
+}
+
+func (l *StatsdListener) capture(receivedAt time.Time, sender net.Addr, packet []byte) {
+	l.lock.Lock()
+	writer := l.captureWriter
+	l.lock.Unlock()
+
+	if writer == nil {
+		return
+	}
+
+	record := CaptureRecord{ReceivedAt: receivedAt, Sender: sender.String(), Packet: packet}
+	if err := writer.Write(record); err != nil {
+		l.Warnf("StatsdListener: Error writing to the capture file: %s", err)
+	}
+}
+
+// SetReplaySpeed makes RunReader keep the gaps between the recorded receive
+// times of the packets, divided by speed: 1 replays a capture at its
+// recorded timing, 2 twice as fast. Zero, the default, replays it as fast as
+// possible. It must be called before RunReader.
+func (l *StatsdListener) SetReplaySpeed(speed float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.replaySpeed = speed
+}
+
+// RunReader replays a capture written by a CaptureWriter, handling every
+// packet as if it had just been received at its recorded receive time, and
+// emits the envelopes on outputChan. Counter rates and sample rates are not
+// reported, as they are flushed on wall clock intervals. RunReader returns
+// once the capture has been read or the listener is stopped, with an error
+// if the capture is malformed.
+func (l *StatsdListener) RunReader(reader io.Reader, outputChan chan *events.Envelope) error {
+	l.attachOutput(outputChan)
+
+	l.lock.Lock()
+	speed, clock := l.replaySpeed, l.clock
+	l.lock.Unlock()
+
+	var firstReceivedAt, replayStartedAt time.Time
+	for {
+		select {
+		case <-l.stopChan:
+			return nil
+		default:
+		}
+
+		record, err := ReadCaptureRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Packets are due relative to the start of the replay, so that the
+		// time spent handling them does not add up.
+		if speed > 0 {
+			if firstReceivedAt.IsZero() {
+				firstReceivedAt, replayStartedAt = record.ReceivedAt, clock.Now()
+			} else if !l.waitForReplay(clock, replayStartedAt.Add(time.Duration(float64(record.ReceivedAt.Sub(firstReceivedAt))/speed))) {
+				return nil
+			}
+		}
+
+		l.handlePacket(record.Packet, record.ReceivedAt)
+	}
+}
+
+// waitForReplay waits on clock until due. It returns false if the listener
+// was stopped meanwhile.
+func (l *StatsdListener) waitForReplay(clock Clock, due time.Time) bool {
+	wait := due.Sub(clock.Now())
+	if wait <= 0 {
+		return true
+	}
+
+	select {
+	case <-clock.After(wait):
+		return true
+	case <-l.stopChan:
+		return false
+	}
+}
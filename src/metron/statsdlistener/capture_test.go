@@ -0,0 +1,242 @@
+package statsdlistener_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"metron/statsdlistener"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Capture", func() {
+	var (
+		captureDir  string
+		capturePath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		captureDir, err = ioutil.TempDir("", "statsd-capture")
+		Expect(err).NotTo(HaveOccurred())
+		capturePath = filepath.Join(captureDir, "statsd.capture")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(captureDir)
+	})
+
+	Context("when capturing the packets a listener receives", func() {
+		var (
+			listener     statsdlistener.StatsdListener
+			writer       *statsdlistener.CaptureWriter
+			envelopeChan chan *events.Envelope
+			wg           *sync.WaitGroup
+			connection   net.Conn
+		)
+
+		packets := []string{
+			"fake-origin.test.gauge:23|g\nfake-origin.test.counter:2|c",
+			"fake-origin.test.gauge:+7|g\nfake-origin.test.counter:3|c|@0.5",
+			"fake-origin.test.timing:42|ms",
+		}
+
+		BeforeEach(func() {
+			loggertesthelper.TestLoggerSink.Clear()
+
+			var err error
+			writer, err = statsdlistener.NewCaptureWriter(capturePath, 1024*1024, 1)
+			Expect(err).NotTo(HaveOccurred())
+
+			listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+			listener.SetCaptureWriter(writer)
+			envelopeChan = make(chan *events.Envelope, 10)
+			wg = stopMeLater(func() { listener.Run(envelopeChan) })
+			Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+			connection, err = net.Dial("udp", "localhost:51162")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			connection.Close()
+			stopAndWait(func() { listener.Stop() }, wg)
+			writer.Close()
+		})
+
+		receiveAll := func(count int) []*events.Envelope {
+			envelopes := make([]*events.Envelope, count)
+			for i := range envelopes {
+				Eventually(envelopeChan).Should(Receive(&envelopes[i]))
+			}
+			return envelopes
+		}
+
+		It("records every packet with its sender and receive time", func() {
+			before := time.Now()
+			for _, packet := range packets {
+				connection.Write([]byte(packet))
+				receiveAll(bytes.Count([]byte(packet), []byte("\n")) + 1)
+			}
+
+			file, err := os.Open(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			for _, packet := range packets {
+				record, err := statsdlistener.ReadCaptureRecord(file)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(record.Packet)).To(Equal(packet))
+				Expect(record.Sender).To(Equal(connection.LocalAddr().String()))
+				Expect(record.ReceivedAt).To(BeTemporally(">=", before))
+				Expect(record.ReceivedAt).To(BeTemporally("<=", time.Now()))
+			}
+			_, err = statsdlistener.ReadCaptureRecord(file)
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("replays the captured packets into identical envelopes", func() {
+			var received []*events.Envelope
+			for _, packet := range packets {
+				connection.Write([]byte(packet))
+				received = append(received, receiveAll(bytes.Count([]byte(packet), []byte("\n"))+1)...)
+			}
+
+			file, err := os.Open(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			replayer := statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+			replayedChan := make(chan *events.Envelope, 10)
+			Expect(replayer.RunReader(file, replayedChan)).To(Succeed())
+
+			Expect(replayedChan).To(HaveLen(len(received)))
+			for _, envelope := range received {
+				Expect(<-replayedChan).To(Equal(envelope))
+			}
+		})
+	})
+
+	Describe("CaptureWriter", func() {
+		record := func(packet string) statsdlistener.CaptureRecord {
+			return statsdlistener.CaptureRecord{ReceivedAt: time.Unix(0, 1420070400000000000), Sender: "127.0.0.1:1234", Packet: []byte(packet)}
+		}
+
+		readAll := func(path string) []string {
+			file, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			var packets []string
+			for {
+				record, err := statsdlistener.ReadCaptureRecord(file)
+				if err == io.EOF {
+					return packets
+				}
+				Expect(err).NotTo(HaveOccurred())
+				packets = append(packets, string(record.Packet))
+			}
+		}
+
+		It("appends to an existing capture", func() {
+			writer, err := statsdlistener.NewCaptureWriter(capturePath, 1024, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(record("first"))).To(Succeed())
+			writer.Close()
+
+			writer, err = statsdlistener.NewCaptureWriter(capturePath, 1024, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(record("second"))).To(Succeed())
+			writer.Close()
+
+			Expect(readAll(capturePath)).To(Equal([]string{"first", "second"}))
+		})
+
+		It("rotates the file once it would grow beyond the max file size, keeping the max number of files", func() {
+			// every record is 14 bytes of header, 14 bytes of sender and 2 bytes of packet
+			writer, err := statsdlistener.NewCaptureWriter(capturePath, 60, 2)
+			Expect(err).NotTo(HaveOccurred())
+			defer writer.Close()
+
+			for _, packet := range []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7"} {
+				Expect(writer.Write(record(packet))).To(Succeed())
+			}
+
+			Expect(readAll(capturePath + ".2")).To(Equal([]string{"p3", "p4"}))
+			Expect(readAll(capturePath + ".1")).To(Equal([]string{"p5", "p6"}))
+			Expect(readAll(capturePath)).To(Equal([]string{"p7"}))
+			Expect(capturePath + ".3").NotTo(BeAnExistingFile())
+
+			for _, path := range []string{capturePath, capturePath + ".1", capturePath + ".2"} {
+				info, err := os.Stat(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeNumerically("<=", 60))
+			}
+		})
+
+		It("starts over without keeping rotated files when the max number of files is 0", func() {
+			writer, err := statsdlistener.NewCaptureWriter(capturePath, 60, 0)
+			Expect(err).NotTo(HaveOccurred())
+			defer writer.Close()
+
+			for _, packet := range []string{"p1", "p2", "p3"} {
+				Expect(writer.Write(record(packet))).To(Succeed())
+			}
+
+			Expect(readAll(capturePath)).To(Equal([]string{"p3"}))
+			Expect(capturePath + ".1").NotTo(BeAnExistingFile())
+		})
+
+		It("writes a record larger than the max file size to a file of its own", func() {
+			writer, err := statsdlistener.NewCaptureWriter(capturePath, 60, 1)
+			Expect(err).NotTo(HaveOccurred())
+			defer writer.Close()
+
+			Expect(writer.Write(record("p1"))).To(Succeed())
+			Expect(writer.Write(record(string(make([]byte, 100))))).To(Succeed())
+
+			Expect(readAll(capturePath + ".1")).To(Equal([]string{"p1"}))
+			Expect(readAll(capturePath)).To(HaveLen(1))
+		})
+
+		It("returns an error once closed", func() {
+			writer, err := statsdlistener.NewCaptureWriter(capturePath, 60, 1)
+			Expect(err).NotTo(HaveOccurred())
+			writer.Close()
+
+			Expect(writer.Write(record("p1"))).NotTo(Succeed())
+		})
+	})
+
+	Describe("ReadCaptureRecord", func() {
+		It("returns an unexpected EOF for a truncated record", func() {
+			var buffer bytes.Buffer
+			writer, err := statsdlistener.NewCaptureWriter(capturePath, 1024, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(statsdlistener.CaptureRecord{ReceivedAt: time.Now(), Sender: "127.0.0.1:1234", Packet: []byte("fake-origin.test.gauge:23|g")})).To(Succeed())
+			writer.Close()
+
+			captured, err := ioutil.ReadFile(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+			buffer.Write(captured[:len(captured)-1])
+
+			_, err = statsdlistener.ReadCaptureRecord(&buffer)
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+		})
+
+		It("makes RunReader return the error for a truncated capture", func() {
+			replayer := statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+			err := replayer.RunReader(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0}), make(chan *events.Envelope, 1))
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+		})
+	})
+})
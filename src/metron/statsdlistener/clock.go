@@ -0,0 +1,32 @@
+package statsdlistener
+
+import (
+	"time"
+)
+
+// Clock tells the time and waits for it to pass. The listener uses the wall
+// clock unless SetClock replaces it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SetClock replaces the clock RunReader waits on to replay a capture at its
+// recorded timing and the clock lines are timed with while parse latency is
+// reported. It must be called before Run or RunReader.
+func (l *StatsdListener) SetClock(clock Clock) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.clock = clock
+}
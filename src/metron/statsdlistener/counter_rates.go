@@ -0,0 +1,123 @@
+package statsdlistener
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const counterRateUnit = "per_second"
+
+type counterDelta struct {
+	origin  string
+	name    string
+	delta   float64
+	updated time.Time
+}
+
+// SetCounterRateInterval switches counters from being emitted on every line
+// to being flushed once per interval. Each flush emits, for every counter
+// seen so far, a CounterEvent with the delta and total, followed by a
+// ValueMetric named "<name>.rate" holding the delta per second over the
+// interval. Counters that are not updated keep being flushed with a zero
+// delta, unless SetKeyTTL evicts them. A zero interval keeps emitting
+// counters on every line.
+func (l *StatsdListener) SetCounterRateInterval(interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counterRateInterval = interval
+	l.notifyReconfigured()
+}
+
+// recordCounterDelta must be called with the lock held.
+func (l *StatsdListener) recordCounterDelta(origin string, name string, delta float64) {
+	key := fmt.Sprintf("%s.%s", origin, name)
+	counter, ok := l.counterDeltas[key]
+	if !ok {
+		counter = &counterDelta{origin: origin, name: name}
+		l.counterDeltas[key] = counter
+	}
+	counter.delta += delta
+	counter.updated = time.Now()
+}
+
+func (l *StatsdListener) flushCounters(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		return false
+	}
+
+	keys := make([]string, 0, len(l.counterDeltas))
+	for key := range l.counterDeltas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	timestamp := now.UnixNano()
+	for _, key := range keys {
+		counter := l.counterDeltas[key]
+		if counter.delta == 0 && l.expired(counter.updated, now) {
+			l.Debugf("StatsdListener: No longer flushing counter %s, not updated for %s", key, now.Sub(counter.updated))
+			delete(l.counterDeltas, key)
+			continue
+		}
+		for _, envelope := range counterEnvelopes(counter, l.typedName(counter.name, "c"), l.counterValues[key], elapsed, timestamp) {
+			if !l.send(envelope) {
+				return true
+			}
+			l.countEmitted("c")
+		}
+		counter.delta = 0
+		l.resetCounterAtThreshold(key)
+	}
+
+	return true
+}
+
+func counterEnvelopes(counter *counterDelta, name string, total float64, elapsed time.Duration, timestamp int64) []*events.Envelope {
+	origin := counter.origin
+	rateName := name + ".rate"
+	rate := counter.delta / elapsed.Seconds()
+
+	return []*events.Envelope{
+		{
+			Origin:    &origin,
+			Timestamp: proto.Int64(timestamp),
+			EventType: events.Envelope_CounterEvent.Enum(),
+
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String(name),
+				Delta: proto.Uint64(nonNegative(counter.delta)),
+				Total: proto.Uint64(nonNegative(total)),
+			},
+		},
+		{
+			Origin:    &origin,
+			Timestamp: proto.Int64(timestamp),
+			EventType: events.Envelope_ValueMetric.Enum(),
+
+			ValueMetric: &events.ValueMetric{
+				Name:  &rateName,
+				Value: &rate,
+				Unit:  proto.String(counterRateUnit),
+			},
+		},
+	}
+}
+
+// nonNegative converts a counter value to a CounterEvent field. Decrements
+// and counter resets can make deltas and totals negative, which a
+// CounterEvent cannot represent; they are reported as zero.
+func nonNegative(value float64) uint64 {
+	if value < 0 {
+		return 0
+	}
+	return uint64(value)
+}
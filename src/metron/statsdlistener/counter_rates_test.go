@@ -0,0 +1,107 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Counter rates", func() {
+	const interval = 200 * time.Millisecond
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receiveCounter := func(name string, delta uint64, total uint64, rate float64) {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(receivedEnvelope.GetOrigin()).To(Equal("fake-origin"))
+		Expect(receivedEnvelope.GetCounterEvent().GetName()).To(Equal(name))
+		Expect(receivedEnvelope.GetCounterEvent().GetDelta()).To(Equal(delta))
+		Expect(receivedEnvelope.GetCounterEvent().GetTotal()).To(Equal(total))
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", name+".rate", rate, "per_second")
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetCounterRateInterval(interval)
+		envelopeChan = make(chan *events.Envelope)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("emits the delta per second over the flush interval alongside the counter", func() {
+		send("fake-origin.test.counter:3|c|@0.2")
+		receiveCounter("test.counter", 15, 15, 75)
+
+		send("fake-origin.test.counter:4|c")
+		receiveCounter("test.counter", 4, 19, 20)
+
+		receiveCounter("test.counter", 0, 19, 0)
+	})
+
+	It("does not emit counters on every line", func() {
+		send("fake-origin.test.counter:3|c")
+		send("fake-origin.test.gauge:5|g")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 5, "gauge")
+
+		receiveCounter("test.counter", 3, 3, 15)
+	})
+
+	It("emits each counter separately", func() {
+		send("fake-origin.a.counter:2|c")
+		send("other-origin.b.counter:4|c")
+
+		var receivedEnvelope *events.Envelope
+		receiveCounter("a.counter", 2, 2, 10)
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetOrigin()).To(Equal("other-origin"))
+		Expect(receivedEnvelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(4))
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "other-origin", "b.counter.rate", 20, "per_second")
+	})
+
+	It("reports decrements as a negative rate", func() {
+		send("fake-origin.test.counter:10|c")
+		receiveCounter("test.counter", 10, 10, 50)
+
+		send("fake-origin.test.counter:-4|c")
+		receiveCounter("test.counter", 0, 6, -20)
+	})
+})
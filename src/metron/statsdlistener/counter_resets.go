@@ -0,0 +1,73 @@
+package statsdlistener
+
+import (
+	"math"
+	"time"
+)
+
+// SetCounterResetThreshold makes the listener reset the running total of a
+// counter to zero once its magnitude reaches threshold, so that totals stay in
+// the range float64 represents exactly and keep counting single increments.
+// The total that reached the threshold is still emitted, on its line or at the
+// next counter rate flush, and the deltas flushed stay exact. Counters last
+// sent as cumulative totals are not reset, as their deltas are worked out from
+// the totals. Zero never resets totals.
+func (l *StatsdListener) SetCounterResetThreshold(threshold float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counterResetThreshold = threshold
+}
+
+// SetCounterResetInterval makes the listener reset the running totals of all
+// counters to zero once per interval, like SetCounterResetThreshold does once
+// a total grows too large. Zero never resets totals on a timer.
+func (l *StatsdListener) SetCounterResetInterval(interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counterResetInterval = interval
+	l.notifyReconfigured()
+}
+
+// markCumulative must be called with the lock held. It records whether the
+// last line for the counter key set its total rather than incrementing it.
+func (l *StatsdListener) markCumulative(key string, cumulative bool) {
+	if cumulative {
+		l.cumulativeCounters[key] = true
+		return
+	}
+	delete(l.cumulativeCounters, key)
+}
+
+// resetCounterAtThreshold must be called with the lock held, once the total
+// of the counter key has been accounted for.
+func (l *StatsdListener) resetCounterAtThreshold(key string) {
+	if l.counterResetThreshold <= 0 || l.cumulativeCounters[key] {
+		return
+	}
+
+	total := l.counterValues[key]
+	if math.Abs(total) < l.counterResetThreshold {
+		return
+	}
+	l.Debugf("StatsdListener: Resetting the total of counter %s at %g", key, total)
+	l.counterValues[key] = 0
+}
+
+func (l *StatsdListener) resetCounters(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.paused {
+		return false
+	}
+
+	for key := range l.counterValues {
+		if l.cumulativeCounters[key] {
+			continue
+		}
+		l.counterValues[key] = 0
+	}
+	return true
+}
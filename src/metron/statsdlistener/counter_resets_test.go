@@ -0,0 +1,162 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Counter resets", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	receiveCounter := func(delta uint64, total uint64) {
+		counter := receive()
+		Expect(counter.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(counter.GetCounterEvent().GetName()).To(Equal("test.counter"))
+		Expect(counter.GetCounterEvent().GetDelta()).To(Equal(delta))
+		Expect(counter.GetCounterEvent().GetTotal()).To(Equal(total))
+		receive()
+	}
+
+	run := func(configure func()) {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		configure()
+		envelopeChan = make(chan *events.Envelope, 100)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	Context("with a threshold", func() {
+		It("emits the total that reached the threshold and then counts from zero", func() {
+			run(func() { listener.SetCounterResetThreshold(10) })
+
+			send("fake-origin.test.counter:6|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", 6, "counter")
+			send("fake-origin.test.counter:5|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", 11, "counter")
+
+			send("fake-origin.test.counter:2|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", 2, "counter")
+		})
+
+		It("resets totals that were decremented below the negative threshold", func() {
+			run(func() { listener.SetCounterResetThreshold(10) })
+
+			send("fake-origin.test.counter:-12|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", -12, "counter")
+
+			send("fake-origin.test.counter:+1|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", 1, "counter")
+		})
+
+		It("resets the total after flushing it and keeps the deltas exact", func() {
+			run(func() {
+				listener.SetCounterRateInterval(200 * time.Millisecond)
+				listener.SetCounterResetThreshold(10)
+			})
+
+			send("fake-origin.test.counter:6|c\nfake-origin.test.counter:6|c")
+			receiveCounter(12, 12)
+
+			send("fake-origin.test.counter:3|c\nfake-origin.test.counter:4|c")
+			receiveCounter(7, 7)
+
+			send("fake-origin.test.counter:1|c")
+			receiveCounter(1, 8)
+		})
+
+		It("keeps counting precisely beyond the range of float64 integers", func() {
+			run(func() {
+				listener.SetCounterRateInterval(200 * time.Millisecond)
+				listener.SetCounterResetThreshold(1 << 40)
+			})
+
+			send("fake-origin.test.counter:9007199254740992|c")
+			receiveCounter(9007199254740992, 9007199254740992)
+
+			send("fake-origin.test.counter:1|c")
+			receiveCounter(1, 1)
+		})
+	})
+
+	Context("with an interval", func() {
+		It("resets the totals of all counters every interval", func() {
+			run(func() { listener.SetCounterResetInterval(300 * time.Millisecond) })
+
+			send("fake-origin.test.counter:6|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", 6, "counter")
+
+			Eventually(func() float64 {
+				send("fake-origin.test.counter:1|c")
+				return receive().GetValueMetric().GetValue()
+			}).Should(BeNumerically("<", 6))
+		})
+
+		It("keeps the deltas exact", func() {
+			run(func() {
+				listener.SetCounterRateInterval(100 * time.Millisecond)
+				listener.SetCounterResetInterval(time.Second)
+			})
+
+			send("fake-origin.test.counter:6|c")
+			receiveCounter(6, 6)
+
+			time.Sleep(1100 * time.Millisecond)
+			for len(envelopeChan) > 0 {
+				<-envelopeChan
+			}
+
+			send("fake-origin.test.counter:2|c")
+			Eventually(func() uint64 {
+				counter := receive()
+				receive()
+				return counter.GetCounterEvent().GetDelta()
+			}).Should(BeEquivalentTo(2))
+			receiveCounter(0, 2)
+		})
+	})
+
+	It("does not reset totals by default", func() {
+		run(func() {})
+
+		send("fake-origin.test.counter:9007199254740990|c")
+		checkValueMetric(receive(), "fake-origin", "test.counter", 9007199254740990, "counter")
+		send("fake-origin.test.counter:2|c")
+		checkValueMetric(receive(), "fake-origin", "test.counter", 9007199254740992, "counter")
+	})
+})
@@ -0,0 +1,71 @@
+package statsdlistener
+
+import (
+	"time"
+)
+
+// DropReason tells why a line was dropped.
+type DropReason string
+
+const (
+	// ReasonParseError is given for lines the parser rejects.
+	ReasonParseError DropReason = "parseError"
+	// ReasonNoOrigin is given for lines without an origin when no default
+	// origin is configured.
+	ReasonNoOrigin DropReason = "noOrigin"
+	// ReasonUnknownType is given for lines of an unknown type that the unknown
+	// type fallback rejects or drops.
+	ReasonUnknownType DropReason = "unknownType"
+	// ReasonLongLine is given for lines longer than the maximum line length
+	// that are not truncated.
+	ReasonLongLine DropReason = "longLine"
+	// ReasonMaxKeys is given for lines for new names once the maximum number of
+	// keys is reached.
+	ReasonMaxKeys DropReason = "maxKeys"
+	// ReasonPaused is given for lines discarded while the listener is paused,
+	// and for the oldest buffered lines once the pause buffer is full.
+	ReasonPaused DropReason = "paused"
+	// ReasonOutputClosed is given for lines whose envelopes could not be sent
+	// because the output was closed or the listener was stopped.
+	ReasonOutputClosed DropReason = "outputClosed"
+)
+
+// DeadLetter records a dropped line.
+type DeadLetter struct {
+	Line      string
+	Reason    DropReason
+	DroppedAt time.Time
+}
+
+// SetDeadLetterChannel makes the listener send a DeadLetter for every line it
+// drops to deadLetters. The listener never blocks on deadLetters: dead
+// letters that do not fit into its buffer are discarded and counted instead,
+// so the channel should be buffered.
+func (l *StatsdListener) SetDeadLetterChannel(deadLetters chan<- DeadLetter) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.deadLetters = deadLetters
+}
+
+// DiscardedDeadLetters returns the number of dead letters discarded because
+// the dead letter channel was full.
+func (l *StatsdListener) DiscardedDeadLetters() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.discardedDeadLetters
+}
+
+// deadLetter must be called with the lock held.
+func (l *StatsdListener) deadLetter(line string, reason DropReason) {
+	if l.deadLetters == nil {
+		return
+	}
+
+	select {
+	case l.deadLetters <- DeadLetter{Line: line, Reason: reason, DroppedAt: time.Now()}:
+	default:
+		l.discardedDeadLetters++
+	}
+}
@@ -0,0 +1,197 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// blankNameParser parses every line to a gauge with a blank name.
+type blankNameParser struct{}
+
+func (blankNameParser) Parse(line string) (*statsdlistener.Stat, error) {
+	return &statsdlistener.Stat{Origin: "fake-origin", Name: " ", Value: 23, Type: "g", SampleRate: 1}, nil
+}
+
+var _ = Describe("Dead letters", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		deadLetters  chan statsdlistener.DeadLetter
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	expectDeadLetter := func(line string, reason statsdlistener.DropReason) {
+		var deadLetter statsdlistener.DeadLetter
+		Eventually(deadLetters).Should(Receive(&deadLetter))
+		Expect(deadLetter.Line).To(Equal(line))
+		Expect(deadLetter.Reason).To(Equal(reason))
+		Expect(deadLetter.DroppedAt).To(BeTemporally("~", time.Now(), time.Second))
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 10)
+		deadLetters = make(chan statsdlistener.DeadLetter, 10)
+		listener.SetDeadLetterChannel(deadLetters)
+	})
+
+	JustBeforeEach(func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("does not send dead letters for lines that are emitted", func() {
+		send("fake-origin.test.gauge:23|g")
+
+		Eventually(envelopeChan).Should(Receive())
+		Consistently(deadLetters).ShouldNot(Receive())
+	})
+
+	It("sends lines the parser rejects", func() {
+		send("fake-origin.test.gauge")
+
+		expectDeadLetter("fake-origin.test.gauge", statsdlistener.ReasonParseError)
+	})
+
+	It("sends lines of an unknown type", func() {
+		send("fake-origin.test.set:23|s")
+
+		expectDeadLetter("fake-origin.test.set:23|s", statsdlistener.ReasonUnknownType)
+	})
+
+	Context("with the unknown type fallback dropping lines silently", func() {
+		BeforeEach(func() {
+			listener.SetUnknownTypeFallback(statsdlistener.DropUnknownType)
+		})
+
+		It("still sends them", func() {
+			send("fake-origin.test.set:23|s")
+
+			expectDeadLetter("fake-origin.test.set:23|s", statsdlistener.ReasonUnknownType)
+		})
+	})
+
+	Context("with lines without an origin", func() {
+		BeforeEach(func() {
+			listener.SetLineParser(statsdlistener.NewPrometheusLineParser(""))
+		})
+
+		It("sends them when no default origin is configured", func() {
+			send("test_gauge 23")
+
+			expectDeadLetter("test_gauge 23", statsdlistener.ReasonNoOrigin)
+		})
+	})
+
+	It("sends lines with a blank origin or name", func() {
+		send(" .test.gauge:23|g\nfake-origin. :23|g")
+
+		expectDeadLetter(" .test.gauge:23|g", statsdlistener.ReasonNoOrigin)
+		expectDeadLetter("fake-origin. :23|g", statsdlistener.ReasonParseError)
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+
+	Context("with a parser that returns a blank name", func() {
+		BeforeEach(func() {
+			listener.SetLineParser(blankNameParser{})
+		})
+
+		It("rejects the line instead of emitting a stat without a name", func() {
+			send("anything")
+
+			expectDeadLetter("anything", statsdlistener.ReasonParseError)
+			Consistently(envelopeChan).ShouldNot(Receive())
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Error parsing stat line \"anything\": Stat has an empty name."))
+		})
+	})
+
+	Context("with a maximum line length", func() {
+		BeforeEach(func() {
+			listener.SetMaxLineLength(20, statsdlistener.RejectLongLines)
+		})
+
+		It("sends the lines that are too long", func() {
+			send("fake-origin.test.long.gauge:23|g")
+
+			expectDeadLetter("fake-origin.test.long.gauge:23|g", statsdlistener.ReasonLongLine)
+		})
+	})
+
+	Context("with a maximum number of keys", func() {
+		BeforeEach(func() {
+			listener.SetMaxKeys(1)
+		})
+
+		It("sends the lines for new names", func() {
+			send("fake-origin.test.gauge:23|g\nfake-origin.new.gauge:5|g")
+
+			Eventually(envelopeChan).Should(Receive())
+			expectDeadLetter("fake-origin.new.gauge:5|g", statsdlistener.ReasonMaxKeys)
+		})
+	})
+
+	Context("while paused", func() {
+		It("sends the lines discarded", func() {
+			listener.Pause()
+			send("fake-origin.test.gauge:23|g")
+
+			expectDeadLetter("fake-origin.test.gauge:23|g", statsdlistener.ReasonPaused)
+		})
+	})
+
+	Context("when the output is closed", func() {
+		BeforeEach(func() {
+			envelopeChan = make(chan *events.Envelope)
+		})
+
+		It("sends the line whose envelope could not be sent", func() {
+			send("fake-origin.test.gauge:23|g")
+			// let the listener block sending the envelope
+			time.Sleep(100 * time.Millisecond)
+
+			listener.CloseOutput()
+
+			expectDeadLetter("fake-origin.test.gauge:23|g", statsdlistener.ReasonOutputClosed)
+		})
+	})
+
+	Context("when the dead letter channel is full", func() {
+		BeforeEach(func() {
+			deadLetters = make(chan statsdlistener.DeadLetter, 1)
+			listener.SetDeadLetterChannel(deadLetters)
+		})
+
+		It("discards and counts the dead letters instead of blocking", func() {
+			send("first\nsecond\nthird\nfake-origin.test.gauge:23|g")
+
+			Eventually(envelopeChan).Should(Receive())
+			expectDeadLetter("first", statsdlistener.ReasonParseError)
+			Expect(listener.DiscardedDeadLetters()).To(Equal(2))
+		})
+	})
+})
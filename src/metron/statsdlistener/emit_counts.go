@@ -0,0 +1,32 @@
+package statsdlistener
+
+// EmitCounts holds how many envelopes the listener has emitted for lines of
+// each statsd type. Every envelope a line produces is counted under the
+// line's type, so gauge delta CounterEvents count as gauges and counter rate
+// flushes count as counters. Statsd sets are not supported; set lines taken
+// in by an unknown type fallback count as the type they are handled as.
+type EmitCounts struct {
+	Counters int
+	Gauges   int
+	Timers   int
+}
+
+// EmitCounts returns the number of envelopes emitted so far by type.
+func (l *StatsdListener) EmitCounts() EmitCounts {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.emitCounts
+}
+
+// countEmitted must be called with the lock held.
+func (l *StatsdListener) countEmitted(statType string) {
+	switch statType {
+	case "c":
+		l.emitCounts.Counters++
+	case "g":
+		l.emitCounts.Gauges++
+	case "ms":
+		l.emitCounts.Timers++
+	}
+}
@@ -0,0 +1,100 @@
+package statsdlistener_test
+
+import (
+	"metron/metrics"
+	"metron/statsdlistener"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation/testhelpers"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Emit counts", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	start := func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 20)
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("starts out with nothing emitted", func() {
+		start()
+		Expect(listener.EmitCounts()).To(Equal(statsdlistener.EmitCounts{}))
+	})
+
+	It("counts the envelopes emitted for each type", func() {
+		start()
+		send("fake-origin.test.counter:1|c\nfake-origin.test.counter:2|c\n" +
+			"fake-origin.test.gauge:3|g\nfake-origin.test.gauge:+4|g\nfake-origin.other.gauge:5|g\n" +
+			"fake-origin.test.timer:6|ms\n" +
+			"fake-origin.test.histogram:7|h")
+
+		Eventually(listener.EmitCounts).Should(Equal(statsdlistener.EmitCounts{Counters: 2, Gauges: 3, Timers: 1}))
+		Expect(envelopeChan).To(HaveLen(6))
+	})
+
+	It("counts lines taken in by the unknown type fallback as the type they are handled as", func() {
+		listener.SetUnknownTypeFallback(statsdlistener.CounterUnknownType)
+		start()
+		send("fake-origin.test.set:3|s\nfake-origin.test.set:4|s\nfake-origin.test.gauge:5|g")
+
+		Eventually(listener.EmitCounts).Should(Equal(statsdlistener.EmitCounts{Counters: 2, Gauges: 1}))
+	})
+
+	It("counts gauge delta counters as gauges", func() {
+		listener.SetGaugeDeltaCounters(true)
+		start()
+		send("fake-origin.test.gauge:3|g\nfake-origin.test.gauge:+4|g")
+
+		Eventually(listener.EmitCounts).Should(Equal(statsdlistener.EmitCounts{Gauges: 3}))
+	})
+
+	It("emits the counts as metrics", func() {
+		start()
+		send("fake-origin.test.counter:1|c\nfake-origin.test.gauge:3|g\nfake-origin.test.timer:6|ms\nfake-origin.test.timer:7|ms")
+
+		testhelpers.EventuallyExpectMetric(&listener, "emittedCounters", 1)
+		testhelpers.EventuallyExpectMetric(&listener, "emittedGauges", 1)
+		testhelpers.EventuallyExpectMetric(&listener, "emittedTimers", 2)
+	})
+
+	It("counts the emitted envelopes in the metrics registry", func() {
+		registry := metrics.NewRegistry()
+		listener.SetMetricsRegistry(registry)
+		start()
+		send("fake-origin.test.counter:1|c\nfake-origin.test.gauge:3|g\nfake-origin.test.timer:6|ms")
+
+		Eventually(func() uint64 { return registry.Counter(metrics.StatsdEmittedEnvelopes) }).Should(BeEquivalentTo(3))
+	})
+})
@@ -0,0 +1,39 @@
+package statsdlistener
+
+import (
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// SetGaugeDeltaCounters makes the listener follow every gauge line that
+// changes a gauge by a signed amount, like "name:+3|g" or "name:-2|g", with a
+// CounterEvent of the same name. Its delta is the change and its total the
+// new gauge value, both truncated to integers and stored as the two's
+// complement of a signed 64 bit integer, so readers that take them as int64
+// get negative changes back. The gauge itself is still emitted as before.
+func (l *StatsdListener) SetGaugeDeltaCounters(enabled bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.gaugeDeltaCounters = enabled
+}
+
+func gaugeDeltaEnvelope(origin string, name string, delta float64, total float64, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(origin),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_CounterEvent.Enum(),
+
+		CounterEvent: &events.CounterEvent{
+			Name:  proto.String(name),
+			Delta: proto.Uint64(signed(delta)),
+			Total: proto.Uint64(signed(total)),
+		},
+	}
+}
+
+// signed converts a gauge value to a CounterEvent field, keeping its sign in
+// the two's complement.
+func signed(value float64) uint64 {
+	return uint64(int64(value))
+}
@@ -0,0 +1,115 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Gauge delta counters", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	start := func(enabled bool) {
+		listener.SetGaugeDeltaCounters(enabled)
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receiveGauge := func(name string, value float64) {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", name, value, "gauge")
+	}
+
+	receiveDelta := func(name string, delta int64, total int64) {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(receivedEnvelope.GetOrigin()).To(Equal("fake-origin"))
+		Expect(receivedEnvelope.GetCounterEvent().GetName()).To(Equal(name))
+		Expect(int64(receivedEnvelope.GetCounterEvent().GetDelta())).To(Equal(delta))
+		Expect(int64(receivedEnvelope.GetCounterEvent().GetTotal())).To(Equal(total))
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("follows every signed gauge change with its signed delta", func() {
+		start(true)
+
+		send("fake-origin.test.gauge:+5|g")
+		receiveGauge("test.gauge", 5)
+		receiveDelta("test.gauge", 5, 5)
+
+		send("fake-origin.test.gauge:-8|g")
+		receiveGauge("test.gauge", -3)
+		receiveDelta("test.gauge", -8, -3)
+
+		send("fake-origin.test.gauge:+2|g")
+		receiveGauge("test.gauge", -1)
+		receiveDelta("test.gauge", 2, -1)
+
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+
+	It("does not emit a delta when a gauge is set to an absolute value", func() {
+		start(true)
+
+		send("fake-origin.test.gauge:+5|g")
+		receiveGauge("test.gauge", 5)
+		receiveDelta("test.gauge", 5, 5)
+
+		send("fake-origin.test.gauge:12|g")
+		receiveGauge("test.gauge", 12)
+		Consistently(envelopeChan).ShouldNot(Receive())
+
+		send("fake-origin.test.gauge:-2|g")
+		receiveGauge("test.gauge", 10)
+		receiveDelta("test.gauge", -2, 10)
+	})
+
+	It("scales the delta by the sample rate", func() {
+		start(true)
+
+		send("fake-origin.test.gauge:+3|g|@0.5")
+		receiveGauge("test.gauge", 6)
+		receiveDelta("test.gauge", 6, 6)
+	})
+
+	It("does not emit deltas by default", func() {
+		start(false)
+
+		send("fake-origin.test.gauge:+5|g")
+		receiveGauge("test.gauge", 5)
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+})
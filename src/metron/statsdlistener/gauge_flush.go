@@ -0,0 +1,132 @@
+package statsdlistener
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+type liveGauge struct {
+	origin  string
+	name    string
+	updated time.Time
+
+	flushed      bool
+	flushedValue float64
+}
+
+// SetGaugeFlushInterval makes the listener emit the current value of every
+// live gauge once per interval, in addition to emitting gauges on every line,
+// so that downstream a gauge that stopped changing can be told from one that
+// stopped reporting. A gauge becomes live when a line updates it, or it is
+// reloaded from the gauge snapshot, while the interval is non-zero. A zero
+// interval disables the flush.
+func (l *StatsdListener) SetGaugeFlushInterval(interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.gaugeFlushInterval = interval
+	l.notifyReconfigured()
+}
+
+// SetGaugeFlushDeltas makes every gauge flush also emit, for each gauge, a
+// ValueMetric named after the gauge with a ".delta" suffix whose value is the
+// change of the gauge since its previous flush. A gauge's first flush, also
+// after it became live again, has no previous value and emits no delta.
+func (l *StatsdListener) SetGaugeFlushDeltas(enabled bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.gaugeFlushDeltas = enabled
+}
+
+// SetKeyTTL makes the periodic flushes leave out the gauges, and the counters
+// flushed at the counter rate interval, that no line has updated for longer
+// than ttl. A counter is only left out once it has no delta left to flush. An
+// evicted key is flushed again once a line updates it. Zero keeps flushing
+// every key seen.
+func (l *StatsdListener) SetKeyTTL(ttl time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.keyTTL = ttl
+}
+
+// touchGauge must be called with the lock held.
+func (l *StatsdListener) touchGauge(key string, origin string, name string, updated time.Time) {
+	if l.gaugeFlushInterval <= 0 {
+		return
+	}
+
+	gauge, ok := l.liveGauges[key]
+	if !ok {
+		gauge = &liveGauge{origin: origin, name: name}
+		l.liveGauges[key] = gauge
+	}
+	gauge.updated = updated
+}
+
+// expired must be called with the lock held. It reports whether a key last
+// updated at updated has outlived the key TTL.
+func (l *StatsdListener) expired(updated time.Time, now time.Time) bool {
+	return l.keyTTL > 0 && now.Sub(updated) > l.keyTTL
+}
+
+func (l *StatsdListener) flushGauges(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		return false
+	}
+
+	keys := make([]string, 0, len(l.liveGauges))
+	for key := range l.liveGauges {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	for _, key := range keys {
+		gauge := l.liveGauges[key]
+		if l.expired(gauge.updated, now) {
+			l.Debugf("StatsdListener: No longer flushing gauge %s, not updated for %s", key, now.Sub(gauge.updated))
+			delete(l.liveGauges, key)
+			continue
+		}
+
+		value := l.gaugeValues[key]
+		name := l.typedName(gauge.name, "g")
+		if !l.send(gaugeEnvelope(gauge.origin, name, value, now.UnixNano())) {
+			return true
+		}
+		l.countEmitted("g")
+
+		if l.gaugeFlushDeltas && gauge.flushed {
+			if !l.send(gaugeEnvelope(gauge.origin, name+".delta", value-gauge.flushedValue, now.UnixNano())) {
+				return true
+			}
+			l.countEmitted("g")
+		}
+		gauge.flushed = true
+		gauge.flushedValue = value
+	}
+
+	return true
+}
+
+func gaugeEnvelope(origin string, name string, value float64, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(origin),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_ValueMetric.Enum(),
+
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(value),
+			Unit:  proto.String("gauge"),
+		},
+	}
+}
@@ -0,0 +1,244 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Gauge flush", func() {
+	const interval = 50 * time.Millisecond
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	// drain discards the envelopes emitted so far.
+	drain := func() int {
+		drained := 0
+		for {
+			select {
+			case <-envelopeChan:
+				drained++
+			default:
+				return drained
+			}
+		}
+	}
+
+	run := func(configure func()) {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		configure()
+		envelopeChan = make(chan *events.Envelope, 100)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	Context("with a gauge flush interval", func() {
+		BeforeEach(func() {
+			run(func() { listener.SetGaugeFlushInterval(interval) })
+		})
+
+		It("emits the current value of every gauge each interval", func() {
+			send("fake-origin.test.gauge:5|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		})
+
+		It("flushes the value the gauge was last updated to", func() {
+			send("fake-origin.test.gauge:5|g\nfake-origin.test.gauge:+2|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 7, "gauge")
+
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 7, "gauge")
+		})
+
+		It("does not flush counters", func() {
+			send("fake-origin.test.counter:3|c")
+			checkValueMetric(receive(), "fake-origin", "test.counter", 3, "counter")
+
+			Consistently(envelopeChan, 3*interval).ShouldNot(Receive())
+		})
+	})
+
+	Context("with gauge flush deltas", func() {
+		BeforeEach(func() {
+			run(func() {
+				listener.SetGaugeFlushInterval(interval)
+				listener.SetGaugeFlushDeltas(true)
+			})
+		})
+
+		// nextDelta returns the value of the next delta flushed, skipping the
+		// other envelopes.
+		nextDelta := func() float64 {
+			for {
+				envelope := receive()
+				if envelope.GetValueMetric().GetName() == "test.gauge.delta" {
+					return envelope.GetValueMetric().GetValue()
+				}
+			}
+		}
+
+		// nextChange returns the value of the next non-zero delta flushed.
+		nextChange := func() float64 {
+			for {
+				if delta := nextDelta(); delta != 0 {
+					return delta
+				}
+			}
+		}
+
+		It("emits the change of every gauge since its previous flush", func() {
+			send("fake-origin.test.gauge:5|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge.delta", 0, "gauge")
+
+			send("fake-origin.test.gauge:+3|g")
+			Expect(nextChange()).To(BeEquivalentTo(3))
+			Expect(nextDelta()).To(BeEquivalentTo(0))
+
+			send("fake-origin.test.gauge:2|g")
+			Expect(nextChange()).To(BeEquivalentTo(-6))
+			Expect(nextDelta()).To(BeEquivalentTo(0))
+		})
+
+		It("emits deltas that add up to the change of the gauge", func() {
+			send("fake-origin.test.gauge:5|g")
+			Expect(nextDelta()).To(BeEquivalentTo(0))
+
+			send("fake-origin.test.gauge:+1|g\nfake-origin.test.gauge:+2|g\nfake-origin.test.gauge:-1|g")
+			sum := 0.0
+			Eventually(func() float64 {
+				sum += nextDelta()
+				return sum
+			}).Should(BeEquivalentTo(2))
+		})
+	})
+
+	Context("without a gauge flush interval", func() {
+		BeforeEach(func() {
+			run(func() {})
+		})
+
+		It("only emits gauges on every line", func() {
+			send("fake-origin.test.gauge:5|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+
+			Consistently(envelopeChan, 3*interval).ShouldNot(Receive())
+		})
+
+		It("starts flushing the gauges updated once reconfigured with an interval", func() {
+			listener.Reconfigure(statsdlistener.StatsdListenerConfig{Address: "localhost:51162", GaugeFlushInterval: interval})
+
+			send("fake-origin.test.gauge:5|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		})
+	})
+
+	Context("with a key TTL", func() {
+		const ttl = 4 * interval
+
+		It("stops flushing gauges that were not updated within the TTL", func() {
+			run(func() {
+				listener.SetGaugeFlushInterval(interval)
+				listener.SetKeyTTL(ttl)
+			})
+
+			send("fake-origin.test.gauge:5|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+
+			time.Sleep(ttl + 2*interval)
+			Expect(drain()).To(BeNumerically("<=", int(ttl/interval)+1))
+			Consistently(envelopeChan, 3*interval).ShouldNot(Receive())
+		})
+
+		It("flushes an evicted gauge again once it is updated", func() {
+			run(func() {
+				listener.SetGaugeFlushInterval(interval)
+				listener.SetKeyTTL(ttl)
+			})
+
+			send("fake-origin.test.gauge:5|g")
+			time.Sleep(ttl + 2*interval)
+			drain()
+			Consistently(envelopeChan, 2*interval).ShouldNot(Receive())
+
+			send("fake-origin.test.gauge:+1|g")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 6, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge", 6, "gauge")
+		})
+
+		It("stops flushing zero deltas for counters that were not updated within the TTL", func() {
+			run(func() {
+				listener.SetCounterRateInterval(interval)
+				listener.SetKeyTTL(ttl)
+			})
+
+			send("fake-origin.test.counter:3|c")
+			counter := receive()
+			Expect(counter.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+			receive()
+
+			counter = receive()
+			Expect(counter.GetCounterEvent().GetDelta()).To(BeEquivalentTo(0))
+			Expect(counter.GetCounterEvent().GetTotal()).To(BeEquivalentTo(3))
+
+			time.Sleep(ttl + 2*interval)
+			drain()
+			Consistently(envelopeChan, 3*interval).ShouldNot(Receive())
+		})
+
+		It("flushes the delta of a counter before evicting it", func() {
+			run(func() {
+				listener.SetCounterRateInterval(4 * interval)
+				listener.SetKeyTTL(interval)
+			})
+
+			send("fake-origin.test.counter:3|c")
+			counter := receive()
+			Expect(counter.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+			receive()
+
+			Consistently(envelopeChan, 6*interval).ShouldNot(Receive())
+		})
+	})
+})
@@ -0,0 +1,169 @@
+package statsdlistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// GaugeSnapshot is the last known value of every gauge, as written to the
+// gauge snapshot file.
+type GaugeSnapshot struct {
+	Gauges []SnapshotGauge `json:"gauges"`
+}
+
+type SnapshotGauge struct {
+	Origin string  `json:"origin"`
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+}
+
+type gaugeKey struct {
+	origin string
+	name   string
+}
+
+// SetGaugeSnapshotFile makes the listener write the last known value of
+// every gauge to path once Run returns, so that they survive a restart. An
+// empty path disables the snapshot. It must be called before Run.
+func (l *StatsdListener) SetGaugeSnapshotFile(path string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.gaugeSnapshotFile = path
+}
+
+// SetReloadGaugeSnapshot makes Run load the gauges from the snapshot file
+// before it starts listening and emit their values right away, so that
+// dashboards do not show gaps until the emitters next update them. A missing
+// snapshot file is not an error. It must be called before Run.
+func (l *StatsdListener) SetReloadGaugeSnapshot(reload bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.reloadGaugeSnapshot = reload
+}
+
+// ReadGaugeSnapshot reads the gauge snapshot written to path.
+func ReadGaugeSnapshot(path string) (GaugeSnapshot, error) {
+	var snapshot GaugeSnapshot
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("invalid gauge snapshot %s: %s", path, err)
+	}
+	return snapshot, nil
+}
+
+// rememberGaugeKey must be called with the lock held. The snapshot needs the
+// origin and name of every gauge, which cannot be told apart in its key.
+func (l *StatsdListener) rememberGaugeKey(key string, origin string, name string) {
+	if l.gaugeSnapshotFile == "" {
+		return
+	}
+	l.gaugeKeys[key] = gaugeKey{origin: origin, name: name}
+}
+
+// reloadGauges loads the gauges of the snapshot file and emits them, unless
+// the listener is paused. Gauges beyond the key limit are dropped.
+func (l *StatsdListener) reloadGauges() {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if !l.reloadGaugeSnapshot || l.gaugeSnapshotFile == "" {
+		return
+	}
+
+	snapshot, err := ReadGaugeSnapshot(l.gaugeSnapshotFile)
+	if os.IsNotExist(err) {
+		l.Infof("StatsdListener: No gauge snapshot found at %s", l.gaugeSnapshotFile)
+		return
+	}
+	if err != nil {
+		l.Warnf("StatsdListener: Not reloading gauges: %s", err)
+		return
+	}
+
+	timestamp := time.Now().UnixNano()
+	for _, gauge := range snapshot.Gauges {
+		key := fmt.Sprintf("%s.%s", gauge.Origin, gauge.Name)
+		if !l.admitKey(key) {
+			continue
+		}
+		l.gaugeValues[key] = gauge.Value
+		l.rememberGaugeKey(key, gauge.Origin, gauge.Name)
+		l.touchGauge(key, gauge.Origin, gauge.Name, time.Now())
+
+		if l.paused {
+			continue
+		}
+		if !l.send(gaugeEnvelope(gauge.Origin, l.typedName(gauge.Name, "g"), gauge.Value, timestamp)) {
+			return
+		}
+		l.countEmitted("g")
+	}
+	l.Infof("StatsdListener: Reloaded %d gauges from %s", len(snapshot.Gauges), l.gaugeSnapshotFile)
+}
+
+// writeGaugeSnapshot replaces the snapshot file with the current gauges. It
+// writes a temporary file next to it first, so that a crash while writing
+// leaves the previous snapshot intact.
+func (l *StatsdListener) writeGaugeSnapshot() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.gaugeSnapshotFile == "" {
+		return
+	}
+
+	snapshot := GaugeSnapshot{Gauges: make([]SnapshotGauge, 0, len(l.gaugeKeys))}
+	for key, gauge := range l.gaugeKeys {
+		snapshot.Gauges = append(snapshot.Gauges, SnapshotGauge{Origin: gauge.origin, Name: gauge.name, Value: l.gaugeValues[key]})
+	}
+	sort.Sort(byOriginAndName(snapshot.Gauges))
+
+	if err := writeFileAtomically(l.gaugeSnapshotFile, snapshot); err != nil {
+		l.Errorf("StatsdListener: Failed to write the gauge snapshot: %s", err)
+		return
+	}
+	l.Infof("StatsdListener: Wrote %d gauges to %s", len(snapshot.Gauges), l.gaugeSnapshotFile)
+}
+
+func writeFileAtomically(path string, snapshot GaugeSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+type byOriginAndName []SnapshotGauge
+
+func (gauges byOriginAndName) Len() int      { return len(gauges) }
+func (gauges byOriginAndName) Swap(i, j int) { gauges[i], gauges[j] = gauges[j], gauges[i] }
+func (gauges byOriginAndName) Less(i, j int) bool {
+	if gauges[i].Origin != gauges[j].Origin {
+		return gauges[i].Origin < gauges[j].Origin
+	}
+	return gauges[i].Name < gauges[j].Name
+}
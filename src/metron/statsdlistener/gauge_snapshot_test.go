@@ -0,0 +1,141 @@
+package statsdlistener_test
+
+import (
+	"io/ioutil"
+	"metron/statsdlistener"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Gauge snapshot", func() {
+	var (
+		snapshotDir  string
+		snapshotFile string
+		envelopeChan chan *events.Envelope
+	)
+
+	// runListener runs a listener configured by configure until stop is
+	// called, sending the given packets once it is listening.
+	runListener := func(configure func(*statsdlistener.StatsdListener), packets ...string) (stop func()) {
+		loggertesthelper.TestLoggerSink.Clear()
+		listener := statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		configure(&listener)
+
+		wg := stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		connection, err := net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+		for _, packet := range packets {
+			_, err := connection.Write([]byte(packet))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		return func() {
+			connection.Close()
+			stopAndWait(func() { listener.Stop() }, wg)
+		}
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	BeforeEach(func() {
+		var err error
+		snapshotDir, err = ioutil.TempDir("", "gauge-snapshot")
+		Expect(err).NotTo(HaveOccurred())
+		snapshotFile = filepath.Join(snapshotDir, "gauges.json")
+		envelopeChan = make(chan *events.Envelope, 20)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(snapshotDir)
+	})
+
+	It("round-trips the gauges across a restart", func() {
+		snapshotting := func(listener *statsdlistener.StatsdListener) {
+			listener.SetGaugeSnapshotFile(snapshotFile)
+			listener.SetReloadGaugeSnapshot(true)
+		}
+
+		stop := runListener(snapshotting, "fake.origin.with.dots.test.gauge:5|g\nfake.origin.with.dots.test.gauge:+2|g\nother-origin.load:0.5|g\nother-origin.requests:3|c")
+		checkValueMetric(receive(), "fake", "origin.with.dots.test.gauge", 5, "gauge")
+		checkValueMetric(receive(), "fake", "origin.with.dots.test.gauge", 7, "gauge")
+		checkValueMetric(receive(), "other-origin", "load", 0.5, "gauge")
+		checkValueMetric(receive(), "other-origin", "requests", 3, "counter")
+		stop()
+
+		snapshot, err := statsdlistener.ReadGaugeSnapshot(snapshotFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshot.Gauges).To(Equal([]statsdlistener.SnapshotGauge{
+			{Origin: "fake", Name: "origin.with.dots.test.gauge", Value: 7},
+			{Origin: "other-origin", Name: "load", Value: 0.5},
+		}))
+
+		stop = runListener(snapshotting)
+		checkValueMetric(receive(), "fake", "origin.with.dots.test.gauge", 7, "gauge")
+		checkValueMetric(receive(), "other-origin", "load", 0.5, "gauge")
+		stop()
+	})
+
+	It("keeps accumulating increments onto the reloaded values", func() {
+		snapshotting := func(listener *statsdlistener.StatsdListener) {
+			listener.SetGaugeSnapshotFile(snapshotFile)
+			listener.SetReloadGaugeSnapshot(true)
+		}
+
+		stop := runListener(snapshotting, "fake-origin.test.gauge:5|g")
+		checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		stop()
+
+		stop = runListener(snapshotting, "fake-origin.test.gauge:+3|g")
+		checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		checkValueMetric(receive(), "fake-origin", "test.gauge", 8, "gauge")
+		stop()
+	})
+
+	It("does not reload the snapshot unless asked to", func() {
+		stop := runListener(func(listener *statsdlistener.StatsdListener) {
+			listener.SetGaugeSnapshotFile(snapshotFile)
+		}, "fake-origin.test.gauge:5|g")
+		checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		stop()
+		Expect(snapshotFile).To(BeAnExistingFile())
+
+		stop = runListener(func(listener *statsdlistener.StatsdListener) {
+			listener.SetGaugeSnapshotFile(snapshotFile)
+		})
+		Consistently(envelopeChan).ShouldNot(Receive())
+		stop()
+	})
+
+	It("starts without gauges when there is no snapshot yet", func() {
+		stop := runListener(func(listener *statsdlistener.StatsdListener) {
+			listener.SetGaugeSnapshotFile(snapshotFile)
+			listener.SetReloadGaugeSnapshot(true)
+		})
+		Consistently(envelopeChan).ShouldNot(Receive())
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("No gauge snapshot found"))
+		stop()
+	})
+
+	It("writes no snapshot by default", func() {
+		stop := runListener(func(*statsdlistener.StatsdListener) {}, "fake-origin.test.gauge:5|g")
+		checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		stop()
+
+		files, err := ioutil.ReadDir(snapshotDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
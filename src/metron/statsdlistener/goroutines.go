@@ -0,0 +1,61 @@
+package statsdlistener
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const goroutineUnit = "count"
+
+// SetGoroutineReportInterval makes the listener report, once per interval,
+// how many goroutines it is running: the reader, the goroutine closing the
+// socket on Stop and one per flusher. The report is a ValueMetric named
+// "goroutines" with the listener's name as origin. The count is expected to
+// stay constant while the listener runs, so a growing count points to a leak.
+// A zero interval disables the report.
+func (l *StatsdListener) SetGoroutineReportInterval(interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.goroutineReportInterval = interval
+	l.notifyReconfigured()
+}
+
+// Goroutines returns the number of goroutines the listener is running.
+func (l *StatsdListener) Goroutines() int {
+	return int(atomic.LoadInt64(l.goroutines))
+}
+
+// spawn runs f in a goroutine that is counted while it runs.
+func (l *StatsdListener) spawn(f func()) {
+	atomic.AddInt64(l.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(l.goroutines, -1)
+		f()
+	}()
+}
+
+func (l *StatsdListener) flushGoroutines(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		return false
+	}
+
+	l.send(&events.Envelope{
+		Origin:    proto.String(l.origin),
+		Timestamp: proto.Int64(time.Now().UnixNano()),
+		EventType: events.Envelope_ValueMetric.Enum(),
+
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String("goroutines"),
+			Value: proto.Float64(float64(l.Goroutines())),
+			Unit:  proto.String(goroutineUnit),
+		},
+	})
+	return true
+}
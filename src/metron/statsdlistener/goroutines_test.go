@@ -0,0 +1,65 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Goroutine report", func() {
+	// the reader, the goroutine emitting resumed lines and closing the
+	// socket and the flushers of counters, sample rates, timers, gauges,
+	// counter resets, parse latency and this report
+	const runningGoroutines = 9
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+	)
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetGoroutineReportInterval(100 * time.Millisecond)
+		envelopeChan = make(chan *events.Envelope, 10)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+	})
+
+	AfterEach(func() {
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("reports the goroutines the listener runs on every flush", func() {
+		for i := 0; i < 3; i++ {
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "name", "goroutines", runningGoroutines, "count")
+		}
+	})
+
+	It("keeps the count when the flush intervals change", func() {
+		listener.SetCounterRateInterval(50 * time.Millisecond)
+		listener.SetSampleRateReportInterval(0)
+		listener.SetCounterRateInterval(0)
+
+		Consistently(listener.Goroutines).Should(Equal(runningGoroutines))
+	})
+
+	It("counts none once stopped", func() {
+		Eventually(listener.Goroutines).Should(Equal(runningGoroutines))
+
+		stopAndWait(func() { listener.Stop() }, wg)
+
+		Eventually(listener.Goroutines).Should(BeZero())
+	})
+})
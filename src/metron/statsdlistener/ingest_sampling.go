@@ -0,0 +1,137 @@
+package statsdlistener
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// IngestSampling downsamples the counter lines of Origin to Rate: lines sent
+// at a higher sample rate, such as unsampled lines, are dropped so that the
+// ones kept are as many as if they had been sent at Rate, and their values
+// are scaled as if they had been. Lines sent at Rate or lower are left
+// as they are.
+type IngestSampling struct {
+	Origin string
+	Rate   float64
+}
+
+// IngestSamplingMode controls how the lines kept by ingest sampling are
+// picked.
+type IngestSamplingMode int
+
+const (
+	// RandomIngestSampling keeps lines with the listener's random source.
+	RandomIngestSampling IngestSamplingMode = iota
+	// HashIngestSampling keeps lines by a hash of their origin, name and
+	// how many lines of the name were received before, so the same lines are
+	// kept every time the same sequence of lines is received.
+	HashIngestSampling
+)
+
+func ParseIngestSamplingMode(mode string) (IngestSamplingMode, error) {
+	switch mode {
+	case "", "random":
+		return RandomIngestSampling, nil
+	case "hash":
+		return HashIngestSampling, nil
+	default:
+		return RandomIngestSampling, fmt.Errorf("Unknown statsd ingest sampling mode '%s', must be random or hash", mode)
+	}
+}
+
+// ValidateIngestSampling checks that every sampling for SetIngestSampling has
+// an origin and a rate greater than 0 and at most 1.
+func ValidateIngestSampling(samplings []IngestSampling) error {
+	for _, sampling := range samplings {
+		if sampling.Origin == "" || sampling.Rate <= 0 || sampling.Rate > 1 {
+			return fmt.Errorf("Statsd ingest sampling %+v must have an origin and a rate greater than 0 and at most 1", sampling)
+		}
+	}
+	return nil
+}
+
+// SetIngestSampling makes the listener downsample the counter lines of the
+// origins of samplings, picking the lines it keeps according to mode.
+// Gauges and timers are never sampled, as their values cannot be scaled.
+// The lines dropped are counted, see IngestSampledOutLines.
+func (l *StatsdListener) SetIngestSampling(samplings []IngestSampling, mode IngestSamplingMode) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.setIngestSampling(samplings, mode)
+}
+
+// setIngestSampling must be called with the lock held.
+func (l *StatsdListener) setIngestSampling(samplings []IngestSampling, mode IngestSamplingMode) {
+	l.ingestSamplingRates = make(map[string]float64, len(samplings))
+	for _, sampling := range samplings {
+		l.ingestSamplingRates[sampling.Origin] = sampling.Rate
+	}
+	l.ingestSamplingMode = mode
+}
+
+// SetRandSource replaces the source RandomIngestSampling picks lines with
+// and timer aggregation replaces samples with. It must be called before Run.
+func (l *StatsdListener) SetRandSource(source rand.Source) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.rand = rand.New(source)
+}
+
+// IngestSampledOutLines returns the number of lines ingest sampling dropped.
+func (l *StatsdListener) IngestSampledOutLines() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.ingestSampledOutLines
+}
+
+// sampleAtIngest must be called with the lock held. It returns false for a
+// line to drop, and otherwise lowers the sample rate of stat to the rate of
+// its origin if that is lower.
+func (l *StatsdListener) sampleAtIngest(origin string, name string, stat *Stat, statType string) bool {
+	if statType != "c" {
+		return true
+	}
+	rate, ok := l.ingestSamplingRates[origin]
+	if !ok || stat.SampleRate <= rate {
+		return true
+	}
+
+	keep := rate / stat.SampleRate
+	var pick float64
+	if l.ingestSamplingMode == HashIngestSampling {
+		key := fmt.Sprintf("%s.%s", origin, name)
+		sequence := l.ingestSequences[key]
+		l.ingestSequences[key] = sequence + 1
+
+		hash := fnv.New64a()
+		hash.Write([]byte(key + "#" + strconv.FormatUint(sequence, 10)))
+		pick = float64(mix(hash.Sum64())) / math.MaxUint64
+	} else {
+		pick = l.rand.Float64()
+	}
+
+	if pick >= keep {
+		l.ingestSampledOutLines++
+		return false
+	}
+	stat.SampleRate = rate
+	return true
+}
+
+// mix is the finalizer of MurmurHash3. FNV spreads a change in the last bytes
+// of its input, such as in the sequence number, over few of the high bits the
+// pick is mostly made of, so they are mixed into all of them.
+func mix(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
@@ -0,0 +1,175 @@
+package statsdlistener_test
+
+import (
+	"math/rand"
+	"metron/statsdlistener"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// countingSource counts how often it is drawn from.
+type countingSource struct {
+	rand.Source
+	draws int64
+}
+
+func (s *countingSource) Int63() int64 {
+	atomic.AddInt64(&s.draws, 1)
+	return s.Source.Int63()
+}
+
+var _ = Describe("Ingest sampling", func() {
+	const lines = 1000
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	// sendLines sends count copies of line, a few dozen per packet.
+	sendLines := func(line string, count int) {
+		for sent := 0; sent < count; sent += 50 {
+			batch := 50
+			if count-sent < batch {
+				batch = count - sent
+			}
+			_, err := connection.Write([]byte(strings.Repeat(line+"\n", batch)))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	// receiveAll returns the envelopes emitted for lines sent in total, once
+	// every line was either emitted or sampled out.
+	receiveAll := func(sent int) []*events.Envelope {
+		var envelopes []*events.Envelope
+		Eventually(func() int {
+			for {
+				select {
+				case envelope := <-envelopeChan:
+					envelopes = append(envelopes, envelope)
+				default:
+					return len(envelopes) + listener.IngestSampledOutLines()
+				}
+			}
+		}).Should(Equal(sent))
+		return envelopes
+	}
+
+	run := func(configure func()) {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		configure()
+		envelopeChan = make(chan *events.Envelope, 2*lines)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("drops the expected fraction of unsampled counter lines and scales the values of the others", func() {
+		run(func() {
+			listener.SetIngestSampling([]statsdlistener.IngestSampling{{Origin: "noisy", Rate: 0.1}}, statsdlistener.RandomIngestSampling)
+			listener.SetRandSource(rand.NewSource(1))
+		})
+
+		sendLines("noisy.requests:1|c", lines)
+		envelopes := receiveAll(lines)
+
+		kept := len(envelopes)
+		Expect(kept).To(BeNumerically("~", lines/10, lines/40))
+		Expect(listener.IngestSampledOutLines()).To(Equal(lines - kept))
+		checkValueMetric(envelopes[0], "noisy", "requests", 10, "counter")
+		checkValueMetric(envelopes[kept-1], "noisy", "requests", float64(10*kept), "counter")
+	})
+
+	It("downsamples lines sampled at a higher rate only by the remaining factor", func() {
+		run(func() {
+			listener.SetIngestSampling([]statsdlistener.IngestSampling{{Origin: "noisy", Rate: 0.1}}, statsdlistener.RandomIngestSampling)
+			listener.SetRandSource(rand.NewSource(1))
+		})
+
+		sendLines("noisy.requests:1|c|@0.5", lines)
+		envelopes := receiveAll(lines)
+
+		kept := len(envelopes)
+		Expect(kept).To(BeNumerically("~", lines/5, lines/20))
+		checkValueMetric(envelopes[0], "noisy", "requests", 10, "counter")
+	})
+
+	It("leaves lines sampled at the rate or lower, other origins, gauges and timers alone", func() {
+		run(func() {
+			listener.SetIngestSampling([]statsdlistener.IngestSampling{{Origin: "noisy", Rate: 0.1}}, statsdlistener.RandomIngestSampling)
+		})
+
+		sendLines("noisy.requests:1|c|@0.05", 10)
+		sendLines("quiet.requests:1|c", 10)
+		sendLines("noisy.memory:5|g", 10)
+		sendLines("noisy.latency:5|ms", 10)
+
+		Expect(receiveAll(40)).To(HaveLen(40))
+		Expect(listener.IngestSampledOutLines()).To(BeZero())
+	})
+
+	It("picks the lines by hash without drawing from the random source", func() {
+		source := &countingSource{Source: rand.NewSource(1)}
+		run(func() {
+			listener.SetIngestSampling([]statsdlistener.IngestSampling{{Origin: "noisy", Rate: 0.1}}, statsdlistener.HashIngestSampling)
+			listener.SetRandSource(source)
+		})
+
+		sendLines("noisy.requests:1|c", lines)
+		envelopes := receiveAll(lines)
+
+		kept := len(envelopes)
+		Expect(kept).To(BeNumerically("~", lines/10, lines/40))
+		checkValueMetric(envelopes[kept-1], "noisy", "requests", float64(10*kept), "counter")
+		Expect(atomic.LoadInt64(&source.draws)).To(BeZero())
+	})
+})
+
+var _ = Describe("ParseIngestSamplingMode", func() {
+	It("parses the modes", func() {
+		Expect(statsdlistener.ParseIngestSamplingMode("random")).To(Equal(statsdlistener.RandomIngestSampling))
+		Expect(statsdlistener.ParseIngestSamplingMode("hash")).To(Equal(statsdlistener.HashIngestSampling))
+	})
+
+	It("defaults to random", func() {
+		Expect(statsdlistener.ParseIngestSamplingMode("")).To(Equal(statsdlistener.RandomIngestSampling))
+	})
+
+	It("returns an error for an unknown mode", func() {
+		_, err := statsdlistener.ParseIngestSamplingMode("modulo")
+		Expect(err).To(MatchError("Unknown statsd ingest sampling mode 'modulo', must be random or hash"))
+	})
+})
+
+var _ = Describe("ValidateIngestSampling", func() {
+	It("accepts rates greater than 0 and at most 1", func() {
+		Expect(statsdlistener.ValidateIngestSampling([]statsdlistener.IngestSampling{{Origin: "a", Rate: 0.01}, {Origin: "b", Rate: 1}})).To(Succeed())
+	})
+
+	It("rejects samplings without an origin or with a rate out of range", func() {
+		Expect(statsdlistener.ValidateIngestSampling([]statsdlistener.IngestSampling{{Rate: 0.5}})).NotTo(Succeed())
+		Expect(statsdlistener.ValidateIngestSampling([]statsdlistener.IngestSampling{{Origin: "a", Rate: 0}})).NotTo(Succeed())
+		Expect(statsdlistener.ValidateIngestSampling([]statsdlistener.IngestSampling{{Origin: "a", Rate: 1.5}})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,104 @@
+package statsdlistener
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stat holds the fields of a single parsed statsd line.
+type Stat struct {
+	Origin        string
+	Name          string
+	IncrementSign string
+	Value         float64
+	Type          string
+	SampleRate    float64
+
+	// Timestamp is the send time reported by the client, in nanoseconds
+	// since the epoch. It is zero when the line carries no timestamp.
+	Timestamp int64
+
+	// Tags holds labels attached to the stat, if the format supports them.
+	Tags map[string]string
+
+	// Cumulative marks counter values that are already running totals. They
+	// replace the accumulated counter value instead of being added to it.
+	Cumulative bool
+}
+
+// LineParser turns a single line into a Stat. Parse returns a nil Stat and a
+// nil error for lines that carry no stat, such as comments.
+type LineParser interface {
+	Parse(line string) (*Stat, error)
+}
+
+type statsdLineParser struct{}
+
+// NewStatsdLineParser returns the default parser. It accepts lines of the
+// form "origin.name:value|type[|@sampleRate][|Ttimestamp]", where the
+// optional timestamp is the client's send time in (fractional) unix seconds.
+// Any lowercase type is parsed; the listener decides how to handle types
+// other than ms, g and c. Lines with a blank name are rejected.
+func NewStatsdLineParser() LineParser {
+	return statsdLineParser{}
+}
+
+var statsdRegexp = regexp.MustCompile(`([^.]+)\.([^:]+):([+-]?)(\d+(\.\d+)?)\|([a-z]+)(\|@(\d+(\.\d+)?))?(\|T(\d+(\.\d+)?))?`)
+
+func (statsdLineParser) Parse(line string) (*Stat, error) {
+	parts := statsdRegexp.FindStringSubmatch(line)
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("Input line '%s' was not a valid statsd line.", line)
+	}
+
+	// complete matched string = parts[0]
+	origin := parts[1]
+	name := parts[2]
+	incrementSign := parts[3]
+	valueString := parts[4]
+	// decimal part of valueString = parts[5]
+	statType := parts[6]
+	// full sampling substring = parts[7]
+	sampleRateString := parts[8]
+	// decimal part of sampleRate = parts[9]
+	// full timestamp substring = parts[10]
+	timestampString := parts[11]
+	timestampFraction := parts[12]
+
+	// a blank name would key the stat under an empty map entry; a blank
+	// origin is left to the listener, which applies the default origin and
+	// the origin rules
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("Input line '%s' has an empty name.", line)
+	}
+
+	value, _ := strconv.ParseFloat(valueString, 64)
+
+	var sampleRate float64
+	if len(sampleRateString) != 0 {
+		sampleRate, _ = strconv.ParseFloat(sampleRateString, 64)
+	} else {
+		sampleRate = 1
+	}
+
+	var timestamp int64
+	if len(timestampString) != 0 {
+		seconds, _ := strconv.ParseInt(strings.TrimSuffix(timestampString, timestampFraction), 10, 64)
+		fraction, _ := strconv.ParseFloat("0"+timestampFraction, 64)
+		timestamp = seconds*int64(time.Second) + int64(fraction*float64(time.Second))
+	}
+
+	return &Stat{
+		Origin:        origin,
+		Name:          name,
+		IncrementSign: incrementSign,
+		Value:         value,
+		Type:          statType,
+		SampleRate:    sampleRate,
+		Timestamp:     timestamp,
+	}, nil
+}
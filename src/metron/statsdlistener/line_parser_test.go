@@ -0,0 +1,73 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StatsdLineParser", func() {
+	var parser statsdlistener.LineParser
+
+	BeforeEach(func() {
+		parser = statsdlistener.NewStatsdLineParser()
+	})
+
+	It("parses a plain statsd line", func() {
+		stat, err := parser.Parse("fake-origin.test.gauge:-23.5|g")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*stat).To(Equal(statsdlistener.Stat{
+			Origin:        "fake-origin",
+			Name:          "test.gauge",
+			IncrementSign: "-",
+			Value:         23.5,
+			Type:          "g",
+			SampleRate:    1,
+		}))
+	})
+
+	It("parses the sample rate", func() {
+		stat, err := parser.Parse("fake-origin.test.counter:7|c|@0.5")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.SampleRate).To(Equal(0.5))
+		Expect(stat.Timestamp).To(BeZero())
+	})
+
+	It("parses an optional send timestamp", func() {
+		stat, err := parser.Parse("fake-origin.test.timing:42|ms|T1420070400")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Timestamp).To(Equal(int64(1420070400000000000)))
+		Expect(stat.SampleRate).To(Equal(float64(1)))
+	})
+
+	It("parses a fractional send timestamp after the sample rate", func() {
+		stat, err := parser.Parse("fake-origin.test.timing:42|ms|@0.1|T1420070400.25")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.SampleRate).To(Equal(0.1))
+		Expect(stat.Timestamp).To(Equal(int64(1420070400250000000)))
+	})
+
+	It("parses types it does not know", func() {
+		stat, err := parser.Parse("fake-origin.test.histogram:5|h")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Type).To(Equal("h"))
+	})
+
+	It("leaves a blank origin to the listener", func() {
+		stat, err := parser.Parse(" .test.gauge:23|g")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Origin).To(Equal(" "))
+		Expect(stat.Name).To(Equal("test.gauge"))
+	})
+
+	It("returns an error for a line with a blank name", func() {
+		_, err := parser.Parse("fake-origin. :23|g")
+		Expect(err).To(MatchError("Input line 'fake-origin. :23|g' has an empty name."))
+	})
+
+	It("returns an error for an invalid line", func() {
+		_, err := parser.Parse("not a statsd line")
+		Expect(err).To(MatchError("Input line 'not a statsd line' was not a valid statsd line."))
+	})
+})
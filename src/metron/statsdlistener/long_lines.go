@@ -0,0 +1,85 @@
+package statsdlistener
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// LongLinePolicy controls what happens to lines longer than the maximum line
+// length.
+type LongLinePolicy int
+
+const (
+	// RejectLongLines drops the line.
+	RejectLongLines LongLinePolicy = iota
+	// TruncateLongLines shortens the name of the stat by as many bytes as
+	// the line is too long. Lines that would be left without a name are
+	// dropped.
+	TruncateLongLines
+)
+
+func ParseLongLinePolicy(policy string) (LongLinePolicy, error) {
+	switch policy {
+	case "", "reject":
+		return RejectLongLines, nil
+	case "truncate":
+		return TruncateLongLines, nil
+	default:
+		return RejectLongLines, fmt.Errorf("Unknown statsd long line policy '%s', must be reject or truncate", policy)
+	}
+}
+
+// SetMaxLineLength limits the length of lines in bytes, handling longer lines
+// according to policy. Zero means no limit.
+func (l *StatsdListener) SetMaxLineLength(maxLength int, policy LongLinePolicy) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.maxLineLength = maxLength
+	l.longLinePolicy = policy
+}
+
+// RejectedLongLines returns the number of lines dropped for exceeding the
+// maximum line length.
+func (l *StatsdListener) RejectedLongLines() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rejectedLongLines
+}
+
+// TruncatedLongLines returns the number of lines whose name was truncated to
+// fit the maximum line length.
+func (l *StatsdListener) TruncatedLongLines() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.truncatedLongLines
+}
+
+// fitLineLength must be called with the lock held. It reports whether the
+// stat parsed from line is kept, truncating its name if the policy says so.
+func (l *StatsdListener) fitLineLength(line string, stat *Stat) bool {
+	excess := len(line) - l.maxLineLength
+	if l.maxLineLength <= 0 || excess <= 0 {
+		return true
+	}
+
+	if l.longLinePolicy == TruncateLongLines && excess < len(stat.Name) {
+		end := len(stat.Name) - excess
+		for end > 0 && !utf8.RuneStart(stat.Name[end]) {
+			end--
+		}
+		if end > 0 {
+			stat.Name = stat.Name[:end]
+			l.truncatedLongLines++
+			return true
+		}
+	}
+
+	if l.rejectedLongLines == 0 {
+		l.Warnf("StatsdListener: Dropping lines longer than %d bytes, such as one of %d bytes starting with \"%.64s\"", l.maxLineLength, len(line), line)
+	}
+	l.rejectedLongLines++
+	return false
+}
@@ -0,0 +1,142 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Long lines", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	start := func(maxLength int, policy statsdlistener.LongLinePolicy) {
+		listener.SetMaxLineLength(maxLength, policy)
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	// longName makes "fake-origin.<longName>:1|g" 100 bytes long.
+	longName := "test." + strings.Repeat("x", 100-len("fake-origin.test.:1|g"))
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("keeps long lines without a maximum line length", func() {
+		start(0, statsdlistener.RejectLongLines)
+		send("fake-origin." + longName + ":1|g")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", longName, 1, "gauge")
+	})
+
+	Context("with the reject policy", func() {
+		It("drops lines longer than the maximum and counts them", func() {
+			start(60, statsdlistener.RejectLongLines)
+			send("fake-origin." + longName + ":1|g\nfake-origin.test.gauge:2|g")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 2, "gauge")
+			Consistently(envelopeChan).ShouldNot(Receive())
+
+			Expect(listener.RejectedLongLines()).To(Equal(1))
+			Expect(listener.TruncatedLongLines()).To(BeZero())
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Dropping lines longer than 60 bytes, such as one of 100 bytes"))
+		})
+
+		It("keeps lines of exactly the maximum length", func() {
+			start(100, statsdlistener.RejectLongLines)
+			send("fake-origin." + longName + ":1|g")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", longName, 1, "gauge")
+			Expect(listener.RejectedLongLines()).To(BeZero())
+		})
+	})
+
+	Context("with the truncate policy", func() {
+		It("truncates the name of lines longer than the maximum to fit", func() {
+			start(60, statsdlistener.TruncateLongLines)
+			send("fake-origin." + longName + ":1|g")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", longName[:len(longName)-40], 1, "gauge")
+			Expect(len("fake-origin." + receivedEnvelope.GetValueMetric().GetName() + ":1|g")).To(Equal(60))
+
+			Expect(listener.TruncatedLongLines()).To(Equal(1))
+			Expect(listener.RejectedLongLines()).To(BeZero())
+		})
+
+		It("tracks truncated names under the truncated name for the key limit", func() {
+			listener.SetMaxKeys(1)
+			start(60, statsdlistener.TruncateLongLines)
+			send("fake-origin." + longName + ":1|g\nfake-origin." + longName + "y:2|g")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", longName[:len(longName)-40], 1, "gauge")
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", longName[:len(longName)-40], 2, "gauge")
+			Expect(listener.DroppedKeyLines()).To(BeZero())
+		})
+
+		It("drops lines that are too long even without a name", func() {
+			start(25, statsdlistener.TruncateLongLines)
+			send("fake-origin.test.gauge:1234567890|g")
+
+			Consistently(envelopeChan).ShouldNot(Receive())
+			Expect(listener.RejectedLongLines()).To(Equal(1))
+			Expect(listener.TruncatedLongLines()).To(BeZero())
+		})
+	})
+
+})
+
+var _ = Describe("ParseLongLinePolicy", func() {
+	It("parses the policies", func() {
+		Expect(statsdlistener.ParseLongLinePolicy("reject")).To(Equal(statsdlistener.RejectLongLines))
+		Expect(statsdlistener.ParseLongLinePolicy("truncate")).To(Equal(statsdlistener.TruncateLongLines))
+	})
+
+	It("defaults to rejecting", func() {
+		Expect(statsdlistener.ParseLongLinePolicy("")).To(Equal(statsdlistener.RejectLongLines))
+	})
+
+	It("returns an error for an unknown policy", func() {
+		_, err := statsdlistener.ParseLongLinePolicy("shorten")
+		Expect(err).To(MatchError("Unknown statsd long line policy 'shorten', must be reject or truncate"))
+	})
+})
@@ -0,0 +1,40 @@
+package statsdlistener
+
+// SetMaxKeys limits the number of distinct counter, gauge and, while timers
+// are aggregated, timer names, keyed by origin and name, the listener keeps
+// state for. Once the limit is reached, lines for new names are dropped while
+// known names keep updating. Zero means no limit.
+func (l *StatsdListener) SetMaxKeys(maxKeys int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.maxKeys = maxKeys
+}
+
+// DroppedKeyLines returns the number of lines dropped because their name
+// would have exceeded the key limit.
+func (l *StatsdListener) DroppedKeyLines() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.droppedKeyLines
+}
+
+// admitKey must be called with the lock held. It reports whether key is
+// already tracked or there is still room to track it.
+func (l *StatsdListener) admitKey(key string) bool {
+	if l.maxKeys <= 0 || l.trackedKeys[key] {
+		return true
+	}
+
+	if len(l.trackedKeys) >= l.maxKeys {
+		if l.droppedKeyLines == 0 {
+			l.Warnf("StatsdListener: Reached the maximum of %d distinct metric names, dropping lines for new names such as \"%s\"", l.maxKeys, key)
+		}
+		l.droppedKeyLines++
+		return false
+	}
+
+	l.trackedKeys[key] = true
+	return true
+}
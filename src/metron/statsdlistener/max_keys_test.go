@@ -0,0 +1,106 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Max keys", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetMaxKeys(2)
+		envelopeChan = make(chan *events.Envelope, 10)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("drops new names once the limit is reached while known names keep updating", func() {
+		send("fake-origin.test.gauge:23|g\nfake-origin.test.counter:1|c\nfake-origin.new.gauge:5|g\nfake-origin.test.gauge:42|g\nfake-origin.test.counter:2|c")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 23, "gauge")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 1, "counter")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 42, "gauge")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 3, "counter")
+
+		Expect(listener.DroppedKeyLines()).To(Equal(1))
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Reached the maximum of 2 distinct metric names"))
+	})
+
+	It("counts the same name from different origins as different keys", func() {
+		send("origin-a.test.gauge:1|g\norigin-b.test.gauge:2|g\norigin-c.test.gauge:3|g")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "origin-a", "test.gauge", 1, "gauge")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "origin-b", "test.gauge", 2, "gauge")
+
+		Eventually(listener.DroppedKeyLines).Should(Equal(1))
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+
+	It("does not limit timers, which keep no state", func() {
+		send("fake-origin.a.gauge:1|g\nfake-origin.b.gauge:2|g\nfake-origin.test.timer:200|ms")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.timer", 200, "ms")
+
+		Expect(listener.DroppedKeyLines()).To(Equal(0))
+	})
+
+	It("limits timers while they are aggregated, as they keep samples", func() {
+		listener.SetTimerAggregation(time.Hour, []float64{50}, 10)
+		send("fake-origin.a.gauge:1|g\nfake-origin.b.gauge:2|g\nfake-origin.test.timer:200|ms")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+
+		Eventually(listener.DroppedKeyLines).Should(Equal(1))
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,45 @@
+package statsdlistener
+
+import (
+	"strings"
+)
+
+// SetFoldNameCase makes the listener fold the names of stats to lower case,
+// so that emitters inconsistent about casing, sending both "App.Requests" and
+// "app.requests", accumulate into one stat. Origin rules are matched against
+// the folded name. Tags are left unchanged. By default names are kept as
+// sent.
+func (l *StatsdListener) SetFoldNameCase(fold bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.foldNameCase = fold
+}
+
+// SetFoldOriginCase makes the listener fold the origins of stats to lower
+// case, after origin rules and the default origin are applied, so that stats
+// sent with differently cased origins accumulate into one. The origins of
+// ingest sampling rates must then be lower case to match. By default origins
+// are kept as sent.
+func (l *StatsdListener) SetFoldOriginCase(fold bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.foldOriginCase = fold
+}
+
+// foldName must be called with the lock held.
+func (l *StatsdListener) foldName(name string) string {
+	if !l.foldNameCase {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
+// foldOrigin must be called with the lock held.
+func (l *StatsdListener) foldOrigin(origin string) string {
+	if !l.foldOriginCase {
+		return origin
+	}
+	return strings.ToLower(origin)
+}
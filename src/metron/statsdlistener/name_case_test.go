@@ -0,0 +1,114 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Name case folding", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 20)
+	})
+
+	JustBeforeEach(func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("keeps the casing of names and origins by default", func() {
+		send("fake-origin.App.Requests:3|c\nfake-origin.app.requests:4|c\nFake-Origin.app.requests:5|c")
+
+		checkValueMetric(receive(), "fake-origin", "App.Requests", 3, "counter")
+		checkValueMetric(receive(), "fake-origin", "app.requests", 4, "counter")
+		checkValueMetric(receive(), "Fake-Origin", "app.requests", 5, "counter")
+	})
+
+	Context("when folding names", func() {
+		BeforeEach(func() {
+			listener.SetFoldNameCase(true)
+		})
+
+		It("accumulates counters sent with differently cased names into one", func() {
+			send("fake-origin.App.Requests:3|c\nfake-origin.app.requests:4|c\nfake-origin.APP.REQUESTS:5|c")
+
+			checkValueMetric(receive(), "fake-origin", "app.requests", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "app.requests", 7, "counter")
+			checkValueMetric(receive(), "fake-origin", "app.requests", 12, "counter")
+		})
+
+		It("accumulates gauges sent with differently cased names into one", func() {
+			send("fake-origin.Queue.Depth:5|g\nfake-origin.queue.depth:+2|g")
+
+			checkValueMetric(receive(), "fake-origin", "queue.depth", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "queue.depth", 7, "gauge")
+		})
+
+		It("keeps the casing of origins", func() {
+			send("Fake-Origin.App.Requests:3|c\nfake-origin.app.requests:4|c")
+
+			checkValueMetric(receive(), "Fake-Origin", "app.requests", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "app.requests", 4, "counter")
+		})
+
+		It("counts the folded names once against the key limit", func() {
+			listener.SetMaxKeys(1)
+			send("fake-origin.App.Requests:3|c\nfake-origin.app.requests:4|c\nfake-origin.other:1|c")
+
+			checkValueMetric(receive(), "fake-origin", "app.requests", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "app.requests", 7, "counter")
+			Consistently(envelopeChan).ShouldNot(Receive())
+		})
+	})
+
+	Context("when folding names and origins", func() {
+		BeforeEach(func() {
+			listener.SetFoldNameCase(true)
+			listener.SetFoldOriginCase(true)
+		})
+
+		It("accumulates stats sent with differently cased origins into one", func() {
+			send("Fake-Origin.App.Requests:3|c\nfake-origin.app.requests:4|c\nFAKE-ORIGIN.app.Requests:5|c")
+
+			checkValueMetric(receive(), "fake-origin", "app.requests", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "app.requests", 7, "counter")
+			checkValueMetric(receive(), "fake-origin", "app.requests", 12, "counter")
+		})
+	})
+})
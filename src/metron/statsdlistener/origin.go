@@ -0,0 +1,67 @@
+package statsdlistener
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OriginRule attributes the stats whose name starts with Prefix to Origin, in
+// place of the origin they were sent with.
+type OriginRule struct {
+	Prefix string
+	Origin string
+}
+
+// ValidateOriginRules checks that every rule for SetOriginRules has a prefix
+// and an origin.
+func ValidateOriginRules(rules []OriginRule) error {
+	for _, rule := range rules {
+		if rule.Prefix == "" || strings.TrimSpace(rule.Origin) == "" {
+			return fmt.Errorf("Statsd origin rule %+v must have a prefix and an origin", rule)
+		}
+	}
+	return nil
+}
+
+// SetOriginRules makes the listener attribute stats to the origin of the
+// first of rules whose prefix their name starts with, such as "tenantA" for
+// a name like "tenantA.requests", so that a metron shared by several tenants
+// emits their stats under their own origins. The name is matched without the
+// origin it was sent with and emitted unchanged. The values are accumulated
+// per resulting origin.
+func (l *StatsdListener) SetOriginRules(rules []OriginRule) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.originRules = rules
+}
+
+// SetDefaultOrigin sets the origin used for lines that parse to an empty
+// origin, such as Prometheus lines with an empty origin label. Dropsonde
+// drops envelopes without an origin, so with no default origin, the
+// default, these lines are rejected instead.
+func (l *StatsdListener) SetDefaultOrigin(origin string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.defaultOrigin = origin
+}
+
+// statOrigin must be called with the lock held.
+func (l *StatsdListener) statOrigin(stat *Stat) (string, error) {
+	for _, rule := range l.originRules {
+		if strings.HasPrefix(stat.Name, rule.Prefix) {
+			return rule.Origin, nil
+		}
+	}
+
+	if strings.TrimSpace(stat.Origin) != "" {
+		return stat.Origin, nil
+	}
+
+	if l.defaultOrigin == "" {
+		return "", errors.New("Stat has an empty origin and no default origin is configured.")
+	}
+	return l.defaultOrigin, nil
+}
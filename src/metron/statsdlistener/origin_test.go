@@ -0,0 +1,192 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Empty origins", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	start := func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetLineParser(statsdlistener.NewPrometheusLineParser("prometheus-origin"))
+		envelopeChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	Context("without a default origin", func() {
+		BeforeEach(start)
+
+		It("rejects lines with an empty origin", func() {
+			send("empty_gauge{origin=\"\"} 23\nblank_gauge{origin=\" \"} 5\nvalid_gauge 42")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "prometheus-origin", "valid_gauge", 42, "gauge")
+			Consistently(envelopeChan).ShouldNot(Receive())
+
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Error parsing stat line \"empty_gauge{origin=\"\"} 23\": Stat has an empty origin and no default origin is configured."))
+		})
+	})
+
+	Context("with a default origin", func() {
+		BeforeEach(func() {
+			listener.SetDefaultOrigin("default-origin")
+			start()
+		})
+
+		It("uses the default origin for lines with an empty origin", func() {
+			send("empty_gauge{origin=\"\"} 23\nlabelled_gauge{origin=\"app\"} 5\nvalid_gauge 42")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "default-origin", "empty_gauge", 23, "gauge")
+
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "app", "labelled_gauge", 5, "gauge")
+
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "prometheus-origin", "valid_gauge", 42, "gauge")
+		})
+
+		It("keeps the state of defaulted lines under the default origin", func() {
+			send("requests_total{origin=\"\"} 3\nrequests_total{origin=\"\"} 7")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "default-origin", "requests_total", 7, "counter")
+		})
+	})
+
+	Context("with the statsd parser and a default origin", func() {
+		BeforeEach(func() {
+			listener.SetLineParser(statsdlistener.NewStatsdLineParser())
+			listener.SetDefaultOrigin("default-origin")
+			start()
+		})
+
+		It("uses the default origin for lines with a blank origin", func() {
+			send(" .test.gauge:23|g")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "default-origin", "test.gauge", 23, "gauge")
+		})
+	})
+})
+
+var _ = Describe("Origin rules", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetOriginRules([]statsdlistener.OriginRule{
+			{Prefix: "tenantA.", Origin: "tenantA"},
+			{Prefix: "tenantB.", Origin: "tenantB"},
+		})
+		envelopeChan = make(chan *events.Envelope, 10)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("attributes the stats to the origin of the rule matching their name", func() {
+		send("job.tenantA.requests:1|c\njob.tenantB.load:5|g\njob.unrouted.requests:2|c")
+
+		checkValueMetric(receive(), "tenantA", "tenantA.requests", 1, "counter")
+		checkValueMetric(receive(), "tenantB", "tenantB.load", 5, "gauge")
+		checkValueMetric(receive(), "job", "unrouted.requests", 2, "counter")
+	})
+
+	It("accumulates the stats under the origin of the rule", func() {
+		send("job.tenantA.requests:1|c\nother-job.tenantA.requests:2|c\njob.tenantB.requests:4|c")
+
+		checkValueMetric(receive(), "tenantA", "tenantA.requests", 1, "counter")
+		checkValueMetric(receive(), "tenantA", "tenantA.requests", 3, "counter")
+		checkValueMetric(receive(), "tenantB", "tenantB.requests", 4, "counter")
+	})
+
+	It("applies the rules to lines with a blank origin", func() {
+		send(" .tenantA.requests:1|c")
+
+		checkValueMetric(receive(), "tenantA", "tenantA.requests", 1, "counter")
+	})
+
+	It("applies the first matching rule", func() {
+		listener.SetOriginRules([]statsdlistener.OriginRule{
+			{Prefix: "tenantA.", Origin: "tenantA"},
+			{Prefix: "tenant", Origin: "tenants"},
+		})
+		send("job.tenantA.requests:1|c\njob.tenantC.requests:1|c")
+
+		checkValueMetric(receive(), "tenantA", "tenantA.requests", 1, "counter")
+		checkValueMetric(receive(), "tenants", "tenantC.requests", 1, "counter")
+	})
+
+	It("validates the rules", func() {
+		Expect(statsdlistener.ValidateOriginRules([]statsdlistener.OriginRule{{Prefix: "tenantA.", Origin: "tenantA"}})).To(Succeed())
+		Expect(statsdlistener.ValidateOriginRules([]statsdlistener.OriginRule{{Prefix: "", Origin: "tenantA"}})).NotTo(Succeed())
+		Expect(statsdlistener.ValidateOriginRules([]statsdlistener.OriginRule{{Prefix: "tenantA.", Origin: " "}})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,79 @@
+package statsdlistener
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const parseLatencyUnit = "ns"
+
+// SetParseLatencyInterval makes the listener time how long it takes to
+// parse every line and report, once per interval, the mean and the maximum
+// parse time over the interval. The reports are ValueMetrics named
+// "parseLatency.mean" and "parseLatency.max", in nanoseconds, with the
+// listener's name as origin. Nothing is reported for an interval without
+// lines. A zero interval disables the timing and the report.
+func (l *StatsdListener) SetParseLatencyInterval(interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.parseLatencyInterval = interval
+	l.notifyReconfigured()
+}
+
+// timedParseStat must be called with the lock held. It parses like parseStat
+// and records the time taken while parse latency is reported.
+func (l *StatsdListener) timedParseStat(data string, receivedAt int64) ([]*events.Envelope, string, error) {
+	if l.parseLatencyInterval <= 0 {
+		return l.parseStat(data, receivedAt)
+	}
+
+	start := l.clock.Now()
+	envelopes, statType, err := l.parseStat(data, receivedAt)
+	latency := l.clock.Now().Sub(start)
+
+	l.parsedLines++
+	l.parseLatencySum += latency
+	if latency > l.parseLatencyMax {
+		l.parseLatencyMax = latency
+	}
+	return envelopes, statType, err
+}
+
+func (l *StatsdListener) flushParseLatency(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		return false
+	}
+
+	parsedLines, sum, max := l.parsedLines, l.parseLatencySum, l.parseLatencyMax
+	l.parsedLines, l.parseLatencySum, l.parseLatencyMax = 0, 0, 0
+	if parsedLines == 0 {
+		return true
+	}
+
+	timestamp := time.Now().UnixNano()
+	mean := float64(sum.Nanoseconds()) / float64(parsedLines)
+	if l.send(l.parseLatencyEnvelope("parseLatency.mean", mean, timestamp)) {
+		l.send(l.parseLatencyEnvelope("parseLatency.max", float64(max.Nanoseconds()), timestamp))
+	}
+	return true
+}
+
+func (l *StatsdListener) parseLatencyEnvelope(name string, value float64, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(l.origin),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_ValueMetric.Enum(),
+
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(value),
+			Unit:  proto.String(parseLatencyUnit),
+		},
+	}
+}
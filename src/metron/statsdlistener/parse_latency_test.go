@@ -0,0 +1,157 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// timingClock advances by the next of its steps every time it is read, so
+// that a line parsed between two reads appears to take that step.
+type timingClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	steps []time.Duration
+	reads int
+}
+
+func (c *timingClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now
+	c.now = c.now.Add(c.steps[c.reads%len(c.steps)])
+	c.reads++
+	return now
+}
+
+func (c *timingClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var _ = Describe("Parse latency", func() {
+	const interval = 100 * time.Millisecond
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	// receiveLatencies skips the envelopes of the lines sent and returns the
+	// next parse latency report, keyed by metric name
+	receiveLatencies := func() map[string]float64 {
+		latencies := make(map[string]float64)
+		for len(latencies) < 2 {
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan, 2*interval).Should(Receive(&receivedEnvelope))
+			if receivedEnvelope.GetOrigin() != "name" {
+				continue
+			}
+			Expect(receivedEnvelope.GetValueMetric().GetUnit()).To(Equal("ns"))
+			latencies[receivedEnvelope.GetValueMetric().GetName()] = receivedEnvelope.GetValueMetric().GetValue()
+		}
+		return latencies
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetParseLatencyInterval(interval)
+		envelopeChan = make(chan *events.Envelope, 100)
+	})
+
+	JustBeforeEach(func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	Context("with a clock that times every parse", func() {
+		BeforeEach(func() {
+			// the clock is read before and after every parse, so the
+			// lines take 2µs and 6µs in turn
+			listener.SetClock(&timingClock{
+				now:   time.Unix(1444990000, 0),
+				steps: []time.Duration{2 * time.Microsecond, 0, 6 * time.Microsecond, 0},
+			})
+		})
+
+		It("reports the mean and maximum parse time over the interval", func() {
+			send("fake-origin.test.gauge:1|g\nfake-origin.test.gauge:2|g\nfake-origin.test.gauge:3|g\nfake-origin.test.gauge:4|g")
+
+			Expect(receiveLatencies()).To(Equal(map[string]float64{
+				"parseLatency.mean": 4000,
+				"parseLatency.max":  6000,
+			}))
+		})
+
+		It("times the lines that fail to parse as well", func() {
+			send("fake-origin.test.gauge:1|g\nnot a stat")
+
+			Expect(receiveLatencies()).To(Equal(map[string]float64{
+				"parseLatency.mean": 4000,
+				"parseLatency.max":  6000,
+			}))
+		})
+
+		It("only reports the lines parsed during the interval", func() {
+			send("fake-origin.test.gauge:1|g\nfake-origin.test.gauge:2|g")
+			Expect(receiveLatencies()).To(HaveKeyWithValue("parseLatency.max", 6000.0))
+
+			send("fake-origin.test.gauge:3|g")
+			Expect(receiveLatencies()).To(Equal(map[string]float64{
+				"parseLatency.mean": 2000,
+				"parseLatency.max":  2000,
+			}))
+		})
+	})
+
+	It("reports plausible parse times on the wall clock", func() {
+		send("fake-origin.test.counter:1|c\nfake-origin.test.timer:10|ms\nfake-origin.test.gauge:23|g")
+
+		latencies := receiveLatencies()
+		Expect(latencies["parseLatency.mean"]).To(BeNumerically(">", 0))
+		Expect(latencies["parseLatency.mean"]).To(BeNumerically("<=", latencies["parseLatency.max"]))
+		Expect(latencies["parseLatency.max"]).To(BeNumerically("<", float64(time.Second)))
+	})
+
+	It("reports nothing for an interval without lines", func() {
+		Consistently(envelopeChan, 3*interval).ShouldNot(Receive())
+	})
+
+	Context("without a parse latency interval", func() {
+		BeforeEach(func() {
+			listener.SetParseLatencyInterval(0)
+		})
+
+		It("does not report parse latency", func() {
+			send("fake-origin.test.gauge:1|g")
+
+			Eventually(envelopeChan).Should(Receive())
+			Consistently(envelopeChan, 3*interval).ShouldNot(Receive())
+		})
+	})
+})
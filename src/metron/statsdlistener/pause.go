@@ -0,0 +1,118 @@
+package statsdlistener
+
+import (
+	"time"
+)
+
+type PausePolicy int
+
+const (
+	// DiscardWhilePaused drops every line received while paused. Counters
+	// and gauges do not accumulate until the listener is resumed.
+	DiscardWhilePaused PausePolicy = iota
+	// BufferWhilePaused keeps up to maxPausedLines lines received while
+	// paused and processes them, in order, after Resume, before any line
+	// received later. The oldest lines are dropped once the buffer is full.
+	BufferWhilePaused
+)
+
+const maxPausedLines = 10000
+
+// Pause stops the listener from emitting envelopes without closing its
+// socket. Packets are still read while paused, so the kernel buffer does not
+// fill up; what happens to their lines depends on the pause policy.
+func (l *StatsdListener) Pause() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.paused {
+		return
+	}
+
+	l.paused = true
+	l.Infof("StatsdListener: Paused (%s)", l.pausePolicy)
+}
+
+func (l *StatsdListener) Resume() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.paused {
+		return
+	}
+
+	l.paused = false
+	l.Infof("StatsdListener: Resumed")
+
+	if l.droppedWhilePaused > 0 {
+		l.Warnf("StatsdListener: Dropped %d lines while paused", l.droppedWhilePaused)
+		l.droppedWhilePaused = 0
+	}
+
+	l.signalResumed()
+}
+
+func (l *StatsdListener) IsPaused() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.paused
+}
+
+func (l *StatsdListener) SetPausePolicy(policy PausePolicy) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.pausePolicy = policy
+}
+
+func (p PausePolicy) String() string {
+	switch p {
+	case BufferWhilePaused:
+		return "buffering"
+	default:
+		return "discarding"
+	}
+}
+
+func (l *StatsdListener) bufferLine(line string) {
+	if len(l.pausedLines) >= maxPausedLines {
+		l.deadLetter(l.pausedLines[0], ReasonPaused)
+		l.pausedLines = l.pausedLines[1:]
+		l.droppedWhilePaused++
+	}
+	l.pausedLines = append(l.pausedLines, line)
+}
+
+// signalResumed must be called with the lock held. It has Run emit the
+// lines buffered while paused, so that Resume does not wait for them to be
+// sent.
+func (l *StatsdListener) signalResumed() {
+	if len(l.pausedLines) == 0 {
+		return
+	}
+
+	select {
+	case l.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// emitPausedLines must be called with the line lock held. It emits the lines
+// buffered while paused one at a time, taking the lock for each, until the
+// listener is paused again. Lines stay buffered until Run has provided an
+// output channel, and are stamped with the time they are emitted.
+func (l *StatsdListener) emitPausedLines() {
+	for {
+		l.lock.Lock()
+		if l.paused || l.outputChan == nil || len(l.pausedLines) == 0 {
+			l.lock.Unlock()
+			return
+		}
+
+		line := l.pausedLines[0]
+		l.pausedLines = l.pausedLines[1:]
+		l.emitLine(line, time.Now().UnixNano())
+		l.unlockAndSend()
+	}
+}
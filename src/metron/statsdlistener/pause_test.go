@@ -0,0 +1,152 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pause and Resume", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope)
+	})
+
+	JustBeforeEach(func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("is not paused initially", func() {
+		Expect(listener.IsPaused()).To(BeFalse())
+	})
+
+	It("does not emit envelopes while paused", func() {
+		listener.Pause()
+		Expect(listener.IsPaused()).To(BeTrue())
+
+		send("fake-origin.test.gauge:23|g")
+
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+
+	It("emits envelopes again after resuming", func() {
+		listener.Pause()
+		listener.Resume()
+		Expect(listener.IsPaused()).To(BeFalse())
+
+		send("fake-origin.test.gauge:23|g")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 23, "gauge")
+	})
+
+	It("does not wait for a slow consumer to pause or report", func() {
+		send("fake-origin.test.gauge:23|g")
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Read 27 bytes"))
+
+		done := make(chan struct{})
+		go func() {
+			listener.Pause()
+			listener.IsPaused()
+			listener.Emit()
+			close(done)
+		}()
+		Eventually(done).Should(BeClosed())
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 23, "gauge")
+	})
+
+	Context("with the default discard policy", func() {
+		It("drains and drops packets received while paused", func() {
+			listener.Pause()
+			send("fake-origin.test.counter:23|c")
+			Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Read 29 bytes"))
+
+			listener.Resume()
+			send("fake-origin.test.counter:7|c")
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 7, "counter")
+			Consistently(envelopeChan).ShouldNot(Receive())
+		})
+	})
+
+	Context("with the buffering policy", func() {
+		BeforeEach(func() {
+			listener.SetPausePolicy(statsdlistener.BufferWhilePaused)
+		})
+
+		It("emits the lines received while paused, in order, on resume", func() {
+			listener.Pause()
+			send("fake-origin.test.counter:23|c\nfake-origin.test.gauge:5|g")
+			send("fake-origin.test.counter:7|c")
+			Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Read 28 bytes"))
+			Consistently(envelopeChan).ShouldNot(Receive())
+
+			go listener.Resume()
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 23, "counter")
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 5, "gauge")
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 30, "counter")
+
+			Eventually(listener.IsPaused).Should(BeFalse())
+		})
+
+		It("resumes without waiting for the lines received while paused to be sent", func() {
+			listener.Pause()
+			send("fake-origin.test.counter:23|c\nfake-origin.test.gauge:5|g")
+			Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Read 56 bytes"))
+
+			done := make(chan struct{})
+			go func() {
+				listener.Resume()
+				close(done)
+			}()
+			Eventually(done).Should(BeClosed())
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 23, "counter")
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 5, "gauge")
+		})
+	})
+})
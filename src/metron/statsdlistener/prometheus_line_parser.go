@@ -0,0 +1,210 @@
+package statsdlistener
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const originLabel = "origin"
+
+var (
+	prometheusNameRegexp  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	prometheusLabelRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+	prometheusTypeRegexp  = regexp.MustCompile(`^#\s*TYPE\s+([a-zA-Z_:][a-zA-Z0-9_:]*)\s+(counter|gauge|summary|histogram|untyped)\s*$`)
+)
+
+var prometheusCounterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+type prometheusLineParser struct {
+	origin string
+
+	lock      sync.Mutex
+	typeHints map[string]string
+}
+
+// NewPrometheusLineParser returns a parser for lines in the Prometheus text
+// exposition format, "metric_name{label="value",...} value [timestamp_ms]".
+// Labels become tags; an "origin" label overrides the given default origin.
+//
+// Counters and gauges are told apart by a preceding "# TYPE" hint for the
+// metric, or failing that by the name: samples ending in _total, _count,
+// _sum or _bucket are counters, everything else is a gauge. Counter values
+// are running totals and replace the accumulated value rather than adding to
+// it. Other comment and blank lines carry no stat.
+func NewPrometheusLineParser(origin string) LineParser {
+	return &prometheusLineParser{
+		origin:    origin,
+		typeHints: make(map[string]string),
+	}
+}
+
+func (p *prometheusLineParser) Parse(line string) (*Stat, error) {
+	line = strings.TrimSpace(line)
+
+	if line == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(line, "#") {
+		if parts := prometheusTypeRegexp.FindStringSubmatch(line); parts != nil {
+			p.lock.Lock()
+			p.typeHints[parts[1]] = parts[2]
+			p.lock.Unlock()
+		}
+		return nil, nil
+	}
+
+	name := prometheusNameRegexp.FindString(line)
+	if name == "" {
+		return nil, invalidPrometheusLine(line, "missing metric name")
+	}
+	rest := line[len(name):]
+
+	tags := make(map[string]string)
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		rest, err = parsePrometheusLabels(rest[1:], tags)
+		if err != nil {
+			return nil, invalidPrometheusLine(line, err.Error())
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 || !strings.HasPrefix(rest, " ") && !strings.HasPrefix(rest, "\t") {
+		return nil, invalidPrometheusLine(line, "expected a value and an optional timestamp")
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, invalidPrometheusLine(line, "invalid value "+fields[0])
+	}
+
+	var timestamp int64
+	if len(fields) == 2 {
+		milliseconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, invalidPrometheusLine(line, "invalid timestamp "+fields[1])
+		}
+		timestamp = milliseconds * int64(time.Millisecond)
+	}
+
+	origin := p.origin
+	if labelOrigin, ok := tags[originLabel]; ok {
+		origin = labelOrigin
+		delete(tags, originLabel)
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	stat := &Stat{
+		Origin:     origin,
+		Name:       name,
+		Value:      value,
+		Type:       "g",
+		SampleRate: 1,
+		Timestamp:  timestamp,
+		Tags:       tags,
+	}
+
+	if p.isCounter(name, tags) {
+		stat.Type = "c"
+		stat.Cumulative = true
+	}
+
+	return stat, nil
+}
+
+func (p *prometheusLineParser) isCounter(name string, tags map[string]string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if hint, ok := p.typeHints[name]; ok {
+		return hint == "counter"
+	}
+
+	for _, suffix := range prometheusCounterSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		switch p.typeHints[strings.TrimSuffix(name, suffix)] {
+		case "gauge", "untyped":
+			return false
+		case "summary":
+			return suffix != "_bucket"
+		}
+		return true
+	}
+
+	return false
+}
+
+// parsePrometheusLabels reads label pairs up to and including the closing
+// brace and returns the remainder of the line.
+func parsePrometheusLabels(input string, tags map[string]string) (string, error) {
+	for {
+		input = strings.TrimLeft(input, " \t")
+		if strings.HasPrefix(input, "}") {
+			return input[1:], nil
+		}
+
+		label := prometheusLabelRegexp.FindString(input)
+		if label == "" {
+			return "", fmt.Errorf("invalid label name")
+		}
+		input = strings.TrimLeft(input[len(label):], " \t")
+
+		if !strings.HasPrefix(input, `="`) {
+			return "", fmt.Errorf("expected =\" after label %s", label)
+		}
+		input = input[2:]
+
+		value, rest, err := unquotePrometheusLabelValue(input)
+		if err != nil {
+			return "", fmt.Errorf("label %s: %s", label, err.Error())
+		}
+		tags[label] = value
+
+		input = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(input, ",") {
+			input = input[1:]
+		} else if !strings.HasPrefix(input, "}") {
+			return "", fmt.Errorf("expected , or } after label %s", label)
+		}
+	}
+}
+
+func unquotePrometheusLabelValue(input string) (string, string, error) {
+	var value []byte
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '"':
+			return string(value), input[i+1:], nil
+		case '\\':
+			i++
+			if i == len(input) {
+				return "", "", fmt.Errorf("unterminated escape")
+			}
+			switch input[i] {
+			case 'n':
+				value = append(value, '\n')
+			case '\\', '"':
+				value = append(value, input[i])
+			default:
+				return "", "", fmt.Errorf("invalid escape \\%c", input[i])
+			}
+		default:
+			value = append(value, input[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated value")
+}
+
+func invalidPrometheusLine(line string, reason string) error {
+	return fmt.Errorf("Input line '%s' was not a valid Prometheus exposition line: %s.", line, reason)
+}
@@ -0,0 +1,132 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PrometheusLineParser", func() {
+	var parser statsdlistener.LineParser
+
+	BeforeEach(func() {
+		parser = statsdlistener.NewPrometheusLineParser("fake-origin")
+	})
+
+	It("parses an unlabeled line", func() {
+		stat, err := parser.Parse("process_open_fds 42")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*stat).To(Equal(statsdlistener.Stat{
+			Origin:     "fake-origin",
+			Name:       "process_open_fds",
+			Value:      42,
+			Type:       "g",
+			SampleRate: 1,
+		}))
+	})
+
+	It("parses labels into tags", func() {
+		stat, err := parser.Parse(`http_requests_in_flight{method="post", path="/v2/apps"} 3.5`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Name).To(Equal("http_requests_in_flight"))
+		Expect(stat.Value).To(Equal(3.5))
+		Expect(stat.Tags).To(Equal(map[string]string{"method": "post", "path": "/v2/apps"}))
+	})
+
+	It("unescapes label values", func() {
+		stat, err := parser.Parse(`errors{message="say \"hi\"\\n\n",} 1`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Tags).To(Equal(map[string]string{"message": "say \"hi\"\\n\n"}))
+	})
+
+	It("uses the origin label as the origin", func() {
+		stat, err := parser.Parse(`up{origin="exporter",job="api"} 1`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Origin).To(Equal("exporter"))
+		Expect(stat.Tags).To(Equal(map[string]string{"job": "api"}))
+	})
+
+	It("parses an optional timestamp in milliseconds", func() {
+		stat, err := parser.Parse("process_open_fds 42 1420070400250")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Timestamp).To(Equal(int64(1420070400250000000)))
+	})
+
+	It("parses special float values", func() {
+		stat, err := parser.Parse(`request_duration_seconds_bucket{le="+Inf"} +Inf`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Value).To(BeNumerically(">", 1e308))
+	})
+
+	Describe("metric types", func() {
+		It("treats names with counter suffixes as cumulative counters", func() {
+			for _, name := range []string{"requests_total", "latency_count", "latency_sum", "latency_bucket"} {
+				stat, err := parser.Parse(name + " 7")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stat.Type).To(Equal("c"), name)
+				Expect(stat.Cumulative).To(BeTrue(), name)
+			}
+		})
+
+		It("treats other names as gauges", func() {
+			stat, err := parser.Parse("temperature_celsius 21")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat.Type).To(Equal("g"))
+			Expect(stat.Cumulative).To(BeFalse())
+		})
+
+		It("prefers a preceding TYPE hint over the suffix convention", func() {
+			stat, err := parser.Parse("# TYPE restarts counter")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat).To(BeNil())
+
+			stat, err = parser.Parse("# TYPE queue_total gauge")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat).To(BeNil())
+
+			stat, _ = parser.Parse("restarts 2")
+			Expect(stat.Type).To(Equal("c"))
+
+			stat, _ = parser.Parse("queue_total 2")
+			Expect(stat.Type).To(Equal("g"))
+		})
+
+		It("treats summary quantiles as gauges and their sums and counts as counters", func() {
+			parser.Parse("# TYPE rpc_duration_seconds summary")
+
+			stat, _ := parser.Parse(`rpc_duration_seconds{quantile="0.99"} 0.2`)
+			Expect(stat.Type).To(Equal("g"))
+
+			stat, _ = parser.Parse("rpc_duration_seconds_count 12")
+			Expect(stat.Type).To(Equal("c"))
+		})
+	})
+
+	It("returns no stat for comments and blank lines", func() {
+		for _, line := range []string{"", "   ", "# HELP process_open_fds Number of open file descriptors."} {
+			stat, err := parser.Parse(line)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat).To(BeNil())
+		}
+	})
+
+	It("returns an error for invalid lines", func() {
+		for _, line := range []string{
+			"42",
+			"no_value",
+			"no_value{}",
+			"bad_value abc",
+			"bad_timestamp 1 now",
+			"too_many_fields 1 2 3",
+			`unterminated{label="value} 1`,
+			`missing_quotes{label=value} 1`,
+			`bad_label{1abel="value"} 1`,
+			`missing_comma{a="1" b="2"} 1`,
+			`missing_space{a="1"}1`,
+		} {
+			_, err := parser.Parse(line)
+			Expect(err).To(HaveOccurred(), line)
+		}
+	})
+})
@@ -0,0 +1,56 @@
+package statsdlistener
+
+import (
+	"unicode/utf8"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// RawLineSourceType is the source type of the log messages carrying raw
+// statsd lines.
+const RawLineSourceType = "STATSD"
+
+// SetRawLineLogMessages makes the listener follow the envelopes of every line
+// it takes in with a LogMessage carrying the line as it was received, under
+// the origin the line's metric is emitted with, for audit trails. Lines the
+// listener drops, and timers whose raw values are dropped, get none. Counters
+// flushed at the counter rate interval get theirs when the line is received.
+// Lines whose name was truncated to the maximum line length are cut to that
+// length.
+func (l *StatsdListener) SetRawLineLogMessages(enabled bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.rawLineLogMessages = enabled
+}
+
+// withRawLine must be called with the lock held.
+func (l *StatsdListener) withRawLine(envelopes []*events.Envelope, origin string, line string, timestamp int64) []*events.Envelope {
+	if !l.rawLineLogMessages {
+		return envelopes
+	}
+	if l.maxLineLength > 0 && len(line) > l.maxLineLength {
+		end := l.maxLineLength
+		for end > 0 && !utf8.RuneStart(line[end]) {
+			end--
+		}
+		line = line[:end]
+	}
+	return append(envelopes, rawLineEnvelope(origin, line, timestamp))
+}
+
+func rawLineEnvelope(origin string, line string, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(origin),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_LogMessage.Enum(),
+
+		LogMessage: &events.LogMessage{
+			Message:     []byte(line),
+			MessageType: events.LogMessage_OUT.Enum(),
+			Timestamp:   proto.Int64(timestamp),
+			SourceType:  proto.String(RawLineSourceType),
+		},
+	}
+}
@@ -0,0 +1,133 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Raw line log messages", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	receiveRawLine := func(origin string, line string) {
+		envelope := receive()
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(envelope.GetOrigin()).To(Equal(origin))
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal(line))
+		Expect(envelope.GetLogMessage().GetMessageType()).To(Equal(events.LogMessage_OUT))
+		Expect(envelope.GetLogMessage().GetSourceType()).To(Equal(statsdlistener.RawLineSourceType))
+		Expect(envelope.GetLogMessage().GetTimestamp()).To(Equal(envelope.GetTimestamp()))
+	}
+
+	run := func(configure func()) {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		configure()
+		envelopeChan = make(chan *events.Envelope, 10)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("follows the metric of every line with the line as a LogMessage", func() {
+		run(func() { listener.SetRawLineLogMessages(true) })
+
+		send("fake-origin.test.gauge:5|g")
+		metric := receive()
+		checkValueMetric(metric, "fake-origin", "test.gauge", 5, "gauge")
+		receiveRawLine("fake-origin", "fake-origin.test.gauge:5|g")
+
+		send("fake-origin.test.counter:3|c|@0.5")
+		checkValueMetric(receive(), "fake-origin", "test.counter", 6, "counter")
+		receiveRawLine("fake-origin", "fake-origin.test.counter:3|c|@0.5")
+
+		Expect(listener.EmitCounts()).To(Equal(statsdlistener.EmitCounts{Counters: 2, Gauges: 2}))
+	})
+
+	It("emits the line under the origin the metric is emitted with", func() {
+		run(func() {
+			listener.SetRawLineLogMessages(true)
+			listener.SetOriginRules([]statsdlistener.OriginRule{{Prefix: "tenantA.", Origin: "tenant-a"}})
+		})
+
+		send("fake-origin.tenantA.requests:1|c")
+		checkValueMetric(receive(), "tenant-a", "tenantA.requests", 1, "counter")
+		receiveRawLine("tenant-a", "fake-origin.tenantA.requests:1|c")
+	})
+
+	It("emits the line of counters flushed at the counter rate interval right away", func() {
+		run(func() {
+			listener.SetRawLineLogMessages(true)
+			listener.SetCounterRateInterval(time.Hour)
+		})
+
+		send("fake-origin.test.counter:3|c")
+		receiveRawLine("fake-origin", "fake-origin.test.counter:3|c")
+	})
+
+	It("emits no line for lines the listener drops", func() {
+		run(func() {
+			listener.SetRawLineLogMessages(true)
+			listener.SetMaxKeys(1)
+		})
+
+		send("fake-origin.test.gauge:5|g")
+		receive()
+		receiveRawLine("fake-origin", "fake-origin.test.gauge:5|g")
+
+		send("fake-origin.other.gauge:5|g\nnot a statsd line")
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+
+	It("cuts the lines whose name was truncated to the maximum line length", func() {
+		run(func() {
+			listener.SetRawLineLogMessages(true)
+			listener.SetMaxLineLength(20, statsdlistener.TruncateLongLines)
+		})
+
+		send("fake-origin.test.gauge.long:5|g")
+		receive()
+		receiveRawLine("fake-origin", "fake-origin.test.gau")
+	})
+
+	It("emits only the metrics by default", func() {
+		run(func() {})
+
+		send("fake-origin.test.gauge:5|g")
+		checkValueMetric(receive(), "fake-origin", "test.gauge", 5, "gauge")
+		Consistently(envelopeChan).ShouldNot(Receive())
+	})
+})
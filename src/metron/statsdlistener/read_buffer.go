@@ -0,0 +1,53 @@
+package statsdlistener
+
+// DefaultReadBufferSize is the maximum size of a UDP payload, so that no
+// packet is cut short.
+const DefaultReadBufferSize = 65535
+
+// SetReadBufferSize sets the size in bytes of the buffer packets are read
+// into. Packets larger than the buffer are cut to its size by the kernel
+// without an error, so a smaller buffer only saves memory where the MTU
+// keeps packets small anyway. Zero means DefaultReadBufferSize. It must be
+// called before Run.
+func (l *StatsdListener) SetReadBufferSize(size int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.readBufferSize = size
+}
+
+// PossiblyTruncatedPackets returns the number of packets that filled the
+// whole read buffer and so may have been truncated.
+func (l *StatsdListener) PossiblyTruncatedPackets() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.possiblyTruncatedPackets
+}
+
+func (l *StatsdListener) newReadBuffer() []byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.readBufferSize <= 0 {
+		return make([]byte, DefaultReadBufferSize)
+	}
+	return make([]byte, l.readBufferSize)
+}
+
+// checkTruncation counts packets of readCount bytes that filled the whole
+// read buffer, as the bytes beyond it cannot be told apart from the end of
+// the packet.
+func (l *StatsdListener) checkTruncation(readCount int, readBuffer []byte, sender string) {
+	if readCount < len(readBuffer) {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.possiblyTruncatedPackets == 0 {
+		l.Warnf("StatsdListener: Packet from %s filled the read buffer of %d bytes and may have been truncated", sender, len(readBuffer))
+	}
+	l.possiblyTruncatedPackets++
+}
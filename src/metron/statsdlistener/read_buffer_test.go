@@ -0,0 +1,113 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Read buffer", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	start := func(size int) {
+		listener.SetReadBufferSize(size)
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	// line returns a gauge line of length bytes.
+	line := func(length int) string {
+		return "fake-origin.test." + strings.Repeat("x", length-len("fake-origin.test.:1|g")) + ":1|g"
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("reads packets up to the maximum UDP payload by default", func() {
+		start(0)
+		send(line(1000))
+
+		Eventually(envelopeChan).Should(Receive())
+		Expect(listener.PossiblyTruncatedPackets()).To(BeZero())
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).NotTo(ContainSubstring("truncated"))
+	})
+
+	Context("with a smaller buffer", func() {
+		BeforeEach(func() {
+			start(100)
+		})
+
+		It("does not warn about packets smaller than the buffer", func() {
+			send(line(99))
+
+			Eventually(envelopeChan).Should(Receive())
+			Expect(listener.PossiblyTruncatedPackets()).To(BeZero())
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).NotTo(ContainSubstring("truncated"))
+		})
+
+		It("warns about and counts packets filling the buffer", func() {
+			send(line(100))
+
+			Eventually(envelopeChan).Should(Receive())
+			Expect(listener.PossiblyTruncatedPackets()).To(Equal(1))
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("filled the read buffer of 100 bytes and may have been truncated"))
+		})
+
+		It("counts packets larger than the buffer, keeping the lines read completely", func() {
+			send(line(50) + "\n" + line(100))
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			Expect(receivedEnvelope.GetValueMetric().GetName()).To(HaveLen(len(line(50)) - len("fake-origin.:1|g")))
+			Eventually(listener.PossiblyTruncatedPackets).Should(Equal(1))
+		})
+
+		It("warns only about the first packet", func() {
+			send(line(100))
+			send(line(100))
+
+			Eventually(envelopeChan).Should(Receive())
+			Eventually(envelopeChan).Should(Receive())
+			Expect(listener.PossiblyTruncatedPackets()).To(Equal(2))
+			Expect(strings.Count(loggertesthelper.TestLoggerSink.LogContents(), "may have been truncated")).To(Equal(1))
+		})
+
+		It("emits the number of packets that may have been truncated", func() {
+			send(line(100))
+
+			Eventually(envelopeChan).Should(Receive())
+			Expect(listener.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "possiblyTruncatedPackets", Value: 1}))
+		})
+	})
+})
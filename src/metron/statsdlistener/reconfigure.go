@@ -0,0 +1,113 @@
+package statsdlistener
+
+import (
+	"time"
+)
+
+// StatsdListenerConfig holds the listener's settings, as read from metron's
+// config file.
+type StatsdListenerConfig struct {
+	Address                  string
+	TimestampSource          TimestampSource
+	CounterRateInterval      time.Duration
+	SampleRateReportInterval time.Duration
+	MaxKeys                  int
+	DefaultOrigin            string
+	OriginRules              []OriginRule
+	UnknownTypeFallback      UnknownTypeFallback
+	GaugeDeltaCounters       bool
+	RawLineLogMessages       bool
+	MaxLineLength            int
+	LongLinePolicy           LongLinePolicy
+	TimerAggregationInterval time.Duration
+	TimerPercentiles         []float64
+	MaxTimerSamples          int
+	DropRawTimers            bool
+	GoroutineReportInterval  time.Duration
+	ParseLatencyInterval     time.Duration
+	GaugeFlushInterval       time.Duration
+	GaugeFlushDeltas         bool
+	KeyTTL                   time.Duration
+	CounterResetThreshold    float64
+	CounterResetInterval     time.Duration
+	TypeNameTemplate         string
+	FoldNameCase             bool
+	FoldOriginCase           bool
+	IngestSampling           []IngestSampling
+	IngestSamplingMode       IngestSamplingMode
+}
+
+// Reconfigure applies config to the listener, also while it is running,
+// without closing its socket. Lines received from then on are handled with
+// the new settings. A changed flush interval flushes what was accumulated
+// over the current interval right away and then starts the new interval.
+// Lowering MaxKeys keeps the names already tracked, only new names are
+// dropped.
+//
+// Settings that only take effect after a restart, such as the address the
+// listener is bound to, are left unchanged. Reconfigure returns their names.
+func (l *StatsdListener) Reconfigure(config StatsdListenerConfig) (restartRequired []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if config.Address != l.host {
+		l.Warnf("StatsdListener: Changing the address from %s to %s requires a restart", l.host, config.Address)
+		restartRequired = append(restartRequired, "Address")
+	}
+
+	intervalsChanged := config.CounterRateInterval != l.counterRateInterval ||
+		config.SampleRateReportInterval != l.sampleRateReportInterval ||
+		config.TimerAggregationInterval != l.timerAggregationInterval ||
+		config.GoroutineReportInterval != l.goroutineReportInterval ||
+		config.ParseLatencyInterval != l.parseLatencyInterval ||
+		config.GaugeFlushInterval != l.gaugeFlushInterval ||
+		config.CounterResetInterval != l.counterResetInterval
+
+	l.timestampSource = config.TimestampSource
+	l.counterRateInterval = config.CounterRateInterval
+	l.sampleRateReportInterval = config.SampleRateReportInterval
+	l.maxKeys = config.MaxKeys
+	l.defaultOrigin = config.DefaultOrigin
+	l.originRules = config.OriginRules
+	l.unknownTypeFallback = config.UnknownTypeFallback
+	l.gaugeDeltaCounters = config.GaugeDeltaCounters
+	l.rawLineLogMessages = config.RawLineLogMessages
+	l.maxLineLength = config.MaxLineLength
+	l.longLinePolicy = config.LongLinePolicy
+	l.timerAggregationInterval = config.TimerAggregationInterval
+	l.timerPercentiles = config.TimerPercentiles
+	l.maxTimerSamples = config.MaxTimerSamples
+	l.dropRawTimers = config.DropRawTimers
+	l.goroutineReportInterval = config.GoroutineReportInterval
+	l.parseLatencyInterval = config.ParseLatencyInterval
+	l.gaugeFlushInterval = config.GaugeFlushInterval
+	l.gaugeFlushDeltas = config.GaugeFlushDeltas
+	l.keyTTL = config.KeyTTL
+	l.counterResetThreshold = config.CounterResetThreshold
+	l.counterResetInterval = config.CounterResetInterval
+	l.typeNameTemplate = config.TypeNameTemplate
+	l.foldNameCase = config.FoldNameCase
+	l.foldOriginCase = config.FoldOriginCase
+	l.setIngestSampling(config.IngestSampling, config.IngestSamplingMode)
+
+	if intervalsChanged {
+		l.notifyReconfigured()
+	}
+	return restartRequired
+}
+
+// notifyReconfigured must be called with the lock held. It wakes up the
+// flushers to pick up their new intervals.
+func (l *StatsdListener) notifyReconfigured() {
+	close(l.reconfigured)
+	l.reconfigured = make(chan struct{})
+}
+
+// flushInterval returns the current value of interval along with the channel
+// that is closed once it may have changed.
+func (l *StatsdListener) flushInterval(interval func() time.Duration) (time.Duration, <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return interval(), l.reconfigured
+}
@@ -0,0 +1,157 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconfigure", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		config       statsdlistener.StatsdListenerConfig
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		config = statsdlistener.StatsdListenerConfig{Address: "localhost:51162"}
+		listener = statsdlistener.NewStatsdListener(config.Address, loggertesthelper.Logger(), "name")
+		listener.Reconfigure(config)
+		envelopeChan = make(chan *events.Envelope, 10)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", config.Address)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("starts flushing counters once a counter flush interval is set", func() {
+		send("fake-origin.test.counter:3|c")
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 3, "counter")
+
+		config.CounterRateInterval = 100 * time.Millisecond
+		Expect(listener.Reconfigure(config)).To(BeEmpty())
+
+		send("fake-origin.test.counter:4|c")
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(receivedEnvelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(4))
+		Expect(receivedEnvelope.GetCounterEvent().GetTotal()).To(BeEquivalentTo(7))
+	})
+
+	It("flushes the current interval and switches to a shorter flush interval right away", func() {
+		config.CounterRateInterval = time.Hour
+		listener.Reconfigure(config)
+
+		send("fake-origin.test.counter:3|c")
+		Consistently(envelopeChan, 100*time.Millisecond).ShouldNot(Receive())
+
+		config.CounterRateInterval = 500 * time.Millisecond
+		listener.Reconfigure(config)
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan, 250*time.Millisecond).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetValueMetric().GetName()).To(Equal("test.counter.rate"))
+
+		Eventually(envelopeChan, time.Second).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(0))
+	})
+
+	It("flushes the pending counters when the counter flush interval is removed", func() {
+		config.CounterRateInterval = time.Hour
+		listener.Reconfigure(config)
+		send("fake-origin.test.counter:3|c")
+		Consistently(envelopeChan, 100*time.Millisecond).ShouldNot(Receive())
+
+		config.CounterRateInterval = 0
+		listener.Reconfigure(config)
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+		Eventually(envelopeChan).Should(Receive())
+
+		send("fake-origin.test.counter:4|c")
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 7, "counter")
+	})
+
+	It("applies a new key limit to the lines received from then on", func() {
+		config.MaxKeys = 1
+		listener.Reconfigure(config)
+
+		send("fake-origin.first.gauge:1|g")
+		send("fake-origin.second.gauge:2|g")
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "first.gauge", 1, "gauge")
+		Eventually(listener.DroppedKeyLines).Should(Equal(1))
+
+		config.MaxKeys = 0
+		listener.Reconfigure(config)
+
+		send("fake-origin.second.gauge:2|g")
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "second.gauge", 2, "gauge")
+	})
+
+	It("applies a new maximum line length to the lines received from then on", func() {
+		config.MaxLineLength = 30
+		config.LongLinePolicy = statsdlistener.RejectLongLines
+		listener.Reconfigure(config)
+
+		send("fake-origin.a.rather.long.gauge.name:1|g")
+		Eventually(listener.RejectedLongLines).Should(Equal(1))
+		Consistently(envelopeChan).ShouldNot(Receive())
+
+		config.MaxLineLength = 0
+		listener.Reconfigure(config)
+
+		send("fake-origin.a.rather.long.gauge.name:1|g")
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "a.rather.long.gauge.name", 1, "gauge")
+	})
+
+	It("reports a changed address as requiring a restart and keeps listening on the old one", func() {
+		config.Address = "localhost:51163"
+		config.GaugeDeltaCounters = true
+
+		Expect(listener.Reconfigure(config)).To(ConsistOf("Address"))
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Changing the address from localhost:51162 to localhost:51163 requires a restart"))
+
+		send("fake-origin.test.gauge:+2|g")
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 2, "gauge")
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		Expect(receivedEnvelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+	})
+})
@@ -0,0 +1,145 @@
+package statsdlistener_test
+
+import (
+	"io/ioutil"
+	"metron/statsdlistener"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeClock advances by the time waited for, right away, unless blocked.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waits   []time.Duration
+	blocked bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.waits = append(c.waits, d)
+	fired := make(chan time.Time, 1)
+	if !c.blocked {
+		c.now = c.now.Add(d)
+		fired <- c.now
+	}
+	return fired
+}
+
+func (c *fakeClock) Waits() []time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.waits
+}
+
+var _ = Describe("Replaying a capture", func() {
+	var (
+		captureDir  string
+		capturePath string
+		replayer    statsdlistener.StatsdListener
+		clock       *fakeClock
+		replayed    chan *events.Envelope
+	)
+
+	recordedAt := time.Unix(1420070400, 0)
+	offsets := []time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond, 350 * time.Millisecond}
+
+	replay := func() error {
+		file, err := os.Open(capturePath)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		return replayer.RunReader(file, replayed)
+	}
+
+	BeforeEach(func() {
+		var err error
+		captureDir, err = ioutil.TempDir("", "statsd-replay")
+		Expect(err).NotTo(HaveOccurred())
+		capturePath = filepath.Join(captureDir, "statsd.capture")
+
+		writer, err := statsdlistener.NewCaptureWriter(capturePath, 1024*1024, 1)
+		Expect(err).NotTo(HaveOccurred())
+		for _, offset := range offsets {
+			record := statsdlistener.CaptureRecord{ReceivedAt: recordedAt.Add(offset), Sender: "127.0.0.1:1234", Packet: []byte("fake-origin.test.gauge:23|g")}
+			Expect(writer.Write(record)).To(Succeed())
+		}
+		Expect(writer.Close()).To(Succeed())
+
+		clock = &fakeClock{now: time.Unix(1444990000, 0)}
+		replayer = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		replayer.SetClock(clock)
+		replayed = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(captureDir)
+	})
+
+	It("replays as fast as possible by default", func() {
+		Expect(replay()).To(Succeed())
+
+		Expect(replayed).To(HaveLen(len(offsets)))
+		Expect(clock.Waits()).To(BeEmpty())
+	})
+
+	It("keeps the recorded gaps between the packets at speed 1", func() {
+		replayer.SetReplaySpeed(1)
+		Expect(replay()).To(Succeed())
+
+		Expect(replayed).To(HaveLen(len(offsets)))
+		Expect(clock.Waits()).To(Equal([]time.Duration{100 * time.Millisecond, 250 * time.Millisecond}))
+	})
+
+	It("stamps the envelopes with the recorded receive times", func() {
+		replayer.SetReplaySpeed(1)
+		Expect(replay()).To(Succeed())
+
+		for _, offset := range offsets {
+			var envelope *events.Envelope
+			Expect(replayed).To(Receive(&envelope))
+			Expect(envelope.GetTimestamp()).To(Equal(recordedAt.Add(offset).UnixNano()))
+		}
+	})
+
+	It("shortens the gaps by the speed", func() {
+		replayer.SetReplaySpeed(2)
+		Expect(replay()).To(Succeed())
+
+		Expect(clock.Waits()).To(Equal([]time.Duration{50 * time.Millisecond, 125 * time.Millisecond}))
+	})
+
+	It("returns when stopped while waiting for the next packet", func() {
+		clock.blocked = true
+		replayer.SetReplaySpeed(1)
+
+		done := make(chan error)
+		go func() {
+			done <- replay()
+		}()
+		Eventually(clock.Waits).Should(HaveLen(1))
+		Expect(replayed).To(HaveLen(1))
+
+		replayer.Stop()
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(replayed).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,95 @@
+package statsdlistener
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const sampleRateUnit = "count"
+
+// SetSampleRateReportInterval makes the listener report, once per interval,
+// how many of the lines received during the interval were unsampled and how
+// many were sampled, the latter also broken down by sample rate. The reports
+// are ValueMetrics with the listener's name as origin:
+//
+//	unsampledLines
+//	sampledLines
+//	sampledLines{sampleRate="0.1"}
+//
+// A zero interval disables the reports.
+func (l *StatsdListener) SetSampleRateReportInterval(interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sampleRateReportInterval = interval
+	l.notifyReconfigured()
+}
+
+// tallySampleRate must be called with the lock held.
+func (l *StatsdListener) tallySampleRate(sampleRate float64) {
+	if l.sampleRateReportInterval <= 0 {
+		return
+	}
+	l.sampleRateTallies[sampleRate]++
+}
+
+func (l *StatsdListener) flushSampleRates(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		return false
+	}
+
+	tallies := l.sampleRateTallies
+	l.sampleRateTallies = make(map[float64]int)
+
+	for _, envelope := range sampleRateEnvelopes(l.origin, tallies, time.Now().UnixNano()) {
+		if !l.send(envelope) {
+			break
+		}
+	}
+	return true
+}
+
+func sampleRateEnvelopes(origin string, tallies map[float64]int, timestamp int64) []*events.Envelope {
+	rates := make([]float64, 0, len(tallies))
+	unsampled, sampled := 0, 0
+	for rate, count := range tallies {
+		if rate >= 1 {
+			unsampled += count
+			continue
+		}
+		sampled += count
+		rates = append(rates, rate)
+	}
+	sort.Float64s(rates)
+
+	envelopes := []*events.Envelope{
+		sampleRateEnvelope(origin, "unsampledLines", unsampled, timestamp),
+		sampleRateEnvelope(origin, "sampledLines", sampled, timestamp),
+	}
+	for _, rate := range rates {
+		name := "sampledLines" + formatTags(map[string]string{"sampleRate": strconv.FormatFloat(rate, 'g', -1, 64)})
+		envelopes = append(envelopes, sampleRateEnvelope(origin, name, tallies[rate], timestamp))
+	}
+	return envelopes
+}
+
+func sampleRateEnvelope(origin string, name string, count int, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(origin),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_ValueMetric.Enum(),
+
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(float64(count)),
+			Unit:  proto.String(sampleRateUnit),
+		},
+	}
+}
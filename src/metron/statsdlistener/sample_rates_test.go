@@ -0,0 +1,109 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sample rate reports", func() {
+	const interval = 200 * time.Millisecond
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	// receiveReport skips the metrics parsed from the lines and collects the
+	// next report, which is sent in one burst, keyed by metric name
+	receiveReport := func() map[string]float64 {
+		var receivedEnvelope *events.Envelope
+		Eventually(func() string {
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			return receivedEnvelope.GetValueMetric().GetName()
+		}).Should(Equal("unsampledLines"))
+
+		report := make(map[string]float64)
+		for {
+			Expect(receivedEnvelope.GetOrigin()).To(Equal("statsdAgentListener"))
+			Expect(receivedEnvelope.GetValueMetric().GetUnit()).To(Equal("count"))
+			report[receivedEnvelope.GetValueMetric().GetName()] = receivedEnvelope.GetValueMetric().GetValue()
+
+			select {
+			case receivedEnvelope = <-envelopeChan:
+			case <-time.After(interval / 4):
+				return report
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "statsdAgentListener")
+		listener.SetSampleRateReportInterval(interval)
+		envelopeChan = make(chan *events.Envelope, 100)
+
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("tallies unsampled and sampled lines by sample rate", func() {
+		send("fake-origin.a.gauge:1|g\nfake-origin.b.counter:1|c|@1\nfake-origin.c.counter:1|c|@0.1\nfake-origin.d.timer:5|ms|@0.5\nfake-origin.e.gauge:2|g|@0.1")
+
+		var report map[string]float64
+		Eventually(func() map[string]float64 {
+			report = receiveReport()
+			return report
+		}).Should(HaveKey(`sampledLines{sampleRate="0.1"}`))
+
+		Expect(report).To(Equal(map[string]float64{
+			"unsampledLines":                 2,
+			"sampledLines":                   3,
+			`sampledLines{sampleRate="0.1"}`: 2,
+			`sampledLines{sampleRate="0.5"}`: 1,
+		}))
+	})
+
+	It("resets the tallies after each report", func() {
+		send("fake-origin.c.counter:1|c|@0.1")
+		Eventually(receiveReport).Should(HaveKey(`sampledLines{sampleRate="0.1"}`))
+
+		Expect(receiveReport()).To(Equal(map[string]float64{
+			"unsampledLines": 0,
+			"sampledLines":   0,
+		}))
+	})
+
+	It("does not count unparseable lines", func() {
+		send("not a statsd line")
+
+		Expect(receiveReport()).To(Equal(map[string]float64{
+			"unsampledLines": 0,
+			"sampledLines":   0,
+		}))
+	})
+})
@@ -3,24 +3,149 @@ package statsdlistener
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
+	"metron/metrics"
 	"net"
-	"regexp"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 	"github.com/gogo/protobuf/proto"
 )
 
+type TimestampSource int
+
+const (
+	// ReceiveTime stamps envelopes with the time the line was received.
+	ReceiveTime TimestampSource = iota
+	// SendTime stamps envelopes with the client's send time when the line
+	// carries one, falling back to the receive time otherwise.
+	SendTime
+)
+
+func ParseTimestampSource(source string) (TimestampSource, error) {
+	switch source {
+	case "", "receive":
+		return ReceiveTime, nil
+	case "send":
+		return SendTime, nil
+	default:
+		return ReceiveTime, fmt.Errorf("Unknown statsd timestamp source '%s', must be receive or send", source)
+	}
+}
+
 type StatsdListener struct {
 	host     string
 	stopChan chan struct{}
+	stopOnce *sync.Once
+
+	parser          LineParser
+	timestampSource TimestampSource
+
+	lock               *sync.Mutex
+	outbox             []outgoingEnvelope // queued by send, sent by unlockAndSend
+	sendLock           *sync.Mutex        // held while sending to outputChan
+	lineLock           *sync.Mutex        // held while handling lines, keeping them in order
+	resumed            chan struct{}      // signalled when buffered lines are to be emitted
+	outputChan         chan *events.Envelope
+	outputDone         chan struct{}
+	outputClosed       bool // guarded by sendLock
+	outputCloseOnce    *sync.Once
+	paused             bool
+	pausePolicy        PausePolicy
+	pausedLines        []string
+	droppedWhilePaused int
 
 	gaugeValues   map[string]float64 // key is "origin.name"
 	counterValues map[string]float64 // key is "origin.name"
 
+	gaugeSnapshotFile   string
+	reloadGaugeSnapshot bool
+	gaugeKeys           map[string]gaugeKey // key is "origin.name"
+
+	reconfigured chan struct{} // closed and replaced when a flush interval changes
+
+	gaugeFlushInterval time.Duration
+	liveGauges         map[string]*liveGauge // key is "origin.name"
+	gaugeFlushDeltas   bool
+	keyTTL             time.Duration
+
+	counterRateInterval time.Duration
+	counterDeltas       map[string]*counterDelta // key is "origin.name"
+
+	counterResetThreshold float64
+	counterResetInterval  time.Duration
+	cumulativeCounters    map[string]bool // key is "origin.name"
+
+	sampleRateReportInterval time.Duration
+	sampleRateTallies        map[float64]int
+	origin                   string
+
+	maxKeys         int
+	trackedKeys     map[string]bool // key is "origin.name"
+	droppedKeyLines int
+
+	defaultOrigin string
+	originRules   []OriginRule
+
+	unknownTypeFallback UnknownTypeFallback
+
+	gaugeDeltaCounters bool
+
+	rawLineLogMessages bool
+
+	ingestSamplingRates   map[string]float64 // key is the origin
+	ingestSamplingMode    IngestSamplingMode
+	ingestSequences       map[string]uint64 // key is "origin.name"
+	ingestSampledOutLines int
+	rand                  *rand.Rand
+
+	typeNameTemplate string
+
+	foldNameCase   bool
+	foldOriginCase bool
+
+	timerAggregationInterval time.Duration
+	timerPercentiles         []float64
+	maxTimerSamples          int
+	timerSamples             map[string]*timerSamples // key is "origin.name"
+	reservoirSampledTimings  int
+	dropRawTimers            bool
+
+	maxLineLength      int
+	longLinePolicy     LongLinePolicy
+	rejectedLongLines  int
+	truncatedLongLines int
+
+	captureWriter *CaptureWriter
+	replaySpeed   float64
+	clock         Clock
+
+	readBufferSize           int
+	possiblyTruncatedPackets int
+
+	goroutineReportInterval time.Duration
+	goroutines              *int64
+
+	parseLatencyInterval time.Duration
+	parsedLines          int
+	parseLatencySum      time.Duration
+	parseLatencyMax      time.Duration
+
+	deadLetters          chan<- DeadLetter
+	discardedDeadLetters int
+
+	emitCounts EmitCounts
+
+	registry *metrics.Registry
+
 	*gosteno.Logger
 }
 
@@ -28,14 +153,43 @@ func NewStatsdListener(listenerAddress string, logger *gosteno.Logger, name stri
 	return StatsdListener{
 		host:     listenerAddress,
 		stopChan: make(chan struct{}),
+		stopOnce: &sync.Once{},
+
+		parser:          NewStatsdLineParser(),
+		lock:            &sync.Mutex{},
+		sendLock:        &sync.Mutex{},
+		lineLock:        &sync.Mutex{},
+		resumed:         make(chan struct{}, 1),
+		outputDone:      make(chan struct{}),
+		outputCloseOnce: &sync.Once{},
+		reconfigured:    make(chan struct{}),
 
 		gaugeValues:   make(map[string]float64),
 		counterValues: make(map[string]float64),
+		gaugeKeys:     make(map[string]gaugeKey),
+		liveGauges:    make(map[string]*liveGauge),
+		counterDeltas: make(map[string]*counterDelta),
+		trackedKeys:   make(map[string]bool),
+		timerSamples:  make(map[string]*timerSamples),
+		goroutines:    new(int64),
+		clock:         wallClock{},
+
+		cumulativeCounters: make(map[string]bool),
+
+		ingestSamplingRates: make(map[string]float64),
+		ingestSequences:     make(map[string]uint64),
+		rand:                rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		sampleRateTallies: make(map[float64]int),
+		origin:            name,
 
 		Logger: logger,
 	}
 }
 
+// Run listens for statsd lines and emits them on outputChan until Stop or
+// CloseOutput is called. Consumers must not close outputChan themselves while
+// Run is executing; CloseOutput closes it safely.
 func (l *StatsdListener) Run(outputChan chan *events.Envelope) {
 	udpAddr, err := net.ResolveUDPAddr("udp", l.host)
 	if err != nil {
@@ -48,14 +202,38 @@ func (l *StatsdListener) Run(outputChan chan *events.Envelope) {
 
 	l.Infof("Listening for statsd on host %s", l.host)
 
-	// Use max UDP size because we don't know how big the message is.
-	maxUDPsize := 65535
-	readBytes := make([]byte, maxUDPsize)
-
-	go func() {
-		<-l.stopChan
-		connection.Close()
-	}()
+	l.attachOutput(outputChan)
+	l.reloadGauges()
+	defer l.writeGaugeSnapshot()
+
+	atomic.AddInt64(l.goroutines, 1)
+	defer atomic.AddInt64(l.goroutines, -1)
+
+	var flushers sync.WaitGroup
+	defer flushers.Wait()
+	l.startFlusher(&flushers, func() time.Duration { return l.counterRateInterval }, l.flushCounters)
+	l.startFlusher(&flushers, func() time.Duration { return l.sampleRateReportInterval }, l.flushSampleRates)
+	l.startFlusher(&flushers, func() time.Duration { return l.timerAggregationInterval }, l.flushTimers)
+	l.startFlusher(&flushers, func() time.Duration { return l.goroutineReportInterval }, l.flushGoroutines)
+	l.startFlusher(&flushers, func() time.Duration { return l.gaugeFlushInterval }, l.flushGauges)
+	l.startFlusher(&flushers, func() time.Duration { return l.counterResetInterval }, l.resetCounters)
+	l.startFlusher(&flushers, func() time.Duration { return l.parseLatencyInterval }, l.flushParseLatency)
+
+	readBytes := l.newReadBuffer()
+
+	l.spawn(func() {
+		for {
+			select {
+			case <-l.resumed:
+				l.lineLock.Lock()
+				l.emitPausedLines()
+				l.lineLock.Unlock()
+			case <-l.stopChan:
+				connection.Close()
+				return
+			}
+		}
+	})
 
 	for {
 		readCount, senderAddr, err := connection.ReadFrom(readBytes)
@@ -64,83 +242,373 @@ func (l *StatsdListener) Run(outputChan chan *events.Envelope) {
 			return
 		}
 		l.Debugf("StatsdListener: Read %d bytes from address %s", readCount, senderAddr)
+		l.checkTruncation(readCount, readBytes, senderAddr.String())
 		trimmedBytes := make([]byte, readCount)
 		copy(trimmedBytes, readBytes[:readCount])
 
-		scanner := bufio.NewScanner(bytes.NewBuffer(trimmedBytes))
-		for scanner.Scan() {
-			line := scanner.Text()
-			envelope, err := l.parseStat(line)
-			if err == nil {
-				outputChan <- envelope
-			} else {
-				l.Warnf("Error parsing stat line \"%s\": %s", line, err.Error())
+		receivedAt := time.Now()
+		l.capture(receivedAt, senderAddr, trimmedBytes)
+		l.handlePacket(trimmedBytes, receivedAt)
+	}
+
+}
+
+// attachOutput makes the listener emit on outputChan.
+func (l *StatsdListener) attachOutput(outputChan chan *events.Envelope) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.outputChan = outputChan
+	if !l.paused {
+		l.signalResumed()
+	}
+}
+
+func (l *StatsdListener) handlePacket(packet []byte, receivedAt time.Time) {
+	scanner := bufio.NewScanner(bytes.NewBuffer(packet))
+	for scanner.Scan() {
+		l.handleLine(scanner.Text(), receivedAt.UnixNano())
+	}
+}
+
+// startFlusher runs flushPeriodically until the listener is stopped.
+// interval is called with the lock held.
+func (l *StatsdListener) startFlusher(flushers *sync.WaitGroup, interval func() time.Duration, flush func(elapsed time.Duration) bool) {
+	flushers.Add(1)
+	l.spawn(func() {
+		defer flushers.Done()
+		l.flushPeriodically(interval, flush)
+	})
+}
+
+// flushPeriodically calls flush every interval until the listener is
+// stopped, and not at all while the interval is zero. flush returns false
+// when it skipped flushing because the listener is paused; the skipped
+// intervals are carried over into the elapsed time of the next flush. When
+// the interval is changed, the time elapsed in the current interval is
+// flushed right away and the new interval starts.
+func (l *StatsdListener) flushPeriodically(interval func() time.Duration, flush func(elapsed time.Duration) bool) {
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	current, reconfigured := l.flushInterval(interval)
+	if current > 0 {
+		ticker = time.NewTicker(current)
+		tick = ticker.C
+	}
+
+	var elapsed time.Duration
+	intervalStart := time.Now()
+	for {
+		select {
+		case <-tick:
+			elapsed += current
+			intervalStart = time.Now()
+			if flush(elapsed) {
+				elapsed = 0
 			}
+		case <-reconfigured:
+			var next time.Duration
+			next, reconfigured = l.flushInterval(interval)
+			if next == current {
+				continue
+			}
+
+			if current > 0 {
+				elapsed += time.Since(intervalStart)
+				if flush(elapsed) {
+					elapsed = 0
+				}
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+			current = next
+			intervalStart = time.Now()
+			if current > 0 {
+				ticker = time.NewTicker(current)
+				tick = ticker.C
+			}
+		case <-l.stopChan:
+			return
+		}
+	}
+}
+
+func (l *StatsdListener) handleLine(line string, receivedAt int64) {
+	l.lineLock.Lock()
+	defer l.lineLock.Unlock()
+
+	l.emitPausedLines()
+
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		if l.pausePolicy == BufferWhilePaused {
+			l.bufferLine(line)
+		} else {
+			l.deadLetter(line, ReasonPaused)
+		}
+		return
+	}
+
+	l.emitLine(line, receivedAt)
+}
+
+// emitLine must be called with the lock held.
+func (l *StatsdListener) emitLine(line string, receivedAt int64) {
+	envelopes, statType, err := l.timedParseStat(line, receivedAt)
+	if err != nil {
+		l.Warnf("Error parsing stat line \"%s\": %s", line, err.Error())
+		return
+	}
+
+	for _, envelope := range envelopes {
+		if !l.queue(envelope, line) {
+			l.deadLetter(line, ReasonOutputClosed)
+			return
+		}
+		l.countEmitted(statType)
+	}
+}
+
+// outgoingEnvelope is an envelope queued to be sent along with the line it
+// was parsed from, if any.
+type outgoingEnvelope struct {
+	envelope *events.Envelope
+	line     string
+}
+
+// send must be called with the lock held. It queues envelope to be sent once
+// the lock is released with unlockAndSend, and returns false once the output
+// has been closed or the listener has been stopped.
+func (l *StatsdListener) send(envelope *events.Envelope) bool {
+	return l.queue(envelope, "")
+}
+
+// queue must be called with the lock held.
+func (l *StatsdListener) queue(envelope *events.Envelope, line string) bool {
+	select {
+	case <-l.outputDone:
+		return false
+	case <-l.stopChan:
+		return false
+	default:
+	}
+
+	l.outbox = append(l.outbox, outgoingEnvelope{envelope: envelope, line: line})
+	return true
+}
+
+// unlockAndSend releases the lock and only then sends the envelopes queued
+// while it was held, so that a slow consumer holds up neither Pause, Resume
+// and Emit nor the other flushes. The lines whose envelopes could not be
+// sent are sent to the dead letter channel.
+func (l *StatsdListener) unlockAndSend() {
+	outbox, outputChan := l.outbox, l.outputChan
+	l.outbox = nil
+	l.lock.Unlock()
+
+	if len(outbox) == 0 {
+		return
+	}
+
+	sent := l.sendAll(outputChan, outbox)
+	if sent == len(outbox) {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var abandoned string
+	for _, outgoing := range outbox[sent:] {
+		if outgoing.line != "" && outgoing.line != abandoned {
+			abandoned = outgoing.line
+			l.deadLetter(outgoing.line, ReasonOutputClosed)
 		}
 	}
+}
+
+// sendAll returns how many of outbox it sent before the output was closed or
+// the listener was stopped.
+func (l *StatsdListener) sendAll(outputChan chan *events.Envelope, outbox []outgoingEnvelope) int {
+	l.sendLock.Lock()
+	defer l.sendLock.Unlock()
+
+	for i, outgoing := range outbox {
+		if l.outputClosed {
+			return i
+		}
 
+		select {
+		case outputChan <- outgoing.envelope:
+			l.registry.Increment(metrics.StatsdEmittedEnvelopes)
+		case <-l.outputDone:
+			return i
+		case <-l.stopChan:
+			return i
+		}
+	}
+	return len(outbox)
 }
 
 func (l *StatsdListener) Stop() {
-	close(l.stopChan)
+	l.stopOnce.Do(func() { close(l.stopChan) })
+}
+
+// CloseOutput is used by a consumer that no longer reads from the output
+// channel. It abandons any send in progress, closes the output channel and
+// stops the listener, so Run returns instead of panicking on its next send.
+func (l *StatsdListener) CloseOutput() {
+	l.outputCloseOnce.Do(func() {
+		close(l.outputDone)
+
+		l.lock.Lock()
+		outputChan := l.outputChan
+		l.lock.Unlock()
+
+		l.sendLock.Lock()
+		l.outputClosed = true
+		if outputChan != nil {
+			close(outputChan)
+		}
+		l.sendLock.Unlock()
+
+		l.Stop()
+	})
+}
+
+func (l *StatsdListener) SetLineParser(parser LineParser) {
+	l.parser = parser
 }
 
-var statsdRegexp = regexp.MustCompile(`([^.]+)\.([^:]+):([+-]?)(\d+(\.\d+)?)\|(ms|g|c)(\|@(\d+(\.\d+)?))?`)
+// SetMetricsRegistry makes the listener count the envelopes it emits in
+// registry. It must be called before Run.
+func (l *StatsdListener) SetMetricsRegistry(registry *metrics.Registry) {
+	l.registry = registry
+}
+
+func (l *StatsdListener) SetTimestampSource(source TimestampSource) {
+	l.timestampSource = source
+}
+
+// parseStat returns the envelopes for a line along with the type the line was
+// handled as.
+func (l *StatsdListener) parseStat(data string, receivedAt int64) ([]*events.Envelope, string, error) {
+	stat, err := l.parser.Parse(data)
+	if err != nil {
+		l.deadLetter(data, ReasonParseError)
+		return nil, "", err
+	}
+	if stat == nil {
+		return nil, "", nil
+	}
+	if strings.TrimSpace(stat.Name) == "" {
+		l.deadLetter(data, ReasonParseError)
+		return nil, "", errors.New("Stat has an empty name.")
+	}
+
+	if !l.fitLineLength(data, stat) {
+		l.deadLetter(data, ReasonLongLine)
+		return nil, "", nil
+	}
 
-func (l *StatsdListener) parseStat(data string) (*events.Envelope, error) {
-	parts := statsdRegexp.FindStringSubmatch(data)
+	stat.Name = l.foldName(stat.Name)
+	origin, err := l.statOrigin(stat)
+	if err != nil {
+		l.deadLetter(data, ReasonNoOrigin)
+		return nil, "", err
+	}
+	origin = l.foldOrigin(origin)
 
-	if len(parts) == 0 {
-		return nil, fmt.Errorf("Input line '%s' was not a valid statsd line.", data)
+	statType, err := l.statType(stat)
+	if err != nil || statType == "" {
+		l.deadLetter(data, ReasonUnknownType)
+		return nil, "", err
 	}
 
-	// complete matched string = parts[0]
-	origin := parts[1]
-	name := parts[2]
-	incrementSign := parts[3]
-	valueString := parts[4]
-	// decimal part of valueString = parts[5]
-	statType := parts[6]
-	// full sampling substring = parts[7]
-	sampleRateString := parts[8]
-	// decimal part of sampleRate = parts[9]
+	l.tallySampleRate(stat.SampleRate)
 
-	value, _ := strconv.ParseFloat(valueString, 64)
+	name := stat.Name + formatTags(stat.Tags)
+	if !l.sampleAtIngest(origin, name, stat, statType) {
+		return nil, "", nil
+	}
+	value := stat.Value / stat.SampleRate
 
-	var sampleRate float64
-	if len(sampleRateString) != 0 {
-		sampleRate, _ = strconv.ParseFloat(sampleRateString, 64)
-	} else {
-		sampleRate = 1
+	keepsState := statType != "ms" || l.timerAggregationInterval > 0
+	if keepsState && !l.admitKey(fmt.Sprintf("%s.%s", origin, name)) {
+		l.deadLetter(data, ReasonMaxKeys)
+		return nil, "", nil
 	}
 
-	value = value / sampleRate
+	timestamp := l.timestamp(stat, receivedAt)
 
 	var unit string
+	var deltaEnvelope *events.Envelope
 	switch statType {
 	case "ms":
 		unit = "ms"
+		if l.timerAggregationInterval > 0 {
+			l.recordTimerSample(origin, name, stat.Value)
+		}
+		if l.dropRawTimers {
+			return nil, "", nil
+		}
 	case "c":
 		unit = "counter"
-		value = l.counterValue(origin, name, value, incrementSign)
+		key := fmt.Sprintf("%s.%s", origin, name)
+		previous := l.counterValues[key]
+		if stat.Cumulative {
+			value = l.setCounterValue(origin, name, value)
+		} else {
+			value = l.counterValue(origin, name, value, stat.IncrementSign)
+		}
+		l.markCumulative(key, stat.Cumulative)
+		if l.counterRateInterval > 0 {
+			l.recordCounterDelta(origin, name, value-previous)
+			return l.withRawLine(nil, origin, data, timestamp), statType, nil
+		}
+		l.resetCounterAtThreshold(key)
 	default:
 		unit = "gauge"
-		value = l.gaugeValue(origin, name, value, incrementSign)
+		previous := l.gaugeValues[fmt.Sprintf("%s.%s", origin, name)]
+		value = l.gaugeValue(origin, name, value, stat.IncrementSign)
+		if l.gaugeDeltaCounters && stat.IncrementSign != "" {
+			deltaEnvelope = gaugeDeltaEnvelope(origin, l.typedName(name, statType), value-previous, value, timestamp)
+		}
 	}
 
+	emittedName := l.typedName(name, statType)
 	env := &events.Envelope{
 		Origin:    &origin,
-		Timestamp: proto.Int64(time.Now().UnixNano()),
+		Timestamp: proto.Int64(timestamp),
 		EventType: events.Envelope_ValueMetric.Enum(),
 
 		ValueMetric: &events.ValueMetric{
-			Name:  &name,
+			Name:  &emittedName,
 			Value: &value,
 			Unit:  &unit,
 		},
 	}
 
-	return env, nil
+	envelopes := []*events.Envelope{env}
+	if deltaEnvelope != nil {
+		envelopes = append(envelopes, deltaEnvelope)
+	}
+	return l.withRawLine(envelopes, origin, data, timestamp), statType, nil
+}
+
+func (l *StatsdListener) timestamp(stat *Stat, receivedAt int64) int64 {
+	if l.timestampSource == SendTime && stat.Timestamp != 0 {
+		return stat.Timestamp
+	}
+	return receivedAt
 }
 
 func (l *StatsdListener) counterValue(origin string, name string, value float64, incrementSign string) float64 {
@@ -159,6 +627,12 @@ func (l *StatsdListener) counterValue(origin string, name string, value float64,
 	return newVal
 }
 
+func (l *StatsdListener) setCounterValue(origin string, name string, value float64) float64 {
+	key := fmt.Sprintf("%s.%s", origin, name)
+	l.counterValues[key] = value
+	return value
+}
+
 func (l *StatsdListener) gaugeValue(origin string, name string, value float64, incrementSign string) float64 {
 
 	key := fmt.Sprintf("%s.%s", origin, name)
@@ -175,5 +649,47 @@ func (l *StatsdListener) gaugeValue(origin string, name string, value float64, i
 	}
 
 	l.gaugeValues[key] = newVal
+	l.rememberGaugeKey(key, origin, name)
+	l.touchGauge(key, origin, name, time.Now())
 	return newVal
 }
+
+// formatTags renders tags as a sorted `{key="value",...}` suffix, so each
+// combination of tags is emitted and accumulated as its own metric.
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", key, tags[key])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (l *StatsdListener) Emit() instrumentation.Context {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return instrumentation.Context{
+		Name: "statsdListener",
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "emittedCounters", Value: l.emitCounts.Counters},
+			instrumentation.Metric{Name: "emittedGauges", Value: l.emitCounts.Gauges},
+			instrumentation.Metric{Name: "emittedTimers", Value: l.emitCounts.Timers},
+			instrumentation.Metric{Name: "rejectedLongLines", Value: l.rejectedLongLines},
+			instrumentation.Metric{Name: "truncatedLongLines", Value: l.truncatedLongLines},
+			instrumentation.Metric{Name: "discardedDeadLetters", Value: l.discardedDeadLetters},
+			instrumentation.Metric{Name: "possiblyTruncatedPackets", Value: l.possiblyTruncatedPackets},
+			instrumentation.Metric{Name: "ingestSampledOutLines", Value: l.ingestSampledOutLines},
+			instrumentation.Metric{Name: "reservoirSampledTimings", Value: l.reservoirSampledTimings},
+		},
+	}
+}
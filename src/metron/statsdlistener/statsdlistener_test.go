@@ -3,8 +3,10 @@ package statsdlistener_test
 import (
 	"metron/statsdlistener"
 
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
 
@@ -184,6 +186,168 @@ var _ = Describe("StatsdListener", func() {
 			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
 			checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 25, "counter")
 		})
+
+		It("emits Prometheus exposition lines with a Prometheus line parser", func(done Done) {
+			listener := statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+			listener.SetLineParser(statsdlistener.NewPrometheusLineParser("fake-origin"))
+
+			envelopeChan := make(chan *events.Envelope)
+
+			wg := stopMeLater(func() { listener.Run(envelopeChan) })
+
+			defer func() {
+				stopAndWait(func() { listener.Stop() }, wg)
+				close(done)
+			}()
+
+			Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+			connection, err := net.Dial("udp", "localhost:51162")
+			Expect(err).ToNot(HaveOccurred())
+			defer connection.Close()
+			promMsg := []byte("# TYPE requests_total counter\nrequests_total{status=\"200\",method=\"get\"} 23\nrequests_total{status=\"200\",method=\"get\"} 30\nqueue_depth 5")
+			_, err = connection.Write(promMsg)
+			Expect(err).ToNot(HaveOccurred())
+
+			var receivedEnvelope *events.Envelope
+
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", `requests_total{method="get",status="200"}`, 23, "counter")
+
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", `requests_total{method="get",status="200"}`, 30, "counter")
+
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "queue_depth", 5, "gauge")
+		})
+
+		Context("with a send timestamp on the line", func() {
+			var (
+				listener     statsdlistener.StatsdListener
+				envelopeChan chan *events.Envelope
+				wg           *sync.WaitGroup
+				sendTime     time.Time
+			)
+
+			BeforeEach(func() {
+				listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+				envelopeChan = make(chan *events.Envelope)
+				sendTime = time.Unix(1420070400, 0)
+			})
+
+			AfterEach(func() {
+				stopAndWait(func() { listener.Stop() }, wg)
+			})
+
+			sendStat := func() *events.Envelope {
+				wg = stopMeLater(func() { listener.Run(envelopeChan) })
+				Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+				connection, err := net.Dial("udp", "localhost:51162")
+				Expect(err).ToNot(HaveOccurred())
+				defer connection.Close()
+				_, err = connection.Write([]byte(fmt.Sprintf("fake-origin.test.gauge:23|g|T%d", sendTime.Unix())))
+				Expect(err).ToNot(HaveOccurred())
+
+				var receivedEnvelope *events.Envelope
+				Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+				checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 23, "gauge")
+				return receivedEnvelope
+			}
+
+			It("uses the receive time by default", func() {
+				before := time.Now().UnixNano()
+				envelope := sendStat()
+				Expect(envelope.GetTimestamp()).To(BeNumerically(">=", before))
+			})
+
+			It("uses the send time when configured to", func() {
+				listener.SetTimestampSource(statsdlistener.SendTime)
+				envelope := sendStat()
+				Expect(envelope.GetTimestamp()).To(Equal(sendTime.UnixNano()))
+			})
+		})
+	})
+})
+
+var _ = Describe("CloseOutput", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		runDone      chan struct{}
+		stopSending  chan struct{}
+	)
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope)
+
+		runDone = make(chan struct{})
+		go func() {
+			defer close(runDone)
+			listener.Run(envelopeChan)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		stop := make(chan struct{})
+		stopSending = stop
+		connection, err := net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer connection.Close()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				connection.Write([]byte("fake-origin.test.counter:1|c"))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		close(stopSending)
+		listener.Stop()
+		Eventually(runDone).Should(BeClosed())
+	})
+
+	It("closes the output channel mid-run and makes Run return without panicking", func() {
+		Eventually(envelopeChan).Should(Receive())
+		Eventually(envelopeChan).Should(Receive())
+
+		listener.CloseOutput()
+
+		Eventually(runDone).Should(BeClosed())
+		Eventually(envelopeChan).Should(BeClosed())
+	})
+
+	It("can be called more than once", func() {
+		Eventually(envelopeChan).Should(Receive())
+
+		listener.CloseOutput()
+		listener.CloseOutput()
+
+		Eventually(runDone).Should(BeClosed())
+	})
+})
+
+var _ = Describe("ParseTimestampSource", func() {
+	It("parses the timestamp sources", func() {
+		Expect(statsdlistener.ParseTimestampSource("receive")).To(Equal(statsdlistener.ReceiveTime))
+		Expect(statsdlistener.ParseTimestampSource("send")).To(Equal(statsdlistener.SendTime))
+	})
+
+	It("defaults to the receive time", func() {
+		Expect(statsdlistener.ParseTimestampSource("")).To(Equal(statsdlistener.ReceiveTime))
+	})
+
+	It("returns an error for an unknown source", func() {
+		_, err := statsdlistener.ParseTimestampSource("bogus")
+		Expect(err).To(HaveOccurred())
 	})
 })
 
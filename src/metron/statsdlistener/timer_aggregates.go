@@ -0,0 +1,180 @@
+package statsdlistener
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const timerCountUnit = "count"
+
+type timerSamples struct {
+	origin string
+	name   string
+
+	count int
+	sum   float64
+	min   float64
+	max   float64
+
+	// samples is a uniform random sample of at most maxTimerSamples of the
+	// timings seen over the interval, from which the percentiles are taken.
+	samples []float64
+}
+
+// SetTimerAggregation makes the listener aggregate the timings received for
+// every timer over each interval. On flush, it emits the following
+// ValueMetrics for every timer seen during the interval, with the timer's
+// origin:
+//
+//	<name>.count
+//	<name>.min
+//	<name>.max
+//	<name>.mean
+//	<name>.p<percentile>, such as <name>.p99 or <name>.p99.9
+//
+// The count, minimum, maximum and mean cover every timing. The percentiles
+// are taken from a random sample of at most maxSamples timings per timer, so
+// the memory used per timer is bounded; with a maxSamples of zero they are
+// not emitted. Once a timer holds maxSamples samples, every further timing
+// replaces a random sample with the probability that keeps the sample uniform,
+// and is counted in ReservoirSampledTimings. Sample rates are not applied to the timings. A zero interval
+// disables the aggregation. While timers are aggregated, their names count
+// against the limit of SetMaxKeys.
+//
+// Timers are still emitted on every line as well, unless SetDropRawTimers is
+// used.
+func (l *StatsdListener) SetTimerAggregation(interval time.Duration, percentiles []float64, maxSamples int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.timerAggregationInterval = interval
+	l.timerPercentiles = percentiles
+	l.maxTimerSamples = maxSamples
+	l.notifyReconfigured()
+}
+
+// SetDropRawTimers stops the listener from emitting timers on every line.
+// Without timer aggregation, timers are then dropped altogether.
+func (l *StatsdListener) SetDropRawTimers(drop bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.dropRawTimers = drop
+}
+
+// recordTimerSample must be called with the lock held.
+func (l *StatsdListener) recordTimerSample(origin string, name string, value float64) {
+	key := fmt.Sprintf("%s.%s", origin, name)
+	timer, ok := l.timerSamples[key]
+	if !ok {
+		timer = &timerSamples{origin: origin, name: name, min: value, max: value}
+		l.timerSamples[key] = timer
+	}
+
+	timer.count++
+	timer.sum += value
+	timer.min = math.Min(timer.min, value)
+	timer.max = math.Max(timer.max, value)
+
+	if len(timer.samples) < l.maxTimerSamples {
+		timer.samples = append(timer.samples, value)
+		return
+	}
+	if l.maxTimerSamples > 0 {
+		l.reservoirSampledTimings++
+	}
+	if i := l.rand.Intn(timer.count); i < len(timer.samples) {
+		timer.samples[i] = value
+	}
+}
+
+// ReservoirSampledTimings returns the number of timings received once their
+// timer already held the maximum number of samples, which only replaced a
+// random sample if any.
+func (l *StatsdListener) ReservoirSampledTimings() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.reservoirSampledTimings
+}
+
+func (l *StatsdListener) flushTimers(elapsed time.Duration) bool {
+	l.lock.Lock()
+	defer l.unlockAndSend()
+
+	if l.paused {
+		return false
+	}
+
+	timers := l.timerSamples
+	l.timerSamples = make(map[string]*timerSamples)
+
+	keys := make([]string, 0, len(timers))
+	for key := range timers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	timestamp := time.Now().UnixNano()
+	for _, key := range keys {
+		for _, envelope := range timerEnvelopes(timers[key], l.typedName(timers[key].name, "ms"), l.timerPercentiles, timestamp) {
+			if !l.send(envelope) {
+				return true
+			}
+			l.countEmitted("ms")
+		}
+	}
+	return true
+}
+
+func timerEnvelopes(timer *timerSamples, name string, percentiles []float64, timestamp int64) []*events.Envelope {
+	sort.Float64s(timer.samples)
+
+	envelopes := []*events.Envelope{
+		timerEnvelope(timer.origin, name+".count", float64(timer.count), timerCountUnit, timestamp),
+		timerEnvelope(timer.origin, name+".min", timer.min, "ms", timestamp),
+		timerEnvelope(timer.origin, name+".max", timer.max, "ms", timestamp),
+		timerEnvelope(timer.origin, name+".mean", timer.sum/float64(timer.count), "ms", timestamp),
+	}
+	if len(timer.samples) == 0 {
+		return envelopes
+	}
+	for _, percentile := range percentiles {
+		percentileName := name + ".p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+		envelopes = append(envelopes, timerEnvelope(timer.origin, percentileName, nearestRank(timer.samples, percentile), "ms", timestamp))
+	}
+	return envelopes
+}
+
+// nearestRank returns the smallest of the sorted samples that is at least as
+// large as percentile percent of them.
+func nearestRank(sorted []float64, percentile float64) float64 {
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+func timerEnvelope(origin string, name string, value float64, unit string, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(origin),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_ValueMetric.Enum(),
+
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(value),
+			Unit:  proto.String(unit),
+		},
+	}
+}
@@ -0,0 +1,205 @@
+package statsdlistener_test
+
+import (
+	"fmt"
+	"math/rand"
+	"metron/statsdlistener"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timer aggregates", func() {
+	const interval = 200 * time.Millisecond
+
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	timings := func(name string, first, last int) string {
+		lines := []string{}
+		for i := first; i <= last; i++ {
+			lines = append(lines, fmt.Sprintf("fake-origin.%s:%d|ms", name, i))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	// receiveAggregates collects the next flush, which is sent in one burst,
+	// keyed by metric name
+	receiveAggregates := func() map[string]float64 {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan, 2*interval).Should(Receive(&receivedEnvelope))
+
+		aggregates := make(map[string]float64)
+		for {
+			Expect(receivedEnvelope.GetOrigin()).To(Equal("fake-origin"))
+			aggregates[receivedEnvelope.GetValueMetric().GetName()] = receivedEnvelope.GetValueMetric().GetValue()
+
+			select {
+			case receivedEnvelope = <-envelopeChan:
+			case <-time.After(interval / 4):
+				return aggregates
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		listener.SetTimerAggregation(interval, []float64{50, 90, 99.9}, 100)
+		envelopeChan = make(chan *events.Envelope, 100)
+	})
+
+	JustBeforeEach(func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("emits every timing as it is received and the aggregates on flush", func() {
+		send(timings("test.timer", 1, 10))
+
+		var receivedEnvelope *events.Envelope
+		for i := 1; i <= 10; i++ {
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.timer", float64(i), "ms")
+		}
+
+		Expect(receiveAggregates()).To(Equal(map[string]float64{
+			"test.timer.count": 10,
+			"test.timer.min":   1,
+			"test.timer.max":   10,
+			"test.timer.mean":  5.5,
+			"test.timer.p50":   5,
+			"test.timer.p90":   9,
+			"test.timer.p99.9": 10,
+		}))
+		Expect(listener.EmitCounts().Timers).To(Equal(17))
+	})
+
+	It("only aggregates the timers seen during the interval", func() {
+		send(timings("test.timer", 1, 1))
+		Eventually(envelopeChan).Should(Receive())
+		Expect(receiveAggregates()).To(HaveKeyWithValue("test.timer.count", 1.0))
+
+		Consistently(envelopeChan, 2*interval).ShouldNot(Receive())
+	})
+
+	It("aggregates every timer separately", func() {
+		listener.SetDropRawTimers(true)
+		send(timings("a.timer", 1, 2) + "\n" + timings("b.timer", 5, 5))
+
+		aggregates := receiveAggregates()
+		Expect(aggregates).To(HaveKeyWithValue("a.timer.count", 2.0))
+		Expect(aggregates).To(HaveKeyWithValue("a.timer.mean", 1.5))
+		Expect(aggregates).To(HaveKeyWithValue("b.timer.count", 1.0))
+		Expect(aggregates).To(HaveKeyWithValue("b.timer.p50", 5.0))
+	})
+
+	Context("when raw timers are dropped", func() {
+		BeforeEach(func() {
+			listener.SetDropRawTimers(true)
+		})
+
+		It("only emits the aggregates", func() {
+			send(timings("test.timer", 1, 4))
+
+			Expect(receiveAggregates()).To(HaveKeyWithValue("test.timer.count", 4.0))
+			Expect(listener.EmitCounts().Timers).To(Equal(7))
+		})
+	})
+
+	Context("with more timings than samples kept", func() {
+		BeforeEach(func() {
+			listener.SetTimerAggregation(interval, []float64{50}, 5)
+			listener.SetDropRawTimers(true)
+		})
+
+		It("covers every timing in the count, minimum, maximum and mean and samples the percentiles", func() {
+			for i := 0; i < 10; i++ {
+				send(timings("test.timer", 10*i+1, 10*i+10))
+			}
+
+			aggregates := receiveAggregates()
+			Expect(aggregates).To(HaveKeyWithValue("test.timer.count", 100.0))
+			Expect(aggregates).To(HaveKeyWithValue("test.timer.min", 1.0))
+			Expect(aggregates).To(HaveKeyWithValue("test.timer.max", 100.0))
+			Expect(aggregates).To(HaveKeyWithValue("test.timer.mean", 50.5))
+			Expect(aggregates["test.timer.p50"]).To(BeNumerically(">=", 1))
+			Expect(aggregates["test.timer.p50"]).To(BeNumerically("<=", 100))
+		})
+
+		It("keeps at most the maximum number of samples and counts the timings sampled beyond it", func() {
+			send(timings("test.timer", 1, 5))
+			Expect(receiveAggregates()).To(HaveKeyWithValue("test.timer.count", 5.0))
+			Expect(listener.ReservoirSampledTimings()).To(BeZero())
+
+			for i := 0; i < 10; i++ {
+				send(timings("test.timer", 10*i+1, 10*i+10))
+			}
+			Expect(receiveAggregates()).To(HaveKeyWithValue("test.timer.count", 100.0))
+			Expect(listener.ReservoirSampledTimings()).To(Equal(95))
+			Expect(listener.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "reservoirSampledTimings", Value: 95}))
+		})
+	})
+
+	Context("with far more timings than samples kept", func() {
+		BeforeEach(func() {
+			listener.SetTimerAggregation(interval, []float64{50, 90}, 100)
+			listener.SetDropRawTimers(true)
+			listener.SetRandSource(rand.NewSource(1))
+		})
+
+		It("keeps a sample the percentiles of which stay close to those of every timing", func() {
+			for i := 0; i < 20; i++ {
+				send(timings("test.timer", 100*i+1, 100*i+100))
+			}
+
+			aggregates := receiveAggregates()
+			Expect(aggregates).To(HaveKeyWithValue("test.timer.count", 2000.0))
+			Expect(aggregates["test.timer.p50"]).To(BeNumerically("~", 1000, 300))
+			Expect(aggregates["test.timer.p90"]).To(BeNumerically("~", 1800, 200))
+			Expect(listener.ReservoirSampledTimings()).To(Equal(1900))
+		})
+	})
+
+	Context("without timer aggregation", func() {
+		BeforeEach(func() {
+			listener.SetTimerAggregation(0, nil, 0)
+		})
+
+		It("only emits every timing as it is received", func() {
+			send(timings("test.timer", 1, 1))
+
+			var receivedEnvelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+			checkValueMetric(receivedEnvelope, "fake-origin", "test.timer", 1, "ms")
+			Consistently(envelopeChan, 2*interval).ShouldNot(Receive())
+		})
+	})
+})
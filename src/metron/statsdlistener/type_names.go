@@ -0,0 +1,48 @@
+package statsdlistener
+
+import (
+	"errors"
+	"strings"
+)
+
+// ValidateTypeNameTemplate checks that a template for SetTypeNameTemplate
+// keeps the name.
+func ValidateTypeNameTemplate(template string) error {
+	if template != "" && !strings.Contains(template, "{name}") {
+		return errors.New("Statsd type name template must contain {name}")
+	}
+	return nil
+}
+
+// SetTypeNameTemplate makes the listener emit stats under names made from
+// template, such as "{name}.{type}", with {name} replaced by the name of the
+// stat and {type} by counter, gauge or timer, so that stats of different
+// types sharing a name do not collide downstream. Suffixes the listener adds
+// to derived metrics, like ".rate" or ".p95", follow the templated name. The
+// values are still accumulated under the name of the stat. An empty
+// template, the default, leaves the names unchanged.
+func (l *StatsdListener) SetTypeNameTemplate(template string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.typeNameTemplate = template
+}
+
+// typedName must be called with the lock held. It returns the name to emit
+// the stat name of statType under.
+func (l *StatsdListener) typedName(name string, statType string) string {
+	if l.typeNameTemplate == "" {
+		return name
+	}
+
+	var typeName string
+	switch statType {
+	case "c":
+		typeName = "counter"
+	case "ms":
+		typeName = "timer"
+	default:
+		typeName = "gauge"
+	}
+	return strings.NewReplacer("{name}", name, "{type}", typeName).Replace(l.typeNameTemplate)
+}
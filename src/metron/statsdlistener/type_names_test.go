@@ -0,0 +1,155 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Type name template", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	receive := func() *events.Envelope {
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		return receivedEnvelope
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 20)
+	})
+
+	JustBeforeEach(func() {
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("leaves the names unchanged by default", func() {
+		send("fake-origin.test.stat:3|c\nfake-origin.test.stat:5|g\nfake-origin.test.stat:7|ms")
+
+		checkValueMetric(receive(), "fake-origin", "test.stat", 3, "counter")
+		checkValueMetric(receive(), "fake-origin", "test.stat", 5, "gauge")
+		checkValueMetric(receive(), "fake-origin", "test.stat", 7, "ms")
+	})
+
+	Context("with a suffix template", func() {
+		BeforeEach(func() {
+			listener.SetTypeNameTemplate("{name}.{type}")
+		})
+
+		It("names every type apart", func() {
+			send("fake-origin.test.stat:3|c\nfake-origin.test.stat:5|g\nfake-origin.test.stat:7|ms")
+
+			checkValueMetric(receive(), "fake-origin", "test.stat.counter", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "test.stat.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.stat.timer", 7, "ms")
+		})
+
+		It("still accumulates the values under the stat name", func() {
+			send("fake-origin.test.counter:3|c\nfake-origin.test.counter:4|c\nfake-origin.test.gauge:5|g\nfake-origin.test.gauge:+2|g")
+
+			checkValueMetric(receive(), "fake-origin", "test.counter.counter", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "test.counter.counter", 7, "counter")
+			checkValueMetric(receive(), "fake-origin", "test.gauge.gauge", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "test.gauge.gauge", 7, "gauge")
+		})
+
+		Context("with gauge delta counters", func() {
+			BeforeEach(func() {
+				listener.SetGaugeDeltaCounters(true)
+			})
+
+			It("names the delta counters like their gauge", func() {
+				send("fake-origin.test.gauge:+2|g")
+
+				checkValueMetric(receive(), "fake-origin", "test.gauge.gauge", 2, "gauge")
+				Expect(receive().GetCounterEvent().GetName()).To(Equal("test.gauge.gauge"))
+			})
+		})
+
+		Context("with counter rates", func() {
+			BeforeEach(func() {
+				listener.SetCounterRateInterval(100 * time.Millisecond)
+			})
+
+			It("puts the rate suffix after the templated name", func() {
+				send("fake-origin.test.counter:3|c")
+
+				counterEnvelope := receive()
+				Expect(counterEnvelope.GetCounterEvent().GetName()).To(Equal("test.counter.counter"))
+				Expect(receive().GetValueMetric().GetName()).To(Equal("test.counter.counter.rate"))
+			})
+		})
+
+		Context("with timer aggregation", func() {
+			BeforeEach(func() {
+				listener.SetTimerAggregation(100*time.Millisecond, []float64{95}, 10)
+				listener.SetDropRawTimers(true)
+			})
+
+			It("puts the aggregate suffixes after the templated name", func() {
+				send("fake-origin.test.timing:7|ms")
+
+				var names []string
+				for i := 0; i < 5; i++ {
+					names = append(names, receive().GetValueMetric().GetName())
+				}
+				Expect(names).To(ConsistOf("test.timing.timer.count", "test.timing.timer.min", "test.timing.timer.max", "test.timing.timer.mean", "test.timing.timer.p95"))
+			})
+		})
+	})
+
+	Context("with a prefix template", func() {
+		BeforeEach(func() {
+			listener.SetTypeNameTemplate("{type}s.{name}")
+		})
+
+		It("names every type apart", func() {
+			send("fake-origin.test.stat:3|c\nfake-origin.test.stat:5|g\nfake-origin.test.stat:7|ms")
+
+			checkValueMetric(receive(), "fake-origin", "counters.test.stat", 3, "counter")
+			checkValueMetric(receive(), "fake-origin", "gauges.test.stat", 5, "gauge")
+			checkValueMetric(receive(), "fake-origin", "timers.test.stat", 7, "ms")
+		})
+	})
+
+	Describe("ValidateTypeNameTemplate", func() {
+		It("accepts templates keeping the name and the empty template", func() {
+			Expect(statsdlistener.ValidateTypeNameTemplate("{name}.{type}")).To(Succeed())
+			Expect(statsdlistener.ValidateTypeNameTemplate("")).To(Succeed())
+		})
+
+		It("rejects templates dropping the name", func() {
+			Expect(statsdlistener.ValidateTypeNameTemplate("{type}")).To(MatchError("Statsd type name template must contain {name}"))
+		})
+	})
+})
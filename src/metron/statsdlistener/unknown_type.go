@@ -0,0 +1,62 @@
+package statsdlistener
+
+import (
+	"fmt"
+)
+
+// UnknownTypeFallback controls what happens to lines whose type is not one
+// of ms, g and c.
+type UnknownTypeFallback int
+
+const (
+	// RejectUnknownType drops the line and logs a warning.
+	RejectUnknownType UnknownTypeFallback = iota
+	// GaugeUnknownType treats the line as a gauge.
+	GaugeUnknownType
+	// CounterUnknownType treats the line as a counter.
+	CounterUnknownType
+	// DropUnknownType drops the line without logging.
+	DropUnknownType
+)
+
+func ParseUnknownTypeFallback(fallback string) (UnknownTypeFallback, error) {
+	switch fallback {
+	case "", "reject":
+		return RejectUnknownType, nil
+	case "gauge":
+		return GaugeUnknownType, nil
+	case "counter":
+		return CounterUnknownType, nil
+	case "drop-silent":
+		return DropUnknownType, nil
+	default:
+		return RejectUnknownType, fmt.Errorf("Unknown statsd type fallback '%s', must be reject, gauge, counter or drop-silent", fallback)
+	}
+}
+
+func (l *StatsdListener) SetUnknownTypeFallback(fallback UnknownTypeFallback) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.unknownTypeFallback = fallback
+}
+
+// statType returns the type the stat is handled as, or an empty type for
+// stats that are dropped silently. It must be called with the lock held.
+func (l *StatsdListener) statType(stat *Stat) (string, error) {
+	switch stat.Type {
+	case "ms", "g", "c":
+		return stat.Type, nil
+	}
+
+	switch l.unknownTypeFallback {
+	case GaugeUnknownType:
+		return "g", nil
+	case CounterUnknownType:
+		return "c", nil
+	case DropUnknownType:
+		return "", nil
+	default:
+		return "", fmt.Errorf("Unknown statsd type '%s'.", stat.Type)
+	}
+}
@@ -0,0 +1,127 @@
+package statsdlistener_test
+
+import (
+	"metron/statsdlistener"
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unknown types", func() {
+	var (
+		listener     statsdlistener.StatsdListener
+		envelopeChan chan *events.Envelope
+		wg           *sync.WaitGroup
+		connection   net.Conn
+	)
+
+	send := func(statsdmsg string) {
+		_, err := connection.Write([]byte(statsdmsg))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	start := func(fallback statsdlistener.UnknownTypeFallback) {
+		listener.SetUnknownTypeFallback(fallback)
+		wg = stopMeLater(func() { listener.Run(envelopeChan) })
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for statsd on host"))
+
+		var err error
+		connection, err = net.Dial("udp", "localhost:51162")
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+
+		listener = statsdlistener.NewStatsdListener("localhost:51162", loggertesthelper.Logger(), "name")
+		envelopeChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		connection.Close()
+		stopAndWait(func() { listener.Stop() }, wg)
+	})
+
+	It("rejects lines with an unknown type with a warning by default", func() {
+		start(statsdlistener.RejectUnknownType)
+		send("fake-origin.test.histogram:23|h\nfake-origin.test.gauge:42|g")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 42, "gauge")
+		Consistently(envelopeChan).ShouldNot(Receive())
+
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).To(ContainSubstring("Error parsing stat line \"fake-origin.test.histogram:23|h\": Unknown statsd type 'h'."))
+	})
+
+	It("treats lines with an unknown type as gauges", func() {
+		start(statsdlistener.GaugeUnknownType)
+		send("fake-origin.test.histogram:23|h\nfake-origin.test.histogram:+2|h")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.histogram", 23, "gauge")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.histogram", 25, "gauge")
+	})
+
+	It("treats lines with an unknown type as counters", func() {
+		start(statsdlistener.CounterUnknownType)
+		send("fake-origin.test.set:3|s\nfake-origin.test.set:4|s")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.set", 3, "counter")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.set", 7, "counter")
+	})
+
+	It("drops lines with an unknown type without a warning", func() {
+		start(statsdlistener.DropUnknownType)
+		send("fake-origin.test.histogram:23|h\nfake-origin.test.gauge:42|g")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.gauge", 42, "gauge")
+		Consistently(envelopeChan).ShouldNot(Receive())
+
+		Expect(loggertesthelper.TestLoggerSink.LogContents()).NotTo(ContainSubstring("test.histogram"))
+	})
+
+	It("handles the known types the same with every fallback", func() {
+		start(statsdlistener.GaugeUnknownType)
+		send("fake-origin.test.counter:3|c\nfake-origin.test.timing:5|ms")
+
+		var receivedEnvelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.counter", 3, "counter")
+
+		Eventually(envelopeChan).Should(Receive(&receivedEnvelope))
+		checkValueMetric(receivedEnvelope, "fake-origin", "test.timing", 5, "ms")
+	})
+})
+
+var _ = Describe("ParseUnknownTypeFallback", func() {
+	It("parses the fallbacks", func() {
+		Expect(statsdlistener.ParseUnknownTypeFallback("reject")).To(Equal(statsdlistener.RejectUnknownType))
+		Expect(statsdlistener.ParseUnknownTypeFallback("gauge")).To(Equal(statsdlistener.GaugeUnknownType))
+		Expect(statsdlistener.ParseUnknownTypeFallback("counter")).To(Equal(statsdlistener.CounterUnknownType))
+		Expect(statsdlistener.ParseUnknownTypeFallback("drop-silent")).To(Equal(statsdlistener.DropUnknownType))
+	})
+
+	It("defaults to rejecting", func() {
+		Expect(statsdlistener.ParseUnknownTypeFallback("")).To(Equal(statsdlistener.RejectUnknownType))
+	})
+
+	It("returns an error for an unknown fallback", func() {
+		_, err := statsdlistener.ParseUnknownTypeFallback("bogus")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,195 @@
+package sysloglistener
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const byteOrderMark = "\xef\xbb\xbf"
+
+// Message is a syslog message parsed from a line in the format of RFC 5424 or
+// RFC 3164. Fields the line leaves out are empty, the timestamp is zero then.
+type Message struct {
+	Priority  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	Text      string
+}
+
+// Severity returns the severity encoded in the priority, from 0 for
+// emergencies to 7 for debug messages.
+func (m Message) Severity() int {
+	return m.Priority % 8
+}
+
+// Facility returns the facility encoded in the priority.
+func (m Message) Facility() int {
+	return m.Priority / 8
+}
+
+// ParseLine parses a syslog line, telling RFC 5424 lines apart by the version
+// following their priority. RFC 3164 timestamps have no year, so they are
+// taken to be in the year of now, or in the year before if that would put
+// them more than a day after now.
+func ParseLine(line string, now time.Time) (Message, error) {
+	priority, rest, err := parsePriority(line)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if strings.HasPrefix(rest, "1 ") {
+		return parseRFC5424(priority, rest[len("1 "):])
+	}
+	return parseRFC3164(priority, rest, now)
+}
+
+func parsePriority(line string) (int, string, error) {
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+		return 0, "", errors.New("missing priority")
+	}
+
+	priority, err := strconv.Atoi(line[1:end])
+	if err != nil || priority < 0 || priority > 191 {
+		return 0, "", fmt.Errorf("invalid priority '%s'", line[1:end])
+	}
+	return priority, line[end+1:], nil
+}
+
+// parseRFC5424 parses what follows the version of an RFC 5424 line:
+//
+//	TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+//
+// with "-" for fields left out. The message id and structured data are
+// dropped.
+func parseRFC5424(priority int, rest string) (Message, error) {
+	var fields [5]string
+	for i := range fields {
+		end := strings.IndexByte(rest, ' ')
+		if end <= 0 {
+			return Message{}, errors.New("incomplete RFC 5424 header")
+		}
+		fields[i], rest = rest[:end], rest[end+1:]
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+
+	message := Message{
+		Priority: priority,
+		Hostname: fields[1],
+		AppName:  fields[2],
+		ProcID:   fields[3],
+	}
+	if fields[0] != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return Message{}, fmt.Errorf("invalid RFC 5424 timestamp '%s'", fields[0])
+		}
+		message.Timestamp = timestamp
+	}
+
+	rest, err := skipStructuredData(rest)
+	if err != nil {
+		return Message{}, err
+	}
+	if rest != "" {
+		if rest[0] != ' ' {
+			return Message{}, errors.New("missing space after the structured data")
+		}
+		message.Text = strings.TrimPrefix(rest[1:], byteOrderMark)
+	}
+	return message, nil
+}
+
+// skipStructuredData returns what follows the structured data at the start of
+// rest, which is either "-" or a sequence of elements in brackets whose
+// quoted parameter values may contain escaped quotes and brackets.
+func skipStructuredData(rest string) (string, error) {
+	if strings.HasPrefix(rest, "-") {
+		return rest[1:], nil
+	}
+	if !strings.HasPrefix(rest, "[") {
+		return "", errors.New("invalid RFC 5424 structured data")
+	}
+
+	inElement, inValue := false, false
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case !inElement && rest[i] == '[':
+			inElement = true
+		case !inElement:
+			return rest[i:], nil
+		case inValue && rest[i] == '\\':
+			i++
+		case rest[i] == '"':
+			inValue = !inValue
+		case !inValue && rest[i] == ']':
+			inElement = false
+		}
+	}
+	if inElement {
+		return "", errors.New("unterminated RFC 5424 structured data")
+	}
+	return "", nil
+}
+
+// parseRFC3164 parses what follows the priority of an RFC 3164 line:
+//
+//	Mmm dd hh:mm:ss [HOSTNAME] TAG[[PID]]: MSG
+//
+// Local senders often leave out the hostname, so it is only taken to be
+// present when the word after the timestamp does not end the tag with a
+// colon. Lines without a tag are kept whole as the message.
+func parseRFC3164(priority int, rest string, now time.Time) (Message, error) {
+	if len(rest) < len(time.Stamp) {
+		return Message{}, errors.New("missing RFC 3164 timestamp")
+	}
+	timestamp, err := time.ParseInLocation(time.Stamp, rest[:len(time.Stamp)], now.Location())
+	if err != nil {
+		return Message{}, fmt.Errorf("invalid RFC 3164 timestamp '%s'", rest[:len(time.Stamp)])
+	}
+	timestamp = timestamp.AddDate(now.Year(), 0, 0)
+	if timestamp.After(now.Add(24 * time.Hour)) {
+		timestamp = timestamp.AddDate(-1, 0, 0)
+	}
+
+	message := Message{Priority: priority, Timestamp: timestamp}
+	rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+
+	word, afterWord := splitWord(rest)
+	if !isTag(word) {
+		message.Hostname = word
+		rest = afterWord
+		word, afterWord = splitWord(rest)
+	}
+
+	if !isTag(word) {
+		message.Text = rest
+		return message, nil
+	}
+	message.AppName = strings.TrimSuffix(word, ":")
+	if start := strings.IndexByte(message.AppName, '['); start > 0 && strings.HasSuffix(message.AppName, "]") {
+		message.ProcID = message.AppName[start+1 : len(message.AppName)-1]
+		message.AppName = message.AppName[:start]
+	}
+	message.Text = afterWord
+	return message, nil
+}
+
+func splitWord(s string) (string, string) {
+	end := strings.IndexByte(s, ' ')
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end+1:]
+}
+
+func isTag(word string) bool {
+	return len(word) > 1 && strings.HasSuffix(word, ":")
+}
@@ -0,0 +1,141 @@
+package sysloglistener_test
+
+import (
+	"metron/sysloglistener"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseLine", func() {
+	now := time.Date(2015, time.October, 16, 12, 0, 0, 0, time.UTC)
+
+	Context("with RFC 5424 lines", func() {
+		It("parses every field", func() {
+			message, err := sysloglistener.ParseLine("<134>1 2015-10-16T10:11:12.345Z host1 haproxy 4711 ID47 - GET /v2/info 200", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message).To(Equal(sysloglistener.Message{
+				Priority:  134,
+				Timestamp: time.Date(2015, time.October, 16, 10, 11, 12, 345000000, time.UTC),
+				Hostname:  "host1",
+				AppName:   "haproxy",
+				ProcID:    "4711",
+				Text:      "GET /v2/info 200",
+			}))
+			Expect(message.Facility()).To(Equal(16))
+			Expect(message.Severity()).To(Equal(6))
+		})
+
+		It("leaves out the fields given as -", func() {
+			message, err := sysloglistener.ParseLine("<14>1 - - - - - - text", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message).To(Equal(sysloglistener.Message{Priority: 14, Text: "text"}))
+		})
+
+		It("skips the structured data, also with escaped brackets and quotes", func() {
+			message, err := sysloglistener.ParseLine(`<14>1 - host app - - [exampleSDID@32473 iut="3" eventSource="a \"quoted\" ] bracket"][other@1 a="b"] text`, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message.Text).To(Equal("text"))
+		})
+
+		It("accepts lines without a message", func() {
+			message, err := sysloglistener.ParseLine(`<14>1 - host app - - [id@1 a="b"]`, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message.AppName).To(Equal("app"))
+			Expect(message.Text).To(BeEmpty())
+		})
+
+		It("strips the byte order mark from the message", func() {
+			message, err := sysloglistener.ParseLine("<14>1 - host app - - - \xef\xbb\xbftext", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message.Text).To(Equal("text"))
+		})
+
+		It("rejects incomplete headers", func() {
+			_, err := sysloglistener.ParseLine("<14>1 2015-10-16T10:11:12Z host1 haproxy", now)
+			Expect(err).To(MatchError("incomplete RFC 5424 header"))
+		})
+
+		It("rejects invalid timestamps", func() {
+			_, err := sysloglistener.ParseLine("<14>1 yesterday host app - - - text", now)
+			Expect(err).To(MatchError("invalid RFC 5424 timestamp 'yesterday'"))
+		})
+
+		It("rejects unterminated structured data", func() {
+			_, err := sysloglistener.ParseLine(`<14>1 - host app - - [id@1 a="b] text`, now)
+			Expect(err).To(MatchError("unterminated RFC 5424 structured data"))
+		})
+	})
+
+	Context("with RFC 3164 lines", func() {
+		It("parses every field", func() {
+			message, err := sysloglistener.ParseLine("<134>Oct 16 10:11:12 host1 haproxy[4711]: GET /v2/info 200", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message).To(Equal(sysloglistener.Message{
+				Priority:  134,
+				Timestamp: time.Date(2015, time.October, 16, 10, 11, 12, 0, time.UTC),
+				Hostname:  "host1",
+				AppName:   "haproxy",
+				ProcID:    "4711",
+				Text:      "GET /v2/info 200",
+			}))
+		})
+
+		It("parses lines without a hostname or process id", func() {
+			message, err := sysloglistener.ParseLine("<134>Oct  6 10:11:12 haproxy: started", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message).To(Equal(sysloglistener.Message{
+				Priority:  134,
+				Timestamp: time.Date(2015, time.October, 6, 10, 11, 12, 0, time.UTC),
+				AppName:   "haproxy",
+				Text:      "started",
+			}))
+		})
+
+		It("keeps lines without a tag whole as the message", func() {
+			message, err := sysloglistener.ParseLine("<13>Oct 16 10:11:12 host1 something happened", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message.Hostname).To(Equal("host1"))
+			Expect(message.AppName).To(BeEmpty())
+			Expect(message.Text).To(Equal("something happened"))
+		})
+
+		It("puts timestamps more than a day ahead into the year before", func() {
+			message, err := sysloglistener.ParseLine("<13>Dec 31 23:59:59 host1 app: text", now)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(message.Timestamp).To(Equal(time.Date(2014, time.December, 31, 23, 59, 59, 0, time.UTC)))
+		})
+
+		It("rejects lines without a timestamp", func() {
+			_, err := sysloglistener.ParseLine("<13>host1 app: text", now)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("rejects lines without a priority", func() {
+		_, err := sysloglistener.ParseLine("Oct 16 10:11:12 host1 app: text", now)
+		Expect(err).To(MatchError("missing priority"))
+	})
+
+	It("rejects priorities out of range", func() {
+		_, err := sysloglistener.ParseLine("<192>Oct 16 10:11:12 host1 app: text", now)
+		Expect(err).To(MatchError("invalid priority '192'"))
+	})
+
+	It("rejects garbage", func() {
+		for _, line := range []string{"garbage", "<>", "<abc>text", "<1234>text", "<13>"} {
+			_, err := sysloglistener.ParseLine(line, now)
+			Expect(err).To(HaveOccurred(), line)
+		}
+	})
+})
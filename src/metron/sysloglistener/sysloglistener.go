@@ -0,0 +1,224 @@
+package sysloglistener
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/gogo/protobuf/proto"
+)
+
+// SourceType is the source type of the log messages made from syslog lines.
+const SourceType = "SYS"
+
+type Network string
+
+const (
+	// TCP reads newline separated lines from every connection.
+	TCP Network = "tcp"
+	// Unixgram reads one line from every datagram sent to a unix socket.
+	Unixgram Network = "unixgram"
+)
+
+// SyslogListener receives syslog lines from jobs that cannot emit dropsonde
+// and turns them into log messages with the configured origin. The messages
+// have no app id.
+type SyslogListener struct {
+	network     Network
+	address     string
+	origin      string
+	contextName string
+
+	stopChan chan struct{}
+	stopOnce *sync.Once
+
+	receivedLines uint64
+	parseErrors   uint64
+
+	*gosteno.Logger
+}
+
+func NewSyslogListener(network Network, address string, origin string, logger *gosteno.Logger, name string) *SyslogListener {
+	return &SyslogListener{
+		network:     network,
+		address:     address,
+		origin:      origin,
+		contextName: name,
+		stopChan:    make(chan struct{}),
+		stopOnce:    &sync.Once{},
+		Logger:      logger,
+	}
+}
+
+// Run listens for syslog lines and emits a log message for every line it can
+// parse on outputChan until Stop is called. Messages of severity error and
+// above become ERR messages, all others OUT messages. Lines that cannot be
+// parsed are counted and dropped.
+func (l *SyslogListener) Run(outputChan chan<- *events.Envelope) {
+	switch l.network {
+	case TCP:
+		l.runTCP(outputChan)
+	case Unixgram:
+		l.runUnixgram(outputChan)
+	default:
+		l.Fatalf("Unknown syslog network '%s', must be tcp or unixgram", l.network)
+	}
+}
+
+func (l *SyslogListener) runTCP(outputChan chan<- *events.Envelope) {
+	listener, err := net.Listen("tcp", l.address)
+	if err != nil {
+		l.Fatalf("Failed to start syslog listener. %s", err)
+	}
+	l.Infof("Listening for syslog on tcp %s", l.address)
+
+	var lock sync.Mutex
+	connections := make(map[net.Conn]struct{})
+	var readers sync.WaitGroup
+	defer readers.Wait()
+
+	go func() {
+		<-l.stopChan
+		listener.Close()
+
+		lock.Lock()
+		defer lock.Unlock()
+		for connection := range connections {
+			connection.Close()
+		}
+	}()
+
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			l.Debugf("Error while accepting. %s", err)
+			return
+		}
+
+		lock.Lock()
+		select {
+		case <-l.stopChan:
+			lock.Unlock()
+			connection.Close()
+			continue
+		default:
+			connections[connection] = struct{}{}
+		}
+		lock.Unlock()
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			defer func() {
+				lock.Lock()
+				delete(connections, connection)
+				lock.Unlock()
+				connection.Close()
+			}()
+
+			scanner := bufio.NewScanner(connection)
+			for scanner.Scan() {
+				l.handleLine(scanner.Text(), outputChan)
+			}
+			if err := scanner.Err(); err != nil {
+				l.Debugf("Error while reading from %s. %s", connection.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (l *SyslogListener) runUnixgram(outputChan chan<- *events.Envelope) {
+	// A socket left behind by a previous run would make listening fail.
+	if info, err := os.Lstat(l.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(l.address)
+	}
+
+	connection, err := net.ListenPacket("unixgram", l.address)
+	if err != nil {
+		l.Fatalf("Failed to start syslog listener. %s", err)
+	}
+	defer os.Remove(l.address)
+	l.Infof("Listening for syslog on unixgram %s", l.address)
+
+	go func() {
+		<-l.stopChan
+		connection.Close()
+	}()
+
+	readBuffer := make([]byte, 65535)
+	for {
+		readCount, _, err := connection.ReadFrom(readBuffer)
+		if err != nil {
+			l.Debugf("Error while reading. %s", err)
+			return
+		}
+		l.handleLine(strings.TrimRight(string(readBuffer[:readCount]), "\r\n"), outputChan)
+	}
+}
+
+func (l *SyslogListener) handleLine(line string, outputChan chan<- *events.Envelope) {
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" {
+		return
+	}
+	atomic.AddUint64(&l.receivedLines, 1)
+
+	receivedAt := time.Now()
+	message, err := ParseLine(line, receivedAt)
+	if err != nil {
+		atomic.AddUint64(&l.parseErrors, 1)
+		l.Debugf("SyslogListener: Dropping line \"%.64s\": %s", line, err)
+		return
+	}
+
+	select {
+	case outputChan <- l.envelope(message, receivedAt):
+	case <-l.stopChan:
+	}
+}
+
+func (l *SyslogListener) envelope(message Message, receivedAt time.Time) *events.Envelope {
+	timestamp := message.Timestamp
+	if timestamp.IsZero() {
+		timestamp = receivedAt
+	}
+
+	messageType := events.LogMessage_OUT
+	if message.Severity() <= 3 {
+		messageType = events.LogMessage_ERR
+	}
+
+	return &events.Envelope{
+		Origin:    proto.String(l.origin),
+		Timestamp: proto.Int64(receivedAt.UnixNano()),
+		EventType: events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{
+			Message:        []byte(message.Text),
+			MessageType:    messageType.Enum(),
+			Timestamp:      proto.Int64(timestamp.UnixNano()),
+			SourceType:     proto.String(SourceType),
+			SourceInstance: proto.String(message.AppName),
+		},
+	}
+}
+
+func (l *SyslogListener) Stop() {
+	l.stopOnce.Do(func() { close(l.stopChan) })
+}
+
+func (l *SyslogListener) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name: l.contextName,
+		Metrics: []instrumentation.Metric{
+			instrumentation.Metric{Name: "receivedLines", Value: atomic.LoadUint64(&l.receivedLines)},
+			instrumentation.Metric{Name: "parseErrors", Value: atomic.LoadUint64(&l.parseErrors)},
+		},
+	}
+}
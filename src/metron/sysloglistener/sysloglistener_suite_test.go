@@ -0,0 +1,13 @@
+package sysloglistener_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSysloglistener(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sysloglistener Suite")
+}
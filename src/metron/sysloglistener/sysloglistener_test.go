@@ -0,0 +1,201 @@
+package sysloglistener_test
+
+import (
+	"io/ioutil"
+	"metron/sysloglistener"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyslogListener", func() {
+	var (
+		listener     *sysloglistener.SyslogListener
+		envelopeChan chan *events.Envelope
+		done         chan struct{}
+	)
+
+	start := func(network sysloglistener.Network, address string) {
+		listener = sysloglistener.NewSyslogListener(network, address, "haproxy-job", loggertesthelper.Logger(), "syslogListener")
+		done = make(chan struct{})
+		go func() {
+			listener.Run(envelopeChan)
+			close(done)
+		}()
+		Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(ContainSubstring("Listening for syslog"))
+	}
+
+	expectLogMessage := func(text string, messageType events.LogMessage_MessageType, sourceInstance string, timestamp time.Time) {
+		var envelope *events.Envelope
+		Eventually(envelopeChan).Should(Receive(&envelope))
+		Expect(envelope.GetOrigin()).To(Equal("haproxy-job"))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(envelope.GetTimestamp()).To(BeNumerically("~", time.Now().UnixNano(), int64(time.Second)))
+
+		logMessage := envelope.GetLogMessage()
+		Expect(string(logMessage.GetMessage())).To(Equal(text))
+		Expect(logMessage.GetMessageType()).To(Equal(messageType))
+		Expect(logMessage.GetSourceType()).To(Equal("SYS"))
+		Expect(logMessage.GetSourceInstance()).To(Equal(sourceInstance))
+		if !timestamp.IsZero() {
+			Expect(logMessage.GetTimestamp()).To(Equal(timestamp.UnixNano()))
+		}
+		Expect(logMessage.AppId).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		loggertesthelper.TestLoggerSink.Clear()
+		envelopeChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		listener.Stop()
+		Eventually(done).Should(BeClosed())
+	})
+
+	Context("over TCP", func() {
+		var connection net.Conn
+
+		BeforeEach(func() {
+			start(sysloglistener.TCP, "localhost:51170")
+
+			var err error
+			connection, err = net.Dial("tcp", "localhost:51170")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			connection.Close()
+		})
+
+		It("emits a log message for every line in either format", func() {
+			_, err := connection.Write([]byte("<134>1 2015-10-16T10:11:12.345Z host1 haproxy 4711 - - GET /v2/info 200\n<11>Oct 16 10:11:12 host1 haproxy[4711]: backend down\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			expectLogMessage("GET /v2/info 200", events.LogMessage_OUT, "haproxy", time.Date(2015, time.October, 16, 10, 11, 12, 345000000, time.UTC))
+			expectLogMessage("backend down", events.LogMessage_ERR, "haproxy", time.Date(time.Now().Year(), time.October, 16, 10, 11, 12, 0, time.Local))
+		})
+
+		It("stamps messages without a timestamp with the time they were received", func() {
+			_, err := connection.Write([]byte("<14>1 - - app - - - text\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var envelope *events.Envelope
+			Eventually(envelopeChan).Should(Receive(&envelope))
+			Expect(envelope.GetLogMessage().GetTimestamp()).To(Equal(envelope.GetTimestamp()))
+		})
+
+		It("counts and drops garbage lines, going on with the next line", func() {
+			_, err := connection.Write([]byte("garbage\n\n<14>1 yesterday - - - - - text\n<14>1 - - app - - - text\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			expectLogMessage("text", events.LogMessage_OUT, "app", time.Time{})
+			Expect(listener.Emit().Metrics).To(ConsistOf(
+				instrumentation.Metric{Name: "receivedLines", Value: uint64(3)},
+				instrumentation.Metric{Name: "parseErrors", Value: uint64(2)},
+			))
+		})
+
+		It("reads from several connections", func() {
+			other, err := net.Dial("tcp", "localhost:51170")
+			Expect(err).NotTo(HaveOccurred())
+			defer other.Close()
+
+			_, err = other.Write([]byte("<14>1 - - other - - - from the other\n"))
+			Expect(err).NotTo(HaveOccurred())
+			expectLogMessage("from the other", events.LogMessage_OUT, "other", time.Time{})
+
+			_, err = connection.Write([]byte("<14>1 - - first - - - from the first\n"))
+			Expect(err).NotTo(HaveOccurred())
+			expectLogMessage("from the first", events.LogMessage_OUT, "first", time.Time{})
+		})
+
+		It("closes the connections when stopped", func() {
+			listener.Stop()
+			Eventually(done).Should(BeClosed())
+
+			_, err := connection.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("over a unix datagram socket", func() {
+		var (
+			socketDir  string
+			socketPath string
+			connection net.Conn
+		)
+
+		BeforeEach(func() {
+			var err error
+			socketDir, err = ioutil.TempDir("", "sysloglistener")
+			Expect(err).NotTo(HaveOccurred())
+			socketPath = filepath.Join(socketDir, "syslog.sock")
+		})
+
+		JustBeforeEach(func() {
+			start(sysloglistener.Unixgram, socketPath)
+
+			var err error
+			connection, err = net.Dial("unixgram", socketPath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			connection.Close()
+			os.RemoveAll(socketDir)
+		})
+
+		It("emits a log message for every datagram in either format", func() {
+			_, err := connection.Write([]byte("<11>1 2015-10-16T10:11:12Z host1 haproxy - - - backend down\n"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = connection.Write([]byte("<134>Oct 16 10:11:12 haproxy[4711]: GET /v2/info 200"))
+			Expect(err).NotTo(HaveOccurred())
+
+			expectLogMessage("backend down", events.LogMessage_ERR, "haproxy", time.Date(2015, time.October, 16, 10, 11, 12, 0, time.UTC))
+			expectLogMessage("GET /v2/info 200", events.LogMessage_OUT, "haproxy", time.Date(time.Now().Year(), time.October, 16, 10, 11, 12, 0, time.Local))
+		})
+
+		It("counts and drops garbage datagrams", func() {
+			_, err := connection.Write([]byte("garbage"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = connection.Write([]byte("<14>1 - - app - - - text"))
+			Expect(err).NotTo(HaveOccurred())
+
+			expectLogMessage("text", events.LogMessage_OUT, "app", time.Time{})
+			Expect(listener.Emit().Metrics).To(ContainElement(instrumentation.Metric{Name: "parseErrors", Value: uint64(1)}))
+		})
+
+		It("removes the socket when stopped", func() {
+			listener.Stop()
+			Eventually(done).Should(BeClosed())
+
+			_, err := os.Stat(socketPath)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		Context("when a socket was left behind", func() {
+			BeforeEach(func() {
+				leftBehind, err := net.ListenPacket("unixgram", socketPath)
+				Expect(err).NotTo(HaveOccurred())
+				// closing a unixgram socket does not remove its file
+				leftBehind.Close()
+			})
+
+			It("replaces it", func() {
+				_, err := connection.Write([]byte("<14>1 - - app - - - text"))
+				Expect(err).NotTo(HaveOccurred())
+
+				expectLogMessage("text", events.LogMessage_OUT, "app", time.Time{})
+			})
+		})
+	})
+})
@@ -21,16 +21,32 @@ func New(deploymentName string, job string, index uint) *Tagger {
 	}
 }
 
+// Run stamps metron's deployment name, job, index and IP address onto every
+// envelope, including the ones generated by metron itself, that does not carry
+// them yet. Values already set by the emitter are kept. The envelopes are
+// tagged in place, so they must not be shared with anything else that reads
+// them.
 func (t *Tagger) Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope) {
 	ip, _ := localip.LocalIP()
-	for envelope := range inputChan {
-		newEnvelope := *envelope
+	deployment := proto.String(t.deploymentName)
+	job := proto.String(t.job)
+	index := proto.String(strconv.Itoa(int(t.index)))
+	ipAddress := proto.String(ip)
 
-		newEnvelope.Deployment = proto.String(t.deploymentName)
-		newEnvelope.Job = proto.String(t.job)
-		newEnvelope.Index = proto.String(strconv.Itoa(int(t.index)))
-		newEnvelope.Ip = proto.String(ip)
+	for envelope := range inputChan {
+		if envelope.GetDeployment() == "" {
+			envelope.Deployment = deployment
+		}
+		if envelope.GetJob() == "" {
+			envelope.Job = job
+		}
+		if envelope.GetIndex() == "" {
+			envelope.Index = index
+		}
+		if envelope.GetIp() == "" {
+			envelope.Ip = ipAddress
+		}
 
-		outputChan <- &newEnvelope
+		outputChan <- envelope
 	}
 }
@@ -11,17 +11,101 @@ import (
 )
 
 var _ = Describe("Tagger", func() {
-	It("tags events with the given deployment name, job, index and IP address", func() {
-		t := tagger.New("test-deployment", "test-job", 2)
+	var (
+		inputChan  chan *events.Envelope
+		outputChan chan *events.Envelope
+		ip         string
+	)
+
+	BeforeEach(func() {
+		inputChan = make(chan *events.Envelope)
+		outputChan = make(chan *events.Envelope)
+		ip, _ = localip.LocalIP()
 
-		inputChan := make(chan *events.Envelope)
-		outputChan := make(chan *events.Envelope)
+		t := tagger.New("test-deployment", "test-job", 2)
 		go t.Run(inputChan, outputChan)
-		envelope := basicHttpStartStopMessage()
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	tag := func(envelope *events.Envelope) *events.Envelope {
 		inputChan <- envelope
+		var tagged *events.Envelope
+		Eventually(outputChan).Should(Receive(&tagged))
+		return tagged
+	}
+
+	It("tags events with the given deployment name, job, index and IP address", func() {
+		envelope := basicHttpStartStopMessage()
 		expectedEnvelope := basicTaggedHttpStartStopMessage(*envelope)
+		inputChan <- envelope
 		Eventually(outputChan).Should(Receive(Equal(expectedEnvelope)))
 	})
+
+	It("tags the envelope in place", func() {
+		envelope := basicHttpStartStopMessage()
+		Expect(tag(envelope)).To(BeIdenticalTo(envelope))
+	})
+
+	It("tags fields set to empty strings", func() {
+		envelope := basicHttpStartStopMessage()
+		envelope.Deployment = proto.String("")
+		envelope.Job = proto.String("")
+		envelope.Index = proto.String("")
+		envelope.Ip = proto.String("")
+
+		tagged := tag(envelope)
+		Expect(tagged.GetDeployment()).To(Equal("test-deployment"))
+		Expect(tagged.GetJob()).To(Equal("test-job"))
+		Expect(tagged.GetIndex()).To(Equal("2"))
+		Expect(tagged.GetIp()).To(Equal(ip))
+	})
+
+	It("keeps the deployment name set by the emitter", func() {
+		envelope := basicHttpStartStopMessage()
+		envelope.Deployment = proto.String("emitter-deployment")
+
+		tagged := tag(envelope)
+		Expect(tagged.GetDeployment()).To(Equal("emitter-deployment"))
+		Expect(tagged.GetJob()).To(Equal("test-job"))
+		Expect(tagged.GetIndex()).To(Equal("2"))
+		Expect(tagged.GetIp()).To(Equal(ip))
+	})
+
+	It("keeps the job set by the emitter", func() {
+		envelope := basicHttpStartStopMessage()
+		envelope.Job = proto.String("emitter-job")
+
+		tagged := tag(envelope)
+		Expect(tagged.GetDeployment()).To(Equal("test-deployment"))
+		Expect(tagged.GetJob()).To(Equal("emitter-job"))
+		Expect(tagged.GetIndex()).To(Equal("2"))
+		Expect(tagged.GetIp()).To(Equal(ip))
+	})
+
+	It("keeps the index set by the emitter, even if it is 0", func() {
+		envelope := basicHttpStartStopMessage()
+		envelope.Index = proto.String("0")
+
+		tagged := tag(envelope)
+		Expect(tagged.GetDeployment()).To(Equal("test-deployment"))
+		Expect(tagged.GetJob()).To(Equal("test-job"))
+		Expect(tagged.GetIndex()).To(Equal("0"))
+		Expect(tagged.GetIp()).To(Equal(ip))
+	})
+
+	It("keeps the IP address set by the emitter", func() {
+		envelope := basicHttpStartStopMessage()
+		envelope.Ip = proto.String("10.10.10.10")
+
+		tagged := tag(envelope)
+		Expect(tagged.GetDeployment()).To(Equal("test-deployment"))
+		Expect(tagged.GetJob()).To(Equal("test-job"))
+		Expect(tagged.GetIndex()).To(Equal("2"))
+		Expect(tagged.GetIp()).To(Equal("10.10.10.10"))
+	})
 })
 
 func basicHttpStartStopMessage() *events.Envelope {
@@ -0,0 +1,211 @@
+package validator
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// DropReason tells why an envelope was dropped.
+type DropReason string
+
+const (
+	// ReasonMissingOrigin is given for envelopes without an origin.
+	ReasonMissingOrigin DropReason = "missingOrigin"
+	// ReasonUnknownEventType is given for envelopes without an event type or
+	// with one metron does not know.
+	ReasonUnknownEventType DropReason = "unknownEventType"
+	// ReasonMissingEvent is given for envelopes whose event type is set but
+	// whose event of that type is not.
+	ReasonMissingEvent DropReason = "missingEvent"
+	// ReasonMissingField is given for envelopes whose event lacks a field
+	// required for its type.
+	ReasonMissingField DropReason = "missingField"
+)
+
+// Validate returns why envelope must not be forwarded, or an empty reason if
+// it may be.
+func Validate(envelope *events.Envelope) DropReason {
+	if envelope.GetOrigin() == "" {
+		return ReasonMissingOrigin
+	}
+	if envelope.EventType == nil {
+		return ReasonUnknownEventType
+	}
+
+	switch envelope.GetEventType() {
+	case events.Envelope_Heartbeat:
+		heartbeat := envelope.GetHeartbeat()
+		if heartbeat == nil {
+			return ReasonMissingEvent
+		}
+		if heartbeat.SentCount == nil || heartbeat.ReceivedCount == nil || heartbeat.ErrorCount == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_HttpStart:
+		start := envelope.GetHttpStart()
+		if start == nil {
+			return ReasonMissingEvent
+		}
+		if start.Timestamp == nil || start.RequestId == nil || start.PeerType == nil || start.Method == nil || start.Uri == nil || start.RemoteAddress == nil || start.UserAgent == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_HttpStop:
+		stop := envelope.GetHttpStop()
+		if stop == nil {
+			return ReasonMissingEvent
+		}
+		if stop.Timestamp == nil || stop.Uri == nil || stop.RequestId == nil || stop.PeerType == nil || stop.StatusCode == nil || stop.ContentLength == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_HttpStartStop:
+		startStop := envelope.GetHttpStartStop()
+		if startStop == nil {
+			return ReasonMissingEvent
+		}
+		if startStop.StartTimestamp == nil || startStop.StopTimestamp == nil || startStop.RequestId == nil || startStop.PeerType == nil || startStop.Method == nil || startStop.Uri == nil || startStop.RemoteAddress == nil || startStop.UserAgent == nil || startStop.StatusCode == nil || startStop.ContentLength == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_LogMessage:
+		logMessage := envelope.GetLogMessage()
+		if logMessage == nil {
+			return ReasonMissingEvent
+		}
+		if logMessage.Message == nil || logMessage.MessageType == nil || logMessage.Timestamp == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_ValueMetric:
+		valueMetric := envelope.GetValueMetric()
+		if valueMetric == nil {
+			return ReasonMissingEvent
+		}
+		if valueMetric.Name == nil || valueMetric.Value == nil || valueMetric.Unit == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_CounterEvent:
+		counterEvent := envelope.GetCounterEvent()
+		if counterEvent == nil {
+			return ReasonMissingEvent
+		}
+		if counterEvent.Name == nil || counterEvent.Delta == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_Error:
+		errorEvent := envelope.GetError()
+		if errorEvent == nil {
+			return ReasonMissingEvent
+		}
+		if errorEvent.Source == nil || errorEvent.Code == nil || errorEvent.Message == nil {
+			return ReasonMissingField
+		}
+	case events.Envelope_ContainerMetric:
+		containerMetric := envelope.GetContainerMetric()
+		if containerMetric == nil {
+			return ReasonMissingEvent
+		}
+		if containerMetric.ApplicationId == nil || containerMetric.InstanceIndex == nil || containerMetric.CpuPercentage == nil || containerMetric.MemoryBytes == nil || containerMetric.DiskBytes == nil {
+			return ReasonMissingField
+		}
+	default:
+		return ReasonUnknownEventType
+	}
+	return ""
+}
+
+// Validator drops the envelopes that downstream consumers cannot handle, such
+// as those whose event type is set but whose event is not, and counts them
+// per reason.
+type Validator struct {
+	lock sync.Mutex
+
+	maxTimestampSkew    time.Duration
+	dropped             map[DropReason]uint64
+	rewrittenTimestamps uint64
+
+	logger *gosteno.Logger
+}
+
+func New(logger *gosteno.Logger) *Validator {
+	return &Validator{
+		dropped: make(map[DropReason]uint64),
+		logger:  logger,
+	}
+}
+
+// SetMaxTimestampSkew makes the validator rewrite the timestamp of envelopes
+// that is further than skew from the time they are validated at to that time,
+// and count them. Envelopes without a timestamp are left as they are. Zero,
+// the default, keeps every timestamp.
+func (v *Validator) SetMaxTimestampSkew(skew time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.maxTimestampSkew = skew
+}
+
+// Run passes on the valid envelopes read from inputChan until inputChan is
+// closed.
+func (v *Validator) Run(inputChan <-chan *events.Envelope, outputChan chan<- *events.Envelope) {
+	for envelope := range inputChan {
+		if !v.validate(envelope) {
+			continue
+		}
+		outputChan <- envelope
+	}
+}
+
+func (v *Validator) validate(envelope *events.Envelope) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if reason := Validate(envelope); reason != "" {
+		v.logger.Debugf("Validator: Dropping envelope of origin %s, %s: %v", envelope.GetOrigin(), reason, envelope)
+		v.dropped[reason]++
+		return false
+	}
+
+	if v.maxTimestampSkew > 0 && envelope.Timestamp != nil {
+		now := time.Now()
+		skew := now.Sub(time.Unix(0, envelope.GetTimestamp()))
+		if skew > v.maxTimestampSkew || skew < -v.maxTimestampSkew {
+			timestamp := now.UnixNano()
+			envelope.Timestamp = &timestamp
+			v.rewrittenTimestamps++
+		}
+	}
+	return true
+}
+
+func (v *Validator) metrics() []instrumentation.Metric {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	reasons := make([]string, 0, len(v.dropped))
+	for reason := range v.dropped {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+
+	metrics := []instrumentation.Metric{
+		instrumentation.Metric{Name: "rewrittenTimestamps", Value: v.rewrittenTimestamps},
+	}
+	for _, reason := range reasons {
+		metrics = append(metrics, instrumentation.Metric{
+			Name:  "droppedEnvelopes",
+			Value: v.dropped[DropReason(reason)],
+			Tags:  map[string]interface{}{"reason": reason},
+		})
+	}
+	return metrics
+}
+
+func (v *Validator) Emit() instrumentation.Context {
+	return instrumentation.Context{
+		Name:    "Validator",
+		Metrics: v.metrics(),
+	}
+}
@@ -0,0 +1,327 @@
+package validator_test
+
+import (
+	"metron/validator"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// requiredFields lists, per event type, a valid envelope and a function per
+// required field of its event that clears the field.
+var requiredFields = []struct {
+	eventType events.Envelope_EventType
+	valid     func() *events.Envelope
+	clear     map[string]func(*events.Envelope)
+}{
+	{
+		events.Envelope_Heartbeat,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_Heartbeat.Enum(), Heartbeat: &events.Heartbeat{
+				SentCount: proto.Uint64(1), ReceivedCount: proto.Uint64(2), ErrorCount: proto.Uint64(0),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"SentCount":     func(e *events.Envelope) { e.Heartbeat.SentCount = nil },
+			"ReceivedCount": func(e *events.Envelope) { e.Heartbeat.ReceivedCount = nil },
+			"ErrorCount":    func(e *events.Envelope) { e.Heartbeat.ErrorCount = nil },
+		},
+	},
+	{
+		events.Envelope_HttpStart,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_HttpStart.Enum(), HttpStart: &events.HttpStart{
+				Timestamp: proto.Int64(1), RequestId: &events.UUID{}, PeerType: events.PeerType_Client.Enum(), Method: events.Method_GET.Enum(),
+				Uri: proto.String("/"), RemoteAddress: proto.String("127.0.0.1"), UserAgent: proto.String("agent"),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"Timestamp":     func(e *events.Envelope) { e.HttpStart.Timestamp = nil },
+			"RequestId":     func(e *events.Envelope) { e.HttpStart.RequestId = nil },
+			"PeerType":      func(e *events.Envelope) { e.HttpStart.PeerType = nil },
+			"Method":        func(e *events.Envelope) { e.HttpStart.Method = nil },
+			"Uri":           func(e *events.Envelope) { e.HttpStart.Uri = nil },
+			"RemoteAddress": func(e *events.Envelope) { e.HttpStart.RemoteAddress = nil },
+			"UserAgent":     func(e *events.Envelope) { e.HttpStart.UserAgent = nil },
+		},
+	},
+	{
+		events.Envelope_HttpStop,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_HttpStop.Enum(), HttpStop: &events.HttpStop{
+				Timestamp: proto.Int64(1), Uri: proto.String("/"), RequestId: &events.UUID{}, PeerType: events.PeerType_Client.Enum(),
+				StatusCode: proto.Int32(200), ContentLength: proto.Int64(3),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"Timestamp":     func(e *events.Envelope) { e.HttpStop.Timestamp = nil },
+			"Uri":           func(e *events.Envelope) { e.HttpStop.Uri = nil },
+			"RequestId":     func(e *events.Envelope) { e.HttpStop.RequestId = nil },
+			"PeerType":      func(e *events.Envelope) { e.HttpStop.PeerType = nil },
+			"StatusCode":    func(e *events.Envelope) { e.HttpStop.StatusCode = nil },
+			"ContentLength": func(e *events.Envelope) { e.HttpStop.ContentLength = nil },
+		},
+	},
+	{
+		events.Envelope_HttpStartStop,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_HttpStartStop.Enum(), HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1), StopTimestamp: proto.Int64(2), RequestId: &events.UUID{}, PeerType: events.PeerType_Server.Enum(),
+				Method: events.Method_GET.Enum(), Uri: proto.String("/"), RemoteAddress: proto.String("127.0.0.1"), UserAgent: proto.String("agent"),
+				StatusCode: proto.Int32(200), ContentLength: proto.Int64(3),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"StartTimestamp": func(e *events.Envelope) { e.HttpStartStop.StartTimestamp = nil },
+			"StopTimestamp":  func(e *events.Envelope) { e.HttpStartStop.StopTimestamp = nil },
+			"RequestId":      func(e *events.Envelope) { e.HttpStartStop.RequestId = nil },
+			"PeerType":       func(e *events.Envelope) { e.HttpStartStop.PeerType = nil },
+			"Method":         func(e *events.Envelope) { e.HttpStartStop.Method = nil },
+			"Uri":            func(e *events.Envelope) { e.HttpStartStop.Uri = nil },
+			"RemoteAddress":  func(e *events.Envelope) { e.HttpStartStop.RemoteAddress = nil },
+			"UserAgent":      func(e *events.Envelope) { e.HttpStartStop.UserAgent = nil },
+			"StatusCode":     func(e *events.Envelope) { e.HttpStartStop.StatusCode = nil },
+			"ContentLength":  func(e *events.Envelope) { e.HttpStartStop.ContentLength = nil },
+		},
+	},
+	{
+		events.Envelope_LogMessage,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_LogMessage.Enum(), LogMessage: &events.LogMessage{
+				Message: []byte("hello"), MessageType: events.LogMessage_OUT.Enum(), Timestamp: proto.Int64(1),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"Message":     func(e *events.Envelope) { e.LogMessage.Message = nil },
+			"MessageType": func(e *events.Envelope) { e.LogMessage.MessageType = nil },
+			"Timestamp":   func(e *events.Envelope) { e.LogMessage.Timestamp = nil },
+		},
+	},
+	{
+		events.Envelope_ValueMetric,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_ValueMetric.Enum(), ValueMetric: &events.ValueMetric{
+				Name: proto.String("name"), Value: proto.Float64(0), Unit: proto.String("unit"),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"Name":  func(e *events.Envelope) { e.ValueMetric.Name = nil },
+			"Value": func(e *events.Envelope) { e.ValueMetric.Value = nil },
+			"Unit":  func(e *events.Envelope) { e.ValueMetric.Unit = nil },
+		},
+	},
+	{
+		events.Envelope_CounterEvent,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_CounterEvent.Enum(), CounterEvent: &events.CounterEvent{
+				Name: proto.String("name"), Delta: proto.Uint64(0),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"Name":  func(e *events.Envelope) { e.CounterEvent.Name = nil },
+			"Delta": func(e *events.Envelope) { e.CounterEvent.Delta = nil },
+		},
+	},
+	{
+		events.Envelope_Error,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_Error.Enum(), Error: &events.Error{
+				Source: proto.String("source"), Code: proto.Int32(1), Message: proto.String("message"),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"Source":  func(e *events.Envelope) { e.Error.Source = nil },
+			"Code":    func(e *events.Envelope) { e.Error.Code = nil },
+			"Message": func(e *events.Envelope) { e.Error.Message = nil },
+		},
+	},
+	{
+		events.Envelope_ContainerMetric,
+		func() *events.Envelope {
+			return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_ContainerMetric.Enum(), ContainerMetric: &events.ContainerMetric{
+				ApplicationId: proto.String("app"), InstanceIndex: proto.Int32(0), CpuPercentage: proto.Float64(1), MemoryBytes: proto.Uint64(2), DiskBytes: proto.Uint64(3),
+			}}
+		},
+		map[string]func(*events.Envelope){
+			"ApplicationId": func(e *events.Envelope) { e.ContainerMetric.ApplicationId = nil },
+			"InstanceIndex": func(e *events.Envelope) { e.ContainerMetric.InstanceIndex = nil },
+			"CpuPercentage": func(e *events.Envelope) { e.ContainerMetric.CpuPercentage = nil },
+			"MemoryBytes":   func(e *events.Envelope) { e.ContainerMetric.MemoryBytes = nil },
+			"DiskBytes":     func(e *events.Envelope) { e.ContainerMetric.DiskBytes = nil },
+		},
+	},
+}
+
+// withoutEvent returns envelope with its event type kept but its event
+// cleared.
+func withoutEvent(envelope *events.Envelope) *events.Envelope {
+	return &events.Envelope{Origin: envelope.Origin, EventType: envelope.EventType}
+}
+
+var _ = Describe("Validate", func() {
+	It("covers every event type", func() {
+		covered := map[events.Envelope_EventType]bool{}
+		for _, eventType := range requiredFields {
+			covered[eventType.eventType] = true
+		}
+		for value := range events.Envelope_EventType_name {
+			Expect(covered).To(HaveKey(events.Envelope_EventType(value)))
+		}
+	})
+
+	It("accepts envelopes with all required fields", func() {
+		for _, eventType := range requiredFields {
+			Expect(validator.Validate(eventType.valid())).To(BeEmpty(), eventType.eventType.String())
+		}
+	})
+
+	It("rejects envelopes whose event is missing", func() {
+		for _, eventType := range requiredFields {
+			Expect(validator.Validate(withoutEvent(eventType.valid()))).To(Equal(validator.ReasonMissingEvent), eventType.eventType.String())
+		}
+	})
+
+	It("rejects envelopes whose event lacks a required field", func() {
+		for _, eventType := range requiredFields {
+			for field, clear := range eventType.clear {
+				envelope := eventType.valid()
+				clear(envelope)
+				Expect(validator.Validate(envelope)).To(Equal(validator.ReasonMissingField), eventType.eventType.String()+"."+field)
+			}
+		}
+	})
+
+	It("rejects envelopes without an origin", func() {
+		envelope := requiredFields[0].valid()
+		envelope.Origin = nil
+		Expect(validator.Validate(envelope)).To(Equal(validator.ReasonMissingOrigin))
+
+		envelope.Origin = proto.String("")
+		Expect(validator.Validate(envelope)).To(Equal(validator.ReasonMissingOrigin))
+	})
+
+	It("rejects envelopes without a known event type", func() {
+		envelope := requiredFields[0].valid()
+		envelope.EventType = nil
+		Expect(validator.Validate(envelope)).To(Equal(validator.ReasonUnknownEventType))
+
+		envelope.EventType = events.Envelope_EventType(99).Enum()
+		Expect(validator.Validate(envelope)).To(Equal(validator.ReasonUnknownEventType))
+	})
+
+	It("accepts the optional fields being absent", func() {
+		envelope := requiredFields[6].valid()
+		Expect(envelope.GetCounterEvent().Total).To(BeNil())
+		Expect(validator.Validate(envelope)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Validator", func() {
+	var (
+		v          *validator.Validator
+		inputChan  chan *events.Envelope
+		outputChan chan *events.Envelope
+	)
+
+	valueMetric := func(timestamp *int64) *events.Envelope {
+		return &events.Envelope{Origin: proto.String("origin"), EventType: events.Envelope_ValueMetric.Enum(), Timestamp: timestamp, ValueMetric: &events.ValueMetric{
+			Name: proto.String("name"), Value: proto.Float64(1), Unit: proto.String("unit"),
+		}}
+	}
+
+	rewrittenTimestamps := func() interface{} {
+		metric := v.Emit().Metrics[0]
+		Expect(metric.Name).To(Equal("rewrittenTimestamps"))
+		return metric.Value
+	}
+
+	BeforeEach(func() {
+		v = validator.New(loggertesthelper.Logger())
+		inputChan = make(chan *events.Envelope)
+		outputChan = make(chan *events.Envelope, 10)
+	})
+
+	AfterEach(func() {
+		close(inputChan)
+	})
+
+	It("passes on valid envelopes", func() {
+		go v.Run(inputChan, outputChan)
+
+		envelope := valueMetric(proto.Int64(1))
+		inputChan <- envelope
+		Eventually(outputChan).Should(Receive(BeIdenticalTo(envelope)))
+	})
+
+	It("drops invalid envelopes and counts them per reason", func() {
+		go v.Run(inputChan, outputChan)
+
+		inputChan <- withoutEvent(valueMetric(nil))
+		inputChan <- withoutEvent(valueMetric(nil))
+		inputChan <- &events.Envelope{EventType: events.Envelope_ValueMetric.Enum()}
+		valid := valueMetric(nil)
+		inputChan <- valid
+
+		Eventually(outputChan).Should(Receive(BeIdenticalTo(valid)))
+		Expect(outputChan).To(BeEmpty())
+
+		Expect(v.Emit().Name).To(Equal("Validator"))
+		Expect(v.Emit().Metrics).To(Equal([]instrumentation.Metric{
+			{Name: "rewrittenTimestamps", Value: uint64(0)},
+			{Name: "droppedEnvelopes", Value: uint64(2), Tags: map[string]interface{}{"reason": "missingEvent"}},
+			{Name: "droppedEnvelopes", Value: uint64(1), Tags: map[string]interface{}{"reason": "missingOrigin"}},
+		}))
+	})
+
+	Context("with a maximum timestamp skew", func() {
+		BeforeEach(func() {
+			v.SetMaxTimestampSkew(time.Minute)
+			go v.Run(inputChan, outputChan)
+		})
+
+		It("keeps timestamps within the skew", func() {
+			timestamp := time.Now().Add(-30 * time.Second).UnixNano()
+			inputChan <- valueMetric(proto.Int64(timestamp))
+
+			var envelope *events.Envelope
+			Eventually(outputChan).Should(Receive(&envelope))
+			Expect(envelope.GetTimestamp()).To(Equal(timestamp))
+			Expect(rewrittenTimestamps()).To(BeEquivalentTo(0))
+		})
+
+		It("rewrites timestamps too far in the past or the future to now", func() {
+			for _, offset := range []time.Duration{-time.Hour, time.Hour} {
+				inputChan <- valueMetric(proto.Int64(time.Now().Add(offset).UnixNano()))
+
+				var envelope *events.Envelope
+				Eventually(outputChan).Should(Receive(&envelope))
+				Expect(time.Unix(0, envelope.GetTimestamp())).To(BeTemporally("~", time.Now(), time.Second))
+			}
+			Expect(rewrittenTimestamps()).To(BeEquivalentTo(2))
+		})
+
+		It("leaves envelopes without a timestamp as they are", func() {
+			inputChan <- valueMetric(nil)
+
+			var envelope *events.Envelope
+			Eventually(outputChan).Should(Receive(&envelope))
+			Expect(envelope.Timestamp).To(BeNil())
+		})
+	})
+
+	It("keeps every timestamp by default", func() {
+		go v.Run(inputChan, outputChan)
+
+		inputChan <- valueMetric(proto.Int64(1))
+
+		var envelope *events.Envelope
+		Eventually(outputChan).Should(Receive(&envelope))
+		Expect(envelope.GetTimestamp()).To(BeEquivalentTo(1))
+	})
+})
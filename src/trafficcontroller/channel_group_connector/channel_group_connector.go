@@ -13,6 +13,11 @@ import (
 
 const checkServerAddressesInterval = 100 * time.Millisecond
 
+// ConnectionRotationOverlap is how long a connection that has reached its
+// max age is kept open after its replacement has been requested, so that no
+// messages are missed while the new connection is being established.
+var ConnectionRotationOverlap = time.Second
+
 type ListenerConstructor func(time.Duration, *gosteno.Logger) listener.Listener
 
 type ChannelGroupConnector interface {
@@ -24,13 +29,19 @@ type channelGroupConnector struct {
 	logger                *gosteno.Logger
 	listenerConstructor   ListenerConstructor
 	generateLogMessage    marshaller.MessageGenerator
+	maxConnectionAge      time.Duration
 }
 
-func NewChannelGroupConnector(provider serveraddressprovider.ServerAddressProvider, listenerConstructor ListenerConstructor, logMessageGenerator marshaller.MessageGenerator, logger *gosteno.Logger) ChannelGroupConnector {
+// NewChannelGroupConnector returns a ChannelGroupConnector. If
+// maxConnectionAge is non-zero, reconnecting streams close and re-establish
+// their doppler connections once they are older than maxConnectionAge, so
+// that long-lived streams are rebalanced across the current set of dopplers.
+func NewChannelGroupConnector(provider serveraddressprovider.ServerAddressProvider, listenerConstructor ListenerConstructor, logMessageGenerator marshaller.MessageGenerator, maxConnectionAge time.Duration, logger *gosteno.Logger) ChannelGroupConnector {
 	return &channelGroupConnector{
 		serverAddressProvider: provider,
 		listenerConstructor:   listenerConstructor,
 		generateLogMessage:    logMessageGenerator,
+		maxConnectionAge:      maxConnectionAge,
 		logger:                logger,
 	}
 }
@@ -38,8 +49,10 @@ func NewChannelGroupConnector(provider serveraddressprovider.ServerAddressProvid
 func (connector *channelGroupConnector) Connect(dopplerEndpoint doppler_endpoint.DopplerEndpoint, messagesChan chan<- []byte, stopChan <-chan struct{}) {
 	defer close(messagesChan)
 	connections := &serverConnections{
-		connectedAddresses: make(map[string]struct{}),
+		connectedAddresses: make(map[string]*serverConnection),
+		disconnectedAt:     make(map[string]time.Time),
 	}
+	rotate := dopplerEndpoint.Reconnect && connector.maxConnectionAge > 0
 
 	checkLoggregatorServersTicker := time.NewTicker(checkServerAddressesInterval)
 	defer checkLoggregatorServersTicker.Stop()
@@ -55,12 +68,19 @@ loop:
 				if connections.connectedToServer(serverAddress) {
 					continue
 				}
-				connections.addConnectedServer(serverAddress)
+				conn := connections.addConnectedServer(serverAddress)
 
-				go func(addr string) {
-					connector.connectToServer(addr, dopplerEndpoint, messagesChan, stopChan)
-					connections.removeConnectedServer(addr)
-				}(serverAddress)
+				connections.Add(1)
+				go func(conn *serverConnection) {
+					connector.expireConnection(conn, rotate, connections, stopChan)
+					connections.Done()
+				}(conn)
+				go func(conn *serverConnection) {
+					connector.connectToServer(conn, dopplerEndpoint, messagesChan, connections)
+					close(conn.done)
+					connections.removeConnectedServer(conn)
+					connections.Done()
+				}(conn)
 			}
 
 			if !dopplerEndpoint.Reconnect {
@@ -79,9 +99,26 @@ loop:
 	connections.Wait()
 }
 
-func (connector *channelGroupConnector) connectToServer(serverAddress string, dopplerEndpoint doppler_endpoint.DopplerEndpoint, messagesChan chan<- []byte, stopChan <-chan struct{}) {
+// connectToServer listens to the doppler at the connection's address until
+// the connection's stop channel is closed or the listener returns. For a
+// reconnecting stream, a listener that lost its connection leaves the time it
+// did so in connections, so that the next listener for the address can report
+// its connection as a reconnect. It only does so while its connection is
+// still the address's current one: the next listener is then started once it
+// has returned, so every message read from the lost connection is on
+// messagesChan before the reconnect notice, if any, and the messages read
+// from the new connection. A connection rotated out leaves no time, as its
+// replacement is already running.
+func (connector *channelGroupConnector) connectToServer(conn *serverConnection, dopplerEndpoint doppler_endpoint.DopplerEndpoint, messagesChan chan<- []byte, connections *serverConnections) {
+	serverAddress, stopChan := conn.address, conn.stopChan
 	l := connector.listenerConstructor(dopplerEndpoint.Timeout, connector.logger)
 
+	reconnector, canReconnect := l.(listener.Reconnector)
+	disconnectedAt := connections.takeDisconnectedAt(serverAddress)
+	if canReconnect && !disconnectedAt.IsZero() {
+		reconnector.SetDisconnectedAt(disconnectedAt)
+	}
+
 	serverUrl := fmt.Sprintf("ws://%s%s", serverAddress, dopplerEndpoint.GetPath())
 	connector.logger.Debugf("proxy: connecting to doppler at %s", serverUrl)
 
@@ -89,14 +126,78 @@ func (connector *channelGroupConnector) connectToServer(serverAddress string, do
 	err := l.Start(serverUrl, appId, messagesChan, stopChan)
 
 	if err != nil {
-		errorMsg := fmt.Sprintf("proxy: error connecting to %s: %s", serverAddress, err.Error())
-		messagesChan <- connector.generateLogMessage(errorMsg, appId)
+		messagesChan <- connector.generateLogMessage(connectErrorNotice(serverAddress, err), appId)
 		connector.logger.Errorf("proxy: error connecting %s %s %s", appId, dopplerEndpoint.Endpoint, err.Error())
 	}
+
+	if !canReconnect || !dopplerEndpoint.Reconnect {
+		return
+	}
+	if !reconnector.HasConnected() {
+		connections.setDisconnectedAt(conn, disconnectedAt)
+		return
+	}
+	select {
+	case <-stopChan:
+	default:
+		connections.setDisconnectedAt(conn, time.Now())
+	}
+}
+
+// connectErrorNotice is the one notice the client gets for a listener that
+// failed. A malformed doppler URL is a configuration mistake, any other
+// error a doppler that cannot be reached or listened to.
+func connectErrorNotice(serverAddress string, err error) string {
+	if _, ok := err.(*listener.InvalidUrlError); ok {
+		return fmt.Sprintf("proxy: invalid doppler server URL for %s, check the configuration", serverAddress)
+	}
+	return fmt.Sprintf("proxy: error connecting to %s: %s", serverAddress, err.Error())
+}
+
+// expireConnection closes the connection's stop channel when the overall stop
+// channel is closed. If rotate is set, it also releases the connection's
+// address once the connection reaches its max age, so that the next address
+// check opens a replacement, and stops the old connection after an overlap.
+func (connector *channelGroupConnector) expireConnection(conn *serverConnection, rotate bool, connections *serverConnections, stopChan <-chan struct{}) {
+	defer close(conn.stopChan)
+
+	var expired <-chan time.Time
+	if rotate {
+		maxAgeTimer := time.NewTimer(connector.maxConnectionAge)
+		defer maxAgeTimer.Stop()
+		expired = maxAgeTimer.C
+	}
+
+	select {
+	case <-expired:
+	case <-conn.done:
+		return
+	case <-stopChan:
+		return
+	}
+
+	connector.logger.Debugf("ChannelGroupConnector.Connect: connection to %s reached max age of %s, reconnecting", conn.address, connector.maxConnectionAge.String())
+	connections.removeConnectedServer(conn)
+
+	overlapTimer := time.NewTimer(ConnectionRotationOverlap)
+	defer overlapTimer.Stop()
+
+	select {
+	case <-overlapTimer.C:
+	case <-conn.done:
+	case <-stopChan:
+	}
+}
+
+type serverConnection struct {
+	address  string
+	stopChan chan struct{}
+	done     chan struct{}
 }
 
 type serverConnections struct {
-	connectedAddresses map[string]struct{}
+	connectedAddresses map[string]*serverConnection
+	disconnectedAt     map[string]time.Time
 	sync.Mutex
 	sync.WaitGroup
 }
@@ -109,18 +210,56 @@ func (connections *serverConnections) connectedToServer(serverAddress string) bo
 	return connected
 }
 
-func (connections *serverConnections) addConnectedServer(serverAddress string) {
+func (connections *serverConnections) addConnectedServer(serverAddress string) *serverConnection {
 	connections.Lock()
 	defer connections.Unlock()
 
+	conn := &serverConnection{
+		address:  serverAddress,
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
 	connections.Add(1)
-	connections.connectedAddresses[serverAddress] = struct{}{}
+	connections.connectedAddresses[serverAddress] = conn
+	return conn
 }
 
-func (connections *serverConnections) removeConnectedServer(serverAddress string) {
+// removeConnectedServer marks the connection's address as no longer
+// connected, unless it has already been taken over by a newer connection.
+func (connections *serverConnections) removeConnectedServer(conn *serverConnection) {
 	connections.Lock()
 	defer connections.Unlock()
-	defer connections.Done()
 
-	delete(connections.connectedAddresses, serverAddress)
+	if connections.connectedAddresses[conn.address] != conn {
+		return
+	}
+	delete(connections.connectedAddresses, conn.address)
+}
+
+// takeDisconnectedAt returns when the last connection to serverAddress was
+// lost, or the zero time if it was not, and forgets it.
+func (connections *serverConnections) takeDisconnectedAt(serverAddress string) time.Time {
+	connections.Lock()
+	defer connections.Unlock()
+
+	disconnectedAt := connections.disconnectedAt[serverAddress]
+	delete(connections.disconnectedAt, serverAddress)
+	return disconnectedAt
+}
+
+// setDisconnectedAt records when the connection was lost, unless it has
+// already been taken over by a newer connection.
+func (connections *serverConnections) setDisconnectedAt(conn *serverConnection, disconnectedAt time.Time) {
+	if disconnectedAt.IsZero() {
+		return
+	}
+
+	connections.Lock()
+	defer connections.Unlock()
+
+	if connections.connectedAddresses[conn.address] != conn {
+		return
+	}
+	connections.disconnectedAt[conn.address] = disconnectedAt
 }
@@ -4,10 +4,15 @@ import (
 	"trafficcontroller/channel_group_connector"
 
 	"errors"
+	"fmt"
 	"github.com/cloudfoundry/dropsonde/events"
 	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
 	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"time"
 	"trafficcontroller/doppler_endpoint"
@@ -68,7 +73,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("opens a listener with the correct app path", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte, 10)
 					stopChan := make(chan struct{})
 					defer close(stopChan)
@@ -79,7 +84,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("opens a listener with the firehose path", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte, 10)
 					stopChan := make(chan struct{})
 					defer close(stopChan)
@@ -90,7 +95,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("puts messages on the channel received by the listener", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte)
 
 					go func() {
@@ -115,7 +120,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("puts messages on the channel received by the listener", func(done Done) {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte)
 
 					go func() {
@@ -160,7 +165,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("receives multiple messages on the channel", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte, 10)
 
 					stopChan := make(chan struct{})
@@ -172,7 +177,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("opens a listener with the correct path", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte, 10)
 					stopChan := make(chan struct{})
 					defer close(stopChan)
@@ -183,7 +188,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("closes listeners and returns when stopChan is closed", func(done Done) {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 
 					outputChan := make(chan []byte, 10)
 					stopChan := make(chan struct{})
@@ -224,7 +229,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("receives multiple messages from each sender", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 					outputChan := make(chan []byte)
 
 					stopChan := make(chan struct{})
@@ -248,7 +253,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 				})
 
 				It("closes listeners and returns when stopChan is closed", func() {
-					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+					channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 
 					outputChan := make(chan []byte, 10)
 					stopChan := make(chan struct{})
@@ -269,6 +274,112 @@ var _ = Describe("ChannelGroupConnector", func() {
 			})
 		})
 
+		Context("when a max connection age is set", func() {
+			var (
+				messageChan          chan []byte
+				senderStopChan       chan struct{}
+				rotatingListeners    []*listener.FakeListener
+				rotatingListenerLock sync.Mutex
+				originalOverlap      time.Duration
+				stopChan             chan struct{}
+				connectDone          chan struct{}
+			)
+
+			listenerCount := func() int {
+				rotatingListenerLock.Lock()
+				defer rotatingListenerLock.Unlock()
+				return len(rotatingListeners)
+			}
+
+			BeforeEach(func() {
+				originalOverlap = channel_group_connector.ConnectionRotationOverlap
+				channel_group_connector.ConnectionRotationOverlap = 50 * time.Millisecond
+
+				messageChan = make(chan []byte)
+				senderStopChan = make(chan struct{})
+				go sendMessages(messageChan, expectedMessage1, senderStopChan)
+
+				rotatingListeners = nil
+				listenerConstructor = func(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
+					rotatingListenerLock.Lock()
+					defer rotatingListenerLock.Unlock()
+					l := listener.NewFakeListener(messageChan, nil)
+					rotatingListeners = append(rotatingListeners, l)
+					return l
+				}
+
+				provider.SetServerAddresses([]string{"10.0.0.1:1234"})
+			})
+
+			AfterEach(func() {
+				senderStopChan <- struct{}{}
+				<-senderStopChan
+				close(stopChan)
+				Eventually(connectDone).Should(BeClosed())
+				channel_group_connector.ConnectionRotationOverlap = originalOverlap
+			})
+
+			// connect streams until the spec ends, so that no connection
+			// outlives the overlap set for the spec.
+			connect := func(maxConnectionAge time.Duration, reconnect bool) chan []byte {
+				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, maxConnectionAge, logger)
+				outputChan := make(chan []byte, 100)
+				stopChan = make(chan struct{})
+				connectDone = make(chan struct{})
+				dopplerEndpoint := doppler_endpoint.NewDopplerEndpoint("stream", "abc123", reconnect)
+				go func() {
+					channelConnector.Connect(dopplerEndpoint, outputChan, stopChan)
+					close(connectDone)
+				}()
+				return outputChan
+			}
+
+			It("rotates streaming connections older than the max age", func() {
+				connect(200*time.Millisecond, true)
+
+				Eventually(listenerCount).Should(BeNumerically(">=", 3))
+
+				rotatingListenerLock.Lock()
+				first := rotatingListeners[0]
+				rotatingListenerLock.Unlock()
+				Expect(first.ConnectedHost()).To(Equal("ws://10.0.0.1:1234/apps/abc123/stream"))
+				Eventually(first.IsStopped).Should(BeTrue())
+			})
+
+			It("connects to the current set of dopplers when rotating", func() {
+				connect(200*time.Millisecond, true)
+
+				Eventually(listenerCount).Should(Equal(1))
+				provider.SetServerAddresses([]string{"10.0.0.2:1234"})
+
+				Eventually(func() string {
+					rotatingListenerLock.Lock()
+					defer rotatingListenerLock.Unlock()
+					return rotatingListeners[len(rotatingListeners)-1].ConnectedHost()
+				}).Should(Equal("ws://10.0.0.2:1234/apps/abc123/stream"))
+			})
+
+			It("keeps delivering messages across rotations", func() {
+				outputChan := connect(200*time.Millisecond, true)
+
+				Eventually(listenerCount).Should(BeNumerically(">=", 3))
+				received := len(outputChan)
+				Eventually(func() int { return len(outputChan) }).Should(BeNumerically(">", received))
+			})
+
+			It("does not rotate connections for non-reconnecting endpoints", func() {
+				connect(100*time.Millisecond, false)
+
+				Eventually(listenerCount).Should(Equal(1))
+				Consistently(listenerCount, 500*time.Millisecond).Should(Equal(1))
+
+				rotatingListenerLock.Lock()
+				first := rotatingListeners[0]
+				rotatingListenerLock.Unlock()
+				Expect(first.IsStopped()).To(BeFalse())
+			})
+		})
+
 		Context("when an error is receieved from the listener", func() {
 			BeforeEach(func() {
 				messageChan := make(chan []byte, 10)
@@ -285,7 +396,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 			})
 
 			It("puts an error on the message channel when reading messages", func() {
-				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 
 				stopChan := make(chan struct{})
 				defer close(stopChan)
@@ -303,6 +414,192 @@ var _ = Describe("ChannelGroupConnector", func() {
 			})
 		})
 
+		Context("when a websocket listener cannot connect", func() {
+			var outputChan chan []byte
+
+			BeforeEach(func() {
+				outputChan = make(chan []byte, 10)
+				listenerConstructor = func(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
+					converter := func(d []byte) ([]byte, error) { return d, nil }
+					return listener.NewWebsocket(marshaller.DropsondeLogMessage, converter, timeout, logger)
+				}
+			})
+
+			AfterEach(func() {
+				for _, l := range fakeListeners {
+					l.Close()
+				}
+			})
+
+			connect := func() {
+				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
+				stopChan := make(chan struct{})
+				defer close(stopChan)
+				dopplerEndpoint := doppler_endpoint.NewDopplerEndpoint("stream", "abc123", false)
+				channelConnector.Connect(dopplerEndpoint, outputChan, stopChan)
+			}
+
+			notices := func() []string {
+				var messages []string
+				for msg := range outputChan {
+					envelope := &events.Envelope{}
+					Expect(proto.Unmarshal(msg, envelope)).To(Succeed())
+					messages = append(messages, string(envelope.GetLogMessage().GetMessage()))
+				}
+				return messages
+			}
+
+			It("tells the client exactly once that the doppler cannot be reached", func() {
+				provider.SetServerAddresses([]string{"127.0.0.1:1"})
+				connect()
+
+				messages := notices()
+				Expect(messages).To(HaveLen(1))
+				Expect(messages[0]).To(HavePrefix("proxy: error connecting to 127.0.0.1:1: "))
+			})
+
+			It("tells the client exactly once to check the configuration for an invalid doppler URL", func() {
+				provider.SetServerAddresses([]string{"127.0.0.1:99999"})
+				connect()
+
+				Expect(notices()).To(Equal([]string{"proxy: invalid doppler server URL for 127.0.0.1:99999, check the configuration"}))
+			})
+		})
+
+		Context("when a doppler drops the connection of a reconnecting stream", func() {
+			var (
+				handler           http.Handler
+				noticeOnReconnect bool
+				server            *httptest.Server
+				reconnectGaps     *listener.ReconnectGaps
+				outputChan        chan []byte
+				stopChan          chan struct{}
+				connectDone       chan struct{}
+				originalOverlap   time.Duration
+			)
+
+			BeforeEach(func() {
+				handler = droppingHandler{"from the doppler"}
+				noticeOnReconnect = false
+				reconnectGaps = listener.NewReconnectGaps(time.Minute)
+				outputChan = make(chan []byte, 100)
+				stopChan = make(chan struct{})
+				connectDone = make(chan struct{})
+				originalOverlap = channel_group_connector.ConnectionRotationOverlap
+
+				listenerConstructor = func(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
+					converter := func(d []byte) ([]byte, error) { return d, nil }
+					websocketListener := listener.NewWebsocket(marshaller.DropsondeLogMessage, converter, timeout, logger)
+					websocketListener.OnReconnect = reconnectGaps.Record
+					websocketListener.NoticeOnReconnect = noticeOnReconnect
+					return websocketListener
+				}
+			})
+
+			JustBeforeEach(func() {
+				server = httptest.NewServer(handler)
+				provider.SetServerAddresses([]string{server.Listener.Addr().String()})
+			})
+
+			AfterEach(func() {
+				close(stopChan)
+				Eventually(connectDone).Should(BeClosed())
+				channel_group_connector.ConnectionRotationOverlap = originalOverlap
+				server.Close()
+				for _, l := range fakeListeners {
+					l.Close()
+				}
+			})
+
+			connect := func(maxConnectionAge time.Duration, reconnect bool) {
+				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, maxConnectionAge, logger)
+				dopplerEndpoint := doppler_endpoint.NewDopplerEndpoint("stream", "abc123", reconnect)
+				go func() {
+					channelConnector.Connect(dopplerEndpoint, outputChan, stopChan)
+					close(connectDone)
+				}()
+			}
+
+			It("reports the reconnect gap tagged with the app and doppler", func() {
+				connect(0, true)
+
+				Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+				Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+
+				metrics := reconnectGaps.Emit().Metrics
+				Expect(metrics).To(HaveLen(1))
+				Expect(metrics[0].Name).To(Equal("dopplerReconnectGap"))
+				Expect(metrics[0].Tags).To(Equal(map[string]interface{}{"appId": "abc123", "doppler": server.Listener.Addr().String()}))
+				Expect(metrics[0].Value).To(BeNumerically(">", 0))
+				Expect(metrics[0].Value).To(BeNumerically("<", 1000))
+			})
+
+			It("does not report a reconnect for a stream that does not reconnect", func() {
+				connect(0, false)
+				Eventually(connectDone).Should(BeClosed())
+
+				Expect(outputChan).To(Receive(Equal([]byte("from the doppler"))))
+				Expect(reconnectGaps.Emit().Metrics).To(BeEmpty())
+			})
+
+			Context("with reconnect notices", func() {
+				BeforeEach(func() {
+					noticeOnReconnect = true
+				})
+
+				Context("when every connection is dropped", func() {
+					BeforeEach(func() {
+						var messages droppingHandler
+						for i := 0; i < 20; i++ {
+							messages = append(messages, fmt.Sprintf("message %d", i))
+						}
+						handler = messages
+					})
+
+					It("puts the notice after every message of the lost connection and before those of the new one", func() {
+						connect(0, true)
+
+						for cycle := 0; cycle < 3; cycle++ {
+							if cycle > 0 {
+								var msg []byte
+								Eventually(outputChan).Should(Receive(&msg))
+								envelope := &events.Envelope{}
+								Expect(proto.Unmarshal(msg, envelope)).To(Succeed())
+								Expect(envelope_extensions.GetAppId(envelope)).To(Equal("abc123"))
+								Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal("WebsocketListener.Start: Reconnected to a doppler server"))
+							}
+							for i := 0; i < 20; i++ {
+								Eventually(outputChan).Should(Receive(Equal([]byte(fmt.Sprintf("message %d", i)))))
+							}
+						}
+					})
+				})
+
+				Context("when a connection is dropped after it was rotated out", func() {
+					var connections holdingHandler
+
+					BeforeEach(func() {
+						channel_group_connector.ConnectionRotationOverlap = time.Second
+						connections = make(holdingHandler, 10)
+						handler = connections
+					})
+
+					It("does not report the later connections as reconnects", func() {
+						connect(200*time.Millisecond, true)
+
+						var rotatedOut *websocket.Conn
+						Eventually(connections).Should(Receive(&rotatedOut))
+						Eventually(connections, 2).Should(Receive())
+						rotatedOut.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+
+						Eventually(connections, 2).Should(Receive())
+						Consistently(func() []instrumentation.Metric { return reconnectGaps.Emit().Metrics }, 500*time.Millisecond).Should(BeEmpty())
+						Expect(outputChan).NotTo(Receive())
+					})
+				})
+			})
+		})
+
 		Context("when streaming messages from a single server and a listener error occurrs", func() {
 			BeforeEach(func() {
 				messageChan1 <- expectedMessage1
@@ -320,7 +617,7 @@ var _ = Describe("ChannelGroupConnector", func() {
 			})
 
 			It("puts a message about the error on the channel ", func() {
-				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, logger)
+				channelConnector := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, marshaller.DropsondeLogMessage, 0, logger)
 				outputChan := make(chan []byte)
 
 				stopChan := make(chan struct{})
@@ -355,3 +652,38 @@ func sendMessages(messageChan chan<- []byte, envBytes []byte, stopChan chan stru
 		}
 	}
 }
+
+// droppingHandler sends its messages on every connection and closes it.
+type droppingHandler []string
+
+func (h droppingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	for _, message := range h {
+		ws.WriteMessage(websocket.BinaryMessage, []byte(message))
+	}
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+}
+
+// holdingHandler passes on every connection and keeps it open until either
+// side closes it.
+type holdingHandler chan *websocket.Conn
+
+func (h holdingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	h <- ws
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
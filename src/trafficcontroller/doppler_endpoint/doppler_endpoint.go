@@ -7,6 +7,7 @@ import (
 	"github.com/cloudfoundry/loggregatorlib/server/handlers"
 	"github.com/gogo/protobuf/proto"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -14,12 +15,17 @@ var WebsocketKeepAliveDuration = 30 * time.Second
 
 const HttpRequestTimeout = 5 * time.Second
 
+// MaxOrigins is the most origins a firehose or stream subscription may filter
+// for. It matches the cap enforced by doppler.
+const MaxOrigins = 10
+
 type DopplerEndpoint struct {
 	Endpoint  string
 	StreamId  string
 	Reconnect bool
 	Timeout   time.Duration
 	HProvider HandlerProvider
+	Origins   []string
 }
 
 func NewDopplerEndpoint(endpoint string,
@@ -63,11 +69,17 @@ func ContainerMetricHandlerProvider(messages <-chan []byte, logger *gosteno.Logg
 }
 
 func (endpoint *DopplerEndpoint) GetPath() string {
+	var path string
 	if endpoint.Endpoint == "firehose" {
-		return "/firehose/" + endpoint.StreamId
+		path = "/firehose/" + endpoint.StreamId
 	} else {
-		return fmt.Sprintf("/apps/%s/%s", endpoint.StreamId, endpoint.Endpoint)
+		path = fmt.Sprintf("/apps/%s/%s", endpoint.StreamId, endpoint.Endpoint)
+	}
+
+	if len(endpoint.Origins) > 0 {
+		path += "?" + url.Values{"origin": endpoint.Origins}.Encode()
 	}
+	return path
 }
 
 func DeDupe(input <-chan []byte) <-chan []byte {
@@ -59,6 +59,12 @@ var _ = Describe("GetPath", func() {
 		dopplerEndpoint := doppler_endpoint.NewDopplerEndpoint("recentlogs", "abc123", true)
 		Expect(dopplerEndpoint.GetPath()).To(Equal("/apps/abc123/recentlogs"))
 	})
+
+	It("adds the origins to the path", func() {
+		dopplerEndpoint := doppler_endpoint.NewDopplerEndpoint("firehose", "subscription-123", true)
+		dopplerEndpoint.Origins = []string{"gorouter", "rep"}
+		Expect(dopplerEndpoint.GetPath()).To(Equal("/firehose/subscription-123?origin=gorouter&origin=rep"))
+	})
 })
 
 var _ = Describe("ContainerMetricsHandler", func() {
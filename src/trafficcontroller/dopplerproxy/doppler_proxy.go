@@ -11,29 +11,40 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 	"trafficcontroller/authorization"
 	"trafficcontroller/channel_group_connector"
 	"trafficcontroller/doppler_endpoint"
+	"trafficcontroller/marshaller"
 )
 
 const FIREHOSE_ID = "firehose"
 
+const connectionClosedNotice = "Connection closed: the traffic controller is shutting down"
+
 type Proxy struct {
 	logAuthorize   authorization.LogAccessAuthorizer
 	adminAuthorize authorization.AdminAccessAuthorizer
 	connector      channel_group_connector.ChannelGroupConnector
 	translate      RequestTranslator
 	cookieDomain   string
+	generateNotice marshaller.MessageGenerator
 	logger         *gosteno.Logger
 	cfcomponent.Component
+
+	subscriptions sync.WaitGroup
+	shutdownLock  sync.RWMutex
+	shuttingDown  bool
+	gracePeriod   time.Duration
+	shutdownChan  chan struct{}
 }
 
 type RequestTranslator func(request *http.Request) (*http.Request, error)
 
 type Authorizer func(authToken string, appId string, logger *gosteno.Logger) (bool, error)
 
-func NewDopplerProxy(logAuthorize authorization.LogAccessAuthorizer, adminAuthorizer authorization.AdminAccessAuthorizer, connector channel_group_connector.ChannelGroupConnector, config cfcomponent.Config, translator RequestTranslator, cookieDomain string, logger *gosteno.Logger) *Proxy {
+func NewDopplerProxy(logAuthorize authorization.LogAccessAuthorizer, adminAuthorizer authorization.AdminAccessAuthorizer, connector channel_group_connector.ChannelGroupConnector, config cfcomponent.Config, translator RequestTranslator, cookieDomain string, messageGenerator marshaller.MessageGenerator, logger *gosteno.Logger) *Proxy {
 	var instrumentables []instrumentation.Instrumentable
 
 	cfc, err := cfcomponent.NewComponent(
@@ -57,8 +68,41 @@ func NewDopplerProxy(logAuthorize authorization.LogAccessAuthorizer, adminAuthor
 		connector:      connector,
 		translate:      translator,
 		cookieDomain:   cookieDomain,
+		generateNotice: messageGenerator,
 		logger:         logger,
+		shutdownChan:   make(chan struct{}),
+	}
+}
+
+// Shutdown stops accepting new subscriptions and lets the current ones drain
+// the messages already buffered for them for up to gracePeriod. Streams then
+// get a connection closed notice before they are closed. Shutdown returns
+// once all subscriptions are closed.
+func (proxy *Proxy) Shutdown(gracePeriod time.Duration) {
+	proxy.shutdownLock.Lock()
+	if proxy.shuttingDown {
+		proxy.shutdownLock.Unlock()
+		return
 	}
+	proxy.shuttingDown = true
+	proxy.gracePeriod = gracePeriod
+	close(proxy.shutdownChan)
+	proxy.shutdownLock.Unlock()
+
+	proxy.logger.Infof("DopplerProxy.Shutdown: Draining subscriptions for up to %v", gracePeriod)
+	proxy.subscriptions.Wait()
+	proxy.logger.Info("DopplerProxy.Shutdown: All subscriptions closed")
+}
+
+func (proxy *Proxy) addSubscription() bool {
+	proxy.shutdownLock.RLock()
+	defer proxy.shutdownLock.RUnlock()
+
+	if proxy.shuttingDown {
+		return false
+	}
+	proxy.subscriptions.Add(1)
+	return true
 }
 
 func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -126,6 +170,12 @@ func (proxy *Proxy) serveFirehose(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
+	origins, ok := originsFrom(writer, request)
+	if !ok {
+		return
+	}
+	dopplerEndpoint.Origins = origins
+
 	proxy.serveWithDoppler(writer, request, dopplerEndpoint)
 }
 
@@ -166,21 +216,133 @@ func (proxy *Proxy) serveAppLogs(writer http.ResponseWriter, request *http.Reque
 	reconnect := endpoint_type != "recentlogs" && endpoint_type != "containermetrics"
 
 	dopplerEndpoint := doppler_endpoint.NewDopplerEndpoint(endpoint_type, appId, reconnect)
+	if endpoint_type == "stream" {
+		origins, ok := originsFrom(writer, request)
+		if !ok {
+			return
+		}
+		dopplerEndpoint.Origins = origins
+	}
 
 	proxy.serveWithDoppler(writer, request, dopplerEndpoint)
 }
 
+// originsFrom returns the origins a firehose or stream request filters for,
+// or writes a bad request response if they are not valid.
+func originsFrom(writer http.ResponseWriter, request *http.Request) ([]string, bool) {
+	origins := request.URL.Query()["origin"]
+	if len(origins) > doppler_endpoint.MaxOrigins {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "Too many origins. At most %d origins can be given.", doppler_endpoint.MaxOrigins)
+		return nil, false
+	}
+
+	for _, origin := range origins {
+		if origin == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "Origin must not be empty.")
+			return nil, false
+		}
+	}
+	return origins, true
+}
+
 func (proxy *Proxy) serveWithDoppler(writer http.ResponseWriter, request *http.Request, dopplerEndpoint doppler_endpoint.DopplerEndpoint) {
+	if !proxy.addSubscription() {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(writer, "Traffic controller is shutting down.")
+		return
+	}
+	defer proxy.subscriptions.Done()
+
 	messagesChan := make(chan []byte, 100)
 	stopChan := make(chan struct{})
-	defer close(stopChan)
+	var stopOnce sync.Once
+	stopConnector := func() { stopOnce.Do(func() { close(stopChan) }) }
+	defer stopConnector()
 
 	go proxy.connector.Connect(dopplerEndpoint, messagesChan, stopChan)
 
-	handler := dopplerEndpoint.HProvider(messagesChan, proxy.logger)
+	outputChan := make(chan []byte)
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
+	go proxy.forward(dopplerEndpoint, messagesChan, outputChan, stopConnector, handlerDone)
+
+	handler := dopplerEndpoint.HProvider(outputChan, proxy.logger)
 	handler.ServeHTTP(writer, request)
 }
 
+// forward passes messages on to the handler until the connector closes
+// messagesChan. On shutdown it stops the connector, keeps forwarding what is
+// left in messagesChan for the grace period and then sends streams the
+// connection closed notice. Closing outputChan makes the handler close the
+// connection.
+func (proxy *Proxy) forward(dopplerEndpoint doppler_endpoint.DopplerEndpoint, messagesChan <-chan []byte, outputChan chan<- []byte, stopConnector func(), handlerDone <-chan struct{}) {
+	defer close(outputChan)
+
+	shutdownChan := proxy.shutdownChan
+	var graceExpired <-chan time.Time
+
+	for {
+		select {
+		case message, ok := <-messagesChan:
+			if !ok {
+				if shutdownChan == nil {
+					proxy.sendNotice(dopplerEndpoint, outputChan, handlerDone, graceExpired)
+				}
+				return
+			}
+			select {
+			case outputChan <- message:
+			case <-handlerDone:
+				return
+			case <-graceExpired:
+				proxy.trySendNotice(dopplerEndpoint, outputChan)
+				return
+			}
+		case <-shutdownChan:
+			shutdownChan = nil
+			stopConnector()
+
+			graceTimer := time.NewTimer(proxy.gracePeriod)
+			defer graceTimer.Stop()
+			graceExpired = graceTimer.C
+		case <-graceExpired:
+			proxy.trySendNotice(dopplerEndpoint, outputChan)
+			return
+		case <-handlerDone:
+			return
+		}
+	}
+}
+
+// sendNotice sends streams the connection closed notice, waiting for the
+// handler until the grace period expires.
+func (proxy *Proxy) sendNotice(dopplerEndpoint doppler_endpoint.DopplerEndpoint, outputChan chan<- []byte, handlerDone <-chan struct{}, graceExpired <-chan time.Time) {
+	if !dopplerEndpoint.Reconnect {
+		return
+	}
+
+	select {
+	case outputChan <- proxy.generateNotice(connectionClosedNotice, dopplerEndpoint.StreamId):
+	case <-handlerDone:
+	case <-graceExpired:
+	}
+}
+
+// trySendNotice sends streams the connection closed notice only if the
+// handler is ready for it right away, as the grace period has expired.
+func (proxy *Proxy) trySendNotice(dopplerEndpoint doppler_endpoint.DopplerEndpoint, outputChan chan<- []byte) {
+	if !dopplerEndpoint.Reconnect {
+		return
+	}
+
+	select {
+	case outputChan <- proxy.generateNotice(connectionClosedNotice, dopplerEndpoint.StreamId):
+	default:
+	}
+}
+
 func (proxy *Proxy) isAuthorized(authorizer Authorizer, appId, authToken string, clientAddress string) (bool, *logmessage.LogMessage) {
 	newLogMessage := func(message []byte) *logmessage.LogMessage {
 		currentTime := time.Now()
@@ -3,18 +3,24 @@ package dopplerproxy_test
 import (
 	"trafficcontroller/dopplerproxy"
 
+	"fmt"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
 	"github.com/cloudfoundry/loggregatorlib/server/handlers"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 	"trafficcontroller/doppler_endpoint"
+	"trafficcontroller/marshaller"
 	testhelpers "trafficcontroller_testhelpers"
 
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -41,6 +47,7 @@ var _ = Describe("ServeHTTP", func() {
 			cfcomponent.Config{},
 			dopplerproxy.TranslateFromDropsondePath,
 			"cookieDomain",
+			marshaller.DropsondeLogMessage,
 			loggertesthelper.Logger(),
 		)
 
@@ -150,6 +157,15 @@ var _ = Describe("ServeHTTP", func() {
 			Eventually(channelGroupConnector.getReconnect).Should(BeTrue())
 		})
 
+		It("passes the requested origins to doppler for streams", func() {
+			req, _ := http.NewRequest("GET", "/apps/abc123/stream?origin=gorouter", nil)
+			req.Header.Add("Authorization", "token")
+
+			proxy.ServeHTTP(recorder, req)
+
+			Eventually(channelGroupConnector.getOrigins).Should(Equal([]string{"gorouter"}))
+		})
+
 		It("connects to doppler servers without reconnecting for recentlogs", func() {
 			close(channelGroupConnector.messages)
 			req, _ := http.NewRequest("GET", "/apps/abc123/recentlogs", nil)
@@ -209,6 +225,40 @@ var _ = Describe("ServeHTTP", func() {
 				Eventually(channelGroupConnector.getReconnect).Should(BeTrue())
 			})
 
+			It("passes the requested origins to doppler", func() {
+				req, _ := http.NewRequest("GET", "/firehose/abc-123?origin=gorouter&origin=rep", nil)
+				req.Header.Add("Authorization", "token")
+
+				proxy.ServeHTTP(recorder, req)
+
+				Eventually(channelGroupConnector.getOrigins).Should(Equal([]string{"gorouter", "rep"}))
+			})
+
+			It("returns a bad request for too many origins", func() {
+				query := url.Values{}
+				for i := 0; i <= doppler_endpoint.MaxOrigins; i++ {
+					query.Add("origin", fmt.Sprintf("origin-%d", i))
+				}
+				req, _ := http.NewRequest("GET", "/firehose/abc-123?"+query.Encode(), nil)
+				req.Header.Add("Authorization", "token")
+
+				proxy.ServeHTTP(recorder, req)
+
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+				Expect(recorder.Body.String()).To(Equal("Too many origins. At most 10 origins can be given."))
+				Consistently(channelGroupConnector.getPath).Should(BeEmpty())
+			})
+
+			It("returns a bad request for an empty origin", func() {
+				req, _ := http.NewRequest("GET", "/firehose/abc-123?origin=", nil)
+				req.Header.Add("Authorization", "token")
+
+				proxy.ServeHTTP(recorder, req)
+
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+				Expect(recorder.Body.String()).To(Equal("Origin must not be empty."))
+			})
+
 			It("returns an unauthorized status and sets the WWW-Authenticate header if authorization fails", func() {
 				adminAuth.Result = testhelpers.AuthorizerResult{Authorized: false, ErrorMessage: "Error: Invalid authorization"}
 
@@ -383,6 +433,144 @@ var _ = Describe("ServeHTTP", func() {
 	})
 })
 
+var _ = Describe("Shutdown", func() {
+	var (
+		proxy     *dopplerproxy.Proxy
+		connector *shutdownConnector
+		server    *httptest.Server
+	)
+
+	dialStream := func() *websocket.Conn {
+		wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/apps/abc123/stream"
+		ws, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Authorization": []string{"token"}})
+		Expect(err).NotTo(HaveOccurred())
+		return ws
+	}
+
+	readAll := func(ws *websocket.Conn) ([][]byte, error) {
+		var messages [][]byte
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				return messages, err
+			}
+			messages = append(messages, message)
+		}
+	}
+
+	logMessageText := func(message []byte) string {
+		var envelope events.Envelope
+		Expect(proto.Unmarshal(message, &envelope)).To(Succeed())
+		return string(envelope.GetLogMessage().GetMessage())
+	}
+
+	BeforeEach(func() {
+		auth := testhelpers.LogAuthorizer{Result: testhelpers.AuthorizerResult{Authorized: true}}
+		adminAuth := testhelpers.AdminAuthorizer{Result: testhelpers.AuthorizerResult{Authorized: true}}
+		connector = &shutdownConnector{
+			buffered:   [][]byte{[]byte("buffered 1"), []byte("buffered 2")},
+			connecting: make(chan struct{}, 10),
+		}
+
+		proxy = dopplerproxy.NewDopplerProxy(
+			auth.Authorize,
+			adminAuth.Authorize,
+			connector,
+			cfcomponent.Config{},
+			dopplerproxy.TranslateFromDropsondePath,
+			"cookieDomain",
+			marshaller.DropsondeLogMessage,
+			loggertesthelper.Logger(),
+		)
+		server = httptest.NewServer(proxy)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("delivers the buffered messages before the connection closed notice", func() {
+		ws := dialStream()
+		defer ws.Close()
+		Eventually(connector.connecting).Should(Receive())
+
+		go proxy.Shutdown(time.Second)
+
+		messages, err := readAll(ws)
+		Expect(err).To(BeAssignableToTypeOf(&websocket.CloseError{}))
+		Expect(err.(*websocket.CloseError).Code).To(Equal(websocket.CloseNormalClosure))
+
+		Expect(messages).To(HaveLen(3))
+		Expect(messages[0]).To(Equal([]byte("buffered 1")))
+		Expect(messages[1]).To(Equal([]byte("buffered 2")))
+		Expect(logMessageText(messages[2])).To(Equal("Connection closed: the traffic controller is shutting down"))
+	})
+
+	It("returns once all subscriptions are closed", func() {
+		ws := dialStream()
+		defer ws.Close()
+		Eventually(connector.connecting).Should(Receive())
+
+		shutdownDone := make(chan struct{})
+		go func() {
+			proxy.Shutdown(time.Second)
+			close(shutdownDone)
+		}()
+
+		readAll(ws)
+		Eventually(shutdownDone).Should(BeClosed())
+	})
+
+	It("closes subscriptions that are still draining when the grace period expires", func() {
+		connector.ignoreStop = true
+		ws := dialStream()
+		defer ws.Close()
+		Eventually(connector.connecting).Should(Receive())
+
+		shutdownDone := make(chan struct{})
+		go func() {
+			proxy.Shutdown(100 * time.Millisecond)
+			close(shutdownDone)
+		}()
+
+		messages, err := readAll(ws)
+		Expect(err).To(BeAssignableToTypeOf(&websocket.CloseError{}))
+		Expect(messages).To(HaveLen(1))
+		Expect(logMessageText(messages[0])).To(Equal("Connection closed: the traffic controller is shutting down"))
+		Eventually(shutdownDone).Should(BeClosed())
+	})
+
+	It("rejects new subscriptions", func() {
+		proxy.Shutdown(time.Second)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/apps/abc123/stream", nil)
+		req.Header.Add("Authorization", "token")
+		proxy.ServeHTTP(recorder, req)
+
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(connector.connecting).NotTo(Receive())
+	})
+
+	It("does not send the notice to recent logs requests", func() {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/apps/abc123/recentlogs", nil)
+		req.Header.Add("Authorization", "token")
+
+		served := make(chan struct{})
+		go func() {
+			proxy.ServeHTTP(recorder, req)
+			close(served)
+		}()
+		Eventually(connector.connecting).Should(Receive())
+
+		proxy.Shutdown(time.Second)
+		Eventually(served).Should(BeClosed())
+
+		Expect(recorder.Body.String()).To(Equal("buffered 1buffered 2"))
+	})
+})
+
 var _ = Describe("DefaultHandlerProvider", func() {
 	It("returns an HTTP handler for .../recentlogs", func() {
 		httpHandler := handlers.NewHttpHandler(make(chan []byte), loggertesthelper.Logger())
@@ -409,6 +597,28 @@ var _ = Describe("DefaultHandlerProvider", func() {
 	})
 })
 
+// shutdownConnector holds back its buffered messages until it is stopped, like
+// a connector that still has messages in flight when the proxy shuts down.
+type shutdownConnector struct {
+	buffered   [][]byte
+	connecting chan struct{}
+	ignoreStop bool
+}
+
+func (c *shutdownConnector) Connect(dopplerEndpoint doppler_endpoint.DopplerEndpoint, messagesChan chan<- []byte, stopChan <-chan struct{}) {
+	c.connecting <- struct{}{}
+
+	<-stopChan
+	if c.ignoreStop {
+		return
+	}
+
+	for _, message := range c.buffered {
+		messagesChan <- message
+	}
+	close(messagesChan)
+}
+
 type fakeChannelGroupConnector struct {
 	messages        chan []byte
 	dopplerEndpoint doppler_endpoint.DopplerEndpoint
@@ -449,6 +659,12 @@ func (f *fakeChannelGroupConnector) getStreamId() string {
 	return f.dopplerEndpoint.StreamId
 }
 
+func (f *fakeChannelGroupConnector) getOrigins() []string {
+	f.Lock()
+	defer f.Unlock()
+	return f.dopplerEndpoint.Origins
+}
+
 func (f *fakeChannelGroupConnector) getReconnect() bool {
 	f.Lock()
 	defer f.Unlock()
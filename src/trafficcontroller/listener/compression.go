@@ -0,0 +1,77 @@
+package listener
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CompressionSampleInterval is how often OnCompressionSample is called while
+// messages are read from a compressed connection.
+var CompressionSampleInterval = 10 * time.Second
+
+// countingConn counts the bytes read from the network, before gorilla
+// decompresses them.
+type countingConn struct {
+	net.Conn
+	bytesRead uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead += uint64(n)
+	return n, err
+}
+
+func compressionNegotiated(response *http.Response) bool {
+	if response == nil {
+		return false
+	}
+
+	for _, extension := range response.Header["Sec-Websocket-Extensions"] {
+		if strings.HasPrefix(strings.TrimSpace(extension), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionSampler tracks how many bytes were read from a connection and
+// how many bytes of messages they carried, and reports both every
+// CompressionSampleInterval. The handshake is counted with the first sample,
+// as gorilla may read the first frames along with it. A nil
+// compressionSampler does nothing.
+type compressionSampler struct {
+	conn         *countingConn
+	messageBytes uint64
+	report       func(wireBytes, messageBytes uint64, remote net.Addr)
+
+	lastSample                      time.Time
+	lastWireBytes, lastMessageBytes uint64
+}
+
+func newCompressionSampler(conn *countingConn, report func(wireBytes, messageBytes uint64, remote net.Addr)) *compressionSampler {
+	return &compressionSampler{
+		conn:       conn,
+		report:     report,
+		lastSample: time.Now(),
+	}
+}
+
+// messageRead must be called from the goroutine reading the connection.
+func (s *compressionSampler) messageRead(message []byte) {
+	if s == nil {
+		return
+	}
+
+	s.messageBytes += uint64(len(message))
+	if time.Since(s.lastSample) < CompressionSampleInterval {
+		return
+	}
+
+	wireBytes := s.conn.bytesRead
+	s.report(wireBytes-s.lastWireBytes, s.messageBytes-s.lastMessageBytes, s.conn.RemoteAddr())
+	s.lastSample = time.Now()
+	s.lastWireBytes, s.lastMessageBytes = wireBytes, s.messageBytes
+}
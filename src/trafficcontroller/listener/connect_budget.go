@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ConnectBudget bounds the connection attempts StartFirstAvailable makes
+// across all of its endpoints. An attempt is one dial of one candidate URL.
+// A zero MaxAttempts or MaxDuration leaves that bound out.
+type ConnectBudget struct {
+	MaxAttempts int
+	MaxDuration time.Duration
+}
+
+func (b ConnectBudget) enabled() bool {
+	return b.MaxAttempts > 0 || b.MaxDuration > 0
+}
+
+// EndpointFailure is the last error connecting to one candidate URL, and how
+// often connecting to it failed.
+type EndpointFailure struct {
+	Url      string
+	Attempts int
+	Err      error
+}
+
+// ConnectBudgetError is returned by StartFirstAvailable once none of its
+// endpoints could be connected to within its budget. It lists the failures of
+// every endpoint tried, in the order the endpoints were given.
+type ConnectBudgetError struct {
+	Attempts int
+	Elapsed  time.Duration
+	Failures []EndpointFailure
+}
+
+func (e *ConnectBudgetError) Error() string {
+	failures := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		failures = append(failures, fmt.Sprintf("%s (%d attempts): %s", failure.Url, failure.Attempts, failure.Err))
+	}
+	return fmt.Sprintf("WebsocketListener.StartFirstAvailable: Unable to connect to any doppler after %d attempts in %s: %s", e.Attempts, e.Elapsed, strings.Join(failures, "; "))
+}
+
+// connectBudget keeps what is left of a ConnectBudget along with the
+// failures that used it up.
+type connectBudget struct {
+	budget   ConnectBudget
+	started  time.Time
+	attempts int
+	failures map[string]*EndpointFailure
+	order    []string
+}
+
+func newConnectBudget(budget ConnectBudget) *connectBudget {
+	b := &connectBudget{budget: budget}
+	b.reset()
+	return b
+}
+
+// reset gives back the whole budget, such as after a successful connection.
+func (b *connectBudget) reset() {
+	b.started = time.Now()
+	b.attempts = 0
+	b.failures = make(map[string]*EndpointFailure)
+	b.order = nil
+}
+
+func (b *connectBudget) exhausted() bool {
+	if b.budget.MaxAttempts > 0 && b.attempts >= b.budget.MaxAttempts {
+		return true
+	}
+	return b.budget.MaxDuration > 0 && time.Since(b.started) >= b.budget.MaxDuration
+}
+
+func (b *connectBudget) fail(url string, err error) {
+	b.attempts++
+	failure, ok := b.failures[url]
+	if !ok {
+		failure = &EndpointFailure{Url: url}
+		b.failures[url] = failure
+		b.order = append(b.order, url)
+	}
+	failure.Attempts++
+	failure.Err = err
+}
+
+func (b *connectBudget) err() *ConnectBudgetError {
+	failures := make([]EndpointFailure, 0, len(b.order))
+	for _, url := range b.order {
+		failures = append(failures, *b.failures[url])
+	}
+	return &ConnectBudgetError{Attempts: b.attempts, Elapsed: time.Since(b.started), Failures: failures}
+}
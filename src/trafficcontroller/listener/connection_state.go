@@ -0,0 +1,42 @@
+package listener
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ConnectionState is the state of a websocket listener's connection to a
+// doppler.
+type ConnectionState int32
+
+const (
+	// Disconnected is the state before the listener first dials a doppler,
+	// and once its connection is closed or could not be made.
+	Disconnected ConnectionState = iota
+	// Connecting is the state while the listener dials a doppler.
+	Connecting
+	// Connected is the state while the listener listens to a doppler.
+	Connected
+)
+
+var connectionStateNames = [...]string{"disconnected", "connecting", "connected"}
+
+func (s ConnectionState) String() string {
+	if s < 0 || int(s) >= len(connectionStateNames) {
+		return fmt.Sprintf("ConnectionState(%d)", s)
+	}
+	return connectionStateNames[s]
+}
+
+// State returns the current state of the listener's connection. It may be
+// called at any time, also while the listener is reading from a doppler.
+func (l *websocketListener) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&l.state))
+}
+
+func (l *websocketListener) setState(state ConnectionState) {
+	previous := ConnectionState(atomic.SwapInt32(&l.state, int32(state)))
+	if previous != state && l.OnStateChange != nil {
+		l.OnStateChange(state)
+	}
+}
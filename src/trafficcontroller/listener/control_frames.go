@@ -0,0 +1,39 @@
+package listener
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// handleControlFrames makes conn pass the payloads of the ping, pong and
+// close frames it reads to OnControlFrame, writing the notices it returns to
+// outputChan. The frames are still answered as gorilla's default handlers
+// do. Without OnControlFrame the handlers are left alone.
+func (l *websocketListener) handleControlFrames(conn *websocket.Conn, appId string, outputChan OutputChannel) {
+	if l.OnControlFrame == nil {
+		return
+	}
+
+	answerPing := conn.PingHandler()
+	conn.SetPingHandler(func(payload string) error {
+		l.controlFrameReceived(websocket.PingMessage, payload, appId, outputChan)
+		return answerPing(payload)
+	})
+
+	answerPong := conn.PongHandler()
+	conn.SetPongHandler(func(payload string) error {
+		l.controlFrameReceived(websocket.PongMessage, payload, appId, outputChan)
+		return answerPong(payload)
+	})
+
+	answerClose := conn.CloseHandler()
+	conn.SetCloseHandler(func(code int, text string) error {
+		l.controlFrameReceived(websocket.CloseMessage, text, appId, outputChan)
+		return answerClose(code, text)
+	})
+}
+
+func (l *websocketListener) controlFrameReceived(frameType int, payload string, appId string, outputChan OutputChannel) {
+	if notice := l.OnControlFrame(frameType, payload); notice != "" {
+		outputChan <- l.generateLogMessage(notice, appId)
+	}
+}
@@ -0,0 +1,59 @@
+package listener
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// InvalidUrlError is returned by Start for a malformed doppler URL, which is
+// a configuration mistake rather than a doppler that cannot be reached.
+type InvalidUrlError struct {
+	Url    string
+	Reason string
+}
+
+func (e *InvalidUrlError) Error() string {
+	return fmt.Sprintf("WebsocketListener.Start: Invalid doppler URL %q: %s", e.Url, e.Reason)
+}
+
+// normalizeUrl trims surrounding whitespace from rawUrl and lower-cases its
+// scheme. It returns an InvalidUrlError unless the result is an absolute ws://
+// or wss:// URL with a host and, if given, a valid port.
+func normalizeUrl(rawUrl string) (string, error) {
+	trimmed := strings.TrimSpace(rawUrl)
+	invalid := func(reason string) (string, error) {
+		return "", &InvalidUrlError{Url: rawUrl, Reason: reason}
+	}
+
+	if trimmed == "" {
+		return invalid("the URL is empty")
+	}
+	if strings.IndexFunc(trimmed, unicode.IsSpace) >= 0 {
+		return invalid("the URL contains whitespace")
+	}
+	if !strings.Contains(trimmed, "://") {
+		return invalid("the URL has no ws:// or wss:// scheme")
+	}
+
+	parsed, err := url.Parse(trimmed)
+	if err != nil {
+		return invalid(err.Error())
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	if parsed.Scheme != "ws" && parsed.Scheme != "wss" {
+		return invalid(fmt.Sprintf("the scheme %s is not ws or wss", parsed.Scheme))
+	}
+	if parsed.Hostname() == "" {
+		return invalid("the URL has no host")
+	}
+	if port := parsed.Port(); port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return invalid(fmt.Sprintf("the port %s is not a valid port number", port))
+		}
+	}
+	return parsed.String(), nil
+}
@@ -0,0 +1,69 @@
+package listener
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// frameReceived passes a frame read at receivedAt to OnFrame and, for frames
+// holding a dropsonde LogMessage, its delivery latency to OnDeliveryLatency.
+// The latency compares the wall clocks of this host and the emitter, so it is
+// only as accurate as their clocks are in sync.
+func (l *websocketListener) frameReceived(receivedAt time.Time, msg []byte) {
+	if l.OnFrame != nil {
+		l.OnFrame(receivedAt, msg)
+	}
+
+	if l.OnDeliveryLatency == nil {
+		return
+	}
+
+	var envelope events.Envelope
+	if err := proto.Unmarshal(msg, &envelope); err != nil {
+		return
+	}
+	if envelope.GetEventType() != events.Envelope_LogMessage || envelope.GetLogMessage().Timestamp == nil {
+		return
+	}
+
+	l.OnDeliveryLatency(receivedAt.Sub(time.Unix(0, envelope.GetLogMessage().GetTimestamp())))
+}
+
+// DeliveryLatencies summarizes the delivery latencies passed to Record, so
+// that they can be reported once per interval rather than once per message.
+// It is safe for use by several listeners at once.
+type DeliveryLatencies struct {
+	lock  sync.Mutex
+	count int
+	sum   time.Duration
+	max   time.Duration
+}
+
+// Record adds latency to the summary. It can be used as OnDeliveryLatency.
+func (d *DeliveryLatencies) Record(latency time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.count++
+	d.sum += latency
+	if latency > d.max {
+		d.max = latency
+	}
+}
+
+// Flush returns the number, mean and maximum of the latencies recorded since
+// the previous call and starts over.
+func (d *DeliveryLatencies) Flush() (count int, mean time.Duration, max time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	count, max = d.count, d.max
+	if count > 0 {
+		mean = d.sum / time.Duration(count)
+	}
+	d.count, d.sum, d.max = 0, 0, 0
+	return count, mean, max
+}
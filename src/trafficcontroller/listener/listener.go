@@ -1,8 +1,18 @@
 package listener
 
+import "time"
+
 type StopChannel <-chan struct{}
 type OutputChannel chan<- []byte
 
 type Listener interface {
 	Start(string, string, OutputChannel, StopChannel) error
 }
+
+// Reconnector is implemented by listeners that can report a connection as a
+// reconnect after a connection was lost, for callers that reconnect by
+// starting a new listener. SetDisconnectedAt must be called before Start.
+type Reconnector interface {
+	SetDisconnectedAt(disconnectedAt time.Time)
+	HasConnected() bool
+}
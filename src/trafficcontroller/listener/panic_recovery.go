@@ -0,0 +1,44 @@
+package listener
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrListenerPanic is returned by a websocket listener that recovered from a
+// panic handling a message read from a doppler, such as one raised by the
+// message converter or a callback.
+var ErrListenerPanic = errors.New("WebsocketListener: Recovered from a panic handling a message from a doppler server")
+
+// listenRecovering listens like listenWithTimeout, but recovers from a panic
+// handling a message so that it only ends the one connection rather than the
+// whole traffic controller. The panic is logged, counted and reported to
+// OnPanic, the client is told with a notice and the connection is closed.
+func (l *websocketListener) listenRecovering(timeout time.Duration, url string, appId string, conn *websocket.Conn, sampler *compressionSampler, outputChan OutputChannel, stopChan StopChannel) (err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		atomic.AddUint64(&l.panics, 1)
+		l.logger.Errorf("WebsocketListener.Start: Recovered from a panic listening to %s for %s: %v\n%s", url, appId, recovered, debug.Stack())
+		if l.OnPanic != nil {
+			l.OnPanic(recovered, appId)
+		}
+		outputChan <- l.generateLogMessage("WebsocketListener.Start: Internal error handling a message from a doppler server, closing the connection", appId)
+		conn.Close()
+		err = ErrListenerPanic
+	}()
+
+	return l.listenWithTimeout(timeout, url, appId, conn, sampler, outputChan, stopChan)
+}
+
+// Panics returns the number of panics the listener recovered from.
+func (l *websocketListener) Panics() uint64 {
+	return atomic.LoadUint64(&l.panics)
+}
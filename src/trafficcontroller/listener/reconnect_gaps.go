@@ -0,0 +1,75 @@
+package listener
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
+)
+
+// ReconnectGaps keeps the last reconnect gap passed to Record for every app
+// and doppler, so that they can be reported tagged with both. Gaps are
+// dropped once they are older than the retention, which bounds the number of
+// apps reported. It is safe for use by several listeners at once.
+type ReconnectGaps struct {
+	retention time.Duration
+
+	lock sync.Mutex
+	gaps map[reconnectGapKey]reconnectGap
+}
+
+type reconnectGapKey struct {
+	appId   string
+	doppler string
+}
+
+type reconnectGap struct {
+	gap        time.Duration
+	recordedAt time.Time
+}
+
+func NewReconnectGaps(retention time.Duration) *ReconnectGaps {
+	return &ReconnectGaps{
+		retention: retention,
+		gaps:      make(map[reconnectGapKey]reconnectGap),
+	}
+}
+
+// Record keeps gap as the last reconnect gap of appId to the doppler at
+// remote. It can be used as OnReconnect.
+func (r *ReconnectGaps) Record(gap time.Duration, appId string, remote net.Addr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune()
+	r.gaps[reconnectGapKey{appId: appId, doppler: remote.String()}] = reconnectGap{gap: gap, recordedAt: time.Now()}
+}
+
+// Emit reports the last reconnect gap of every app and doppler, in
+// milliseconds, tagged with the app id and the doppler's address.
+func (r *ReconnectGaps) Emit() instrumentation.Context {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune()
+	var metrics []instrumentation.Metric
+	for key, gap := range r.gaps {
+		tags := map[string]interface{}{"appId": key.appId, "doppler": key.doppler}
+		metrics = append(metrics, instrumentation.Metric{Name: "dopplerReconnectGap", Value: float64(gap.gap) / float64(time.Millisecond), Tags: tags})
+	}
+
+	return instrumentation.Context{
+		Name:    "reconnectGaps",
+		Metrics: metrics,
+	}
+}
+
+// prune must be called with the lock held.
+func (r *ReconnectGaps) prune() {
+	for key, gap := range r.gaps {
+		if time.Since(gap.recordedAt) > r.retention {
+			delete(r.gaps, key)
+		}
+	}
+}
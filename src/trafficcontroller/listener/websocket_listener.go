@@ -1,10 +1,14 @@
 package listener
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"trafficcontroller/marshaller"
 
@@ -12,12 +16,115 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// DefaultCloseTimeout is the CloseTimeout of new websocket listeners.
+const DefaultCloseTimeout = time.Second
+
+// DefaultReconnectDelay is the ReconnectDelay of new websocket listeners.
+const DefaultReconnectDelay = 100 * time.Millisecond
+
+// Resolver returns the URL of the doppler serving appId.
+type Resolver func(appId string) (string, error)
+
 type websocketListener struct {
 	sync.WaitGroup
 	generateLogMessage marshaller.MessageGenerator
 	convertLogMessage  MessageConverter
 	timeout            time.Duration
 	logger             *gosteno.Logger
+
+	// OnConnect, if set, is called once the websocket handshake with a
+	// doppler succeeds, with the time taken to dial and the remote address.
+	OnConnect func(dialDuration time.Duration, remote net.Addr)
+
+	// LogDialAttempts makes the listener log every attempt to dial a doppler,
+	// with the URL, whether it succeeded and how long it took, so that
+	// operators can follow the connections to the dopplers over time. By
+	// default the attempts are not logged.
+	LogDialAttempts bool
+
+	// OnReconnect, if set, is called whenever StartWithResolver connects
+	// again after a doppler closed the connection, and when Start connects
+	// after SetDisconnectedAt, with the time from the connection being lost to
+	// the new handshake succeeding, the app it listens for and the new remote
+	// address. The gap is how long no logs were delivered for the app.
+	OnReconnect func(gap time.Duration, appId string, remote net.Addr)
+
+	// NoticeOnReconnect makes StartWithResolver write a notice to the output
+	// channel whenever it connects again after a doppler closed the
+	// connection, and Start when it connects after SetDisconnectedAt. Every
+	// message read from the closed connection is written before the notice
+	// and every message read from the new one after it, as a connection is
+	// read to its end before the next one is dialled, and the notice is
+	// written before the new connection is read.
+	NoticeOnReconnect bool
+
+	// OnStateChange, if set, is called with the new state whenever the state
+	// of the connection changes, see State.
+	OnStateChange func(state ConnectionState)
+
+	// OnCompressionSample, if set, is called every CompressionSampleInterval
+	// while listening to a doppler that negotiated permessage-deflate, with
+	// the bytes read from the connection and the bytes of the messages they
+	// decompressed to since the previous call.
+	OnCompressionSample func(wireBytes, messageBytes uint64, remote net.Addr)
+
+	// OnFrame, if set, is called for every message read from a doppler with
+	// the wall-clock time it was received, before the message is converted.
+	OnFrame func(receivedAt time.Time, message []byte)
+
+	// OnDeliveryLatency, if set, is called for every message read from a
+	// doppler that is a dropsonde LogMessage, with the time between the
+	// message's timestamp and its receipt.
+	OnDeliveryLatency func(latency time.Duration)
+
+	// OnControlFrame, if set, is called with the type and payload of every
+	// ping, pong and close frame read from a doppler, which dopplers may use
+	// to pass on operational hints such as shedding load. A non-empty notice
+	// it returns is written to the output channel. By default the payloads
+	// are ignored.
+	OnControlFrame func(frameType int, payload string) (notice string)
+
+	// Filter, if set, is called for every message read from a doppler before
+	// it is converted. Messages it returns false for are dropped and counted,
+	// see FilteredMessages.
+	Filter func(message []byte) bool
+
+	// OnPanic, if set, is called with the value recovered from a panic
+	// handling a message read from a doppler and the app it was for. The
+	// connection is closed after such a panic, see ErrListenerPanic.
+	OnPanic func(recovered interface{}, appId string)
+
+	// ReconnectAfterPanic makes StartWithResolver reconnect after recovering
+	// from a panic, as it does after the doppler closed the connection,
+	// rather than returning ErrListenerPanic.
+	ReconnectAfterPanic bool
+
+	// CloseTimeout is how long the listener waits for the doppler to
+	// acknowledge its close frame once the stop channel is closed, before
+	// closing the connection. With a zero CloseTimeout the connection is
+	// closed right after the close frame is sent.
+	CloseTimeout time.Duration
+
+	// ReconnectDelay is how long StartWithResolver waits after a doppler
+	// closed the connection before resolving the URL again and reconnecting,
+	// and StartFirstAvailable with a ConnectBudget waits before trying its
+	// endpoints again.
+	ReconnectDelay time.Duration
+
+	// ConnectBudget, if set, bounds the connection attempts
+	// StartFirstAvailable makes across all of its endpoints, see
+	// StartFirstAvailable.
+	ConnectBudget ConnectBudget
+
+	stopReasonLock sync.Mutex
+	stopReason     string
+
+	disconnectedAt time.Time
+	connected      bool
+
+	state            int32
+	filteredMessages uint64
+	panics           uint64
 }
 
 type MessageConverter func([]byte) ([]byte, error)
@@ -28,33 +135,335 @@ func NewWebsocket(logMessageGenerator marshaller.MessageGenerator, messageConver
 		convertLogMessage:  messageConverter,
 		timeout:            timeout,
 		logger:             logger,
+		CloseTimeout:       DefaultCloseTimeout,
+		ReconnectDelay:     DefaultReconnectDelay,
 	}
 }
 
+// SetStopReason makes the listener write a connection closed notice giving
+// reason to the output channel once the stop channel is closed, so that
+// callers that stop a listener for different reasons can tell clients why.
+// It must be called before the stop channel is closed. Without a reason no
+// notice is written.
+func (l *websocketListener) SetStopReason(reason string) {
+	l.stopReasonLock.Lock()
+	defer l.stopReasonLock.Unlock()
+
+	l.stopReason = reason
+}
+
+func (l *websocketListener) getStopReason() string {
+	l.stopReasonLock.Lock()
+	defer l.stopReasonLock.Unlock()
+
+	return l.stopReason
+}
+
+// FilteredMessages returns the number of messages Filter dropped.
+func (l *websocketListener) FilteredMessages() uint64 {
+	return atomic.LoadUint64(&l.filteredMessages)
+}
+
+// SetDisconnectedAt makes Start report its connection as a reconnect of a
+// connection to a doppler that was lost at disconnectedAt, see OnReconnect.
+// It is for callers that reconnect by starting a new listener, such as the
+// channel group connector. It must be called before Start.
+func (l *websocketListener) SetDisconnectedAt(disconnectedAt time.Time) {
+	l.disconnectedAt = disconnectedAt
+}
+
+// HasConnected returns whether the listener has connected to a doppler. It
+// must not be called while the listener is starting.
+func (l *websocketListener) HasConnected() bool {
+	return l.connected
+}
+
+// Start listens to the doppler at url until the stop channel is closed. A
+// malformed url is reported with an InvalidUrlError, so that a configuration
+// mistake can be told from a doppler that cannot be reached. Neither is
+// written to the output channel; the channel group connector writes the
+// client a distinct notice for each, see connectErrorNotice.
 func (l *websocketListener) Start(url string, appId string, outputChan OutputChannel, stopChan StopChannel) error {
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	url, err := normalizeUrl(url)
+	if err != nil {
+		l.logger.Error(err.Error())
+		return err
+	}
+
+	conn, sampler, err := l.dial(url)
 	if err != nil {
+		l.logger.Errorf("WebsocketListener.Start: Error dialling %s: %s", url, err.Error())
 		return err
 	}
+	if !l.disconnectedAt.IsZero() && l.OnReconnect != nil {
+		l.OnReconnect(time.Since(l.disconnectedAt), appId, conn.RemoteAddr())
+	}
+	if !l.disconnectedAt.IsZero() && l.NoticeOnReconnect {
+		outputChan <- l.generateLogMessage("WebsocketListener.Start: Reconnected to a doppler server", appId)
+	}
+
+	return l.listen(url, appId, conn, sampler, outputChan, stopChan)
+}
+
+// StartWithResolver listens to the doppler at the URL resolve returns for
+// appId. Whenever the doppler closes the connection, it resolves the URL again
+// and reconnects, so that the app follows changes to where its logs are
+// served, until the stop channel is closed. It returns the first error
+// resolving the URL, connecting or listening.
+func (l *websocketListener) StartWithResolver(resolve Resolver, appId string, outputChan OutputChannel, stopChan StopChannel) error {
+	var closedAt time.Time
+	for {
+		url, err := resolve(appId)
+		if err != nil {
+			l.logger.Errorf("WebsocketListener.StartWithResolver: Error resolving the doppler for %s: %s", appId, err.Error())
+			return err
+		}
+
+		conn, sampler, err := l.dial(url)
+		if err != nil {
+			return err
+		}
+		if !closedAt.IsZero() && l.OnReconnect != nil {
+			l.OnReconnect(time.Since(closedAt), appId, conn.RemoteAddr())
+		}
+		if !closedAt.IsZero() && l.NoticeOnReconnect {
+			outputChan <- l.generateLogMessage("WebsocketListener.StartWithResolver: Reconnected to a doppler server", appId)
+		}
+
+		if err := l.listenUntilClosed(url, appId, conn, sampler, outputChan, stopChan); err != nil {
+			if err != ErrListenerPanic || !l.ReconnectAfterPanic {
+				return err
+			}
+		}
+		closedAt = time.Now()
+
+		select {
+		case <-stopChan:
+			return nil
+		case <-time.After(l.ReconnectDelay):
+		}
+		l.logger.Debugf("WebsocketListener.StartWithResolver: %s closed the connection, reconnecting", url)
+	}
+}
+
+// listenUntilClosed listens like listen, but also releases the connection once
+// the doppler closes it rather than only once stopChan is closed.
+func (l *websocketListener) listenUntilClosed(url string, appId string, conn *websocket.Conn, sampler *compressionSampler, outputChan OutputChannel, stopChan StopChannel) error {
+	listenDone := make(chan struct{})
+	connStopChan := make(chan struct{})
+	go func() {
+		select {
+		case <-stopChan:
+		case <-listenDone:
+		}
+		close(connStopChan)
+	}()
+
+	defer close(listenDone)
+	return l.listen(url, appId, conn, sampler, outputChan, connStopChan)
+}
+
+// StartFirstAvailable tries the endpoints in order and listens to the first
+// one that connects, so an app can be served from any of several dopplers.
+// Endpoints may mix ws:// and wss:// URLs; an endpoint given as a bare
+// host:port is tried as wss:// first and ws:// second. A notice is written to
+// outputChan for every endpoint that cannot be reached, and the last dial
+// error is returned if none can.
+//
+// With a ConnectBudget, the endpoints are tried again and again, waiting
+// ReconnectDelay after each round, until one connects or the budget is used
+// up, and a ConnectBudgetError listing the failure of every endpoint is
+// returned. A successful connection gives back the whole budget, and once the
+// doppler closes the connection the endpoints are tried again from the first
+// one, until the stop channel is closed.
+func (l *websocketListener) StartFirstAvailable(endpoints []string, appId string, outputChan OutputChannel, stopChan StopChannel) error {
+	if l.ConnectBudget.enabled() {
+		return l.startFirstAvailableWithBudget(candidateUrls(endpoints), appId, outputChan, stopChan)
+	}
+
+	var err error
+	for _, url := range candidateUrls(endpoints) {
+		var conn *websocket.Conn
+		var sampler *compressionSampler
+		conn, sampler, err = l.dial(url)
+		if err != nil {
+			l.connectFailed(url, err, appId, outputChan)
+			continue
+		}
+
+		return l.listen(url, appId, conn, sampler, outputChan, stopChan)
+	}
+
+	if err == nil {
+		err = errors.New("WebsocketListener.StartFirstAvailable: No endpoints given")
+	}
+	return err
+}
+
+func (l *websocketListener) startFirstAvailableWithBudget(urls []string, appId string, outputChan OutputChannel, stopChan StopChannel) error {
+	if len(urls) == 0 {
+		return errors.New("WebsocketListener.StartFirstAvailable: No endpoints given")
+	}
+
+	budget := newConnectBudget(l.ConnectBudget)
+	for {
+		for _, url := range urls {
+			if budget.exhausted() {
+				err := budget.err()
+				l.logger.Error(err.Error())
+				outputChan <- l.generateLogMessage("WebsocketListener.StartFirstAvailable: Unable to reach any doppler server", appId)
+				return err
+			}
+
+			conn, sampler, err := l.dial(url)
+			if err != nil {
+				budget.fail(url, err)
+				l.connectFailed(url, err, appId, outputChan)
+				continue
+			}
+
+			if err := l.listenUntilClosed(url, appId, conn, sampler, outputChan, stopChan); err != nil {
+				return err
+			}
+			budget.reset()
+			l.logger.Debugf("WebsocketListener.StartFirstAvailable: %s closed the connection, reconnecting", url)
+			break
+		}
+
+		select {
+		case <-stopChan:
+			return nil
+		case <-time.After(l.ReconnectDelay):
+		}
+	}
+}
+
+func (l *websocketListener) connectFailed(url string, err error, appId string, outputChan OutputChannel) {
+	l.logger.Warnf("WebsocketListener.StartFirstAvailable: Error connecting to %s: %s", url, err.Error())
+	outputChan <- l.generateLogMessage("WebsocketListener.StartFirstAvailable: Error connecting to a doppler server, trying the next one", appId)
+}
+
+func candidateUrls(endpoints []string) []string {
+	urls := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if strings.HasPrefix(endpoint, "ws://") || strings.HasPrefix(endpoint, "wss://") {
+			urls = append(urls, endpoint)
+			continue
+		}
+		urls = append(urls, "wss://"+endpoint, "ws://"+endpoint)
+	}
+	return urls
+}
+
+// dial offers permessage-deflate to the doppler, which decides whether it is
+// used. The returned sampler is nil unless compression was negotiated and
+// OnCompressionSample is set.
+func (l *websocketListener) dial(url string) (*websocket.Conn, *compressionSampler, error) {
+	var counted *countingConn
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		netDial := websocket.DefaultDialer.NetDial
+		if netDial == nil {
+			netDial = net.Dial
+		}
+		conn, err := netDial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		counted = &countingConn{Conn: conn}
+		return counted, nil
+	}
+
+	l.setState(Connecting)
+	dialStart := time.Now()
+	conn, response, err := dialer.Dial(url, nil)
+	if err != nil {
+		l.setState(Disconnected)
+		if l.LogDialAttempts {
+			l.logger.Infof("WebsocketListener: Dialling %s failed after %s: %s", url, time.Since(dialStart), err)
+		}
+		return nil, nil, err
+	}
+	l.setState(Connected)
+	l.connected = true
+	if l.LogDialAttempts {
+		l.logger.Infof("WebsocketListener: Dialled %s in %s", url, time.Since(dialStart))
+	}
+
+	if l.OnConnect != nil {
+		l.OnConnect(time.Since(dialStart), conn.RemoteAddr())
+	}
+
+	var sampler *compressionSampler
+	if l.OnCompressionSample != nil && compressionNegotiated(response) {
+		sampler = newCompressionSampler(counted, l.OnCompressionSample)
+	}
+	return conn, sampler, nil
+}
 
+func (l *websocketListener) listen(url string, appId string, conn *websocket.Conn, sampler *compressionSampler, outputChan OutputChannel, stopChan StopChannel) error {
+	l.handleControlFrames(conn, appId, outputChan)
+
+	readDone := make(chan struct{})
 	go func() {
 		<-stopChan
 		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+		l.awaitCloseAck(url, readDone)
 		conn.Close()
 	}()
 
-	return l.listenWithTimeout(l.timeout, url, appId, conn, outputChan)
+	err := l.listenRecovering(l.timeout, url, appId, conn, sampler, outputChan, stopChan)
+	close(readDone)
+	l.setState(Disconnected)
+
+	select {
+	case <-stopChan:
+		if reason := l.getStopReason(); reason != "" {
+			outputChan <- l.generateLogMessage("WebsocketListener.Start: Connection closed: "+reason, appId)
+		}
+	default:
+	}
+	return err
+}
+
+// awaitCloseAck waits until the doppler has answered the close frame, which
+// ends the read loop, or CloseTimeout has passed.
+func (l *websocketListener) awaitCloseAck(url string, readDone <-chan struct{}) {
+	if l.CloseTimeout <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(l.CloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-readDone:
+	case <-timer.C:
+		l.logger.Debugf("WebsocketListener.Start: %s did not acknowledge the close frame within %s", url, l.CloseTimeout.String())
+	}
 }
 
-func (l *websocketListener) listenWithTimeout(timeout time.Duration, url string, appId string, conn *websocket.Conn, outputChan OutputChannel) error {
+func (l *websocketListener) listenWithTimeout(timeout time.Duration, url string, appId string, conn *websocket.Conn, sampler *compressionSampler, outputChan OutputChannel, stopChan StopChannel) error {
 	for {
 		conn.SetReadDeadline(deadline(timeout))
 		_, msg, err := conn.ReadMessage()
+		receivedAt := time.Now()
 
-		if err == io.EOF {
+		if err == io.EOF || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 			return nil
 		}
 
+		if err != nil {
+			select {
+			case <-stopChan:
+				// Closing the connection, or waiting for the close
+				// acknowledgement, ended the read.
+				return nil
+			default:
+			}
+		}
+
 		if err != nil {
 			isTimeout, _ := regexp.MatchString(`i/o timeout`, err.Error())
 			if isTimeout {
@@ -74,6 +483,14 @@ func (l *websocketListener) listenWithTimeout(timeout time.Duration, url string,
 			return nil
 		}
 
+		sampler.messageRead(msg)
+		l.frameReceived(receivedAt, msg)
+
+		if l.Filter != nil && !l.Filter(msg) {
+			atomic.AddUint64(&l.filteredMessages, 1)
+			continue
+		}
+
 		convertedMessage, err := l.convertLogMessage(msg)
 		if err == nil {
 			outputChan <- convertedMessage
@@ -3,17 +3,25 @@ package listener_test
 import (
 	"trafficcontroller/listener"
 
+	"errors"
 	"fmt"
 	"github.com/cloudfoundry/loggregatorlib/logmessage"
 	"github.com/gorilla/websocket"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 	"trafficcontroller/marshaller"
 
+	"github.com/cloudfoundry/dropsonde/events"
+	"github.com/cloudfoundry/dropsonde/factories"
+	"github.com/cloudfoundry/loggregatorlib/cfcomponent/instrumentation"
 	"github.com/cloudfoundry/loggregatorlib/loggertesthelper"
+	"github.com/gogo/protobuf/proto"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -45,12 +53,72 @@ var _ = Describe("WebsocketListener", func() {
 		ts.Close()
 	})
 
+	receiveNotice := func() string {
+		var msgData []byte
+		Eventually(outputChan).Should(Receive(&msgData))
+		msg, _ := logmessage.ParseMessage(msgData)
+		Expect(msg.GetLogMessage().GetSourceName()).To(Equal("LGR"))
+		return string(msg.GetLogMessage().GetMessage())
+	}
+
 	Context("when the server is not running", func() {
 		It("should error when connecting", func(done Done) {
 			err := l.Start("ws://localhost:1234", "myApp", outputChan, stopChan)
 			Expect(err).To(HaveOccurred())
 			close(done)
 		}, 2)
+
+		It("returns an error other than an invalid URL error and leaves the notice to the caller", func(done Done) {
+			err := l.Start("ws://localhost:1234", "myApp", outputChan, stopChan)
+			Expect(err).NotTo(BeAssignableToTypeOf(&listener.InvalidUrlError{}))
+
+			Expect(outputChan).NotTo(Receive())
+			close(done)
+		}, 2)
+
+		It("logs the failed dial attempt with its duration when logging dial attempts", func(done Done) {
+			loggertesthelper.TestLoggerSink.Clear()
+			converter := func(d []byte) ([]byte, error) { return d, nil }
+			websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+			websocketListener.LogDialAttempts = true
+
+			websocketListener.Start("ws://localhost:1234", "myApp", outputChan, stopChan)
+
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).To(MatchRegexp(`WebsocketListener: Dialling ws://localhost:1234 failed after [0-9.]+[µnm]?s: .*connection refused`))
+			close(done)
+		}, 2)
+	})
+
+	Context("when the URL is malformed", func() {
+		malformedUrls := map[string]string{
+			"":                         "the URL is empty",
+			"localhost:1234":           "the URL has no ws:// or wss:// scheme",
+			"ws://local host:1234":     "the URL contains whitespace",
+			"ws://localhost:1234/a b":  "the URL contains whitespace",
+			"http://localhost:1234":    "the scheme http is not ws or wss",
+			"ws://":                    "the URL has no host",
+			"ws://localhost:99999":     "the port 99999 is not a valid port number",
+			"ws://localhost:port/path": "invalid port",
+		}
+
+		for malformedUrl, reason := range malformedUrls {
+			malformedUrl, reason := malformedUrl, reason
+
+			It(fmt.Sprintf("returns an invalid URL error for %q", malformedUrl), func() {
+				err := l.Start(malformedUrl, "myApp", outputChan, stopChan)
+				Expect(err).To(BeAssignableToTypeOf(&listener.InvalidUrlError{}))
+
+				invalidUrlError := err.(*listener.InvalidUrlError)
+				Expect(invalidUrlError.Url).To(Equal(malformedUrl))
+				Expect(invalidUrlError.Reason).To(ContainSubstring(reason))
+				Expect(err.Error()).To(HavePrefix("WebsocketListener.Start: Invalid doppler URL"))
+			})
+
+			It(fmt.Sprintf("leaves the notice for %q to the caller", malformedUrl), func() {
+				l.Start(malformedUrl, "myApp", outputChan, stopChan)
+				Expect(outputChan).NotTo(Receive())
+			})
+		}
 	})
 
 	Context("when the server is running", func() {
@@ -75,6 +143,70 @@ var _ = Describe("WebsocketListener", func() {
 			close(done)
 		})
 
+		It("trims the URL and accepts an upper case scheme", func() {
+			go l.Start(fmt.Sprintf("  WS://%s\n", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+			message := []byte("hello world")
+			messageChan <- message
+
+			var receivedMessage []byte
+			Eventually(outputChan).Should(Receive(&receivedMessage))
+			Expect(receivedMessage).To(Equal(message))
+		})
+
+		It("should report the dial duration once connected", func(done Done) {
+			type connection struct {
+				dialDuration time.Duration
+				remote       net.Addr
+			}
+			connections := make(chan connection, 1)
+
+			converter := func(d []byte) ([]byte, error) { return d, nil }
+			websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+			websocketListener.OnConnect = func(dialDuration time.Duration, remote net.Addr) {
+				connections <- connection{dialDuration: dialDuration, remote: remote}
+			}
+
+			dialStart := time.Now()
+			go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+			var c connection
+			Eventually(connections).Should(Receive(&c))
+			Expect(c.dialDuration).To(BeNumerically(">", 0))
+			Expect(c.dialDuration).To(BeNumerically("<=", time.Since(dialStart)))
+			Expect(c.remote.String()).To(Equal(ts.Listener.Addr().String()))
+			Consistently(connections).ShouldNot(Receive())
+
+			close(stopChan)
+			close(done)
+		})
+
+		It("logs the successful dial attempt with its duration when logging dial attempts", func(done Done) {
+			loggertesthelper.TestLoggerSink.Clear()
+			converter := func(d []byte) ([]byte, error) { return d, nil }
+			websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+			websocketListener.LogDialAttempts = true
+
+			go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+			Eventually(loggertesthelper.TestLoggerSink.LogContents).Should(MatchRegexp(`WebsocketListener: Dialled ws://%s in [0-9.]+[µnm]?s`, regexp.QuoteMeta(ts.Listener.Addr().String())))
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).NotTo(ContainSubstring("failed after"))
+
+			close(stopChan)
+			close(done)
+		})
+
+		It("does not log the dial attempts by default", func(done Done) {
+			loggertesthelper.TestLoggerSink.Clear()
+
+			go l.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+			messageChan <- []byte("hello world")
+			Eventually(outputChan).Should(Receive())
+			Expect(loggertesthelper.TestLoggerSink.LogContents()).NotTo(ContainSubstring("Dialled"))
+			close(done)
+		})
+
 		It("should output messages recieved from the server", func(done Done) {
 			go l.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
 
@@ -88,6 +220,73 @@ var _ = Describe("WebsocketListener", func() {
 			close(done)
 		})
 
+		Context("with frame timing", func() {
+			var websocketListener listener.Listener
+			var frameTimes chan time.Time
+			var latencies chan time.Duration
+
+			BeforeEach(func() {
+				frameTimes = make(chan time.Time, 10)
+				latencies = make(chan time.Duration, 10)
+
+				converter := func(d []byte) ([]byte, error) { return d, nil }
+				wl := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+				wl.OnFrame = func(receivedAt time.Time, message []byte) {
+					frameTimes <- receivedAt
+				}
+				wl.OnDeliveryLatency = func(latency time.Duration) {
+					latencies <- latency
+				}
+				websocketListener = wl
+			})
+
+			AfterEach(func() {
+				close(stopChan)
+			})
+
+			It("reports the time every message is received", func() {
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				sentAt := time.Now()
+				messageChan <- []byte("hello world")
+
+				var receivedAt time.Time
+				Eventually(frameTimes).Should(Receive(&receivedAt))
+				Expect(receivedAt).To(BeTemporally(">=", sentAt))
+				Expect(receivedAt).To(BeTemporally("<=", time.Now()))
+				Eventually(outputChan).Should(Receive(Equal([]byte("hello world"))))
+			})
+
+			It("reports the delivery latency of log messages", func() {
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				sentAt := time.Now()
+				messageChan <- marshalledLogMessage(sentAt.Add(-2 * time.Second))
+
+				var latency time.Duration
+				Eventually(latencies).Should(Receive(&latency))
+				Expect(latency).To(BeNumerically(">=", 2*time.Second))
+				Expect(latency).To(BeNumerically("<=", 2*time.Second+time.Since(sentAt)))
+			})
+
+			It("reports no delivery latency for other messages", func() {
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				heartbeat, err := proto.Marshal(&events.Envelope{
+					Origin:    proto.String("fake-origin"),
+					EventType: events.Envelope_Heartbeat.Enum(),
+					Heartbeat: factories.NewHeartbeat(1, 2, 3),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				messageChan <- heartbeat
+				messageChan <- []byte("hello world")
+
+				Eventually(frameTimes).Should(Receive())
+				Eventually(frameTimes).Should(Receive())
+				Consistently(latencies).ShouldNot(Receive())
+			})
+		})
+
 		It("should not send errors when client requests close without issue", func() {
 			doneWaiting := make(chan struct{})
 			go func() {
@@ -141,6 +340,370 @@ var _ = Describe("WebsocketListener", func() {
 			Eventually(doneWaiting).Should(BeClosed())
 			close(done)
 		})
+
+		Context("with compression sampling", func() {
+			type sample struct {
+				wireBytes, messageBytes uint64
+			}
+			var samples chan sample
+			var websocketListener listener.Listener
+
+			BeforeEach(func() {
+				listener.CompressionSampleInterval = 0
+				samples = make(chan sample, 100)
+
+				converter := func(d []byte) ([]byte, error) { return d, nil }
+				wl := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+				wl.OnCompressionSample = func(wireBytes, messageBytes uint64, remote net.Addr) {
+					samples <- sample{wireBytes: wireBytes, messageBytes: messageBytes}
+				}
+				websocketListener = wl
+			})
+
+			AfterEach(func() {
+				listener.CompressionSampleInterval = 10 * time.Second
+				close(stopChan)
+			})
+
+			It("reports fewer bytes read than received when the server compresses", func() {
+				fh.Lock()
+				fh.compress = true
+				fh.Unlock()
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				message := []byte(strings.Repeat("compressible ", 100))
+				messageChan <- message
+				Eventually(outputChan).Should(Receive(Equal(message)))
+
+				var s sample
+				Eventually(samples).Should(Receive(&s))
+				Expect(s.messageBytes).To(BeEquivalentTo(len(message)))
+				Expect(s.wireBytes).To(BeNumerically(">", 0))
+				Expect(s.wireBytes).To(BeNumerically("<", s.messageBytes))
+			})
+
+			It("does not report anything when the server does not compress", func() {
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				message := []byte(strings.Repeat("compressible ", 100))
+				messageChan <- message
+				Eventually(outputChan).Should(Receive(Equal(message)))
+
+				Consistently(samples).ShouldNot(Receive())
+			})
+		})
+
+		Context("with a filter", func() {
+			It("forwards only the messages the filter matches and counts the others", func() {
+				converter := func(d []byte) ([]byte, error) { return d, nil }
+				websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+				websocketListener.Filter = func(message []byte) bool {
+					return strings.Contains(string(message), "error")
+				}
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				messageChan <- []byte("an error occurred")
+				messageChan <- []byte("all is well")
+				messageChan <- []byte("another error")
+				messageChan <- []byte("still fine")
+
+				Eventually(outputChan).Should(Receive(Equal([]byte("an error occurred"))))
+				Eventually(outputChan).Should(Receive(Equal([]byte("another error"))))
+				Eventually(websocketListener.FilteredMessages).Should(BeEquivalentTo(2))
+				Consistently(outputChan).ShouldNot(Receive())
+
+				close(stopChan)
+			})
+
+			It("forwards every message without a filter", func() {
+				go l.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				messageChan <- []byte("an error occurred")
+				messageChan <- []byte("all is well")
+
+				Eventually(outputChan).Should(Receive(Equal([]byte("an error occurred"))))
+				Eventually(outputChan).Should(Receive(Equal([]byte("all is well"))))
+				close(stopChan)
+			})
+		})
+
+		Context("when handling a message panics", func() {
+			It("recovers, tells the client and closes only that connection", func(done Done) {
+				converter := func(d []byte) ([]byte, error) {
+					if string(d) == "poison" {
+						panic("cannot convert poison")
+					}
+					return d, nil
+				}
+				websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+				recovered := make(chan interface{}, 1)
+				websocketListener.OnPanic = func(value interface{}, appId string) {
+					Expect(appId).To(Equal("myApp"))
+					recovered <- value
+				}
+
+				errs := make(chan error, 1)
+				go func() {
+					errs <- websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+				}()
+
+				messageChan <- []byte("fine")
+				Eventually(outputChan).Should(Receive(Equal([]byte("fine"))))
+				messageChan <- []byte("poison")
+
+				Eventually(errs).Should(Receive(Equal(listener.ErrListenerPanic)))
+				Expect(receiveNotice()).To(ContainSubstring("Internal error handling a message"))
+				Expect(recovered).To(Receive(Equal("cannot convert poison")))
+				Expect(websocketListener.Panics()).To(BeEquivalentTo(1))
+				close(stopChan)
+				close(done)
+			})
+
+			It("recovers from a panicking filter", func(done Done) {
+				websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, func(d []byte) ([]byte, error) { return d, nil }, 500*time.Millisecond, loggertesthelper.Logger())
+				websocketListener.Filter = func(message []byte) bool {
+					var nilMap map[string]bool
+					nilMap[string(message)] = true
+					return true
+				}
+
+				errs := make(chan error, 1)
+				go func() {
+					errs <- websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+				}()
+
+				messageChan <- []byte("message")
+				Eventually(errs).Should(Receive(Equal(listener.ErrListenerPanic)))
+				Expect(websocketListener.Panics()).To(BeEquivalentTo(1))
+				close(stopChan)
+				close(done)
+			})
+		})
+
+		Context("with control frames", func() {
+			sendPing := func(payload string) {
+				Eventually(fh.lastConn).ShouldNot(BeNil())
+				err := fh.lastConn().WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(time.Second))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			It("surfaces the notices the control frame handler makes of ping payloads", func() {
+				type controlFrame struct {
+					frameType int
+					payload   string
+				}
+				frames := make(chan controlFrame, 10)
+
+				converter := func(d []byte) ([]byte, error) { return d, nil }
+				websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+				websocketListener.OnControlFrame = func(frameType int, payload string) string {
+					frames <- controlFrame{frameType: frameType, payload: payload}
+					if payload == "" {
+						return ""
+					}
+					return "Doppler notice: " + payload
+				}
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				sendPing("shedding load")
+				Eventually(frames).Should(Receive(Equal(controlFrame{frameType: websocket.PingMessage, payload: "shedding load"})))
+
+				var notice []byte
+				Eventually(outputChan).Should(Receive(&notice))
+				receivedMessage, err := logmessage.ParseMessage(notice)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(receivedMessage.GetLogMessage().GetMessage())).To(Equal("Doppler notice: shedding load"))
+				Expect(receivedMessage.GetLogMessage().GetAppId()).To(Equal("myApp"))
+
+				sendPing("")
+				Eventually(frames).Should(Receive(Equal(controlFrame{frameType: websocket.PingMessage, payload: ""})))
+				Consistently(outputChan).ShouldNot(Receive())
+
+				close(stopChan)
+			})
+
+			It("still answers pings with the control frame handler set", func() {
+				pinger := &pingHandler{payload: "are you there", pongs: make(chan string, 1)}
+				pingServer := httptest.NewServer(pinger)
+				defer pingServer.Close()
+
+				converter := func(d []byte) ([]byte, error) { return d, nil }
+				websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+				websocketListener.OnControlFrame = func(int, string) string { return "" }
+				go websocketListener.Start(fmt.Sprintf("ws://%s", pingServer.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				Eventually(pinger.pongs).Should(Receive(Equal("are you there")))
+				close(stopChan)
+			})
+
+			It("ignores the payloads by default", func() {
+				go l.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				sendPing("shedding load")
+				Consistently(outputChan).ShouldNot(Receive())
+				close(stopChan)
+			})
+		})
+
+		Context("with a stop reason", func() {
+			var websocketListener interface {
+				listener.Listener
+				SetStopReason(string)
+			}
+
+			BeforeEach(func() {
+				converter := func(d []byte) ([]byte, error) { return d, nil }
+				websocketListener = listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+			})
+
+			startAndStop := func() {
+				doneWaiting := make(chan struct{})
+				go func() {
+					websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+					close(doneWaiting)
+				}()
+
+				message := []byte("hello world")
+				messageChan <- message
+				Eventually(outputChan).Should(Receive(Equal(message)))
+
+				close(stopChan)
+				Eventually(doneWaiting).Should(BeClosed())
+			}
+
+			It("gives the reason in the connection closed notice", func() {
+				websocketListener.SetStopReason("server maintenance")
+				startAndStop()
+
+				var msgData []byte
+				Eventually(outputChan).Should(Receive(&msgData))
+				msg, _ := logmessage.ParseMessage(msgData)
+				Expect(msg.GetLogMessage().GetSourceName()).To(Equal("LGR"))
+				Expect(msg.GetLogMessage().GetAppId()).To(Equal("myApp"))
+				Expect(string(msg.GetLogMessage().GetMessage())).To(Equal("WebsocketListener.Start: Connection closed: server maintenance"))
+				Consistently(outputChan).Should(BeEmpty())
+			})
+
+			It("gives the last reason set before stopping", func() {
+				websocketListener.SetStopReason("user disconnected")
+				websocketListener.SetStopReason("rebalance")
+				startAndStop()
+
+				var msgData []byte
+				Eventually(outputChan).Should(Receive(&msgData))
+				msg, _ := logmessage.ParseMessage(msgData)
+				Expect(string(msg.GetLogMessage().GetMessage())).To(Equal("WebsocketListener.Start: Connection closed: rebalance"))
+			})
+
+			It("does not write a notice when the server closes the connection", func() {
+				websocketListener.SetStopReason("server maintenance")
+				go websocketListener.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+
+				message := []byte("hello world")
+				messageChan <- message
+				Eventually(outputChan).Should(Receive(Equal(message)))
+
+				close(messageChan)
+				Consistently(func() string {
+					select {
+					case msgData := <-outputChan:
+						msg, _ := logmessage.ParseMessage(msgData)
+						return string(msg.GetLogMessage().GetMessage())
+					default:
+						return ""
+					}
+				}).ShouldNot(ContainSubstring("Connection closed"))
+				close(stopChan)
+			})
+		})
+	})
+
+	Describe("StartFirstAvailable", func() {
+		var websocketListener interface {
+			StartFirstAvailable([]string, string, listener.OutputChannel, listener.StopChannel) error
+		}
+
+		BeforeEach(func() {
+			converter := func(d []byte) ([]byte, error) { return d, nil }
+			websocketListener = listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		})
+
+		receiveNotice := func() string {
+			var msgData []byte
+			Eventually(outputChan).Should(Receive(&msgData))
+			msg, _ := logmessage.ParseMessage(msgData)
+			Expect(msg.GetLogMessage().GetSourceName()).To(Equal("LGR"))
+			return string(msg.GetLogMessage().GetMessage())
+		}
+
+		It("errors when none of the endpoints can be reached", func(done Done) {
+			err := websocketListener.StartFirstAvailable([]string{"ws://localhost:1234", "wss://localhost:1235"}, "myApp", outputChan, stopChan)
+			Expect(err).To(HaveOccurred())
+
+			Expect(receiveNotice()).To(ContainSubstring("Error connecting to a doppler server"))
+			Expect(receiveNotice()).To(ContainSubstring("Error connecting to a doppler server"))
+			close(done)
+		}, 2)
+
+		It("errors when no endpoints are given", func() {
+			err := websocketListener.StartFirstAvailable(nil, "myApp", outputChan, stopChan)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("when a later endpoint is running", func() {
+			BeforeEach(func() {
+				ts.Start()
+				Eventually(func() bool {
+					resp, _ := http.Head(fmt.Sprintf("http://%s", ts.Listener.Addr()))
+					return resp != nil && resp.StatusCode == http.StatusOK
+				}).Should(BeTrue())
+			})
+
+			It("skips the dead endpoint with a notice and listens to the live one", func() {
+				endpoints := []string{"wss://localhost:1234", fmt.Sprintf("ws://%s", ts.Listener.Addr())}
+				go websocketListener.StartFirstAvailable(endpoints, "myApp", outputChan, stopChan)
+
+				Expect(receiveNotice()).To(Equal("WebsocketListener.StartFirstAvailable: Error connecting to a doppler server, trying the next one"))
+
+				message := []byte("hello world")
+				messageChan <- message
+
+				var receivedMessage []byte
+				Eventually(outputChan).Should(Receive(&receivedMessage))
+				Expect(receivedMessage).To(Equal(message))
+			})
+
+			It("falls back from wss to ws for endpoints without a scheme", func() {
+				endpoints := []string{"localhost:1234", ts.Listener.Addr().String()}
+				go websocketListener.StartFirstAvailable(endpoints, "myApp", outputChan, stopChan)
+
+				for i := 0; i < 3; i++ {
+					Expect(receiveNotice()).To(ContainSubstring("trying the next one"))
+				}
+
+				message := []byte("hello world")
+				messageChan <- message
+
+				var receivedMessage []byte
+				Eventually(outputChan).Should(Receive(&receivedMessage))
+				Expect(receivedMessage).To(Equal(message))
+			})
+
+			It("returns once stopped", func(done Done) {
+				doneWaiting := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					err := websocketListener.StartFirstAvailable([]string{"ws://localhost:1234", fmt.Sprintf("ws://%s", ts.Listener.Addr())}, "myApp", outputChan, stopChan)
+					Expect(err).NotTo(HaveOccurred())
+					close(doneWaiting)
+				}()
+
+				receiveNotice()
+				close(stopChan)
+				Eventually(doneWaiting).Should(BeClosed())
+				close(done)
+			})
+		})
 	})
 
 	Context("when the server is slow", func() {
@@ -221,9 +784,694 @@ var _ = Describe("WebsocketListener", func() {
 	})
 })
 
+var _ = Describe("DeliveryLatencies", func() {
+	It("summarizes the latencies recorded since the last flush", func() {
+		latencies := &listener.DeliveryLatencies{}
+		latencies.Record(10 * time.Millisecond)
+		latencies.Record(30 * time.Millisecond)
+		latencies.Record(20 * time.Millisecond)
+
+		count, mean, max := latencies.Flush()
+		Expect(count).To(Equal(3))
+		Expect(mean).To(Equal(20 * time.Millisecond))
+		Expect(max).To(Equal(30 * time.Millisecond))
+
+		count, mean, max = latencies.Flush()
+		Expect(count).To(BeZero())
+		Expect(mean).To(BeZero())
+		Expect(max).To(BeZero())
+	})
+})
+
+var _ = Describe("WebsocketListener started after a lost connection", func() {
+	var (
+		websocketListener listener.Listener
+		outputChan        chan []byte
+		stopChan          chan struct{}
+		server            *httptest.Server
+		reconnects        chan time.Duration
+		remotes           chan net.Addr
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(greetingHandler("from the doppler"))
+		outputChan = make(chan []byte, 10)
+		stopChan = make(chan struct{})
+		reconnects = make(chan time.Duration, 10)
+		remotes = make(chan net.Addr, 10)
+
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		l := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		l.OnReconnect = func(gap time.Duration, appId string, remote net.Addr) {
+			Expect(appId).To(Equal("myApp"))
+			reconnects <- gap
+			remotes <- remote
+		}
+		websocketListener = l
+	})
+
+	AfterEach(func() {
+		close(stopChan)
+		server.Close()
+	})
+
+	It("reports the time since the connection was lost once it connects", func() {
+		reconnector := websocketListener.(listener.Reconnector)
+		reconnector.SetDisconnectedAt(time.Now().Add(-300 * time.Millisecond))
+
+		go websocketListener.Start(fmt.Sprintf("ws://%s", server.Listener.Addr()), "myApp", outputChan, stopChan)
+
+		var gap time.Duration
+		Eventually(reconnects).Should(Receive(&gap))
+		Expect(gap).To(BeNumerically(">=", 300*time.Millisecond))
+		Expect(gap).To(BeNumerically("<", time.Second))
+		Expect((<-remotes).String()).To(Equal(server.Listener.Addr().String()))
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+	})
+
+	It("writes a notice before the messages of the new connection", func() {
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		noticingListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		noticingListener.NoticeOnReconnect = true
+		noticingListener.SetDisconnectedAt(time.Now())
+
+		go noticingListener.Start(fmt.Sprintf("ws://%s", server.Listener.Addr()), "myApp", outputChan, stopChan)
+
+		var msgData []byte
+		Eventually(outputChan).Should(Receive(&msgData))
+		msg, err := logmessage.ParseMessage(msgData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(msg.GetLogMessage().GetMessage())).To(Equal("WebsocketListener.Start: Reconnected to a doppler server"))
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+	})
+
+	It("does not report a reconnect for a first connection", func() {
+		go websocketListener.Start(fmt.Sprintf("ws://%s", server.Listener.Addr()), "myApp", outputChan, stopChan)
+
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+		Consistently(reconnects).ShouldNot(Receive())
+	})
+
+	It("tells whether it connected", func() {
+		reconnector := websocketListener.(listener.Reconnector)
+		reconnector.SetDisconnectedAt(time.Now())
+
+		websocketListener.Start("ws://localhost:1234", "myApp", outputChan, stopChan)
+		Expect(reconnector.HasConnected()).To(BeFalse())
+		Expect(reconnects).NotTo(Receive())
+
+		websocketListener.Start(fmt.Sprintf("ws://%s", server.Listener.Addr()), "myApp", outputChan, stopChan)
+		Expect(reconnector.HasConnected()).To(BeTrue())
+	})
+})
+
+var _ = Describe("ReconnectGaps", func() {
+	It("reports the last gap of every app and doppler tagged with both", func() {
+		gaps := listener.NewReconnectGaps(time.Minute)
+		firstDoppler := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8081}
+		secondDoppler := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8081}
+		gaps.Record(100*time.Millisecond, "app1", firstDoppler)
+		gaps.Record(250*time.Millisecond, "app1", firstDoppler)
+		gaps.Record(50*time.Millisecond, "app2", secondDoppler)
+
+		context := gaps.Emit()
+		Expect(context.Name).To(Equal("reconnectGaps"))
+		Expect(context.Metrics).To(ConsistOf(
+			instrumentation.Metric{Name: "dopplerReconnectGap", Value: 250.0, Tags: map[string]interface{}{"appId": "app1", "doppler": "10.0.0.1:8081"}},
+			instrumentation.Metric{Name: "dopplerReconnectGap", Value: 50.0, Tags: map[string]interface{}{"appId": "app2", "doppler": "10.0.0.2:8081"}},
+		))
+	})
+
+	It("drops the gaps older than the retention", func() {
+		gaps := listener.NewReconnectGaps(50 * time.Millisecond)
+		gaps.Record(100*time.Millisecond, "app1", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8081})
+		Expect(gaps.Emit().Metrics).To(HaveLen(1))
+
+		Eventually(func() []instrumentation.Metric { return gaps.Emit().Metrics }).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("WebsocketListener close handshake", func() {
+	var (
+		ts         *httptest.Server
+		handler    *closeAckHandler
+		outputChan chan []byte
+		stopChan   chan struct{}
+	)
+
+	converter := func(d []byte) ([]byte, error) { return d, nil }
+
+	BeforeEach(func() {
+		handler = &closeAckHandler{closeCodes: make(chan int, 1), ackErrors: make(chan error, 1), release: make(chan struct{})}
+		ts = httptest.NewServer(handler)
+		outputChan = make(chan []byte, 10)
+		stopChan = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		close(handler.release)
+		ts.Close()
+	})
+
+	// stop starts a listener with the given close timeout, stops it once
+	// connected and returns how long Start took to return after the stop
+	// channel was closed.
+	stop := func(closeTimeout time.Duration) time.Duration {
+		l := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 0, loggertesthelper.Logger())
+		l.CloseTimeout = closeTimeout
+		connected := make(chan struct{})
+		l.OnConnect = func(time.Duration, net.Addr) { close(connected) }
+
+		doneWaiting := make(chan struct{})
+		go func() {
+			l.Start(fmt.Sprintf("ws://%s", ts.Listener.Addr()), "myApp", outputChan, stopChan)
+			close(doneWaiting)
+		}()
+		Eventually(connected).Should(BeClosed())
+
+		stoppedAt := time.Now()
+		close(stopChan)
+		Eventually(doneWaiting, 2).Should(BeClosed())
+		return time.Since(stoppedAt)
+	}
+
+	It("uses the default close timeout", func() {
+		l := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 0, loggertesthelper.Logger())
+		Expect(l.CloseTimeout).To(Equal(listener.DefaultCloseTimeout))
+	})
+
+	It("sends a normal close frame and waits for the acknowledgement", func() {
+		handler.ack = true
+		handler.ackDelay = 200 * time.Millisecond
+
+		elapsed := stop(time.Second)
+		Expect(elapsed).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(elapsed).To(BeNumerically("<", time.Second))
+		Eventually(handler.closeCodes).Should(Receive(Equal(websocket.CloseNormalClosure)))
+		Eventually(handler.ackErrors).Should(Receive(BeNil()))
+		Consistently(outputChan).Should(BeEmpty())
+	})
+
+	It("closes the connection once the close timeout has passed without an acknowledgement", func() {
+		elapsed := stop(300 * time.Millisecond)
+		Expect(elapsed).To(BeNumerically(">=", 300*time.Millisecond))
+		Expect(elapsed).To(BeNumerically("<", time.Second))
+		Eventually(handler.closeCodes).Should(Receive(Equal(websocket.CloseNormalClosure)))
+		Consistently(outputChan).Should(BeEmpty())
+	})
+
+	It("closes the connection right away with a zero close timeout", func() {
+		handler.ack = true
+		handler.ackDelay = 500 * time.Millisecond
+
+		Expect(stop(0)).To(BeNumerically("<", 500*time.Millisecond))
+		Eventually(handler.closeCodes).Should(Receive(Equal(websocket.CloseNormalClosure)))
+	})
+})
+
+var _ = Describe("WebsocketListener with a resolver", func() {
+	var (
+		firstServer, secondServer *httptest.Server
+		outputChan                chan []byte
+		stopChan                  chan struct{}
+		websocketListener         interface {
+			StartWithResolver(listener.Resolver, string, listener.OutputChannel, listener.StopChannel) error
+		}
+
+		resolvedLock sync.Mutex
+		resolvedFor  []string
+	)
+
+	// resolver returns urls one after the other, and the last one from then
+	// on.
+	resolver := func(urls ...string) listener.Resolver {
+		return func(appId string) (string, error) {
+			resolvedLock.Lock()
+			defer resolvedLock.Unlock()
+
+			resolvedFor = append(resolvedFor, appId)
+			if len(resolvedFor) <= len(urls) {
+				return urls[len(resolvedFor)-1], nil
+			}
+			return urls[len(urls)-1], nil
+		}
+	}
+
+	resolutions := func() []string {
+		resolvedLock.Lock()
+		defer resolvedLock.Unlock()
+		return append([]string(nil), resolvedFor...)
+	}
+
+	BeforeEach(func() {
+		firstServer = httptest.NewServer(greetingHandler("from the first doppler"))
+		secondServer = httptest.NewServer(greetingHandler("from the second doppler"))
+		outputChan = make(chan []byte, 10)
+		stopChan = make(chan struct{})
+
+		// the listener of the previous spec may still be resolving
+		resolvedLock.Lock()
+		resolvedFor = nil
+		resolvedLock.Unlock()
+
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		websocketListener = listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+	})
+
+	AfterEach(func() {
+		firstServer.Close()
+		secondServer.Close()
+	})
+
+	It("resolves the url again on every reconnect and uses the new one", func() {
+		resolve := resolver(fmt.Sprintf("ws://%s", firstServer.Listener.Addr()), fmt.Sprintf("ws://%s", secondServer.Listener.Addr()))
+		go websocketListener.StartWithResolver(resolve, "myApp", outputChan, stopChan)
+		defer close(stopChan)
+
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the first doppler"))))
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the second doppler"))))
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the second doppler"))))
+		Expect(resolutions()).To(HaveLen(3))
+		Expect(resolutions()).To(ConsistOf("myApp", "myApp", "myApp"))
+	})
+
+	It("reports how long it took to reconnect after the doppler closed the connection", func() {
+		reconnects := make(chan time.Duration, 10)
+		remotes := make(chan net.Addr, 10)
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		reconnectingListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		reconnectingListener.ReconnectDelay = 200 * time.Millisecond
+		reconnectingListener.OnReconnect = func(gap time.Duration, appId string, remote net.Addr) {
+			Expect(appId).To(Equal("myApp"))
+			reconnects <- gap
+			remotes <- remote
+		}
+
+		resolve := resolver(fmt.Sprintf("ws://%s", firstServer.Listener.Addr()), fmt.Sprintf("ws://%s", secondServer.Listener.Addr()))
+		go reconnectingListener.StartWithResolver(resolve, "myApp", outputChan, stopChan)
+		defer close(stopChan)
+
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the first doppler"))))
+		Consistently(reconnects, 100*time.Millisecond).ShouldNot(Receive())
+
+		var gap time.Duration
+		Eventually(reconnects).Should(Receive(&gap))
+		Expect(gap).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(gap).To(BeNumerically("<", time.Second))
+		Expect((<-remotes).String()).To(Equal(secondServer.Listener.Addr().String()))
+	})
+
+	It("writes a notice between the messages of the closed connection and those of the new one", func() {
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		noticingListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		noticingListener.ReconnectDelay = 10 * time.Millisecond
+		noticingListener.NoticeOnReconnect = true
+
+		burstServer := httptest.NewServer(burstHandler(20))
+		defer burstServer.Close()
+		burstOutputChan := make(chan []byte, 100)
+		go noticingListener.StartWithResolver(resolver(fmt.Sprintf("ws://%s", burstServer.Listener.Addr())), "myApp", burstOutputChan, stopChan)
+		defer close(stopChan)
+
+		for cycle := 0; cycle < 3; cycle++ {
+			if cycle > 0 {
+				var msgData []byte
+				Eventually(burstOutputChan).Should(Receive(&msgData))
+				msg, err := logmessage.ParseMessage(msgData)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(msg.GetLogMessage().GetMessage())).To(Equal("WebsocketListener.StartWithResolver: Reconnected to a doppler server"))
+			}
+			for i := 0; i < 20; i++ {
+				Eventually(burstOutputChan).Should(Receive(Equal([]byte(fmt.Sprintf("message %d", i)))))
+			}
+		}
+	})
+
+	Context("when handling a message panics", func() {
+		converter := func(d []byte) ([]byte, error) {
+			if string(d) == "from the first doppler" {
+				panic("cannot convert")
+			}
+			return d, nil
+		}
+
+		It("returns the panic error", func(done Done) {
+			panickingListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+			resolve := resolver(fmt.Sprintf("ws://%s", firstServer.Listener.Addr()), fmt.Sprintf("ws://%s", secondServer.Listener.Addr()))
+			err := panickingListener.StartWithResolver(resolve, "myApp", outputChan, stopChan)
+			Expect(err).To(Equal(listener.ErrListenerPanic))
+			Expect(resolutions()).To(HaveLen(1))
+			close(done)
+		})
+
+		It("reconnects when told to", func() {
+			panickingListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+			panickingListener.ReconnectAfterPanic = true
+			resolve := resolver(fmt.Sprintf("ws://%s", firstServer.Listener.Addr()), fmt.Sprintf("ws://%s", secondServer.Listener.Addr()))
+			go panickingListener.StartWithResolver(resolve, "myApp", outputChan, stopChan)
+			defer close(stopChan)
+
+			var notice []byte
+			Eventually(outputChan).Should(Receive(&notice))
+			Expect(string(notice)).To(ContainSubstring("Internal error handling a message"))
+			Eventually(outputChan).Should(Receive(Equal([]byte("from the second doppler"))))
+			Expect(panickingListener.Panics()).To(BeEquivalentTo(1))
+		})
+	})
+
+	It("returns the error resolving the url", func(done Done) {
+		resolveErr := errors.New("no doppler serves myApp")
+		resolve := func(appId string) (string, error) { return "", resolveErr }
+
+		err := websocketListener.StartWithResolver(resolve, "myApp", outputChan, stopChan)
+		Expect(err).To(Equal(resolveErr))
+		close(done)
+	})
+
+	It("returns the error connecting to the resolved url", func(done Done) {
+		err := websocketListener.StartWithResolver(resolver("ws://localhost:1234"), "myApp", outputChan, stopChan)
+		Expect(err).To(HaveOccurred())
+		close(done)
+	})
+
+	It("returns once stopped without resolving the url again", func(done Done) {
+		handler := &closeAckHandler{closeCodes: make(chan int, 1), ackErrors: make(chan error, 1), release: make(chan struct{})}
+		blockingServer := httptest.NewServer(handler)
+		defer blockingServer.Close()
+		defer close(handler.release)
+
+		doneWaiting := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			err := websocketListener.StartWithResolver(resolver(fmt.Sprintf("ws://%s", blockingServer.Listener.Addr())), "myApp", outputChan, stopChan)
+			Expect(err).NotTo(HaveOccurred())
+			close(doneWaiting)
+		}()
+
+		Eventually(resolutions).Should(HaveLen(1))
+		close(stopChan)
+		Eventually(doneWaiting, 2).Should(BeClosed())
+		Expect(resolutions()).To(HaveLen(1))
+		close(done)
+	}, 5)
+})
+
+var _ = Describe("WebsocketListener with a connect budget", func() {
+	var (
+		outputChan chan []byte
+		stopChan   chan struct{}
+	)
+
+	BeforeEach(func() {
+		outputChan = make(chan []byte, 100)
+		stopChan = make(chan struct{})
+	})
+
+	start := func(budget listener.ConnectBudget, endpoints ...string) error {
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		budgetedListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		budgetedListener.ReconnectDelay = 10 * time.Millisecond
+		budgetedListener.ConnectBudget = budget
+		return budgetedListener.StartFirstAvailable(endpoints, "myApp", outputChan, stopChan)
+	}
+
+	It("stops after the attempts of the budget and lists the failure of every endpoint", func(done Done) {
+		err := start(listener.ConnectBudget{MaxAttempts: 5}, "ws://localhost:1234", "ws://localhost:1235")
+
+		budgetErr, ok := err.(*listener.ConnectBudgetError)
+		Expect(ok).To(BeTrue())
+		Expect(budgetErr.Attempts).To(Equal(5))
+		Expect(budgetErr.Failures).To(HaveLen(2))
+		Expect(budgetErr.Failures[0].Url).To(Equal("ws://localhost:1234"))
+		Expect(budgetErr.Failures[0].Attempts).To(Equal(3))
+		Expect(budgetErr.Failures[1].Url).To(Equal("ws://localhost:1235"))
+		Expect(budgetErr.Failures[1].Attempts).To(Equal(2))
+
+		Expect(err.Error()).To(ContainSubstring("after 5 attempts"))
+		Expect(err.Error()).To(ContainSubstring("ws://localhost:1234 (3 attempts): "))
+		Expect(err.Error()).To(ContainSubstring("ws://localhost:1235 (2 attempts): "))
+		Expect(err.Error()).To(ContainSubstring("connection refused"))
+		close(done)
+	}, 2)
+
+	It("stops once the time of the budget is up", func(done Done) {
+		started := time.Now()
+		err := start(listener.ConnectBudget{MaxDuration: 200 * time.Millisecond}, "ws://localhost:1234", "localhost:1235")
+
+		Expect(time.Since(started)).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+		budgetErr, ok := err.(*listener.ConnectBudgetError)
+		Expect(ok).To(BeTrue())
+		Expect(budgetErr.Attempts).To(BeNumerically(">", 3))
+		Expect(budgetErr.Failures).To(HaveLen(3))
+		Expect(budgetErr.Failures[1].Url).To(Equal("wss://localhost:1235"))
+		Expect(budgetErr.Failures[2].Url).To(Equal("ws://localhost:1235"))
+		close(done)
+	}, 2)
+
+	It("tells the client once no doppler server can be reached", func(done Done) {
+		start(listener.ConnectBudget{MaxAttempts: 2}, "ws://localhost:1234")
+
+		var notices []string
+		for len(outputChan) > 0 {
+			msg, _ := logmessage.ParseMessage(<-outputChan)
+			notices = append(notices, string(msg.GetLogMessage().GetMessage()))
+		}
+		Expect(notices).To(HaveLen(3))
+		Expect(notices[2]).To(Equal("WebsocketListener.StartFirstAvailable: Unable to reach any doppler server"))
+		close(done)
+	}, 2)
+
+	It("gives back the whole budget on every connection and tries again once it is closed", func() {
+		server := httptest.NewServer(greetingHandler("from the doppler"))
+		defer server.Close()
+
+		go start(listener.ConnectBudget{MaxAttempts: 2}, "ws://localhost:1234", fmt.Sprintf("ws://%s", server.Listener.Addr()))
+		defer close(stopChan)
+
+		for i := 0; i < 3; i++ {
+			Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+		}
+	})
+})
+
+var _ = Describe("WebsocketListener connection state", func() {
+	var (
+		outputChan        chan []byte
+		stopChan          chan struct{}
+		websocketListener interface {
+			listener.Listener
+			StartWithResolver(listener.Resolver, string, listener.OutputChannel, listener.StopChannel) error
+			State() listener.ConnectionState
+		}
+
+		changesLock sync.Mutex
+		changes     []listener.ConnectionState
+	)
+
+	stateChanges := func() []listener.ConnectionState {
+		changesLock.Lock()
+		defer changesLock.Unlock()
+		return append([]listener.ConnectionState(nil), changes...)
+	}
+
+	BeforeEach(func() {
+		outputChan = make(chan []byte, 100)
+		stopChan = make(chan struct{})
+		changes = nil
+
+		converter := func(d []byte) ([]byte, error) { return d, nil }
+		wl := listener.NewWebsocket(marshaller.LoggregatorLogMessage, converter, 500*time.Millisecond, loggertesthelper.Logger())
+		wl.ReconnectDelay = 50 * time.Millisecond
+		wl.OnStateChange = func(state listener.ConnectionState) {
+			changesLock.Lock()
+			defer changesLock.Unlock()
+			changes = append(changes, state)
+		}
+		websocketListener = wl
+	})
+
+	It("is disconnected before it is started", func() {
+		Expect(websocketListener.State()).To(Equal(listener.Disconnected))
+		Expect(stateChanges()).To(BeEmpty())
+	})
+
+	It("names the states, and numbers the ones it does not know", func() {
+		Expect(listener.Connecting.String()).To(Equal("connecting"))
+		Expect(listener.ConnectionState(7).String()).To(Equal("ConnectionState(7)"))
+		Expect(listener.ConnectionState(-1).String()).To(Equal("ConnectionState(-1)"))
+	})
+
+	It("is connected while listening and disconnected once the doppler closes the connection", func() {
+		fh := &fakeHandler{messages: make(chan []byte)}
+		server := httptest.NewServer(fh)
+		defer server.Close()
+
+		listenDone := make(chan struct{})
+		go func() {
+			websocketListener.Start(fmt.Sprintf("ws://%s", server.Listener.Addr()), "myApp", outputChan, stopChan)
+			close(listenDone)
+		}()
+		defer close(stopChan)
+
+		fh.messages <- []byte("hello")
+		Eventually(outputChan).Should(Receive())
+		Expect(websocketListener.State()).To(Equal(listener.Connected))
+
+		fh.Close()
+		Eventually(listenDone).Should(BeClosed())
+		Expect(websocketListener.State()).To(Equal(listener.Disconnected))
+		Expect(stateChanges()).To(Equal([]listener.ConnectionState{listener.Connecting, listener.Connected, listener.Disconnected}))
+	})
+
+	It("is disconnected once it is stopped", func() {
+		fh := &fakeHandler{messages: make(chan []byte)}
+		server := httptest.NewServer(fh)
+		defer server.Close()
+
+		listenDone := make(chan struct{})
+		go func() {
+			websocketListener.Start(fmt.Sprintf("ws://%s", server.Listener.Addr()), "myApp", outputChan, stopChan)
+			close(listenDone)
+		}()
+
+		Eventually(websocketListener.State).Should(Equal(listener.Connected))
+		close(stopChan)
+		Eventually(listenDone).Should(BeClosed())
+		Expect(websocketListener.State()).To(Equal(listener.Disconnected))
+	})
+
+	It("is disconnected when the doppler cannot be reached", func() {
+		websocketListener.Start("ws://localhost:1234", "myApp", outputChan, stopChan)
+		Expect(websocketListener.State()).To(Equal(listener.Disconnected))
+		Expect(stateChanges()).To(Equal([]listener.ConnectionState{listener.Connecting, listener.Disconnected}))
+	})
+
+	It("follows the connection across reconnects while being read concurrently", func() {
+		server := httptest.NewServer(greetingHandler("from the doppler"))
+		defer server.Close()
+
+		resolve := func(appId string) (string, error) { return fmt.Sprintf("ws://%s", server.Listener.Addr()), nil }
+		go websocketListener.StartWithResolver(resolve, "myApp", outputChan, stopChan)
+		defer close(stopChan)
+
+		go func() {
+			for {
+				select {
+				case <-stopChan:
+					return
+				default:
+					websocketListener.State()
+				}
+			}
+		}()
+
+		Eventually(outputChan).Should(Receive(Equal([]byte("from the doppler"))))
+		Eventually(func() int { return len(stateChanges()) }).Should(BeNumerically(">=", 6))
+		Expect(stateChanges()[:6]).To(Equal([]listener.ConnectionState{
+			listener.Connecting, listener.Connected, listener.Disconnected,
+			listener.Connecting, listener.Connected, listener.Disconnected,
+		}))
+	})
+})
+
+// greetingHandler sends its greeting on every connection and closes it.
+type greetingHandler string
+
+func (h greetingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	ws.WriteMessage(websocket.BinaryMessage, []byte(h))
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+}
+
+// burstHandler sends its number of messages on every connection as fast as
+// it can and closes the connection right after the last one.
+type burstHandler int
+
+func (h burstHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	for i := 0; i < int(h); i++ {
+		ws.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("message %d", i)))
+	}
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+}
+
+// pingHandler sends a ping with its payload on every connection and records
+// the payloads of the pongs it receives.
+type pingHandler struct {
+	payload string
+	pongs   chan string
+}
+
+func (h *pingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	ws.SetPongHandler(func(payload string) error {
+		h.pongs <- payload
+		return nil
+	})
+	ws.WriteControl(websocket.PingMessage, []byte(h.payload), time.Now().Add(time.Second))
+
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// closeAckHandler records the close frames it receives and, if ack is set,
+// acknowledges them after ackDelay. It keeps the connection open until
+// release is closed.
+type closeAckHandler struct {
+	ack        bool
+	ackDelay   time.Duration
+	closeCodes chan int
+	ackErrors  chan error
+	release    chan struct{}
+}
+
+func (h *closeAckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	ws.SetCloseHandler(func(code int, text string) error {
+		h.closeCodes <- code
+		if h.ack {
+			time.Sleep(h.ackDelay)
+			h.ackErrors <- ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+		}
+		return nil
+	})
+
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			<-h.release
+			return
+		}
+	}
+}
+
 type fakeHandler struct {
 	messages   chan []byte
 	lastWSConn *websocket.Conn
+	compress   bool
 	sync.Mutex
 }
 
@@ -238,7 +1486,18 @@ func (f *fakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ws, err := websocket.Upgrade(w, r, nil, 0, 0)
+	f.Lock()
+	compress := f.compress
+	f.Unlock()
+
+	var ws *websocket.Conn
+	var err error
+	if compress {
+		upgrader := websocket.Upgrader{EnableCompression: true}
+		ws, err = upgrader.Upgrade(w, r, nil)
+	} else {
+		ws, err = websocket.Upgrade(w, r, nil, 0, 0)
+	}
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, "Not a websocket handshake", 400)
 		return
@@ -283,3 +1542,18 @@ func (f *fakeHandler) lastConn() *websocket.Conn {
 	defer f.Unlock()
 	return f.lastWSConn
 }
+
+func marshalledLogMessage(timestamp time.Time) []byte {
+	message, err := proto.Marshal(&events.Envelope{
+		Origin:    proto.String("fake-origin"),
+		EventType: events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{
+			Message:     []byte("hello world"),
+			MessageType: events.LogMessage_OUT.Enum(),
+			Timestamp:   proto.Int64(timestamp.UnixNano()),
+			AppId:       proto.String("myApp"),
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return message
+}
@@ -9,10 +9,12 @@ import (
 	"os/signal"
 	"runtime/pprof"
 	"strconv"
+	"sync"
 	"time"
 	"trafficcontroller/authorization"
 
 	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/gunk/workpool"
 	"github.com/cloudfoundry/loggregatorlib/cfcomponent"
@@ -39,6 +41,10 @@ var DefaultStoreAdapterProvider = func(urls []string, concurrentRequests int) st
 
 var EtcdQueryInterval = 5 * time.Second
 
+// reconnectGapRetention is how long the last reconnect gap of an app to a
+// doppler is reported on varz.
+const reconnectGapRetention = 10 * time.Minute
+
 type Config struct {
 	EtcdUrls                  []string
 	EtcdMaxConcurrentRequests int
@@ -59,6 +65,16 @@ type Config struct {
 	UaaHost               string
 	UaaClientId           string
 	UaaClientSecret       string
+
+	MaxDopplerConnectionAgeSeconds int
+	ShutdownGracePeriodSeconds     int
+	LogDopplerDialAttempts         bool
+	NoticeDopplerReconnects        bool
+
+	// DeliveryLatencyReportIntervalSeconds, if non-zero, makes the traffic
+	// controller report the mean and maximum delivery latency of the log
+	// messages it read from dopplers once per interval.
+	DeliveryLatencyReportIntervalSeconds int
 }
 
 func (c *Config) setDefaults() {
@@ -131,12 +147,16 @@ func main() {
 	adapter := DefaultStoreAdapterProvider(config.EtcdUrls, config.EtcdMaxConcurrentRequests)
 	adapter.Connect()
 
-	dopplerProxy := makeDopplerProxy(adapter, config, logger)
+	latencies := newDeliveryLatencies(config)
+	reconnectGaps := listener.NewReconnectGaps(reconnectGapRetention)
+
+	dopplerProxy := makeDopplerProxy(adapter, config, latencies, reconnectGaps, logger)
 	startOutgoingDopplerProxy(net.JoinHostPort(dopplerProxy.IpAddress, strconv.FormatUint(uint64(config.OutgoingDropsondePort), 10)), dopplerProxy)
 
-	legacyProxy := makeLegacyProxy(adapter, config, logger)
+	legacyProxy := makeLegacyProxy(adapter, config, latencies, reconnectGaps, logger)
 	startOutgoingProxy(net.JoinHostPort(legacyProxy.IpAddress, strconv.FormatUint(uint64(config.OutgoingPort), 10)), legacyProxy)
 
+	legacyProxy.Instrumentables = append(legacyProxy.Instrumentables, reconnectGaps)
 	setupMonitoring(legacyProxy, config, logger)
 
 	rr := routerregistrar.NewRouterRegistrar(config.MbusClient, logger)
@@ -161,11 +181,24 @@ func main() {
 			cfcomponent.DumpGoRoutine()
 		case <-killChan:
 			rr.UnregisterFromRouter(legacyProxy.IpAddress, config.OutgoingPort, []string{uri})
-			break
+			shutdownProxies(time.Duration(config.ShutdownGracePeriodSeconds)*time.Second, dopplerProxy, legacyProxy)
+			return
 		}
 	}
 }
 
+func shutdownProxies(gracePeriod time.Duration, proxies ...*dopplerproxy.Proxy) {
+	var wg sync.WaitGroup
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy *dopplerproxy.Proxy) {
+			defer wg.Done()
+			proxy.Shutdown(gracePeriod)
+		}(proxy)
+	}
+	wg.Wait()
+}
+
 func ParseConfig(logLevel *bool, configFile, logFilePath *string) (*Config, *gosteno.Logger, error) {
 	config := &Config{OutgoingPort: 8080}
 	err := cfcomponent.ReadConfigInto(config, *configFile)
@@ -219,12 +252,12 @@ func setupMonitoring(proxy *dopplerproxy.Proxy, config *Config, logger *gosteno.
 	}()
 }
 
-func makeDopplerProxy(adapter storeadapter.StoreAdapter, config *Config, logger *gosteno.Logger) *dopplerproxy.Proxy {
-	return makeProxy(adapter, config, logger, marshaller.DropsondeLogMessage, dopplerproxy.TranslateFromDropsondePath, newDropsondeWebsocketListener, "doppler."+config.SystemDomain)
+func makeDopplerProxy(adapter storeadapter.StoreAdapter, config *Config, latencies *listener.DeliveryLatencies, reconnectGaps *listener.ReconnectGaps, logger *gosteno.Logger) *dopplerproxy.Proxy {
+	return makeProxy(adapter, config, logger, marshaller.DropsondeLogMessage, dopplerproxy.TranslateFromDropsondePath, newDropsondeWebsocketListener(config, latencies, reconnectGaps), "doppler."+config.SystemDomain)
 }
 
-func makeLegacyProxy(adapter storeadapter.StoreAdapter, config *Config, logger *gosteno.Logger) *dopplerproxy.Proxy {
-	return makeProxy(adapter, config, logger, marshaller.LoggregatorLogMessage, dopplerproxy.TranslateFromLegacyPath, newLegacyWebsocketListener, "loggregator."+config.SystemDomain)
+func makeLegacyProxy(adapter storeadapter.StoreAdapter, config *Config, latencies *listener.DeliveryLatencies, reconnectGaps *listener.ReconnectGaps, logger *gosteno.Logger) *dopplerproxy.Proxy {
+	return makeProxy(adapter, config, logger, marshaller.LoggregatorLogMessage, dopplerproxy.TranslateFromLegacyPath, newLegacyWebsocketListener(config, latencies, reconnectGaps), "loggregator."+config.SystemDomain)
 }
 
 func makeProxy(adapter storeadapter.StoreAdapter, config *Config, logger *gosteno.Logger, messageGenerator marshaller.MessageGenerator, translator dopplerproxy.RequestTranslator, listenerConstructor channel_group_connector.ListenerConstructor, cookieDomain string) *dopplerproxy.Proxy {
@@ -234,9 +267,9 @@ func makeProxy(adapter storeadapter.StoreAdapter, config *Config, logger *gosten
 	adminAuthorizer := authorization.NewAdminAccessAuthorizer(*disableAccessControl, &uaaClient)
 
 	provider := MakeProvider(adapter, "/healthstatus/doppler", config.DopplerPort, logger)
-	cgc := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, messageGenerator, logger)
+	cgc := channel_group_connector.NewChannelGroupConnector(provider, listenerConstructor, messageGenerator, time.Duration(config.MaxDopplerConnectionAgeSeconds)*time.Second, logger)
 
-	return dopplerproxy.NewDopplerProxy(logAuthorizer, adminAuthorizer, cgc, config.Config, translator, cookieDomain, logger)
+	return dopplerproxy.NewDopplerProxy(logAuthorizer, adminAuthorizer, cgc, config.Config, translator, cookieDomain, messageGenerator, logger)
 }
 
 func startOutgoingDopplerProxy(host string, proxy http.Handler) {
@@ -248,13 +281,92 @@ func startOutgoingDopplerProxy(host string, proxy http.Handler) {
 	}()
 }
 
-func newDropsondeWebsocketListener(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
-	messageConverter := func(message []byte) ([]byte, error) {
-		return message, nil
+func newDropsondeWebsocketListener(config *Config, latencies *listener.DeliveryLatencies, reconnectGaps *listener.ReconnectGaps) channel_group_connector.ListenerConstructor {
+	return func(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
+		messageConverter := func(message []byte) ([]byte, error) {
+			return message, nil
+		}
+		websocketListener := listener.NewWebsocket(marshaller.DropsondeLogMessage, messageConverter, timeout, logger)
+		websocketListener.OnConnect = reportDialDuration(logger)
+		websocketListener.OnReconnect = reportReconnectGap(reconnectGaps, logger)
+		websocketListener.OnPanic = reportListenerPanic
+		websocketListener.OnCompressionSample = reportCompression
+		if latencies != nil {
+			websocketListener.OnDeliveryLatency = latencies.Record
+		}
+		websocketListener.LogDialAttempts = config.LogDopplerDialAttempts
+		websocketListener.NoticeOnReconnect = config.NoticeDopplerReconnects
+		return websocketListener
+	}
+}
+
+func newLegacyWebsocketListener(config *Config, latencies *listener.DeliveryLatencies, reconnectGaps *listener.ReconnectGaps) channel_group_connector.ListenerConstructor {
+	return func(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
+		websocketListener := listener.NewWebsocket(marshaller.LoggregatorLogMessage, marshaller.TranslateDropsondeToLegacyLogMessage, timeout, logger)
+		websocketListener.OnConnect = reportDialDuration(logger)
+		websocketListener.OnReconnect = reportReconnectGap(reconnectGaps, logger)
+		websocketListener.OnPanic = reportListenerPanic
+		websocketListener.OnCompressionSample = reportCompression
+		if latencies != nil {
+			websocketListener.OnDeliveryLatency = latencies.Record
+		}
+		websocketListener.LogDialAttempts = config.LogDopplerDialAttempts
+		websocketListener.NoticeOnReconnect = config.NoticeDopplerReconnects
+		return websocketListener
+	}
+}
+
+func reportDialDuration(logger *gosteno.Logger) func(time.Duration, net.Addr) {
+	return func(dialDuration time.Duration, remote net.Addr) {
+		logger.Debugf("Connected to doppler %s in %s", remote, dialDuration)
+		metrics.SendValue("dopplerDialDuration", float64(dialDuration)/float64(time.Millisecond), "ms")
 	}
-	return listener.NewWebsocket(marshaller.DropsondeLogMessage, messageConverter, timeout, logger)
 }
 
-func newLegacyWebsocketListener(timeout time.Duration, logger *gosteno.Logger) listener.Listener {
-	return listener.NewWebsocket(marshaller.LoggregatorLogMessage, marshaller.TranslateDropsondeToLegacyLogMessage, timeout, logger)
+// reportReconnectGap sends every reconnect gap as a value metric and keeps it
+// in reconnectGaps, which reports it on varz tagged with the app and doppler.
+func reportReconnectGap(reconnectGaps *listener.ReconnectGaps, logger *gosteno.Logger) func(time.Duration, string, net.Addr) {
+	return func(gap time.Duration, appId string, remote net.Addr) {
+		logger.Infof("Reconnected app %s to doppler %s after %s", appId, remote, gap)
+		metrics.SendValue("dopplerReconnectGap", float64(gap)/float64(time.Millisecond), "ms")
+		reconnectGaps.Record(gap, appId, remote)
+	}
+}
+
+func reportListenerPanic(recovered interface{}, appId string) {
+	metrics.IncrementCounter("listenerPanics")
+}
+
+// newDeliveryLatencies returns nil unless delivery latencies are to be
+// reported, so that the listeners do not unmarshal every message for them.
+func newDeliveryLatencies(config *Config) *listener.DeliveryLatencies {
+	if config.DeliveryLatencyReportIntervalSeconds <= 0 {
+		return nil
+	}
+
+	latencies := &listener.DeliveryLatencies{}
+	go reportDeliveryLatencies(latencies, time.Duration(config.DeliveryLatencyReportIntervalSeconds)*time.Second)
+	return latencies
+}
+
+func reportDeliveryLatencies(latencies *listener.DeliveryLatencies, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		count, mean, max := latencies.Flush()
+		if count == 0 {
+			continue
+		}
+		metrics.SendValue("logDeliveryLatency.mean", float64(mean)/float64(time.Millisecond), "ms")
+		metrics.SendValue("logDeliveryLatency.max", float64(max)/float64(time.Millisecond), "ms")
+	}
+}
+
+func reportCompression(wireBytes, messageBytes uint64, remote net.Addr) {
+	metrics.AddToCounter("dopplerCompressedBytesRead", wireBytes)
+	metrics.AddToCounter("dopplerUncompressedBytesRead", messageBytes)
+	if wireBytes > 0 {
+		metrics.SendValue("dopplerCompressionRatio", float64(messageBytes)/float64(wireBytes), "ratio")
+	}
 }